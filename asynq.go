@@ -7,6 +7,7 @@ package asynq
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net/url"
 	"strconv"
@@ -77,15 +78,44 @@ type TaskInfo struct {
 	// State indicates the task state.
 	State TaskState
 
-	// MaxRetry is the maximum number of times the task can be retried.
+	// MaxRetry is the maximum number of times the task can be retried, as set by
+	// the MaxRetry option or the default of the client.
+	//
+	// If DefaultMaxRetry is true, servers with a RetryPolicy for the queue of the task
+	// (see Config.QueueRetryPolicies) retry the task up to RetryPolicy.MaxRetry times instead.
 	MaxRetry int
 
+	// DefaultMaxRetry reports whether the task was enqueued without the MaxRetry
+	// option, i.e. MaxRetry is the default max retry of the client.
+	DefaultMaxRetry bool
+
 	// Retried is the number of times the task has retried so far.
 	Retried int
 
 	// LastErr is the error message from the last failure.
 	LastErr string
 
+	// ErrorHistory is the list of error messages from the most recent failures
+	// (up to 25), oldest first. Its last element is the same as LastErr.
+	ErrorHistory []string
+
+	// ArchiveReason is the reason the task was last archived, one of the ArchiveReason* constants.
+	// Empty if the task has never been archived.
+	ArchiveReason string
+
+	// PayloadSize is the size in bytes of the original payload if the payload was
+	// truncated when the task was archived (see Config.MaxArchivedPayloadSize), and
+	// PayloadDigest is the hex-encoded SHA-256 digest of the original payload.
+	// PayloadSize is zero if the payload is intact. A task with a truncated payload
+	// cannot be run or cloned.
+	PayloadSize   int
+	PayloadDigest string
+
+	// PayloadRef is the key of the payload in the PayloadStore, if the payload was
+	// stored externally when the task was enqueued (see ClientConfig.PayloadStore).
+	// Payload is empty if PayloadRef is set.
+	PayloadRef string
+
 	// LastFailedAt is the time time of the last failure if any.
 	// If the task has no failures, LastFailedAt is zero time (i.e. time.Time{}).
 	LastFailedAt time.Time
@@ -108,11 +138,71 @@ type TaskInfo struct {
 	// Zero value (i.e. time.Time{}) indicates no value.
 	CompletedAt time.Time
 
+	// EnqueuedAt is the time when the task was enqueued by the client.
+	// Zero value (i.e. time.Time{}) indicates no value.
+	EnqueuedAt time.Time
+
 	// Result holds the result data associated with the task.
 	// Use ResultWriter to write result data from the Handler.
 	Result []byte
+
+	// Progress holds the progress reported by the Handler with ReportProgress
+	// while processing the task, nil if no progress is reported.
+	// It is filled in by Inspector.GetTaskInfo and Inspector.ListActiveTasks.
+	Progress []byte
+
+	// IdempotencyKey is the idempotency key attached to the task, empty if not specified.
+	IdempotencyKey string
+
+	// GroupKey is the key of the group the task belongs to, empty if not specified.
+	GroupKey string
+
+	// Class is the class of the task, empty if not specified.
+	Class string
+
+	// ClonedFrom is the ID of the archived task this task was cloned from
+	// with Inspector.CloneTask, empty if the task is not a clone.
+	ClonedFrom string
+
+	// Dependencies is the list of IDs of the tasks which need to complete before the task is processed.
+	Dependencies []string
+
+	// Headers holds the headers attached to the task, nil if not specified.
+	Headers map[string]string
+
+	// Labels holds the labels a server must have to process the task, nil if not specified.
+	Labels map[string]string
+
+	// ExpiresAt is the time the task is discarded if it hasn't started processing,
+	// zero if the task was enqueued without TTL option.
+	ExpiresAt time.Time
 }
 
+// Reasons a task is archived, reported in TaskInfo.ArchiveReason.
+const (
+	// The task failed and had no retries left.
+	ArchiveReasonMaxRetry = base.ArchiveReasonMaxRetry
+
+	// The Handler returned SkipRetry.
+	ArchiveReasonSkipRetry = base.ArchiveReasonSkipRetry
+
+	// The lease of the task expired with no retries left (see ErrLeaseExpired).
+	ArchiveReasonDeadlineExceeded = base.ArchiveReasonDeadlineExceeded
+
+	// The task was archived with the Inspector.
+	ArchiveReasonOperator = base.ArchiveReasonOperator
+
+	// No handler was registered for the task type (see ArchiveUnhandled).
+	ArchiveReasonNoHandler = base.ArchiveReasonNoHandler
+
+	// The task was scheduled to be processed long before it was archived, e.g. after
+	// it got stuck in the scheduled or retry state (see Config.StaleTaskAge).
+	ArchiveReasonStale = base.ArchiveReasonStale
+
+	// A task the task depends on was archived (see DependsOn).
+	ArchiveReasonDependencyArchived = base.ArchiveReasonDependencyArchived
+)
+
 // If t is non-zero, returns time converted from t as unix time in seconds.
 // If t is zero, returns zero value of time.Time.
 func fromUnixTimeOrZero(t int64) time.Time {
@@ -131,6 +221,11 @@ func newTaskInfo(msg *base.TaskMessage, state base.TaskState, nextProcessAt time
 		MaxRetry:      msg.Retry,
 		Retried:       msg.Retried,
 		LastErr:       msg.ErrorMsg,
+		ErrorHistory:  msg.ErrorHistory,
+		ArchiveReason: msg.ArchiveReason,
+		PayloadSize:   int(msg.PayloadSize),
+		PayloadDigest: msg.PayloadDigest,
+		PayloadRef:    msg.PayloadRef,
 		Timeout:       time.Duration(msg.Timeout) * time.Second,
 		Deadline:      fromUnixTimeOrZero(msg.Deadline),
 		Retention:     time.Duration(msg.Retention) * time.Second,
@@ -138,6 +233,20 @@ func newTaskInfo(msg *base.TaskMessage, state base.TaskState, nextProcessAt time
 		LastFailedAt:  fromUnixTimeOrZero(msg.LastFailedAt),
 		CompletedAt:   fromUnixTimeOrZero(msg.CompletedAt),
 		Result:        result,
+
+		IdempotencyKey: msg.IdempotencyKey,
+		GroupKey:       msg.GroupKey,
+		Class:          msg.Class,
+		ClonedFrom:     msg.ClonedFrom,
+		Dependencies:   msg.Dependencies,
+		Headers:        msg.Headers,
+		Labels:         msg.Labels,
+		ExpiresAt:      fromUnixTimeOrZero(msg.ExpiresAt),
+
+		DefaultMaxRetry: msg.DefaultRetry,
+	}
+	if msg.EnqueuedAt > 0 {
+		info.EnqueuedAt = time.Unix(0, msg.EnqueuedAt)
 	}
 
 	switch state {
@@ -153,12 +262,48 @@ func newTaskInfo(msg *base.TaskMessage, state base.TaskState, nextProcessAt time
 		info.State = TaskStateArchived
 	case base.TaskStateCompleted:
 		info.State = TaskStateCompleted
+	case base.TaskStateWaiting:
+		info.State = TaskStateWaiting
+	case base.TaskStateUnhandled:
+		info.State = TaskStateUnhandled
 	default:
 		panic(fmt.Sprintf("internal error: unknown state: %d", state))
 	}
 	return &info
 }
 
+// RetrySchedule returns a preview of the times at which the remaining attempts to
+// process the task would happen with the given retry delay function, assuming each
+// attempt fails immediately with the last error of the task. The first element is
+// NextProcessAt and the last element is the time of the last attempt before the
+// task is archived.
+//
+// Use the RetryDelayFunc of the Config of the servers processing the task;
+// if fn is nil, DefaultRetryDelayFunc is used. The schedule assumes MaxRetry attempts;
+// it doesn't account for a RetryPolicy of the queue of the task (see DefaultMaxRetry). Note that the preview of a randomized
+// retry delay function (e.g. DefaultRetryDelayFunc) is only an estimate.
+//
+// RetrySchedule returns nil if the task is not pending, scheduled or waiting to be retried.
+func (info *TaskInfo) RetrySchedule(fn RetryDelayFunc) []time.Time {
+	switch info.State {
+	case TaskStatePending, TaskStateScheduled, TaskStateRetry:
+	default:
+		return nil
+	}
+	if fn == nil {
+		fn = DefaultRetryDelayFunc
+	}
+	err := errors.New(info.LastErr)
+	task := NewTask(info.Type, info.Payload)
+	t := info.NextProcessAt
+	schedule := []time.Time{t}
+	for n := info.Retried; n < info.MaxRetry; n++ {
+		t = t.Add(fn(n, err, task))
+		schedule = append(schedule, t)
+	}
+	return schedule
+}
+
 // TaskState denotes the state of a task.
 type TaskState int
 
@@ -180,6 +325,12 @@ const (
 
 	// Indicates that the task is processed successfully and retained until the retention TTL expires.
 	TaskStateCompleted
+
+	// Indicates that the task is waiting for the tasks it depends on to complete.
+	TaskStateWaiting
+
+	// Indicates that the task was parked because no handler is registered for its type.
+	TaskStateUnhandled
 )
 
 func (s TaskState) String() string {
@@ -196,6 +347,10 @@ func (s TaskState) String() string {
 		return "archived"
 	case TaskStateCompleted:
 		return "completed"
+	case TaskStateWaiting:
+		return "waiting"
+	case TaskStateUnhandled:
+		return "unhandled"
 	}
 	panic("asynq: unknown task state")
 }
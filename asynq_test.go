@@ -9,6 +9,7 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/google/go-cmp/cmp"
@@ -192,3 +193,48 @@ func TestParseRedisURIErrors(t *testing.T) {
 		}
 	}
 }
+
+func TestTaskInfoRetrySchedule(t *testing.T) {
+	now := time.Now()
+	linear := func(n int, e error, task *Task) time.Duration {
+		return time.Duration(n+1) * time.Minute
+	}
+	tests := []struct {
+		desc string
+		info *TaskInfo
+		want []time.Time
+	}{
+		{
+			desc: "retry task",
+			info: &TaskInfo{State: TaskStateRetry, Retried: 1, MaxRetry: 3, NextProcessAt: now},
+			want: []time.Time{now, now.Add(2 * time.Minute), now.Add(5 * time.Minute)},
+		},
+		{
+			desc: "pending task",
+			info: &TaskInfo{State: TaskStatePending, MaxRetry: 2, NextProcessAt: now},
+			want: []time.Time{now, now.Add(time.Minute), now.Add(3 * time.Minute)},
+		},
+		{
+			desc: "last attempt",
+			info: &TaskInfo{State: TaskStateRetry, Retried: 3, MaxRetry: 3, NextProcessAt: now},
+			want: []time.Time{now},
+		},
+		{
+			desc: "archived task",
+			info: &TaskInfo{State: TaskStateArchived, Retried: 3, MaxRetry: 3},
+			want: nil,
+		},
+	}
+	for _, tc := range tests {
+		got := tc.info.RetrySchedule(linear)
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("%s: RetrySchedule returned mismatch (-want,+got):\n%s", tc.desc, diff)
+		}
+	}
+
+	// DefaultRetryDelayFunc is used if fn is nil.
+	info := &TaskInfo{State: TaskStateRetry, Retried: 0, MaxRetry: 1, NextProcessAt: now}
+	if got := info.RetrySchedule(nil); len(got) != 2 || got[1].Sub(got[0]) < 15*time.Second {
+		t.Errorf("RetrySchedule(nil) = %v, want two attempts at least 15s apart", got)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/rdb"
+)
+
+// AuditEvent is an entry of the audit log of a queue.
+//
+// See Config.AuditLog for how to enable audit logs.
+type AuditEvent struct {
+	// ID identifies the event in the audit log of the queue.
+	ID string
+
+	// Queue is the name of the queue the event belongs to.
+	Queue string
+
+	// Event is one of:
+	//
+	//	"enqueued"   the task was enqueued to be processed immediately
+	//	"scheduled"  the task was enqueued to be processed in the future
+	//	"started"    a server started processing the task
+	//	"retried"    the task failed and will be retried
+	//	"archived"   the task failed and was archived, or was archived by an operator
+	//	"parked"     no handler was registered for the task type, see Config.UnhandledTaskPolicy
+	//	"quarantined" the signature of the task was missing or invalid, see Config.SigningKey
+	//	"run"        the task was run by an operator
+	//	"deleted"    the task was deleted by an operator
+	//	"imported"   the task was imported to the archive by an operator
+	//	"delayed"    the task was postponed by an operator, see Inspector.DelayQueue
+	//	"requeued"   the task of a dead server was requeued by an operator, see Inspector.RequeueOrphans
+	//	"cloned"     the task was enqueued as a clone of an archived task by an operator, see Inspector.CloneTask
+	//	"paused"     the queue was paused by an operator
+	//	"unpaused"   the queue was unpaused by an operator
+	//	"draining"   the queue was put into draining mode by an operator
+	//	"undrained"  the queue was taken out of draining mode by an operator
+	//	"removed"    the queue was deleted by an operator
+	//	"tripped"    a server paused the queue because too many of its tasks failed, see Config.QueueFailureThreshold
+	Event string
+
+	// TaskID and TaskType identify the task.
+	// For actions applied to all tasks in a state (e.g. DeleteAllArchivedTasks),
+	// TaskID is empty and State is the state.
+	// For events about the queue itself, all of them are empty.
+	// TaskType is known only for the events recorded by clients and servers.
+	TaskID   string
+	TaskType string
+	State    string
+
+	// Count is the number of tasks the event applies to.
+	Count int
+
+	// Reason is the error message of a retried or archived task,
+	// or the failure rate for which a queue was paused.
+	Reason string
+
+	// Operator reports whether the event was caused by an action of an Inspector.
+	Operator bool
+
+	// Actor identifies who performed the action of the Inspector.
+	// Empty if no actor was given, see InspectorConfig.Actor and Inspector.WithActor.
+	Actor string
+
+	// Time is the time the event was recorded.
+	Time time.Time
+}
+
+// ListAuditEvents retrieves the events in the audit log of the specified queue, newest first.
+// The audit log holds about the 10000 most recent events of the queue, and is kept
+// after the queue is deleted.
+//
+// By default, it retrieves the first 30 events.
+func (i *Inspector) ListAuditEvents(qname string, opts ...ListOption) ([]*AuditEvent, error) {
+	if err := base.ValidateQueueName(qname); err != nil {
+		return nil, fmt.Errorf("asynq: %w", err)
+	}
+	opt := composeListOptions(opts...)
+	pgn := rdb.Pagination{Size: opt.pageSize, Page: opt.pageNum - 1}
+	data, err := i.rdb.ListAuditEvents(qname, pgn)
+	if err != nil {
+		return nil, fmt.Errorf("asynq: %w", err)
+	}
+	var events []*AuditEvent
+	for _, e := range data {
+		events = append(events, &AuditEvent{
+			ID:       e.ID,
+			Queue:    qname,
+			Event:    e.Event,
+			TaskID:   e.TaskID,
+			TaskType: e.TaskType,
+			State:    e.State,
+			Count:    e.Count,
+			Reason:   e.Reason,
+			Operator: e.Operator,
+			Actor:    e.Actor,
+			Time:     e.Time,
+		})
+	}
+	return events, nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestInspectorListAuditEvents(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	client := NewClientWithConfig(getRedisConnOpt(t), ClientConfig{AuditLog: true})
+	defer client.Close()
+	inspector := NewInspectorWithConfig(getRedisConnOpt(t), InspectorConfig{AuditLog: true})
+	defer inspector.Close()
+
+	info, err := client.Enqueue(NewTask("send_email", nil), Queue("email"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inspector.ArchiveTask("email", info.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inspector.RunAllArchivedTasks("email"); err != nil {
+		t.Fatal(err)
+	}
+	// Actions of an inspector without audit log are not recorded.
+	if _, err := NewInspector(getRedisConnOpt(t)).DeleteAllPendingTasks("email"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := inspector.ListAuditEvents("email")
+	if err != nil {
+		t.Fatalf("ListAuditEvents returned error: %v", err)
+	}
+	want := []*AuditEvent{
+		{Queue: "email", Event: "run", State: "archived", Count: 1, Operator: true},
+		{Queue: "email", Event: "archived", TaskID: info.ID, Count: 1, Operator: true},
+		{Queue: "email", Event: "enqueued", TaskID: info.ID, TaskType: "send_email", Count: 1},
+	}
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreFields(AuditEvent{}, "ID", "Time")); diff != "" {
+		t.Errorf("ListAuditEvents returned unexpected events; (-want,+got)\n%s", diff)
+	}
+
+	if got, err := inspector.ListAuditEvents("email", PageSize(1), Page(3)); err != nil || len(got) != 1 || got[0].Event != "enqueued" {
+		t.Errorf("ListAuditEvents(PageSize(1), Page(3)) returned (%v, %v), want the enqueued event", got, err)
+	}
+	if _, err := inspector.ListAuditEvents(""); err == nil {
+		t.Errorf("ListAuditEvents with empty queue name returned nil error, want non-nil error")
+	}
+}
+
+func TestInspectorWithActor(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	inspector := NewInspectorWithConfig(getRedisConnOpt(t), InspectorConfig{AuditLog: true, Actor: "ops-bot"})
+	defer inspector.Close()
+
+	if err := inspector.WithActor("alice@example.com").PauseQueue("email"); err != nil {
+		t.Fatal(err)
+	}
+	if err := inspector.UnpauseQueue("email"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := inspector.ListAuditEvents("email")
+	if err != nil {
+		t.Fatalf("ListAuditEvents returned error: %v", err)
+	}
+	want := []*AuditEvent{
+		{Queue: "email", Event: "unpaused", Operator: true, Actor: "ops-bot"},
+		{Queue: "email", Event: "paused", Operator: true, Actor: "alice@example.com"},
+	}
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreFields(AuditEvent{}, "ID", "Time")); diff != "" {
+		t.Errorf("ListAuditEvents returned unexpected events; (-want,+got)\n%s", diff)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -183,6 +184,60 @@ func BenchmarkEndToEndMultipleQueues(b *testing.B) {
 	}
 }
 
+// E2E benchmark measuring the latency from before the enqueue of a task
+// until its handler is called, while the tasks are enqueued concurrently.
+func BenchmarkEndToEndLatency(b *testing.B) {
+	const count = 10000
+	for n := 0; n < b.N; n++ {
+		b.StopTimer() // begin setup
+		setup(b)
+		redis := getRedisConnOpt(b)
+		client := NewClient(redis)
+		srv := NewServer(redis, Config{
+			Concurrency: 10,
+			LogLevel:    testLogLevel,
+		})
+		var (
+			mu        sync.Mutex
+			latencies []time.Duration
+			wg        sync.WaitGroup
+		)
+		wg.Add(count)
+		handler := func(ctx context.Context, t *Task) error {
+			var enqueuedAt time.Time
+			if err := enqueuedAt.UnmarshalBinary(t.Payload()); err != nil {
+				b.Errorf("could not decode payload: %v", err)
+			}
+			mu.Lock()
+			latencies = append(latencies, time.Since(enqueuedAt))
+			mu.Unlock()
+			wg.Done()
+			return nil
+		}
+		srv.Start(HandlerFunc(handler))
+		b.StartTimer() // end setup
+
+		for i := 0; i < count; i++ {
+			payload, err := time.Now().MarshalBinary()
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := client.Enqueue(NewTask("latency", payload)); err != nil {
+				b.Fatalf("could not enqueue a task: %v", err)
+			}
+		}
+		wg.Wait()
+
+		b.StopTimer() // begin teardown
+		srv.Stop()
+		client.Close()
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		b.ReportMetric(float64(latencies[count/2].Microseconds()), "p50-µs")
+		b.ReportMetric(float64(latencies[count*99/100].Microseconds()), "p99-µs")
+		b.StartTimer() // end teardown
+	}
+}
+
 // E2E benchmark to check client enqueue operation performs correctly,
 // while server is busy processing tasks.
 func BenchmarkClientWhileServerRunning(b *testing.B) {
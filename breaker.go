@@ -0,0 +1,157 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hibiken/asynq/internal/timeutil"
+)
+
+// circuitBreaker tracks consecutive broker failures and opens after the
+// number of failures reaches the threshold. While open, callers should not
+// call the broker until the cool-off period elapses. After the cool-off,
+// a single call is allowed through to probe the broker: the breaker closes
+// if it succeeds and opens again if it fails.
+//
+// A nil *circuitBreaker is valid and never opens.
+type circuitBreaker struct {
+	clock     timeutil.Clock
+	threshold int
+	coolOff   time.Duration
+
+	mu       sync.Mutex
+	failures int       // number of consecutive failures
+	openedAt time.Time // zero if the breaker is closed
+	probing  bool      // true while a probe call is in flight
+}
+
+func newCircuitBreaker(threshold int, coolOff time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &circuitBreaker{
+		clock:     timeutil.NewRealClock(),
+		threshold: threshold,
+		coolOff:   coolOff,
+	}
+}
+
+// allow reports whether a call to the broker should be made.
+func (cb *circuitBreaker) allow() bool {
+	if cb == nil {
+		return true
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.openedAt.IsZero() {
+		return true
+	}
+	if cb.probing || cb.clock.Now().Before(cb.openedAt.Add(cb.coolOff)) {
+		return false
+	}
+	cb.probing = true
+	return true
+}
+
+// record records the result of a call to the broker.
+func (cb *circuitBreaker) record(err error) {
+	if cb == nil {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.probing = false
+	if err == nil {
+		cb.failures = 0
+		cb.openedAt = time.Time{}
+		return
+	}
+	cb.failures++
+	if cb.failures >= cb.threshold {
+		cb.openedAt = cb.clock.Now()
+	}
+}
+
+// isOpen reports whether the breaker is open, i.e. the broker is considered unavailable.
+func (cb *circuitBreaker) isOpen() bool {
+	if cb == nil {
+		return false
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return !cb.openedAt.IsZero()
+}
+
+// queueBreaker tracks the outcomes of the last tasks processed from each queue
+// and trips when the failure rate over them exceeds the threshold.
+//
+// A nil *queueBreaker is valid and never trips.
+type queueBreaker struct {
+	threshold float64 // fraction of failed tasks above which the breaker trips
+	window    int     // number of last tasks the failure rate is computed over
+
+	mu       sync.Mutex
+	outcomes map[string]*outcomes // maps queue name to its outcomes
+}
+
+// outcomes is a ring buffer of the outcomes of the last tasks of a queue.
+type outcomes struct {
+	failed   []bool
+	next     int // index of the slot to write next
+	n        int // number of recorded outcomes, up to len(failed)
+	failures int // number of failed outcomes among the recorded ones
+}
+
+func newQueueBreaker(threshold float64, window int) *queueBreaker {
+	if threshold <= 0 || window <= 0 {
+		return nil
+	}
+	return &queueBreaker{
+		threshold: threshold,
+		window:    window,
+		outcomes:  make(map[string]*outcomes),
+	}
+}
+
+// record records the outcome of a task processed from the queue, and reports
+// whether the breaker trips along with the failure rate over the window.
+//
+// The breaker trips only once the window is full, and starts over with an empty
+// window after it trips.
+func (qb *queueBreaker) record(qname string, failed bool) (tripped bool, rate float64) {
+	if qb == nil {
+		return false, 0
+	}
+	qb.mu.Lock()
+	defer qb.mu.Unlock()
+	o, ok := qb.outcomes[qname]
+	if !ok {
+		o = &outcomes{failed: make([]bool, qb.window)}
+		qb.outcomes[qname] = o
+	}
+	if o.n == len(o.failed) {
+		if o.failed[o.next] {
+			o.failures--
+		}
+	} else {
+		o.n++
+	}
+	o.failed[o.next] = failed
+	if failed {
+		o.failures++
+	}
+	o.next = (o.next + 1) % len(o.failed)
+	if o.n < len(o.failed) {
+		return false, 0
+	}
+	rate = float64(o.failures) / float64(o.n)
+	if rate <= qb.threshold {
+		return false, rate
+	}
+	delete(qb.outcomes, qname)
+	return true, rate
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hibiken/asynq/internal/timeutil"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	clock := timeutil.NewSimulatedClock(now)
+	cb := newCircuitBreaker(3, 10*time.Second)
+	cb.clock = clock
+	errBroker := fmt.Errorf("connection refused")
+
+	for i := 0; i < 2; i++ {
+		cb.record(errBroker)
+	}
+	if !cb.allow() || cb.isOpen() {
+		t.Fatalf("breaker opened after 2 failures, want closed with threshold 3")
+	}
+	cb.record(errBroker)
+	if cb.allow() || !cb.isOpen() {
+		t.Fatalf("breaker is closed after 3 failures, want open")
+	}
+
+	// After cool-off, a single probe is allowed.
+	clock.SetTime(now.Add(11 * time.Second))
+	if !cb.allow() {
+		t.Fatalf("breaker did not allow a probe after cool-off")
+	}
+	if cb.allow() {
+		t.Errorf("breaker allowed a second call while probing")
+	}
+	cb.record(errBroker)
+	if cb.allow() {
+		t.Errorf("breaker allowed a call right after a failed probe")
+	}
+
+	clock.SetTime(now.Add(22 * time.Second))
+	if !cb.allow() {
+		t.Fatalf("breaker did not allow a probe after cool-off")
+	}
+	cb.record(nil)
+	if !cb.allow() || cb.isOpen() {
+		t.Errorf("breaker is open after a successful probe, want closed")
+	}
+}
+
+func TestQueueBreaker(t *testing.T) {
+	qb := newQueueBreaker(0.5, 4)
+	// The breaker does not trip until the window is full.
+	for i := 0; i < 3; i++ {
+		if tripped, _ := qb.record("default", true); tripped {
+			t.Fatalf("breaker tripped after %d outcomes, want the window of 4 to fill first", i+1)
+		}
+	}
+	if tripped, _ := qb.record("low", true); tripped {
+		t.Errorf("breaker tripped for a queue with a single outcome")
+	}
+	tripped, rate := qb.record("default", false)
+	if !tripped || rate != 0.75 {
+		t.Fatalf("record returned (%t, %v), want (true, 0.75)", tripped, rate)
+	}
+
+	// The window starts over after the breaker trips, and old outcomes drop out of it.
+	for _, failed := range []bool{true, false, false, true, true} {
+		if tripped, _ := qb.record("default", failed); tripped {
+			t.Fatalf("breaker tripped with a failure rate of 50%%, want threshold to be exceeded")
+		}
+	}
+	if tripped, rate := qb.record("default", true); !tripped || rate != 0.75 {
+		t.Errorf("record returned (%t, %v), want (true, 0.75)", tripped, rate)
+	}
+
+	var nilBreaker *queueBreaker
+	if tripped, _ := nilBreaker.record("default", true); tripped {
+		t.Errorf("nil breaker tripped")
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	cb := newCircuitBreaker(0, 10*time.Second)
+	for i := 0; i < 100; i++ {
+		cb.record(fmt.Errorf("connection refused"))
+	}
+	if !cb.allow() || cb.isOpen() {
+		t.Errorf("disabled breaker opened")
+	}
+}
@@ -7,7 +7,10 @@ package asynq
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -25,15 +28,353 @@ import (
 // Clients are safe for concurrent use by multiple goroutines.
 type Client struct {
 	rdb *rdb.RDB
+
+	// broker is used to write tasks.
+	broker base.Broker
+
+	// retry policy for transient redis errors.
+	maxRetry      int
+	retryDelay    time.Duration
+	maxRetryDelay time.Duration
+
+	// validators of the tasks enqueued, keyed by task type.
+	validators map[string]ValidatorFunc
+
+	// payloadStore stores the payloads larger than payloadStoreThreshold bytes, if non-nil.
+	payloadStore          PayloadStore
+	payloadStoreThreshold int
+
+	// signingKey is the key with which to sign the tasks, if non-nil.
+	signingKey []byte
+
+	// environment the client runs in, empty if unset.
+	environment string
+
+	// guards envChecked and envErr.
+	envMu sync.Mutex
+	// envChecked is true once the environment of the database is known,
+	// and envErr is the result of the check then.
+	envChecked bool
+	envErr     error
+
+	// hooks are called around each enqueue.
+	hooks []EnqueueHook
+
+	// mirror writes the tasks to the mirror database, if non-nil.
+	mirror *mirror
+
+	// maximum number of pending tasks, keyed by queue name.
+	maxQueueSize map[string]int
+
+	// default options of the tasks enqueued, by type pattern from the least
+	// to the most specific one, and by queue name.
+	typeOptions  []typeOptions
+	queueOptions map[string][]Option
+}
+
+// ClientConfig specifies the client's behavior.
+type ClientConfig struct {
+	// EnqueueMaxRetry is the maximum number of times Enqueue retries writing a task
+	// when the write fails with a transient redis error (e.g. network error, or the
+	// redis server loading data or failing over).
+	//
+	// A retry which finds the task already written by a previous attempt, whose
+	// reply was lost, succeeds instead of reporting a duplicate or conflicting task.
+	//
+	// If unset or zero, Enqueue returns the error without retrying.
+	EnqueueMaxRetry int
+
+	// EnqueueRetryDelay is the delay before the first retry.
+	// The delay is doubled on each subsequent retry, up to EnqueueMaxRetryDelay.
+	//
+	// If unset or zero, a delay of 100 milliseconds is used.
+	EnqueueRetryDelay time.Duration
+
+	// EnqueueMaxRetryDelay is the upper bound of the delay between retries.
+	//
+	// If unset or zero, a maximum delay of 2 seconds is used.
+	EnqueueMaxRetryDelay time.Duration
+
+	// BrokerLatencyFunc is called after each redis command run by the client
+	// with the name of the operation and the time it took. See BrokerLatencyFunc for details.
+	BrokerLatencyFunc BrokerLatencyFunc
+
+	// AuditLog specifies whether to record the tasks enqueued by the client
+	// in the audit logs of their queues.
+	// See Config.AuditLog for details.
+	AuditLog bool
+
+	// PublishEvents specifies whether to publish the tasks enqueued by the client
+	// to the subscribers of their queues.
+	// See Config.PublishEvents for details.
+	PublishEvents bool
+
+	// Validators maps task type names to the validators of the tasks of the type,
+	// which run before a task is written to redis. The validator for the key "*"
+	// runs on all tasks, before the validator for the type of the task.
+	// If a validator returns an error, enqueue returns a *ValidationError wrapping it.
+	//
+	// Use this to catch malformed tasks in the producer instead of in the handler.
+	//
+	// Example:
+	//
+	//     Validators: map[string]asynq.ValidatorFunc{
+	//         "*":          asynq.MaxPayloadSize(64 << 10),
+	//         "email:send": asynq.RequireFields("to", "subject"),
+	//     }
+	Validators map[string]ValidatorFunc
+
+	// PayloadStore stores the payloads of tasks larger than PayloadStoreThreshold
+	// outside of redis, and redis holds only the key of the payload.
+	// Use this to keep the memory used by redis bounded for queues of large
+	// payloads (e.g. media processing).
+	//
+	// Servers processing the tasks must set Config.PayloadStore to the same store.
+	//
+	// If unset, all payloads are stored in redis.
+	PayloadStore PayloadStore
+
+	// PayloadStoreThreshold is the size in bytes above which payloads are stored
+	// in PayloadStore.
+	//
+	// If unset or zero, payloads larger than 64KiB are stored in PayloadStore.
+	PayloadStoreThreshold int
+
+	// SigningKey is the key with which to sign the tasks enqueued by the client,
+	// so that servers can detect tasks tampered with in redis (e.g. when redis is
+	// shared across services). The signature is an HMAC-SHA256 of the type, payload,
+	// queue and options of the task.
+	//
+	// Servers processing the tasks must set Config.SigningKey to the same key.
+	//
+	// If unset, tasks are not signed.
+	SigningKey []byte
+
+	// Environment specifies the name of the environment the client runs in
+	// (e.g. "staging", "production"). Enqueue returns an error wrapping
+	// ErrEnvironmentMismatch if the redis database is labeled with another environment.
+	// Each environment must use its own database. See Config.Environment for details.
+	//
+	// If unset, the client enqueues tasks to any database.
+	Environment string
+
+	// EnqueueHooks are called around each enqueue of the client, in order,
+	// e.g. to record metrics, inject headers or log the enqueues of all producers
+	// from shared code. See EnqueueHook for details.
+	EnqueueHooks []EnqueueHook
+
+	// Mirror specifies a secondary redis database (e.g. in another region) to which
+	// the client mirrors the tasks it writes, so that the pending and scheduled
+	// tasks survive an outage of the primary database.
+	//
+	// Tasks are mirrored in the background once they are written to the primary
+	// database, in the order they were written. Mirroring is best-effort: a task
+	// which cannot be written to the mirror is not retried, and Enqueue does not
+	// wait for or report the write to the mirror. Use MirrorStats to monitor the lag
+	// of the mirror.
+	//
+	// Only the enqueues of the client are mirrored: the processing, retries and
+	// deletions of the tasks on the primary database are not, so the mirror also
+	// holds the tasks processed since they were mirrored, up to MirrorRetention.
+	// Tasks enqueued by a Scheduler are mirrored if SchedulerOpts.Mirror is set.
+	// To fail over, promote the mirror with Inspector.PromoteMirror (or "asynq mirror
+	// promote"): servers configured with Config.Mirror process the tasks of the mirror
+	// once restarted, and tasks already processed on the primary database within
+	// MirrorRetention may be processed again. Clients don't switch to the mirror:
+	// once it's promoted, point the clients to the mirror instead of the primary database.
+	//
+	// If unset, tasks are not mirrored.
+	Mirror RedisConnOpt
+
+	// MirrorBufferSize is the maximum number of tasks waiting to be written to the
+	// mirror. Tasks written while the buffer is full are not mirrored.
+	//
+	// If unset or zero, up to 10000 tasks wait to be mirrored.
+	MirrorBufferSize int
+
+	// MirrorRetention is how long the mirrored tasks are kept in the mirror:
+	// the pending tasks enqueued and the scheduled tasks to be processed longer ago
+	// are deleted from the mirror, assuming they were processed on the primary database.
+	//
+	// If unset or zero, the tasks are kept for 24 hours.
+	MirrorRetention time.Duration
+
+	// MaxQueueSize maps queue names to the maximum number of pending tasks of the queue.
+	// Enqueue returns an error wrapping ErrQueueFull instead of enqueueing a task to
+	// be processed immediately to a queue holding that many pending tasks, so that
+	// producers can shed load when the servers fall behind.
+	// Scheduled tasks are not limited.
+	//
+	// The size of the queue is checked before the task is written, so concurrent
+	// enqueues may exceed the limit by the number of producers.
+	//
+	// If unset, or for the queues not in the map, queues are not limited.
+	MaxQueueSize map[string]int
+
+	// DefaultOptions maps task types to the options to enqueue the tasks of the type
+	// with, so that call sites don't repeat them. A key ending with "*" matches the
+	// types starting with the rest of the key, e.g. "email:*" matches "email:welcome",
+	// and "*" matches all types.
+	//
+	// The options of a more specific key override the options of a less specific one,
+	// and the options given to NewTask and Enqueue override all default options.
+	//
+	// Example:
+	//
+	//     DefaultOptions: map[string][]asynq.Option{
+	//         "*":       {asynq.Retention(time.Hour)},
+	//         "email:*": {asynq.Queue("notifications"), asynq.MaxRetry(10), asynq.Timeout(30 * time.Second)},
+	//     }
+	DefaultOptions map[string][]Option
+
+	// QueueDefaultOptions maps queue names to the options to enqueue the tasks of the
+	// queue with, e.g. a Timeout applying to all tasks of a queue of short tasks.
+	// The queue of a task is the one given by the options of the task, including
+	// DefaultOptions, or the default queue.
+	//
+	// The options of the queue are overridden by DefaultOptions and by the options
+	// given to NewTask and Enqueue. Queue options in the map are ignored.
+	QueueDefaultOptions map[string][]Option
+}
+
+// typeOptions are the default options of the tasks whose type matches pattern.
+type typeOptions struct {
+	pattern string
+	opts    []Option
+}
+
+// match reports whether the task type matches the pattern.
+func (o *typeOptions) match(typename string) bool {
+	if strings.HasSuffix(o.pattern, "*") {
+		return strings.HasPrefix(typename, strings.TrimSuffix(o.pattern, "*"))
+	}
+	return typename == o.pattern
+}
+
+// sortTypeOptions returns the options of the given patterns, from the least
+// to the most specific pattern: "*" first, then the prefix patterns from the
+// shortest to the longest, then the exact types.
+func sortTypeOptions(m map[string][]Option) []typeOptions {
+	res := make([]typeOptions, 0, len(m))
+	for pattern, opts := range m {
+		res = append(res, typeOptions{pattern, opts})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		pi, pj := strings.HasSuffix(res[i].pattern, "*"), strings.HasSuffix(res[j].pattern, "*")
+		if pi != pj {
+			return pi
+		}
+		if len(res[i].pattern) != len(res[j].pattern) {
+			return len(res[i].pattern) < len(res[j].pattern)
+		}
+		return res[i].pattern < res[j].pattern
+	})
+	return res
+}
+
+// withDefaultOptions returns opts preceded by the default options of the client
+// for the type of the task and for its queue, so that opts override them.
+func (c *Client) withDefaultOptions(typename string, opts []Option) []Option {
+	if len(c.typeOptions) == 0 && len(c.queueOptions) == 0 {
+		return opts
+	}
+	var res []Option
+	for i := range c.typeOptions {
+		if c.typeOptions[i].match(typename) {
+			res = append(res, c.typeOptions[i].opts...)
+		}
+	}
+	res = append(res, opts...)
+	if len(c.queueOptions) == 0 {
+		return res
+	}
+	qname := base.DefaultQueueName
+	for _, opt := range res {
+		if q, ok := opt.(queueOption); ok {
+			qname = string(q)
+		}
+	}
+	var qopts []Option
+	for _, opt := range c.queueOptions[qname] {
+		if _, ok := opt.(queueOption); !ok {
+			qopts = append(qopts, opt)
+		}
+	}
+	return append(qopts, res...)
+}
+
+// EnqueueHook is called around each enqueue of a Client.
+// See ClientConfig.EnqueueHooks.
+type EnqueueHook interface {
+	// BeforeEnqueue is called before the task is enqueued with the options given
+	// to Enqueue, and returns the options to enqueue the task with, e.g. with an
+	// additional Header option. The options given to NewTask still apply.
+	//
+	// If BeforeEnqueue returns a non-nil error, the task is not enqueued and
+	// Enqueue returns the error. The hooks after it are not called.
+	BeforeEnqueue(ctx context.Context, task *Task, opts []Option) ([]Option, error)
+
+	// AfterEnqueue is called with the result of each enqueue, including the enqueues
+	// rejected by a BeforeEnqueue: the info of the enqueued task, or the error if the
+	// task could not be enqueued.
+	AfterEnqueue(ctx context.Context, info *TaskInfo, err error)
 }
 
+const (
+	defaultEnqueueRetryDelay    = 100 * time.Millisecond
+	defaultEnqueueMaxRetryDelay = 2 * time.Second
+)
+
 // NewClient returns a new Client instance given a redis connection option.
 func NewClient(r RedisConnOpt) *Client {
+	return NewClientWithConfig(r, ClientConfig{})
+}
+
+// NewClientWithConfig returns a new Client instance given a redis connection option
+// and a client config.
+func NewClientWithConfig(r RedisConnOpt, cfg ClientConfig) *Client {
 	c, ok := r.MakeRedisClient().(redis.UniversalClient)
 	if !ok {
 		panic(fmt.Sprintf("asynq: unsupported RedisConnOpt type %T", r))
 	}
-	return &Client{rdb: rdb.NewRDB(c)}
+	retryDelay := cfg.EnqueueRetryDelay
+	if retryDelay <= 0 {
+		retryDelay = defaultEnqueueRetryDelay
+	}
+	maxRetryDelay := cfg.EnqueueMaxRetryDelay
+	if maxRetryDelay <= 0 {
+		maxRetryDelay = defaultEnqueueMaxRetryDelay
+	}
+	payloadStoreThreshold := cfg.PayloadStoreThreshold
+	if payloadStoreThreshold <= 0 {
+		payloadStoreThreshold = defaultPayloadStoreThreshold
+	}
+	rdb := rdb.NewRDB(c)
+	rdb.SetAuditLog(cfg.AuditLog)
+	rdb.SetEventPublishing(cfg.PublishEvents)
+	rdb.SetLatencyFunc(cfg.BrokerLatencyFunc)
+	var m *mirror
+	if cfg.Mirror != nil {
+		m = newMirror(cfg.Mirror, cfg.MirrorBufferSize, cfg.MirrorRetention)
+	}
+	return &Client{
+		rdb:           rdb,
+		broker:        rdb,
+		maxRetry:      cfg.EnqueueMaxRetry,
+		retryDelay:    retryDelay,
+		maxRetryDelay: maxRetryDelay,
+		validators:    cfg.Validators,
+
+		payloadStore:          cfg.PayloadStore,
+		payloadStoreThreshold: payloadStoreThreshold,
+		signingKey:            cfg.SigningKey,
+		environment:           cfg.Environment,
+		hooks:                 cfg.EnqueueHooks,
+		mirror:                m,
+		maxQueueSize:          cfg.MaxQueueSize,
+		typeOptions:           sortTypeOptions(cfg.DefaultOptions),
+		queueOptions:          cfg.QueueDefaultOptions,
+	}
 }
 
 type OptionType int
@@ -48,6 +389,15 @@ const (
 	ProcessInOpt
 	TaskIDOpt
 	RetentionOpt
+	IdempotencyKeyOpt
+	GroupKeyOpt
+	DependsOnOpt
+	HeaderOpt
+	TTLOpt
+	AtMostOnceOpt
+	TaskClassOpt
+	OverlapOpt
+	RequireLabelOpt
 )
 
 // Option specifies the task processing behavior.
@@ -73,6 +423,18 @@ type (
 	processAtOption time.Time
 	processInOption time.Duration
 	retentionOption time.Duration
+	groupKeyOption  string
+	dependsOnOption []string
+	headerOption    struct{ key, value string }
+	labelOption     struct{ key, value string }
+	ttlOption       time.Duration
+	taskClassOption string
+
+	idempotencyKeyOption struct {
+		key string
+		ttl time.Duration
+	}
+	atMostOnceOption struct{}
 )
 
 // MaxRetry returns an option to specify the max number of times
@@ -193,9 +555,150 @@ func (ttl retentionOption) String() string     { return fmt.Sprintf("Retention(%
 func (ttl retentionOption) Type() OptionType   { return RetentionOpt }
 func (ttl retentionOption) Value() interface{} { return time.Duration(ttl) }
 
+// IdempotencyKey returns an option to attach a producer provided idempotency key to the task.
+// Task enqueued with this option is rejected with ErrDuplicateTask if another task in the same
+// queue was enqueued with the same key within the given ttl, regardless of the state of that task.
+// Unlike Unique, the key is held for the whole ttl and is not released when the task gets processed.
+// TTL duration must be greater than or equal to 1 second.
+//
+// Use Inspector.GetTaskInfoByIdempotencyKey to look up the task which owns the key.
+func IdempotencyKey(key string, ttl time.Duration) Option {
+	return idempotencyKeyOption{key: key, ttl: ttl}
+}
+
+func (opt idempotencyKeyOption) String() string {
+	return fmt.Sprintf("IdempotencyKey(%q, %v)", opt.key, opt.ttl)
+}
+func (opt idempotencyKeyOption) Type() OptionType   { return IdempotencyKeyOpt }
+func (opt idempotencyKeyOption) Value() interface{} { return opt.key }
+
+// GroupKey returns an option to specify the group the task belongs to.
+// Tasks sharing the same group key in a queue are processed one at a time in enqueue order
+// across all servers, while tasks in different groups are processed concurrently.
+// A task in a group is held back until the task enqueued before it is processed successfully
+// or archived. A task being retried keeps the rest of the group waiting.
+//
+// GroupKey option cannot be used together with Unique, ProcessAt, or ProcessIn options.
+// Note that bulk operations of Inspector (e.g. DeleteAllPendingTasks) only apply to the
+// tasks at the head of each group.
+func GroupKey(key string) Option {
+	return groupKeyOption(key)
+}
+
+func (key groupKeyOption) String() string     { return fmt.Sprintf("GroupKey(%q)", string(key)) }
+func (key groupKeyOption) Type() OptionType   { return GroupKeyOpt }
+func (key groupKeyOption) Value() interface{} { return string(key) }
+
+// DependsOn returns an option to specify the tasks which need to complete successfully
+// before the task can be processed. Tasks are identified by their IDs and need to be in
+// the same queue as the task.
+// The task stays in waiting state until all of the tasks it depends on complete,
+// then it's moved to pending state automatically.
+// A task which doesn't exist at the time of enqueue is considered already completed,
+// and so is a task which is deleted before it completes. If one of the tasks is archived,
+// the task is archived as well with the ArchiveReasonDependencyArchived reason; run it
+// with the Inspector once the archived task has been run again and completed.
+// IDs given more than once are counted once.
+//
+// DependsOn option cannot be used together with Unique, GroupKey, ProcessAt, or ProcessIn options.
+func DependsOn(ids ...string) Option {
+	return dependsOnOption(ids)
+}
+
+func (ids dependsOnOption) String() string {
+	quoted := make([]string, len(ids))
+	for i, id := range ids {
+		quoted[i] = strconv.Quote(id)
+	}
+	return fmt.Sprintf("DependsOn(%s)", strings.Join(quoted, ", "))
+}
+func (ids dependsOnOption) Type() OptionType   { return DependsOnOpt }
+func (ids dependsOnOption) Value() interface{} { return []string(ids) }
+
+// Header returns an option to attach a header to the task.
+// Headers hold cross-cutting metadata (e.g. trace ID, tenant ID, origin service)
+// separate from the payload, and are accessible in the Handler with GetHeaders.
+//
+// Header option can be passed multiple times to set multiple headers.
+// If the same key is given more than once, the last value is used.
+func Header(key, value string) Option {
+	return headerOption{key, value}
+}
+
+func (h headerOption) String() string     { return fmt.Sprintf("Header(%q, %q)", h.key, h.value) }
+func (h headerOption) Type() OptionType   { return HeaderOpt }
+func (h headerOption) Value() interface{} { return map[string]string{h.key: h.value} }
+
+// RequireLabel returns an option to require the server processing the task to have
+// the given label, e.g. RequireLabel("gpu", "true") for a task which needs a GPU.
+// Only the servers whose Config.Labels include all the labels required by the task
+// process the task; the other servers leave it in the queue.
+//
+// RequireLabel option can be passed multiple times to require multiple labels.
+// The key must not be empty, and neither the key nor the value may contain a comma;
+// the key may not contain an equal sign.
+func RequireLabel(key, value string) Option {
+	return labelOption{key, value}
+}
+
+func (l labelOption) String() string     { return fmt.Sprintf("RequireLabel(%q, %q)", l.key, l.value) }
+func (l labelOption) Type() OptionType   { return RequireLabelOpt }
+func (l labelOption) Value() interface{} { return map[string]string{l.key: l.value} }
+
+// TTL returns an option to specify how long the task is valid for.
+// If the task hasn't started processing within the given duration after
+// it's enqueued, the task is discarded without being processed.
+// TTL duration must be greater than or equal to 1 second.
+//
+// Expired tasks are discarded by the server, so a task may stay in the queue
+// for a few seconds after it expires. Once processing has started, the task
+// is no longer subject to the TTL, even if it's retried afterwards.
+//
+// TTL option cannot be used together with GroupKey or DependsOn options.
+func TTL(d time.Duration) Option {
+	return ttlOption(d)
+}
+
+func (ttl ttlOption) String() string     { return fmt.Sprintf("TTL(%v)", time.Duration(ttl)) }
+func (ttl ttlOption) Type() OptionType   { return TTLOpt }
+func (ttl ttlOption) Value() interface{} { return time.Duration(ttl) }
+
+// AtMostOnce returns an option to make sure that the task is not processed by
+// more than one worker at a time.
+//
+// When a server dequeues the task, the task is marked as started until the handler
+// returns. If the task is delivered again in the meantime (e.g. the handler ignored
+// the cancelation of its context after the timeout and the task was retried, or the
+// task was pushed back to the queue on shutdown while the handler was running), the
+// new delivery stays pending and isn't dequeued until the mark is cleared.
+//
+// If the server process dies while processing the task, the mark expires one minute
+// after the task's deadline, and the task is then processed again as usual.
+func AtMostOnce() Option {
+	return atMostOnceOption{}
+}
+
+func (opt atMostOnceOption) String() string     { return "AtMostOnce()" }
+func (opt atMostOnceOption) Type() OptionType   { return AtMostOnceOpt }
+func (opt atMostOnceOption) Value() interface{} { return true }
+
+// TaskClass returns an option to specify the class of the task, e.g. "cpu" for
+// CPU-bound tasks or "io" for IO-bound tasks.
+//
+// Use Config.ClassConcurrency to limit the number of tasks of each class processed
+// concurrently by a server, so that a flood of tasks of one class doesn't occupy all
+// the workers.
+func TaskClass(name string) Option {
+	return taskClassOption(name)
+}
+
+func (name taskClassOption) String() string     { return fmt.Sprintf("TaskClass(%q)", string(name)) }
+func (name taskClassOption) Type() OptionType   { return TaskClassOpt }
+func (name taskClassOption) Value() interface{} { return string(name) }
+
 // ErrDuplicateTask indicates that the given task could not be enqueued since it's a duplicate of another task.
 //
-// ErrDuplicateTask error only applies to tasks enqueued with a Unique option.
+// ErrDuplicateTask error only applies to tasks enqueued with a Unique or IdempotencyKey option.
 var ErrDuplicateTask = errors.New("task already exists")
 
 // ErrTaskIDConflict indicates that the given task could not be enqueued since its task ID already exists.
@@ -203,8 +706,28 @@ var ErrDuplicateTask = errors.New("task already exists")
 // ErrTaskIDConflict error only applies to tasks enqueued with a TaskID option.
 var ErrTaskIDConflict = errors.New("task ID conflicts with another task")
 
+// ErrQueueDraining indicates that the given task could not be enqueued since the queue is draining.
+//
+// See Inspector.DrainQueue for details.
+var ErrQueueDraining = errors.New("queue is draining")
+
+// ErrQueueFull indicates that the given task could not be enqueued since the queue
+// holds the maximum number of pending tasks.
+//
+// See ClientConfig.MaxQueueSize for details.
+var ErrQueueFull = errors.New("queue is full")
+
+// RedisCommandError indicates that a redis command failed, e.g. because redis
+// could not be reached. Command is the name of the command (e.g. "zadd") and Err
+// the error returned by the redis client.
+//
+// The errors returned by Client, Server and Inspector operations which failed
+// because of a redis command wrap a *RedisCommandError; use errors.As to get it.
+type RedisCommandError = errors.RedisCommandError
+
 type option struct {
 	retry     int
+	retrySet  bool // whether retry was set with the MaxRetry option
 	queue     string
 	taskID    string
 	timeout   time.Duration
@@ -212,6 +735,16 @@ type option struct {
 	uniqueTTL time.Duration
 	processAt time.Time
 	retention time.Duration
+
+	idempotencyKey string
+	idempotencyTTL time.Duration
+	groupKey       string
+	dependencies   []string
+	headers        map[string]string
+	ttl            time.Duration
+	atMostOnce     bool
+	class          string
+	labels         map[string]string
 }
 
 // composeOptions merges user provided options into the default options
@@ -219,18 +752,25 @@ type option struct {
 // It also validates the user provided options and returns an error if any of
 // the user provided options fail the validations.
 func composeOptions(opts ...Option) (option, error) {
+	return composeOptionsAt(time.Now(), opts...)
+}
+
+// composeOptionsAt is like composeOptions, but uses now as the current time
+// (e.g. to resolve ProcessIn option).
+func composeOptionsAt(now time.Time, opts ...Option) (option, error) {
 	res := option{
 		retry:     defaultMaxRetry,
 		queue:     base.DefaultQueueName,
 		taskID:    uuid.NewString(),
 		timeout:   0, // do not set to deafultTimeout here
 		deadline:  time.Time{},
-		processAt: time.Now(),
+		processAt: now,
 	}
 	for _, opt := range opts {
 		switch opt := opt.(type) {
 		case retryOption:
 			res.retry = int(opt)
+			res.retrySet = true
 		case queueOption:
 			qname := string(opt)
 			if err := base.ValidateQueueName(qname); err != nil {
@@ -256,9 +796,68 @@ func composeOptions(opts ...Option) (option, error) {
 		case processAtOption:
 			res.processAt = time.Time(opt)
 		case processInOption:
-			res.processAt = time.Now().Add(time.Duration(opt))
+			res.processAt = now.Add(time.Duration(opt))
 		case retentionOption:
 			res.retention = time.Duration(opt)
+		case idempotencyKeyOption:
+			if strings.TrimSpace(opt.key) == "" {
+				return option{}, errors.New("idempotency key cannot be empty")
+			}
+			if opt.ttl < 1*time.Second {
+				return option{}, errors.New("IdempotencyKey TTL cannot be less than 1s")
+			}
+			res.idempotencyKey = opt.key
+			res.idempotencyTTL = opt.ttl
+		case groupKeyOption:
+			key := string(opt)
+			if strings.TrimSpace(key) == "" {
+				return option{}, errors.New("group key cannot be empty")
+			}
+			res.groupKey = key
+		case dependsOnOption:
+			for _, id := range opt {
+				if err := validateTaskID(id); err != nil {
+					return option{}, err
+				}
+			}
+			res.dependencies = nil
+			seen := make(map[string]bool)
+			for _, id := range opt {
+				if !seen[id] {
+					seen[id] = true
+					res.dependencies = append(res.dependencies, id)
+				}
+			}
+		case headerOption:
+			if strings.TrimSpace(opt.key) == "" {
+				return option{}, errors.New("header key cannot be empty")
+			}
+			if res.headers == nil {
+				res.headers = make(map[string]string)
+			}
+			res.headers[opt.key] = opt.value
+		case labelOption:
+			if !base.ValidLabel(opt.key, opt.value) {
+				return option{}, fmt.Errorf("invalid label %q=%q", opt.key, opt.value)
+			}
+			if res.labels == nil {
+				res.labels = make(map[string]string)
+			}
+			res.labels[opt.key] = opt.value
+		case ttlOption:
+			ttl := time.Duration(opt)
+			if ttl < 1*time.Second {
+				return option{}, errors.New("TTL cannot be less than 1s")
+			}
+			res.ttl = ttl
+		case atMostOnceOption:
+			res.atMostOnce = true
+		case taskClassOption:
+			class := string(opt)
+			if strings.TrimSpace(class) == "" {
+				return option{}, errors.New("task class cannot be empty")
+			}
+			res.class = class
 		default:
 			// ignore unexpected option
 		}
@@ -289,10 +888,27 @@ var (
 )
 
 // Close closes the connection with redis.
+//
+// If the client mirrors tasks, Close waits up to 5 seconds for the pending
+// tasks to be written to the mirror.
 func (c *Client) Close() error {
+	if c.mirror != nil {
+		c.mirror.close()
+	}
 	return c.rdb.Close()
 }
 
+// MirrorStats returns the statistics of the mirroring of the tasks written
+// by the client. See ClientConfig.Mirror.
+//
+// The statistics are zero if the client does not mirror tasks.
+func (c *Client) MirrorStats() MirrorStats {
+	if c.mirror == nil {
+		return MirrorStats{}
+	}
+	return c.mirror.getStats()
+}
+
 // Enqueue enqueues the given task to a queue.
 //
 // Enqueue returns TaskInfo and nil error if the task is enqueued successfully, otherwise returns a non-nil error.
@@ -322,11 +938,40 @@ func (c *Client) Enqueue(task *Task, opts ...Option) (*TaskInfo, error) {
 //
 // The first argument context applies to the enqueue operation. To specify task timeout and deadline, use Timeout and Deadline option instead.
 func (c *Client) EnqueueContext(ctx context.Context, task *Task, opts ...Option) (*TaskInfo, error) {
+	if len(c.hooks) == 0 {
+		return c.enqueueTask(ctx, task, opts...)
+	}
+	var (
+		info *TaskInfo
+		err  error
+	)
+	for _, hook := range c.hooks {
+		if opts, err = hook.BeforeEnqueue(ctx, task, opts); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		info, err = c.enqueueTask(ctx, task, opts...)
+	}
+	for _, hook := range c.hooks {
+		hook.AfterEnqueue(ctx, info, err)
+	}
+	return info, err
+}
+
+func (c *Client) enqueueTask(ctx context.Context, task *Task, opts ...Option) (*TaskInfo, error) {
 	if strings.TrimSpace(task.Type()) == "" {
 		return nil, fmt.Errorf("task typename cannot be empty")
 	}
-	// merge task options with the options provided at enqueue time.
-	opts = append(task.opts, opts...)
+	if err := c.validate(task); err != nil {
+		return nil, err
+	}
+	if err := c.checkEnvironment(); err != nil {
+		return nil, err
+	}
+	// merge task options with the options provided at enqueue time,
+	// both of which override the default options of the client.
+	opts = c.withDefaultOptions(task.Type(), append(task.opts, opts...))
 	opt, err := composeOptions(opts...)
 	if err != nil {
 		return nil, err
@@ -343,6 +988,34 @@ func (c *Client) EnqueueContext(ctx context.Context, task *Task, opts ...Option)
 		// If neither deadline nor timeout are set, use default timeout.
 		timeout = defaultTimeout
 	}
+	now := time.Now()
+	if opt.groupKey != "" {
+		if opt.uniqueTTL > 0 {
+			return nil, fmt.Errorf("GroupKey option cannot be used with Unique option")
+		}
+		if opt.processAt.After(now) {
+			return nil, fmt.Errorf("GroupKey option cannot be used with ProcessAt or ProcessIn option")
+		}
+	}
+	if len(opt.dependencies) > 0 {
+		if opt.uniqueTTL > 0 || opt.groupKey != "" {
+			return nil, fmt.Errorf("DependsOn option cannot be used with Unique or GroupKey option")
+		}
+		if opt.processAt.After(now) {
+			return nil, fmt.Errorf("DependsOn option cannot be used with ProcessAt or ProcessIn option")
+		}
+	}
+	var expiresAt int64
+	if opt.ttl > 0 {
+		if opt.groupKey != "" || len(opt.dependencies) > 0 {
+			return nil, fmt.Errorf("TTL option cannot be used with GroupKey or DependsOn option")
+		}
+		expiry := now.Add(opt.ttl)
+		if !opt.processAt.Before(expiry) {
+			return nil, fmt.Errorf("task would expire before it's scheduled to be processed")
+		}
+		expiresAt = expiry.Unix()
+	}
 	var uniqueKey string
 	if opt.uniqueTTL > 0 {
 		uniqueKey = base.UniqueKey(opt.queue, task.Type(), task.Payload())
@@ -357,39 +1030,182 @@ func (c *Client) EnqueueContext(ctx context.Context, task *Task, opts ...Option)
 		Timeout:   int64(timeout.Seconds()),
 		UniqueKey: uniqueKey,
 		Retention: int64(opt.retention.Seconds()),
+
+		IdempotencyKey: opt.idempotencyKey,
+		GroupKey:       opt.groupKey,
+		Dependencies:   opt.dependencies,
+		Headers:        opt.headers,
+		ExpiresAt:      expiresAt,
+		AtMostOnce:     opt.atMostOnce,
+		Class:          opt.class,
+		Labels:         opt.labels,
+		EnqueuedAt:     now.UnixNano(),
+		DefaultRetry:   !opt.retrySet,
+	}
+	if !opt.processAt.After(now) {
+		if err := c.checkQueueSize(ctx, msg.Queue); err != nil {
+			return nil, err
+		}
+	}
+	if opt.idempotencyKey != "" {
+		if err := c.rdb.ReserveIdempotencyKey(ctx, msg, opt.idempotencyTTL); err != nil {
+			if errors.Is(err, errors.ErrDuplicateTask) {
+				return nil, fmt.Errorf("%w", ErrDuplicateTask)
+			}
+			return nil, fmt.Errorf("asynq: %w", err)
+		}
+	}
+	if c.payloadStore != nil && len(msg.Payload) > c.payloadStoreThreshold {
+		key := newPayloadKey(msg)
+		if err := c.payloadStore.Put(ctx, key, msg.Payload); err != nil {
+			if opt.idempotencyKey != "" {
+				c.rdb.ReleaseIdempotencyKey(ctx, msg.Queue, opt.idempotencyKey, msg.ID)
+			}
+			return nil, fmt.Errorf("asynq: could not store payload: %v", err)
+		}
+		msg.Payload = nil
+		msg.PayloadRef = key
+	}
+	if c.signingKey != nil {
+		base.SignMessage(msg, c.signingKey)
 	}
-	now := time.Now()
 	var state base.TaskState
+	var write func() error
 	if opt.processAt.Before(now) || opt.processAt.Equal(now) {
 		opt.processAt = now
-		err = c.enqueue(ctx, msg, opt.uniqueTTL)
+		write = func() error { return c.enqueue(ctx, msg, opt.uniqueTTL) }
 		state = base.TaskStatePending
+		if len(msg.Dependencies) > 0 {
+			state = base.TaskStateWaiting
+		}
 	} else {
-		err = c.schedule(ctx, msg, opt.processAt, opt.uniqueTTL)
+		write = func() error { return c.schedule(ctx, msg, opt.processAt, opt.uniqueTTL) }
 		state = base.TaskStateScheduled
 	}
+	generatedID := true
+	for _, o := range opts {
+		if o.Type() == TaskIDOpt {
+			generatedID = false
+		}
+	}
+	err = c.retry(ctx, func(n int) error {
+		err := write()
+		if n > 0 && generatedID && errors.Is(err, errors.ErrTaskIdConflict) {
+			// The task ID was generated for this call, so the conflict means that
+			// a previous attempt wrote the task before failing with a transient error.
+			return nil
+		}
+		if n > 0 && errors.Is(err, errors.ErrDuplicateTask) {
+			// The lock held by the task means that a previous attempt acquired the lock
+			// and wrote the task before failing with a transient error.
+			if id, lerr := c.rdb.UniqueLockHolder(ctx, msg.UniqueKey); lerr == nil && id == msg.ID {
+				return nil
+			}
+		}
+		return err
+	})
+	if err != nil && opt.idempotencyKey != "" {
+		// The task was not written, release the key so that the producer can retry the enqueue.
+		// Note: A transient error may hide a successful write, keep the key then.
+		if !errors.IsTransient(err) {
+			c.rdb.ReleaseIdempotencyKey(ctx, msg.Queue, opt.idempotencyKey, msg.ID)
+		}
+	}
+	if err != nil && msg.PayloadRef != "" {
+		// The task was not written, delete its payload.
+		// Note: A transient error may hide a successful write, keep the payload then.
+		if !errors.IsTransient(err) {
+			c.payloadStore.Delete(ctx, msg.PayloadRef)
+		}
+	}
 	switch {
 	case errors.Is(err, errors.ErrDuplicateTask):
 		return nil, fmt.Errorf("%w", ErrDuplicateTask)
 	case errors.Is(err, errors.ErrTaskIdConflict):
 		return nil, fmt.Errorf("%w", ErrTaskIDConflict)
+	case errors.Is(err, errors.ErrQueueDraining):
+		return nil, fmt.Errorf("%w: queue=%q", ErrQueueDraining, msg.Queue)
 	case err != nil:
 		return nil, err
 	}
+	if c.mirror != nil {
+		w := &mirrorWrite{msg: msg, uniqueTTL: opt.uniqueTTL, writtenAt: time.Now()}
+		if state == base.TaskStateScheduled {
+			w.processAt = opt.processAt
+		}
+		c.mirror.add(w)
+	}
 	return newTaskInfo(msg, state, opt.processAt, nil), nil
 }
 
+// checkEnvironment checks the environment of the database on the first call,
+// and returns the result of the check on subsequent calls.
+// A transient error is not remembered, so that the next call checks again.
+func (c *Client) checkEnvironment() error {
+	if c.environment == "" {
+		return nil
+	}
+	c.envMu.Lock()
+	defer c.envMu.Unlock()
+	if c.envChecked {
+		return c.envErr
+	}
+	err := checkEnvironment(c.broker, c.environment)
+	if err != nil && !errors.Is(err, ErrEnvironmentMismatch) {
+		return err
+	}
+	c.envChecked, c.envErr = true, err
+	return err
+}
+
+// checkQueueSize returns an error wrapping ErrQueueFull if the queue holds
+// the maximum number of pending tasks.
+func (c *Client) checkQueueSize(ctx context.Context, qname string) error {
+	max, ok := c.maxQueueSize[qname]
+	if !ok {
+		return nil
+	}
+	n, err := c.rdb.PendingSize(ctx, qname)
+	if err != nil {
+		return err
+	}
+	if n >= int64(max) {
+		return fmt.Errorf("%w: queue=%q", ErrQueueFull, qname)
+	}
+	return nil
+}
+
 func (c *Client) enqueue(ctx context.Context, msg *base.TaskMessage, uniqueTTL time.Duration) error {
 	if uniqueTTL > 0 {
-		return c.rdb.EnqueueUnique(ctx, msg, uniqueTTL)
+		return c.broker.EnqueueUnique(ctx, msg, uniqueTTL)
+	}
+	return c.broker.Enqueue(ctx, msg)
+}
+
+// retry calls fn until it succeeds, returns a non-transient error, or the
+// maximum number of retries is reached. n is the number of retries so far.
+func (c *Client) retry(ctx context.Context, fn func(n int) error) error {
+	delay := c.retryDelay
+	for n := 0; ; n++ {
+		err := fn(n)
+		if err == nil || n >= c.maxRetry || !errors.IsTransient(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > c.maxRetryDelay {
+			delay = c.maxRetryDelay
+		}
 	}
-	return c.rdb.Enqueue(ctx, msg)
 }
 
 func (c *Client) schedule(ctx context.Context, msg *base.TaskMessage, t time.Time, uniqueTTL time.Duration) error {
 	if uniqueTTL > 0 {
 		ttl := t.Add(uniqueTTL).Sub(time.Now())
-		return c.rdb.ScheduleUnique(ctx, msg, t, ttl)
+		return c.broker.ScheduleUnique(ctx, msg, t, ttl)
 	}
-	return c.rdb.Schedule(ctx, msg, t)
+	return c.broker.Schedule(ctx, msg, t)
 }
@@ -6,7 +6,8 @@ package asynq
 
 import (
 	"context"
-	"errors"
+	"io"
+	"sync"
 	"testing"
 	"time"
 
@@ -14,6 +15,7 @@ import (
 	"github.com/google/go-cmp/cmp/cmpopts"
 	h "github.com/hibiken/asynq/internal/asynqtest"
 	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/errors"
 )
 
 func TestClientEnqueueWithProcessAtOption(t *testing.T) {
@@ -54,16 +56,19 @@ func TestClientEnqueueWithProcessAtOption(t *testing.T) {
 				Timeout:       defaultTimeout,
 				Deadline:      time.Time{},
 				NextProcessAt: now,
+
+				DefaultMaxRetry: true,
 			},
 			wantPending: map[string][]*base.TaskMessage{
 				"default": {
 					{
-						Type:     task.Type(),
-						Payload:  task.Payload(),
-						Retry:    defaultMaxRetry,
-						Queue:    "default",
-						Timeout:  int64(defaultTimeout.Seconds()),
-						Deadline: noDeadline.Unix(),
+						Type:         task.Type(),
+						Payload:      task.Payload(),
+						Retry:        defaultMaxRetry,
+						DefaultRetry: true,
+						Queue:        "default",
+						Timeout:      int64(defaultTimeout.Seconds()),
+						Deadline:     noDeadline.Unix(),
 					},
 				},
 			},
@@ -88,6 +93,8 @@ func TestClientEnqueueWithProcessAtOption(t *testing.T) {
 				Timeout:       defaultTimeout,
 				Deadline:      time.Time{},
 				NextProcessAt: oneHourLater,
+
+				DefaultMaxRetry: true,
 			},
 			wantPending: map[string][]*base.TaskMessage{
 				"default": {},
@@ -96,12 +103,13 @@ func TestClientEnqueueWithProcessAtOption(t *testing.T) {
 				"default": {
 					{
 						Message: &base.TaskMessage{
-							Type:     task.Type(),
-							Payload:  task.Payload(),
-							Retry:    defaultMaxRetry,
-							Queue:    "default",
-							Timeout:  int64(defaultTimeout.Seconds()),
-							Deadline: noDeadline.Unix(),
+							Type:         task.Type(),
+							Payload:      task.Payload(),
+							Retry:        defaultMaxRetry,
+							DefaultRetry: true,
+							Queue:        "default",
+							Timeout:      int64(defaultTimeout.Seconds()),
+							Deadline:     noDeadline.Unix(),
 						},
 						Score: oneHourLater.Unix(),
 					},
@@ -120,7 +128,7 @@ func TestClientEnqueueWithProcessAtOption(t *testing.T) {
 			continue
 		}
 		cmpOptions := []cmp.Option{
-			cmpopts.IgnoreFields(TaskInfo{}, "ID"),
+			cmpopts.IgnoreFields(TaskInfo{}, "ID", "EnqueuedAt"),
 			cmpopts.EquateApproxTime(500 * time.Millisecond),
 		}
 		if diff := cmp.Diff(tc.wantInfo, gotInfo, cmpOptions...); diff != "" {
@@ -130,13 +138,13 @@ func TestClientEnqueueWithProcessAtOption(t *testing.T) {
 
 		for qname, want := range tc.wantPending {
 			gotPending := h.GetPendingMessages(t, r, qname)
-			if diff := cmp.Diff(want, gotPending, h.IgnoreIDOpt, cmpopts.EquateEmpty()); diff != "" {
+			if diff := cmp.Diff(want, gotPending, h.IgnoreIDOpt, h.IgnoreEnqueuedAtOpt, cmpopts.EquateEmpty()); diff != "" {
 				t.Errorf("%s;\nmismatch found in %q; (-want,+got)\n%s", tc.desc, base.PendingKey(qname), diff)
 			}
 		}
 		for qname, want := range tc.wantScheduled {
 			gotScheduled := h.GetScheduledEntries(t, r, qname)
-			if diff := cmp.Diff(want, gotScheduled, h.IgnoreIDOpt, cmpopts.EquateEmpty()); diff != "" {
+			if diff := cmp.Diff(want, gotScheduled, h.IgnoreIDOpt, h.IgnoreEnqueuedAtOpt, cmpopts.EquateEmpty()); diff != "" {
 				t.Errorf("%s;\nmismatch found in %q; (-want,+got)\n%s", tc.desc, base.ScheduledKey(qname), diff)
 			}
 		}
@@ -273,16 +281,19 @@ func TestClientEnqueue(t *testing.T) {
 				Timeout:       defaultTimeout,
 				Deadline:      time.Time{},
 				NextProcessAt: now,
+
+				DefaultMaxRetry: true,
 			},
 			wantPending: map[string][]*base.TaskMessage{
 				"custom": {
 					{
-						Type:     task.Type(),
-						Payload:  task.Payload(),
-						Retry:    defaultMaxRetry,
-						Queue:    "custom",
-						Timeout:  int64(defaultTimeout.Seconds()),
-						Deadline: noDeadline.Unix(),
+						Type:         task.Type(),
+						Payload:      task.Payload(),
+						Retry:        defaultMaxRetry,
+						DefaultRetry: true,
+						Queue:        "custom",
+						Timeout:      int64(defaultTimeout.Seconds()),
+						Deadline:     noDeadline.Unix(),
 					},
 				},
 			},
@@ -305,16 +316,19 @@ func TestClientEnqueue(t *testing.T) {
 				Timeout:       defaultTimeout,
 				Deadline:      time.Time{},
 				NextProcessAt: now,
+
+				DefaultMaxRetry: true,
 			},
 			wantPending: map[string][]*base.TaskMessage{
 				"MyQueue": {
 					{
-						Type:     task.Type(),
-						Payload:  task.Payload(),
-						Retry:    defaultMaxRetry,
-						Queue:    "MyQueue",
-						Timeout:  int64(defaultTimeout.Seconds()),
-						Deadline: noDeadline.Unix(),
+						Type:         task.Type(),
+						Payload:      task.Payload(),
+						Retry:        defaultMaxRetry,
+						DefaultRetry: true,
+						Queue:        "MyQueue",
+						Timeout:      int64(defaultTimeout.Seconds()),
+						Deadline:     noDeadline.Unix(),
 					},
 				},
 			},
@@ -337,16 +351,19 @@ func TestClientEnqueue(t *testing.T) {
 				Timeout:       20 * time.Second,
 				Deadline:      time.Time{},
 				NextProcessAt: now,
+
+				DefaultMaxRetry: true,
 			},
 			wantPending: map[string][]*base.TaskMessage{
 				"default": {
 					{
-						Type:     task.Type(),
-						Payload:  task.Payload(),
-						Retry:    defaultMaxRetry,
-						Queue:    "default",
-						Timeout:  20,
-						Deadline: noDeadline.Unix(),
+						Type:         task.Type(),
+						Payload:      task.Payload(),
+						Retry:        defaultMaxRetry,
+						DefaultRetry: true,
+						Queue:        "default",
+						Timeout:      20,
+						Deadline:     noDeadline.Unix(),
 					},
 				},
 			},
@@ -369,16 +386,19 @@ func TestClientEnqueue(t *testing.T) {
 				Timeout:       noTimeout,
 				Deadline:      time.Date(2020, time.June, 24, 0, 0, 0, 0, time.UTC),
 				NextProcessAt: now,
+
+				DefaultMaxRetry: true,
 			},
 			wantPending: map[string][]*base.TaskMessage{
 				"default": {
 					{
-						Type:     task.Type(),
-						Payload:  task.Payload(),
-						Retry:    defaultMaxRetry,
-						Queue:    "default",
-						Timeout:  int64(noTimeout.Seconds()),
-						Deadline: time.Date(2020, time.June, 24, 0, 0, 0, 0, time.UTC).Unix(),
+						Type:         task.Type(),
+						Payload:      task.Payload(),
+						Retry:        defaultMaxRetry,
+						DefaultRetry: true,
+						Queue:        "default",
+						Timeout:      int64(noTimeout.Seconds()),
+						Deadline:     time.Date(2020, time.June, 24, 0, 0, 0, 0, time.UTC).Unix(),
 					},
 				},
 			},
@@ -402,16 +422,19 @@ func TestClientEnqueue(t *testing.T) {
 				Timeout:       20 * time.Second,
 				Deadline:      time.Date(2020, time.June, 24, 0, 0, 0, 0, time.UTC),
 				NextProcessAt: now,
+
+				DefaultMaxRetry: true,
 			},
 			wantPending: map[string][]*base.TaskMessage{
 				"default": {
 					{
-						Type:     task.Type(),
-						Payload:  task.Payload(),
-						Retry:    defaultMaxRetry,
-						Queue:    "default",
-						Timeout:  20,
-						Deadline: time.Date(2020, time.June, 24, 0, 0, 0, 0, time.UTC).Unix(),
+						Type:         task.Type(),
+						Payload:      task.Payload(),
+						Retry:        defaultMaxRetry,
+						DefaultRetry: true,
+						Queue:        "default",
+						Timeout:      20,
+						Deadline:     time.Date(2020, time.June, 24, 0, 0, 0, 0, time.UTC).Unix(),
 					},
 				},
 			},
@@ -435,17 +458,20 @@ func TestClientEnqueue(t *testing.T) {
 				Deadline:      time.Time{},
 				NextProcessAt: now,
 				Retention:     24 * time.Hour,
+
+				DefaultMaxRetry: true,
 			},
 			wantPending: map[string][]*base.TaskMessage{
 				"default": {
 					{
-						Type:      task.Type(),
-						Payload:   task.Payload(),
-						Retry:     defaultMaxRetry,
-						Queue:     "default",
-						Timeout:   int64(defaultTimeout.Seconds()),
-						Deadline:  noDeadline.Unix(),
-						Retention: int64((24 * time.Hour).Seconds()),
+						Type:         task.Type(),
+						Payload:      task.Payload(),
+						Retry:        defaultMaxRetry,
+						DefaultRetry: true,
+						Queue:        "default",
+						Timeout:      int64(defaultTimeout.Seconds()),
+						Deadline:     noDeadline.Unix(),
+						Retention:    int64((24 * time.Hour).Seconds()),
 					},
 				},
 			},
@@ -461,7 +487,7 @@ func TestClientEnqueue(t *testing.T) {
 			continue
 		}
 		cmpOptions := []cmp.Option{
-			cmpopts.IgnoreFields(TaskInfo{}, "ID"),
+			cmpopts.IgnoreFields(TaskInfo{}, "ID", "EnqueuedAt"),
 			cmpopts.EquateApproxTime(500 * time.Millisecond),
 		}
 		if diff := cmp.Diff(tc.wantInfo, gotInfo, cmpOptions...); diff != "" {
@@ -471,7 +497,7 @@ func TestClientEnqueue(t *testing.T) {
 
 		for qname, want := range tc.wantPending {
 			got := h.GetPendingMessages(t, r, qname)
-			if diff := cmp.Diff(want, got, h.IgnoreIDOpt); diff != "" {
+			if diff := cmp.Diff(want, got, h.IgnoreIDOpt, h.IgnoreEnqueuedAtOpt); diff != "" {
 				t.Errorf("%s;\nmismatch found in %q; (-want,+got)\n%s", tc.desc, base.PendingKey(qname), diff)
 			}
 		}
@@ -512,17 +538,20 @@ func TestClientEnqueueWithTaskIDOption(t *testing.T) {
 				Timeout:       defaultTimeout,
 				Deadline:      time.Time{},
 				NextProcessAt: now,
+
+				DefaultMaxRetry: true,
 			},
 			wantPending: map[string][]*base.TaskMessage{
 				"default": {
 					{
-						ID:       "custom_id",
-						Type:     task.Type(),
-						Payload:  task.Payload(),
-						Retry:    defaultMaxRetry,
-						Queue:    "default",
-						Timeout:  int64(defaultTimeout.Seconds()),
-						Deadline: noDeadline.Unix(),
+						ID:           "custom_id",
+						Type:         task.Type(),
+						Payload:      task.Payload(),
+						Retry:        defaultMaxRetry,
+						DefaultRetry: true,
+						Queue:        "default",
+						Timeout:      int64(defaultTimeout.Seconds()),
+						Deadline:     noDeadline.Unix(),
 					},
 				},
 			},
@@ -539,6 +568,7 @@ func TestClientEnqueueWithTaskIDOption(t *testing.T) {
 		}
 
 		cmpOptions := []cmp.Option{
+			cmpopts.IgnoreFields(TaskInfo{}, "EnqueuedAt"),
 			cmpopts.EquateApproxTime(500 * time.Millisecond),
 		}
 		if diff := cmp.Diff(tc.wantInfo, gotInfo, cmpOptions...); diff != "" {
@@ -548,7 +578,7 @@ func TestClientEnqueueWithTaskIDOption(t *testing.T) {
 
 		for qname, want := range tc.wantPending {
 			got := h.GetPendingMessages(t, r, qname)
-			if diff := cmp.Diff(want, got); diff != "" {
+			if diff := cmp.Diff(want, got, h.IgnoreEnqueuedAtOpt); diff != "" {
 				t.Errorf("%s;\nmismatch found in %q; (-want,+got)\n%s", tc.desc, base.PendingKey(qname), diff)
 			}
 		}
@@ -606,6 +636,8 @@ func TestClientEnqueueWithProcessInOption(t *testing.T) {
 				Timeout:       defaultTimeout,
 				Deadline:      time.Time{},
 				NextProcessAt: time.Now().Add(1 * time.Hour),
+
+				DefaultMaxRetry: true,
 			},
 			wantPending: map[string][]*base.TaskMessage{
 				"default": {},
@@ -614,12 +646,13 @@ func TestClientEnqueueWithProcessInOption(t *testing.T) {
 				"default": {
 					{
 						Message: &base.TaskMessage{
-							Type:     task.Type(),
-							Payload:  task.Payload(),
-							Retry:    defaultMaxRetry,
-							Queue:    "default",
-							Timeout:  int64(defaultTimeout.Seconds()),
-							Deadline: noDeadline.Unix(),
+							Type:         task.Type(),
+							Payload:      task.Payload(),
+							Retry:        defaultMaxRetry,
+							DefaultRetry: true,
+							Queue:        "default",
+							Timeout:      int64(defaultTimeout.Seconds()),
+							Deadline:     noDeadline.Unix(),
 						},
 						Score: time.Now().Add(time.Hour).Unix(),
 					},
@@ -643,16 +676,19 @@ func TestClientEnqueueWithProcessInOption(t *testing.T) {
 				Timeout:       defaultTimeout,
 				Deadline:      time.Time{},
 				NextProcessAt: now,
+
+				DefaultMaxRetry: true,
 			},
 			wantPending: map[string][]*base.TaskMessage{
 				"default": {
 					{
-						Type:     task.Type(),
-						Payload:  task.Payload(),
-						Retry:    defaultMaxRetry,
-						Queue:    "default",
-						Timeout:  int64(defaultTimeout.Seconds()),
-						Deadline: noDeadline.Unix(),
+						Type:         task.Type(),
+						Payload:      task.Payload(),
+						Retry:        defaultMaxRetry,
+						DefaultRetry: true,
+						Queue:        "default",
+						Timeout:      int64(defaultTimeout.Seconds()),
+						Deadline:     noDeadline.Unix(),
 					},
 				},
 			},
@@ -672,7 +708,7 @@ func TestClientEnqueueWithProcessInOption(t *testing.T) {
 			continue
 		}
 		cmpOptions := []cmp.Option{
-			cmpopts.IgnoreFields(TaskInfo{}, "ID"),
+			cmpopts.IgnoreFields(TaskInfo{}, "ID", "EnqueuedAt"),
 			cmpopts.EquateApproxTime(500 * time.Millisecond),
 		}
 		if diff := cmp.Diff(tc.wantInfo, gotInfo, cmpOptions...); diff != "" {
@@ -682,13 +718,13 @@ func TestClientEnqueueWithProcessInOption(t *testing.T) {
 
 		for qname, want := range tc.wantPending {
 			gotPending := h.GetPendingMessages(t, r, qname)
-			if diff := cmp.Diff(want, gotPending, h.IgnoreIDOpt, cmpopts.EquateEmpty()); diff != "" {
+			if diff := cmp.Diff(want, gotPending, h.IgnoreIDOpt, h.IgnoreEnqueuedAtOpt, cmpopts.EquateEmpty()); diff != "" {
 				t.Errorf("%s;\nmismatch found in %q; (-want,+got)\n%s", tc.desc, base.PendingKey(qname), diff)
 			}
 		}
 		for qname, want := range tc.wantScheduled {
 			gotScheduled := h.GetScheduledEntries(t, r, qname)
-			if diff := cmp.Diff(want, gotScheduled, h.IgnoreIDOpt, cmpopts.EquateEmpty()); diff != "" {
+			if diff := cmp.Diff(want, gotScheduled, h.IgnoreIDOpt, h.IgnoreEnqueuedAtOpt, cmpopts.EquateEmpty()); diff != "" {
 				t.Errorf("%s;\nmismatch found in %q; (-want,+got)\n%s", tc.desc, base.ScheduledKey(qname), diff)
 			}
 		}
@@ -784,15 +820,18 @@ func TestClientWithDefaultOptions(t *testing.T) {
 				Timeout:       defaultTimeout,
 				Deadline:      time.Time{},
 				NextProcessAt: now,
+
+				DefaultMaxRetry: true,
 			},
 			queue: "feed",
 			want: &base.TaskMessage{
-				Type:     "feed:import",
-				Payload:  nil,
-				Retry:    defaultMaxRetry,
-				Queue:    "feed",
-				Timeout:  int64(defaultTimeout.Seconds()),
-				Deadline: noDeadline.Unix(),
+				Type:         "feed:import",
+				Payload:      nil,
+				Retry:        defaultMaxRetry,
+				DefaultRetry: true,
+				Queue:        "feed",
+				Timeout:      int64(defaultTimeout.Seconds()),
+				Deadline:     noDeadline.Unix(),
 			},
 		},
 		{
@@ -864,7 +903,7 @@ func TestClientWithDefaultOptions(t *testing.T) {
 			t.Fatal(err)
 		}
 		cmpOptions := []cmp.Option{
-			cmpopts.IgnoreFields(TaskInfo{}, "ID"),
+			cmpopts.IgnoreFields(TaskInfo{}, "ID", "EnqueuedAt"),
 			cmpopts.EquateApproxTime(500 * time.Millisecond),
 		}
 		if diff := cmp.Diff(tc.wantInfo, gotInfo, cmpOptions...); diff != "" {
@@ -878,7 +917,7 @@ func TestClientWithDefaultOptions(t *testing.T) {
 			continue
 		}
 		got := pending[0]
-		if diff := cmp.Diff(tc.want, got, h.IgnoreIDOpt); diff != "" {
+		if diff := cmp.Diff(tc.want, got, h.IgnoreIDOpt, h.IgnoreEnqueuedAtOpt); diff != "" {
 			t.Errorf("%s;\nmismatch found in pending task message; (-want,+got)\n%s",
 				tc.desc, diff)
 		}
@@ -1019,3 +1058,639 @@ func TestClientEnqueueUniqueWithProcessAtOption(t *testing.T) {
 		}
 	}
 }
+
+func TestClientEnqueueWithIdempotencyKey(t *testing.T) {
+	r := setup(t)
+	c := NewClient(getRedisConnOpt(t))
+	defer c.Close()
+
+	tests := []struct {
+		desc string
+		opts []Option
+		key  string
+		ttl  time.Duration
+	}{
+		{
+			desc: "pending task",
+			key:  "order:42",
+			ttl:  time.Hour,
+		},
+		{
+			desc: "scheduled task",
+			opts: []Option{ProcessIn(10 * time.Minute)},
+			key:  "order:43",
+			ttl:  30 * time.Minute,
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r) // clean up db before each test case.
+
+		opts := append(tc.opts, IdempotencyKey(tc.key, tc.ttl))
+		info, err := c.Enqueue(NewTask("charge", nil), opts...)
+		if err != nil {
+			t.Fatalf("%s; Enqueue returned error: %v", tc.desc, err)
+		}
+		if info.IdempotencyKey != tc.key {
+			t.Errorf("%s; IdempotencyKey = %q, want %q", tc.desc, info.IdempotencyKey, tc.key)
+		}
+
+		key := base.IdempotencyKey(base.DefaultQueueName, tc.key)
+		if owner := r.Get(context.Background(), key).Val(); owner != info.ID {
+			t.Errorf("%s; owner of idempotency key = %q, want %q", tc.desc, owner, info.ID)
+		}
+		gotTTL := r.TTL(context.Background(), key).Val()
+		if !cmp.Equal(tc.ttl.Seconds(), gotTTL.Seconds(), cmpopts.EquateApprox(0, 1)) {
+			t.Errorf("%s; TTL = %v, want %v", tc.desc, gotTTL, tc.ttl)
+		}
+
+		// Enqueue a task with the same key again, even with a different payload. It should fail.
+		_, err = c.Enqueue(NewTask("charge", []byte("other")), opts...)
+		if !errors.Is(err, ErrDuplicateTask) {
+			t.Errorf("%s; Enqueue returned %v, want error wrapping ErrDuplicateTask", tc.desc, err)
+		}
+	}
+}
+
+func TestClientEnqueueWithIdempotencyKeyReleasesKeyOnError(t *testing.T) {
+	r := setup(t)
+	c := NewClient(getRedisConnOpt(t))
+	defer c.Close()
+
+	if _, err := c.Enqueue(NewTask("foo", nil), TaskID("custom_id")); err != nil {
+		t.Fatal(err)
+	}
+	_, err := c.Enqueue(NewTask("foo", nil), TaskID("custom_id"), IdempotencyKey("foo:1", time.Hour))
+	if !errors.Is(err, ErrTaskIDConflict) {
+		t.Fatalf("Enqueue returned %v, want error wrapping ErrTaskIDConflict", err)
+	}
+	if n := r.Exists(context.Background(), base.IdempotencyKey(base.DefaultQueueName, "foo:1")).Val(); n != 0 {
+		t.Errorf("idempotency key was not released after enqueue failure")
+	}
+}
+
+func TestClientEnqueueWithGroupKeyError(t *testing.T) {
+	r := setup(t)
+	c := NewClient(getRedisConnOpt(t))
+	defer c.Close()
+
+	tests := []struct {
+		desc string
+		opts []Option
+	}{
+		{"empty key", []Option{GroupKey("  ")}},
+		{"with Unique", []Option{GroupKey("user:42"), Unique(time.Hour)}},
+		{"with ProcessIn", []Option{GroupKey("user:42"), ProcessIn(time.Hour)}},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r)
+		if _, err := c.Enqueue(NewTask("sync", nil), tc.opts...); err == nil {
+			t.Errorf("%s; Enqueue returned nil error, want non-nil error", tc.desc)
+		}
+	}
+}
+
+func TestClientEnqueueWithDependsOn(t *testing.T) {
+	r := setup(t)
+	c := NewClient(getRedisConnOpt(t))
+	defer c.Close()
+	inspector := NewInspector(getRedisConnOpt(t))
+
+	parent, err := c.Enqueue(NewTask("import", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := c.Enqueue(NewTask("notify", nil), DependsOn(parent.ID))
+	if err != nil {
+		t.Fatalf("Enqueue returned error: %v", err)
+	}
+	if child.State != TaskStateWaiting {
+		t.Errorf("State = %v, want %v", child.State, TaskStateWaiting)
+	}
+	if diff := cmp.Diff([]string{parent.ID}, child.Dependencies); diff != "" {
+		t.Errorf("Dependencies mismatch; (-want,+got)\n%s", diff)
+	}
+
+	waiting, err := inspector.ListWaitingTasks(base.DefaultQueueName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(waiting) != 1 || waiting[0].ID != child.ID || waiting[0].State != TaskStateWaiting {
+		t.Errorf("ListWaitingTasks returned %+v, want the child task in waiting state", waiting)
+	}
+
+	dup, err := c.Enqueue(NewTask("notify", nil), DependsOn(parent.ID, parent.ID))
+	if err != nil {
+		t.Fatalf("Enqueue with duplicate dependencies returned error: %v", err)
+	}
+	if diff := cmp.Diff([]string{parent.ID}, dup.Dependencies); diff != "" {
+		t.Errorf("Dependencies mismatch with duplicate IDs; (-want,+got)\n%s", diff)
+	}
+
+	if _, err := c.Enqueue(NewTask("notify", nil), DependsOn(parent.ID), Unique(time.Hour)); err == nil {
+		t.Errorf("Enqueue with DependsOn and Unique returned nil error, want non-nil error")
+	}
+	h.FlushDB(t, r)
+}
+
+func TestClientEnqueueWithHeaders(t *testing.T) {
+	r := setup(t)
+	c := NewClient(getRedisConnOpt(t))
+	defer c.Close()
+
+	info, err := c.Enqueue(NewTask("foo", nil), Header("trace_id", "abc"), Header("tenant", "acme"), Header("trace_id", "xyz"))
+	if err != nil {
+		t.Fatalf("Enqueue returned error: %v", err)
+	}
+	want := map[string]string{"trace_id": "xyz", "tenant": "acme"}
+	if diff := cmp.Diff(want, info.Headers); diff != "" {
+		t.Errorf("Headers mismatch; (-want,+got)\n%s", diff)
+	}
+	pending := h.GetPendingMessages(t, r, base.DefaultQueueName)
+	if len(pending) != 1 {
+		t.Fatalf("got %d pending tasks, want 1", len(pending))
+	}
+	if diff := cmp.Diff(want, pending[0].Headers); diff != "" {
+		t.Errorf("Headers of pending task mismatch; (-want,+got)\n%s", diff)
+	}
+
+	if _, err := c.Enqueue(NewTask("foo", nil), Header("", "abc")); err == nil {
+		t.Errorf("Enqueue with empty header key returned nil error, want non-nil error")
+	}
+	h.FlushDB(t, r)
+}
+
+// recordingHook is an EnqueueHook which adds a header to each task and records
+// the results of the enqueues.
+type recordingHook struct {
+	header    string
+	beforeErr error
+	infos     []*TaskInfo
+	errs      []error
+}
+
+func (hook *recordingHook) BeforeEnqueue(ctx context.Context, task *Task, opts []Option) ([]Option, error) {
+	if hook.beforeErr != nil {
+		return nil, hook.beforeErr
+	}
+	return append(opts, Header(hook.header, task.Type())), nil
+}
+
+func (hook *recordingHook) AfterEnqueue(ctx context.Context, info *TaskInfo, err error) {
+	hook.infos = append(hook.infos, info)
+	hook.errs = append(hook.errs, err)
+}
+
+func TestClientEnqueueHooks(t *testing.T) {
+	r := setup(t)
+	defer h.FlushDB(t, r)
+	first := &recordingHook{header: "first"}
+	second := &recordingHook{header: "second"}
+	c := NewClientWithConfig(getRedisConnOpt(t), ClientConfig{EnqueueHooks: []EnqueueHook{first, second}})
+	defer c.Close()
+
+	info, err := c.Enqueue(NewTask("foo", nil), Header("trace_id", "abc"))
+	if err != nil {
+		t.Fatalf("Enqueue returned error: %v", err)
+	}
+	want := map[string]string{"trace_id": "abc", "first": "foo", "second": "foo"}
+	if diff := cmp.Diff(want, info.Headers); diff != "" {
+		t.Errorf("Headers mismatch; (-want,+got)\n%s", diff)
+	}
+	for _, hook := range []*recordingHook{first, second} {
+		if len(hook.infos) != 1 || hook.infos[0] != info || hook.errs[0] != nil {
+			t.Errorf("AfterEnqueue of hook %q called with %v, %v; want the info of the enqueued task", hook.header, hook.infos, hook.errs)
+		}
+	}
+
+	// The hooks see the errors of the enqueues.
+	_, err = c.Enqueue(NewTask("foo", nil), TaskID(info.ID))
+	if !errors.Is(err, ErrTaskIDConflict) {
+		t.Fatalf("Enqueue with taken task ID returned %v, want ErrTaskIDConflict", err)
+	}
+	if len(second.errs) != 2 || second.infos[1] != nil || second.errs[1] != err {
+		t.Errorf("AfterEnqueue called with %v, %v; want the error of the enqueue", second.infos, second.errs)
+	}
+
+	// An error of BeforeEnqueue rejects the enqueue.
+	first.beforeErr = errors.New("rejected")
+	if _, err := c.Enqueue(NewTask("bar", nil)); err != first.beforeErr {
+		t.Errorf("Enqueue returned %v, want %v", err, first.beforeErr)
+	}
+	if len(second.errs) != 3 || second.errs[2] != first.beforeErr {
+		t.Errorf("AfterEnqueue called with %v; want the error of BeforeEnqueue", second.errs)
+	}
+	if n := len(h.GetPendingMessages(t, r, base.DefaultQueueName)); n != 1 {
+		t.Errorf("got %d pending tasks, want 1", n)
+	}
+}
+
+func TestClientEnqueueWithTTL(t *testing.T) {
+	r := setup(t)
+	c := NewClient(getRedisConnOpt(t))
+	defer c.Close()
+
+	now := time.Now()
+	info, err := c.Enqueue(NewTask("foo", nil), TTL(time.Hour))
+	if err != nil {
+		t.Fatalf("Enqueue returned error: %v", err)
+	}
+	if want := now.Add(time.Hour); info.ExpiresAt.Sub(want) > time.Second || want.Sub(info.ExpiresAt) > time.Second {
+		t.Errorf("ExpiresAt = %v, want %v", info.ExpiresAt, want)
+	}
+	expiry := r.ZRange(context.Background(), base.ExpiryKey(base.DefaultQueueName), 0, -1).Val()
+	if diff := cmp.Diff([]string{info.ID}, expiry); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.ExpiryKey(base.DefaultQueueName), diff)
+	}
+
+	errTests := []struct {
+		desc string
+		opts []Option
+	}{
+		{"TTL less than 1s", []Option{TTL(500 * time.Millisecond)}},
+		{"TTL with GroupKey", []Option{TTL(time.Hour), GroupKey("user:1")}},
+		{"TTL with DependsOn", []Option{TTL(time.Hour), DependsOn(info.ID)}},
+		{"TTL elapsing before ProcessIn", []Option{TTL(time.Minute), ProcessIn(time.Hour)}},
+	}
+	for _, tc := range errTests {
+		if _, err := c.Enqueue(NewTask("foo", nil), tc.opts...); err == nil {
+			t.Errorf("%s; Enqueue returned nil error, want non-nil error", tc.desc)
+		}
+	}
+	h.FlushDB(t, r)
+}
+
+func TestClientEnqueueWithAtMostOnce(t *testing.T) {
+	r := setup(t)
+	c := NewClient(getRedisConnOpt(t))
+	defer c.Close()
+
+	if _, err := c.Enqueue(NewTask("foo", nil), AtMostOnce()); err != nil {
+		t.Fatalf("Enqueue returned error: %v", err)
+	}
+	msgs := h.GetPendingMessages(t, r, base.DefaultQueueName)
+	if len(msgs) != 1 || !msgs[0].AtMostOnce {
+		t.Errorf("pending messages = %v, want one at-most-once message", msgs)
+	}
+}
+
+func TestClientEnqueueWithTaskClass(t *testing.T) {
+	r := setup(t)
+	c := NewClient(getRedisConnOpt(t))
+	defer c.Close()
+
+	info, err := c.Enqueue(NewTask("transcode", nil), TaskClass("cpu"), ProcessIn(time.Hour))
+	if err != nil {
+		t.Fatalf("Enqueue returned error: %v", err)
+	}
+	if info.Class != "cpu" {
+		t.Errorf("TaskInfo.Class = %q, want %q", info.Class, "cpu")
+	}
+	key := base.TaskKey(base.DefaultQueueName, info.ID)
+	if got := r.HGet(context.Background(), key, "class").Val(); got != "cpu" {
+		t.Errorf("class field of %q = %q, want %q", key, got, "cpu")
+	}
+	if _, err := c.Enqueue(NewTask("transcode", nil), TaskClass(" ")); err == nil {
+		t.Errorf("Enqueue with empty TaskClass returned nil error, want non-nil error")
+	}
+}
+
+func TestClientEnqueueWithRequireLabel(t *testing.T) {
+	r := setup(t)
+	c := NewClient(getRedisConnOpt(t))
+	defer c.Close()
+
+	info, err := c.Enqueue(NewTask("train", nil), RequireLabel("region", "eu"), RequireLabel("gpu", "true"))
+	if err != nil {
+		t.Fatalf("Enqueue returned error: %v", err)
+	}
+	want := map[string]string{"gpu": "true", "region": "eu"}
+	if diff := cmp.Diff(want, info.Labels); diff != "" {
+		t.Errorf("TaskInfo.Labels mismatch (-want,+got)\n%s", diff)
+	}
+	key := base.TaskKey(base.DefaultQueueName, info.ID)
+	if got := r.HGet(context.Background(), key, "labels").Val(); got != "gpu=true,region=eu" {
+		t.Errorf("labels field of %q = %q, want %q", key, got, "gpu=true,region=eu")
+	}
+	for _, opt := range []Option{RequireLabel("", "true"), RequireLabel("a=b", "c"), RequireLabel("gpu", "a,b")} {
+		if _, err := c.Enqueue(NewTask("train", nil), opt); err == nil {
+			t.Errorf("Enqueue with %v returned nil error, want non-nil error", opt)
+		}
+	}
+}
+
+func TestClientEnqueueToDrainingQueue(t *testing.T) {
+	r := setup(t)
+	c := NewClient(getRedisConnOpt(t))
+	defer c.Close()
+	inspector := NewInspector(getRedisConnOpt(t))
+
+	if _, err := c.Enqueue(NewTask("foo", nil), Queue("legacy")); err != nil {
+		t.Fatal(err)
+	}
+	if err := inspector.DrainQueue("legacy"); err != nil {
+		t.Fatalf("DrainQueue returned error: %v", err)
+	}
+	if _, err := c.Enqueue(NewTask("foo", nil), Queue("legacy")); !errors.Is(err, ErrQueueDraining) {
+		t.Errorf("Enqueue to a draining queue returned %v, want %v", err, ErrQueueDraining)
+	}
+	info, err := inspector.GetQueueInfo("legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Draining || info.Pending != 1 {
+		t.Errorf("GetQueueInfo returned Draining=%t Pending=%d, want Draining=true Pending=1", info.Draining, info.Pending)
+	}
+
+	if err := inspector.UndrainQueue("legacy"); err != nil {
+		t.Fatalf("UndrainQueue returned error: %v", err)
+	}
+	if _, err := c.Enqueue(NewTask("foo", nil), Queue("legacy")); err != nil {
+		t.Errorf("Enqueue to an undrained queue returned error: %v", err)
+	}
+	h.FlushDB(t, r)
+}
+
+func TestClientEnqueueToFullQueue(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	c := NewClientWithConfig(getRedisConnOpt(t), ClientConfig{MaxQueueSize: map[string]int{"low": 2}})
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.Enqueue(NewTask("foo", nil), Queue("low")); err != nil {
+			t.Fatalf("Enqueue returned error: %v", err)
+		}
+	}
+	if _, err := c.Enqueue(NewTask("foo", nil), Queue("low")); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Enqueue to a full queue returned %v, want %v", err, ErrQueueFull)
+	}
+	// Scheduled tasks and other queues are not limited.
+	if _, err := c.Enqueue(NewTask("foo", nil), Queue("low"), ProcessIn(time.Hour)); err != nil {
+		t.Errorf("Enqueue of scheduled task to a full queue returned error: %v", err)
+	}
+	if _, err := c.Enqueue(NewTask("foo", nil)); err != nil {
+		t.Errorf("Enqueue to an unlimited queue returned error: %v", err)
+	}
+	if n := len(h.GetPendingMessages(t, r, "low")); n != 2 {
+		t.Errorf("queue %q has %d pending tasks, want 2", "low", n)
+	}
+}
+
+func TestClientConfigDefaultOptions(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	c := NewClientWithConfig(getRedisConnOpt(t), ClientConfig{
+		DefaultOptions: map[string][]Option{
+			"*":             {MaxRetry(3), Retention(time.Hour)},
+			"email:*":       {Queue("notifications"), MaxRetry(10), Timeout(30 * time.Second)},
+			"email:welcome": {MaxRetry(20)},
+		},
+		QueueDefaultOptions: map[string][]Option{
+			"notifications": {Timeout(time.Minute), Retention(2 * time.Hour), Queue("ignored")},
+			"default":       {Timeout(5 * time.Second)},
+		},
+	})
+	defer c.Close()
+
+	tests := []struct {
+		desc          string
+		task          *Task
+		opts          []Option
+		wantQueue     string
+		wantMaxRetry  int
+		wantTimeout   time.Duration
+		wantRetention time.Duration
+	}{
+		{
+			desc:          "matching all types",
+			task:          NewTask("reindex", nil),
+			wantQueue:     "default",
+			wantMaxRetry:  3,
+			wantTimeout:   5 * time.Second,
+			wantRetention: time.Hour,
+		},
+		{
+			desc:          "matching a prefix",
+			task:          NewTask("email:reminder", nil),
+			wantQueue:     "notifications",
+			wantMaxRetry:  10,
+			wantTimeout:   30 * time.Second,
+			wantRetention: time.Hour,
+		},
+		{
+			desc:          "matching a type",
+			task:          NewTask("email:welcome", nil),
+			wantQueue:     "notifications",
+			wantMaxRetry:  20,
+			wantTimeout:   30 * time.Second,
+			wantRetention: time.Hour,
+		},
+		{
+			desc:          "overridden by task and enqueue options",
+			task:          NewTask("email:welcome", nil, MaxRetry(1)),
+			opts:          []Option{Queue("low")},
+			wantQueue:     "low",
+			wantMaxRetry:  1,
+			wantTimeout:   30 * time.Second,
+			wantRetention: time.Hour,
+		},
+		{
+			desc:          "with the options of the queue given at enqueue time",
+			task:          NewTask("reindex", nil),
+			opts:          []Option{Queue("notifications")},
+			wantQueue:     "notifications",
+			wantMaxRetry:  3,
+			wantTimeout:   time.Minute,
+			wantRetention: time.Hour,
+		},
+	}
+	for _, tc := range tests {
+		info, err := c.Enqueue(tc.task, tc.opts...)
+		if err != nil {
+			t.Errorf("%s: Enqueue returned error: %v", tc.desc, err)
+			continue
+		}
+		if info.Queue != tc.wantQueue || info.MaxRetry != tc.wantMaxRetry || info.Timeout != tc.wantTimeout || info.Retention != tc.wantRetention {
+			t.Errorf("%s: Enqueue returned Queue=%q MaxRetry=%d Timeout=%v Retention=%v, want Queue=%q MaxRetry=%d Timeout=%v Retention=%v",
+				tc.desc, info.Queue, info.MaxRetry, info.Timeout, info.Retention,
+				tc.wantQueue, tc.wantMaxRetry, tc.wantTimeout, tc.wantRetention)
+		}
+	}
+}
+
+func TestRedisCommandError(t *testing.T) {
+	c := NewClient(RedisClientOpt{Addr: "localhost:0", DialTimeout: 100 * time.Millisecond})
+	defer c.Close()
+	inspector := NewInspector(RedisClientOpt{Addr: "localhost:0", DialTimeout: 100 * time.Millisecond})
+	defer inspector.Close()
+
+	_, enqueueErr := c.Enqueue(NewTask("foo", nil))
+	_, inspectErr := inspector.GetQueueInfo("default")
+	for _, err := range []error{enqueueErr, inspectErr} {
+		var cmdErr *RedisCommandError
+		if !errors.As(err, &cmdErr) || cmdErr.Command == "" || cmdErr.Err == nil {
+			t.Errorf("error %v does not wrap a *RedisCommandError with the failed command", err)
+		}
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	transientErr := errors.E(errors.Op("rdb.Enqueue"), errors.Unknown,
+		&errors.RedisCommandError{Command: "eval", Err: errors.New("LOADING Redis is loading the dataset in memory")})
+	otherErr := errors.E(errors.Op("rdb.Enqueue"), errors.AlreadyExists, errors.ErrTaskIdConflict)
+
+	tests := []struct {
+		desc      string
+		maxRetry  int
+		errs      []error // errors returned by each call, nil afterwards
+		wantCalls int
+		wantErr   error
+	}{
+		{"no retry by default", 0, []error{transientErr}, 1, transientErr},
+		{"retry transient errors", 3, []error{transientErr, transientErr}, 3, nil},
+		{"give up after max retry", 2, []error{transientErr, transientErr, transientErr, transientErr}, 3, transientErr},
+		{"do not retry other errors", 3, []error{otherErr}, 1, otherErr},
+	}
+
+	for _, tc := range tests {
+		c := &Client{maxRetry: tc.maxRetry, retryDelay: time.Millisecond, maxRetryDelay: 2 * time.Millisecond}
+		calls := 0
+		err := c.retry(context.Background(), func(n int) error {
+			if n != calls {
+				t.Errorf("%s; retry count = %d, want %d", tc.desc, n, calls)
+			}
+			calls++
+			if n < len(tc.errs) {
+				return tc.errs[n]
+			}
+			return nil
+		})
+		if err != tc.wantErr {
+			t.Errorf("%s; retry returned %v, want %v", tc.desc, err, tc.wantErr)
+		}
+		if calls != tc.wantCalls {
+			t.Errorf("%s; fn was called %d times, want %d", tc.desc, calls, tc.wantCalls)
+		}
+	}
+}
+
+func TestClientEnqueueWithSigningKey(t *testing.T) {
+	r := setup(t)
+	key := []byte("secret")
+	c := NewClientWithConfig(getRedisConnOpt(t), ClientConfig{SigningKey: key})
+	defer c.Close()
+
+	if _, err := c.Enqueue(NewTask("email:send", []byte("to=user")), Header("tenant", "acme")); err != nil {
+		t.Fatalf("Enqueue returned error: %v", err)
+	}
+	msgs := h.GetPendingMessages(t, r, base.DefaultQueueName)
+	if len(msgs) != 1 {
+		t.Fatalf("got %d pending messages, want 1", len(msgs))
+	}
+	if !base.VerifyMessage(msgs[0], key) {
+		t.Errorf("pending message is not signed with the signing key of the client")
+	}
+}
+
+// lostReplyBroker writes the first task, then returns a transient error
+// as if the reply of redis was lost.
+type lostReplyBroker struct {
+	base.Broker
+	calls int
+}
+
+func (b *lostReplyBroker) EnqueueUnique(ctx context.Context, msg *base.TaskMessage, ttl time.Duration) error {
+	b.calls++
+	if err := b.Broker.EnqueueUnique(ctx, msg, ttl); err != nil || b.calls > 1 {
+		return err
+	}
+	return errors.E(errors.Op("rdb.EnqueueUnique"), errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: io.EOF})
+}
+
+func TestClientRetryEnqueueUniqueAfterLostReply(t *testing.T) {
+	r := setup(t)
+	c := NewClientWithConfig(getRedisConnOpt(t), ClientConfig{EnqueueMaxRetry: 2, EnqueueRetryDelay: time.Millisecond})
+	defer c.Close()
+	b := &lostReplyBroker{Broker: c.broker}
+	c.broker = b
+
+	info, err := c.Enqueue(NewTask("email:send", []byte("to=user")), Unique(time.Hour))
+	if err != nil {
+		t.Fatalf("Enqueue returned error %v, want nil since the first attempt wrote the task", err)
+	}
+	if b.calls != 2 {
+		t.Errorf("EnqueueUnique was called %d times, want 2", b.calls)
+	}
+	msgs := h.GetPendingMessages(t, r, base.DefaultQueueName)
+	if len(msgs) != 1 || msgs[0].ID != info.ID {
+		t.Errorf("pending messages = %v, want the enqueued task only", msgs)
+	}
+
+	// A task of another producer holding the lock is still a duplicate.
+	if _, err := c.Enqueue(NewTask("email:send", []byte("to=user")), Unique(time.Hour)); !errors.Is(err, ErrDuplicateTask) {
+		t.Errorf("Enqueue of a duplicate task returned %v, want ErrDuplicateTask", err)
+	}
+}
+
+// committedWriteBroker writes each task, then returns a transient error
+// as if the reply of redis was lost.
+type committedWriteBroker struct {
+	base.Broker
+}
+
+func (b *committedWriteBroker) Enqueue(ctx context.Context, msg *base.TaskMessage) error {
+	if err := b.Broker.Enqueue(ctx, msg); err != nil {
+		return err
+	}
+	return errors.E(errors.Op("rdb.Enqueue"), errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: io.EOF})
+}
+
+func TestClientKeepsIdempotencyKeyAfterTransientError(t *testing.T) {
+	r := setup(t)
+	c := NewClient(getRedisConnOpt(t))
+	defer c.Close()
+	c.broker = &committedWriteBroker{Broker: c.broker}
+
+	task := NewTask("email:send", []byte("to=user"))
+	if _, err := c.Enqueue(task, IdempotencyKey("order-1", time.Hour)); err == nil {
+		t.Fatalf("Enqueue returned nil error, want the transient error of the broker")
+	}
+	_, err := c.Enqueue(task, IdempotencyKey("order-1", time.Hour))
+	if !errors.Is(err, ErrDuplicateTask) {
+		t.Errorf("second Enqueue returned %v, want ErrDuplicateTask since the first attempt wrote the task", err)
+	}
+	if msgs := h.GetPendingMessages(t, r, base.DefaultQueueName); len(msgs) != 1 {
+		t.Errorf("got %d pending messages, want 1", len(msgs))
+	}
+}
+
+func TestClientBrokerLatencyFunc(t *testing.T) {
+	setup(t)
+	var (
+		mu  sync.Mutex
+		ops []string
+	)
+	c := NewClientWithConfig(getRedisConnOpt(t), ClientConfig{
+		BrokerLatencyFunc: func(op string, d time.Duration, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			ops = append(ops, op)
+		},
+	})
+	defer c.Close()
+
+	if _, err := c.Enqueue(NewTask("email:send", nil)); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	found := false
+	for _, op := range ops {
+		found = found || op == "enqueue"
+	}
+	if !found {
+		t.Errorf("reported operations %v, want the enqueue script", ops)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// ErrIncompatibleServers indicates that the server is incompatible with
+// the running servers of its environment.
+//
+// See Config.StrictCompatibility for details.
+var ErrIncompatibleServers = errors.New("asynq: incompatible servers")
+
+// serverFeatures returns the features of a server with the given config
+// which affect how tasks are read, sorted.
+func serverFeatures(cfg Config) []string {
+	var features []string
+	if cfg.PayloadStore != nil {
+		features = append(features, base.FeaturePayloadStore)
+	}
+	if len(cfg.SigningKey) > 0 {
+		features = append(features, base.FeatureSigning)
+	}
+	return features
+}
+
+// checkCompatibility compares the server with the running servers, and returns an
+// error wrapping ErrIncompatibleServers if they're incompatible and strictCompatibility
+// is set. The incompatibilities are logged as warnings otherwise.
+func (srv *Server) checkCompatibility() error {
+	problems, err := srv.broker.CheckCompatibility(srv.heartbeater.snapshot().info)
+	if err != nil {
+		srv.logger.Warnf("Could not check compatibility with running servers: %v", err)
+		return nil
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	if srv.strictCompatibility {
+		return fmt.Errorf("%w: %s", ErrIncompatibleServers, strings.Join(problems, "; "))
+	}
+	for _, p := range problems {
+		srv.logger.Warnf("Incompatible with running server: %s", p)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/rdb"
+)
+
+func TestServerCompatibility(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	old := &base.ServerInfo{
+		Host:     "localhost",
+		PID:      1234,
+		ServerID: "old",
+		Queues:   map[string]int{"default": 1},
+		Status:   "active",
+		Started:  time.Now(),
+		Version:  "0.18.6",
+	}
+	if err := rdb.NewRDB(r).WriteServerState(old, nil, time.Minute); err != nil {
+		t.Fatalf("could not write server state: %v", err)
+	}
+	handler := HandlerFunc(func(ctx context.Context, task *Task) error { return nil })
+
+	srv := NewServer(getRedisConnOpt(t), Config{LogLevel: testLogLevel, StrictCompatibility: true})
+	if err := srv.Start(handler); !errors.Is(err, ErrIncompatibleServers) {
+		t.Errorf("Start with a server of another version running returned %v, want ErrIncompatibleServers", err)
+		srv.Shutdown()
+	}
+
+	// Without StrictCompatibility, the incompatibilities are only logged.
+	srv = NewServer(getRedisConnOpt(t), Config{LogLevel: testLogLevel})
+	if err := srv.Start(handler); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	srv.Shutdown()
+}
+
+func TestServerFeatures(t *testing.T) {
+	tests := []struct {
+		cfg  Config
+		want []string
+	}{
+		{Config{}, nil},
+		{Config{SigningKey: []byte("secret")}, []string{base.FeatureSigning}},
+		{Config{SigningKey: []byte("secret"), PayloadStore: newMemPayloadStore()}, []string{base.FeaturePayloadStore, base.FeatureSigning}},
+	}
+	for _, tc := range tests {
+		if diff := cmp.Diff(tc.want, serverFeatures(tc.cfg)); diff != "" {
+			t.Errorf("serverFeatures mismatch (-want,+got):\n%s", diff)
+		}
+	}
+}
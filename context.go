@@ -6,6 +6,7 @@ package asynq
 
 import (
 	"context"
+	"fmt"
 
 	asynqcontext "github.com/hibiken/asynq/internal/context"
 )
@@ -40,3 +41,90 @@ func GetMaxRetry(ctx context.Context) (n int, ok bool) {
 func GetQueueName(ctx context.Context) (qname string, ok bool) {
 	return asynqcontext.GetQueueName(ctx)
 }
+
+// GetHeaders extracts the headers attached to the task with the Header option from a context, if any.
+//
+// Return value headers is nil if the task doesn't have any header.
+// The returned map must not be modified.
+func GetHeaders(ctx context.Context) (headers map[string]string, ok bool) {
+	return asynqcontext.GetHeaders(ctx)
+}
+
+// GetShutdownSignal extracts a channel from a context, if any, which is closed
+// when the server starts shutting down.
+//
+// Once the channel is closed, the Handler has until Config.ShutdownTimeout
+// elapses to finish processing or to save its progress with Checkpoint. After the timeout, the context is canceled
+// and the task is pushed back to the queue to be processed again.
+//
+//	select {
+//	case <-shutdown:
+//	    saveProgress()
+//	    return nil
+//	case item := <-items:
+//	    process(item)
+//	}
+func GetShutdownSignal(ctx context.Context) (ch <-chan struct{}, ok bool) {
+	return asynqcontext.GetShutdownSignal(ctx)
+}
+
+// Checkpoint saves data as the progress of the task being processed with the given context.
+// The checkpoint is kept while the task is retried or pushed back to the queue on shutdown,
+// and the handler processing the task again can read it with GetCheckpoint to resume the work.
+// Each call overwrites the previous checkpoint of the task.
+//
+// Checkpoint returns an error if the context is not the one passed to a Handler by the Server.
+func Checkpoint(ctx context.Context, data []byte) error {
+	fn, ok := asynqcontext.GetCheckpointer(ctx)
+	if !ok {
+		return fmt.Errorf("asynq: context is not a task context")
+	}
+	if data == nil {
+		data = []byte{}
+	}
+	if err := fn(data); err != nil {
+		return fmt.Errorf("asynq: could not save checkpoint: %w", err)
+	}
+	return nil
+}
+
+// ReportProgress saves data as the progress of the task being processed with the given context,
+// so that it can be shown while the task is active (see TaskInfo.Progress).
+// The data is opaque to asynq, e.g. a percentage such as []byte("42") or a JSON document.
+// Each call overwrites the previous progress; the progress is cleared when the task is retried.
+//
+// ReportProgress returns an error if the context is not the one passed to a Handler by the Server.
+func ReportProgress(ctx context.Context, data []byte) error {
+	fn, ok := asynqcontext.GetProgressWriter(ctx)
+	if !ok {
+		return fmt.Errorf("asynq: context is not a task context")
+	}
+	if data == nil {
+		data = []byte{}
+	}
+	if err := fn(data); err != nil {
+		return fmt.Errorf("asynq: could not save progress: %w", err)
+	}
+	return nil
+}
+
+// GetCheckpoint extracts the checkpoint saved by a previous attempt to process the task
+// with Checkpoint from a context, if any.
+//
+// Return value ok is false if the task has no checkpoint. The checkpoint is read when the task
+// is dequeued; calls to Checkpoint don't change the value returned for the current context.
+func GetCheckpoint(ctx context.Context) (data []byte, ok bool) {
+	return asynqcontext.GetCheckpoint(ctx)
+}
+
+// GetDependencyResults extracts the results of the tasks the task depends on (see DependsOn)
+// from a context, keyed by task ID. The result of a dependency is the data it wrote with
+// its ResultWriter before completing, so that a task can consume the output of the tasks
+// it depends on without an external store.
+//
+// Return value ok is false if none of the dependencies of the task wrote a result.
+// Dependencies which wrote no result, or which were deleted before the task was enqueued,
+// are missing from the map.
+func GetDependencyResults(ctx context.Context) (results map[string][]byte, ok bool) {
+	return asynqcontext.GetDependencyResults(ctx)
+}
@@ -0,0 +1,273 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/log"
+)
+
+// debugServer serves HTTP endpoints to debug a running server:
+//
+//	/debug/pprof/            runtime profiles in the format of net/http/pprof
+//	/debug/asynq/server      server info and configuration
+//	/debug/asynq/workers     active workers
+//	/debug/asynq/broker      broker connectivity
+//
+// Note: Profiles are served with runtime/pprof directly instead of importing
+// net/http/pprof, which registers its handlers on http.DefaultServeMux of
+// every program importing this package.
+type debugServer struct {
+	logger *log.Logger
+	broker base.Broker
+
+	// address to listen on, debug server is disabled if empty.
+	addr string
+
+	// config is the effective configuration of the server.
+	config *debugConfig
+
+	// state returns the current state of the server.
+	state func(ctx context.Context) (*serverSnapshot, error)
+
+	mu     sync.Mutex
+	server *http.Server
+}
+
+type debugServerParams struct {
+	logger *log.Logger
+	broker base.Broker
+	addr   string
+	config *debugConfig
+	state  func(ctx context.Context) (*serverSnapshot, error)
+}
+
+func newDebugServer(params debugServerParams) *debugServer {
+	return &debugServer{
+		logger: params.logger,
+		broker: params.broker,
+		addr:   params.addr,
+		config: params.config,
+		state:  params.state,
+	}
+}
+
+// debugConfig is the configuration of the server after defaults are applied.
+type debugConfig struct {
+	Queues              map[string]int    `json:"queues"`
+	StrictPriority      bool              `json:"strict_priority"`
+	QueueConcurrency    map[string]int    `json:"queue_concurrency,omitempty"`
+	ClassConcurrency    map[string]int    `json:"class_concurrency,omitempty"`
+	Labels              map[string]string `json:"labels,omitempty"`
+	Environment         string            `json:"environment,omitempty"`
+	ShutdownTimeout     string            `json:"shutdown_timeout"`
+	HealthCheckInterval string            `json:"health_check_interval"`
+	PollInterval        string            `json:"poll_interval"`
+	MinPollInterval     string            `json:"min_poll_interval"`
+	LogLevel            string            `json:"log_level"`
+}
+
+func (d *debugServer) start(wg *sync.WaitGroup) {
+	if d.addr == "" {
+		return
+	}
+	// Listen synchronously so that the address is in use by the time the server starts.
+	l, err := net.Listen("tcp", d.addr)
+	if err != nil {
+		d.logger.Errorf("Could not start debug server: %v", err)
+		return
+	}
+	srv := &http.Server{Handler: d.handler()}
+	d.mu.Lock()
+	d.server = srv
+	d.mu.Unlock()
+	d.logger.Infof("Serving debug endpoints on %s", l.Addr())
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			d.logger.Errorf("Debug server stopped: %v", err)
+		}
+	}()
+}
+
+func (d *debugServer) shutdown() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.server == nil {
+		return
+	}
+	d.logger.Debug("Debug server shutting down...")
+	// Note: Close instead of waiting for requests, a CPU profile may take a while.
+	d.server.Close()
+	d.server = nil
+}
+
+func (d *debugServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", servePprof)
+	mux.HandleFunc("/debug/asynq/server", d.serveServer)
+	mux.HandleFunc("/debug/asynq/workers", d.serveWorkers)
+	mux.HandleFunc("/debug/asynq/broker", d.serveBroker)
+	return mux
+}
+
+// debugStateTimeout is the maximum time to wait for the state of the server.
+const debugStateTimeout = 5 * time.Second
+
+func (d *debugServer) currentState(r *http.Request) (*serverSnapshot, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), debugStateTimeout)
+	defer cancel()
+	return d.state(ctx)
+}
+
+func (d *debugServer) serveServer(w http.ResponseWriter, r *http.Request) {
+	s, err := d.currentState(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not get server state: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		ID                string       `json:"id"`
+		Host              string       `json:"host"`
+		PID               int          `json:"pid"`
+		Status            string       `json:"status"`
+		Started           time.Time    `json:"started"`
+		Concurrency       int          `json:"concurrency"`
+		ActiveWorkerCount int          `json:"active_worker_count"`
+		Config            *debugConfig `json:"config"`
+	}{
+		ID:                s.info.ServerID,
+		Host:              s.info.Host,
+		PID:               s.info.PID,
+		Status:            s.info.Status,
+		Started:           s.info.Started,
+		Concurrency:       s.info.Concurrency,
+		ActiveWorkerCount: s.info.ActiveWorkerCount,
+		Config:            d.config,
+	})
+}
+
+type debugWorker struct {
+	TaskID   string    `json:"task_id"`
+	TaskType string    `json:"task_type"`
+	Queue    string    `json:"queue"`
+	Started  time.Time `json:"started"`
+	Deadline time.Time `json:"deadline"`
+}
+
+func (d *debugServer) serveWorkers(w http.ResponseWriter, r *http.Request) {
+	s, err := d.currentState(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not get server state: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	workers := make([]*debugWorker, 0, len(s.workers))
+	for _, w := range s.workers {
+		workers = append(workers, &debugWorker{
+			TaskID:   w.ID,
+			TaskType: w.Type,
+			Queue:    w.Queue,
+			Started:  w.Started,
+			Deadline: w.Deadline,
+		})
+	}
+	sort.Slice(workers, func(i, j int) bool { return workers[i].Started.Before(workers[j].Started) })
+	writeJSON(w, http.StatusOK, workers)
+}
+
+func (d *debugServer) serveBroker(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	err := d.broker.Ping()
+	res := struct {
+		OK      bool   `json:"ok"`
+		Latency string `json:"latency"`
+		Error   string `json:"error,omitempty"`
+	}{OK: err == nil, Latency: time.Since(start).String()}
+	code := http.StatusOK
+	if err != nil {
+		res.Error = err.Error()
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, res)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// servePprof serves runtime profiles at /debug/pprof/<name>,
+// compatible with go tool pprof.
+func servePprof(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/")
+	switch name {
+	case "":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		profiles := pprof.Profiles()
+		sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name() < profiles[j].Name() })
+		for _, p := range profiles {
+			fmt.Fprintf(w, "%d\t%s\n", p.Count(), p.Name())
+		}
+		fmt.Fprintf(w, "-\tprofile (CPU profile, ?seconds=N)\n")
+	case "profile":
+		serveCPUProfile(w, r)
+	default:
+		p := pprof.Lookup(name)
+		if p == nil {
+			http.Error(w, fmt.Sprintf("unknown profile %q", name), http.StatusNotFound)
+			return
+		}
+		debug, _ := strconv.Atoi(r.FormValue("debug"))
+		if name == "heap" && r.FormValue("gc") != "" {
+			runtime.GC()
+		}
+		if debug == 0 {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		} else {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+		p.WriteTo(w, debug)
+	}
+}
+
+func serveCPUProfile(w http.ResponseWriter, r *http.Request) {
+	sec, err := strconv.Atoi(r.FormValue("seconds"))
+	if err != nil || sec <= 0 {
+		sec = 30
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+	if err := pprof.StartCPUProfile(w); err != nil {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Del("Content-Disposition")
+		http.Error(w, fmt.Sprintf("could not enable CPU profiling: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer pprof.StopCPUProfile()
+	timer := time.NewTimer(time.Duration(sec) * time.Second)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/hibiken/asynq/internal/testbroker"
+)
+
+func TestDebugServer(t *testing.T) {
+	r := rdb.NewRDB(setup(t))
+	defer r.Close()
+	broker := testbroker.NewTestBroker(r)
+	starting := make(chan *workerInfo)
+	finished := make(chan *base.TaskMessage)
+	hb := newHeartbeater(heartbeaterParams{
+		logger:      testLogger,
+		broker:      broker,
+		interval:    time.Hour,
+		concurrency: 10,
+		queues:      map[string]int{"default": 1},
+		state:       base.NewServerState(),
+		starting:    starting,
+		finished:    finished,
+	})
+	var wg sync.WaitGroup
+	hb.start(&wg)
+	defer hb.shutdown()
+
+	msg := h.NewTaskMessage("send_email", nil)
+	starting <- &workerInfo{msg: msg, started: time.Now(), deadline: time.Now().Add(time.Minute)}
+
+	d := newDebugServer(debugServerParams{
+		logger: testLogger,
+		broker: broker,
+		config: &debugConfig{Queues: map[string]int{"default": 1}, ShutdownTimeout: "8s"},
+		state:  hb.currentState,
+	})
+	ts := httptest.NewServer(d.handler())
+	defer ts.Close()
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s returned error: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(body)
+	}
+
+	code, body := get("/debug/asynq/server")
+	if code != http.StatusOK {
+		t.Fatalf("GET /debug/asynq/server returned %d: %s", code, body)
+	}
+	var server struct {
+		ID                string       `json:"id"`
+		Concurrency       int          `json:"concurrency"`
+		ActiveWorkerCount int          `json:"active_worker_count"`
+		Config            *debugConfig `json:"config"`
+	}
+	if err := json.Unmarshal([]byte(body), &server); err != nil {
+		t.Fatalf("could not decode server info %q: %v", body, err)
+	}
+	if server.ID != hb.serverID || server.Concurrency != 10 || server.ActiveWorkerCount != 1 {
+		t.Errorf("GET /debug/asynq/server returned %s, want id=%q concurrency=10 active_worker_count=1", body, hb.serverID)
+	}
+	if server.Config == nil || server.Config.ShutdownTimeout != "8s" {
+		t.Errorf("GET /debug/asynq/server returned config %+v, want shutdown timeout 8s", server.Config)
+	}
+
+	code, body = get("/debug/asynq/workers")
+	var workers []*debugWorker
+	if err := json.Unmarshal([]byte(body), &workers); err != nil || code != http.StatusOK {
+		t.Fatalf("GET /debug/asynq/workers returned %d %q", code, body)
+	}
+	if len(workers) != 1 || workers[0].TaskID != msg.ID || workers[0].TaskType != "send_email" {
+		t.Errorf("GET /debug/asynq/workers returned %s, want the worker processing task %q", body, msg.ID)
+	}
+
+	if code, body := get("/debug/asynq/broker"); code != http.StatusOK || !strings.Contains(body, `"ok": true`) {
+		t.Errorf("GET /debug/asynq/broker returned %d %q, want 200 with ok", code, body)
+	}
+	broker.Sleep()
+	if code, body := get("/debug/asynq/broker"); code != http.StatusServiceUnavailable || !strings.Contains(body, `"ok": false`) {
+		t.Errorf("GET /debug/asynq/broker with broker down returned %d %q, want 503", code, body)
+	}
+	broker.Wakeup()
+
+	if code, body := get("/debug/pprof/"); code != http.StatusOK || !strings.Contains(body, "goroutine") {
+		t.Errorf("GET /debug/pprof/ returned %d %q, want 200 with the list of profiles", code, body)
+	}
+	if code, body := get("/debug/pprof/goroutine?debug=1"); code != http.StatusOK || !strings.Contains(body, "goroutine profile") {
+		t.Errorf("GET /debug/pprof/goroutine?debug=1 returned %d %q, want 200 with the goroutine profile", code, body)
+	}
+	if code, _ := get("/debug/pprof/nonexistent"); code != http.StatusNotFound {
+		t.Errorf("GET /debug/pprof/nonexistent returned %d, want 404", code)
+	}
+}
+
+func TestDebugServerStartAndShutdown(t *testing.T) {
+	r := rdb.NewRDB(setup(t))
+	defer r.Close()
+	d := newDebugServer(debugServerParams{
+		logger: testLogger,
+		broker: r,
+		addr:   "localhost:0",
+		config: &debugConfig{},
+	})
+	var wg sync.WaitGroup
+	d.start(&wg)
+	d.shutdown()
+	wg.Wait()
+	d.shutdown() // shutdown is a no-op once the server is closed.
+
+	// The debug server is disabled if the address is empty.
+	d = newDebugServer(debugServerParams{logger: testLogger, broker: r, config: &debugConfig{}})
+	d.start(&wg)
+	d.shutdown()
+	wg.Wait()
+}
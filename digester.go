@@ -0,0 +1,191 @@
+// Copyright 2021 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/log"
+)
+
+// ExpiryDigest summarizes the archived tasks of a queue which are about to be
+// deleted permanently by the retention policy of the archive, which keeps
+// archived tasks for 90 days and at most 10,000 tasks per queue.
+type ExpiryDigest struct {
+	// Queue is the name of the queue.
+	Queue string
+
+	// Count is the number of tasks deleted by the time ExpiresBy.
+	Count int
+
+	// Trimmed is the number of the tasks deleted to keep the archive within its
+	// maximum size rather than by age, assuming tasks keep being archived at the
+	// rate of the last day. These are the oldest tasks of the archive.
+	Trimmed int
+
+	// CountByType is the number of the tasks of each type.
+	CountByType map[string]int
+
+	// OldestArchivedAt and NewestArchivedAt are the times the oldest and the
+	// newest of the tasks were archived.
+	OldestArchivedAt time.Time
+	NewestArchivedAt time.Time
+
+	// ExpiresBy is the time by which the tasks may be deleted.
+	ExpiresBy time.Time
+}
+
+// ExpiryNotifier delivers the digests of the expiring archived tasks,
+// e.g. to a chat channel or by email.
+//
+// See Config.ExpiryNotifier for how the digests are made.
+type ExpiryNotifier interface {
+	NotifyExpiry(ctx context.Context, d *ExpiryDigest) error
+}
+
+// ExpiryNotifierFunc is an adapter to allow the use of ordinary functions as an ExpiryNotifier.
+type ExpiryNotifierFunc func(ctx context.Context, d *ExpiryDigest) error
+
+// NotifyExpiry calls fn(ctx, d).
+func (fn ExpiryNotifierFunc) NotifyExpiry(ctx context.Context, d *ExpiryDigest) error {
+	return fn(ctx, d)
+}
+
+const (
+	// expiryDigestPeriod is the period of the digests, and how far ahead the
+	// digests look for expiring tasks.
+	expiryDigestPeriod = 24 * time.Hour
+
+	// expiryDigestCheckInterval is the interval between checks for a digest to make.
+	// It's shorter than the period so that restarts of the servers don't delay digests.
+	expiryDigestCheckInterval = time.Hour
+
+	// expiryNotifyTimeout is the maximum duration of a call to the notifier.
+	expiryNotifyTimeout = 30 * time.Second
+
+	// expiryDigestClaim is how long a server has to make and deliver a digest
+	// before another server may make it.
+	expiryDigestClaim = 5 * time.Minute
+)
+
+// A digester is responsible for notifying the archived tasks about to expire.
+// Once a period, it makes a digest of the archived tasks of each queue to be
+// deleted within the period, and calls the notifier with the digest.
+// The servers share the digests, so that each digest is made only once;
+// a digest which failed to be delivered is made again on the next check.
+type digester struct {
+	logger   *log.Logger
+	broker   base.Broker
+	notifier ExpiryNotifier
+
+	// channel to communicate back to the long running "digester" goroutine.
+	done chan struct{}
+
+	// list of queue names to digest.
+	queues []string
+
+	// interval between checks for a digest to make.
+	interval time.Duration
+
+	// period of the digests.
+	period time.Duration
+}
+
+type digesterParams struct {
+	logger   *log.Logger
+	broker   base.Broker
+	notifier ExpiryNotifier
+	queues   []string
+	interval time.Duration
+	period   time.Duration
+}
+
+func newDigester(params digesterParams) *digester {
+	return &digester{
+		logger:   params.logger,
+		broker:   params.broker,
+		notifier: params.notifier,
+		done:     make(chan struct{}),
+		queues:   params.queues,
+		interval: params.interval,
+		period:   params.period,
+	}
+}
+
+func (d *digester) shutdown() {
+	if d.notifier == nil {
+		return
+	}
+	d.logger.Debug("Digester shutting down...")
+	// Signal the digester goroutine to stop.
+	d.done <- struct{}{}
+}
+
+// start starts the "digester" goroutine.
+func (d *digester) start(wg *sync.WaitGroup) {
+	if d.notifier == nil {
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		d.exec()
+		timer := time.NewTimer(d.interval)
+		for {
+			select {
+			case <-d.done:
+				d.logger.Debug("Digester done")
+				timer.Stop()
+				return
+			case <-timer.C:
+				d.exec()
+				timer.Reset(d.interval)
+			}
+		}
+	}()
+}
+
+func (d *digester) exec() {
+	for _, qname := range d.queues {
+		// Note: The broker returns nil if the queue was digested within the period.
+		summary, err := d.broker.ClaimExpiryDigest(qname, d.period, d.period, expiryDigestClaim)
+		if err != nil {
+			d.logger.Errorf("Could not list expiring archived tasks of queue %q: %v", qname, err)
+			continue
+		}
+		if summary == nil {
+			continue
+		}
+		digest := makeExpiryDigest(qname, summary, time.Now().Add(d.period))
+		ctx, cancel := context.WithTimeout(context.Background(), expiryNotifyTimeout)
+		err = d.notifier.NotifyExpiry(ctx, digest)
+		cancel()
+		if err != nil {
+			d.logger.Errorf("Could not notify expiring archived tasks of queue %q: %v", qname, err)
+		}
+		if err := d.broker.FinishExpiryDigest(qname, d.period, err == nil); err != nil {
+			d.logger.Errorf("Could not record the digest of expiring archived tasks of queue %q: %v", qname, err)
+		}
+	}
+}
+
+// makeExpiryDigest makes the digest of the given summary of expiring archived tasks.
+func makeExpiryDigest(qname string, summary *base.ExpiringArchived, expiresBy time.Time) *ExpiryDigest {
+	digest := &ExpiryDigest{
+		Queue:            qname,
+		Trimmed:          summary.Trimmed,
+		CountByType:      summary.CountByType,
+		OldestArchivedAt: summary.OldestArchivedAt,
+		NewestArchivedAt: summary.NewestArchivedAt,
+		ExpiresBy:        expiresBy,
+	}
+	for _, n := range summary.CountByType {
+		digest.Count += n
+	}
+	return digest
+}
@@ -0,0 +1,94 @@
+// Copyright 2021 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/rdb"
+)
+
+func TestDigester(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	h.FlushDB(t, r)
+	now := time.Now()
+	expired := now.AddDate(0, 0, -90)
+	entries := []base.Z{
+		{Message: h.NewTaskMessage("send_email", nil), Score: expired.Add(-time.Hour).Unix()},
+		{Message: h.NewTaskMessage("send_email", nil), Score: expired.Add(time.Hour).Unix()},
+		{Message: h.NewTaskMessage("reindex", nil), Score: expired.Add(2 * time.Hour).Unix()},
+		// Archived too recently to be deleted within the next day.
+		{Message: h.NewTaskMessage("reindex", nil), Score: now.Unix()},
+	}
+	h.SeedArchivedQueue(t, r, entries, "default")
+
+	var (
+		mu       sync.Mutex
+		attempts int
+		digests  []*ExpiryDigest
+	)
+	notifier := ExpiryNotifierFunc(func(ctx context.Context, d *ExpiryDigest) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts == 1 {
+			// A digest which failed to be delivered is made again on the next check.
+			return errors.New("notification failed")
+		}
+		digests = append(digests, d)
+		return nil
+	})
+	// Two servers share the digests.
+	var (
+		wg        sync.WaitGroup
+		digesters []*digester
+	)
+	for i := 0; i < 2; i++ {
+		d := newDigester(digesterParams{
+			logger:   testLogger,
+			broker:   rdb.NewRDB(r),
+			notifier: notifier,
+			queues:   []string{"default", "custom"},
+			interval: 100 * time.Millisecond,
+			period:   24 * time.Hour,
+		})
+		d.start(&wg)
+		digesters = append(digesters, d)
+	}
+	time.Sleep(500 * time.Millisecond)
+	for _, d := range digesters {
+		d.shutdown()
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(digests) != 1 || attempts != 2 {
+		t.Fatalf("got %d digests in %d attempts, want 1 digest in 2 attempts", len(digests), attempts)
+	}
+	got := digests[0]
+	want := &ExpiryDigest{
+		Queue:            "default",
+		Count:            3,
+		CountByType:      map[string]int{"send_email": 2, "reindex": 1},
+		OldestArchivedAt: time.Unix(entries[0].Score, 0),
+		NewestArchivedAt: time.Unix(entries[2].Score, 0),
+	}
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreFields(ExpiryDigest{}, "ExpiresBy")); diff != "" {
+		t.Errorf("digest mismatch (-want,+got):\n%s", diff)
+	}
+	if d := got.ExpiresBy.Sub(now); d < 24*time.Hour || d > 25*time.Hour {
+		t.Errorf("digest expires by %v, want in a day", got.ExpiresBy)
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// ErrEnvironmentMismatch indicates that the redis database is labeled with
+// an environment other than the one of the client or server.
+//
+// See Config.Environment for details.
+var ErrEnvironmentMismatch = errors.New("asynq: environment mismatch")
+
+// checkEnvironment labels the database of the broker with env unless it's already labeled,
+// and returns an error wrapping ErrEnvironmentMismatch if it's labeled with another environment.
+// It's a no-op if env is empty.
+func checkEnvironment(broker base.Broker, env string) error {
+	if env == "" {
+		return nil
+	}
+	got, err := broker.ClaimEnvironment(env)
+	if err != nil {
+		return fmt.Errorf("asynq: could not check environment: %w", err)
+	}
+	if got != env {
+		return fmt.Errorf("%w: redis database belongs to environment %q, not %q", ErrEnvironmentMismatch, got, env)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+func TestClientEnvironment(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+
+	staging := NewClientWithConfig(getRedisConnOpt(t), ClientConfig{Environment: "staging"})
+	defer staging.Close()
+	if _, err := staging.Enqueue(NewTask("send_email", nil)); err != nil {
+		t.Fatalf("Enqueue returned error: %v", err)
+	}
+	production := NewClientWithConfig(getRedisConnOpt(t), ClientConfig{Environment: "production"})
+	defer production.Close()
+	if _, err := production.Enqueue(NewTask("send_email", nil)); !errors.Is(err, ErrEnvironmentMismatch) {
+		t.Errorf("Enqueue to a database of another environment returned %v, want ErrEnvironmentMismatch", err)
+	}
+	if n := len(h.GetPendingMessages(t, r, base.DefaultQueueName)); n != 1 {
+		t.Errorf("got %d pending tasks, want 1", n)
+	}
+
+	inspector := NewInspector(getRedisConnOpt(t))
+	defer inspector.Close()
+	info, err := inspector.GetQueueInfo(base.DefaultQueueName)
+	if err != nil {
+		t.Fatalf("GetQueueInfo returned error: %v", err)
+	}
+	if info.Environment != "staging" {
+		t.Errorf("QueueInfo.Environment = %q, want %q", info.Environment, "staging")
+	}
+}
+
+func TestServerEnvironment(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	client := NewClientWithConfig(getRedisConnOpt(t), ClientConfig{Environment: "staging"})
+	defer client.Close()
+	if _, err := client.Enqueue(NewTask("send_email", nil)); err != nil {
+		t.Fatalf("Enqueue returned error: %v", err)
+	}
+	handler := HandlerFunc(func(ctx context.Context, task *Task) error { return nil })
+
+	srv := NewServer(getRedisConnOpt(t), Config{LogLevel: testLogLevel, Environment: "production"})
+	if err := srv.Start(handler); !errors.Is(err, ErrEnvironmentMismatch) {
+		t.Errorf("Start in a database of another environment returned %v, want ErrEnvironmentMismatch", err)
+		srv.Shutdown()
+	}
+
+	srv = NewServer(getRedisConnOpt(t), Config{LogLevel: testLogLevel, Environment: "staging"})
+	if err := srv.Start(handler); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	defer srv.Shutdown()
+	time.Sleep(time.Second) // wait for the first heartbeat
+	inspector := NewInspector(getRedisConnOpt(t))
+	defer inspector.Close()
+	servers, err := inspector.Servers()
+	if err != nil {
+		t.Fatalf("Servers returned error: %v", err)
+	}
+	if len(servers) != 1 || servers[0].Environment != "staging" {
+		t.Errorf("Servers() = %v, want one server in environment %q", servers, "staging")
+	}
+}
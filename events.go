@@ -0,0 +1,119 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/rdb"
+)
+
+// QueueEvent is a change in a queue, delivered to the subscribers of the queue.
+//
+// See Config.PublishEvents for how to enable publishing of events.
+type QueueEvent struct {
+	// Queue is the name of the queue the event belongs to.
+	Queue string
+
+	// Event is "completed" for a task processed successfully,
+	// or one of the events recorded in the audit log (see AuditEvent.Event).
+	// For example, a failed task is "retried", and a task which
+	// exhausted its retries is "archived".
+	Event string
+
+	// TaskID, TaskType, State, Count, Reason, Operator and Actor
+	// are the same as the fields of AuditEvent.
+	TaskID   string
+	TaskType string
+	State    string
+	Count    int
+	Reason   string
+	Operator bool
+	Actor    string
+
+	// Time is the time the event was published.
+	Time time.Time
+}
+
+// Subscription delivers the events of the queues subscribed to with Inspector.Subscribe.
+type Subscription struct {
+	pubsub *redis.PubSub
+	ch     chan *QueueEvent
+	done   chan struct{}
+	once   sync.Once
+}
+
+// Subscribe subscribes to the events of the specified queues,
+// or of all queues if no queue is specified.
+//
+// Events are delivered as they happen, so that dashboards can update live
+// instead of polling GetQueueInfo. Events published while no one is subscribed
+// are not delivered, and events may be dropped if the receiver falls behind.
+//
+// The caller must call Close on the returned Subscription once done.
+func (i *Inspector) Subscribe(qnames ...string) (*Subscription, error) {
+	for _, qname := range qnames {
+		if err := base.ValidateQueueName(qname); err != nil {
+			return nil, fmt.Errorf("asynq: %w", err)
+		}
+	}
+	pubsub, err := i.rdb.EventsPubSub(qnames...)
+	if err != nil {
+		return nil, fmt.Errorf("asynq: %w", err)
+	}
+	s := &Subscription{
+		pubsub: pubsub,
+		ch:     make(chan *QueueEvent, 100),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *Subscription) run() {
+	defer close(s.ch)
+	for msg := range s.pubsub.Channel() {
+		e, err := rdb.DecodeQueueEvent(msg)
+		if err != nil {
+			continue
+		}
+		select {
+		case s.ch <- &QueueEvent{
+			Queue:    e.Queue,
+			Event:    e.Event,
+			TaskID:   e.TaskID,
+			TaskType: e.TaskType,
+			State:    e.State,
+			Count:    e.Count,
+			Reason:   e.Reason,
+			Operator: e.Operator,
+			Actor:    e.Actor,
+			Time:     e.Time,
+		}:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Channel returns the channel of the events.
+// The channel is closed after Close is called.
+func (s *Subscription) Channel() <-chan *QueueEvent {
+	return s.ch
+}
+
+// Close unsubscribes from the events and closes the channel of the events.
+func (s *Subscription) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.done)
+		err = s.pubsub.Close()
+	})
+	return err
+}
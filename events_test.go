@@ -0,0 +1,67 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestInspectorSubscribe(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	client := NewClientWithConfig(getRedisConnOpt(t), ClientConfig{PublishEvents: true})
+	defer client.Close()
+	inspector := NewInspectorWithConfig(getRedisConnOpt(t), InspectorConfig{PublishEvents: true})
+	defer inspector.Close()
+
+	sub, err := inspector.Subscribe("email")
+	if err != nil {
+		t.Fatalf("Subscribe returned error: %v", err)
+	}
+	info, err := client.Enqueue(NewTask("send_email", nil), Queue("email"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Events of other queues are not delivered.
+	if _, err := client.Enqueue(NewTask("resize", nil), Queue("image")); err != nil {
+		t.Fatal(err)
+	}
+	if err := inspector.DeleteTask("email", info.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []*QueueEvent{
+		{Queue: "email", Event: "enqueued", TaskID: info.ID, TaskType: "send_email", Count: 1},
+		{Queue: "email", Event: "deleted", TaskID: info.ID, Count: 1, Operator: true},
+	}
+	var got []*QueueEvent
+	for range want {
+		select {
+		case e := <-sub.Channel():
+			got = append(got, e)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for events; got %v", got)
+		}
+	}
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreFields(QueueEvent{}, "Time")); diff != "" {
+		t.Errorf("Subscribe delivered unexpected events; (-want,+got)\n%s", diff)
+	}
+
+	if err := sub.Close(); err != nil {
+		t.Errorf("Close returned error: %v", err)
+	}
+	select {
+	case _, ok := <-sub.Channel():
+		if ok {
+			t.Errorf("Channel delivered an event after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Channel is not closed after Close")
+	}
+}
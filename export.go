@@ -0,0 +1,373 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/errors"
+	"github.com/hibiken/asynq/internal/rdb"
+)
+
+// archivedTaskRecord is the representation of an archived task written by
+// ExportArchivedTasks. Each record is written as a JSON object on its own line.
+type archivedTaskRecord struct {
+	ID         string            `json:"id"`
+	Queue      string            `json:"queue"`
+	Type       string            `json:"type"`
+	Payload    []byte            `json:"payload"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	MaxRetry   int               `json:"max_retry"`
+	Retried    int               `json:"retried"`
+	LastErr    string            `json:"last_err,omitempty"`
+	ArchivedAt time.Time         `json:"archived_at"`
+
+	ErrorHistory  []string `json:"error_history,omitempty"`
+	ArchiveReason string   `json:"archive_reason,omitempty"`
+
+	// Zero value indicates no value.
+	LastFailedAt time.Time `json:"last_failed_at"`
+	Deadline     time.Time `json:"deadline"`
+
+	TimeoutSeconds   int64 `json:"timeout_seconds"`
+	RetentionSeconds int64 `json:"retention_seconds,omitempty"`
+
+	UniqueKey      string            `json:"unique_key,omitempty"`
+	IdempotencyKey string            `json:"idempotency_key,omitempty"`
+	GroupKey       string            `json:"group_key,omitempty"`
+	Dependencies   []string          `json:"dependencies,omitempty"`
+	Class          string            `json:"class,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	AtMostOnce     bool              `json:"at_most_once,omitempty"`
+	DefaultRetry   bool              `json:"default_retry,omitempty"`
+	ClonedFrom     string            `json:"cloned_from,omitempty"`
+
+	// Zero value indicates no value.
+	ExpiresAt  time.Time `json:"expires_at"`
+	EnqueuedAt time.Time `json:"enqueued_at"`
+
+	// PayloadSize and PayloadDigest are set if the payload was truncated
+	// when the task was archived, see Config.MaxArchivedPayloadSize.
+	PayloadSize   int64  `json:"payload_size,omitempty"`
+	PayloadDigest string `json:"payload_digest,omitempty"`
+	PayloadRef    string `json:"payload_ref,omitempty"`
+
+	// Signature covers the queue of the task, see ImportArchivedTasks.
+	Signature []byte `json:"signature,omitempty"`
+
+	// SchemaVersion and UnknownFields hold the fields of a message encoded
+	// by a newer version, so that they're kept across the export.
+	SchemaVersion int    `json:"schema_version,omitempty"`
+	UnknownFields []byte `json:"unknown_fields,omitempty"`
+}
+
+// toUnixTimeOrZero is the inverse of fromUnixTimeOrZero.
+func toUnixTimeOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// fromUnixNanoOrZero returns the time of the given Unix time in nanoseconds,
+// or the zero time if n is zero.
+func fromUnixNanoOrZero(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// toUnixNanoOrZero is the inverse of fromUnixNanoOrZero.
+func toUnixNanoOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func newArchivedTaskRecord(z base.Z) *archivedTaskRecord {
+	msg := z.Message
+	return &archivedTaskRecord{
+		ID:               msg.ID,
+		Queue:            msg.Queue,
+		Type:             msg.Type,
+		Payload:          msg.Payload,
+		Headers:          msg.Headers,
+		MaxRetry:         msg.Retry,
+		Retried:          msg.Retried,
+		LastErr:          msg.ErrorMsg,
+		ArchivedAt:       time.Unix(z.Score, 0).UTC(),
+		LastFailedAt:     fromUnixTimeOrZero(msg.LastFailedAt).UTC(),
+		Deadline:         fromUnixTimeOrZero(msg.Deadline).UTC(),
+		TimeoutSeconds:   msg.Timeout,
+		RetentionSeconds: msg.Retention,
+		ErrorHistory:     msg.ErrorHistory,
+		ArchiveReason:    msg.ArchiveReason,
+		UniqueKey:        msg.UniqueKey,
+		IdempotencyKey:   msg.IdempotencyKey,
+		GroupKey:         msg.GroupKey,
+		Dependencies:     msg.Dependencies,
+		Class:            msg.Class,
+		Labels:           msg.Labels,
+		AtMostOnce:       msg.AtMostOnce,
+		DefaultRetry:     msg.DefaultRetry,
+		ClonedFrom:       msg.ClonedFrom,
+		ExpiresAt:        fromUnixTimeOrZero(msg.ExpiresAt).UTC(),
+		EnqueuedAt:       fromUnixNanoOrZero(msg.EnqueuedAt).UTC(),
+		PayloadSize:      msg.PayloadSize,
+		PayloadDigest:    msg.PayloadDigest,
+		PayloadRef:       msg.PayloadRef,
+		Signature:        msg.Signature,
+		SchemaVersion:    msg.SchemaVersion,
+		UnknownFields:    msg.UnknownFields,
+	}
+}
+
+func (rec *archivedTaskRecord) message(qname string) *base.TaskMessage {
+	return &base.TaskMessage{
+		ID:           rec.ID,
+		Queue:        qname,
+		Type:         rec.Type,
+		Payload:      rec.Payload,
+		Headers:      rec.Headers,
+		Retry:        rec.MaxRetry,
+		Retried:      rec.Retried,
+		ErrorMsg:     rec.LastErr,
+		LastFailedAt: toUnixTimeOrZero(rec.LastFailedAt),
+		Deadline:     toUnixTimeOrZero(rec.Deadline),
+		Timeout:      rec.TimeoutSeconds,
+		Retention:    rec.RetentionSeconds,
+
+		ErrorHistory:  rec.ErrorHistory,
+		ArchiveReason: rec.ArchiveReason,
+
+		UniqueKey:      rec.UniqueKey,
+		IdempotencyKey: rec.IdempotencyKey,
+		GroupKey:       rec.GroupKey,
+		Dependencies:   rec.Dependencies,
+		Class:          rec.Class,
+		Labels:         rec.Labels,
+		AtMostOnce:     rec.AtMostOnce,
+		DefaultRetry:   rec.DefaultRetry,
+		ClonedFrom:     rec.ClonedFrom,
+		ExpiresAt:      toUnixTimeOrZero(rec.ExpiresAt),
+		EnqueuedAt:     toUnixNanoOrZero(rec.EnqueuedAt),
+		PayloadSize:    rec.PayloadSize,
+		PayloadDigest:  rec.PayloadDigest,
+		PayloadRef:     rec.PayloadRef,
+		Signature:      rec.Signature,
+		SchemaVersion:  rec.SchemaVersion,
+		UnknownFields:  rec.UnknownFields,
+	}
+}
+
+// exportPageSize is the number of tasks read from redis at a time
+// by ExportArchivedTasks and TaskIterator.
+const exportPageSize = 100
+
+// ExportArchivedTasks writes all archived tasks in the specified queue to w
+// in JSON Lines format (i.e. one JSON object per line), and returns the number
+// of tasks written.
+//
+// Each line holds the task along with its metadata and the time it was archived,
+// and can be read back with ImportArchivedTasks.
+// Tasks are not removed from the queue; use DeleteAllArchivedTasks after the export
+// to free up the memory in redis.
+//
+// Tasks are read from redis a page at a time as they are written, so exporting
+// millions of tasks uses little memory and a slow writer (e.g. an http.ResponseWriter
+// streaming the export to a client) slows down the reads from redis.
+// Each task archived before the export starts is written exactly once; tasks archived
+// while the export is in progress may or may not be included.
+func (i *Inspector) ExportArchivedTasks(qname string, w io.Writer) (int, error) {
+	if err := base.ValidateQueueName(qname); err != nil {
+		return 0, fmt.Errorf("asynq: %w", err)
+	}
+	enc := json.NewEncoder(w)
+	n := 0
+	var cursor rdb.ZSetCursor
+	for {
+		page, err := i.rdb.ListTasksAfter(qname, base.TaskStateArchived, cursor, exportPageSize)
+		switch {
+		case errors.IsQueueNotFound(err):
+			return n, fmt.Errorf("asynq: %w", ErrQueueNotFound)
+		case err != nil:
+			return n, fmt.Errorf("asynq: %w", err)
+		}
+		if len(page.Tasks) == 0 {
+			return n, nil
+		}
+		for j, info := range page.Tasks {
+			z := base.Z{Message: info.Message, Score: page.Scores[j]}
+			if err := enc.Encode(newArchivedTaskRecord(z)); err != nil {
+				return n, fmt.Errorf("asynq: could not write task %q: %v", z.Message.ID, err)
+			}
+			n++
+		}
+		cursor = page.Next
+	}
+}
+
+// TaskIterator iterates over the tasks of a queue in a state, reading them from
+// redis a page at a time as the iteration proceeds. See Inspector.IterateTasks.
+//
+// Example:
+//
+//	it := inspector.IterateTasks("default", asynq.TaskStateArchived)
+//	for it.Next() {
+//	    info := it.Task()
+//	    // ...
+//	}
+//	if err := it.Err(); err != nil {
+//	    // ...
+//	}
+type TaskIterator struct {
+	inspector *Inspector
+	qname     string
+	state     base.TaskState
+	pageSize  int
+
+	cursor rdb.ZSetCursor
+	tasks  []*base.TaskInfo
+	task   *TaskInfo
+	done   bool
+	err    error
+}
+
+// IterateTasks returns an iterator over the tasks of the queue in the given state,
+// in increasing order of score: the time the task is scheduled to be processed at
+// (scheduled, retry), the time the task was archived (archived, waiting, unhandled),
+// or the time the task expires at (completed). Pending and active tasks are held in
+// lists, not sorted sets; use ListPendingTasks and ListActiveTasks to list them.
+//
+// The next page of tasks is read from redis only once the tasks read before are
+// consumed, so the iteration holds at most a page of tasks in memory and proceeds
+// at the pace of the caller, e.g. to stream millions of archived tasks to a client.
+// Unlike listing the tasks page by page, adding or deleting tasks during the
+// iteration doesn't shift the pages: each task is returned at most once, and the
+// tasks present for the whole iteration are all returned.
+//
+// The PageSize option specifies the number of tasks read from redis at a time.
+// By default, 100 tasks are read at a time.
+func (i *Inspector) IterateTasks(qname string, state TaskState, opts ...ListOption) *TaskIterator {
+	it := &TaskIterator{inspector: i, qname: qname, pageSize: exportPageSize}
+	for _, opt := range opts {
+		if n, ok := opt.(pageSizeOpt); ok && n > 0 {
+			it.pageSize = int(n)
+		}
+	}
+	if err := base.ValidateQueueName(qname); err != nil {
+		it.err = fmt.Errorf("asynq: %w", err)
+		return it
+	}
+	switch state {
+	case TaskStateScheduled, TaskStateRetry, TaskStateArchived, TaskStateCompleted, TaskStateWaiting, TaskStateUnhandled:
+		it.state, _ = toBaseTaskState(state)
+	default:
+		it.err = fmt.Errorf("asynq: cannot iterate over tasks in %v state", state)
+	}
+	return it
+}
+
+// Next advances the iterator to the next task, which is then returned by Task.
+// It returns false once there are no more tasks or an error occurred;
+// call Err to tell apart the two cases.
+func (it *TaskIterator) Next() bool {
+	if it.err != nil || it.done {
+		return false
+	}
+	if len(it.tasks) == 0 {
+		page, err := it.inspector.rdb.ListTasksAfter(it.qname, it.state, it.cursor, it.pageSize)
+		switch {
+		case errors.IsQueueNotFound(err):
+			it.err = fmt.Errorf("asynq: %w", ErrQueueNotFound)
+			return false
+		case err != nil:
+			it.err = fmt.Errorf("asynq: %w", err)
+			return false
+		}
+		if len(page.Tasks) == 0 {
+			it.done = true
+			return false
+		}
+		it.tasks, it.cursor = page.Tasks, page.Next
+	}
+	info := it.tasks[0]
+	it.tasks = it.tasks[1:]
+	it.task = newTaskInfo(info.Message, info.State, info.NextProcessAt, info.Result)
+	it.task.Payload = it.inspector.redactPayload(it.task.Type, it.task.Payload)
+	return true
+}
+
+// Task returns the current task of the iteration.
+func (it *TaskIterator) Task() *TaskInfo {
+	return it.task
+}
+
+// Err returns the error which stopped the iteration, if any.
+func (it *TaskIterator) Err() error {
+	return it.err
+}
+
+// ImportArchivedTasks reads tasks written by ExportArchivedTasks from r and
+// adds them to the archived tasks of the specified queue, regardless of the
+// queue the tasks were exported from. It returns the number of tasks imported.
+//
+// Signed tasks (see ClientConfig.SigningKey) can only be imported to the queue
+// they were exported from, since the signature covers the queue: importing one to
+// another queue returns an error.
+//
+// Tasks keep their IDs, error messages and the time they were archived.
+// A task whose ID already exists in the queue is skipped, so that the same
+// export can be imported more than once.
+// Imported tasks can be run again with RunTask or RunAllArchivedTasks.
+//
+// Note that archived tasks are trimmed by age and count whenever a task is archived,
+// so tasks archived a long time ago may be deleted soon after they are imported.
+func (i *Inspector) ImportArchivedTasks(qname string, r io.Reader) (int, error) {
+	if err := i.checkWritable(); err != nil {
+		return 0, err
+	}
+	if err := base.ValidateQueueName(qname); err != nil {
+		return 0, fmt.Errorf("asynq: %w", err)
+	}
+	dec := json.NewDecoder(r)
+	n := 0
+	for line := 1; ; line++ {
+		var rec archivedTaskRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, fmt.Errorf("asynq: could not read task #%d: %v", line, err)
+		}
+		if err := validateTaskID(rec.ID); err != nil {
+			return n, fmt.Errorf("asynq: invalid task #%d: %v", line, err)
+		}
+		if strings.TrimSpace(rec.Type) == "" {
+			return n, fmt.Errorf("asynq: invalid task #%d: task typename cannot be empty", line)
+		}
+		if len(rec.Signature) > 0 && rec.Queue != qname {
+			return n, fmt.Errorf("asynq: invalid task #%d: task is signed for queue %q and cannot be imported to queue %q", line, rec.Queue, qname)
+		}
+		archivedAt := rec.ArchivedAt
+		if archivedAt.IsZero() {
+			archivedAt = time.Now()
+		}
+		err := i.rdb.AddArchived(rec.message(qname), archivedAt)
+		switch {
+		case errors.Is(err, errors.ErrTaskIdConflict):
+			continue
+		case err != nil:
+			return n, fmt.Errorf("asynq: %w", err)
+		}
+		n++
+	}
+}
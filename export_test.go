@@ -0,0 +1,237 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+func TestInspectorExportImportArchivedTasks(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	inspector := NewInspector(getRedisConnOpt(t))
+
+	now := time.Now()
+	var entries []base.Z
+	// More than exportPageSize to make sure all pages are exported.
+	for n := 0; n < exportPageSize+20; n++ {
+		msg := h.NewTaskMessage(fmt.Sprintf("task%d", n), []byte(fmt.Sprintf(`{"n": %d}`, n)))
+		msg.Retried = msg.Retry
+		msg.ErrorMsg = "something went wrong"
+		msg.LastFailedAt = now.Add(-time.Duration(n) * time.Minute).Unix()
+		if n%2 == 0 {
+			msg.Headers = map[string]string{"tenant": "acme"}
+			msg.Deadline = now.Add(time.Hour).Unix()
+		}
+		entries = append(entries, base.Z{Message: msg, Score: msg.LastFailedAt})
+	}
+	h.SeedArchivedQueue(t, r, entries, "default")
+
+	var buf bytes.Buffer
+	n, err := inspector.ExportArchivedTasks("default", &buf)
+	if err != nil {
+		t.Fatalf("ExportArchivedTasks returned error: %v", err)
+	}
+	if n != len(entries) {
+		t.Errorf("ExportArchivedTasks returned %d, want %d", n, len(entries))
+	}
+	if got := strings.Count(buf.String(), "\n"); got != len(entries) {
+		t.Errorf("export has %d lines, want %d", got, len(entries))
+	}
+	if got := h.GetArchivedEntries(t, r, "default"); len(got) != len(entries) {
+		t.Errorf("%d archived tasks left after export, want %d", len(got), len(entries))
+	}
+	exported := buf.String()
+
+	if _, err := inspector.DeleteAllArchivedTasks("default"); err != nil {
+		t.Fatal(err)
+	}
+	n, err = inspector.ImportArchivedTasks("default", strings.NewReader(exported))
+	if err != nil {
+		t.Fatalf("ImportArchivedTasks returned error: %v", err)
+	}
+	if n != len(entries) {
+		t.Errorf("ImportArchivedTasks returned %d, want %d", n, len(entries))
+	}
+	if diff := cmp.Diff(entries, h.GetArchivedEntries(t, r, "default"), h.SortZSetEntryOpt); diff != "" {
+		t.Errorf("mismatch found in %q after import; (-want,+got)\n%s", base.ArchivedKey("default"), diff)
+	}
+
+	// Importing the same tasks again is a no-op.
+	n, err = inspector.ImportArchivedTasks("default", strings.NewReader(exported))
+	if err != nil || n != 0 {
+		t.Errorf("ImportArchivedTasks for existing tasks returned (%d, %v), want (0, nil)", n, err)
+	}
+
+	// Tasks can be imported to another queue.
+	if _, err := inspector.ImportArchivedTasks("backup", strings.NewReader(exported)); err != nil {
+		t.Fatalf("ImportArchivedTasks returned error: %v", err)
+	}
+	var want []base.Z
+	for _, z := range entries {
+		msg := *z.Message
+		msg.Queue = "backup"
+		want = append(want, base.Z{Message: &msg, Score: z.Score})
+	}
+	if diff := cmp.Diff(want, h.GetArchivedEntries(t, r, "backup"), h.SortZSetEntryOpt); diff != "" {
+		t.Errorf("mismatch found in %q after import; (-want,+got)\n%s", base.ArchivedKey("backup"), diff)
+	}
+	queues, err := inspector.Queues()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"backup", "default"}, queues, h.SortStringSliceOpt); diff != "" {
+		t.Errorf("Queues() mismatch; (-want,+got)\n%s", diff)
+	}
+}
+
+func TestInspectorExportImportArchivedTasksKeepsAllFields(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	inspector := NewInspector(getRedisConnOpt(t))
+
+	now := time.Now()
+	msg := h.NewTaskMessage("report", []byte("0123"))
+	msg.Retried = 3
+	msg.ErrorMsg = "oops"
+	msg.ErrorHistory = []string{"oops"}
+	msg.ArchiveReason = base.ArchiveReasonMaxRetry
+	msg.LastFailedAt = now.Unix()
+	msg.Deadline = now.Add(time.Hour).Unix()
+	msg.Retention = 3600
+	msg.Headers = map[string]string{"tenant": "acme"}
+	msg.UniqueKey = base.UniqueKey("default", msg.Type, msg.Payload)
+	msg.IdempotencyKey = "report:42"
+	msg.GroupKey = "user:42"
+	msg.Dependencies = []string{"parent"}
+	msg.Class = "cpu"
+	msg.Labels = map[string]string{"gpu": "true"}
+	msg.AtMostOnce = true
+	msg.DefaultRetry = true
+	msg.ClonedFrom = "original"
+	msg.ExpiresAt = now.Add(2 * time.Hour).Unix()
+	msg.EnqueuedAt = now.UnixNano()
+	msg.PayloadSize = 10
+	msg.PayloadDigest = "digest"
+	msg.PayloadRef = "ref"
+	msg.SchemaVersion = base.TaskMessageSchemaVersion + 1
+	msg.UnknownFields = []byte{0xa0, 0x06, 0x01} // field 100, varint 1
+	base.SignMessage(msg, []byte("secret"))
+	entries := []base.Z{{Message: msg, Score: now.Unix()}}
+	h.SeedArchivedQueue(t, r, entries, "default")
+
+	var buf bytes.Buffer
+	if _, err := inspector.ExportArchivedTasks("default", &buf); err != nil {
+		t.Fatalf("ExportArchivedTasks returned error: %v", err)
+	}
+	exported := buf.String()
+	if _, err := inspector.DeleteAllArchivedTasks("default"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inspector.ImportArchivedTasks("default", strings.NewReader(exported)); err != nil {
+		t.Fatalf("ImportArchivedTasks returned error: %v", err)
+	}
+	if diff := cmp.Diff(entries, h.GetArchivedEntries(t, r, "default")); diff != "" {
+		t.Errorf("mismatch found in %q after import; (-want,+got)\n%s", base.ArchivedKey("default"), diff)
+	}
+	if got := r.HGet(context.Background(), base.TaskKey("default", msg.ID), "group_key").Val(); got != base.GroupKey("default", msg.GroupKey) {
+		t.Errorf("group_key of the imported task = %q, want %q", got, base.GroupKey("default", msg.GroupKey))
+	}
+
+	// The signature covers the queue, so a signed task cannot be imported to another queue.
+	if n, err := inspector.ImportArchivedTasks("backup", strings.NewReader(exported)); err == nil || n != 0 {
+		t.Errorf("ImportArchivedTasks of a signed task to another queue returned (%d, %v), want (0, non-nil error)", n, err)
+	}
+}
+
+func TestInspectorExportArchivedTasksError(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	inspector := NewInspector(getRedisConnOpt(t))
+
+	var buf bytes.Buffer
+	if _, err := inspector.ExportArchivedTasks("nonexistent", &buf); err == nil {
+		t.Errorf("ExportArchivedTasks for nonexistent queue returned nil error, want non-nil error")
+	}
+}
+
+func TestInspectorImportArchivedTasksError(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	inspector := NewInspector(getRedisConnOpt(t))
+
+	tests := []struct {
+		desc  string
+		input string
+		want  int // number of tasks imported before the error
+	}{
+		{"malformed JSON", `{"id": "a", "type": "foo"}` + "\n" + `{"id": `, 1},
+		{"missing ID", `{"type": "foo"}`, 0},
+		{"missing type", `{"id": "b"}`, 0},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r)
+		n, err := inspector.ImportArchivedTasks("default", strings.NewReader(tc.input))
+		if err == nil {
+			t.Errorf("%s; ImportArchivedTasks returned nil error, want non-nil error", tc.desc)
+		}
+		if n != tc.want {
+			t.Errorf("%s; ImportArchivedTasks returned %d, want %d", tc.desc, n, tc.want)
+		}
+	}
+}
+
+func TestInspectorIterateTasks(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	inspector := NewInspector(getRedisConnOpt(t))
+	now := time.Now()
+	var entries []base.Z
+	for n := 0; n < 7; n++ {
+		entries = append(entries, base.Z{Message: h.NewTaskMessage(fmt.Sprintf("task%d", n), nil), Score: now.Add(time.Duration(n) * time.Minute).Unix()})
+	}
+	h.SeedArchivedQueue(t, r, entries, "default")
+
+	var got []string
+	it := inspector.IterateTasks("default", TaskStateArchived, PageSize(3))
+	for it.Next() {
+		if len(got) == 0 {
+			// Tasks deleted during the iteration don't shift the pages.
+			r.ZRem(context.Background(), base.ArchivedKey("default"), entries[0].Message.ID)
+		}
+		got = append(got, it.Task().ID)
+		if it.Task().State != TaskStateArchived {
+			t.Errorf("task %s has state %v, want archived", it.Task().ID, it.Task().State)
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("iteration returned error: %v", err)
+	}
+	var want []string
+	for _, z := range entries {
+		want = append(want, z.Message.ID)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("iterated tasks mismatch (-want,+got):\n%s", diff)
+	}
+
+	if it := inspector.IterateTasks("default", TaskStatePending); it.Next() || it.Err() == nil {
+		t.Errorf("iteration over pending tasks returned no error, want error")
+	}
+	if it := inspector.IterateTasks("nonexistent", TaskStateArchived); it.Next() || !errors.Is(it.Err(), ErrQueueNotFound) {
+		t.Errorf("iteration over nonexistent queue returned %v, want ErrQueueNotFound", it.Err())
+	}
+}
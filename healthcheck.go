@@ -5,6 +5,7 @@
 package asynq
 
 import (
+	"fmt"
 	"sync"
 	"time"
 
@@ -26,6 +27,9 @@ type healthchecker struct {
 
 	// function to call periodically.
 	healthcheckFunc func(error)
+
+	// breaker reports whether the broker is considered unavailable.
+	breaker *circuitBreaker
 }
 
 type healthcheckerParams struct {
@@ -33,6 +37,7 @@ type healthcheckerParams struct {
 	broker          base.Broker
 	interval        time.Duration
 	healthcheckFunc func(error)
+	breaker         *circuitBreaker
 }
 
 func newHealthChecker(params healthcheckerParams) *healthchecker {
@@ -42,6 +47,7 @@ func newHealthChecker(params healthcheckerParams) *healthchecker {
 		done:            make(chan struct{}),
 		interval:        params.interval,
 		healthcheckFunc: params.healthcheckFunc,
+		breaker:         params.breaker,
 	}
 }
 
@@ -72,6 +78,15 @@ func (hc *healthchecker) start(wg *sync.WaitGroup) {
 				return
 			case <-timer.C:
 				err := hc.broker.Ping()
+				if hc.breaker.isOpen() {
+					// Report degraded state even if the ping succeeds, since
+					// task processing is paused until the breaker closes.
+					if err != nil {
+						err = fmt.Errorf("asynq: %w: %v", ErrCircuitOpen, err)
+					} else {
+						err = fmt.Errorf("asynq: %w", ErrCircuitOpen)
+					}
+				}
 				hc.healthcheckFunc(err)
 				timer.Reset(hc.interval)
 			}
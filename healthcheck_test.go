@@ -5,6 +5,8 @@
 package asynq
 
 import (
+	"errors"
+	"fmt"
 	"sync"
 	"testing"
 	"time"
@@ -101,3 +103,41 @@ func TestHealthCheckerWhenRedisDown(t *testing.T) {
 
 	hc.shutdown()
 }
+
+func TestHealthCheckerWhenCircuitOpen(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	rdbClient := rdb.NewRDB(r)
+
+	var (
+		// mu guards e variable.
+		mu sync.Mutex
+		e  error
+	)
+	checkFn := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		e = err
+	}
+	breaker := newCircuitBreaker(1, time.Minute)
+	breaker.record(fmt.Errorf("connection refused"))
+
+	hc := newHealthChecker(healthcheckerParams{
+		logger:          testLogger,
+		broker:          rdbClient,
+		interval:        1 * time.Second,
+		healthcheckFunc: checkFn,
+		breaker:         breaker,
+	})
+
+	hc.start(&sync.WaitGroup{})
+	time.Sleep(2 * time.Second)
+
+	mu.Lock()
+	if !errors.Is(e, ErrCircuitOpen) {
+		t.Errorf("HealthCheckFunc was called with %v, want error wrapping %v", e, ErrCircuitOpen)
+	}
+	mu.Unlock()
+
+	hc.shutdown()
+}
@@ -5,6 +5,7 @@
 package asynq
 
 import (
+	"context"
 	"os"
 	"sync"
 	"time"
@@ -30,9 +31,21 @@ type heartbeater struct {
 	host           string
 	pid            int
 	serverID       string
-	concurrency    int
 	queues         map[string]int
 	strictPriority bool
+	environment    string
+	features       []string
+
+	// statusTTL is how long the final status of the server is kept after the
+	// server shuts down; the server state is cleared on shutdown if not positive.
+	statusTTL time.Duration
+
+	// concurrency may be changed while the server is running.
+	// shutdownFinished and shutdownRequeued are set once the workers have quit.
+	mu               sync.Mutex
+	concurrency      int
+	shutdownFinished int
+	shutdownRequeued int
 
 	// following fields are mutable and should be accessed only by the
 	// heartbeater goroutine. In other words, confine these variables
@@ -46,6 +59,15 @@ type heartbeater struct {
 	// channels to receive updates on active workers.
 	starting <-chan *workerInfo
 	finished <-chan *base.TaskMessage
+
+	// channel to receive requests for the current server state.
+	requests chan chan<- *serverSnapshot
+}
+
+// serverSnapshot holds the state of the server at a point in time.
+type serverSnapshot struct {
+	info    *base.ServerInfo
+	workers []*base.WorkerInfo
 }
 
 type heartbeaterParams struct {
@@ -55,6 +77,9 @@ type heartbeaterParams struct {
 	concurrency    int
 	queues         map[string]int
 	strictPriority bool
+	environment    string
+	features       []string
+	statusTTL      time.Duration
 	state          *base.ServerState
 	starting       <-chan *workerInfo
 	finished       <-chan *base.TaskMessage
@@ -78,11 +103,15 @@ func newHeartbeater(params heartbeaterParams) *heartbeater {
 		concurrency:    params.concurrency,
 		queues:         params.queues,
 		strictPriority: params.strictPriority,
+		environment:    params.environment,
+		features:       params.features,
+		statusTTL:      params.statusTTL,
 
 		state:    params.state,
 		workers:  make(map[string]*workerInfo),
 		starting: params.starting,
 		finished: params.finished,
+		requests: make(chan chan<- *serverSnapshot),
 	}
 }
 
@@ -115,7 +144,7 @@ func (h *heartbeater) start(wg *sync.WaitGroup) {
 		for {
 			select {
 			case <-h.done:
-				h.broker.ClearServerState(h.host, h.pid, h.serverID)
+				h.writeFinalState()
 				h.logger.Debug("Heartbeater done")
 				timer.Stop()
 				return
@@ -129,22 +158,58 @@ func (h *heartbeater) start(wg *sync.WaitGroup) {
 
 			case msg := <-h.finished:
 				delete(h.workers, msg.ID)
+
+			case req := <-h.requests:
+				req <- h.snapshot()
 			}
 		}
 	}()
 }
 
 func (h *heartbeater) beat() {
+	s := h.snapshot()
+	// Note: Set TTL to be long enough so that it won't expire before we write again
+	// and short enough to expire quickly once the process is shut down or killed.
+	if err := h.broker.WriteServerState(s.info, s.workers, h.interval*2); err != nil {
+		h.logger.Errorf("could not write server state data: %v", err)
+	}
+}
+
+// writeFinalState writes the final status of the server, with the number of tasks
+// finished and requeued during the shutdown, to be kept for statusTTL.
+// The server state is cleared instead if statusTTL is not positive.
+func (h *heartbeater) writeFinalState() {
+	if h.statusTTL <= 0 {
+		h.broker.ClearServerState(h.host, h.pid, h.serverID)
+		return
+	}
+	info := h.snapshot().info
+	info.Status = "closed"
+	h.mu.Lock()
+	info.ShutdownFinished = h.shutdownFinished
+	info.ShutdownRequeued = h.shutdownRequeued
+	h.mu.Unlock()
+	if err := h.broker.WriteServerState(info, nil, h.statusTTL); err != nil {
+		h.logger.Errorf("could not write final server state data: %v", err)
+	}
+}
+
+// snapshot returns the current state of the server.
+// It should be called only by the heartbeater goroutine.
+func (h *heartbeater) snapshot() *serverSnapshot {
 	info := base.ServerInfo{
 		Host:              h.host,
 		PID:               h.pid,
 		ServerID:          h.serverID,
-		Concurrency:       h.concurrency,
+		Concurrency:       h.getConcurrency(),
 		Queues:            h.queues,
 		StrictPriority:    h.strictPriority,
 		Status:            h.state.String(),
 		Started:           h.started,
 		ActiveWorkerCount: len(h.workers),
+		Environment:       h.environment,
+		Version:           base.Version,
+		Features:          h.features,
 	}
 
 	var ws []*base.WorkerInfo
@@ -161,10 +226,43 @@ func (h *heartbeater) beat() {
 			Deadline: w.deadline,
 		})
 	}
+	return &serverSnapshot{info: &info, workers: ws}
+}
 
-	// Note: Set TTL to be long enough so that it won't expire before we write again
-	// and short enough to expire quickly once the process is shut down or killed.
-	if err := h.broker.WriteServerState(&info, ws, h.interval*2); err != nil {
-		h.logger.Errorf("could not write server state data: %v", err)
+// currentState returns the current state of the server from the heartbeater goroutine.
+// It returns an error if the heartbeater is not running or ctx is done before the
+// heartbeater responds.
+func (h *heartbeater) currentState(ctx context.Context) (*serverSnapshot, error) {
+	ch := make(chan *serverSnapshot, 1)
+	select {
+	case h.requests <- ch:
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
+	select {
+	case s := <-ch:
+		return s, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (h *heartbeater) setConcurrency(n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.concurrency = n
+}
+
+// setShutdownStats sets the number of tasks finished and requeued during the shutdown.
+func (h *heartbeater) setShutdownStats(finished, requeued int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.shutdownFinished = finished
+	h.shutdownRequeued = requeued
+}
+
+func (h *heartbeater) getConcurrency() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.concurrency
 }
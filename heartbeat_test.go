@@ -66,6 +66,7 @@ func TestHeartbeater(t *testing.T) {
 			Concurrency: tc.concurrency,
 			Started:     time.Now(),
 			Status:      "active",
+			Version:     base.Version,
 		}
 
 		// allow for heartbeater to write to redis
@@ -154,3 +155,50 @@ func TestHeartbeaterWithRedisDown(t *testing.T) {
 
 	hb.shutdown()
 }
+
+func TestHeartbeaterFinalStatus(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	rdbClient := rdb.NewRDB(r)
+
+	tests := []struct {
+		statusTTL   time.Duration
+		wantServers int
+	}{
+		{0, 0},
+		{time.Minute, 1},
+	}
+	for _, tc := range tests {
+		h.FlushDB(t, r)
+		state := base.NewServerState()
+		state.Set(base.StateActive)
+		hb := newHeartbeater(heartbeaterParams{
+			logger:      testLogger,
+			broker:      rdbClient,
+			interval:    time.Second,
+			concurrency: 10,
+			queues:      map[string]int{"default": 1},
+			statusTTL:   tc.statusTTL,
+			state:       state,
+			starting:    make(chan *workerInfo),
+			finished:    make(chan *base.TaskMessage),
+		})
+		var wg sync.WaitGroup
+		hb.start(&wg)
+		hb.setShutdownStats(3, 1)
+		hb.shutdown()
+		wg.Wait()
+
+		ss, err := rdbClient.ListServers()
+		if err != nil {
+			t.Fatalf("could not read server info from redis: %v", err)
+		}
+		if len(ss) != tc.wantServers {
+			t.Errorf("statusTTL=%v: (*RDB).ListServers returned %d server info, want %d", tc.statusTTL, len(ss), tc.wantServers)
+			continue
+		}
+		if len(ss) == 1 && (ss[0].Status != "closed" || ss[0].ShutdownFinished != 3 || ss[0].ShutdownRequeued != 1) {
+			t.Errorf("final server info = %+v, want status %q with 3 tasks finished and 1 requeued", ss[0], "closed")
+		}
+	}
+}
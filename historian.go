@@ -0,0 +1,87 @@
+// Copyright 2021 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/log"
+)
+
+// A historian is responsible for sampling the sizes of the specified queues.
+// It periodically records the number of tasks in each state of the queues in the
+// history of the queues, which is returned by Inspector.QueueHistory.
+type historian struct {
+	logger *log.Logger
+	broker base.Broker
+
+	// channel to communicate back to the long running "historian" goroutine.
+	done chan struct{}
+
+	// list of queue names to sample.
+	queues []string
+
+	// interval between samples; sampling is disabled if not positive.
+	interval time.Duration
+}
+
+type historianParams struct {
+	logger   *log.Logger
+	broker   base.Broker
+	queues   []string
+	interval time.Duration
+}
+
+func newHistorian(params historianParams) *historian {
+	return &historian{
+		logger:   params.logger,
+		broker:   params.broker,
+		done:     make(chan struct{}),
+		queues:   params.queues,
+		interval: params.interval,
+	}
+}
+
+func (h *historian) shutdown() {
+	if h.interval <= 0 {
+		return
+	}
+	h.logger.Debug("Historian shutting down...")
+	// Signal the historian goroutine to stop.
+	h.done <- struct{}{}
+}
+
+// start starts the "historian" goroutine.
+func (h *historian) start(wg *sync.WaitGroup) {
+	if h.interval <= 0 {
+		return
+	}
+	wg.Add(1)
+	timer := time.NewTimer(h.interval)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-h.done:
+				h.logger.Debug("Historian done")
+				return
+			case <-timer.C:
+				h.exec()
+				timer.Reset(h.interval)
+			}
+		}
+	}()
+}
+
+func (h *historian) exec() {
+	for _, qname := range h.queues {
+		// Note: The broker skips the sample if another server sampled the queue within the interval.
+		if err := h.broker.RecordQueueSizes(qname, h.interval); err != nil {
+			h.logger.Errorf("Could not record the sizes of queue %q: %v", qname, err)
+		}
+	}
+}
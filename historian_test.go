@@ -0,0 +1,81 @@
+// Copyright 2021 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/rdb"
+)
+
+func TestHistorian(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	h.FlushDB(t, r)
+	const interval = 500 * time.Millisecond
+	historian := newHistorian(historianParams{
+		logger:   testLogger,
+		broker:   rdb.NewRDB(r),
+		queues:   []string{"default", "custom"},
+		interval: interval,
+	})
+	h.SeedPendingQueue(t, r, []*base.TaskMessage{h.NewTaskMessage("task1", nil), h.NewTaskMessage("task2", nil)}, "default")
+	h.SeedArchivedQueue(t, r, []base.Z{{Message: h.NewTaskMessageWithQueue("task3", nil, "custom"), Score: time.Now().Unix()}}, "custom")
+
+	var wg sync.WaitGroup
+	historian.start(&wg)
+	time.Sleep(3 * interval) // make sure to let historian run at least twice
+	historian.shutdown()
+	wg.Wait()
+
+	inspector := NewInspector(getRedisConnOpt(t))
+	got, err := inspector.QueueHistory("default", time.Minute)
+	if err != nil {
+		t.Fatalf("QueueHistory returned error: %v", err)
+	}
+	if len(got) < 2 {
+		t.Fatalf("QueueHistory returned %d samples, want at least 2", len(got))
+	}
+	for i, s := range got {
+		if s.Queue != "default" || s.Size != 2 || s.Pending != 2 {
+			t.Errorf("QueueHistory returned sample %+v, want 2 pending tasks in queue %q", s, "default")
+		}
+		if i > 0 && !s.Time.After(got[i-1].Time) {
+			t.Errorf("QueueHistory returned samples out of order: %v after %v", s.Time, got[i-1].Time)
+		}
+	}
+	got, err = inspector.QueueHistory("custom", time.Minute)
+	if err != nil || len(got) == 0 || got[0].Archived != 1 {
+		t.Errorf("QueueHistory returned (%v, %v), want samples of 1 archived task", got, err)
+	}
+	if _, err := inspector.QueueHistory("nonexistent", time.Minute); !errors.Is(err, ErrQueueNotFound) {
+		t.Errorf("QueueHistory of nonexistent queue returned %v, want ErrQueueNotFound", err)
+	}
+}
+
+func TestHistorianDisabled(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	h.FlushDB(t, r)
+	historian := newHistorian(historianParams{
+		logger:   testLogger,
+		broker:   rdb.NewRDB(r),
+		queues:   []string{"default"},
+		interval: -1,
+	})
+	var wg sync.WaitGroup
+	historian.start(&wg)
+	historian.shutdown()
+	wg.Wait()
+	if n := r.Exists(context.Background(), base.QueueHistoryKey("default")).Val(); n != 0 {
+		t.Errorf("history of queue %q exists, want no samples", "default")
+	}
+}
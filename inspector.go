@@ -5,12 +5,16 @@
 package asynq
 
 import (
+	"context"
 	"fmt"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
 	"github.com/hibiken/asynq/internal/base"
 	"github.com/hibiken/asynq/internal/errors"
 	"github.com/hibiken/asynq/internal/rdb"
@@ -20,17 +24,124 @@ import (
 // queues and tasks.
 type Inspector struct {
 	rdb *rdb.RDB
+
+	// redact returns the payloads of the tasks as shown by the inspector; nil to show them as is.
+	redact PayloadRedactor
+
+	// readOnly makes the methods changing queues, tasks or servers return ErrReadOnly.
+	readOnly bool
 }
 
 // New returns a new instance of Inspector.
 func NewInspector(r RedisConnOpt) *Inspector {
+	return NewInspectorWithConfig(r, InspectorConfig{})
+}
+
+// InspectorConfig specifies the inspector's behavior.
+type InspectorConfig struct {
+	// AuditLog specifies whether to record the tasks run, archived and deleted
+	// with the inspector, as well as the queues paused, unpaused, drained and deleted,
+	// in the audit logs of their queues.
+	// See Config.AuditLog for details.
+	AuditLog bool
+
+	// PublishEvents specifies whether to publish the actions performed with the inspector
+	// to the subscribers of their queues.
+	// See Config.PublishEvents for details.
+	PublishEvents bool
+
+	// Actor identifies who performs the actions of the inspector
+	// (e.g. the name or email of the operator), and is recorded in the audit log events.
+	// Use Inspector.WithActor to attribute the actions to a different actor.
+	//
+	// Optional.
+	Actor string
+
+	// RedactPayload optionally returns the payload of a task as shown by the inspector,
+	// so that operators can browse queues without seeing sensitive data: it's applied to
+	// the payloads of the tasks returned by GetTaskInfo, the List methods, IterateTasks
+	// and CloneTask, of the tasks processed by the workers returned by Servers, and of
+	// the tasks of the entries returned by SchedulerEntries.
+	// Use RedactJSONFields to mask the fields of JSON payloads by name.
+	//
+	// ExportArchivedTasks writes the payloads as is, so that the exported tasks can be
+	// imported back.
+	//
+	// If unset, payloads are shown as is.
+	RedactPayload PayloadRedactor
+
+	// ReadOnly specifies whether the inspector only reads from redis, e.g. to give the
+	// credentials of a dashboard to support staff without risk of purging a queue by
+	// accident. The methods of a read-only inspector which change queues, tasks or
+	// servers (e.g. DeleteTask, RunAllArchivedTasks, PauseQueue or PurgeQueue unless
+	// it's a dry run) return an error wrapping ErrReadOnly without changing anything.
+	// The tasks whose data cannot be decoded are omitted from the listed tasks, but
+	// not quarantined (see ListQuarantinedTasks).
+	//
+	// Note that the redis credentials still allow the writes; use a redis user
+	// restricted to read commands to enforce read-only access in redis as well.
+	ReadOnly bool
+
+	// BrokerLatencyFunc is called after each redis command run by the inspector
+	// (e.g. to list or update tasks) with the name of the operation and the time it took.
+	// See BrokerLatencyFunc for details.
+	BrokerLatencyFunc BrokerLatencyFunc
+}
+
+// NewInspectorWithConfig returns a new instance of Inspector given a redis connection option
+// and an inspector config.
+func NewInspectorWithConfig(r RedisConnOpt, cfg InspectorConfig) *Inspector {
 	c, ok := r.MakeRedisClient().(redis.UniversalClient)
 	if !ok {
 		panic(fmt.Sprintf("inspeq: unsupported RedisConnOpt type %T", r))
 	}
+	rdb := rdb.NewRDB(c)
+	rdb.SetAuditLog(cfg.AuditLog)
+	rdb.SetEventPublishing(cfg.PublishEvents)
+	rdb.SetReadOnly(cfg.ReadOnly)
+	rdb.SetLatencyFunc(cfg.BrokerLatencyFunc)
+	return &Inspector{
+		rdb:      rdb.WithAuditActor(cfg.Actor),
+		redact:   cfg.RedactPayload,
+		readOnly: cfg.ReadOnly,
+	}
+}
+
+// WithActor returns an inspector which records the given actor in the audit log
+// events of its actions, e.g. the user of an admin dashboard handling a request.
+//
+// The returned inspector shares the connection with i. Closing either of them
+// closes the connection for both.
+func (i *Inspector) WithActor(actor string) *Inspector {
 	return &Inspector{
-		rdb: rdb.NewRDB(c),
+		rdb:      i.rdb.WithAuditActor(actor),
+		redact:   i.redact,
+		readOnly: i.readOnly,
+	}
+}
+
+// checkWritable returns an error wrapping ErrReadOnly if the inspector is read-only.
+func (i *Inspector) checkWritable() error {
+	if i.readOnly {
+		return fmt.Errorf("asynq: %w", ErrReadOnly)
+	}
+	return nil
+}
+
+// redactPayload returns the payload of the task of the given type as shown by the inspector.
+func (i *Inspector) redactPayload(typename string, payload []byte) []byte {
+	if i.redact == nil {
+		return payload
+	}
+	return i.redact(typename, payload)
+}
+
+// redactTasks redacts the payloads of the given tasks in place and returns them.
+func (i *Inspector) redactTasks(tasks []*TaskInfo) []*TaskInfo {
+	for _, t := range tasks {
+		t.Payload = i.redactPayload(t.Type, t.Payload)
 	}
+	return tasks
 }
 
 // Close closes the connection with redis.
@@ -39,6 +150,9 @@ func (i *Inspector) Close() error {
 }
 
 // Queues returns a list of all queue names.
+//
+// A queue is known once a task is enqueued to it or a running Server
+// is configured to process it.
 func (i *Inspector) Queues() ([]string, error) {
 	return i.rdb.AllQueues()
 }
@@ -56,7 +170,7 @@ type QueueInfo struct {
 	Latency time.Duration
 
 	// Size is the total number of tasks in the queue.
-	// The value is the sum of Pending, Active, Scheduled, Retry, and Archived.
+	// The value is the sum of Pending, Active, Scheduled, Retry, Archived, Completed, Waiting, and Unhandled.
 	Size int
 
 	// Number of pending tasks.
@@ -71,6 +185,13 @@ type QueueInfo struct {
 	Archived int
 	// Number of stored completed tasks.
 	Completed int
+	// Number of tasks waiting for their dependencies to complete.
+	Waiting int
+	// Number of tasks parked because no handler is registered for their type.
+	Unhandled int
+	// Number of tasks quarantined because their data could not be decoded.
+	// Quarantined tasks are not included in Size.
+	Quarantined int
 
 	// Total number of tasks being processed within the given date (counter resets daily).
 	// The number includes both succeeded and failed tasks.
@@ -82,11 +203,29 @@ type QueueInfo struct {
 	ProcessedTotal int
 	// Total number of tasks failed (cumulative).
 	FailedTotal int
+	// Total number of tasks processed without a handler registered for their type (cumulative).
+	// It counts such tasks regardless of Config.UnhandledTaskPolicy.
+	UnhandledTotal int
+	// Total number of tasks deleted because their data could not be decoded (cumulative).
+	// See Config.UndecodableTaskPolicy.
+	DroppedTotal int
+
+	// Number of enqueues rejected as duplicates by Unique or IdempotencyKey option,
+	// by task type (cumulative). Nil if no enqueue was rejected.
+	Duplicates map[string]int
+
+	// Environment the redis database is labeled with (see Config.Environment).
+	// Empty if the database is not labeled.
+	Environment string
 
 	// Paused indicates whether the queue is paused.
 	// If true, tasks in the queue will not be processed.
 	Paused bool
 
+	// Draining indicates whether the queue is draining.
+	// If true, new tasks cannot be enqueued to the queue.
+	Draining bool
+
 	// Time when this queue info snapshot was taken.
 	Timestamp time.Time
 }
@@ -111,15 +250,92 @@ func (i *Inspector) GetQueueInfo(qname string) (*QueueInfo, error) {
 		Retry:          stats.Retry,
 		Archived:       stats.Archived,
 		Completed:      stats.Completed,
+		Waiting:        stats.Waiting,
+		Unhandled:      stats.Unhandled,
+		Quarantined:    stats.Quarantined,
 		Processed:      stats.Processed,
 		Failed:         stats.Failed,
 		ProcessedTotal: stats.ProcessedTotal,
 		FailedTotal:    stats.FailedTotal,
+		UnhandledTotal: stats.UnhandledTotal,
+		DroppedTotal:   stats.DroppedTotal,
+		Duplicates:     stats.Duplicates,
+		Environment:    stats.Environment,
 		Paused:         stats.Paused,
+		Draining:       stats.Draining,
 		Timestamp:      stats.Timestamp,
 	}, nil
 }
 
+// ScalingHint holds a recommended number of workers for a queue.
+//
+// RecommendedWorkers can be exported as an external metric to an autoscaler
+// (e.g. Kubernetes HorizontalPodAutoscaler) to scale worker processes.
+type ScalingHint struct {
+	// Name of the queue.
+	Queue string
+	// Depth is the number of tasks waiting for or occupying a worker,
+	// i.e. the number of pending and active tasks.
+	Depth int
+	// Latency of the queue, measured by the oldest pending task in the queue.
+	Latency time.Duration
+	// ProcessingRate is the number of tasks a single worker processes per second,
+	// as given to ScalingHint.
+	ProcessingRate float64
+	// LatencyTarget is the time within which the tasks in the queue should be processed,
+	// as given to ScalingHint.
+	LatencyTarget time.Duration
+	// RecommendedWorkers is the number of workers needed to process all tasks
+	// in the queue within LatencyTarget.
+	RecommendedWorkers int
+	// Time when this hint was computed.
+	Timestamp time.Time
+}
+
+// ScalingHint returns a recommended number of workers for the queue, computed from
+// the current depth of the queue, the number of tasks a single worker processes per
+// second (rate), and the time within which the tasks should be processed (target).
+//
+// See RecommendedWorkers for the formula.
+func (i *Inspector) ScalingHint(qname string, rate float64, target time.Duration) (*ScalingHint, error) {
+	if err := base.ValidateQueueName(qname); err != nil {
+		return nil, err
+	}
+	if rate <= 0 {
+		return nil, fmt.Errorf("asynq: processing rate must be positive, got %v", rate)
+	}
+	if target <= 0 {
+		return nil, fmt.Errorf("asynq: latency target must be positive, got %v", target)
+	}
+	stats, err := i.rdb.CurrentStats(qname)
+	if err != nil {
+		return nil, err
+	}
+	depth := stats.Pending + stats.Active
+	return &ScalingHint{
+		Queue:              stats.Queue,
+		Depth:              depth,
+		Latency:            stats.Latency,
+		ProcessingRate:     rate,
+		LatencyTarget:      target,
+		RecommendedWorkers: RecommendedWorkers(depth, rate, target),
+		Timestamp:          stats.Timestamp,
+	}, nil
+}
+
+// RecommendedWorkers returns the number of workers needed to process depth tasks
+// within target, given that a single worker processes rate tasks per second.
+//
+// The result is depth / (rate * target) rounded up, and is zero if depth is zero.
+// It returns zero if rate or target is not positive.
+func RecommendedWorkers(depth int, rate float64, target time.Duration) int {
+	if depth <= 0 || rate <= 0 || target <= 0 {
+		return 0
+	}
+	perWorker := rate * target.Seconds()
+	return int(math.Ceil(float64(depth) / perWorker))
+}
+
 // DailyStats holds aggregate data for a given day for a given queue.
 type DailyStats struct {
 	// Name of the queue.
@@ -154,6 +370,289 @@ func (i *Inspector) History(qname string, n int) ([]*DailyStats, error) {
 	return res, nil
 }
 
+// QueueSample holds the number of tasks in each state of a queue at a given time.
+type QueueSample struct {
+	// Name of the queue.
+	Queue string
+	// Size is the total number of tasks in the queue.
+	Size int
+	// Number of tasks in each state.
+	Pending   int
+	Active    int
+	Scheduled int
+	Retry     int
+	Archived  int
+	Completed int
+	Waiting   int
+	Unhandled int
+	// Time this sample was taken.
+	Time time.Time
+}
+
+// QueueHistory returns the samples of the sizes of the queue taken within the given
+// window (e.g. the last 24 hours), sorted by time in ascending order.
+//
+// The queues are sampled by the servers processing them; see Config.QueueHistoryInterval.
+func (i *Inspector) QueueHistory(qname string, window time.Duration) ([]*QueueSample, error) {
+	if err := base.ValidateQueueName(qname); err != nil {
+		return nil, err
+	}
+	if window <= 0 {
+		return nil, fmt.Errorf("asynq: window must be positive")
+	}
+	samples, err := i.rdb.QueueHistory(qname, time.Now().Add(-window))
+	if errors.IsQueueNotFound(err) {
+		return nil, fmt.Errorf("%w: queue=%q", ErrQueueNotFound, qname)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var res []*QueueSample
+	for _, s := range samples {
+		res = append(res, &QueueSample{
+			Queue:     s.Queue,
+			Size:      s.Size,
+			Pending:   s.Pending,
+			Active:    s.Active,
+			Scheduled: s.Scheduled,
+			Retry:     s.Retry,
+			Archived:  s.Archived,
+			Completed: s.Completed,
+			Waiting:   s.Waiting,
+			Unhandled: s.Unhandled,
+			Time:      s.Time,
+		})
+	}
+	return res, nil
+}
+
+// TaskSample holds the measurements of a task sampled on completion.
+type TaskSample struct {
+	// Type name of the task.
+	Type string
+	// Size of the payload of the task in bytes.
+	PayloadSize int
+	// Time the handler took to process the task.
+	Duration time.Duration
+	// Time the task was pending in the queue before it was processed.
+	// Zero if unknown.
+	WaitTime time.Duration
+	// Time the task completed.
+	CompletedAt time.Time
+}
+
+// TaskSampleSummary summarizes a set of sampled tasks.
+type TaskSampleSummary struct {
+	// Number of sampled tasks.
+	Count int
+	// Average and maximum payload size in bytes.
+	AvgPayloadSize int
+	MaxPayloadSize int
+	// Average and maximum processing duration.
+	AvgDuration time.Duration
+	MaxDuration time.Duration
+	// Average and maximum wait time in the queue.
+	AvgWaitTime time.Duration
+	MaxWaitTime time.Duration
+}
+
+func summarizeTaskSamples(samples []*TaskSample) *TaskSampleSummary {
+	s := &TaskSampleSummary{Count: len(samples)}
+	if len(samples) == 0 {
+		return s
+	}
+	var payloadSize int
+	var duration, waitTime time.Duration
+	for _, sample := range samples {
+		payloadSize += sample.PayloadSize
+		duration += sample.Duration
+		waitTime += sample.WaitTime
+		if sample.PayloadSize > s.MaxPayloadSize {
+			s.MaxPayloadSize = sample.PayloadSize
+		}
+		if sample.Duration > s.MaxDuration {
+			s.MaxDuration = sample.Duration
+		}
+		if sample.WaitTime > s.MaxWaitTime {
+			s.MaxWaitTime = sample.WaitTime
+		}
+	}
+	s.AvgPayloadSize = payloadSize / len(samples)
+	s.AvgDuration = duration / time.Duration(len(samples))
+	s.AvgWaitTime = waitTime / time.Duration(len(samples))
+	return s
+}
+
+// TaskSampleStats holds the sampled tasks of a queue.
+type TaskSampleStats struct {
+	// Name of the queue.
+	Queue string
+	// Sampled tasks, most recent first.
+	Samples []*TaskSample
+	// Summary of all the sampled tasks.
+	Total *TaskSampleSummary
+	// Summaries of the sampled tasks of each type.
+	ByType map[string]*TaskSampleSummary
+}
+
+// TaskSampleStats returns the tasks sampled on completion in the queue, with a summary
+// of their payload sizes, processing durations and wait times.
+//
+// The tasks are sampled by the servers processing them; see Config.TaskSampleRate.
+func (i *Inspector) TaskSampleStats(qname string) (*TaskSampleStats, error) {
+	if err := base.ValidateQueueName(qname); err != nil {
+		return nil, err
+	}
+	samples, err := i.rdb.ListTaskSamples(qname)
+	if errors.IsQueueNotFound(err) {
+		return nil, fmt.Errorf("%w: queue=%q", ErrQueueNotFound, qname)
+	}
+	if err != nil {
+		return nil, err
+	}
+	stats := &TaskSampleStats{Queue: qname, ByType: make(map[string]*TaskSampleSummary)}
+	byType := make(map[string][]*TaskSample)
+	for _, s := range samples {
+		sample := &TaskSample{
+			Type:        s.Type,
+			PayloadSize: s.PayloadSize,
+			Duration:    s.Duration,
+			WaitTime:    s.WaitTime,
+			CompletedAt: s.CompletedAt,
+		}
+		stats.Samples = append(stats.Samples, sample)
+		byType[s.Type] = append(byType[s.Type], sample)
+	}
+	stats.Total = summarizeTaskSamples(stats.Samples)
+	for tasktype, ss := range byType {
+		stats.ByType[tasktype] = summarizeTaskSamples(ss)
+	}
+	return stats, nil
+}
+
+// LatencyHistogram counts latencies of tasks in buckets.
+type LatencyHistogram struct {
+	// Upper bounds of the buckets, in increasing order.
+	Bounds []time.Duration
+	// Number of latencies in each bucket: Counts[i] counts the latencies greater than
+	// Bounds[i-1] and less than or equal to Bounds[i]. The last element, at index
+	// len(Bounds), counts the latencies greater than the last bound.
+	Counts []int
+	// Number of latencies counted.
+	Count int
+	// Sum of the latencies counted.
+	Sum time.Duration
+}
+
+func newLatencyHistogram(h *rdb.LatencyHistogram) *LatencyHistogram {
+	res := &LatencyHistogram{
+		Bounds: append([]time.Duration(nil), base.LatencyBuckets...),
+		Counts: make([]int, len(base.LatencyBuckets)+1),
+	}
+	if h != nil {
+		for i, n := range h.Counts {
+			res.Counts[i] = int(n)
+			res.Count += int(n)
+		}
+		res.Sum = h.Sum
+	}
+	return res
+}
+
+// add counts the latencies of other in the histogram.
+func (h *LatencyHistogram) add(other *LatencyHistogram) {
+	for i, n := range other.Counts {
+		h.Counts[i] += n
+	}
+	h.Count += other.Count
+	h.Sum += other.Sum
+}
+
+// Mean returns the mean of the latencies, or zero if no latency is counted.
+func (h *LatencyHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Quantile returns an estimate of the q-quantile of the latencies, for q between 0 and 1,
+// e.g. Quantile(0.99) for the 99th percentile. The quantile is interpolated linearly within
+// the bucket it falls in; it is the last bound if it falls in the overflow bucket.
+// Quantile returns zero if no latency is counted.
+func (h *LatencyHistogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 || len(h.Bounds) == 0 {
+		return 0
+	}
+	rank := q * float64(h.Count)
+	var seen float64
+	for i, n := range h.Counts {
+		if n == 0 || seen+float64(n) < rank {
+			seen += float64(n)
+			continue
+		}
+		if i == len(h.Bounds) {
+			break
+		}
+		var lower time.Duration
+		if i > 0 {
+			lower = h.Bounds[i-1]
+		}
+		frac := (rank - seen) / float64(n)
+		return lower + time.Duration(frac*float64(h.Bounds[i]-lower))
+	}
+	return h.Bounds[len(h.Bounds)-1]
+}
+
+// TaskLatency holds the latency histograms of successfully processed tasks.
+type TaskLatency struct {
+	// Wait counts the times from the tasks becoming pending to the start of the
+	// processing which completed them, excluding the time the tasks were scheduled
+	// or waiting to be retried.
+	Wait *LatencyHistogram
+	// Run counts the times the handler took to process the tasks.
+	Run *LatencyHistogram
+}
+
+// TaskLatencyStats holds the latency histograms of the tasks of a queue.
+type TaskLatencyStats struct {
+	// Name of the queue.
+	Queue string
+	// Latencies of all the tasks of the queue.
+	Total *TaskLatency
+	// Latencies of the tasks of each type.
+	ByType map[string]*TaskLatency
+}
+
+// TaskLatencyStats returns the histograms of the latencies of the tasks successfully
+// processed in the queue, from the time they became pending to their completion.
+//
+// The latencies are recorded by the servers processing the tasks; see Config.TrackLatency.
+func (i *Inspector) TaskLatencyStats(qname string) (*TaskLatencyStats, error) {
+	if err := base.ValidateQueueName(qname); err != nil {
+		return nil, err
+	}
+	hists, err := i.rdb.ListLatencyHistograms(qname)
+	if errors.IsQueueNotFound(err) {
+		return nil, fmt.Errorf("%w: queue=%q", ErrQueueNotFound, qname)
+	}
+	if err != nil {
+		return nil, err
+	}
+	stats := &TaskLatencyStats{
+		Queue:  qname,
+		Total:  &TaskLatency{Wait: newLatencyHistogram(nil), Run: newLatencyHistogram(nil)},
+		ByType: make(map[string]*TaskLatency),
+	}
+	for tasktype, h := range hists {
+		l := &TaskLatency{Wait: newLatencyHistogram(h.Wait), Run: newLatencyHistogram(h.Run)}
+		stats.ByType[tasktype] = l
+		stats.Total.Wait.add(l.Wait)
+		stats.Total.Run.add(l.Run)
+	}
+	return stats, nil
+}
+
 var (
 	// ErrQueueNotFound indicates that the specified queue does not exist.
 	ErrQueueNotFound = errors.New("queue not found")
@@ -163,6 +662,16 @@ var (
 
 	// ErrTaskNotFound indicates that the specified task cannot be found in the queue.
 	ErrTaskNotFound = errors.New("task not found")
+
+	// ErrServerNotFound indicates that the specified server cannot be found.
+	ErrServerNotFound = errors.New("server not found")
+
+	// ErrReadOnly indicates that the inspector is read-only and cannot change anything.
+	// See InspectorConfig.ReadOnly.
+	ErrReadOnly = errors.New("inspector is read-only")
+
+	// ErrUniqueLockNotFound indicates that the specified uniqueness lock cannot be found in the queue.
+	ErrUniqueLockNotFound = errors.New("uniqueness lock not found")
 )
 
 // DeleteQueue removes the specified queue.
@@ -172,10 +681,17 @@ var (
 // If force is set to false, DeleteQueue will remove the queue only if
 // the queue is empty.
 //
+// Along with the tasks, DeleteQueue removes the paused and draining state of
+// the queue and its total processed and failed counters.
+// Daily stats of the queue expire on their own.
+//
 // If the specified queue does not exist, DeleteQueue returns ErrQueueNotFound.
 // If force is set to false and the specified queue is not empty, DeleteQueue
 // returns ErrQueueNotEmpty.
 func (i *Inspector) DeleteQueue(qname string, force bool) error {
+	if err := i.checkWritable(); err != nil {
+		return err
+	}
 	err := i.rdb.RemoveQueue(qname, force)
 	if errors.IsQueueNotFound(err) {
 		return fmt.Errorf("%w: queue=%q", ErrQueueNotFound, qname)
@@ -198,9 +714,54 @@ func (i *Inspector) GetTaskInfo(qname, id string) (*TaskInfo, error) {
 	case errors.IsTaskNotFound(err):
 		return nil, fmt.Errorf("asynq: %w", ErrTaskNotFound)
 	case err != nil:
-		return nil, fmt.Errorf("asynq: %v", err)
+		return nil, fmt.Errorf("asynq: %w", err)
+	}
+	ti := newTaskInfo(info.Message, info.State, info.NextProcessAt, info.Result)
+	ti.Progress = info.Progress
+	ti.Payload = i.redactPayload(ti.Type, ti.Payload)
+	return ti, nil
+}
+
+// GetTaskInfos retrieves information of the tasks with the given IDs from the given
+// queue in a single round trip to redis, e.g. to show the state of all the tasks
+// related to an order. The returned slice holds the information of each task in the
+// order of ids, and nil for the tasks which don't exist.
+//
+// Returns an error wrapping ErrQueueNotFound if a queue with the given name doesn't exist.
+func (i *Inspector) GetTaskInfos(qname string, ids []string) ([]*TaskInfo, error) {
+	infos, err := i.rdb.GetTaskInfos(qname, ids)
+	switch {
+	case errors.IsQueueNotFound(err):
+		return nil, fmt.Errorf("asynq: %w", ErrQueueNotFound)
+	case err != nil:
+		return nil, fmt.Errorf("asynq: %w", err)
+	}
+	tasks := make([]*TaskInfo, len(infos))
+	for j, info := range infos {
+		if info == nil {
+			continue
+		}
+		ti := newTaskInfo(info.Message, info.State, info.NextProcessAt, info.Result)
+		ti.Progress = info.Progress
+		ti.Payload = i.redactPayload(ti.Type, ti.Payload)
+		tasks[j] = ti
+	}
+	return tasks, nil
+}
+
+// GetTaskInfoByIdempotencyKey retrieves information of the task which owns the given idempotency key.
+//
+// Returns an error wrapping ErrQueueNotFound if a queue with the given name doesn't exist.
+// Returns an error wrapping ErrTaskNotFound if no task owns the key in the queue.
+func (i *Inspector) GetTaskInfoByIdempotencyKey(qname, key string) (*TaskInfo, error) {
+	id, err := i.rdb.GetIdempotencyKeyOwner(qname, key)
+	switch {
+	case errors.CanonicalCode(err) == errors.NotFound:
+		return nil, fmt.Errorf("asynq: %w", ErrTaskNotFound)
+	case err != nil:
+		return nil, fmt.Errorf("asynq: %w", err)
 	}
-	return newTaskInfo(info.Message, info.State, info.NextProcessAt, info.Result), nil
+	return i.GetTaskInfo(qname, id)
 }
 
 // ListOption specifies behavior of list operation.
@@ -269,7 +830,7 @@ func Page(n int) ListOption {
 // By default, it retrieves the first 30 tasks.
 func (i *Inspector) ListPendingTasks(qname string, opts ...ListOption) ([]*TaskInfo, error) {
 	if err := base.ValidateQueueName(qname); err != nil {
-		return nil, fmt.Errorf("asynq: %v", err)
+		return nil, fmt.Errorf("asynq: %w", err)
 	}
 	opt := composeListOptions(opts...)
 	pgn := rdb.Pagination{Size: opt.pageSize, Page: opt.pageNum - 1}
@@ -278,7 +839,7 @@ func (i *Inspector) ListPendingTasks(qname string, opts ...ListOption) ([]*TaskI
 	case errors.IsQueueNotFound(err):
 		return nil, fmt.Errorf("asynq: %w", ErrQueueNotFound)
 	case err != nil:
-		return nil, fmt.Errorf("asynq: %v", err)
+		return nil, fmt.Errorf("asynq: %w", err)
 	}
 	var tasks []*TaskInfo
 	for _, i := range infos {
@@ -289,7 +850,7 @@ func (i *Inspector) ListPendingTasks(qname string, opts ...ListOption) ([]*TaskI
 			i.Result,
 		))
 	}
-	return tasks, err
+	return i.redactTasks(tasks), err
 }
 
 // ListActiveTasks retrieves active tasks from the specified queue.
@@ -297,7 +858,7 @@ func (i *Inspector) ListPendingTasks(qname string, opts ...ListOption) ([]*TaskI
 // By default, it retrieves the first 30 tasks.
 func (i *Inspector) ListActiveTasks(qname string, opts ...ListOption) ([]*TaskInfo, error) {
 	if err := base.ValidateQueueName(qname); err != nil {
-		return nil, fmt.Errorf("asynq: %v", err)
+		return nil, fmt.Errorf("asynq: %w", err)
 	}
 	opt := composeListOptions(opts...)
 	pgn := rdb.Pagination{Size: opt.pageSize, Page: opt.pageNum - 1}
@@ -306,18 +867,20 @@ func (i *Inspector) ListActiveTasks(qname string, opts ...ListOption) ([]*TaskIn
 	case errors.IsQueueNotFound(err):
 		return nil, fmt.Errorf("asynq: %w", ErrQueueNotFound)
 	case err != nil:
-		return nil, fmt.Errorf("asynq: %v", err)
+		return nil, fmt.Errorf("asynq: %w", err)
 	}
 	var tasks []*TaskInfo
 	for _, i := range infos {
-		tasks = append(tasks, newTaskInfo(
+		info := newTaskInfo(
 			i.Message,
 			i.State,
 			i.NextProcessAt,
 			i.Result,
-		))
+		)
+		info.Progress = i.Progress
+		tasks = append(tasks, info)
 	}
-	return tasks, err
+	return i.redactTasks(tasks), err
 }
 
 // ListScheduledTasks retrieves scheduled tasks from the specified queue.
@@ -326,7 +889,7 @@ func (i *Inspector) ListActiveTasks(qname string, opts ...ListOption) ([]*TaskIn
 // By default, it retrieves the first 30 tasks.
 func (i *Inspector) ListScheduledTasks(qname string, opts ...ListOption) ([]*TaskInfo, error) {
 	if err := base.ValidateQueueName(qname); err != nil {
-		return nil, fmt.Errorf("asynq: %v", err)
+		return nil, fmt.Errorf("asynq: %w", err)
 	}
 	opt := composeListOptions(opts...)
 	pgn := rdb.Pagination{Size: opt.pageSize, Page: opt.pageNum - 1}
@@ -335,7 +898,7 @@ func (i *Inspector) ListScheduledTasks(qname string, opts ...ListOption) ([]*Tas
 	case errors.IsQueueNotFound(err):
 		return nil, fmt.Errorf("asynq: %w", ErrQueueNotFound)
 	case err != nil:
-		return nil, fmt.Errorf("asynq: %v", err)
+		return nil, fmt.Errorf("asynq: %w", err)
 	}
 	var tasks []*TaskInfo
 	for _, i := range infos {
@@ -346,7 +909,7 @@ func (i *Inspector) ListScheduledTasks(qname string, opts ...ListOption) ([]*Tas
 			i.Result,
 		))
 	}
-	return tasks, nil
+	return i.redactTasks(tasks), nil
 }
 
 // ListRetryTasks retrieves retry tasks from the specified queue.
@@ -355,7 +918,7 @@ func (i *Inspector) ListScheduledTasks(qname string, opts ...ListOption) ([]*Tas
 // By default, it retrieves the first 30 tasks.
 func (i *Inspector) ListRetryTasks(qname string, opts ...ListOption) ([]*TaskInfo, error) {
 	if err := base.ValidateQueueName(qname); err != nil {
-		return nil, fmt.Errorf("asynq: %v", err)
+		return nil, fmt.Errorf("asynq: %w", err)
 	}
 	opt := composeListOptions(opts...)
 	pgn := rdb.Pagination{Size: opt.pageSize, Page: opt.pageNum - 1}
@@ -364,7 +927,7 @@ func (i *Inspector) ListRetryTasks(qname string, opts ...ListOption) ([]*TaskInf
 	case errors.IsQueueNotFound(err):
 		return nil, fmt.Errorf("asynq: %w", ErrQueueNotFound)
 	case err != nil:
-		return nil, fmt.Errorf("asynq: %v", err)
+		return nil, fmt.Errorf("asynq: %w", err)
 	}
 	var tasks []*TaskInfo
 	for _, i := range infos {
@@ -375,7 +938,7 @@ func (i *Inspector) ListRetryTasks(qname string, opts ...ListOption) ([]*TaskInf
 			i.Result,
 		))
 	}
-	return tasks, nil
+	return i.redactTasks(tasks), nil
 }
 
 // ListArchivedTasks retrieves archived tasks from the specified queue.
@@ -384,7 +947,7 @@ func (i *Inspector) ListRetryTasks(qname string, opts ...ListOption) ([]*TaskInf
 // By default, it retrieves the first 30 tasks.
 func (i *Inspector) ListArchivedTasks(qname string, opts ...ListOption) ([]*TaskInfo, error) {
 	if err := base.ValidateQueueName(qname); err != nil {
-		return nil, fmt.Errorf("asynq: %v", err)
+		return nil, fmt.Errorf("asynq: %w", err)
 	}
 	opt := composeListOptions(opts...)
 	pgn := rdb.Pagination{Size: opt.pageSize, Page: opt.pageNum - 1}
@@ -393,7 +956,7 @@ func (i *Inspector) ListArchivedTasks(qname string, opts ...ListOption) ([]*Task
 	case errors.IsQueueNotFound(err):
 		return nil, fmt.Errorf("asynq: %w", ErrQueueNotFound)
 	case err != nil:
-		return nil, fmt.Errorf("asynq: %v", err)
+		return nil, fmt.Errorf("asynq: %w", err)
 	}
 	var tasks []*TaskInfo
 	for _, i := range infos {
@@ -404,7 +967,7 @@ func (i *Inspector) ListArchivedTasks(qname string, opts ...ListOption) ([]*Task
 			i.Result,
 		))
 	}
-	return tasks, nil
+	return i.redactTasks(tasks), nil
 }
 
 // ListCompletedTasks retrieves completed tasks from the specified queue.
@@ -413,7 +976,7 @@ func (i *Inspector) ListArchivedTasks(qname string, opts ...ListOption) ([]*Task
 // By default, it retrieves the first 30 tasks.
 func (i *Inspector) ListCompletedTasks(qname string, opts ...ListOption) ([]*TaskInfo, error) {
 	if err := base.ValidateQueueName(qname); err != nil {
-		return nil, fmt.Errorf("asynq: %v", err)
+		return nil, fmt.Errorf("asynq: %w", err)
 	}
 	opt := composeListOptions(opts...)
 	pgn := rdb.Pagination{Size: opt.pageSize, Page: opt.pageNum - 1}
@@ -422,7 +985,7 @@ func (i *Inspector) ListCompletedTasks(qname string, opts ...ListOption) ([]*Tas
 	case errors.IsQueueNotFound(err):
 		return nil, fmt.Errorf("asynq: %w", ErrQueueNotFound)
 	case err != nil:
-		return nil, fmt.Errorf("asynq: %v", err)
+		return nil, fmt.Errorf("asynq: %w", err)
 	}
 	var tasks []*TaskInfo
 	for _, i := range infos {
@@ -433,52 +996,457 @@ func (i *Inspector) ListCompletedTasks(qname string, opts ...ListOption) ([]*Tas
 			i.Result,
 		))
 	}
-	return tasks, nil
+	return i.redactTasks(tasks), nil
 }
 
-// DeleteAllPendingTasks deletes all pending tasks from the specified queue,
-// and reports the number tasks deleted.
-func (i *Inspector) DeleteAllPendingTasks(qname string) (int, error) {
+// ListWaitingTasks retrieves tasks waiting for their dependencies to complete from the specified queue.
+// Tasks are sorted by enqueue time in ascending order.
+//
+// By default, it retrieves the first 30 tasks.
+func (i *Inspector) ListWaitingTasks(qname string, opts ...ListOption) ([]*TaskInfo, error) {
 	if err := base.ValidateQueueName(qname); err != nil {
-		return 0, err
+		return nil, fmt.Errorf("asynq: %w", err)
 	}
-	n, err := i.rdb.DeleteAllPendingTasks(qname)
-	return int(n), err
+	opt := composeListOptions(opts...)
+	pgn := rdb.Pagination{Size: opt.pageSize, Page: opt.pageNum - 1}
+	infos, err := i.rdb.ListWaiting(qname, pgn)
+	switch {
+	case errors.IsQueueNotFound(err):
+		return nil, fmt.Errorf("asynq: %w", ErrQueueNotFound)
+	case err != nil:
+		return nil, fmt.Errorf("asynq: %w", err)
+	}
+	var tasks []*TaskInfo
+	for _, i := range infos {
+		tasks = append(tasks, newTaskInfo(
+			i.Message,
+			i.State,
+			i.NextProcessAt,
+			i.Result,
+		))
+	}
+	return i.redactTasks(tasks), nil
 }
 
-// DeleteAllScheduledTasks deletes all scheduled tasks from the specified queue,
-// and reports the number tasks deleted.
-func (i *Inspector) DeleteAllScheduledTasks(qname string) (int, error) {
+// ListUnhandledTasks retrieves tasks parked because no handler is registered for their type
+// from the specified queue. Tasks are sorted by the time they were parked in ascending order.
+//
+// See Config.UnhandledTaskPolicy for how tasks are parked.
+//
+// By default, it retrieves the first 30 tasks.
+func (i *Inspector) ListUnhandledTasks(qname string, opts ...ListOption) ([]*TaskInfo, error) {
 	if err := base.ValidateQueueName(qname); err != nil {
-		return 0, err
+		return nil, fmt.Errorf("asynq: %w", err)
 	}
-	n, err := i.rdb.DeleteAllScheduledTasks(qname)
-	return int(n), err
+	opt := composeListOptions(opts...)
+	pgn := rdb.Pagination{Size: opt.pageSize, Page: opt.pageNum - 1}
+	infos, err := i.rdb.ListUnhandled(qname, pgn)
+	switch {
+	case errors.IsQueueNotFound(err):
+		return nil, fmt.Errorf("asynq: %w", ErrQueueNotFound)
+	case err != nil:
+		return nil, fmt.Errorf("asynq: %w", err)
+	}
+	var tasks []*TaskInfo
+	for _, i := range infos {
+		tasks = append(tasks, newTaskInfo(
+			i.Message,
+			i.State,
+			i.NextProcessAt,
+			i.Result,
+		))
+	}
+	return i.redactTasks(tasks), nil
 }
 
-// DeleteAllRetryTasks deletes all retry tasks from the specified queue,
-// and reports the number tasks deleted.
-func (i *Inspector) DeleteAllRetryTasks(qname string) (int, error) {
-	if err := base.ValidateQueueName(qname); err != nil {
-		return 0, err
-	}
-	n, err := i.rdb.DeleteAllRetryTasks(qname)
-	return int(n), err
+// QuarantinedTask is a task whose data could not be decoded.
+//
+// List operations, and servers dequeuing such tasks (see Config.UndecodableTaskPolicy),
+// move them out of their state into the quarantine of the queue, instead of failing
+// or skipping them on every call.
+type QuarantinedTask struct {
+	// ID is the identifier of the task.
+	ID string
+
+	// Queue is the name of the queue in which the task belongs.
+	Queue string
+
+	// Data is the raw task data as stored in redis.
+	Data []byte
+
+	// State is the name of the state the task was in when it was quarantined
+	// (e.g. "pending", "archived").
+	State string
+
+	// QuarantinedAt is the time the task was quarantined.
+	QuarantinedAt time.Time
 }
 
-// DeleteAllArchivedTasks deletes all archived tasks from the specified queue,
-// and reports the number tasks deleted.
-func (i *Inspector) DeleteAllArchivedTasks(qname string) (int, error) {
+// ListQuarantinedTasks retrieves quarantined tasks from the specified queue.
+// Tasks are sorted by the time they were quarantined in ascending order.
+//
+// By default, it retrieves the first 30 tasks.
+func (i *Inspector) ListQuarantinedTasks(qname string, opts ...ListOption) ([]*QuarantinedTask, error) {
 	if err := base.ValidateQueueName(qname); err != nil {
-		return 0, err
+		return nil, fmt.Errorf("asynq: %w", err)
 	}
-	n, err := i.rdb.DeleteAllArchivedTasks(qname)
-	return int(n), err
+	opt := composeListOptions(opts...)
+	pgn := rdb.Pagination{Size: opt.pageSize, Page: opt.pageNum - 1}
+	entries, err := i.rdb.ListQuarantined(qname, pgn)
+	switch {
+	case errors.IsQueueNotFound(err):
+		return nil, fmt.Errorf("asynq: %w", ErrQueueNotFound)
+	case err != nil:
+		return nil, fmt.Errorf("asynq: %w", err)
+	}
+	var tasks []*QuarantinedTask
+	for _, e := range entries {
+		tasks = append(tasks, &QuarantinedTask{
+			ID:            e.ID,
+			Queue:         qname,
+			Data:          e.Data,
+			State:         e.State,
+			QuarantinedAt: e.QuarantinedAt,
+		})
+	}
+	return tasks, nil
 }
 
-// DeleteAllCompletedTasks deletes all completed tasks from the specified queue,
+// TaskFilter specifies a condition on the tasks counted by CountTasks,
+// or deleted, run or archived by DeleteTasks, RunTasks and ArchiveTasks.
+type TaskFilter interface{}
+
+// internal filter representation.
+type (
+	taskTypeFilter       string
+	errorContainsFilter  string
+	failedBeforeFilter   time.Time
+	enqueuedBeforeFilter time.Time
+)
+
+func composeTaskFilters(filters ...TaskFilter) rdb.TaskFilter {
+	var res rdb.TaskFilter
+	for _, f := range filters {
+		switch f := f.(type) {
+		case taskTypeFilter:
+			res.Type = string(f)
+		case errorContainsFilter:
+			res.ErrorContains = string(f)
+		case failedBeforeFilter:
+			res.FailedBefore = time.Time(f)
+		case enqueuedBeforeFilter:
+			res.EnqueuedBefore = time.Time(f)
+		default:
+			// ignore unexpected filter
+		}
+	}
+	return res
+}
+
+// FilterByType returns a filter matching the tasks of the given type.
+func FilterByType(typename string) TaskFilter {
+	return taskTypeFilter(typename)
+}
+
+// FilterByErrorContains returns a filter matching the tasks whose last error
+// message contains the given substring (e.g. "503").
+func FilterByErrorContains(substr string) TaskFilter {
+	return errorContainsFilter(substr)
+}
+
+// FilterByFailedBefore returns a filter matching the tasks which last failed before
+// the given time, e.g. time.Now().Add(-24*time.Hour) for the tasks which failed
+// more than a day ago. Tasks which never failed don't match.
+func FilterByFailedBefore(t time.Time) TaskFilter {
+	return failedBeforeFilter(t)
+}
+
+// FilterByEnqueuedBefore returns a filter matching the tasks which were enqueued
+// before the given time, e.g. time.Now().Add(-24*time.Hour) for the tasks enqueued
+// more than a day ago. Tasks enqueued by versions of asynq which didn't record
+// the enqueue time don't match.
+func FilterByEnqueuedBefore(t time.Time) TaskFilter {
+	return enqueuedBeforeFilter(t)
+}
+
+// CountTasks returns the number of tasks in the given state in the specified queue
+// which match the given filters, without retrieving the tasks.
+// If a filter of the same kind is given more than once, the last one is used.
+//
+// Without filters, the count is read from the size of the state.
+// With only a FilterByType filter, the tasks are matched in redis in a single
+// script, which blocks redis for the time it takes to read all tasks in the state.
+// With other filters, the tasks are matched in redis in batches.
+//
+// If the specified queue does not exist, CountTasks returns ErrQueueNotFound.
+func (i *Inspector) CountTasks(qname string, state TaskState, filters ...TaskFilter) (int, error) {
+	if err := base.ValidateQueueName(qname); err != nil {
+		return 0, fmt.Errorf("asynq: %w", err)
+	}
+	s, err := toBaseTaskState(state)
+	if err != nil {
+		return 0, err
+	}
+	f := composeTaskFilters(filters...)
+	var n int64
+	if f.ErrorContains != "" || !f.FailedBefore.IsZero() || !f.EnqueuedBefore.IsZero() {
+		n, err = i.rdb.UpdateTasks(qname, s, rdb.TaskActionCount, f)
+	} else {
+		n, err = i.rdb.CountTasks(qname, s, f.Type)
+	}
+	switch {
+	case errors.IsQueueNotFound(err):
+		return 0, fmt.Errorf("asynq: %w", ErrQueueNotFound)
+	case err != nil:
+		return 0, fmt.Errorf("asynq: %w", err)
+	}
+	return int(n), nil
+}
+
+func toBaseTaskState(state TaskState) (base.TaskState, error) {
+	switch state {
+	case TaskStateActive:
+		return base.TaskStateActive, nil
+	case TaskStatePending:
+		return base.TaskStatePending, nil
+	case TaskStateScheduled:
+		return base.TaskStateScheduled, nil
+	case TaskStateRetry:
+		return base.TaskStateRetry, nil
+	case TaskStateArchived:
+		return base.TaskStateArchived, nil
+	case TaskStateCompleted:
+		return base.TaskStateCompleted, nil
+	case TaskStateWaiting:
+		return base.TaskStateWaiting, nil
+	case TaskStateUnhandled:
+		return base.TaskStateUnhandled, nil
+	}
+	return 0, fmt.Errorf("asynq: unknown task state: %d", state)
+}
+
+// scanPageSize is the number of tasks read from redis at a time when scanning all tasks in a state.
+const scanPageSize = 100
+
+// listTasks lists the tasks in the given state in the queue.
+func (i *Inspector) listTasks(qname string, state base.TaskState, pgn rdb.Pagination) ([]*base.TaskInfo, error) {
+	switch state {
+	case base.TaskStateActive:
+		return i.rdb.ListActive(qname, pgn)
+	case base.TaskStatePending:
+		return i.rdb.ListPending(qname, pgn)
+	case base.TaskStateScheduled:
+		return i.rdb.ListScheduled(qname, pgn)
+	case base.TaskStateRetry:
+		return i.rdb.ListRetry(qname, pgn)
+	case base.TaskStateArchived:
+		return i.rdb.ListArchived(qname, pgn)
+	case base.TaskStateCompleted:
+		return i.rdb.ListCompleted(qname, pgn)
+	case base.TaskStateUnhandled:
+		return i.rdb.ListUnhandled(qname, pgn)
+	default:
+		return i.rdb.ListWaiting(qname, pgn)
+	}
+}
+
+// updateTasks applies the action to the tasks in the given state in the queue
+// which match the filters, and reports the number of tasks updated.
+func (i *Inspector) updateTasks(qname string, state TaskState, filters []TaskFilter, action rdb.TaskAction) (int, error) {
+	if err := base.ValidateQueueName(qname); err != nil {
+		return 0, fmt.Errorf("asynq: %w", err)
+	}
+	s, err := toBaseTaskState(state)
+	if err != nil {
+		return 0, err
+	}
+	n, err := i.rdb.UpdateTasks(qname, s, action, composeTaskFilters(filters...))
+	switch {
+	case errors.IsQueueNotFound(err):
+		return int(n), fmt.Errorf("asynq: %w", ErrQueueNotFound)
+	case err != nil:
+		return int(n), fmt.Errorf("asynq: %w", err)
+	}
+	return int(n), nil
+}
+
+// DeleteTasks deletes the tasks in the given state in the specified queue which
+// match the given filters, and reports the number of tasks deleted.
+//
+// The tasks are matched and deleted in redis in batches of 100 tasks, each in a
+// single script: a task is deleted only if it's still in the state and matches the
+// filters when its batch is run, so tasks which changed state meanwhile are skipped.
+// If an error occurs, the number of tasks already deleted is returned with the error.
+//
+// Tasks in the active or waiting state cannot be deleted.
+// If the specified queue does not exist, DeleteTasks returns an error wrapping ErrQueueNotFound.
+func (i *Inspector) DeleteTasks(qname string, state TaskState, filters ...TaskFilter) (int, error) {
+	if err := i.checkWritable(); err != nil {
+		return 0, err
+	}
+	switch state {
+	case TaskStatePending, TaskStateScheduled, TaskStateRetry, TaskStateArchived, TaskStateCompleted, TaskStateUnhandled:
+	default:
+		return 0, fmt.Errorf("asynq: cannot delete tasks in %v state", state)
+	}
+	return i.updateTasks(qname, state, filters, rdb.TaskActionDelete)
+}
+
+// RunTasks moves the tasks in the given state in the specified queue which
+// match the given filters to the pending state, and reports the number of tasks moved,
+// e.g. to retry the archived tasks of a type which failed with a given error:
+//
+//	n, err := inspector.RunTasks("default", asynq.TaskStateArchived,
+//	    asynq.FilterByType("image:resize"), asynq.FilterByErrorContains("503"))
+//
+// The tasks are matched and moved in redis in batches of 100 tasks, each in a
+// single script: a task is moved only if it's still in the state and matches the
+// filters when its batch is run, so tasks which changed state meanwhile are skipped.
+// If an error occurs, the number of tasks already moved is returned with the error.
+// Archived tasks whose payload was truncated are skipped.
+//
+// Only tasks in the scheduled, retry, archived or unhandled state can be run.
+// If the specified queue does not exist, RunTasks returns an error wrapping ErrQueueNotFound.
+func (i *Inspector) RunTasks(qname string, state TaskState, filters ...TaskFilter) (int, error) {
+	if err := i.checkWritable(); err != nil {
+		return 0, err
+	}
+	switch state {
+	case TaskStateScheduled, TaskStateRetry, TaskStateArchived, TaskStateUnhandled:
+	default:
+		return 0, fmt.Errorf("asynq: cannot run tasks in %v state", state)
+	}
+	return i.updateTasks(qname, state, filters, rdb.TaskActionRun)
+}
+
+// ArchiveTasks archives the tasks in the given state in the specified queue which
+// match the given filters, and reports the number of tasks archived.
+//
+// The tasks are matched and archived in redis in batches of 100 tasks, each in a
+// single script: a task is archived only if it's still in the state and matches the
+// filters when its batch is run, so tasks which changed state meanwhile are skipped.
+// If an error occurs, the number of tasks already archived is returned with the error.
+//
+// Only tasks in the pending, scheduled or retry state can be archived.
+// If the specified queue does not exist, ArchiveTasks returns an error wrapping ErrQueueNotFound.
+func (i *Inspector) ArchiveTasks(qname string, state TaskState, filters ...TaskFilter) (int, error) {
+	if err := i.checkWritable(); err != nil {
+		return 0, err
+	}
+	switch state {
+	case TaskStatePending, TaskStateScheduled, TaskStateRetry:
+	default:
+		return 0, fmt.Errorf("asynq: cannot archive tasks in %v state", state)
+	}
+	return i.updateTasks(qname, state, filters, rdb.TaskActionArchive)
+}
+
+// ListTasksWithoutVersionHandler retrieves the tasks in the given state in the specified queue
+// whose type is versioned (e.g. "email:send@v3") and has no handler registered in mux
+// for its version. Such tasks are processed by the handler of the latest version if
+// version fallback is enabled on mux, or matched against the other patterns otherwise.
+//
+// Use it before and during a rolling deployment, with the mux of the servers being
+// deployed, to find the tasks whose version the servers can't process as-is.
+//
+// All tasks in the state are read to find the matching ones.
+// By default, it retrieves the first 30 matching tasks.
+func (i *Inspector) ListTasksWithoutVersionHandler(qname string, state TaskState, mux *ServeMux, opts ...ListOption) ([]*TaskInfo, error) {
+	if err := base.ValidateQueueName(qname); err != nil {
+		return nil, fmt.Errorf("asynq: %w", err)
+	}
+	s, err := toBaseTaskState(state)
+	if err != nil {
+		return nil, err
+	}
+	opt := composeListOptions(opts...)
+	skip := (opt.pageNum - 1) * opt.pageSize
+	var tasks []*TaskInfo
+	for page := 0; len(tasks) < opt.pageSize; page++ {
+		infos, err := i.listTasks(qname, s, rdb.Pagination{Size: scanPageSize, Page: page})
+		switch {
+		case errors.IsQueueNotFound(err):
+			return nil, fmt.Errorf("asynq: %w", ErrQueueNotFound)
+		case err != nil:
+			return nil, fmt.Errorf("asynq: %w", err)
+		}
+		for _, info := range infos {
+			if mux.hasVersionHandler(info.Message.Type) {
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			if len(tasks) < opt.pageSize {
+				tasks = append(tasks, newTaskInfo(info.Message, info.State, info.NextProcessAt, info.Result))
+			}
+		}
+		if len(infos) < scanPageSize {
+			break
+		}
+	}
+	return i.redactTasks(tasks), nil
+}
+
+// DeleteAllPendingTasks deletes all pending tasks from the specified queue,
+// and reports the number tasks deleted.
+func (i *Inspector) DeleteAllPendingTasks(qname string) (int, error) {
+	if err := i.checkWritable(); err != nil {
+		return 0, err
+	}
+	if err := base.ValidateQueueName(qname); err != nil {
+		return 0, err
+	}
+	n, err := i.rdb.DeleteAllPendingTasks(qname)
+	return int(n), err
+}
+
+// DeleteAllScheduledTasks deletes all scheduled tasks from the specified queue,
+// and reports the number tasks deleted.
+func (i *Inspector) DeleteAllScheduledTasks(qname string) (int, error) {
+	if err := i.checkWritable(); err != nil {
+		return 0, err
+	}
+	if err := base.ValidateQueueName(qname); err != nil {
+		return 0, err
+	}
+	n, err := i.rdb.DeleteAllScheduledTasks(qname)
+	return int(n), err
+}
+
+// DeleteAllRetryTasks deletes all retry tasks from the specified queue,
+// and reports the number tasks deleted.
+func (i *Inspector) DeleteAllRetryTasks(qname string) (int, error) {
+	if err := i.checkWritable(); err != nil {
+		return 0, err
+	}
+	if err := base.ValidateQueueName(qname); err != nil {
+		return 0, err
+	}
+	n, err := i.rdb.DeleteAllRetryTasks(qname)
+	return int(n), err
+}
+
+// DeleteAllArchivedTasks deletes all archived tasks from the specified queue,
+// and reports the number tasks deleted.
+func (i *Inspector) DeleteAllArchivedTasks(qname string) (int, error) {
+	if err := i.checkWritable(); err != nil {
+		return 0, err
+	}
+	if err := base.ValidateQueueName(qname); err != nil {
+		return 0, err
+	}
+	n, err := i.rdb.DeleteAllArchivedTasks(qname)
+	return int(n), err
+}
+
+// DeleteAllCompletedTasks deletes all completed tasks from the specified queue,
 // and reports the number tasks deleted.
 func (i *Inspector) DeleteAllCompletedTasks(qname string) (int, error) {
+	if err := i.checkWritable(); err != nil {
+		return 0, err
+	}
 	if err := base.ValidateQueueName(qname); err != nil {
 		return 0, err
 	}
@@ -486,6 +1454,175 @@ func (i *Inspector) DeleteAllCompletedTasks(qname string) (int, error) {
 	return int(n), err
 }
 
+// RepairQuarantinedTask replaces the data of the quarantined task with the given ID
+// with data, the encoding of a task message repaired from the data of the task
+// (see QuarantinedTask.Data), and moves the task to pending to be processed.
+//
+// Returns an error wrapping ErrQueueNotFound if a queue with the given name doesn't exist.
+// Returns an error wrapping ErrTaskNotFound if the task is not quarantined.
+// Returns an error if data cannot be decoded, or is the message of another task.
+func (i *Inspector) RepairQuarantinedTask(qname, id string, data []byte) error {
+	if err := i.checkWritable(); err != nil {
+		return err
+	}
+	if err := base.ValidateQueueName(qname); err != nil {
+		return fmt.Errorf("asynq: %w", err)
+	}
+	err := i.rdb.RepairQuarantinedTask(qname, id, data)
+	switch {
+	case errors.IsQueueNotFound(err):
+		return fmt.Errorf("asynq: %w", ErrQueueNotFound)
+	case errors.IsTaskNotFound(err):
+		return fmt.Errorf("asynq: %w", ErrTaskNotFound)
+	case err != nil:
+		return fmt.Errorf("asynq: %w", err)
+	}
+	return nil
+}
+
+// DeleteAllQuarantinedTasks deletes all quarantined tasks from the specified queue,
+// and reports the number tasks deleted.
+func (i *Inspector) DeleteAllQuarantinedTasks(qname string) (int, error) {
+	if err := i.checkWritable(); err != nil {
+		return 0, err
+	}
+	if err := base.ValidateQueueName(qname); err != nil {
+		return 0, err
+	}
+	n, err := i.rdb.DeleteAllQuarantinedTasks(qname)
+	return int(n), err
+}
+
+// DeleteAllUnhandledTasks deletes all unhandled tasks from the specified queue,
+// and reports the number tasks deleted.
+func (i *Inspector) DeleteAllUnhandledTasks(qname string) (int, error) {
+	if err := i.checkWritable(); err != nil {
+		return 0, err
+	}
+	if err := base.ValidateQueueName(qname); err != nil {
+		return 0, err
+	}
+	n, err := i.rdb.DeleteAllUnhandledTasks(qname)
+	return int(n), err
+}
+
+// CloneTask enqueues a copy of the archived task with the given id to the pending state
+// of the same queue, with the given payload instead of the payload of the archived task,
+// e.g. to process a task again after correcting the input which made it fail.
+// The archived task is left in place and the clone refers to it with TaskInfo.ClonedFrom.
+//
+// The clone has a new ID and keeps the type, retry count, timeout, retention, headers
+// and class of the archived task; its deadline is kept only if it hasn't passed.
+// Options which don't apply to a task processed anew (e.g. Unique, GroupKey and
+// DependsOn) are not kept. Note that the clone is not signed (see Config.SigningKey).
+//
+// If a queue with the given name doesn't exist, it returns an error wrapping ErrQueueNotFound.
+// If a task with the given id doesn't exist in the queue, it returns an error wrapping ErrTaskNotFound.
+// If the task is not archived, or its payload was truncated when it was archived
+// (see Config.MaxArchivedPayloadSize), it returns a non-nil error.
+func (i *Inspector) CloneTask(qname, id string, payload []byte) (*TaskInfo, error) {
+	if err := i.checkWritable(); err != nil {
+		return nil, err
+	}
+	if err := base.ValidateQueueName(qname); err != nil {
+		return nil, fmt.Errorf("asynq: %w", err)
+	}
+	info, err := i.rdb.GetTaskInfo(qname, id)
+	switch {
+	case errors.IsQueueNotFound(err):
+		return nil, fmt.Errorf("asynq: %w", ErrQueueNotFound)
+	case errors.IsTaskNotFound(err):
+		return nil, fmt.Errorf("asynq: %w", ErrTaskNotFound)
+	case err != nil:
+		return nil, fmt.Errorf("asynq: %w", err)
+	}
+	if info.State != base.TaskStateArchived {
+		return nil, fmt.Errorf("asynq: cannot clone task in %v state, only archived tasks can be cloned", info.State)
+	}
+	orig := info.Message
+	if orig.PayloadSize > 0 {
+		return nil, fmt.Errorf("asynq: cannot clone task whose payload was truncated when it was archived")
+	}
+	now := time.Now()
+	msg := &base.TaskMessage{
+		ID:         uuid.NewString(),
+		Type:       orig.Type,
+		Payload:    payload,
+		Queue:      orig.Queue,
+		Retry:      orig.Retry,
+		Timeout:    orig.Timeout,
+		Deadline:   orig.Deadline,
+		Retention:  orig.Retention,
+		Headers:    orig.Headers,
+		AtMostOnce: orig.AtMostOnce,
+		Class:      orig.Class,
+		Labels:     orig.Labels,
+		ClonedFrom: orig.ID,
+
+		DefaultRetry: orig.DefaultRetry,
+	}
+	if msg.Deadline != noDeadline.Unix() && msg.Deadline <= now.Unix() {
+		msg.Deadline = noDeadline.Unix()
+		if msg.Timeout == 0 {
+			msg.Timeout = int64(defaultTimeout.Seconds())
+		}
+	}
+	if err := i.rdb.Enqueue(context.Background(), msg); err != nil {
+		return nil, fmt.Errorf("asynq: %w", err)
+	}
+	clone := newTaskInfo(msg, base.TaskStatePending, now, nil)
+	clone.Payload = i.redactPayload(clone.Type, clone.Payload)
+	return clone, nil
+}
+
+// PurgeQueue deletes all tasks in the given state from the specified queue,
+// and reports the number of tasks deleted.
+//
+// If dryRun is true, no task is deleted and PurgeQueue reports the number of
+// tasks which would be deleted, so that the operation can be previewed.
+// Note that tasks may change state between the preview and the purge.
+//
+// Tasks in the active or waiting state cannot be purged.
+// If the specified queue does not exist, PurgeQueue returns an error wrapping ErrQueueNotFound.
+func (i *Inspector) PurgeQueue(qname string, state TaskState, dryRun bool) (int, error) {
+	if !dryRun {
+		if err := i.checkWritable(); err != nil {
+			return 0, err
+		}
+	}
+	if err := base.ValidateQueueName(qname); err != nil {
+		return 0, fmt.Errorf("asynq: %w", err)
+	}
+	var purge func(qname string) (int64, error)
+	switch state {
+	case TaskStatePending:
+		purge = i.rdb.DeleteAllPendingTasks
+	case TaskStateScheduled:
+		purge = i.rdb.DeleteAllScheduledTasks
+	case TaskStateRetry:
+		purge = i.rdb.DeleteAllRetryTasks
+	case TaskStateArchived:
+		purge = i.rdb.DeleteAllArchivedTasks
+	case TaskStateCompleted:
+		purge = i.rdb.DeleteAllCompletedTasks
+	case TaskStateUnhandled:
+		purge = i.rdb.DeleteAllUnhandledTasks
+	default:
+		return 0, fmt.Errorf("asynq: cannot purge tasks in %v state", state)
+	}
+	if dryRun {
+		return i.CountTasks(qname, state)
+	}
+	n, err := purge(qname)
+	switch {
+	case errors.IsQueueNotFound(err):
+		return 0, fmt.Errorf("asynq: %w", ErrQueueNotFound)
+	case err != nil:
+		return 0, fmt.Errorf("asynq: %w", err)
+	}
+	return int(n), nil
+}
+
 // DeleteTask deletes a task with the given id from the given queue.
 // The task needs to be in pending, scheduled, retry, or archived state,
 // otherwise DeleteTask will return an error.
@@ -494,8 +1631,11 @@ func (i *Inspector) DeleteAllCompletedTasks(qname string) (int, error) {
 // If a task with the given id doesn't exist in the queue, it returns an error wrapping ErrTaskNotFound.
 // If the task is in active state, it returns a non-nil error.
 func (i *Inspector) DeleteTask(qname, id string) error {
+	if err := i.checkWritable(); err != nil {
+		return err
+	}
 	if err := base.ValidateQueueName(qname); err != nil {
-		return fmt.Errorf("asynq: %v", err)
+		return fmt.Errorf("asynq: %w", err)
 	}
 	err := i.rdb.DeleteTask(qname, id)
 	switch {
@@ -504,7 +1644,7 @@ func (i *Inspector) DeleteTask(qname, id string) error {
 	case errors.IsTaskNotFound(err):
 		return fmt.Errorf("asynq: %w", ErrTaskNotFound)
 	case err != nil:
-		return fmt.Errorf("asynq: %v", err)
+		return fmt.Errorf("asynq: %w", err)
 	}
 	return nil
 
@@ -513,6 +1653,9 @@ func (i *Inspector) DeleteTask(qname, id string) error {
 // RunAllScheduledTasks transition all scheduled tasks to pending state from the given queue,
 // and reports the number of tasks transitioned.
 func (i *Inspector) RunAllScheduledTasks(qname string) (int, error) {
+	if err := i.checkWritable(); err != nil {
+		return 0, err
+	}
 	if err := base.ValidateQueueName(qname); err != nil {
 		return 0, err
 	}
@@ -523,6 +1666,9 @@ func (i *Inspector) RunAllScheduledTasks(qname string) (int, error) {
 // RunAllRetryTasks transition all retry tasks to pending state from the given queue,
 // and reports the number of tasks transitioned.
 func (i *Inspector) RunAllRetryTasks(qname string) (int, error) {
+	if err := i.checkWritable(); err != nil {
+		return 0, err
+	}
 	if err := base.ValidateQueueName(qname); err != nil {
 		return 0, err
 	}
@@ -532,7 +1678,11 @@ func (i *Inspector) RunAllRetryTasks(qname string) (int, error) {
 
 // RunAllArchivedTasks transition all archived tasks to pending state from the given queue,
 // and reports the number of tasks transitioned.
+// Tasks whose payload was truncated when they were archived are left in the archive.
 func (i *Inspector) RunAllArchivedTasks(qname string) (int, error) {
+	if err := i.checkWritable(); err != nil {
+		return 0, err
+	}
 	if err := base.ValidateQueueName(qname); err != nil {
 		return 0, err
 	}
@@ -540,16 +1690,60 @@ func (i *Inspector) RunAllArchivedTasks(qname string) (int, error) {
 	return int(n), err
 }
 
+// RunAllArchivedTasksAtRate transition all archived tasks from the given queue to
+// pending state at a rate of perSecond tasks per second, and reports the number of
+// tasks to transition. As with RunAllArchivedTasks, tasks whose payload was truncated
+// are left in the archive.
+//
+// The tasks are moved to scheduled state, to be processed in the order they were
+// archived, so that rescuing a large number of tasks does not overload again the
+// downstream service which made them fail.
+func (i *Inspector) RunAllArchivedTasksAtRate(qname string, perSecond int) (int, error) {
+	if err := i.checkWritable(); err != nil {
+		return 0, err
+	}
+	if err := base.ValidateQueueName(qname); err != nil {
+		return 0, err
+	}
+	if perSecond < 1 {
+		return 0, fmt.Errorf("asynq: rate must be positive, got %d", perSecond)
+	}
+	n, err := i.rdb.RunAllArchivedTasksAtRate(qname, perSecond)
+	if errors.IsQueueNotFound(err) {
+		return 0, fmt.Errorf("%w: queue=%q", ErrQueueNotFound, qname)
+	}
+	return int(n), err
+}
+
+// RunAllUnhandledTasks transition all unhandled tasks to pending state from the given queue,
+// and reports the number of tasks transitioned.
+//
+// Use it once servers with a handler for the types of the tasks are deployed.
+func (i *Inspector) RunAllUnhandledTasks(qname string) (int, error) {
+	if err := i.checkWritable(); err != nil {
+		return 0, err
+	}
+	if err := base.ValidateQueueName(qname); err != nil {
+		return 0, err
+	}
+	n, err := i.rdb.RunAllUnhandledTasks(qname)
+	return int(n), err
+}
+
 // RunTask updates the task to pending state given a queue name and task id.
 // The task needs to be in scheduled, retry, or archived state, otherwise RunTask
 // will return an error.
 //
 // If a queue with the given name doesn't exist, it returns an error wrapping ErrQueueNotFound.
 // If a task with the given id doesn't exist in the queue, it returns an error wrapping ErrTaskNotFound.
-// If the task is in pending or active state, it returns a non-nil error.
+// If the task is in pending or active state, or is archived with a truncated payload
+// (see Config.MaxArchivedPayloadSize), it returns a non-nil error.
 func (i *Inspector) RunTask(qname, id string) error {
+	if err := i.checkWritable(); err != nil {
+		return err
+	}
 	if err := base.ValidateQueueName(qname); err != nil {
-		return fmt.Errorf("asynq: %v", err)
+		return fmt.Errorf("asynq: %w", err)
 	}
 	err := i.rdb.RunTask(qname, id)
 	switch {
@@ -558,7 +1752,7 @@ func (i *Inspector) RunTask(qname, id string) error {
 	case errors.IsTaskNotFound(err):
 		return fmt.Errorf("asynq: %w", ErrTaskNotFound)
 	case err != nil:
-		return fmt.Errorf("asynq: %v", err)
+		return fmt.Errorf("asynq: %w", err)
 	}
 	return nil
 }
@@ -566,6 +1760,9 @@ func (i *Inspector) RunTask(qname, id string) error {
 // ArchiveAllPendingTasks archives all pending tasks from the given queue,
 // and reports the number of tasks archived.
 func (i *Inspector) ArchiveAllPendingTasks(qname string) (int, error) {
+	if err := i.checkWritable(); err != nil {
+		return 0, err
+	}
 	if err := base.ValidateQueueName(qname); err != nil {
 		return 0, err
 	}
@@ -576,6 +1773,9 @@ func (i *Inspector) ArchiveAllPendingTasks(qname string) (int, error) {
 // ArchiveAllScheduledTasks archives all scheduled tasks from the given queue,
 // and reports the number of tasks archiveed.
 func (i *Inspector) ArchiveAllScheduledTasks(qname string) (int, error) {
+	if err := i.checkWritable(); err != nil {
+		return 0, err
+	}
 	if err := base.ValidateQueueName(qname); err != nil {
 		return 0, err
 	}
@@ -586,6 +1786,9 @@ func (i *Inspector) ArchiveAllScheduledTasks(qname string) (int, error) {
 // ArchiveAllRetryTasks archives all retry tasks from the given queue,
 // and reports the number of tasks archiveed.
 func (i *Inspector) ArchiveAllRetryTasks(qname string) (int, error) {
+	if err := i.checkWritable(); err != nil {
+		return 0, err
+	}
 	if err := base.ValidateQueueName(qname); err != nil {
 		return 0, err
 	}
@@ -593,6 +1796,65 @@ func (i *Inspector) ArchiveAllRetryTasks(qname string) (int, error) {
 	return int(n), err
 }
 
+// ArchiveStaleTasks archives the scheduled and retry tasks of the given queue which
+// were to be processed more than the given age ago, with the ArchiveReasonStale reason,
+// and reports the number of tasks archived. Ready tasks are moved to the pending state
+// as soon as a server is running, so such tasks are stuck, e.g. because of a past bug.
+//
+// Servers archive stale tasks periodically if Config.StaleTaskAge is set.
+//
+// If a queue with the given name doesn't exist, it returns an error wrapping ErrQueueNotFound.
+func (i *Inspector) ArchiveStaleTasks(qname string, age time.Duration) (int, error) {
+	if err := i.checkWritable(); err != nil {
+		return 0, err
+	}
+	if err := base.ValidateQueueName(qname); err != nil {
+		return 0, err
+	}
+	if age <= 0 {
+		return 0, fmt.Errorf("asynq: age must be positive, got %v", age)
+	}
+	n, err := i.rdb.ArchiveStaleTasks(qname, time.Now().Add(-age))
+	switch {
+	case errors.IsQueueNotFound(err):
+		return 0, fmt.Errorf("%w: queue=%q", ErrQueueNotFound, qname)
+	case err != nil:
+		return int(n), fmt.Errorf("asynq: %w", err)
+	}
+	return int(n), nil
+}
+
+// DelayQueue postpones all the scheduled and retry tasks of the given queue by d,
+// e.g. during a known outage of a service their handlers depend on, and reports the
+// number of tasks delayed. The process time of each task is moved forward by d, in
+// batches of 100 tasks. Pending tasks are not affected; pause the queue to hold them.
+//
+// Tasks which would be delayed past the time by which they must start processing
+// (see the TTL option) are not delayed, so that they aren't discarded.
+// The retries delayed are not moved back within the RetryWindows of the servers:
+// a retry delayed outside of the window of its queue runs at its new time.
+//
+// If a queue with the given name doesn't exist, it returns an error wrapping ErrQueueNotFound.
+func (i *Inspector) DelayQueue(qname string, d time.Duration) (int, error) {
+	if err := i.checkWritable(); err != nil {
+		return 0, err
+	}
+	if err := base.ValidateQueueName(qname); err != nil {
+		return 0, err
+	}
+	if d < time.Second {
+		return 0, fmt.Errorf("asynq: delay must be at least a second, got %v", d)
+	}
+	n, err := i.rdb.DelayQueue(qname, d)
+	switch {
+	case errors.IsQueueNotFound(err):
+		return 0, fmt.Errorf("%w: queue=%q", ErrQueueNotFound, qname)
+	case err != nil:
+		return 0, fmt.Errorf("asynq: %w", err)
+	}
+	return int(n), nil
+}
+
 // ArchiveTask archives a task with the given id in the given queue.
 // The task needs to be in pending, scheduled, or retry state, otherwise ArchiveTask
 // will return an error.
@@ -601,6 +1863,9 @@ func (i *Inspector) ArchiveAllRetryTasks(qname string) (int, error) {
 // If a task with the given id doesn't exist in the queue, it returns an error wrapping ErrTaskNotFound.
 // If the task is in already archived, it returns a non-nil error.
 func (i *Inspector) ArchiveTask(qname, id string) error {
+	if err := i.checkWritable(); err != nil {
+		return err
+	}
 	if err := base.ValidateQueueName(qname); err != nil {
 		return fmt.Errorf("asynq: err")
 	}
@@ -611,7 +1876,7 @@ func (i *Inspector) ArchiveTask(qname, id string) error {
 	case errors.IsTaskNotFound(err):
 		return fmt.Errorf("asynq: %w", ErrTaskNotFound)
 	case err != nil:
-		return fmt.Errorf("asynq: %v", err)
+		return fmt.Errorf("asynq: %w", err)
 	}
 	return nil
 }
@@ -621,12 +1886,152 @@ func (i *Inspector) ArchiveTask(qname, id string) error {
 // guarantee that the task with the given id will be canceled. The return
 // value only indicates whether the cancelation signal has been sent.
 func (i *Inspector) CancelProcessing(id string) error {
+	if err := i.checkWritable(); err != nil {
+		return err
+	}
 	return i.rdb.PublishCancelation(id)
 }
 
+// SetServerConcurrency sends a signal to the server with the given id to change
+// its concurrency to n. Like CancelProcessing, SetServerConcurrency is best-effort:
+// the return value only indicates whether the signal has been sent.
+//
+// The new concurrency is reported in ServerInfo.Concurrency after the server's next heartbeat.
+func (i *Inspector) SetServerConcurrency(serverID string, n int) error {
+	if err := i.checkWritable(); err != nil {
+		return err
+	}
+	if n < 1 {
+		return fmt.Errorf("asynq: concurrency must be positive, got %d", n)
+	}
+	return i.rdb.PublishConcurrency(serverID, n)
+}
+
+// QuietServer sends a signal to the server with the given id to stop processing
+// new tasks, as Server.Stop does. Active tasks are processed to completion, and the
+// server keeps running until it is shut down. Like CancelProcessing, QuietServer is
+// best-effort: the return value only indicates whether the signal has been sent.
+//
+// The server is reported as "stopped" in ServerInfo.Status after its next heartbeat.
+func (i *Inspector) QuietServer(serverID string) error {
+	if err := i.checkWritable(); err != nil {
+		return err
+	}
+	return i.rdb.PublishQuiet(serverID)
+}
+
+// RequeueOrphans moves the tasks being processed by the server with the given id
+// back to the head of their queues, and removes the server from the list of servers.
+// It returns the number of tasks requeued.
+//
+// Use RequeueOrphans when the server is known to be dead (e.g. its host failed),
+// to get its tasks processed by other servers right away instead of once their
+// deadline passes. If the server is still running, its tasks are processed twice.
+// The state of a dead server expires once its heartbeat times out, after which
+// its tasks can only be recovered through their deadline.
+//
+// Returns an error wrapping ErrServerNotFound if no server with the given id is found.
+func (i *Inspector) RequeueOrphans(serverID string) (int, error) {
+	if err := i.checkWritable(); err != nil {
+		return 0, err
+	}
+	n, err := i.rdb.RequeueOrphans(serverID)
+	switch {
+	case errors.CanonicalCode(err) == errors.NotFound:
+		return 0, fmt.Errorf("%w: server=%q", ErrServerNotFound, serverID)
+	case err != nil:
+		return n, fmt.Errorf("asynq: %w", err)
+	}
+	return n, nil
+}
+
+// UniqueLock describes a uniqueness lock held by a task enqueued with the Unique option.
+//
+// While the lock is held, tasks of the same type and payload cannot be enqueued
+// in the queue. The lock is released once the task is processed successfully or
+// deleted, or when the lock expires.
+type UniqueLock struct {
+	// Queue is the name of the queue of the lock.
+	Queue string
+
+	// Key is the redis key of the lock.
+	Key string
+
+	// Type is the type of the tasks locked out.
+	Type string
+
+	// TaskID is the ID of the task holding the lock.
+	TaskID string
+
+	// TTL is the time remaining until the lock expires.
+	// It is negative if the lock doesn't expire.
+	TTL time.Duration
+}
+
+// ListUniqueLocks returns the uniqueness locks held in the queue, sorted by key.
+//
+// The keys of the queue are scanned to find the locks, which takes time
+// proportional to the number of keys in the database.
+//
+// If a queue with the given name doesn't exist, it returns an error wrapping ErrQueueNotFound.
+func (i *Inspector) ListUniqueLocks(qname string) ([]*UniqueLock, error) {
+	if err := base.ValidateQueueName(qname); err != nil {
+		return nil, err
+	}
+	locks, err := i.rdb.ListUniqueLocks(qname)
+	switch {
+	case errors.IsQueueNotFound(err):
+		return nil, fmt.Errorf("%w: queue=%q", ErrQueueNotFound, qname)
+	case err != nil:
+		return nil, fmt.Errorf("asynq: %w", err)
+	}
+	prefix := base.UniqueKeyPrefix(qname)
+	res := make([]*UniqueLock, len(locks))
+	for j, l := range locks {
+		// The key is <prefix><type>:<checksum of the payload>.
+		typename := strings.TrimPrefix(l.Key, prefix)
+		if k := strings.LastIndex(typename, ":"); k >= 0 {
+			typename = typename[:k]
+		}
+		res[j] = &UniqueLock{
+			Queue:  qname,
+			Key:    l.Key,
+			Type:   typename,
+			TaskID: l.TaskID,
+			TTL:    l.TTL,
+		}
+	}
+	return res, nil
+}
+
+// ReleaseUniqueLock releases the uniqueness lock with the given key in the queue,
+// e.g. a lock held by a task which is stuck, so that a task with the same type and
+// payload can be enqueued again. The task holding the lock is left as is.
+//
+// If the lock doesn't exist, it returns an error wrapping ErrUniqueLockNotFound.
+func (i *Inspector) ReleaseUniqueLock(qname, key string) error {
+	if err := i.checkWritable(); err != nil {
+		return err
+	}
+	if err := base.ValidateQueueName(qname); err != nil {
+		return err
+	}
+	err := i.rdb.ReleaseUniqueLock(qname, key)
+	switch {
+	case errors.CanonicalCode(err) == errors.NotFound:
+		return fmt.Errorf("%w: queue=%q key=%q", ErrUniqueLockNotFound, qname, key)
+	case err != nil:
+		return fmt.Errorf("asynq: %w", err)
+	}
+	return nil
+}
+
 // PauseQueue pauses task processing on the specified queue.
 // If the queue is already paused, it will return a non-nil error.
 func (i *Inspector) PauseQueue(qname string) error {
+	if err := i.checkWritable(); err != nil {
+		return err
+	}
 	if err := base.ValidateQueueName(qname); err != nil {
 		return err
 	}
@@ -636,12 +2041,47 @@ func (i *Inspector) PauseQueue(qname string) error {
 // UnpauseQueue resumes task processing on the specified queue.
 // If the queue is not paused, it will return a non-nil error.
 func (i *Inspector) UnpauseQueue(qname string) error {
+	if err := i.checkWritable(); err != nil {
+		return err
+	}
 	if err := base.ValidateQueueName(qname); err != nil {
 		return err
 	}
 	return i.rdb.Unpause(qname)
 }
 
+// DrainQueue stops the specified queue from accepting new tasks.
+// Enqueueing a task to a draining queue fails with ErrQueueDraining, while
+// tasks already in the queue continue to be processed.
+//
+// The queue stays draining until it's undrained with UndrainQueue, or deleted with DeleteQueue.
+// If the queue is already draining, it will return a non-nil error.
+func (i *Inspector) DrainQueue(qname string) error {
+	if err := i.checkWritable(); err != nil {
+		return err
+	}
+	if err := base.ValidateQueueName(qname); err != nil {
+		return err
+	}
+	err := i.rdb.DrainQueue(qname)
+	if errors.IsQueueNotFound(err) {
+		return fmt.Errorf("%w: queue=%q", ErrQueueNotFound, qname)
+	}
+	return err
+}
+
+// UndrainQueue lets the specified draining queue accept new tasks again.
+// If the queue is not draining, it will return a non-nil error.
+func (i *Inspector) UndrainQueue(qname string) error {
+	if err := i.checkWritable(); err != nil {
+		return err
+	}
+	if err := base.ValidateQueueName(qname); err != nil {
+		return err
+	}
+	return i.rdb.UndrainQueue(qname)
+}
+
 // Servers return a list of running servers' information.
 func (i *Inspector) Servers() ([]*ServerInfo, error) {
 	servers, err := i.rdb.ListServers()
@@ -655,15 +2095,20 @@ func (i *Inspector) Servers() ([]*ServerInfo, error) {
 	m := make(map[string]*ServerInfo) // ServerInfo keyed by serverID
 	for _, s := range servers {
 		m[s.ServerID] = &ServerInfo{
-			ID:             s.ServerID,
-			Host:           s.Host,
-			PID:            s.PID,
-			Concurrency:    s.Concurrency,
-			Queues:         s.Queues,
-			StrictPriority: s.StrictPriority,
-			Started:        s.Started,
-			Status:         s.Status,
-			ActiveWorkers:  make([]*WorkerInfo, 0),
+			ID:               s.ServerID,
+			Host:             s.Host,
+			PID:              s.PID,
+			Concurrency:      s.Concurrency,
+			Queues:           s.Queues,
+			StrictPriority:   s.StrictPriority,
+			Started:          s.Started,
+			Status:           s.Status,
+			Environment:      s.Environment,
+			ShutdownFinished: s.ShutdownFinished,
+			ShutdownRequeued: s.ShutdownRequeued,
+			Version:          s.Version,
+			Features:         s.Features,
+			ActiveWorkers:    make([]*WorkerInfo, 0),
 		}
 	}
 	for _, w := range workers {
@@ -674,7 +2119,7 @@ func (i *Inspector) Servers() ([]*ServerInfo, error) {
 		wrkInfo := &WorkerInfo{
 			TaskID:      w.ID,
 			TaskType:    w.Type,
-			TaskPayload: w.Payload,
+			TaskPayload: i.redactPayload(w.Type, w.Payload),
 			Queue:       w.Queue,
 			Started:     w.Started,
 			Deadline:    w.Deadline,
@@ -688,6 +2133,95 @@ func (i *Inspector) Servers() ([]*ServerInfo, error) {
 	return out, nil
 }
 
+// ConfigDrift describes a setting whose value differs between the running
+// servers of an environment, e.g. during a partial deploy.
+type ConfigDrift struct {
+	// Environment of the servers (see Config.Environment).
+	// Empty for the servers without an environment.
+	Environment string
+
+	// Setting is the name of the setting which differs:
+	// "Version", "Concurrency", "Features", "Queues" or "StrictPriority".
+	Setting string
+
+	// Values maps each value of the setting to the IDs of the servers
+	// configured with the value.
+	// Queues are formatted as "name:priority" pairs sorted by name, e.g. "critical:6 default:3",
+	// and features as a comma-separated list.
+	Values map[string][]string
+}
+
+// ConfigDrift compares the configurations of the running servers, and returns
+// the settings whose value differs between the servers of the same environment,
+// sorted by environment and setting.
+//
+// Servers which have shut down are ignored.
+func (i *Inspector) ConfigDrift() ([]*ConfigDrift, error) {
+	servers, err := i.rdb.ListServers()
+	if err != nil {
+		return nil, err
+	}
+	settings := []struct {
+		name  string
+		value func(s *base.ServerInfo) string
+	}{
+		{"Concurrency", func(s *base.ServerInfo) string { return strconv.Itoa(s.Concurrency) }},
+		{"Features", func(s *base.ServerInfo) string { return strings.Join(s.Features, ",") }},
+		{"Queues", func(s *base.ServerInfo) string { return formatQueueConfig(s.Queues) }},
+		{"StrictPriority", func(s *base.ServerInfo) string { return strconv.FormatBool(s.StrictPriority) }},
+		{"Version", func(s *base.ServerInfo) string { return s.Version }},
+	}
+	envs := make(map[string][]*base.ServerInfo)
+	for _, s := range servers {
+		if s.Status == "closed" {
+			continue
+		}
+		envs[s.Environment] = append(envs[s.Environment], s)
+	}
+	var res []*ConfigDrift
+	for env, ss := range envs {
+		for _, setting := range settings {
+			values := make(map[string][]string)
+			for _, s := range ss {
+				v := setting.value(s)
+				values[v] = append(values[v], s.ServerID)
+			}
+			if len(values) < 2 {
+				continue
+			}
+			for _, ids := range values {
+				sort.Strings(ids)
+			}
+			res = append(res, &ConfigDrift{Environment: env, Setting: setting.name, Values: values})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Environment != res[j].Environment {
+			return res[i].Environment < res[j].Environment
+		}
+		return res[i].Setting < res[j].Setting
+	})
+	return res, nil
+}
+
+// formatQueueConfig formats the queue priorities of a server as "name:priority"
+// pairs sorted by name.
+func formatQueueConfig(queues map[string]int) string {
+	var qnames []string
+	for qname := range queues {
+		qnames = append(qnames, qname)
+	}
+	sort.Strings(qnames)
+	var b strings.Builder
+	for i, qname := range qnames {
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		fmt.Fprintf(&b, "%s:%d", qname, queues[qname])
+	}
+	return b.String()
+}
+
 // ServerInfo describes a running Server instance.
 type ServerInfo struct {
 	// Unique Identifier for the server.
@@ -706,8 +2240,23 @@ type ServerInfo struct {
 	// Time the server started.
 	Started time.Time
 	// Status indicates the status of the server.
-	// TODO: Update comment with more details.
+	// The value is "active" if the server is processing tasks, "stopped"
+	// if the server stopped processing new tasks (see Server.Stop), or "closed"
+	// if the server has shut down (see Config.ShutdownStatusTTL).
 	Status string
+	// Environment the server runs in (see Config.Environment).
+	// Empty if the server has no environment.
+	Environment string
+	// Number of tasks finished and requeued during the shutdown of the server.
+	// Set only if the status is "closed" (see Config.ShutdownStatusTTL).
+	ShutdownFinished int
+	ShutdownRequeued int
+	// Version of the asynq library the server is built with.
+	// Empty if the server is built with a version which does not report it.
+	Version string
+	// Features enabled on the server which affect how tasks are read
+	// (e.g. "payload_store", "signing"; see Config.StrictCompatibility).
+	Features []string
 	// A List of active workers currently processing tasks.
 	ActiveWorkers []*WorkerInfo
 }
@@ -728,6 +2277,26 @@ type WorkerInfo struct {
 	Deadline time.Time
 }
 
+// PromoteMirror marks the redis database of the inspector, a mirror of a primary
+// database (see ClientConfig.Mirror), as promoted to replace the primary database.
+// Servers configured with the mirror in Config.Mirror process the tasks of the
+// mirror once restarted.
+//
+// PromoteMirror returns the time the database was promoted at; promoting
+// a database promoted before returns the time of the first promotion.
+func (i *Inspector) PromoteMirror() (time.Time, error) {
+	if err := i.checkWritable(); err != nil {
+		return time.Time{}, err
+	}
+	return i.rdb.Promote()
+}
+
+// PromotedAt returns the time the redis database of the inspector was promoted at
+// (see PromoteMirror), or the zero time if the database is not promoted.
+func (i *Inspector) PromotedAt() (time.Time, error) {
+	return i.rdb.PromotedAt(context.Background())
+}
+
 // ClusterKeySlot returns an integer identifying the hash slot the given queue hashes to.
 func (i *Inspector) ClusterKeySlot(qname string) (int64, error) {
 	return i.rdb.ClusterKeySlot(qname)
@@ -788,7 +2357,7 @@ func (i *Inspector) SchedulerEntries() ([]*SchedulerEntry, error) {
 		return nil, err
 	}
 	for _, e := range res {
-		task := NewTask(e.Type, e.Payload)
+		task := NewTask(e.Type, i.redactPayload(e.Type, e.Payload))
 		var opts []Option
 		for _, s := range e.Opts {
 			if o, err := parseOption(s); err == nil {
@@ -861,6 +2430,75 @@ func parseOption(s string) (Option, error) {
 			return nil, err
 		}
 		return Retention(d), nil
+	case "TTL":
+		d, err := time.ParseDuration(arg)
+		if err != nil {
+			return nil, err
+		}
+		return TTL(d), nil
+	case "IdempotencyKey":
+		i := strings.LastIndex(arg, ", ")
+		if i < 0 {
+			return nil, fmt.Errorf("cannot not parse option string %q", s)
+		}
+		key, err := strconv.Unquote(arg[:i])
+		if err != nil {
+			return nil, err
+		}
+		d, err := time.ParseDuration(arg[i+2:])
+		if err != nil {
+			return nil, err
+		}
+		return IdempotencyKey(key, d), nil
+	case "GroupKey":
+		key, err := strconv.Unquote(arg)
+		if err != nil {
+			return nil, err
+		}
+		return GroupKey(key), nil
+	case "DependsOn":
+		var ids []string
+		for _, s := range strings.Split(arg, ", ") {
+			id, err := strconv.Unquote(s)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+		return DependsOn(ids...), nil
+	case "Header", "RequireLabel":
+		// Try each separator, since the quoted key may contain the separator itself.
+		for i := strings.Index(arg, ", "); i >= 0; {
+			key, err1 := strconv.Unquote(arg[:i])
+			value, err2 := strconv.Unquote(arg[i+2:])
+			if err1 == nil && err2 == nil {
+				if fn == "RequireLabel" {
+					return RequireLabel(key, value), nil
+				}
+				return Header(key, value), nil
+			}
+			j := strings.Index(arg[i+1:], ", ")
+			if j < 0 {
+				break
+			}
+			i += j + 1
+		}
+		return nil, fmt.Errorf("cannot not parse option string %q", s)
+	case "AtMostOnce":
+		return AtMostOnce(), nil
+	case "TaskClass":
+		class, err := strconv.Unquote(arg)
+		if err != nil {
+			return nil, err
+		}
+		return TaskClass(class), nil
+	case "Overlap":
+		for _, policy := range []OverlapPolicy{OverlapAllow, OverlapSkip, OverlapCancelPrevious} {
+			if arg == policy.String() {
+				return Overlap(policy), nil
+			}
+		}
+		return nil, fmt.Errorf("cannot not parse option string %q", s)
 	default:
 		return nil, fmt.Errorf("cannot not parse option string %q", s)
 	}
@@ -874,7 +2512,7 @@ func parseOptionFunc(s string) string {
 func parseOptionArg(s string) string {
 	i := strings.Index(s, "(")
 	if i >= 0 {
-		j := strings.Index(s, ")")
+		j := strings.LastIndex(s, ")")
 		if j > i {
 			return s[i+1 : j]
 		}
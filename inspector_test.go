@@ -8,6 +8,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"sort"
 	"testing"
@@ -256,6 +257,93 @@ func TestInspectorDeleteQueueErrorQueueNotFound(t *testing.T) {
 	}
 }
 
+func TestRecommendedWorkers(t *testing.T) {
+	tests := []struct {
+		depth  int
+		rate   float64
+		target time.Duration
+		want   int
+	}{
+		{depth: 0, rate: 1, target: time.Minute, want: 0},
+		{depth: 60, rate: 1, target: time.Minute, want: 1},
+		{depth: 61, rate: 1, target: time.Minute, want: 2},
+		{depth: 100, rate: 0.5, target: 10 * time.Second, want: 20},
+		{depth: 100, rate: 0, target: time.Minute, want: 0},
+		{depth: 100, rate: 1, target: 0, want: 0},
+	}
+
+	for _, tc := range tests {
+		if got := RecommendedWorkers(tc.depth, tc.rate, tc.target); got != tc.want {
+			t.Errorf("RecommendedWorkers(%d, %v, %v) = %d, want %d", tc.depth, tc.rate, tc.target, got, tc.want)
+		}
+	}
+}
+
+func TestInspectorScalingHint(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	now := time.Now()
+	inspector := NewInspector(getRedisConnOpt(t))
+	inspector.rdb.SetClock(timeutil.NewSimulatedClock(now))
+
+	var pending []*base.TaskMessage
+	for i := 0; i < 25; i++ {
+		pending = append(pending, h.NewTaskMessage("task", nil))
+	}
+	active := []*base.TaskMessage{h.NewTaskMessage("task", nil)}
+	h.SeedPendingQueue(t, r, pending, base.DefaultQueueName)
+	h.SeedActiveQueue(t, r, active, base.DefaultQueueName)
+	// Make sure the queue is registered.
+	if err := r.SAdd(context.Background(), base.AllQueues, base.DefaultQueueName).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := inspector.ScalingHint(base.DefaultQueueName, 0.5, 10*time.Second)
+	if err != nil {
+		t.Fatalf("ScalingHint returned error: %v", err)
+	}
+	want := &ScalingHint{
+		Queue:              base.DefaultQueueName,
+		Depth:              26,
+		ProcessingRate:     0.5,
+		LatencyTarget:      10 * time.Second,
+		RecommendedWorkers: 6,
+		Timestamp:          now,
+	}
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreFields(ScalingHint{}, "Latency"), cmpopts.EquateApproxTime(time.Second)); diff != "" {
+		t.Errorf("ScalingHint returned %+v, want %+v; (-want,+got)\n%s", got, want, diff)
+	}
+
+	if _, err := inspector.ScalingHint(base.DefaultQueueName, 0, time.Minute); err == nil {
+		t.Error("ScalingHint with zero rate did not return error")
+	}
+	if _, err := inspector.ScalingHint(base.DefaultQueueName, 1, 0); err == nil {
+		t.Error("ScalingHint with zero latency target did not return error")
+	}
+}
+
+func TestInspectorGetQueueInfoDuplicates(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	client := NewClient(getRedisConnOpt(t))
+	defer client.Close()
+	inspector := NewInspector(getRedisConnOpt(t))
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Enqueue(NewTask("charge", nil), IdempotencyKey("order:42", time.Hour))
+		if err != nil && !errors.Is(err, ErrDuplicateTask) {
+			t.Fatalf("Enqueue returned error: %v", err)
+		}
+	}
+	info, err := inspector.GetQueueInfo(base.DefaultQueueName)
+	if err != nil {
+		t.Fatalf("GetQueueInfo returned error: %v", err)
+	}
+	if diff := cmp.Diff(map[string]int{"charge": 2}, info.Duplicates); diff != "" {
+		t.Errorf("Duplicates mismatch (-want,+got):\n%s", diff)
+	}
+}
+
 func TestInspectorGetQueueInfo(t *testing.T) {
 	r := setup(t)
 	defer r.Close()
@@ -674,6 +762,70 @@ func TestInspectorGetTaskInfoError(t *testing.T) {
 	}
 }
 
+func TestInspectorGetTaskInfoByIdempotencyKey(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	client := NewClient(getRedisConnOpt(t))
+	defer client.Close()
+	inspector := NewInspector(getRedisConnOpt(t))
+
+	enqueued, err := client.Enqueue(NewTask("charge", nil), IdempotencyKey("order:42", time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := inspector.GetTaskInfoByIdempotencyKey("default", "order:42")
+	if err != nil {
+		t.Fatalf("GetTaskInfoByIdempotencyKey returned error: %v", err)
+	}
+	if got.ID != enqueued.ID || got.IdempotencyKey != "order:42" {
+		t.Errorf("GetTaskInfoByIdempotencyKey returned task (id=%q, key=%q), want (id=%q, key=%q)",
+			got.ID, got.IdempotencyKey, enqueued.ID, "order:42")
+	}
+
+	if _, err := inspector.GetTaskInfoByIdempotencyKey("default", "order:43"); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("GetTaskInfoByIdempotencyKey returned %v for unknown key, want ErrTaskNotFound", err)
+	}
+}
+
+func TestInspectorGetTaskInfos(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	client := NewClient(getRedisConnOpt(t))
+	defer client.Close()
+	inspector := NewInspector(getRedisConnOpt(t))
+
+	charge, err := client.Enqueue(NewTask("order:charge", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ship, err := client.Enqueue(NewTask("order:ship", nil), ProcessIn(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := inspector.GetTaskInfos("default", []string{ship.ID, "nonexistent", charge.ID})
+	if err != nil {
+		t.Fatalf("GetTaskInfos returned error: %v", err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("GetTaskInfos returned %d tasks, want 3", len(got))
+	}
+	if got[0] == nil || got[0].ID != ship.ID || got[0].State != TaskStateScheduled {
+		t.Errorf("GetTaskInfos()[0] = %+v, want scheduled task %s", got[0], ship.ID)
+	}
+	if got[1] != nil {
+		t.Errorf("GetTaskInfos()[1] = %+v, want nil for a nonexistent task", got[1])
+	}
+	if got[2] == nil || got[2].ID != charge.ID || got[2].State != TaskStatePending {
+		t.Errorf("GetTaskInfos()[2] = %+v, want pending task %s", got[2], charge.ID)
+	}
+
+	if _, err := inspector.GetTaskInfos("nonexistent", []string{charge.ID}); !errors.Is(err, ErrQueueNotFound) {
+		t.Errorf("GetTaskInfos returned %v for unknown queue, want ErrQueueNotFound", err)
+	}
+}
+
 func TestInspectorListPendingTasks(t *testing.T) {
 	r := setup(t)
 	defer r.Close()
@@ -1184,6 +1336,91 @@ func TestInspectorListTasksQueueNotFoundError(t *testing.T) {
 	}
 }
 
+func TestInspectorListQuarantinedTasks(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	m1 := h.NewTaskMessage("task1", nil)
+	m2 := h.NewTaskMessage("task2", nil)
+	h.SeedArchivedQueue(t, r, []base.Z{
+		{Message: m1, Score: time.Now().Add(-time.Hour).Unix()},
+		{Message: m2, Score: time.Now().Add(-time.Minute).Unix()},
+	}, "default")
+	if err := r.HSet(context.Background(), base.TaskKey("default", m2.ID), "msg", "bad data").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	inspector := NewInspector(getRedisConnOpt(t))
+	archived, err := inspector.ListArchivedTasks("default")
+	if err != nil {
+		t.Fatalf("ListArchivedTasks returned error: %v", err)
+	}
+	if len(archived) != 1 || archived[0].ID != m1.ID {
+		t.Errorf("ListArchivedTasks returned %v, want only task %q", archived, m1.ID)
+	}
+
+	info, err := inspector.GetQueueInfo("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Quarantined != 1 || info.Archived != 1 {
+		t.Errorf("GetQueueInfo returned Quarantined=%d Archived=%d, want Quarantined=1 Archived=1", info.Quarantined, info.Archived)
+	}
+
+	got, err := inspector.ListQuarantinedTasks("default")
+	if err != nil {
+		t.Fatalf("ListQuarantinedTasks returned error: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("ListQuarantinedTasks returned %d tasks, want 1", len(got))
+	}
+	want := &QuarantinedTask{ID: m2.ID, Queue: "default", Data: []byte("bad data"), State: "archived"}
+	if diff := cmp.Diff(want, got[0], cmpopts.IgnoreFields(QuarantinedTask{}, "QuarantinedAt")); diff != "" {
+		t.Errorf("ListQuarantinedTasks mismatch; (-want,+got)\n%s", diff)
+	}
+
+	if n, err := inspector.DeleteAllQuarantinedTasks("default"); err != nil || n != 1 {
+		t.Errorf("DeleteAllQuarantinedTasks returned (%d, %v), want (1, nil)", n, err)
+	}
+	if _, err := inspector.ListQuarantinedTasks("nonexistent"); !errors.Is(err, ErrQueueNotFound) {
+		t.Errorf("ListQuarantinedTasks for nonexistent queue returned %v, want %v", err, ErrQueueNotFound)
+	}
+}
+
+func TestInspectorRepairQuarantinedTask(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	msg := h.NewTaskMessage("email:send", []byte("to=user"))
+	h.SeedPendingQueue(t, r, []*base.TaskMessage{msg}, "default")
+	if err := r.HSet(context.Background(), base.TaskKey("default", msg.ID), "msg", "bad data").Err(); err != nil {
+		t.Fatal(err)
+	}
+	inspector := NewInspector(getRedisConnOpt(t))
+	if _, err := inspector.ListPendingTasks("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := base.EncodeMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inspector.RepairQuarantinedTask("default", msg.ID, []byte("still bad")); err == nil {
+		t.Errorf("RepairQuarantinedTask with undecodable data returned nil error")
+	}
+	if err := inspector.RepairQuarantinedTask("default", msg.ID, data); err != nil {
+		t.Fatalf("RepairQuarantinedTask returned error: %v", err)
+	}
+	info, err := inspector.GetTaskInfo("default", msg.ID)
+	if err != nil {
+		t.Fatalf("GetTaskInfo returned error: %v", err)
+	}
+	if info.State != TaskStatePending || string(info.Payload) != "to=user" {
+		t.Errorf("repaired task has state %v and payload %q, want pending task with payload %q", info.State, info.Payload, "to=user")
+	}
+	if err := inspector.RepairQuarantinedTask("default", msg.ID, data); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("RepairQuarantinedTask of a task not quarantined returned %v, want ErrTaskNotFound", err)
+	}
+}
+
 func TestInspectorDeleteAllPendingTasks(t *testing.T) {
 	r := setup(t)
 	defer r.Close()
@@ -1512,6 +1749,56 @@ func TestInspectorDeleteAllCompletedTasks(t *testing.T) {
 	}
 }
 
+// operatorArchived returns a copy of msg archived with the inspector.
+func operatorArchived(msg *base.TaskMessage) *base.TaskMessage {
+	m := *msg
+	m.ArchiveReason = base.ArchiveReasonOperator
+	return &m
+}
+
+func TestInspectorPurgeQueue(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	m1 := h.NewTaskMessage("task1", nil)
+	m2 := h.NewTaskMessage("task2", nil)
+	m3 := h.NewTaskMessage("task3", nil)
+	now := time.Now()
+	h.SeedPendingQueue(t, r, []*base.TaskMessage{m1, m2}, "default")
+	h.SeedRetryQueue(t, r, []base.Z{{Message: m3, Score: now.Add(time.Minute).Unix()}}, "default")
+
+	inspector := NewInspector(getRedisConnOpt(t))
+	defer inspector.Close()
+
+	n, err := inspector.PurgeQueue("default", TaskStatePending, true)
+	if err != nil || n != 2 {
+		t.Fatalf("PurgeQueue(%q, pending, dryRun=true) = (%d, %v), want (2, nil)", "default", n, err)
+	}
+	if got := h.GetPendingMessages(t, r, "default"); len(got) != 2 {
+		t.Errorf("got %d pending tasks after dry run, want 2", len(got))
+	}
+
+	n, err = inspector.PurgeQueue("default", TaskStatePending, false)
+	if err != nil || n != 2 {
+		t.Fatalf("PurgeQueue(%q, pending, dryRun=false) = (%d, %v), want (2, nil)", "default", n, err)
+	}
+	if got := h.GetPendingMessages(t, r, "default"); len(got) != 0 {
+		t.Errorf("got %d pending tasks after purge, want 0", len(got))
+	}
+	// Tasks in other states are left untouched.
+	if got := h.GetRetryMessages(t, r, "default"); len(got) != 1 {
+		t.Errorf("got %d retry tasks after purge, want 1", len(got))
+	}
+
+	if _, err := inspector.PurgeQueue("default", TaskStateActive, true); err == nil {
+		t.Errorf("PurgeQueue(%q, active, dryRun=true) returned nil error, want non-nil error", "default")
+	}
+	for _, dryRun := range []bool{true, false} {
+		if _, err := inspector.PurgeQueue("nonexistent", TaskStateRetry, dryRun); !errors.Is(err, ErrQueueNotFound) {
+			t.Errorf("PurgeQueue(%q, retry, dryRun=%t) returned %v, want ErrQueueNotFound", "nonexistent", dryRun, err)
+		}
+	}
+}
+
 func TestInspectorArchiveAllPendingTasks(t *testing.T) {
 	r := setup(t)
 	defer r.Close()
@@ -1549,9 +1836,9 @@ func TestInspectorArchiveAllPendingTasks(t *testing.T) {
 			},
 			wantArchived: map[string][]base.Z{
 				"default": {
-					base.Z{Message: m1, Score: now.Unix()},
-					base.Z{Message: m2, Score: now.Unix()},
-					base.Z{Message: m3, Score: now.Unix()},
+					base.Z{Message: operatorArchived(m1), Score: now.Unix()},
+					base.Z{Message: operatorArchived(m2), Score: now.Unix()},
+					base.Z{Message: operatorArchived(m3), Score: now.Unix()},
 				},
 				"custom": {},
 			},
@@ -1588,7 +1875,7 @@ func TestInspectorArchiveAllPendingTasks(t *testing.T) {
 				"default": {
 					z1,
 					z2,
-					base.Z{Message: m3, Score: now.Unix()},
+					base.Z{Message: operatorArchived(m3), Score: now.Unix()},
 				},
 			},
 		},
@@ -1666,9 +1953,9 @@ func TestInspectorArchiveAllScheduledTasks(t *testing.T) {
 			},
 			wantArchived: map[string][]base.Z{
 				"default": {
-					base.Z{Message: m1, Score: now.Unix()},
-					base.Z{Message: m2, Score: now.Unix()},
-					base.Z{Message: m3, Score: now.Unix()},
+					base.Z{Message: operatorArchived(m1), Score: now.Unix()},
+					base.Z{Message: operatorArchived(m2), Score: now.Unix()},
+					base.Z{Message: operatorArchived(m3), Score: now.Unix()},
 				},
 				"custom": {},
 			},
@@ -1688,8 +1975,8 @@ func TestInspectorArchiveAllScheduledTasks(t *testing.T) {
 			wantArchived: map[string][]base.Z{
 				"default": {
 					z3,
-					base.Z{Message: m1, Score: now.Unix()},
-					base.Z{Message: m2, Score: now.Unix()},
+					base.Z{Message: operatorArchived(m1), Score: now.Unix()},
+					base.Z{Message: operatorArchived(m2), Score: now.Unix()},
 				},
 			},
 		},
@@ -1799,9 +2086,9 @@ func TestInspectorArchiveAllRetryTasks(t *testing.T) {
 			},
 			wantArchived: map[string][]base.Z{
 				"default": {
-					base.Z{Message: m1, Score: now.Unix()},
-					base.Z{Message: m2, Score: now.Unix()},
-					base.Z{Message: m3, Score: now.Unix()},
+					base.Z{Message: operatorArchived(m1), Score: now.Unix()},
+					base.Z{Message: operatorArchived(m2), Score: now.Unix()},
+					base.Z{Message: operatorArchived(m3), Score: now.Unix()},
 				},
 				"custom": {},
 			},
@@ -1821,8 +2108,8 @@ func TestInspectorArchiveAllRetryTasks(t *testing.T) {
 			wantArchived: map[string][]base.Z{
 				"default": {
 					z3,
-					base.Z{Message: m1, Score: now.Unix()},
-					base.Z{Message: m2, Score: now.Unix()},
+					base.Z{Message: operatorArchived(m1), Score: now.Unix()},
+					base.Z{Message: operatorArchived(m2), Score: now.Unix()},
 				},
 			},
 		},
@@ -2221,6 +2508,43 @@ func TestInspectorRunAllArchivedTasks(t *testing.T) {
 	}
 }
 
+func TestInspectorRunAllArchivedTasksAtRate(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	now := time.Now()
+	var entries []base.Z
+	for i := 0; i < 3; i++ {
+		entries = append(entries, base.Z{Message: h.NewTaskMessage("task1", nil), Score: now.Add(-time.Minute).Unix()})
+	}
+	h.SeedArchivedQueue(t, r, entries, "default")
+
+	inspector := NewInspector(getRedisConnOpt(t))
+	n, err := inspector.RunAllArchivedTasksAtRate("default", 1)
+	if err != nil || n != 3 {
+		t.Fatalf("RunAllArchivedTasksAtRate returned (%d, %v), want (3, nil)", n, err)
+	}
+	scheduled := h.GetScheduledEntries(t, r, "default")
+	if len(scheduled) != 3 {
+		t.Fatalf("got %d scheduled tasks, want 3", len(scheduled))
+	}
+	last := scheduled[0].Score
+	for _, z := range scheduled[1:] {
+		if z.Score > last {
+			last = z.Score
+		}
+	}
+	if last < now.Unix()+2 {
+		t.Errorf("last task is scheduled at %d, want at least %d", last, now.Unix()+2)
+	}
+
+	if _, err := inspector.RunAllArchivedTasksAtRate("nonexistent", 1); !errors.Is(err, ErrQueueNotFound) {
+		t.Errorf("RunAllArchivedTasksAtRate on nonexistent queue returned %v, want ErrQueueNotFound", err)
+	}
+	if _, err := inspector.RunAllArchivedTasksAtRate("default", 0); err == nil {
+		t.Errorf("RunAllArchivedTasksAtRate with zero rate returned nil error, want non-nil error")
+	}
+}
+
 func TestInspectorDeleteTaskDeletesPendingTask(t *testing.T) {
 	r := setup(t)
 	defer r.Close()
@@ -2808,6 +3132,68 @@ func TestInspectorRunTaskError(t *testing.T) {
 	}
 }
 
+func TestInspectorCloneTask(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	now := time.Now()
+	m1 := h.NewTaskMessage("email:send", []byte(`{"to": "invalid"}`))
+	m1.Retry = 5
+	m1.Retried = 5
+	m1.ErrorMsg = "invalid recipient"
+	m1.Headers = map[string]string{"trace_id": "abc"}
+	m1.Deadline = now.Add(-time.Hour).Unix()
+	m1.Timeout = 0
+	m1.DefaultRetry = true
+	m2 := h.NewTaskMessage("email:send", nil)
+	h.SeedArchivedQueue(t, r, []base.Z{{Message: m1, Score: now.Unix()}}, "default")
+	h.SeedRetryQueue(t, r, []base.Z{{Message: m2, Score: now.Add(time.Minute).Unix()}}, "default")
+
+	inspector := NewInspector(getRedisConnOpt(t))
+	defer inspector.Close()
+
+	payload := []byte(`{"to": "user@example.com"}`)
+	info, err := inspector.CloneTask("default", m1.ID, payload)
+	if err != nil {
+		t.Fatalf("CloneTask returned error: %v", err)
+	}
+	if info.ID == m1.ID || info.ClonedFrom != m1.ID || info.State != TaskStatePending {
+		t.Errorf("CloneTask returned ID=%q ClonedFrom=%q State=%v, want a new pending task cloned from %q",
+			info.ID, info.ClonedFrom, info.State, m1.ID)
+	}
+	pending := h.GetPendingMessages(t, r, "default")
+	if len(pending) != 1 {
+		t.Fatalf("got %d pending tasks, want 1", len(pending))
+	}
+	want := &base.TaskMessage{
+		ID:         info.ID,
+		Type:       m1.Type,
+		Payload:    payload,
+		Queue:      "default",
+		Retry:      5,
+		Timeout:    int64(defaultTimeout.Seconds()), // the deadline of the archived task has passed
+		Headers:    m1.Headers,
+		ClonedFrom: m1.ID,
+
+		DefaultRetry: true, // the clone keeps the retry policy of the queue
+	}
+	if diff := cmp.Diff(want, pending[0]); diff != "" {
+		t.Errorf("pending task mismatch (-want,+got):\n%s", diff)
+	}
+	if got := h.GetArchivedMessages(t, r, "default"); len(got) != 1 || got[0].ID != m1.ID {
+		t.Errorf("archived tasks = %v, want the original task %s left in place", got, m1.ID)
+	}
+
+	if _, err := inspector.CloneTask("default", m2.ID, payload); err == nil {
+		t.Errorf("CloneTask of retry task returned nil error, want non-nil error")
+	}
+	if _, err := inspector.CloneTask("default", "nonexistent", payload); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("CloneTask of nonexistent task returned %v, want ErrTaskNotFound", err)
+	}
+	if _, err := inspector.CloneTask("nonexistent", m1.ID, payload); !errors.Is(err, ErrQueueNotFound) {
+		t.Errorf("CloneTask from nonexistent queue returned %v, want ErrQueueNotFound", err)
+	}
+}
+
 func TestInspectorArchiveTaskArchivesPendingTask(t *testing.T) {
 	r := setup(t)
 	defer r.Close()
@@ -2842,7 +3228,7 @@ func TestInspectorArchiveTaskArchivesPendingTask(t *testing.T) {
 			},
 			wantArchived: map[string][]base.Z{
 				"default": {
-					{Message: m1, Score: now.Unix()},
+					{Message: operatorArchived(m1), Score: now.Unix()},
 				},
 				"custom": {},
 			},
@@ -2865,7 +3251,7 @@ func TestInspectorArchiveTaskArchivesPendingTask(t *testing.T) {
 			wantArchived: map[string][]base.Z{
 				"default": {},
 				"custom": {
-					{Message: m2, Score: now.Unix()},
+					{Message: operatorArchived(m2), Score: now.Unix()},
 				},
 			},
 		},
@@ -2939,7 +3325,7 @@ func TestInspectorArchiveTaskArchivesScheduledTask(t *testing.T) {
 				"default": {},
 				"custom": {
 					{
-						Message: m2,
+						Message: operatorArchived(m2),
 						Score:   now.Unix(),
 					},
 				},
@@ -3014,7 +3400,7 @@ func TestInspectorArchiveTaskArchivesRetryTask(t *testing.T) {
 				"default": {},
 				"custom": {
 					{
-						Message: m2,
+						Message: operatorArchived(m2),
 						Score:   now.Unix(),
 					},
 				},
@@ -3232,6 +3618,16 @@ func TestParseOption(t *testing.T) {
 		{ProcessAt(oneHourFromNow).String(), ProcessAtOpt, oneHourFromNow},
 		{`ProcessIn(10m)`, ProcessInOpt, 10 * time.Minute},
 		{`Retention(24h)`, RetentionOpt, 24 * time.Hour},
+		{`IdempotencyKey("order:(42)", 1h)`, IdempotencyKeyOpt, "order:(42)"},
+		{`GroupKey("user:42")`, GroupKeyOpt, "user:42"},
+		{`DependsOn("abc", "xyz")`, DependsOnOpt, []string{"abc", "xyz"}},
+		{`Header("trace_id", "abc")`, HeaderOpt, map[string]string{"trace_id": "abc"}},
+		{`TTL(1m)`, TTLOpt, 1 * time.Minute},
+		{`AtMostOnce()`, AtMostOnceOpt, true},
+		{`TaskClass("cpu")`, TaskClassOpt, "cpu"},
+		{`Overlap(skip)`, OverlapOpt, OverlapSkip},
+		{Header(`a", "b`, "c, d").String(), HeaderOpt, map[string]string{`a", "b`: "c, d"}},
+		{`RequireLabel("gpu", "true")`, RequireLabelOpt, map[string]string{"gpu": "true"}},
 	}
 
 	for _, tc := range tests {
@@ -3247,7 +3643,7 @@ func TestParseOption(t *testing.T) {
 				t.Fatalf("got type %v, want type %v ", got.Type(), tc.wantType)
 			}
 			switch tc.wantType {
-			case QueueOpt:
+			case QueueOpt, IdempotencyKeyOpt, GroupKeyOpt, TaskClassOpt:
 				gotVal, ok := got.Value().(string)
 				if !ok {
 					t.Fatal("returned Option with non-string value")
@@ -3263,7 +3659,7 @@ func TestParseOption(t *testing.T) {
 				if gotVal != tc.wantVal.(int) {
 					t.Fatalf("got value %v, want %v", gotVal, tc.wantVal)
 				}
-			case TimeoutOpt, UniqueOpt, ProcessInOpt, RetentionOpt:
+			case TimeoutOpt, UniqueOpt, ProcessInOpt, RetentionOpt, TTLOpt:
 				gotVal, ok := got.Value().(time.Duration)
 				if !ok {
 					t.Fatal("returned Option with non duration value")
@@ -3271,6 +3667,30 @@ func TestParseOption(t *testing.T) {
 				if gotVal != tc.wantVal.(time.Duration) {
 					t.Fatalf("got value %v, want %v", gotVal, tc.wantVal)
 				}
+			case DependsOnOpt:
+				gotVal, ok := got.Value().([]string)
+				if !ok {
+					t.Fatal("returned Option with non string slice value")
+				}
+				if diff := cmp.Diff(tc.wantVal.([]string), gotVal); diff != "" {
+					t.Fatalf("got value %v, want %v", gotVal, tc.wantVal)
+				}
+			case HeaderOpt, RequireLabelOpt:
+				gotVal, ok := got.Value().(map[string]string)
+				if !ok {
+					t.Fatal("returned Option with non map value")
+				}
+				if diff := cmp.Diff(tc.wantVal.(map[string]string), gotVal); diff != "" {
+					t.Fatalf("got value %v, want %v", gotVal, tc.wantVal)
+				}
+			case AtMostOnceOpt:
+				if gotVal, ok := got.Value().(bool); !ok || !gotVal {
+					t.Fatalf("got value %v, want true", got.Value())
+				}
+			case OverlapOpt:
+				if gotVal, ok := got.Value().(OverlapPolicy); !ok || gotVal != tc.wantVal.(OverlapPolicy) {
+					t.Fatalf("got value %v, want %v", got.Value(), tc.wantVal)
+				}
 			case DeadlineOpt, ProcessAtOpt:
 				gotVal, ok := got.Value().(time.Time)
 				if !ok {
@@ -3285,3 +3705,563 @@ func TestParseOption(t *testing.T) {
 		})
 	}
 }
+
+func TestInspectorCountTasks(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	m1 := h.NewTaskMessage("email:send", nil)
+	m2 := h.NewTaskMessage("email:send", nil)
+	m3 := h.NewTaskMessage("image:resize", nil)
+	now := time.Now()
+	h.SeedArchivedQueue(t, r, []base.Z{
+		{Message: m1, Score: now.Unix()},
+		{Message: m2, Score: now.Unix()},
+		{Message: m3, Score: now.Unix()},
+	}, "default")
+	h.SeedPendingQueue(t, r, []*base.TaskMessage{m3}, "default")
+	r.SAdd(context.Background(), base.AllQueues, "default")
+
+	inspector := NewInspector(getRedisConnOpt(t))
+
+	tests := []struct {
+		state   TaskState
+		filters []TaskFilter
+		want    int
+	}{
+		{TaskStateArchived, nil, 3},
+		{TaskStateArchived, []TaskFilter{FilterByType("email:send")}, 2},
+		{TaskStateArchived, []TaskFilter{FilterByType("image:resize"), FilterByType("email:send")}, 2},
+		{TaskStatePending, []TaskFilter{FilterByType("email:send")}, 0},
+		{TaskStatePending, nil, 1},
+	}
+
+	for _, tc := range tests {
+		got, err := inspector.CountTasks("default", tc.state, tc.filters...)
+		if err != nil {
+			t.Errorf("CountTasks(%q, %v, %v) returned error: %v", "default", tc.state, tc.filters, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("CountTasks(%q, %v, %v) = %d, want %d", "default", tc.state, tc.filters, got, tc.want)
+		}
+	}
+
+	if _, err := inspector.CountTasks("nonexistent", TaskStatePending); !errors.Is(err, ErrQueueNotFound) {
+		t.Errorf("CountTasks on nonexistent queue returned %v, want ErrQueueNotFound", err)
+	}
+}
+
+func TestInspectorBulkActionsByFilter(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	now := time.Now()
+	newFailedTask := func(typename, errMsg string, failedAt time.Time) *base.TaskMessage {
+		msg := h.NewTaskMessage(typename, nil)
+		msg.ErrorMsg = errMsg
+		msg.LastFailedAt = failedAt.Unix()
+		return msg
+	}
+	m1 := newFailedTask("image:resize", "upstream returned 503", now.Add(-2*time.Hour))
+	m2 := newFailedTask("image:resize", "upstream returned 503", now.Add(-time.Minute))
+	m3 := newFailedTask("image:resize", "invalid image", now.Add(-2*time.Hour))
+	m4 := newFailedTask("email:send", "upstream returned 503", now.Add(-2*time.Hour))
+	inspector := NewInspector(getRedisConnOpt(t))
+
+	seed := func() {
+		h.FlushDB(t, r)
+		h.SeedArchivedQueue(t, r, []base.Z{
+			{Message: m1, Score: now.Unix()},
+			{Message: m2, Score: now.Unix()},
+			{Message: m3, Score: now.Unix()},
+			{Message: m4, Score: now.Unix()},
+		}, "default")
+	}
+	filters := []TaskFilter{FilterByType("image:resize"), FilterByErrorContains("503"), FilterByFailedBefore(now.Add(-time.Hour))}
+
+	seed()
+	if n, err := inspector.CountTasks("default", TaskStateArchived, filters...); err != nil || n != 1 {
+		t.Errorf("CountTasks returned (%d, %v), want (1, nil)", n, err)
+	}
+	if n, err := inspector.RunTasks("default", TaskStateArchived, filters...); err != nil || n != 1 {
+		t.Errorf("RunTasks returned (%d, %v), want (1, nil)", n, err)
+	}
+	if pending := h.GetPendingMessages(t, r, "default"); len(pending) != 1 || pending[0].ID != m1.ID {
+		t.Errorf("pending tasks = %v, want task %s", pending, m1.ID)
+	}
+
+	seed()
+	if n, err := inspector.DeleteTasks("default", TaskStateArchived, FilterByErrorContains("503")); err != nil || n != 3 {
+		t.Errorf("DeleteTasks returned (%d, %v), want (3, nil)", n, err)
+	}
+	if archived := h.GetArchivedMessages(t, r, "default"); len(archived) != 1 || archived[0].ID != m3.ID {
+		t.Errorf("archived tasks = %v, want task %s", archived, m3.ID)
+	}
+
+	h.FlushDB(t, r)
+	h.SeedRetryQueue(t, r, []base.Z{{Message: m2, Score: now.Add(time.Hour).Unix()}}, "default")
+	if n, err := inspector.ArchiveTasks("default", TaskStateRetry, FilterByType("email:send")); err != nil || n != 0 {
+		t.Errorf("ArchiveTasks returned (%d, %v), want (0, nil)", n, err)
+	}
+	if n, err := inspector.ArchiveTasks("default", TaskStateRetry, FilterByType("image:resize")); err != nil || n != 1 {
+		t.Errorf("ArchiveTasks returned (%d, %v), want (1, nil)", n, err)
+	}
+
+	m5 := h.NewTaskMessage("image:resize", nil)
+	m5.EnqueuedAt = now.Add(-48 * time.Hour).UnixNano()
+	h.SeedPendingQueue(t, r, []*base.TaskMessage{m5, m3}, "default")
+	if n, err := inspector.DeleteTasks("default", TaskStatePending, FilterByEnqueuedBefore(now.Add(-24*time.Hour))); err != nil || n != 1 {
+		t.Errorf("DeleteTasks returned (%d, %v), want (1, nil)", n, err)
+	}
+	if pending := h.GetPendingMessages(t, r, "default"); len(pending) != 1 || pending[0].ID != m3.ID {
+		t.Errorf("pending tasks = %v, want task %s", pending, m3.ID)
+	}
+
+	if _, err := inspector.RunTasks("default", TaskStatePending); err == nil {
+		t.Errorf("RunTasks of pending tasks returned nil error, want non-nil error")
+	}
+	if _, err := inspector.DeleteTasks("nonexistent", TaskStateArchived); !errors.Is(err, ErrQueueNotFound) {
+		t.Errorf("DeleteTasks on nonexistent queue returned %v, want ErrQueueNotFound", err)
+	}
+}
+
+func TestInspectorGetTaskInfoArchiveReason(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	m1 := h.NewTaskMessage("task1", nil)
+	m1.ErrorMsg = "oops again"
+	m1.ErrorHistory = []string{"oops", "oops again"}
+	h.SeedPendingQueue(t, r, []*base.TaskMessage{m1}, "default")
+	r.SAdd(context.Background(), base.AllQueues, "default")
+
+	inspector := NewInspector(getRedisConnOpt(t))
+	if err := inspector.ArchiveTask("default", m1.ID); err != nil {
+		t.Fatal(err)
+	}
+	info, err := inspector.GetTaskInfo("default", m1.ID)
+	if err != nil {
+		t.Fatalf("GetTaskInfo returned error: %v", err)
+	}
+	if info.ArchiveReason != ArchiveReasonOperator {
+		t.Errorf("ArchiveReason = %q, want %q", info.ArchiveReason, ArchiveReasonOperator)
+	}
+	if diff := cmp.Diff(m1.ErrorHistory, info.ErrorHistory); diff != "" {
+		t.Errorf("ErrorHistory = %v, want %v; (-want,+got)\n%s", info.ErrorHistory, m1.ErrorHistory, diff)
+	}
+
+	// The reason is cleared once the task is run again.
+	for _, run := range []func() error{
+		func() error { return inspector.RunTask("default", m1.ID) },
+		func() error { _, err := inspector.RunAllArchivedTasks("default"); return err },
+	} {
+		if err := run(); err != nil {
+			t.Fatalf("running archived task returned error: %v", err)
+		}
+		info, err = inspector.GetTaskInfo("default", m1.ID)
+		if err != nil {
+			t.Fatalf("GetTaskInfo returned error: %v", err)
+		}
+		if info.State != TaskStatePending || info.ArchiveReason != "" {
+			t.Errorf("task state = %v with ArchiveReason = %q after run, want pending with empty reason", info.State, info.ArchiveReason)
+		}
+		if err := inspector.ArchiveTask("default", m1.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestInspectorListTasksWithoutVersionHandler(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	m1 := h.NewTaskMessage("email:send@v1", nil)
+	m2 := h.NewTaskMessage("email:send@v2", nil)
+	m3 := h.NewTaskMessage("email:send@v3", nil)
+	m4 := h.NewTaskMessage("image:resize", nil)
+	m5 := h.NewTaskMessage("image:resize@v2", nil)
+	h.SeedPendingQueue(t, r, []*base.TaskMessage{m1, m2, m3, m4, m5}, "default")
+	r.SAdd(context.Background(), base.AllQueues, "default")
+
+	mux := NewServeMux()
+	mux.HandleFunc("email:send@v1", func(ctx context.Context, t *Task) error { return nil })
+	mux.HandleFunc("email:send@v2", func(ctx context.Context, t *Task) error { return nil })
+	mux.HandleFunc("image:", func(ctx context.Context, t *Task) error { return nil })
+
+	inspector := NewInspector(getRedisConnOpt(t))
+	got, err := inspector.ListTasksWithoutVersionHandler("default", TaskStatePending, mux)
+	if err != nil {
+		t.Fatalf("ListTasksWithoutVersionHandler returned error: %v", err)
+	}
+	var gotIDs []string
+	for _, info := range got {
+		gotIDs = append(gotIDs, info.ID)
+	}
+	if diff := cmp.Diff([]string{m3.ID, m5.ID}, gotIDs); diff != "" {
+		t.Errorf("ListTasksWithoutVersionHandler returned unexpected tasks; (-want,+got)\n%s", diff)
+	}
+
+	got, err = inspector.ListTasksWithoutVersionHandler("default", TaskStatePending, mux, PageSize(1), Page(2))
+	if err != nil || len(got) != 1 || got[0].ID != m5.ID {
+		t.Errorf("ListTasksWithoutVersionHandler(PageSize(1), Page(2)) returned (%v, %v), want task %s", got, err, m5.ID)
+	}
+	if _, err := inspector.ListTasksWithoutVersionHandler("nonexistent", TaskStatePending, mux); !errors.Is(err, ErrQueueNotFound) {
+		t.Errorf("ListTasksWithoutVersionHandler on nonexistent queue returned %v, want ErrQueueNotFound", err)
+	}
+}
+
+func TestInspectorUnhandledTasks(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	now := time.Now()
+	m1 := h.NewTaskMessage("email:send@v3", nil)
+	m2 := h.NewTaskMessage("image:resize", nil)
+	h.SeedUnhandledQueue(t, r, []base.Z{
+		{Message: m1, Score: now.Add(-2 * time.Minute).Unix()},
+		{Message: m2, Score: now.Add(-1 * time.Minute).Unix()},
+	}, "default")
+
+	inspector := NewInspector(getRedisConnOpt(t))
+	info, err := inspector.GetQueueInfo("default")
+	if err != nil {
+		t.Fatalf("GetQueueInfo returned error: %v", err)
+	}
+	if info.Unhandled != 2 || info.Size != 2 {
+		t.Errorf("GetQueueInfo returned Unhandled=%d Size=%d, want 2, 2", info.Unhandled, info.Size)
+	}
+
+	got, err := inspector.ListUnhandledTasks("default")
+	if err != nil {
+		t.Fatalf("ListUnhandledTasks returned error: %v", err)
+	}
+	if len(got) != 2 || got[0].ID != m1.ID || got[1].ID != m2.ID {
+		t.Fatalf("ListUnhandledTasks returned %v, want tasks %s and %s", got, m1.ID, m2.ID)
+	}
+	if got[0].State != TaskStateUnhandled {
+		t.Errorf("ListUnhandledTasks returned task in state %v, want %v", got[0].State, TaskStateUnhandled)
+	}
+	if _, err := inspector.ListUnhandledTasks("nonexistent"); !errors.Is(err, ErrQueueNotFound) {
+		t.Errorf("ListUnhandledTasks on nonexistent queue returned %v, want ErrQueueNotFound", err)
+	}
+
+	n, err := inspector.RunAllUnhandledTasks("default")
+	if err != nil || n != 2 {
+		t.Fatalf("RunAllUnhandledTasks returned (%d, %v), want (2, nil)", n, err)
+	}
+	if pending := h.GetPendingMessages(t, r, "default"); len(pending) != 2 {
+		t.Errorf("got %d pending tasks after RunAllUnhandledTasks, want 2", len(pending))
+	}
+	if unhandled := h.GetUnhandledMessages(t, r, "default"); len(unhandled) != 0 {
+		t.Errorf("got %d unhandled tasks after RunAllUnhandledTasks, want 0", len(unhandled))
+	}
+}
+
+func TestInspectorConfigDrift(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	rdbClient := rdb.NewRDB(r)
+	servers := []*base.ServerInfo{
+		{ServerID: "a", Concurrency: 10, Queues: map[string]int{"critical": 6, "default": 3}, Status: "active", Version: "0.19.1", Environment: "production"},
+		{ServerID: "b", Concurrency: 10, Queues: map[string]int{"default": 3, "critical": 6}, Status: "active", Version: "0.19.1", Environment: "production"},
+		{ServerID: "c", Concurrency: 20, Queues: map[string]int{"default": 1}, Status: "stopped", Version: "0.19.0", Environment: "production"},
+		// Servers which shut down and servers of other environments are not compared.
+		{ServerID: "d", Concurrency: 5, Queues: map[string]int{"default": 1}, Status: "closed", Version: "0.18.0", Environment: "production"},
+		{ServerID: "e", Concurrency: 5, Queues: map[string]int{"default": 1}, Status: "active", Version: "0.19.1", Environment: "staging"},
+	}
+	for _, s := range servers {
+		s.Host, s.PID, s.Started = "localhost", 1234, time.Now()
+		if err := rdbClient.WriteServerState(s, nil, time.Minute); err != nil {
+			t.Fatalf("could not write server state: %v", err)
+		}
+	}
+
+	inspector := NewInspector(getRedisConnOpt(t))
+	got, err := inspector.ConfigDrift()
+	if err != nil {
+		t.Fatalf("ConfigDrift returned error: %v", err)
+	}
+	want := []*ConfigDrift{
+		{Environment: "production", Setting: "Concurrency", Values: map[string][]string{"10": {"a", "b"}, "20": {"c"}}},
+		{Environment: "production", Setting: "Queues", Values: map[string][]string{"critical:6 default:3": {"a", "b"}, "default:1": {"c"}}},
+		{Environment: "production", Setting: "Version", Values: map[string][]string{"0.19.1": {"a", "b"}, "0.19.0": {"c"}}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ConfigDrift() mismatch (-want,+got):\n%s", diff)
+	}
+}
+
+func TestInspectorRequeueOrphans(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	msg := h.NewTaskMessage("send_email", nil)
+	h.SeedActiveQueue(t, r, []*base.TaskMessage{msg}, base.DefaultQueueName)
+	h.SeedDeadlines(t, r, []base.Z{{Message: msg, Score: time.Now().Add(time.Hour).Unix()}}, base.DefaultQueueName)
+	info := &base.ServerInfo{Host: "127.0.0.1", PID: 1234, ServerID: "dead", Status: "active"}
+	workers := []*base.WorkerInfo{{Host: info.Host, PID: info.PID, ServerID: info.ServerID, ID: msg.ID, Type: msg.Type, Queue: msg.Queue}}
+	if err := rdb.NewRDB(r).WriteServerState(info, workers, time.Minute); err != nil {
+		t.Fatalf("could not write server state: %v", err)
+	}
+
+	inspector := NewInspector(getRedisConnOpt(t))
+	n, err := inspector.RequeueOrphans("dead")
+	if err != nil || n != 1 {
+		t.Fatalf("RequeueOrphans(%q) = (%d, %v), want (1, nil)", "dead", n, err)
+	}
+	got, err := inspector.GetTaskInfo(base.DefaultQueueName, msg.ID)
+	if err != nil || got.State != TaskStatePending {
+		t.Errorf("GetTaskInfo(%q) = (%v, %v), want a pending task", msg.ID, got, err)
+	}
+	if _, err := inspector.RequeueOrphans("dead"); !errors.Is(err, ErrServerNotFound) {
+		t.Errorf("RequeueOrphans(%q) returned %v, want ErrServerNotFound", "dead", err)
+	}
+}
+
+func TestLatencyHistogramQuantile(t *testing.T) {
+	h := &LatencyHistogram{
+		Bounds: []time.Duration{10 * time.Millisecond, 100 * time.Millisecond, time.Second},
+		Counts: []int{50, 40, 0, 10},
+		Count:  100,
+		Sum:    time.Minute,
+	}
+	tests := []struct {
+		q    float64
+		want time.Duration
+	}{
+		{0.25, 5 * time.Millisecond},
+		{0.5, 10 * time.Millisecond},
+		{0.7, 55 * time.Millisecond},
+		{0.99, time.Second}, // overflow bucket
+	}
+	for _, tc := range tests {
+		if got := h.Quantile(tc.q); got != tc.want {
+			t.Errorf("Quantile(%v) = %v, want %v", tc.q, got, tc.want)
+		}
+	}
+	if got := h.Mean(); got != 600*time.Millisecond {
+		t.Errorf("Mean() = %v, want 600ms", got)
+	}
+	if got := new(LatencyHistogram).Quantile(0.5); got != 0 {
+		t.Errorf("Quantile of empty histogram = %v, want 0", got)
+	}
+}
+
+func TestInspectorRedactPayload(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	payload := []byte(`{"user":"alice","password":"s3cret"}`)
+	msg := h.NewTaskMessage("login", payload)
+	h.SeedPendingQueue(t, r, []*base.TaskMessage{msg}, base.DefaultQueueName)
+	want := `{"password":"[REDACTED]","user":"alice"}`
+
+	inspector := NewInspectorWithConfig(getRedisConnOpt(t), InspectorConfig{
+		RedactPayload: RedactJSONFields("password"),
+	})
+	info, err := inspector.GetTaskInfo(base.DefaultQueueName, msg.ID)
+	if err != nil {
+		t.Fatalf("GetTaskInfo returned error: %v", err)
+	}
+	if got := string(info.Payload); got != want {
+		t.Errorf("GetTaskInfo returned payload %s, want %s", got, want)
+	}
+	tasks, err := inspector.WithActor("alice").ListPendingTasks(base.DefaultQueueName)
+	if err != nil || len(tasks) != 1 {
+		t.Fatalf("ListPendingTasks = (%v, %v), want one task", tasks, err)
+	}
+	if got := string(tasks[0].Payload); got != want {
+		t.Errorf("ListPendingTasks returned payload %s, want %s", got, want)
+	}
+
+	// The task is stored as is.
+	stored := h.GetPendingMessages(t, r, base.DefaultQueueName)
+	if len(stored) != 1 || string(stored[0].Payload) != string(payload) {
+		t.Errorf("pending messages are %v, want the task with its payload unchanged", stored)
+	}
+}
+
+func TestInspectorArchiveStaleTasks(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	stale := h.NewTaskMessage("stuck", nil)
+	h.SeedRetryQueue(t, r, []base.Z{{Message: stale, Score: time.Now().AddDate(0, 0, -30).Unix()}}, base.DefaultQueueName)
+
+	inspector := NewInspector(getRedisConnOpt(t))
+	if _, err := inspector.ArchiveStaleTasks(base.DefaultQueueName, 0); err == nil {
+		t.Errorf("ArchiveStaleTasks with zero age returned no error")
+	}
+	n, err := inspector.ArchiveStaleTasks(base.DefaultQueueName, 7*24*time.Hour)
+	if err != nil || n != 1 {
+		t.Fatalf("ArchiveStaleTasks = (%d, %v), want (1, nil)", n, err)
+	}
+	info, err := inspector.GetTaskInfo(base.DefaultQueueName, stale.ID)
+	if err != nil || info.State != TaskStateArchived || info.ArchiveReason != ArchiveReasonStale {
+		t.Errorf("GetTaskInfo(%q) = (%v, %v), want a task archived as stale", stale.ID, info, err)
+	}
+	if _, err := inspector.ArchiveStaleTasks("nonexistent", time.Hour); !errors.Is(err, ErrQueueNotFound) {
+		t.Errorf("ArchiveStaleTasks of nonexistent queue returned %v, want ErrQueueNotFound", err)
+	}
+}
+
+func TestInspectorDelayQueue(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	msg := h.NewTaskMessage("webhook:deliver", nil)
+	retryAt := time.Now().Add(time.Minute)
+	h.SeedRetryQueue(t, r, []base.Z{{Message: msg, Score: retryAt.Unix()}}, base.DefaultQueueName)
+
+	inspector := NewInspector(getRedisConnOpt(t))
+	if _, err := inspector.DelayQueue(base.DefaultQueueName, 0); err == nil {
+		t.Errorf("DelayQueue with zero delay returned no error")
+	}
+	n, err := inspector.DelayQueue(base.DefaultQueueName, 2*time.Hour)
+	if err != nil || n != 1 {
+		t.Fatalf("DelayQueue = (%d, %v), want (1, nil)", n, err)
+	}
+	info, err := inspector.GetTaskInfo(base.DefaultQueueName, msg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Unix(retryAt.Unix(), 0).Add(2 * time.Hour); !info.NextProcessAt.Equal(want) {
+		t.Errorf("task is to be processed at %v, want %v", info.NextProcessAt, want)
+	}
+	if _, err := inspector.DelayQueue("nonexistent", time.Hour); !errors.Is(err, ErrQueueNotFound) {
+		t.Errorf("DelayQueue of nonexistent queue returned %v, want ErrQueueNotFound", err)
+	}
+}
+
+func TestInspectorUniqueLocks(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	client := NewClient(getRedisConnOpt(t))
+	defer client.Close()
+	task := NewTask("email:welcome", []byte(`{"user_id":42}`))
+	info, err := client.Enqueue(task, Unique(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inspector := NewInspector(getRedisConnOpt(t))
+	locks, err := inspector.ListUniqueLocks(base.DefaultQueueName)
+	if err != nil {
+		t.Fatalf("ListUniqueLocks returned error: %v", err)
+	}
+	if len(locks) != 1 {
+		t.Fatalf("ListUniqueLocks returned %d locks, want 1", len(locks))
+	}
+	got := locks[0]
+	if got.Queue != base.DefaultQueueName || got.Type != "email:welcome" || got.TaskID != info.ID || got.TTL <= 0 || got.TTL > time.Hour {
+		t.Errorf("ListUniqueLocks returned %+v, want the lock of task %s of type %q", got, info.ID, "email:welcome")
+	}
+
+	if err := inspector.ReleaseUniqueLock(base.DefaultQueueName, got.Key); err != nil {
+		t.Fatalf("ReleaseUniqueLock returned error: %v", err)
+	}
+	if _, err := client.Enqueue(task, Unique(time.Hour)); err != nil {
+		t.Errorf("Enqueue of task with released uniqueness lock returned error: %v", err)
+	}
+	if err := inspector.ReleaseUniqueLock(base.DefaultQueueName, "asynq:{default}:unique:nonexistent:"); !errors.Is(err, ErrUniqueLockNotFound) {
+		t.Errorf("ReleaseUniqueLock of nonexistent lock returned %v, want ErrUniqueLockNotFound", err)
+	}
+	if _, err := inspector.ListUniqueLocks("nonexistent"); !errors.Is(err, ErrQueueNotFound) {
+		t.Errorf("ListUniqueLocks of nonexistent queue returned %v, want ErrQueueNotFound", err)
+	}
+}
+
+func TestInspectorReadOnly(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	m1 := h.NewTaskMessage("task1", nil)
+	m2 := h.NewTaskMessage("task2", nil)
+	h.SeedPendingQueue(t, r, []*base.TaskMessage{m1}, base.DefaultQueueName)
+	h.SeedArchivedQueue(t, r, []base.Z{{Message: m2, Score: time.Now().Unix()}}, base.DefaultQueueName)
+
+	inspector := NewInspectorWithConfig(getRedisConnOpt(t), InspectorConfig{ReadOnly: true})
+	qname := base.DefaultQueueName
+	writes := map[string]func() error{
+		"DeleteQueue":            func() error { return inspector.DeleteQueue(qname, true) },
+		"DeleteTask":             func() error { return inspector.DeleteTask(qname, m1.ID) },
+		"RunTask":                func() error { return inspector.RunTask(qname, m2.ID) },
+		"ArchiveTask":            func() error { return inspector.ArchiveTask(qname, m1.ID) },
+		"PauseQueue":             func() error { return inspector.PauseQueue(qname) },
+		"DrainQueue":             func() error { return inspector.DrainQueue(qname) },
+		"UndrainQueue":           func() error { return inspector.UndrainQueue(qname) },
+		"ReleaseUniqueLock":      func() error { return inspector.ReleaseUniqueLock(qname, "asynq:{default}:unique:task1:") },
+		"CancelProcessing":       func() error { return inspector.CancelProcessing(m1.ID) },
+		"DelayQueue":             func() error { _, err := inspector.DelayQueue(qname, time.Hour); return err },
+		"RepairQuarantinedTask":  func() error { return inspector.RepairQuarantinedTask(qname, m1.ID, nil) },
+		"DeleteAllPendingTasks":  func() error { _, err := inspector.DeleteAllPendingTasks(qname); return err },
+		"RunAllArchivedTasks":    func() error { _, err := inspector.RunAllArchivedTasks(qname); return err },
+		"ArchiveAllPendingTasks": func() error { _, err := inspector.ArchiveAllPendingTasks(qname); return err },
+		"DeleteTasks":            func() error { _, err := inspector.DeleteTasks(qname, TaskStatePending); return err },
+		"PurgeQueue":             func() error { _, err := inspector.PurgeQueue(qname, TaskStatePending, false); return err },
+		"CloneTask":              func() error { _, err := inspector.CloneTask(qname, m1.ID, nil); return err },
+		"PromoteMirror":          func() error { _, err := inspector.PromoteMirror(); return err },
+	}
+	for name, fn := range writes {
+		if err := fn(); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("%s of read-only inspector returned %v, want ErrReadOnly", name, err)
+		}
+	}
+	// Nothing was changed.
+	if diff := cmp.Diff([]*base.TaskMessage{m1}, h.GetPendingMessages(t, r, qname)); diff != "" {
+		t.Errorf("pending messages mismatch (-want,+got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{m2}, h.GetArchivedMessages(t, r, qname)); diff != "" {
+		t.Errorf("archived messages mismatch (-want,+got):\n%s", diff)
+	}
+
+	// Reads and dry runs are allowed.
+	info, err := inspector.GetQueueInfo(qname)
+	if err != nil || info.Paused || info.Pending != 1 {
+		t.Errorf("GetQueueInfo(%q) = (%+v, %v), want an unpaused queue with 1 pending task", qname, info, err)
+	}
+	if n, err := inspector.PurgeQueue(qname, TaskStatePending, true); err != nil || n != 1 {
+		t.Errorf("PurgeQueue dry run of read-only inspector = (%d, %v), want (1, nil)", n, err)
+	}
+	if err := inspector.WithActor("support").DeleteTask(qname, m1.ID); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("DeleteTask of read-only inspector with actor returned %v, want ErrReadOnly", err)
+	}
+}
+
+func TestInspectorReadOnlyDoesNotQuarantine(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	ctx := context.Background()
+	qname := base.DefaultQueueName
+	m1 := h.NewTaskMessage("task1", nil)
+	m2 := h.NewTaskMessage("task2", nil)
+	m3 := h.NewTaskMessage("task3", nil)
+	h.SeedPendingQueue(t, r, []*base.TaskMessage{m1, m2}, qname)
+	h.SeedArchivedQueue(t, r, []base.Z{{Message: m3, Score: time.Now().Unix()}}, qname)
+	for _, id := range []string{m2.ID, m3.ID} {
+		if err := r.HSet(ctx, base.TaskKey(qname, id), "msg", "bad data").Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	inspector := NewInspectorWithConfig(getRedisConnOpt(t), InspectorConfig{ReadOnly: true})
+	pending, err := inspector.ListPendingTasks(qname)
+	if err != nil || len(pending) != 1 || pending[0].ID != m1.ID {
+		t.Errorf("ListPendingTasks(%q) = (%v, %v), want only %q", qname, pending, err, m1.ID)
+	}
+	if archived, err := inspector.ListArchivedTasks(qname); err != nil || len(archived) != 0 {
+		t.Errorf("ListArchivedTasks(%q) = (%v, %v), want no tasks", qname, archived, err)
+	}
+	it := inspector.IterateTasks(qname, TaskStateArchived)
+	for it.Next() {
+		t.Errorf("IterateTasks returned task %q, want no tasks", it.Task().ID)
+	}
+	if err := it.Err(); err != nil {
+		t.Errorf("IterateTasks returned error: %v", err)
+	}
+	if n, err := inspector.ExportArchivedTasks(qname, io.Discard); err != nil || n != 0 {
+		t.Errorf("ExportArchivedTasks(%q) = (%d, %v), want (0, nil)", qname, n, err)
+	}
+
+	// The undecodable tasks are left as is.
+	if n := r.ZCard(ctx, base.QuarantineKey(qname)).Val(); n != 0 {
+		t.Errorf("%q has %d entries, want 0", base.QuarantineKey(qname), n)
+	}
+	if diff := cmp.Diff([]string{m2.ID, m1.ID}, r.LRange(ctx, base.PendingKey(qname), 0, -1).Val()); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.PendingKey(qname), diff)
+	}
+	if n := r.ZCard(ctx, base.ArchivedKey(qname)).Val(); n != 1 {
+		t.Errorf("%q has %d entries, want 1", base.ArchivedKey(qname), n)
+	}
+}
@@ -95,6 +95,10 @@ var SortStringSliceOpt = cmp.Transformer("SortStringSlice", func(in []string) []
 // IgnoreIDOpt is an cmp.Option to ignore ID field in task messages when comparing.
 var IgnoreIDOpt = cmpopts.IgnoreFields(base.TaskMessage{}, "ID")
 
+// IgnoreEnqueuedAtOpt is an cmp.Option to ignore EnqueuedAt field, set by the client
+// to the time of the enqueue, in task messages when comparing.
+var IgnoreEnqueuedAtOpt = cmpopts.IgnoreFields(base.TaskMessage{}, "EnqueuedAt")
+
 // NewTaskMessage returns a new instance of TaskMessage given a task type and payload.
 func NewTaskMessage(taskType string, payload []byte) *base.TaskMessage {
 	return NewTaskMessageWithQueue(taskType, payload, base.DefaultQueueName)
@@ -128,6 +132,7 @@ func JSON(kv map[string]interface{}) []byte {
 func TaskMessageAfterRetry(t base.TaskMessage, errMsg string, failedAt time.Time) *base.TaskMessage {
 	t.Retried = t.Retried + 1
 	t.ErrorMsg = errMsg
+	t.ErrorHistory = base.AppendErrorHistory(t.ErrorHistory, errMsg)
 	t.LastFailedAt = failedAt.Unix()
 	return &t
 }
@@ -135,10 +140,19 @@ func TaskMessageAfterRetry(t base.TaskMessage, errMsg string, failedAt time.Time
 // TaskMessageWithError returns an updated copy of t with the given error message.
 func TaskMessageWithError(t base.TaskMessage, errMsg string, failedAt time.Time) *base.TaskMessage {
 	t.ErrorMsg = errMsg
+	t.ErrorHistory = base.AppendErrorHistory(t.ErrorHistory, errMsg)
 	t.LastFailedAt = failedAt.Unix()
 	return &t
 }
 
+// TaskMessageAfterArchive returns an updated copy of t after archiving it with the given
+// error message and archive reason.
+func TaskMessageAfterArchive(t base.TaskMessage, errMsg, reason string, failedAt time.Time) *base.TaskMessage {
+	m := TaskMessageWithError(t, errMsg, failedAt)
+	m.ArchiveReason = reason
+	return m
+}
+
 // TaskMessageWithCompletedAt returns an updated copy of t after completion.
 func TaskMessageWithCompletedAt(t base.TaskMessage, completedAt time.Time) *base.TaskMessage {
 	t.CompletedAt = completedAt.Unix()
@@ -237,6 +251,13 @@ func SeedCompletedQueue(tb testing.TB, r redis.UniversalClient, entries []base.Z
 	seedRedisZSet(tb, r, base.CompletedKey(qname), entries, base.TaskStateCompleted)
 }
 
+// SeedUnhandledQueue initializes the unhandled set with the given entries.
+func SeedUnhandledQueue(tb testing.TB, r redis.UniversalClient, entries []base.Z, qname string) {
+	tb.Helper()
+	r.SAdd(context.Background(), base.AllQueues, qname)
+	seedRedisZSet(tb, r, base.UnhandledKey(qname), entries, base.TaskStateUnhandled)
+}
+
 // SeedAllPendingQueues initializes all of the specified queues with the given messages.
 //
 // pending maps a queue name to a list of messages.
@@ -311,6 +332,9 @@ func seedRedisList(tb testing.TB, c redis.UniversalClient, key string,
 			"deadline":   msg.Deadline,
 			"unique_key": msg.UniqueKey,
 		}
+		if msg.AtMostOnce {
+			data["at_most_once"] = 1
+		}
 		if err := c.HSet(context.Background(), key, data).Err(); err != nil {
 			tb.Fatal(err)
 		}
@@ -341,6 +365,9 @@ func seedRedisZSet(tb testing.TB, c redis.UniversalClient, key string,
 			"deadline":   msg.Deadline,
 			"unique_key": msg.UniqueKey,
 		}
+		if msg.AtMostOnce {
+			data["at_most_once"] = 1
+		}
 		if err := c.HSet(context.Background(), key, data).Err(); err != nil {
 			tb.Fatal(err)
 		}
@@ -395,6 +422,20 @@ func GetCompletedMessages(tb testing.TB, r redis.UniversalClient, qname string)
 	return getMessagesFromZSet(tb, r, qname, base.CompletedKey, base.TaskStateCompleted)
 }
 
+// GetWaitingMessages returns all waiting task messages in the given queue.
+// It also asserts the state field of the task.
+func GetWaitingMessages(tb testing.TB, r redis.UniversalClient, qname string) []*base.TaskMessage {
+	tb.Helper()
+	return getMessagesFromZSet(tb, r, qname, base.WaitingKey, base.TaskStateWaiting)
+}
+
+// GetUnhandledMessages returns all unhandled task messages in the given queue.
+// It also asserts the state field of the task.
+func GetUnhandledMessages(tb testing.TB, r redis.UniversalClient, qname string) []*base.TaskMessage {
+	tb.Helper()
+	return getMessagesFromZSet(tb, r, qname, base.UnhandledKey, base.TaskStateUnhandled)
+}
+
 // GetScheduledEntries returns all scheduled messages and its score in the given queue.
 // It also asserts the state field of the task.
 func GetScheduledEntries(tb testing.TB, r redis.UniversalClient, qname string) []base.Z {
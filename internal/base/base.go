@@ -7,17 +7,23 @@ package base
 
 import (
 	"context"
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/hibiken/asynq/internal/errors"
 	pb "github.com/hibiken/asynq/internal/proto"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -32,13 +38,40 @@ var DefaultQueue = PendingKey(DefaultQueueName)
 
 // Global Redis keys.
 const (
-	AllServers    = "asynq:servers"    // ZSET
-	AllWorkers    = "asynq:workers"    // ZSET
-	AllSchedulers = "asynq:schedulers" // ZSET
-	AllQueues     = "asynq:queues"     // SET
-	CancelChannel = "asynq:cancel"     // PubSub channel
+	AllServers     = "asynq:servers"     // ZSET
+	AllWorkers     = "asynq:workers"     // ZSET
+	AllSchedulers  = "asynq:schedulers"  // ZSET
+	AllQueues      = "asynq:queues"      // SET
+	CancelChannel  = "asynq:cancel"      // PubSub channel
+	AbortChannel   = "asynq:abort"       // PubSub channel
+	EnvironmentKey = "asynq:environment" // STRING
+	PromotedKey    = "asynq:promoted"    // STRING
 )
 
+// ConcurrencyChannel returns the PubSub channel used to change the concurrency of the given server.
+func ConcurrencyChannel(serverID string) string {
+	return "asynq:concurrency:" + serverID
+}
+
+// QuietChannel returns the PubSub channel used to stop the given server from processing new tasks.
+func QuietChannel(serverID string) string {
+	return "asynq:quiet:" + serverID
+}
+
+// WakeupChannel returns the PubSub channel used to wake up the servers idle on the given queue
+// when tasks become pending in the queue.
+func WakeupChannel(qname string) string {
+	return QueueKeyPrefix(qname) + "wakeup"
+}
+
+// EventsChannel returns the PubSub channel on which the events of the given queue are published.
+func EventsChannel(qname string) string {
+	return EventsChannelPrefix + qname
+}
+
+// EventsChannelPrefix is the prefix of the PubSub channels of queue events.
+const EventsChannelPrefix = "asynq:events:"
+
 // Max value for int64.
 //
 // Use this value to check if a redis counter value reached maximum.
@@ -55,6 +88,8 @@ const (
 	TaskStateRetry
 	TaskStateArchived
 	TaskStateCompleted
+	TaskStateWaiting
+	TaskStateUnhandled
 )
 
 func (s TaskState) String() string {
@@ -71,6 +106,10 @@ func (s TaskState) String() string {
 		return "archived"
 	case TaskStateCompleted:
 		return "completed"
+	case TaskStateWaiting:
+		return "waiting"
+	case TaskStateUnhandled:
+		return "unhandled"
 	}
 	panic(fmt.Sprintf("internal error: unknown task state %d", s))
 }
@@ -89,6 +128,10 @@ func TaskStateFromString(s string) (TaskState, error) {
 		return TaskStateArchived, nil
 	case "completed":
 		return TaskStateCompleted, nil
+	case "waiting":
+		return TaskStateWaiting, nil
+	case "unhandled":
+		return TaskStateUnhandled, nil
 	}
 	return 0, errors.E(errors.FailedPrecondition, fmt.Sprintf("%q is not supported task state", s))
 }
@@ -122,6 +165,12 @@ func PendingKey(qname string) string {
 	return fmt.Sprintf("%spending", QueueKeyPrefix(qname))
 }
 
+// PendingListsKey returns a redis key for the set of lists holding the pending
+// tasks set aside by the servers which couldn't process them, in addition to PendingKey.
+func PendingListsKey(qname string) string {
+	return fmt.Sprintf("%spending_lists", QueueKeyPrefix(qname))
+}
+
 // ActiveKey returns a redis key for the active tasks.
 func ActiveKey(qname string) string {
 	return fmt.Sprintf("%sactive", QueueKeyPrefix(qname))
@@ -151,11 +200,51 @@ func CompletedKey(qname string) string {
 	return fmt.Sprintf("%scompleted", QueueKeyPrefix(qname))
 }
 
+// WaitingKey returns a redis key for the waiting tasks.
+func WaitingKey(qname string) string {
+	return fmt.Sprintf("%swaiting", QueueKeyPrefix(qname))
+}
+
+// QuarantineKey returns a redis key for the tasks whose data could not be decoded.
+func QuarantineKey(qname string) string {
+	return fmt.Sprintf("%squarantine", QueueKeyPrefix(qname))
+}
+
+// UnhandledKey returns a redis key for the tasks parked because no handler is registered for their type.
+func UnhandledKey(qname string) string {
+	return fmt.Sprintf("%sunhandled", QueueKeyPrefix(qname))
+}
+
+// AuditKey returns a redis key for the stream of the audit log of the given queue.
+func AuditKey(qname string) string {
+	return fmt.Sprintf("%saudit", QueueKeyPrefix(qname))
+}
+
+// StartedKey returns a redis key to mark that the given at-most-once task is being processed.
+func StartedKey(qname, id string) string {
+	return fmt.Sprintf("%sstarted:%s", QueueKeyPrefix(qname), id)
+}
+
+// DependentsKey returns a redis key for the set of tasks waiting for the given task to complete.
+func DependentsKey(qname, id string) string {
+	return fmt.Sprintf("%sdependents:%s", QueueKeyPrefix(qname), id)
+}
+
 // PausedKey returns a redis key to indicate that the given queue is paused.
 func PausedKey(qname string) string {
 	return fmt.Sprintf("%spaused", QueueKeyPrefix(qname))
 }
 
+// ExpiryKey returns a redis key for the expiration times of tasks with a TTL.
+func ExpiryKey(qname string) string {
+	return fmt.Sprintf("%sexpiry", QueueKeyPrefix(qname))
+}
+
+// DrainingKey returns a redis key to indicate that the given queue is draining.
+func DrainingKey(qname string) string {
+	return fmt.Sprintf("%sdraining", QueueKeyPrefix(qname))
+}
+
 // ProcessedTotalKey returns a redis key for total processed count for the given queue.
 func ProcessedTotalKey(qname string) string {
 	return fmt.Sprintf("%sprocessed", QueueKeyPrefix(qname))
@@ -166,6 +255,52 @@ func FailedTotalKey(qname string) string {
 	return fmt.Sprintf("%sfailed", QueueKeyPrefix(qname))
 }
 
+// UnhandledTotalKey returns a redis key for the total count of tasks processed
+// without a handler registered for their type in the given queue.
+func UnhandledTotalKey(qname string) string {
+	return fmt.Sprintf("%sunhandled_total", QueueKeyPrefix(qname))
+}
+
+// DroppedTotalKey returns a redis key for the total count of tasks deleted from
+// the given queue because their data could not be decoded.
+func DroppedTotalKey(qname string) string {
+	return fmt.Sprintf("%sdropped_total", QueueKeyPrefix(qname))
+}
+
+// ResultCacheKey returns a redis key for the cached result of the completed task
+// of the given type with the given idempotency key.
+func ResultCacheKey(qname, tasktype, key string) string {
+	return fmt.Sprintf("%sresult_cache:%s:%s", QueueKeyPrefix(qname), tasktype, key)
+}
+
+// QueueHistoryKey returns a redis key for the sorted set of the sampled sizes of the given queue.
+func QueueHistoryKey(qname string) string {
+	return fmt.Sprintf("%shistory", QueueKeyPrefix(qname))
+}
+
+// TaskSamplesKey returns a redis key for the list of the sampled tasks of the given queue.
+func TaskSamplesKey(qname string) string {
+	return fmt.Sprintf("%ssamples", QueueKeyPrefix(qname))
+}
+
+// ExpiryDigestKey returns a redis key for the marker of the last digest of
+// the expiring archived tasks of the given queue.
+func ExpiryDigestKey(qname string) string {
+	return fmt.Sprintf("%sexpiry_digest", QueueKeyPrefix(qname))
+}
+
+// LatencyKey returns a redis key for the hash holding the latency histograms
+// of the tasks of the given queue per task type.
+func LatencyKey(qname string) string {
+	return fmt.Sprintf("%slatency", QueueKeyPrefix(qname))
+}
+
+// DuplicatesKey returns a redis key for the hash holding the number of enqueues
+// rejected as duplicates per task type in the given queue.
+func DuplicatesKey(qname string) string {
+	return fmt.Sprintf("%sduplicates", QueueKeyPrefix(qname))
+}
+
 // ProcessedKey returns a redis key for processed count for the given day for the queue.
 func ProcessedKey(qname string, t time.Time) string {
 	return fmt.Sprintf("%sprocessed:%s", QueueKeyPrefix(qname), t.UTC().Format("2006-01-02"))
@@ -196,13 +331,34 @@ func SchedulerHistoryKey(entryID string) string {
 	return fmt.Sprintf("asynq:scheduler_history:%s", entryID)
 }
 
+// SchedulerPrevTaskKey returns a redis key for the task enqueued on the previous occurrence
+// of a scheduler entry. Unlike the entry ID, the entry key is the same across restarts.
+func SchedulerPrevTaskKey(entryKey string) string {
+	return fmt.Sprintf("asynq:scheduler_prev:%s", entryKey)
+}
+
 // UniqueKey returns a redis key with the given type, payload, and queue name.
 func UniqueKey(qname, tasktype string, payload []byte) string {
 	if payload == nil {
-		return fmt.Sprintf("%sunique:%s:", QueueKeyPrefix(qname), tasktype)
+		return fmt.Sprintf("%s%s:", UniqueKeyPrefix(qname), tasktype)
 	}
 	checksum := md5.Sum(payload)
-	return fmt.Sprintf("%sunique:%s:%s", QueueKeyPrefix(qname), tasktype, hex.EncodeToString(checksum[:]))
+	return fmt.Sprintf("%s%s:%s", UniqueKeyPrefix(qname), tasktype, hex.EncodeToString(checksum[:]))
+}
+
+// UniqueKeyPrefix returns a prefix for the unique keys of the given queue.
+func UniqueKeyPrefix(qname string) string {
+	return fmt.Sprintf("%sunique:", QueueKeyPrefix(qname))
+}
+
+// IdempotencyKey returns a redis key for the given producer provided idempotency key and queue name.
+func IdempotencyKey(qname, key string) string {
+	return fmt.Sprintf("%sidempotency:%s", QueueKeyPrefix(qname), key)
+}
+
+// GroupKey returns a redis key for the list of tasks in the given group of the queue.
+func GroupKey(qname, key string) string {
+	return fmt.Sprintf("%sgroup:%s", QueueKeyPrefix(qname), key)
 }
 
 // TaskMessage is the internal representation of a task with additional metadata fields.
@@ -263,51 +419,423 @@ type TaskMessage struct {
 	//
 	// Use zero to indicate no value.
 	CompletedAt int64
+
+	// IdempotencyKey holds the producer provided key used to deduplicate enqueue requests for this task.
+	//
+	// Empty string indicates that no idempotency key was used.
+	IdempotencyKey string
+
+	// GroupKey holds the producer provided key used to process tasks sharing the key one at a time in enqueue order.
+	//
+	// Empty string indicates that the task doesn't belong to a group.
+	GroupKey string
+
+	// Dependencies holds the IDs of the tasks in the same queue which need to complete
+	// successfully before this task can be processed.
+	Dependencies []string
+
+	// Headers holds producer provided metadata attached to the task, separate from the payload.
+	//
+	// Nil indicates that no header was set.
+	Headers map[string]string
+
+	// ExpiresAt is the time in Unix time by which the task needs to start processing.
+	// A task which hasn't started processing by then is discarded.
+	//
+	// Use zero to indicate no expiration.
+	ExpiresAt int64
+
+	// AtMostOnce indicates that the task must not be processed by more than one
+	// worker at a time. A delivery of the task while a previous delivery is still
+	// being processed is discarded.
+	AtMostOnce bool
+
+	// ArchiveReason is the reason the task was last archived, one of the ArchiveReason* constants.
+	//
+	// Empty string indicates that the task has never been archived.
+	ArchiveReason string
+
+	// ErrorHistory holds the error messages of the most recent failed attempts
+	// to process the task, oldest first. Its last element is the same as ErrorMsg.
+	ErrorHistory []string
+
+	// PayloadSize is the size in bytes of the original payload if the payload was
+	// truncated when the task was archived, and PayloadDigest is the hex-encoded
+	// SHA-256 digest of the original payload.
+	//
+	// Zero PayloadSize indicates that the payload is intact.
+	PayloadSize   int64
+	PayloadDigest string
+
+	// PayloadRef is the key of the payload in the external payload store, if the
+	// payload was too large to be stored in redis. Payload is empty if PayloadRef is set.
+	PayloadRef string
+
+	// Signature is the HMAC-SHA256 of the fields of the message set at enqueue time,
+	// computed with the signing key of the client. Empty if the message is not signed.
+	// See SignMessage.
+	Signature []byte
+
+	// Class is the class of the task (e.g. "cpu" or "io"), which limits the number of
+	// tasks of the class processed concurrently by a server. Empty if the task has no class.
+	Class string
+
+	// ClonedFrom is the ID of the archived task this task was cloned from.
+	// Empty if the task is not a clone.
+	ClonedFrom string
+
+	// Labels are the labels a server must have to process the task.
+	// Nil if any server can process the task.
+	Labels map[string]string
+
+	// EnqueuedAt is the time the task was enqueued by the client in Unix time in nanoseconds.
+	// It is kept across retries. Zero if unknown.
+	EnqueuedAt int64
+
+	// DefaultRetry reports whether Retry is the default max retry of the client,
+	// i.e. the task was enqueued without the MaxRetry option. Servers may then use
+	// the max retry of the queue instead (see asynq.Config.QueueRetryPolicies).
+	DefaultRetry bool
+
+	// SchemaVersion is the version of the schema the message was encoded with,
+	// if it is newer than TaskMessageSchemaVersion. Zero otherwise.
+	SchemaVersion int
+
+	// UnknownFields holds the encoding of the fields of the message unknown to this
+	// version of the schema, i.e. added by a newer version. EncodeMessage writes them
+	// back so that they're kept when the message is updated by an older version.
+	UnknownFields []byte
+
+	// Checkpoint holds the progress saved by a previous delivery of the task.
+	// It is stored separately from the message and is not encoded by EncodeMessage;
+	// Broker.Dequeue sets it on the message it returns.
+	Checkpoint []byte
+
+	// PendingSince is the time in Unix nanoseconds the task became pending.
+	// Like Checkpoint, it is not encoded by EncodeMessage; Broker.Dequeue sets it
+	// on the message it returns. Zero if unknown.
+	PendingSince int64
+
+	// DependencyResults maps the IDs of the dependencies of the task to the results
+	// they wrote before completing. Like Checkpoint, it is not encoded by EncodeMessage;
+	// Broker.Dequeue sets it on the message it returns. Dependencies which wrote no
+	// result are missing.
+	DependencyResults map[string][]byte
+
+	// Lease identifies the delivery of the task returned by Broker.Dequeue, which
+	// increments it every time the task is dequeued. Like Checkpoint, it is not
+	// encoded by EncodeMessage. The broker ignores an acknowledgement of the task
+	// (e.g. Done, Retry) made under a previous lease, i.e. by a server the task
+	// was recovered from. Zero if unknown, in which case it is not checked.
+	Lease int64
+}
+
+// Reasons a task is archived.
+const (
+	ArchiveReasonMaxRetry         = "max-retries-exceeded"
+	ArchiveReasonSkipRetry        = "skip-retry"
+	ArchiveReasonDeadlineExceeded = "deadline-exceeded"
+	ArchiveReasonOperator         = "operator-archived"
+	ArchiveReasonNoHandler        = "no-handler"
+	ArchiveReasonStale            = "stale"
+
+	ArchiveReasonDependencyArchived = "dependency-archived"
+)
+
+// MaxErrorHistory is the maximum number of error messages kept in the error history of a task.
+const MaxErrorHistory = 25
+
+// AppendErrorHistory returns a copy of the given error history with errMsg appended,
+// holding at most MaxErrorHistory most recent messages.
+func AppendErrorHistory(history []string, errMsg string) []string {
+	if len(history) >= MaxErrorHistory {
+		history = history[len(history)-MaxErrorHistory+1:]
+	}
+	res := make([]string, 0, len(history)+1)
+	res = append(res, history...)
+	return append(res, errMsg)
 }
 
+// FormatLabels returns the given labels as "key=value" strings sorted by key,
+// the form in which the labels of tasks and servers are matched in redis.
+func FormatLabels(labels map[string]string) []string {
+	if len(labels) == 0 {
+		return nil
+	}
+	res := make([]string, 0, len(labels))
+	for k, v := range labels {
+		res = append(res, k+"="+v)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// ValidLabel reports whether the given key and value can be used as a label.
+// The key must not be empty, and neither must contain a comma; the key must not
+// contain an equal sign.
+func ValidLabel(key, value string) bool {
+	return strings.TrimSpace(key) != "" && !strings.ContainsAny(key, ",=") && !strings.Contains(value, ",")
+}
+
+// EncodeArchiveReason returns the encoding of the archive reason, which sets
+// the archive reason of an encoded task message when appended to it.
+//
+// Note: Fields of a message are merged when the encoding of a message is
+// concatenated, the last value winning for scalar fields. This lets scripts
+// set the reason on encoded messages without decoding them.
+//
+// The field is encoded even if reason is empty, so that the encoding of the
+// empty reason clears the archive reason of the message.
+func EncodeArchiveReason(reason string) ([]byte, error) {
+	if !utf8.ValidString(reason) {
+		return nil, fmt.Errorf("archive reason %q is not valid UTF-8", reason)
+	}
+	field := (&pb.TaskMessage{}).ProtoReflect().Descriptor().Fields().ByName("archive_reason")
+	b := protowire.AppendTag(nil, field.Number(), protowire.BytesType)
+	return protowire.AppendString(b, reason), nil
+}
+
+// TaskMessageSchemaVersion is the version of the schema of the encoded TaskMessage.
+//
+// The schema evolves in compatible ways only, so that producers and consumers using
+// different versions interoperate during a rolling upgrade: fields keep their number,
+// new fields are added with a new number, and a field missing from a message takes
+// its default value (see DecodeMessage). Increment the version when a field is added.
+const TaskMessageSchemaVersion = 4
+
 // EncodeMessage marshals the given task message and returns an encoded bytes.
 func EncodeMessage(msg *TaskMessage) ([]byte, error) {
 	if msg == nil {
 		return nil, fmt.Errorf("cannot encode nil message")
 	}
-	return proto.Marshal(&pb.TaskMessage{
-		Type:         msg.Type,
-		Payload:      msg.Payload,
-		Id:           msg.ID,
-		Queue:        msg.Queue,
-		Retry:        int32(msg.Retry),
-		Retried:      int32(msg.Retried),
-		ErrorMsg:     msg.ErrorMsg,
-		LastFailedAt: msg.LastFailedAt,
-		Timeout:      msg.Timeout,
-		Deadline:     msg.Deadline,
-		UniqueKey:    msg.UniqueKey,
-		Retention:    msg.Retention,
-		CompletedAt:  msg.CompletedAt,
+	version := TaskMessageSchemaVersion
+	if msg.SchemaVersion > version {
+		version = msg.SchemaVersion
+	}
+	data, err := proto.Marshal(&pb.TaskMessage{
+		Type:           msg.Type,
+		Payload:        msg.Payload,
+		Id:             msg.ID,
+		Queue:          msg.Queue,
+		Retry:          int32(msg.Retry),
+		Retried:        int32(msg.Retried),
+		ErrorMsg:       msg.ErrorMsg,
+		LastFailedAt:   msg.LastFailedAt,
+		Timeout:        msg.Timeout,
+		Deadline:       msg.Deadline,
+		UniqueKey:      msg.UniqueKey,
+		Retention:      msg.Retention,
+		CompletedAt:    msg.CompletedAt,
+		IdempotencyKey: msg.IdempotencyKey,
+		GroupKey:       msg.GroupKey,
+		Dependencies:   msg.Dependencies,
+		Headers:        msg.Headers,
+		ExpiresAt:      msg.ExpiresAt,
+		AtMostOnce:     msg.AtMostOnce,
+		ArchiveReason:  msg.ArchiveReason,
+		ErrorHistory:   msg.ErrorHistory,
+		PayloadSize:    msg.PayloadSize,
+		PayloadDigest:  msg.PayloadDigest,
+		PayloadRef:     msg.PayloadRef,
+		Signature:      msg.Signature,
+		Class:          msg.Class,
+		ClonedFrom:     msg.ClonedFrom,
+		Labels:         msg.Labels,
+		EnqueuedAt:     msg.EnqueuedAt,
+		DefaultRetry:   msg.DefaultRetry,
+		SchemaVersion:  int32(version),
 	})
+	if err != nil {
+		return nil, err
+	}
+	return append(data, msg.UnknownFields...), nil
+}
+
+// SignMessage sets the signature of the given message to the HMAC-SHA256 of its
+// fields set at enqueue time, computed with the given key.
+//
+// Fields updated while the task moves through its lifecycle (e.g. Retried, ErrorMsg)
+// are not signed, so that the signature stays valid across retries.
+func SignMessage(msg *TaskMessage, key []byte) {
+	msg.Signature = messageSignature(msg, key)
+}
+
+// VerifyMessage reports whether the given message has a valid signature for the given key.
+func VerifyMessage(msg *TaskMessage, key []byte) bool {
+	if len(msg.Signature) == 0 {
+		return false
+	}
+	return hmac.Equal(messageSignature(msg, key), msg.Signature)
+}
+
+func messageSignature(msg *TaskMessage, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	// Each field is written with its length or value as a varint, in a fixed order,
+	// so that the signed data is unambiguous and independent of the message encoding.
+	var buf [binary.MaxVarintLen64]byte
+	writeInt := func(n int64) {
+		mac.Write(buf[:binary.PutVarint(buf[:], n)])
+	}
+	writeBytes := func(b []byte) {
+		writeInt(int64(len(b)))
+		mac.Write(b)
+	}
+	writeString := func(s string) { writeBytes([]byte(s)) }
+
+	writeString(msg.ID)
+	writeString(msg.Type)
+	writeBytes(msg.Payload)
+	writeString(msg.PayloadRef)
+	writeString(msg.Queue)
+	writeInt(int64(msg.Retry))
+	writeInt(msg.Timeout)
+	writeInt(msg.Deadline)
+	writeInt(msg.Retention)
+	writeInt(msg.ExpiresAt)
+	if msg.AtMostOnce {
+		writeInt(1)
+	} else {
+		writeInt(0)
+	}
+	writeString(msg.UniqueKey)
+	writeString(msg.IdempotencyKey)
+	writeString(msg.GroupKey)
+	writeString(msg.Class)
+	writeInt(int64(len(msg.Dependencies)))
+	for _, id := range msg.Dependencies {
+		writeString(id)
+	}
+	writeMap := func(m map[string]string) {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		writeInt(int64(len(keys)))
+		for _, k := range keys {
+			writeString(k)
+			writeString(m[k])
+		}
+	}
+	writeMap(msg.Headers)
+	writeMap(msg.Labels)
+	if msg.DefaultRetry {
+		writeInt(1)
+	} else {
+		writeInt(0)
+	}
+	writeInt(msg.EnqueuedAt)
+	return mac.Sum(nil)
 }
 
 // DecodeMessage unmarshals the given bytes and returns a decoded task message.
+//
+// Messages encoded with a newer version of the schema are decoded too: the fields
+// unknown to this version are kept in UnknownFields. Fields missing from the message
+// (e.g. encoded with an older version) take their default value.
 func DecodeMessage(data []byte) (*TaskMessage, error) {
 	var pbmsg pb.TaskMessage
 	if err := proto.Unmarshal(data, &pbmsg); err != nil {
 		return nil, err
 	}
-	return &TaskMessage{
-		Type:         pbmsg.GetType(),
-		Payload:      pbmsg.GetPayload(),
-		ID:           pbmsg.GetId(),
-		Queue:        pbmsg.GetQueue(),
-		Retry:        int(pbmsg.GetRetry()),
-		Retried:      int(pbmsg.GetRetried()),
-		ErrorMsg:     pbmsg.GetErrorMsg(),
-		LastFailedAt: pbmsg.GetLastFailedAt(),
-		Timeout:      pbmsg.GetTimeout(),
-		Deadline:     pbmsg.GetDeadline(),
-		UniqueKey:    pbmsg.GetUniqueKey(),
-		Retention:    pbmsg.GetRetention(),
-		CompletedAt:  pbmsg.GetCompletedAt(),
-	}, nil
+	msg := &TaskMessage{
+		Type:           pbmsg.GetType(),
+		Payload:        pbmsg.GetPayload(),
+		ID:             pbmsg.GetId(),
+		Queue:          pbmsg.GetQueue(),
+		Retry:          int(pbmsg.GetRetry()),
+		Retried:        int(pbmsg.GetRetried()),
+		ErrorMsg:       pbmsg.GetErrorMsg(),
+		LastFailedAt:   pbmsg.GetLastFailedAt(),
+		Timeout:        pbmsg.GetTimeout(),
+		Deadline:       pbmsg.GetDeadline(),
+		UniqueKey:      pbmsg.GetUniqueKey(),
+		Retention:      pbmsg.GetRetention(),
+		CompletedAt:    pbmsg.GetCompletedAt(),
+		IdempotencyKey: pbmsg.GetIdempotencyKey(),
+		GroupKey:       pbmsg.GetGroupKey(),
+		Dependencies:   pbmsg.GetDependencies(),
+		Headers:        pbmsg.GetHeaders(),
+		ExpiresAt:      pbmsg.GetExpiresAt(),
+		AtMostOnce:     pbmsg.GetAtMostOnce(),
+		ArchiveReason:  pbmsg.GetArchiveReason(),
+		ErrorHistory:   pbmsg.GetErrorHistory(),
+		PayloadSize:    pbmsg.GetPayloadSize(),
+		PayloadDigest:  pbmsg.GetPayloadDigest(),
+		PayloadRef:     pbmsg.GetPayloadRef(),
+		Signature:      pbmsg.GetSignature(),
+		Class:          pbmsg.GetClass(),
+		ClonedFrom:     pbmsg.GetClonedFrom(),
+		Labels:         pbmsg.GetLabels(),
+		EnqueuedAt:     pbmsg.GetEnqueuedAt(),
+		DefaultRetry:   pbmsg.GetDefaultRetry(),
+	}
+	if v := int(pbmsg.GetSchemaVersion()); v > TaskMessageSchemaVersion {
+		msg.SchemaVersion = v
+	}
+	if unknown := pbmsg.ProtoReflect().GetUnknown(); len(unknown) > 0 {
+		msg.UnknownFields = append([]byte(nil), unknown...)
+	}
+	if msg.Queue == "" {
+		// Tasks with no queue are enqueued to the default queue.
+		msg.Queue = DefaultQueueName
+	}
+	return msg, nil
+}
+
+// ValidateMessage checks that the given task message conforms to the contract of
+// the messages written to redis (see docs/wire-format.md), e.g. a message written
+// by a producer in another language, and returns the problems found, if any.
+func ValidateMessage(msg *TaskMessage) []string {
+	var problems []string
+	addf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	if strings.TrimSpace(msg.Type) == "" {
+		addf("type is empty")
+	}
+	if msg.ID == "" {
+		addf("id is empty")
+	}
+	if err := ValidateQueueName(msg.Queue); err != nil {
+		addf("queue: %v", err)
+	}
+	if msg.Retry < 0 {
+		addf("retry is negative: %d", msg.Retry)
+	}
+	if msg.Retried < 0 {
+		addf("retried is negative: %d", msg.Retried)
+	}
+	if msg.Timeout < 0 {
+		addf("timeout is negative: %d", msg.Timeout)
+	}
+	if msg.Deadline < 0 {
+		addf("deadline is negative: %d", msg.Deadline)
+	}
+	if msg.Timeout <= 0 && msg.Deadline <= 0 {
+		addf("neither timeout nor deadline is set")
+	}
+	if msg.Retention < 0 {
+		addf("retention is negative: %d", msg.Retention)
+	}
+	if msg.UniqueKey != "" && !strings.HasPrefix(msg.UniqueKey, UniqueKeyPrefix(msg.Queue)) {
+		addf("unique_key %q is not a unique key of queue %q", msg.UniqueKey, msg.Queue)
+	}
+	if len(msg.Dependencies) > 0 && (msg.UniqueKey != "" || msg.GroupKey != "") {
+		addf("dependencies cannot be set with unique_key or group_key")
+	}
+	if msg.UniqueKey != "" && msg.GroupKey != "" {
+		addf("unique_key cannot be set with group_key")
+	}
+	if msg.PayloadRef != "" && len(msg.Payload) > 0 {
+		addf("payload must be empty when payload_ref is set")
+	}
+	for k := range msg.Headers {
+		if k == "" {
+			addf("headers has an empty key")
+		}
+	}
+	return problems
 }
 
 // TaskInfo describes a task message and its metadata.
@@ -316,6 +844,7 @@ type TaskInfo struct {
 	State         TaskState
 	NextProcessAt time.Time
 	Result        []byte
+	Progress      []byte
 }
 
 // Z represents sorted set member.
@@ -397,6 +926,161 @@ type ServerInfo struct {
 	Status            string
 	Started           time.Time
 	ActiveWorkerCount int
+	Environment       string
+	// Number of tasks finished and requeued during the shutdown, set in the
+	// final status of the server.
+	ShutdownFinished int
+	ShutdownRequeued int
+	// Version of the asynq library the server is built with.
+	// Empty for servers built with a version which does not report it.
+	Version string
+	// Features enabled on the server which affect how tasks are read,
+	// sorted (see FeaturePayloadStore and FeatureSigning).
+	Features []string
+}
+
+// TaskSample holds the measurements of a task sampled on completion.
+type TaskSample struct {
+	Type        string
+	PayloadSize int
+	// Duration is the time the handler took to process the task.
+	Duration time.Duration
+	// WaitTime is the time the task was pending before it was processed;
+	// zero if unknown.
+	WaitTime time.Duration
+	// CompletedAt is the time the task completed.
+	CompletedAt time.Time
+}
+
+// LatencyBuckets are the upper bounds of the buckets of the latency histograms of
+// tasks, in increasing order. Latencies above the last bound are counted in an
+// overflow bucket. Changing the bounds invalidates the recorded histograms.
+var LatencyBuckets = []time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+	5 * time.Minute,
+	15 * time.Minute,
+	time.Hour,
+	6 * time.Hour,
+	24 * time.Hour,
+}
+
+// LatencyBucket returns the index in LatencyBuckets of the bucket counting the
+// latency d, or len(LatencyBuckets) if d falls in the overflow bucket.
+func LatencyBucket(d time.Duration) int {
+	return sort.Search(len(LatencyBuckets), func(i int) bool { return d <= LatencyBuckets[i] })
+}
+
+// TaskLatency holds the latencies of a task measured on completion.
+type TaskLatency struct {
+	Type string
+	// Wait is the time from the task becoming pending to the start of the processing
+	// which completed it; zero if unknown.
+	Wait time.Duration
+	// Run is the time the handler took to process the task.
+	Run time.Duration
+}
+
+// ExpiringArchived summarizes the archived tasks of a queue which are about to be
+// deleted permanently, either by age or to keep the archive within its maximum size.
+type ExpiringArchived struct {
+	CountByType map[string]int
+	// Expired is the number of tasks deleted by age.
+	Expired int
+	// Trimmed is the number of the other tasks deleted to keep the archive within
+	// its maximum size, if tasks keep being archived at the same rate.
+	Trimmed int
+	// OldestArchivedAt and NewestArchivedAt are the times the oldest and the newest
+	// of the tasks were archived.
+	OldestArchivedAt time.Time
+	NewestArchivedAt time.Time
+}
+
+// Features reported in ServerInfo.Features.
+const (
+	// FeaturePayloadStore indicates that the server loads the payloads
+	// stored outside of redis (i.e. tasks with a payload ref).
+	FeaturePayloadStore = "payload_store"
+
+	// FeatureSigning indicates that the server verifies the signatures of tasks,
+	// and rejects unsigned tasks.
+	FeatureSigning = "signing"
+)
+
+// Incompatibilities compares the server described by info with the other running
+// servers of the same environment, and returns a description of each difference
+// which may break the processing of tasks in a mixed fleet, e.g. during a rolling upgrade:
+//
+//   - a server running another minor version of the library, since the data in redis
+//     may be written differently across minor versions;
+//   - a server processing a queue of the server without one of the features of
+//     the server, or with a feature the server does not have.
+func Incompatibilities(info *ServerInfo, others []*ServerInfo) []string {
+	var res []string
+	for _, o := range others {
+		if o.ServerID == info.ServerID || o.Status == "closed" || o.Environment != info.Environment {
+			continue
+		}
+		name := fmt.Sprintf("server %s on %s:%d", o.ServerID, o.Host, o.PID)
+		if minorVersion(o.Version) != minorVersion(info.Version) {
+			v := "asynq v" + o.Version
+			if o.Version == "" {
+				v = "an older asynq version which does not report it"
+			}
+			res = append(res, fmt.Sprintf("%s runs %s, this server runs v%s", name, v, info.Version))
+		}
+		if !sharesQueue(info.Queues, o.Queues) {
+			continue
+		}
+		for _, f := range info.Features {
+			if !hasFeature(o.Features, f) {
+				res = append(res, fmt.Sprintf("%s processes queues of this server without feature %q", name, f))
+			}
+		}
+		for _, f := range o.Features {
+			if !hasFeature(info.Features, f) {
+				res = append(res, fmt.Sprintf("%s processes queues of this server with feature %q, which this server does not have", name, f))
+			}
+		}
+	}
+	return res
+}
+
+// minorVersion returns the major and minor version of the given version, e.g. "0.19" for "0.19.1".
+func minorVersion(v string) string {
+	if i := strings.LastIndex(v, "."); i > strings.Index(v, ".") {
+		return v[:i]
+	}
+	return v
+}
+
+func sharesQueue(x, y map[string]int) bool {
+	for qname := range x {
+		if _, ok := y[qname]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func hasFeature(features []string, f string) bool {
+	for _, g := range features {
+		if g == f {
+			return true
+		}
+	}
+	return false
 }
 
 // EncodeServerInfo marshals the given ServerInfo and returns the encoded bytes.
@@ -422,6 +1106,11 @@ func EncodeServerInfo(info *ServerInfo) ([]byte, error) {
 		Status:            info.Status,
 		StartTime:         started,
 		ActiveWorkerCount: int32(info.ActiveWorkerCount),
+		Environment:       info.Environment,
+		ShutdownFinished:  int32(info.ShutdownFinished),
+		ShutdownRequeued:  int32(info.ShutdownRequeued),
+		Version:           info.Version,
+		Features:          info.Features,
 	})
 }
 
@@ -449,6 +1138,11 @@ func DecodeServerInfo(b []byte) (*ServerInfo, error) {
 		Status:            pbmsg.GetStatus(),
 		Started:           startTime,
 		ActiveWorkerCount: int(pbmsg.GetActiveWorkerCount()),
+		Environment:       pbmsg.GetEnvironment(),
+		ShutdownFinished:  int(pbmsg.GetShutdownFinished()),
+		ShutdownRequeued:  int(pbmsg.GetShutdownRequeued()),
+		Version:           pbmsg.GetVersion(),
+		Features:          pbmsg.GetFeatures(),
 	}, nil
 }
 
@@ -640,13 +1334,38 @@ func DecodeSchedulerEnqueueEvent(b []byte) (*SchedulerEnqueueEvent, error) {
 type Cancelations struct {
 	mu          sync.Mutex
 	cancelFuncs map[string]context.CancelFunc
+	// aborted holds the IDs of the tasks canceled with Abort.
+	aborted map[string]bool
 }
 
 // NewCancelations returns a Cancelations instance.
 func NewCancelations() *Cancelations {
 	return &Cancelations{
 		cancelFuncs: make(map[string]context.CancelFunc),
+		aborted:     make(map[string]bool),
+	}
+}
+
+// Abort calls the cancel func of the task with the given id, and marks the
+// task as aborted: it is archived rather than retried if it fails.
+// It reports whether the task has a cancel func.
+func (c *Cancelations) Abort(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fn, ok := c.cancelFuncs[id]
+	if !ok {
+		return false
 	}
+	c.aborted[id] = true
+	fn()
+	return true
+}
+
+// Aborted reports whether the task with the given id was canceled with Abort.
+func (c *Cancelations) Aborted(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.aborted[id]
 }
 
 // Add adds a new cancel func to the collection.
@@ -661,6 +1380,7 @@ func (c *Cancelations) Delete(id string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	delete(c.cancelFuncs, id)
+	delete(c.aborted, id)
 }
 
 // Get returns a cancel func given an id.
@@ -676,23 +1396,47 @@ func (c *Cancelations) Get(id string) (fn context.CancelFunc, ok bool) {
 // See rdb.RDB as a reference implementation.
 type Broker interface {
 	Ping() error
+	ClaimEnvironment(env string) (string, error)
 	Enqueue(ctx context.Context, msg *TaskMessage) error
 	EnqueueUnique(ctx context.Context, msg *TaskMessage, ttl time.Duration) error
 	Dequeue(qnames ...string) (*TaskMessage, time.Time, error)
+	DequeueSkipping(skipClasses []string, qnames ...string) (*TaskMessage, time.Time, error)
+	DequeueMatching(labels, skipClasses []string, qnames ...string) (*TaskMessage, time.Time, error)
+	PauseFor(qname string, d time.Duration, reason string) (bool, error)
 	Done(msg *TaskMessage) error
 	MarkAsComplete(msg *TaskMessage) error
 	Requeue(msg *TaskMessage) error
+	ClearStarted(msg *TaskMessage) error
+	CacheResult(msg *TaskMessage, ttl time.Duration) error
+	CachedResult(msg *TaskMessage) ([]byte, bool, error)
 	Schedule(ctx context.Context, msg *TaskMessage, processAt time.Time) error
 	ScheduleUnique(ctx context.Context, msg *TaskMessage, processAt time.Time, ttl time.Duration) error
 	Retry(msg *TaskMessage, processAt time.Time, errMsg string, isFailure bool) error
-	Archive(msg *TaskMessage, errMsg string) error
+	Archive(msg *TaskMessage, errMsg, reason string) error
+	Park(msg *TaskMessage, errMsg string) error
+	Quarantine(msg *TaskMessage, errMsg string) error
+	RecordUnhandled(qname string) error
 	ForwardIfReady(qnames ...string) error
 	DeleteExpiredCompletedTasks(qname string) error
+	ArchiveStaleTasks(qname string, cutoff time.Time) (int64, error)
+	RecordQueueSizes(qname string, interval time.Duration) error
+	ClaimExpiryDigest(qname string, within, period, claim time.Duration) (*ExpiringArchived, error)
+	FinishExpiryDigest(qname string, period time.Duration, notified bool) error
+	RecordTaskSample(qname string, s *TaskSample) error
+	RecordLatency(qname string, l *TaskLatency) error
 	ListDeadlineExceeded(deadline time.Time, qnames ...string) ([]*TaskMessage, error)
 	WriteServerState(info *ServerInfo, workers []*WorkerInfo, ttl time.Duration) error
+	CheckCompatibility(info *ServerInfo) ([]string, error)
 	ClearServerState(host string, pid int, serverID string) error
 	CancelationPubSub() (*redis.PubSub, error) // TODO: Need to decouple from redis to support other brokers
 	PublishCancelation(id string) error
+	ConcurrencyPubSub(serverID string) (*redis.PubSub, error)
+	WakeupPubSub(qnames ...string) (*redis.PubSub, error)
+	PublishConcurrency(serverID string, n int) error
+	QuietPubSub(serverID string) (*redis.PubSub, error)
+	PublishQuiet(serverID string) error
 	WriteResult(qname, id string, data []byte) (n int, err error)
+	WriteCheckpoint(qname, id string, data []byte) error
+	WriteProgress(qname, id string, data []byte) error
 	Close() error
 }
@@ -10,12 +10,16 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/uuid"
+	pb "github.com/hibiken/asynq/internal/proto"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestTaskKey(t *testing.T) {
@@ -156,6 +160,144 @@ func TestCompletedKey(t *testing.T) {
 	}
 }
 
+func TestWaitingKey(t *testing.T) {
+	tests := []struct {
+		qname string
+		want  string
+	}{
+		{"default", "asynq:{default}:waiting"},
+		{"custom", "asynq:{custom}:waiting"},
+	}
+
+	for _, tc := range tests {
+		got := WaitingKey(tc.qname)
+		if got != tc.want {
+			t.Errorf("WaitingKey(%q) = %q, want %q", tc.qname, got, tc.want)
+		}
+	}
+}
+
+func TestUnhandledKey(t *testing.T) {
+	tests := []struct {
+		qname string
+		want  string
+	}{
+		{"default", "asynq:{default}:unhandled"},
+		{"custom", "asynq:{custom}:unhandled"},
+	}
+
+	for _, tc := range tests {
+		got := UnhandledKey(tc.qname)
+		if got != tc.want {
+			t.Errorf("UnhandledKey(%q) = %q, want %q", tc.qname, got, tc.want)
+		}
+	}
+}
+
+func TestUnhandledTotalKey(t *testing.T) {
+	tests := []struct {
+		qname string
+		want  string
+	}{
+		{"default", "asynq:{default}:unhandled_total"},
+		{"custom", "asynq:{custom}:unhandled_total"},
+	}
+
+	for _, tc := range tests {
+		got := UnhandledTotalKey(tc.qname)
+		if got != tc.want {
+			t.Errorf("UnhandledTotalKey(%q) = %q, want %q", tc.qname, got, tc.want)
+		}
+	}
+}
+
+func TestEventsChannel(t *testing.T) {
+	tests := []struct {
+		qname string
+		want  string
+	}{
+		{"default", "asynq:events:default"},
+		{"custom", "asynq:events:custom"},
+	}
+
+	for _, tc := range tests {
+		got := EventsChannel(tc.qname)
+		if got != tc.want {
+			t.Errorf("EventsChannel(%q) = %q, want %q", tc.qname, got, tc.want)
+		}
+	}
+}
+
+func TestQuarantineKey(t *testing.T) {
+	tests := []struct {
+		qname string
+		want  string
+	}{
+		{"default", "asynq:{default}:quarantine"},
+		{"custom", "asynq:{custom}:quarantine"},
+	}
+
+	for _, tc := range tests {
+		got := QuarantineKey(tc.qname)
+		if got != tc.want {
+			t.Errorf("QuarantineKey(%q) = %q, want %q", tc.qname, got, tc.want)
+		}
+	}
+}
+
+func TestDependentsKey(t *testing.T) {
+	tests := []struct {
+		qname string
+		id    string
+		want  string
+	}{
+		{"default", "abc", "asynq:{default}:dependents:abc"},
+		{"custom", "xyz", "asynq:{custom}:dependents:xyz"},
+	}
+
+	for _, tc := range tests {
+		got := DependentsKey(tc.qname, tc.id)
+		if got != tc.want {
+			t.Errorf("DependentsKey(%q, %q) = %q, want %q", tc.qname, tc.id, got, tc.want)
+		}
+	}
+}
+
+func TestAuditKey(t *testing.T) {
+	tests := []struct {
+		qname string
+		want  string
+	}{
+		{"default", "asynq:{default}:audit"},
+		{"custom", "asynq:{custom}:audit"},
+	}
+
+	for _, tc := range tests {
+		got := AuditKey(tc.qname)
+		if got != tc.want {
+			t.Errorf("AuditKey(%q) = %q, want %q", tc.qname, got, tc.want)
+		}
+	}
+}
+
+func TestStartedKey(t *testing.T) {
+	tests := []struct {
+		qname string
+		id    string
+		want  string
+	}{
+		{"default", "abc", "asynq:{default}:started:abc"},
+		{"custom", "xyz", "asynq:{custom}:started:xyz"},
+	}
+
+	for _, tc := range tests {
+		got := StartedKey(tc.qname, tc.id)
+		if got != tc.want {
+			t.Errorf("StartedKey(%q, %q) = %q, want %q", tc.qname, tc.id, got, tc.want)
+		}
+	}
+}
+
 func TestPausedKey(t *testing.T) {
 	tests := []struct {
 		qname string
@@ -173,6 +315,23 @@ func TestPausedKey(t *testing.T) {
 	}
 }
 
+func TestDrainingKey(t *testing.T) {
+	tests := []struct {
+		qname string
+		want  string
+	}{
+		{"default", "asynq:{default}:draining"},
+		{"custom", "asynq:{custom}:draining"},
+	}
+
+	for _, tc := range tests {
+		got := DrainingKey(tc.qname)
+		if got != tc.want {
+			t.Errorf("DrainingKey(%q) = %q, want %q", tc.qname, got, tc.want)
+		}
+	}
+}
+
 func TestProcessedTotalKey(t *testing.T) {
 	tests := []struct {
 		qname string
@@ -424,6 +583,150 @@ func TestMessageEncoding(t *testing.T) {
 				Retention: 3600,
 			},
 		},
+		{
+			in: &TaskMessage{
+				Type:         "task2",
+				ID:           id,
+				Queue:        "default",
+				Timeout:      1800,
+				Dependencies: []string{"abc", "xyz"},
+			},
+			out: &TaskMessage{
+				Type:         "task2",
+				ID:           id,
+				Queue:        "default",
+				Timeout:      1800,
+				Dependencies: []string{"abc", "xyz"},
+			},
+		},
+		{
+			in: &TaskMessage{
+				Type:    "task3",
+				ID:      id,
+				Queue:   "default",
+				Timeout: 1800,
+				Headers: map[string]string{"trace_id": "abc", "tenant": "acme"},
+			},
+			out: &TaskMessage{
+				Type:    "task3",
+				ID:      id,
+				Queue:   "default",
+				Timeout: 1800,
+				Headers: map[string]string{"trace_id": "abc", "tenant": "acme"},
+			},
+		},
+		{
+			in: &TaskMessage{
+				Type:      "task4",
+				ID:        id,
+				Queue:     "default",
+				Timeout:   1800,
+				ExpiresAt: 1700000000,
+			},
+			out: &TaskMessage{
+				Type:      "task4",
+				ID:        id,
+				Queue:     "default",
+				Timeout:   1800,
+				ExpiresAt: 1700000000,
+			},
+		},
+		{
+			in: &TaskMessage{
+				Type:       "task5",
+				ID:         id,
+				Queue:      "default",
+				Timeout:    1800,
+				AtMostOnce: true,
+			},
+			out: &TaskMessage{
+				Type:       "task5",
+				ID:         id,
+				Queue:      "default",
+				Timeout:    1800,
+				AtMostOnce: true,
+			},
+		},
+		{
+			in: &TaskMessage{
+				Type:          "task6",
+				ID:            id,
+				Queue:         "default",
+				ErrorMsg:      "oops again",
+				ArchiveReason: ArchiveReasonMaxRetry,
+				ErrorHistory:  []string{"oops", "oops again"},
+			},
+			out: &TaskMessage{
+				Type:          "task6",
+				ID:            id,
+				Queue:         "default",
+				ErrorMsg:      "oops again",
+				ArchiveReason: ArchiveReasonMaxRetry,
+				ErrorHistory:  []string{"oops", "oops again"},
+			},
+		},
+		{
+			in: &TaskMessage{
+				Type:          "task7",
+				Payload:       []byte("trunc"),
+				ID:            id,
+				Queue:         "default",
+				PayloadSize:   1024,
+				PayloadDigest: "5f70bf18a086007016e948b04aed3b82103a36bea41755b6cddfaf10ace3c6ef",
+			},
+			out: &TaskMessage{
+				Type:          "task7",
+				Payload:       []byte("trunc"),
+				ID:            id,
+				Queue:         "default",
+				PayloadSize:   1024,
+				PayloadDigest: "5f70bf18a086007016e948b04aed3b82103a36bea41755b6cddfaf10ace3c6ef",
+			},
+		},
+		{
+			in: &TaskMessage{
+				Type:       "task8",
+				ID:         id,
+				Queue:      "default",
+				PayloadRef: "default/" + id,
+			},
+			out: &TaskMessage{
+				Type:       "task8",
+				ID:         id,
+				Queue:      "default",
+				PayloadRef: "default/" + id,
+			},
+		},
+		{
+			in: &TaskMessage{
+				Type:       "task9",
+				ID:         id,
+				Queue:      "default",
+				EnqueuedAt: 1700000000123456789,
+			},
+			out: &TaskMessage{
+				Type:       "task9",
+				ID:         id,
+				Queue:      "default",
+				EnqueuedAt: 1700000000123456789,
+			},
+		},
+		{
+			in: &TaskMessage{
+				Type:         "task10",
+				ID:           id,
+				Queue:        "default",
+				Retry:        25,
+				DefaultRetry: true,
+			},
+			out: &TaskMessage{
+				Type:         "task10",
+				ID:           id,
+				Queue:        "default",
+				Retry:        25,
+				DefaultRetry: true,
+			},
+		},
 	}
 
 	for _, tc := range tests {
@@ -444,6 +747,263 @@ func TestMessageEncoding(t *testing.T) {
 	}
 }
 
+func TestLatencyBucket(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want int
+	}{
+		{0, 0},
+		{LatencyBuckets[0], 0},
+		{LatencyBuckets[0] + 1, 1},
+		{time.Second, 7},
+		{LatencyBuckets[len(LatencyBuckets)-1], len(LatencyBuckets) - 1},
+		{LatencyBuckets[len(LatencyBuckets)-1] + 1, len(LatencyBuckets)},
+	}
+	for _, tc := range tests {
+		if got := LatencyBucket(tc.d); got != tc.want {
+			t.Errorf("LatencyBucket(%v) = %d, want %d", tc.d, got, tc.want)
+		}
+	}
+}
+
+func TestEncodeArchiveReason(t *testing.T) {
+	msg := &TaskMessage{
+		Type:          "task1",
+		ID:            uuid.NewString(),
+		Queue:         "default",
+		ArchiveReason: ArchiveReasonSkipRetry,
+		ErrorHistory:  []string{"oops"},
+	}
+	encoded, err := EncodeMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reason, err := EncodeArchiveReason(ArchiveReasonOperator)
+	if err != nil {
+		t.Fatalf("EncodeArchiveReason returned error: %v", err)
+	}
+	decoded, err := DecodeMessage(append(encoded, reason...))
+	if err != nil {
+		t.Fatalf("DecodeMessage returned error: %v", err)
+	}
+	want := *msg
+	want.ArchiveReason = ArchiveReasonOperator
+	if diff := cmp.Diff(&want, decoded); diff != "" {
+		t.Errorf("Decoded message with appended archive reason == %+v, want %+v;(-want,+got)\n%s",
+			decoded, &want, diff)
+	}
+
+	// Appending the encoding of the empty reason clears the reason.
+	clear, err := EncodeArchiveReason("")
+	if err != nil {
+		t.Fatalf("EncodeArchiveReason returned error: %v", err)
+	}
+	decoded, err = DecodeMessage(append(append(encoded, reason...), clear...))
+	if err != nil {
+		t.Fatalf("DecodeMessage returned error: %v", err)
+	}
+	want.ArchiveReason = ""
+	if diff := cmp.Diff(&want, decoded); diff != "" {
+		t.Errorf("Decoded message with appended empty archive reason == %+v, want %+v;(-want,+got)\n%s",
+			decoded, &want, diff)
+	}
+}
+
+func TestMessageSchemaCompatibility(t *testing.T) {
+	id := uuid.NewString()
+
+	// A message encoded before the schema was versioned, with no queue.
+	old, err := proto.Marshal(&pb.TaskMessage{Type: "task1", Id: id, Retry: 25})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeMessage(old)
+	if err != nil {
+		t.Fatalf("DecodeMessage returned error: %v", err)
+	}
+	want := &TaskMessage{Type: "task1", ID: id, Queue: DefaultQueueName, Retry: 25}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Decoded message with no schema version mismatch (-want,+got)\n%s", diff)
+	}
+
+	// A message encoded with a newer version of the schema, with a field added by the version.
+	newer, err := proto.Marshal(&pb.TaskMessage{Type: "task1", Id: id, Queue: "critical", SchemaVersion: TaskMessageSchemaVersion + 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newField := protowire.AppendTag(nil, 1000, protowire.BytesType)
+	newField = protowire.AppendString(newField, "added by a newer version")
+	got, err = DecodeMessage(append(newer, newField...))
+	if err != nil {
+		t.Fatalf("DecodeMessage returned error: %v", err)
+	}
+	want = &TaskMessage{
+		Type:          "task1",
+		ID:            id,
+		Queue:         "critical",
+		SchemaVersion: TaskMessageSchemaVersion + 1,
+		UnknownFields: newField,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Decoded message with newer schema version mismatch (-want,+got)\n%s", diff)
+	}
+
+	// The newer fields are kept when the message is updated and encoded again.
+	got.Retried++
+	encoded, err := EncodeMessage(got)
+	if err != nil {
+		t.Fatalf("EncodeMessage returned error: %v", err)
+	}
+	var pbmsg pb.TaskMessage
+	if err := proto.Unmarshal(encoded, &pbmsg); err != nil {
+		t.Fatal(err)
+	}
+	if v := pbmsg.GetSchemaVersion(); v != TaskMessageSchemaVersion+1 {
+		t.Errorf("Encoded message has schema version %d, want %d", v, TaskMessageSchemaVersion+1)
+	}
+	if diff := cmp.Diff(newField, []byte(pbmsg.ProtoReflect().GetUnknown())); diff != "" {
+		t.Errorf("Unknown fields of encoded message mismatch (-want,+got)\n%s", diff)
+	}
+
+	// Messages are encoded with the current version of the schema.
+	encoded, err = EncodeMessage(&TaskMessage{Type: "task1", ID: id, Queue: "default"})
+	if err != nil {
+		t.Fatalf("EncodeMessage returned error: %v", err)
+	}
+	if err := proto.Unmarshal(encoded, &pbmsg); err != nil {
+		t.Fatal(err)
+	}
+	if v := pbmsg.GetSchemaVersion(); v != TaskMessageSchemaVersion {
+		t.Errorf("Encoded message has schema version %d, want %d", v, TaskMessageSchemaVersion)
+	}
+}
+
+func TestAppendErrorHistory(t *testing.T) {
+	var full []string
+	for i := 0; i < MaxErrorHistory; i++ {
+		full = append(full, strconv.Itoa(i))
+	}
+	tests := []struct {
+		history []string
+		errMsg  string
+		want    []string
+	}{
+		{nil, "oops", []string{"oops"}},
+		{[]string{"a"}, "b", []string{"a", "b"}},
+		{full, "last", append(append([]string{}, full[1:]...), "last")},
+	}
+	for _, tc := range tests {
+		got := AppendErrorHistory(tc.history, tc.errMsg)
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("AppendErrorHistory(%v, %q) = %v, want %v;(-want,+got)\n%s",
+				tc.history, tc.errMsg, got, tc.want, diff)
+		}
+	}
+	// Must not modify the backing array of the given history.
+	history := make([]string, 1, 2)
+	history[0] = "a"
+	_ = AppendErrorHistory(history, "b")
+	if got := history[:2][1]; got != "" {
+		t.Errorf("AppendErrorHistory modified the given history: got %q appended to it", got)
+	}
+}
+
+func TestSignMessage(t *testing.T) {
+	key := []byte("secret")
+	newMsg := func() *TaskMessage {
+		return &TaskMessage{
+			ID:      "abc123",
+			Type:    "email:send",
+			Payload: []byte(`{"to":"user@example.com"}`),
+			Queue:   "default",
+			Retry:   25,
+			Timeout: 1800,
+			Headers: map[string]string{"tenant": "acme", "trace": "xyz"},
+
+			EnqueuedAt: 1700000000000000000,
+		}
+	}
+	msg := newMsg()
+	SignMessage(msg, key)
+	if !VerifyMessage(msg, key) {
+		t.Fatalf("VerifyMessage returned false for a signed message")
+	}
+
+	// The signature survives an encoding round trip and updates by the server.
+	encoded, err := EncodeMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeMessage(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded.Retried++
+	decoded.ErrorMsg = "oops"
+	decoded.ErrorHistory = []string{"oops"}
+	if !VerifyMessage(decoded, key) {
+		t.Errorf("VerifyMessage returned false for a signed message after a retry")
+	}
+
+	tests := []struct {
+		desc   string
+		tamper func(msg *TaskMessage)
+	}{
+		{"payload", func(msg *TaskMessage) { msg.Payload = []byte(`{"to":"attacker@example.com"}`) }},
+		{"type", func(msg *TaskMessage) { msg.Type = "email:delete" }},
+		{"retry", func(msg *TaskMessage) { msg.Retry = 1000 }},
+		{"header", func(msg *TaskMessage) { msg.Headers["tenant"] = "other" }},
+		{"labels", func(msg *TaskMessage) { msg.Labels = map[string]string{"gpu": "true"} }},
+		{"default retry", func(msg *TaskMessage) { msg.DefaultRetry = true }},
+		{"enqueued at", func(msg *TaskMessage) { msg.EnqueuedAt++ }},
+		// Moving a header to the labels must change the signature.
+		{"header moved to labels", func(msg *TaskMessage) {
+			delete(msg.Headers, "trace")
+			msg.Labels = map[string]string{"trace": "xyz"}
+		}},
+		// Moving bytes between adjacent fields must change the signature.
+		{"boundary", func(msg *TaskMessage) {
+			msg.ID = "abc123e"
+			msg.Type = "mail:send"
+		}},
+		{"signature removed", func(msg *TaskMessage) { msg.Signature = nil }},
+	}
+	for _, tc := range tests {
+		msg := newMsg()
+		SignMessage(msg, key)
+		tc.tamper(msg)
+		if VerifyMessage(msg, key) {
+			t.Errorf("VerifyMessage returned true for a message with tampered %s", tc.desc)
+		}
+	}
+	if VerifyMessage(msg, []byte("another secret")) {
+		t.Errorf("VerifyMessage returned true for a different key")
+	}
+}
+
+func TestIncompatibilities(t *testing.T) {
+	info := &ServerInfo{ServerID: "self", Queues: map[string]int{"default": 1}, Version: "0.19.1", Features: []string{FeatureSigning}, Status: "active"}
+	others := []*ServerInfo{
+		info,
+		{ServerID: "patch", Host: "h", PID: 1, Queues: map[string]int{"default": 1}, Version: "0.19.0", Features: []string{FeatureSigning}, Status: "active"},
+		{ServerID: "minor", Host: "h", PID: 2, Queues: map[string]int{"low": 1}, Version: "0.18.6", Status: "active"},
+		{ServerID: "unknown", Host: "h", PID: 3, Queues: map[string]int{"low": 1}, Status: "active"},
+		{ServerID: "unsigned", Host: "h", PID: 4, Queues: map[string]int{"default": 1}, Version: "0.19.1", Features: []string{FeaturePayloadStore}, Status: "stopped"},
+		// Servers which shut down and servers of other environments are not compared.
+		{ServerID: "closed", Host: "h", PID: 5, Queues: map[string]int{"default": 1}, Version: "0.18.6", Status: "closed"},
+		{ServerID: "staging", Host: "h", PID: 6, Queues: map[string]int{"default": 1}, Version: "0.18.6", Status: "active", Environment: "staging"},
+	}
+	want := []string{
+		"server minor on h:2 runs asynq v0.18.6, this server runs v0.19.1",
+		"server unknown on h:3 runs an older asynq version which does not report it, this server runs v0.19.1",
+		`server unsigned on h:4 processes queues of this server without feature "signing"`,
+		`server unsigned on h:4 processes queues of this server with feature "payload_store", which this server does not have`,
+	}
+	if diff := cmp.Diff(want, Incompatibilities(info, others)); diff != "" {
+		t.Errorf("Incompatibilities mismatch (-want,+got):\n%s", diff)
+	}
+}
+
 func TestServerInfoEncoding(t *testing.T) {
 	tests := []struct {
 		info ServerInfo
@@ -459,6 +1019,22 @@ func TestServerInfoEncoding(t *testing.T) {
 				Status:            "active",
 				Started:           time.Now().Add(-3 * time.Hour),
 				ActiveWorkerCount: 8,
+				Environment:       "staging",
+				Version:           "0.19.1",
+				Features:          []string{FeaturePayloadStore, FeatureSigning},
+			},
+		},
+		{
+			info: ServerInfo{
+				Host:             "127.0.0.1",
+				PID:              9876,
+				ServerID:         "abc123",
+				Concurrency:      10,
+				Queues:           map[string]int{"default": 1},
+				Status:           "closed",
+				Started:          time.Now().Add(-3 * time.Hour),
+				ShutdownFinished: 7,
+				ShutdownRequeued: 2,
 			},
 		},
 	}
@@ -609,6 +1185,32 @@ func TestStatusConcurrentAccess(t *testing.T) {
 
 // Test for cancelations being accessed by multiple goroutines.
 // Run with -race flag to check for data race.
+func TestCancelationsAbort(t *testing.T) {
+	c := NewCancelations()
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Add("key1", cancel)
+
+	if c.Abort("key2") {
+		t.Errorf("(*Cancelations).Abort(%q) = true, want false", "key2")
+	}
+	if c.Aborted("key1") {
+		t.Errorf("(*Cancelations).Aborted(%q) = true before Abort, want false", "key1")
+	}
+	if !c.Abort("key1") {
+		t.Errorf("(*Cancelations).Abort(%q) = false, want true", "key1")
+	}
+	if ctx.Err() == nil {
+		t.Errorf("context of %q not canceled after Abort", "key1")
+	}
+	if !c.Aborted("key1") {
+		t.Errorf("(*Cancelations).Aborted(%q) = false after Abort, want true", "key1")
+	}
+	c.Delete("key1")
+	if c.Aborted("key1") {
+		t.Errorf("(*Cancelations).Aborted(%q) = true after Delete, want false", "key1")
+	}
+}
+
 func TestCancelationsConcurrentAccess(t *testing.T) {
 	c := NewCancelations()
 
@@ -651,3 +1253,40 @@ func TestCancelationsConcurrentAccess(t *testing.T) {
 		t.Errorf("(*Cancelations).Get(%q) = _, true, want <nil>, false", key2)
 	}
 }
+
+func TestValidateMessage(t *testing.T) {
+	valid := func() *TaskMessage {
+		return &TaskMessage{
+			Type:    "email:send",
+			Payload: []byte(`{"to":"user@example.com"}`),
+			ID:      uuid.NewString(),
+			Queue:   "default",
+			Retry:   25,
+			Timeout: 1800,
+		}
+	}
+	tests := []struct {
+		desc   string
+		modify func(msg *TaskMessage)
+		want   int // number of problems
+	}{
+		{"valid message", func(msg *TaskMessage) {}, 0},
+		{"deadline only", func(msg *TaskMessage) { msg.Timeout, msg.Deadline = 0, time.Now().Unix() }, 0},
+		{"unique", func(msg *TaskMessage) { msg.UniqueKey = UniqueKey(msg.Queue, msg.Type, msg.Payload) }, 0},
+		{"blank type", func(msg *TaskMessage) { msg.Type = " " }, 1},
+		{"no id", func(msg *TaskMessage) { msg.ID = "" }, 1},
+		{"negative retry", func(msg *TaskMessage) { msg.Retry = -1 }, 1},
+		{"no timeout nor deadline", func(msg *TaskMessage) { msg.Timeout = 0 }, 1},
+		{"unique key of another queue", func(msg *TaskMessage) { msg.UniqueKey = UniqueKey("other", msg.Type, msg.Payload) }, 1},
+		{"dependencies and group", func(msg *TaskMessage) { msg.Dependencies, msg.GroupKey = []string{"a"}, "g" }, 1},
+		{"payload and payload ref", func(msg *TaskMessage) { msg.PayloadRef = "s3://payloads/1" }, 1},
+		{"several problems", func(msg *TaskMessage) { msg.Type, msg.ID, msg.Timeout = "", "", -1 }, 4},
+	}
+	for _, tc := range tests {
+		msg := valid()
+		tc.modify(msg)
+		if got := ValidateMessage(msg); len(got) != tc.want {
+			t.Errorf("%s: ValidateMessage returned %q, want %d problems", tc.desc, got, tc.want)
+		}
+	}
+}
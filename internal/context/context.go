@@ -17,6 +17,9 @@ type taskMetadata struct {
 	maxRetry   int
 	retryCount int
 	qname      string
+	headers    map[string]string
+	checkpoint []byte
+	depResults map[string][]byte
 }
 
 // ctxKey type is unexported to prevent collisions with context keys defined in
@@ -27,15 +30,28 @@ type ctxKey int
 // Its value of zero is arbitrary.
 const metadataCtxKey ctxKey = 0
 
+// shutdownCtxKey is the context key for the shutdown signal channel.
+const shutdownCtxKey ctxKey = 1
+
+// checkpointerCtxKey is the context key for the function saving the task checkpoint.
+const checkpointerCtxKey ctxKey = 2
+
+// progressWriterCtxKey is the context key for the function saving the task progress.
+const progressWriterCtxKey ctxKey = 3
+
 // New returns a context and cancel function for a given task message.
-func New(msg *base.TaskMessage, deadline time.Time) (context.Context, context.CancelFunc) {
+// The returned context is derived from the given parent context.
+func New(parent context.Context, msg *base.TaskMessage, deadline time.Time) (context.Context, context.CancelFunc) {
 	metadata := taskMetadata{
 		id:         msg.ID,
 		maxRetry:   msg.Retry,
 		retryCount: msg.Retried,
 		qname:      msg.Queue,
+		headers:    msg.Headers,
+		checkpoint: msg.Checkpoint,
+		depResults: msg.DependencyResults,
 	}
-	ctx := context.WithValue(context.Background(), metadataCtxKey, metadata)
+	ctx := context.WithValue(parent, metadataCtxKey, metadata)
 	return context.WithDeadline(ctx, deadline)
 }
 
@@ -85,3 +101,72 @@ func GetQueueName(ctx context.Context) (qname string, ok bool) {
 	}
 	return metadata.qname, true
 }
+
+// GetHeaders extracts the task headers from a context, if any.
+//
+// Return value headers is nil if the task doesn't have any header.
+func GetHeaders(ctx context.Context) (headers map[string]string, ok bool) {
+	metadata, ok := ctx.Value(metadataCtxKey).(taskMetadata)
+	if !ok {
+		return nil, false
+	}
+	return metadata.headers, true
+}
+
+// GetCheckpoint extracts the checkpoint of the task from a context, if any.
+//
+// Return value ok is false if the task has no checkpoint.
+func GetCheckpoint(ctx context.Context) (data []byte, ok bool) {
+	metadata, ok := ctx.Value(metadataCtxKey).(taskMetadata)
+	if !ok || metadata.checkpoint == nil {
+		return nil, false
+	}
+	return metadata.checkpoint, true
+}
+
+// GetDependencyResults extracts the results of the dependencies of the task from a context, if any.
+//
+// Return value ok is false if none of the dependencies of the task wrote a result.
+func GetDependencyResults(ctx context.Context) (results map[string][]byte, ok bool) {
+	metadata, ok := ctx.Value(metadataCtxKey).(taskMetadata)
+	if !ok || len(metadata.depResults) == 0 {
+		return nil, false
+	}
+	return metadata.depResults, true
+}
+
+// WithCheckpointer returns a copy of ctx which carries the given function
+// saving the checkpoint of the task.
+func WithCheckpointer(ctx context.Context, fn func(data []byte) error) context.Context {
+	return context.WithValue(ctx, checkpointerCtxKey, fn)
+}
+
+// GetCheckpointer extracts the function saving the checkpoint of the task from a context, if any.
+func GetCheckpointer(ctx context.Context) (fn func(data []byte) error, ok bool) {
+	fn, ok = ctx.Value(checkpointerCtxKey).(func(data []byte) error)
+	return fn, ok
+}
+
+// WithProgressWriter returns a copy of ctx which carries the given function
+// saving the progress of the task.
+func WithProgressWriter(ctx context.Context, fn func(data []byte) error) context.Context {
+	return context.WithValue(ctx, progressWriterCtxKey, fn)
+}
+
+// GetProgressWriter extracts the function saving the progress of the task from a context, if any.
+func GetProgressWriter(ctx context.Context) (fn func(data []byte) error, ok bool) {
+	fn, ok = ctx.Value(progressWriterCtxKey).(func(data []byte) error)
+	return fn, ok
+}
+
+// WithShutdownSignal returns a copy of ctx which carries the given channel
+// closed when the server starts shutting down.
+func WithShutdownSignal(ctx context.Context, ch <-chan struct{}) context.Context {
+	return context.WithValue(ctx, shutdownCtxKey, ch)
+}
+
+// GetShutdownSignal extracts the shutdown signal channel from a context, if any.
+func GetShutdownSignal(ctx context.Context) (ch <-chan struct{}, ok bool) {
+	ch, ok = ctx.Value(shutdownCtxKey).(<-chan struct{})
+	return ch, ok
+}
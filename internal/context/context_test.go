@@ -28,7 +28,7 @@ func TestCreateContextWithFutureDeadline(t *testing.T) {
 			Payload: nil,
 		}
 
-		ctx, cancel := New(msg, tc.deadline)
+		ctx, cancel := New(context.Background(), msg, tc.deadline)
 		select {
 		case x := <-ctx.Done():
 			t.Errorf("<-ctx.Done() == %v, want nothing (it should block)", x)
@@ -67,7 +67,7 @@ func TestCreateContextWithPastDeadline(t *testing.T) {
 			Payload: nil,
 		}
 
-		ctx, cancel := New(msg, tc.deadline)
+		ctx, cancel := New(context.Background(), msg, tc.deadline)
 		defer cancel()
 
 		select {
@@ -94,10 +94,11 @@ func TestGetTaskMetadataFromContext(t *testing.T) {
 		{"with zero retried message", &base.TaskMessage{Type: "something", ID: uuid.NewString(), Retry: 25, Retried: 0, Timeout: 1800, Queue: "default"}},
 		{"with non-zero retried message", &base.TaskMessage{Type: "something", ID: uuid.NewString(), Retry: 10, Retried: 5, Timeout: 1800, Queue: "default"}},
 		{"with custom queue name", &base.TaskMessage{Type: "something", ID: uuid.NewString(), Retry: 25, Retried: 0, Timeout: 1800, Queue: "custom"}},
+		{"with headers", &base.TaskMessage{Type: "something", ID: uuid.NewString(), Retry: 25, Retried: 0, Timeout: 1800, Queue: "default", Headers: map[string]string{"trace_id": "abc"}}},
 	}
 
 	for _, tc := range tests {
-		ctx, cancel := New(tc.msg, time.Now().Add(30*time.Minute))
+		ctx, cancel := New(context.Background(), tc.msg, time.Now().Add(30*time.Minute))
 		defer cancel()
 
 		id, ok := GetTaskID(ctx)
@@ -131,6 +132,14 @@ func TestGetTaskMetadataFromContext(t *testing.T) {
 		if ok && qname != tc.msg.Queue {
 			t.Errorf("%s: GetQueueName(ctx) returned qname == %q, want %q", tc.desc, qname, tc.msg.Queue)
 		}
+
+		headers, ok := GetHeaders(ctx)
+		if !ok {
+			t.Errorf("%s: GetHeaders(ctx) returned ok == false", tc.desc)
+		}
+		if diff := cmp.Diff(tc.msg.Headers, headers); ok && diff != "" {
+			t.Errorf("%s: GetHeaders(ctx) returned %v, want %v", tc.desc, headers, tc.msg.Headers)
+		}
 	}
 }
 
@@ -155,5 +164,121 @@ func TestGetTaskMetadataFromContextError(t *testing.T) {
 		if _, ok := GetQueueName(tc.ctx); ok {
 			t.Errorf("%s: GetQueueName(ctx) returned ok == true", tc.desc)
 		}
+		if _, ok := GetHeaders(tc.ctx); ok {
+			t.Errorf("%s: GetHeaders(ctx) returned ok == true", tc.desc)
+		}
+		if _, ok := GetCheckpoint(tc.ctx); ok {
+			t.Errorf("%s: GetCheckpoint(ctx) returned ok == true", tc.desc)
+		}
+	}
+}
+
+func TestGetShutdownSignal(t *testing.T) {
+	if _, ok := GetShutdownSignal(context.Background()); ok {
+		t.Errorf("GetShutdownSignal(ctx) returned ok == true for background context")
+	}
+
+	ch := make(chan struct{})
+	ctx := WithShutdownSignal(context.Background(), ch)
+	got, ok := GetShutdownSignal(ctx)
+	if !ok {
+		t.Fatalf("GetShutdownSignal(ctx) returned ok == false")
+	}
+	select {
+	case <-got:
+		t.Fatal("shutdown signal channel is closed before the shutdown")
+	default:
+	}
+	close(ch)
+	select {
+	case <-got:
+	default:
+		t.Error("shutdown signal channel is not closed after the shutdown")
+	}
+}
+
+func TestGetCheckpoint(t *testing.T) {
+	deadline := time.Now().Add(time.Minute)
+	msg := &base.TaskMessage{Type: "import", ID: uuid.NewString(), Queue: "default"}
+	ctx, cancel := New(context.Background(), msg, deadline)
+	defer cancel()
+	if _, ok := GetCheckpoint(ctx); ok {
+		t.Errorf("GetCheckpoint(ctx) returned ok == true for task without checkpoint")
+	}
+
+	msg.Checkpoint = []byte("offset=42")
+	ctx, cancel = New(context.Background(), msg, deadline)
+	defer cancel()
+	got, ok := GetCheckpoint(ctx)
+	if !ok {
+		t.Fatalf("GetCheckpoint(ctx) returned ok == false")
+	}
+	if string(got) != "offset=42" {
+		t.Errorf("GetCheckpoint(ctx) = %q, want %q", got, "offset=42")
+	}
+}
+
+func TestGetDependencyResults(t *testing.T) {
+	deadline := time.Now().Add(time.Minute)
+	msg := &base.TaskMessage{Type: "report", ID: uuid.NewString(), Queue: "default", Dependencies: []string{"a", "b"}}
+	ctx, cancel := New(context.Background(), msg, deadline)
+	defer cancel()
+	if _, ok := GetDependencyResults(ctx); ok {
+		t.Errorf("GetDependencyResults(ctx) returned ok == true for task without dependency results")
+	}
+
+	msg.DependencyResults = map[string][]byte{"a": []byte("rows=42")}
+	ctx, cancel = New(context.Background(), msg, deadline)
+	defer cancel()
+	got, ok := GetDependencyResults(ctx)
+	if !ok {
+		t.Fatalf("GetDependencyResults(ctx) returned ok == false")
+	}
+	if diff := cmp.Diff(msg.DependencyResults, got); diff != "" {
+		t.Errorf("GetDependencyResults(ctx) mismatch (-want,+got):\n%s", diff)
+	}
+}
+
+func TestGetCheckpointer(t *testing.T) {
+	if _, ok := GetCheckpointer(context.Background()); ok {
+		t.Errorf("GetCheckpointer(ctx) returned ok == true for background context")
+	}
+
+	var saved []byte
+	ctx := WithCheckpointer(context.Background(), func(data []byte) error {
+		saved = data
+		return nil
+	})
+	fn, ok := GetCheckpointer(ctx)
+	if !ok {
+		t.Fatalf("GetCheckpointer(ctx) returned ok == false")
+	}
+	if err := fn([]byte("offset=7")); err != nil {
+		t.Fatalf("checkpointer returned error: %v", err)
+	}
+	if string(saved) != "offset=7" {
+		t.Errorf("checkpointer saved %q, want %q", saved, "offset=7")
+	}
+}
+
+func TestGetProgressWriter(t *testing.T) {
+	if _, ok := GetProgressWriter(context.Background()); ok {
+		t.Errorf("GetProgressWriter(ctx) returned ok == true for background context")
+	}
+
+	var saved []byte
+	ctx := WithProgressWriter(context.Background(), func(data []byte) error {
+		saved = data
+		return nil
+	})
+	fn, ok := GetProgressWriter(ctx)
+	if !ok {
+		t.Fatalf("GetProgressWriter(ctx) returned ok == false")
+	}
+	if err := fn([]byte("42")); err != nil {
+		t.Fatalf("progress writer returned error: %v", err)
+	}
+	if string(saved) != "42" {
+		t.Errorf("progress writer saved %q, want %q", saved, "42")
 	}
 }
@@ -12,7 +12,9 @@ package errors
 import (
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"runtime"
 	"strings"
 )
@@ -173,6 +175,9 @@ var (
 
 	// ErrTaskIdConflict indicates that another task with the same task ID already exist
 	ErrTaskIdConflict = errors.New("task id conflicts with another task")
+
+	// ErrQueueDraining indicates that the queue is draining and does not accept new tasks.
+	ErrQueueDraining = errors.New("queue is draining")
 )
 
 // TaskNotFoundError indicates that a task with the given ID does not exist
@@ -256,6 +261,34 @@ func IsRedisCommandError(err error) bool {
 	return As(err, &target)
 }
 
+// transientRedisErrorPrefixes lists prefixes of redis error replies which
+// indicate a temporary condition of the server (e.g. loading data, failover).
+var transientRedisErrorPrefixes = []string{"LOADING ", "READONLY ", "CLUSTERDOWN ", "TRYAGAIN ", "MASTERDOWN "}
+
+// IsTransient reports whether err is likely caused by a temporary failure in
+// communicating with redis (e.g. network error, failover in progress), so that
+// retrying the operation may succeed.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	var netErr net.Error
+	if As(err, &netErr) || Is(err, io.EOF) || Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var cmdErr *RedisCommandError
+	if !As(err, &cmdErr) || cmdErr.Err == nil {
+		return false
+	}
+	msg := cmdErr.Err.Error()
+	for _, prefix := range transientRedisErrorPrefixes {
+		if strings.HasPrefix(msg, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 /*************************************************
     Standard Library errors package functions
 *************************************************/
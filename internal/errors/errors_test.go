@@ -4,7 +4,10 @@
 
 package errors
 
-import "testing"
+import (
+	"net"
+	"testing"
+)
 
 func TestErrorDebugString(t *testing.T) {
 	// DebugString should include Op since its meant to be used by
@@ -131,6 +134,30 @@ func TestErrorPredicates(t *testing.T) {
 			err:  E(Op("rdb.ArchiveTask"), NotFound, &QueueNotFoundError{Queue: "default"}),
 			want: true,
 		},
+		{
+			desc: "IsTransient should detect network errors in err's chain",
+			fn:   IsTransient,
+			err:  E(Op("rdb.Enqueue"), Unknown, &RedisCommandError{Command: "eval", Err: &net.OpError{Op: "dial", Err: New("connection refused")}}),
+			want: true,
+		},
+		{
+			desc: "IsTransient should detect LOADING reply from redis",
+			fn:   IsTransient,
+			err:  E(Op("rdb.Enqueue"), Unknown, &RedisCommandError{Command: "eval", Err: New("LOADING Redis is loading the dataset in memory")}),
+			want: true,
+		},
+		{
+			desc: "IsTransient should not detect other redis errors",
+			fn:   IsTransient,
+			err:  E(Op("rdb.Enqueue"), Unknown, &RedisCommandError{Command: "eval", Err: New("ERR unknown command")}),
+			want: false,
+		},
+		{
+			desc: "IsTransient should not detect domain errors",
+			fn:   IsTransient,
+			err:  E(Op("rdb.Enqueue"), AlreadyExists, ErrTaskIdConflict),
+			want: false,
+		},
 	}
 
 	for _, tc := range tests {
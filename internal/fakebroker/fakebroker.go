@@ -0,0 +1,730 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+// Package fakebroker exports an in-memory broker implementation whose notion
+// of time is given by a timeutil.Clock, for deterministic simulation tests.
+package fakebroker
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/errors"
+	"github.com/hibiken/asynq/internal/timeutil"
+)
+
+// Broker is an in-memory broker for tests.
+//
+// All time-dependent behavior (scheduling, retry, deadlines, uniqueness locks
+// and retention) is computed from the clock given to New, so that tests can
+// control it with a timeutil.SimulatedClock.
+//
+// Broker doesn't support task groups, task dependencies or pubsub; the
+// *PubSub methods return an error.
+type Broker struct {
+	mu     sync.Mutex
+	clock  timeutil.Clock
+	queues map[string]*queue
+	// uniqueKeys maps a uniqueness lock to the ID of the task holding it and its expiration time.
+	uniqueKeys map[string]lock
+	// started maps the ID of an at-most-once task to the expiration time of its marker.
+	started map[string]time.Time
+	// environment the broker is labeled with, empty if unlabeled.
+	environment string
+	// results maps a result cache key to the cached result.
+	results map[string]cachedResult
+}
+
+type cachedResult struct {
+	data     []byte
+	expireAt time.Time
+}
+
+type lock struct {
+	id       string
+	expireAt time.Time
+}
+
+type queue struct {
+	tasks   map[string]*task
+	pending []string // IDs of pending tasks; the first one is dequeued next.
+	active  []string // IDs of active tasks in the order they were dequeued.
+
+	// quarantined holds the tasks moved out of the queue by Quarantine, by ID.
+	quarantined map[string]*task
+
+	pausedUntil time.Time // zero if the queue is not paused.
+
+	processed int
+	failed    int
+	unhandled int
+}
+
+type task struct {
+	msg        *base.TaskMessage
+	state      base.TaskState
+	score      time.Time // time to process for scheduled and retry tasks, deadline for active tasks, expiration for completed tasks.
+	result     []byte
+	checkpoint []byte
+	progress   []byte
+	lease      int64 // incremented every time the task is dequeued, see base.TaskMessage.Lease.
+}
+
+// Make sure Broker implements Broker interface at compile time.
+var _ base.Broker = (*Broker)(nil)
+
+var errPubSubNotSupported = errors.New("fakebroker: pubsub is not supported")
+
+// New returns an empty Broker using the given clock.
+func New(clock timeutil.Clock) *Broker {
+	return &Broker{
+		clock:      clock,
+		queues:     make(map[string]*queue),
+		uniqueKeys: make(map[string]lock),
+		started:    make(map[string]time.Time),
+		results:    make(map[string]cachedResult),
+	}
+}
+
+func (b *Broker) queue(qname string) *queue {
+	q, ok := b.queues[qname]
+	if !ok {
+		q = &queue{tasks: make(map[string]*task), quarantined: make(map[string]*task)}
+		b.queues[qname] = q
+	}
+	return q
+}
+
+// copyMessage returns a copy of msg, so that callers cannot modify the stored messages.
+func copyMessage(msg *base.TaskMessage) *base.TaskMessage {
+	m := *msg
+	m.Checkpoint = nil
+	return &m
+}
+
+func remove(ids []string, id string) []string {
+	for i, x := range ids {
+		if x == id {
+			return append(ids[:i:i], ids[i+1:]...)
+		}
+	}
+	return ids
+}
+
+func (b *Broker) Ping() error { return nil }
+
+func (b *Broker) Close() error { return nil }
+
+// add stores msg in the given state, and fails if the ID is taken.
+func (b *Broker) add(op errors.Op, msg *base.TaskMessage, state base.TaskState, score time.Time) error {
+	q := b.queue(msg.Queue)
+	if _, ok := q.tasks[msg.ID]; ok {
+		return errors.E(op, errors.AlreadyExists, errors.ErrTaskIdConflict)
+	}
+	if _, ok := q.quarantined[msg.ID]; ok {
+		return errors.E(op, errors.AlreadyExists, errors.ErrTaskIdConflict)
+	}
+	q.tasks[msg.ID] = &task{msg: copyMessage(msg), state: state, score: score}
+	if state == base.TaskStatePending {
+		q.pending = append(q.pending, msg.ID)
+	}
+	return nil
+}
+
+// lockUnique acquires the uniqueness lock of msg for ttl.
+func (b *Broker) lockUnique(op errors.Op, msg *base.TaskMessage, ttl time.Duration) error {
+	now := b.clock.Now()
+	if l, ok := b.uniqueKeys[msg.UniqueKey]; ok && now.Before(l.expireAt) {
+		return errors.E(op, errors.AlreadyExists, errors.ErrDuplicateTask)
+	}
+	b.uniqueKeys[msg.UniqueKey] = lock{id: msg.ID, expireAt: now.Add(ttl)}
+	return nil
+}
+
+// unlockUnique releases the uniqueness lock of msg if the task holds it.
+func (b *Broker) unlockUnique(msg *base.TaskMessage) {
+	if l, ok := b.uniqueKeys[msg.UniqueKey]; ok && l.id == msg.ID {
+		delete(b.uniqueKeys, msg.UniqueKey)
+	}
+}
+
+func (b *Broker) Enqueue(ctx context.Context, msg *base.TaskMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.add("fakebroker.Enqueue", msg, base.TaskStatePending, time.Time{})
+}
+
+func (b *Broker) EnqueueUnique(ctx context.Context, msg *base.TaskMessage, ttl time.Duration) error {
+	var op errors.Op = "fakebroker.EnqueueUnique"
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.queue(msg.Queue).tasks[msg.ID]; ok {
+		return errors.E(op, errors.AlreadyExists, errors.ErrTaskIdConflict)
+	}
+	if err := b.lockUnique(op, msg, ttl); err != nil {
+		return err
+	}
+	return b.add(op, msg, base.TaskStatePending, time.Time{})
+}
+
+func (b *Broker) Schedule(ctx context.Context, msg *base.TaskMessage, processAt time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.add("fakebroker.Schedule", msg, base.TaskStateScheduled, processAt)
+}
+
+func (b *Broker) ScheduleUnique(ctx context.Context, msg *base.TaskMessage, processAt time.Time, ttl time.Duration) error {
+	var op errors.Op = "fakebroker.ScheduleUnique"
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.queue(msg.Queue).tasks[msg.ID]; ok {
+		return errors.E(op, errors.AlreadyExists, errors.ErrTaskIdConflict)
+	}
+	if err := b.lockUnique(op, msg, ttl); err != nil {
+		return err
+	}
+	return b.add(op, msg, base.TaskStateScheduled, processAt)
+}
+
+// Dequeue pops the next pending task off the first of the given queues
+// which has one, and returns the task with its deadline.
+// Tasks which require labels are left in their queues.
+func (b *Broker) Dequeue(qnames ...string) (*base.TaskMessage, time.Time, error) {
+	return b.dequeue("fakebroker.Dequeue", nil, nil, qnames)
+}
+
+// DequeueSkipping is like Dequeue, but leaves the tasks of the given classes
+// in their queues.
+func (b *Broker) DequeueSkipping(skipClasses []string, qnames ...string) (*base.TaskMessage, time.Time, error) {
+	return b.dequeue("fakebroker.DequeueSkipping", nil, skipClasses, qnames)
+}
+
+// DequeueMatching is like DequeueSkipping, but also pops the tasks which require
+// labels if the given labels include all of them.
+func (b *Broker) DequeueMatching(labels, skipClasses []string, qnames ...string) (*base.TaskMessage, time.Time, error) {
+	return b.dequeue("fakebroker.DequeueMatching", labels, skipClasses, qnames)
+}
+
+func (b *Broker) dequeue(op errors.Op, labels, skipClasses, qnames []string) (*base.TaskMessage, time.Time, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.clock.Now()
+	for _, qname := range qnames {
+		q, ok := b.queues[qname]
+		if !ok || now.Before(q.pausedUntil) {
+			continue
+		}
+		i := 0
+		for i < len(q.pending) && (!matches(q.tasks[q.pending[i]].msg, labels, skipClasses) || b.isStarted(q.pending[i], now)) {
+			i++
+		}
+		if i == len(q.pending) {
+			continue
+		}
+		id := q.pending[i]
+		q.pending = append(q.pending[:i:i], q.pending[i+1:]...)
+		t := q.tasks[id]
+		var deadline time.Time
+		switch {
+		case t.msg.Timeout != 0 && t.msg.Deadline != 0:
+			deadline = now.Add(time.Duration(t.msg.Timeout) * time.Second)
+			if d := time.Unix(t.msg.Deadline, 0); d.Before(deadline) {
+				deadline = d
+			}
+		case t.msg.Timeout != 0:
+			deadline = now.Add(time.Duration(t.msg.Timeout) * time.Second)
+		case t.msg.Deadline != 0:
+			deadline = time.Unix(t.msg.Deadline, 0)
+		default:
+			return nil, time.Time{}, errors.E(op, errors.Internal, "both timeout and deadline are not set")
+		}
+		t.state = base.TaskStateActive
+		t.score = deadline
+		t.progress = nil
+		t.lease++
+		q.active = append(q.active, id)
+		if t.msg.AtMostOnce {
+			b.started[id] = deadline.Add(atMostOnceGrace)
+		}
+		msg := copyMessage(t.msg)
+		msg.Checkpoint = t.checkpoint
+		msg.Lease = t.lease
+		return msg, deadline, nil
+	}
+	return nil, time.Time{}, errors.E(op, errors.NotFound, errors.ErrNoProcessableTask)
+}
+
+// ClaimEnvironment labels the broker with the environment name env unless
+// it's already labeled, and returns the environment of the broker.
+func (b *Broker) ClaimEnvironment(env string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.environment == "" {
+		b.environment = env
+	}
+	return b.environment, nil
+}
+
+// PauseFor pauses the queue for the duration d.
+// It reports whether the queue was paused, i.e. false if it was already paused.
+func (b *Broker) PauseFor(qname string, d time.Duration, reason string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q := b.queue(qname)
+	now := b.clock.Now()
+	if now.Before(q.pausedUntil) {
+		return false, nil
+	}
+	q.pausedUntil = now.Add(d)
+	return true, nil
+}
+
+// activeTask returns the stored active task for msg.
+func (b *Broker) activeTask(op errors.Op, msg *base.TaskMessage) (*queue, *task, error) {
+	q, ok := b.queues[msg.Queue]
+	if !ok {
+		return nil, nil, errors.E(op, errors.NotFound, &errors.QueueNotFoundError{Queue: msg.Queue})
+	}
+	t, ok := q.tasks[msg.ID]
+	if !ok || t.state != base.TaskStateActive || (msg.Lease != 0 && msg.Lease != t.lease) {
+		return nil, nil, errors.E(op, errors.NotFound, &errors.TaskNotFoundError{Queue: msg.Queue, ID: msg.ID})
+	}
+	return q, t, nil
+}
+
+func (b *Broker) Done(msg *base.TaskMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, _, err := b.activeTask("fakebroker.Done", msg)
+	if err != nil {
+		return err
+	}
+	q.active = remove(q.active, msg.ID)
+	delete(q.tasks, msg.ID)
+	q.processed++
+	b.unlockUnique(msg)
+	return nil
+}
+
+func (b *Broker) MarkAsComplete(msg *base.TaskMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, t, err := b.activeTask("fakebroker.MarkAsComplete", msg)
+	if err != nil {
+		return err
+	}
+	now := b.clock.Now()
+	msg.CompletedAt = now.Unix()
+	q.active = remove(q.active, msg.ID)
+	t.msg = copyMessage(msg)
+	t.state = base.TaskStateCompleted
+	t.score = now.Add(time.Duration(msg.Retention) * time.Second)
+	q.processed++
+	b.unlockUnique(msg)
+	return nil
+}
+
+// Requeue moves the active task back to the front of the pending tasks.
+func (b *Broker) Requeue(msg *base.TaskMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, t, err := b.activeTask("fakebroker.Requeue", msg)
+	if err != nil {
+		return err
+	}
+	q.active = remove(q.active, msg.ID)
+	t.state = base.TaskStatePending
+	t.score = time.Time{}
+	q.pending = append([]string{msg.ID}, q.pending...)
+	return nil
+}
+
+// atMostOnceGrace is the duration after the deadline of an at-most-once task
+// for which it stays marked as started, as with rdb.
+const atMostOnceGrace = time.Minute
+
+// isStarted reports whether the at-most-once task is marked as started by a
+// previous delivery, in which case it isn't dequeued.
+func (b *Broker) isStarted(id string, now time.Time) bool {
+	exp, ok := b.started[id]
+	return ok && now.Before(exp)
+}
+
+func (b *Broker) ClearStarted(msg *base.TaskMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.started, msg.ID)
+	return nil
+}
+
+// CacheResult caches the result of the given completed task for the duration ttl.
+func (b *Broker) CacheResult(msg *base.TaskMessage, ttl time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var data []byte
+	if t, ok := b.queue(msg.Queue).tasks[msg.ID]; ok {
+		data = t.result
+	}
+	key := base.ResultCacheKey(msg.Queue, msg.Type, msg.IdempotencyKey)
+	b.results[key] = cachedResult{data: append([]byte{}, data...), expireAt: b.clock.Now().Add(ttl)}
+	return nil
+}
+
+// CachedResult returns the cached result of a completed task of the same type
+// and with the same idempotency key as the given task, if any.
+func (b *Broker) CachedResult(msg *base.TaskMessage) ([]byte, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := base.ResultCacheKey(msg.Queue, msg.Type, msg.IdempotencyKey)
+	res, ok := b.results[key]
+	if !ok || !b.clock.Now().Before(res.expireAt) {
+		delete(b.results, key)
+		return nil, false, nil
+	}
+	return append([]byte{}, res.data...), true, nil
+}
+
+func (b *Broker) Retry(msg *base.TaskMessage, processAt time.Time, errMsg string, isFailure bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, t, err := b.activeTask("fakebroker.Retry", msg)
+	if err != nil {
+		return err
+	}
+	modified := copyMessage(msg)
+	if isFailure {
+		modified.Retried++
+		q.failed++
+	}
+	modified.ErrorMsg = errMsg
+	modified.ErrorHistory = base.AppendErrorHistory(msg.ErrorHistory, errMsg)
+	modified.LastFailedAt = b.clock.Now().Unix()
+	q.active = remove(q.active, msg.ID)
+	q.processed++
+	t.msg = modified
+	t.state = base.TaskStateRetry
+	t.score = processAt
+	return nil
+}
+
+func (b *Broker) Archive(msg *base.TaskMessage, errMsg, reason string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, t, err := b.activeTask("fakebroker.Archive", msg)
+	if err != nil {
+		return err
+	}
+	now := b.clock.Now()
+	modified := copyMessage(msg)
+	modified.ErrorMsg = errMsg
+	modified.ErrorHistory = base.AppendErrorHistory(msg.ErrorHistory, errMsg)
+	modified.ArchiveReason = reason
+	modified.LastFailedAt = now.Unix()
+	q.active = remove(q.active, msg.ID)
+	q.processed++
+	q.failed++
+	t.msg = modified
+	t.state = base.TaskStateArchived
+	t.score = now
+	return nil
+}
+
+func (b *Broker) Park(msg *base.TaskMessage, errMsg string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, t, err := b.activeTask("fakebroker.Park", msg)
+	if err != nil {
+		return err
+	}
+	modified := copyMessage(msg)
+	modified.ErrorMsg = errMsg
+	modified.ErrorHistory = base.AppendErrorHistory(msg.ErrorHistory, errMsg)
+	q.active = remove(q.active, msg.ID)
+	t.msg = modified
+	t.state = base.TaskStateUnhandled
+	t.score = b.clock.Now()
+	return nil
+}
+
+func (b *Broker) Quarantine(msg *base.TaskMessage, errMsg string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, t, err := b.activeTask("fakebroker.Quarantine", msg)
+	if err != nil {
+		return err
+	}
+	modified := copyMessage(msg)
+	modified.ErrorMsg = errMsg
+	modified.ErrorHistory = base.AppendErrorHistory(msg.ErrorHistory, errMsg)
+	q.active = remove(q.active, msg.ID)
+	delete(q.tasks, msg.ID)
+	t.msg = modified
+	t.score = b.clock.Now()
+	q.quarantined[msg.ID] = t
+	return nil
+}
+
+func (b *Broker) RecordUnhandled(qname string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.queue(qname).unhandled++
+	return nil
+}
+
+// ForwardIfReady moves the scheduled and retry tasks which are due to the pending state,
+// in the order of the time they are due.
+func (b *Broker) ForwardIfReady(qnames ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.clock.Now()
+	for _, qname := range qnames {
+		q, ok := b.queues[qname]
+		if !ok {
+			continue
+		}
+		var ready []*task
+		for _, t := range q.tasks {
+			if (t.state == base.TaskStateScheduled || t.state == base.TaskStateRetry) && !t.score.After(now) {
+				ready = append(ready, t)
+			}
+		}
+		sortByScore(ready)
+		for _, t := range ready {
+			t.state = base.TaskStatePending
+			t.score = time.Time{}
+			q.pending = append(q.pending, t.msg.ID)
+		}
+	}
+	return nil
+}
+
+func (b *Broker) DeleteExpiredCompletedTasks(qname string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[qname]
+	if !ok {
+		return nil
+	}
+	now := b.clock.Now()
+	for id, t := range q.tasks {
+		if t.state == base.TaskStateCompleted && t.score.Before(now) {
+			delete(q.tasks, id)
+		}
+	}
+	return nil
+}
+
+func (b *Broker) ArchiveStaleTasks(qname string, cutoff time.Time) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[qname]
+	if !ok {
+		return 0, nil
+	}
+	now := b.clock.Now()
+	var n int64
+	for _, t := range q.tasks {
+		if (t.state == base.TaskStateScheduled || t.state == base.TaskStateRetry) && t.score.Before(cutoff) {
+			modified := copyMessage(t.msg)
+			modified.ArchiveReason = base.ArchiveReasonStale
+			t.msg = modified
+			t.state = base.TaskStateArchived
+			t.score = now
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (b *Broker) ListDeadlineExceeded(deadline time.Time, qnames ...string) ([]*base.TaskMessage, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var msgs []*base.TaskMessage
+	for _, qname := range qnames {
+		q, ok := b.queues[qname]
+		if !ok {
+			continue
+		}
+		for _, id := range q.active {
+			if t := q.tasks[id]; t.score.Before(deadline) {
+				msgs = append(msgs, copyMessage(t.msg))
+			}
+		}
+	}
+	return msgs, nil
+}
+
+// RecordQueueSizes does nothing; the broker keeps no history of the queue sizes.
+func (b *Broker) RecordQueueSizes(qname string, interval time.Duration) error { return nil }
+
+// ClaimExpiryDigest returns no tasks; the broker does not expire archived tasks.
+func (b *Broker) ClaimExpiryDigest(qname string, within, period, claim time.Duration) (*base.ExpiringArchived, error) {
+	return nil, nil
+}
+
+// FinishExpiryDigest does nothing; the broker makes no digests.
+func (b *Broker) FinishExpiryDigest(qname string, period time.Duration, notified bool) error {
+	return nil
+}
+
+// RecordTaskSample does nothing; the broker keeps no sampled tasks.
+func (b *Broker) RecordTaskSample(qname string, s *base.TaskSample) error { return nil }
+
+// RecordLatency does nothing; the broker keeps no latency histograms.
+func (b *Broker) RecordLatency(qname string, l *base.TaskLatency) error { return nil }
+
+func (b *Broker) WriteServerState(info *base.ServerInfo, workers []*base.WorkerInfo, ttl time.Duration) error {
+	return nil
+}
+
+// CheckCompatibility reports no incompatibility; the broker does not keep the server states.
+func (b *Broker) CheckCompatibility(info *base.ServerInfo) ([]string, error) { return nil, nil }
+
+func (b *Broker) ClearServerState(host string, pid int, serverID string) error { return nil }
+
+func (b *Broker) CancelationPubSub() (*redis.PubSub, error) { return nil, errPubSubNotSupported }
+
+func (b *Broker) PublishCancelation(id string) error { return errPubSubNotSupported }
+
+func (b *Broker) ConcurrencyPubSub(serverID string) (*redis.PubSub, error) {
+	return nil, errPubSubNotSupported
+}
+
+func (b *Broker) WakeupPubSub(qnames ...string) (*redis.PubSub, error) {
+	return nil, errPubSubNotSupported
+}
+
+func (b *Broker) PublishConcurrency(serverID string, n int) error { return errPubSubNotSupported }
+
+func (b *Broker) QuietPubSub(serverID string) (*redis.PubSub, error) {
+	return nil, errPubSubNotSupported
+}
+
+func (b *Broker) PublishQuiet(serverID string) error { return errPubSubNotSupported }
+
+func (b *Broker) WriteResult(qname, id string, data []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t, ok := b.queue(qname).tasks[id]
+	if !ok {
+		return 0, errors.E("fakebroker.WriteResult", errors.NotFound, &errors.TaskNotFoundError{Queue: qname, ID: id})
+	}
+	t.result = append([]byte(nil), data...)
+	return len(data), nil
+}
+
+func (b *Broker) WriteCheckpoint(qname, id string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t, ok := b.queue(qname).tasks[id]
+	if !ok || t.state != base.TaskStateActive {
+		return errors.E("fakebroker.WriteCheckpoint", errors.NotFound, &errors.TaskNotFoundError{Queue: qname, ID: id})
+	}
+	t.checkpoint = append([]byte{}, data...)
+	return nil
+}
+
+func (b *Broker) WriteProgress(qname, id string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t, ok := b.queue(qname).tasks[id]
+	if !ok || t.state != base.TaskStateActive {
+		return errors.E("fakebroker.WriteProgress", errors.NotFound, &errors.TaskNotFoundError{Queue: qname, ID: id})
+	}
+	t.progress = append([]byte{}, data...)
+	return nil
+}
+
+// Tasks returns the tasks in the given queue and state.
+//
+// Pending and active tasks are returned in the order they are (or were) dequeued,
+// and the other tasks in the order of their score (e.g. the time to process
+// scheduled and retry tasks).
+func (b *Broker) Tasks(qname string, state base.TaskState) []*base.TaskInfo {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[qname]
+	if !ok {
+		return nil
+	}
+	var tasks []*task
+	switch state {
+	case base.TaskStatePending:
+		for _, id := range q.pending {
+			tasks = append(tasks, q.tasks[id])
+		}
+	case base.TaskStateActive:
+		for _, id := range q.active {
+			tasks = append(tasks, q.tasks[id])
+		}
+	default:
+		for _, t := range q.tasks {
+			if t.state == state {
+				tasks = append(tasks, t)
+			}
+		}
+		sortByScore(tasks)
+	}
+	var infos []*base.TaskInfo
+	for _, t := range tasks {
+		info := &base.TaskInfo{Message: copyMessage(t.msg), State: t.state, Result: t.result, Progress: t.progress}
+		switch t.state {
+		case base.TaskStatePending:
+			info.NextProcessAt = b.clock.Now()
+		case base.TaskStateScheduled, base.TaskStateRetry:
+			info.NextProcessAt = t.score
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// Stats returns the number of processed, failed and unhandled tasks in the given queue.
+func (b *Broker) Stats(qname string) (processed, failed, unhandled int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[qname]
+	if !ok {
+		return 0, 0, 0
+	}
+	return q.processed, q.failed, q.unhandled
+}
+
+// sortByScore sorts tasks by score, breaking ties by ID to keep the order deterministic.
+func sortByScore(tasks []*task) {
+	sort.Slice(tasks, func(i, j int) bool {
+		if !tasks[i].score.Equal(tasks[j].score) {
+			return tasks[i].score.Before(tasks[j].score)
+		}
+		return tasks[i].msg.ID < tasks[j].msg.ID
+	})
+}
+
+// contains reports whether s is in list.
+// matches reports whether the task can be dequeued by a server with the given labels,
+// skipping the tasks of the given classes.
+func matches(msg *base.TaskMessage, labels, skipClasses []string) bool {
+	if contains(skipClasses, msg.Class) {
+		return false
+	}
+	for _, label := range base.FormatLabels(msg.Labels) {
+		if !contains(labels, label) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,230 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package fakebroker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/errors"
+	"github.com/hibiken/asynq/internal/timeutil"
+)
+
+func ids(infos []*base.TaskInfo) []string {
+	var res []string
+	for _, info := range infos {
+		res = append(res, info.Message.ID)
+	}
+	return res
+}
+
+func TestDequeueOrder(t *testing.T) {
+	clock := timeutil.NewSimulatedClock(time.Now())
+	b := New(clock)
+	ctx := context.Background()
+	m1 := h.NewTaskMessage("one", nil)
+	m2 := h.NewTaskMessage("two", nil)
+	m3 := h.NewTaskMessageWithQueue("three", nil, "critical")
+	for _, msg := range []*base.TaskMessage{m1, m2, m3} {
+		if err := b.Enqueue(ctx, msg); err != nil {
+			t.Fatalf("Enqueue returned error: %v", err)
+		}
+	}
+	if err := b.Enqueue(ctx, m1); !errors.Is(err, errors.ErrTaskIdConflict) {
+		t.Errorf("Enqueue with taken ID returned %v, want ErrTaskIdConflict", err)
+	}
+
+	got, deadline, err := b.Dequeue("critical", "default")
+	if err != nil || got.ID != m3.ID {
+		t.Fatalf("Dequeue returned (%v, %v), want task %s", got, err, m3.ID)
+	}
+	if want := clock.Now().Add(time.Duration(m3.Timeout) * time.Second); !deadline.Equal(want) {
+		t.Errorf("Dequeue returned deadline %v, want %v", deadline, want)
+	}
+	got, _, err = b.Dequeue("critical", "default")
+	if err != nil || got.ID != m1.ID {
+		t.Fatalf("Dequeue returned (%v, %v), want task %s", got, err, m1.ID)
+	}
+	// A requeued task is dequeued next.
+	if err := b.Requeue(got); err != nil {
+		t.Fatalf("Requeue returned error: %v", err)
+	}
+	if diff := cmp.Diff([]string{m1.ID, m2.ID}, ids(b.Tasks("default", base.TaskStatePending))); diff != "" {
+		t.Errorf("pending tasks mismatch (-want,+got):\n%s", diff)
+	}
+	if err := b.Done(m2); !errors.IsTaskNotFound(err) {
+		t.Errorf("Done for pending task returned %v, want TaskNotFoundError", err)
+	}
+}
+
+func TestDequeueSkipping(t *testing.T) {
+	b := New(timeutil.NewSimulatedClock(time.Now()))
+	ctx := context.Background()
+	m1 := h.NewTaskMessage("transcode", nil)
+	m1.Class = "cpu"
+	m2 := h.NewTaskMessage("webhook", nil)
+	m2.Class = "io"
+	for _, msg := range []*base.TaskMessage{m1, m2} {
+		if err := b.Enqueue(ctx, msg); err != nil {
+			t.Fatalf("Enqueue returned error: %v", err)
+		}
+	}
+	got, _, err := b.DequeueSkipping([]string{"cpu"}, "default")
+	if err != nil || got.ID != m2.ID {
+		t.Fatalf("DequeueSkipping returned (%v, %v), want task %s", got, err, m2.ID)
+	}
+	if _, _, err := b.DequeueSkipping([]string{"cpu"}, "default"); !errors.Is(err, errors.ErrNoProcessableTask) {
+		t.Errorf("DequeueSkipping returned %v, want ErrNoProcessableTask", err)
+	}
+	if diff := cmp.Diff([]string{m1.ID}, ids(b.Tasks("default", base.TaskStatePending))); diff != "" {
+		t.Errorf("pending tasks mismatch (-want,+got):\n%s", diff)
+	}
+}
+
+func TestPauseFor(t *testing.T) {
+	clock := timeutil.NewSimulatedClock(time.Now())
+	b := New(clock)
+	if err := b.Enqueue(context.Background(), h.NewTaskMessage("one", nil)); err != nil {
+		t.Fatalf("Enqueue returned error: %v", err)
+	}
+	if ok, err := b.PauseFor("default", time.Minute, "failing"); err != nil || !ok {
+		t.Fatalf("PauseFor returned (%t, %v), want (true, nil)", ok, err)
+	}
+	if ok, _ := b.PauseFor("default", time.Minute, "failing"); ok {
+		t.Errorf("PauseFor of paused queue returned true, want false")
+	}
+	if _, _, err := b.Dequeue("default"); !errors.Is(err, errors.ErrNoProcessableTask) {
+		t.Errorf("Dequeue from paused queue returned %v, want ErrNoProcessableTask", err)
+	}
+	clock.AdvanceTime(time.Minute)
+	if _, _, err := b.Dequeue("default"); err != nil {
+		t.Errorf("Dequeue after the pause elapsed returned error: %v", err)
+	}
+}
+
+func TestRetryAndForward(t *testing.T) {
+	clock := timeutil.NewSimulatedClock(time.Now())
+	b := New(clock)
+	ctx := context.Background()
+	m1 := h.NewTaskMessage("one", nil)
+	m2 := h.NewTaskMessage("two", nil)
+	if err := b.Schedule(ctx, m1, clock.Now().Add(2*time.Minute)); err != nil {
+		t.Fatalf("Schedule returned error: %v", err)
+	}
+	if err := b.Enqueue(ctx, m2); err != nil {
+		t.Fatalf("Enqueue returned error: %v", err)
+	}
+	msg, _, err := b.Dequeue("default")
+	if err != nil {
+		t.Fatalf("Dequeue returned error: %v", err)
+	}
+	if err := b.WriteCheckpoint("default", msg.ID, []byte("offset=3")); err != nil {
+		t.Fatalf("WriteCheckpoint returned error: %v", err)
+	}
+	if err := b.Retry(msg, clock.Now().Add(time.Minute), "oops", true); err != nil {
+		t.Fatalf("Retry returned error: %v", err)
+	}
+	retry := b.Tasks("default", base.TaskStateRetry)
+	if len(retry) != 1 || retry[0].Message.Retried != 1 || retry[0].Message.ErrorMsg != "oops" {
+		t.Fatalf("retry tasks = %v, want task %s retried once with error %q", retry, m2.ID, "oops")
+	}
+
+	clock.AdvanceTime(time.Minute)
+	if err := b.ForwardIfReady("default"); err != nil {
+		t.Fatalf("ForwardIfReady returned error: %v", err)
+	}
+	if diff := cmp.Diff([]string{m2.ID}, ids(b.Tasks("default", base.TaskStatePending))); diff != "" {
+		t.Errorf("pending tasks after a minute mismatch (-want,+got):\n%s", diff)
+	}
+	clock.AdvanceTime(time.Minute)
+	b.ForwardIfReady("default")
+	if diff := cmp.Diff([]string{m2.ID, m1.ID}, ids(b.Tasks("default", base.TaskStatePending))); diff != "" {
+		t.Errorf("pending tasks after two minutes mismatch (-want,+got):\n%s", diff)
+	}
+
+	msg, _, err = b.Dequeue("default")
+	if err != nil {
+		t.Fatalf("Dequeue returned error: %v", err)
+	}
+	if string(msg.Checkpoint) != "offset=3" {
+		t.Errorf("Dequeue returned checkpoint %q, want %q", msg.Checkpoint, "offset=3")
+	}
+	if processed, failed, _ := b.Stats("default"); processed != 1 || failed != 1 {
+		t.Errorf("Stats = (%d, %d), want (1, 1)", processed, failed)
+	}
+}
+
+func TestUniqueLockExpiration(t *testing.T) {
+	clock := timeutil.NewSimulatedClock(time.Now())
+	b := New(clock)
+	ctx := context.Background()
+	m1 := h.NewTaskMessage("report", nil)
+	m1.UniqueKey = base.UniqueKey(m1.Queue, m1.Type, m1.Payload)
+	m2 := h.NewTaskMessage("report", nil)
+	m2.UniqueKey = m1.UniqueKey
+
+	if err := b.EnqueueUnique(ctx, m1, time.Minute); err != nil {
+		t.Fatalf("EnqueueUnique returned error: %v", err)
+	}
+	if err := b.EnqueueUnique(ctx, m2, time.Minute); !errors.Is(err, errors.ErrDuplicateTask) {
+		t.Errorf("EnqueueUnique of duplicate returned %v, want ErrDuplicateTask", err)
+	}
+	clock.AdvanceTime(time.Minute)
+	if err := b.EnqueueUnique(ctx, m2, time.Minute); err != nil {
+		t.Errorf("EnqueueUnique after the lock expired returned error: %v", err)
+	}
+}
+
+func TestDeleteExpiredCompletedTasks(t *testing.T) {
+	clock := timeutil.NewSimulatedClock(time.Now())
+	b := New(clock)
+	msg := h.NewTaskMessage("one", nil)
+	msg.Retention = 60
+	b.Enqueue(context.Background(), msg)
+	got, _, err := b.Dequeue("default")
+	if err != nil {
+		t.Fatalf("Dequeue returned error: %v", err)
+	}
+	if err := b.MarkAsComplete(got); err != nil {
+		t.Fatalf("MarkAsComplete returned error: %v", err)
+	}
+
+	clock.AdvanceTime(time.Minute)
+	b.DeleteExpiredCompletedTasks("default")
+	if n := len(b.Tasks("default", base.TaskStateCompleted)); n != 1 {
+		t.Errorf("got %d completed tasks before the retention elapsed, want 1", n)
+	}
+	clock.AdvanceTime(time.Second)
+	b.DeleteExpiredCompletedTasks("default")
+	if n := len(b.Tasks("default", base.TaskStateCompleted)); n != 0 {
+		t.Errorf("got %d completed tasks after the retention elapsed, want 0", n)
+	}
+}
+
+func TestArchiveStaleTasks(t *testing.T) {
+	clock := timeutil.NewSimulatedClock(time.Now())
+	b := New(clock)
+	ctx := context.Background()
+	m1 := h.NewTaskMessage("stuck", nil)
+	m2 := h.NewTaskMessage("soon", nil)
+	b.Schedule(ctx, m1, clock.Now().Add(-48*time.Hour))
+	b.Schedule(ctx, m2, clock.Now().Add(time.Minute))
+
+	n, err := b.ArchiveStaleTasks("default", clock.Now().Add(-24*time.Hour))
+	if err != nil || n != 1 {
+		t.Fatalf("ArchiveStaleTasks = (%d, %v), want (1, nil)", n, err)
+	}
+	archived := b.Tasks("default", base.TaskStateArchived)
+	if len(archived) != 1 || archived[0].Message.ID != m1.ID || archived[0].Message.ArchiveReason != base.ArchiveReasonStale {
+		t.Errorf("archived tasks = %v, want %s archived as stale", archived, m1.ID)
+	}
+	if diff := cmp.Diff([]string{m2.ID}, ids(b.Tasks("default", base.TaskStateScheduled))); diff != "" {
+		t.Errorf("scheduled tasks mismatch (-want,+got):\n%s", diff)
+	}
+}
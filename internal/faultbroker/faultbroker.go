@@ -0,0 +1,216 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+// Package faultbroker exports a broker implementation which injects faults into
+// the broker operations, to test the idempotency of handlers and the recovery
+// from broker failures in package testing.
+package faultbroker
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/errors"
+)
+
+// Config specifies the faults to inject into the broker operations.
+type Config struct {
+	// Latency is added to each broker operation.
+	Latency time.Duration
+
+	// ErrorRate is the probability, between 0 and 1, that a broker operation fails
+	// with a transient error without being performed, as if redis were unavailable.
+	ErrorRate float64
+
+	// DropAckRate is the probability, between 0 and 1, that the acknowledgement of a
+	// successfully processed task (i.e. its removal from the active tasks) is dropped.
+	// The acknowledgement reports success but the task is left active, so the task is
+	// processed again once its deadline is exceeded.
+	DropAckRate float64
+
+	// Ops limits the faults to the named broker operations (e.g. "Enqueue", "Dequeue",
+	// "Retry").
+	//
+	// If empty, faults are injected into all operations on tasks.
+	Ops []string
+
+	// Seed seeds the source of randomness deciding which operations fail,
+	// to reproduce a run.
+	//
+	// If zero, a random seed is used.
+	Seed int64
+}
+
+// errInjectedFault is the cause of the errors injected into broker operations.
+// It is reported as a transient redis error (see errors.IsTransient).
+var errInjectedFault = errors.New("TRYAGAIN fault injected for testing")
+
+// FaultBroker is a broker implementation which injects faults into the task
+// operations of the underlying broker. The other operations are passed through.
+type FaultBroker struct {
+	base.Broker
+	cfg Config
+	ops map[string]bool
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// Make sure FaultBroker implements Broker interface at compile time.
+var _ base.Broker = (*FaultBroker)(nil)
+
+func NewFaultBroker(b base.Broker, cfg Config) *FaultBroker {
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	fb := &FaultBroker{Broker: b, cfg: cfg, rnd: rand.New(rand.NewSource(seed))}
+	if len(cfg.Ops) > 0 {
+		fb.ops = make(map[string]bool)
+		for _, op := range cfg.Ops {
+			fb.ops[op] = true
+		}
+	}
+	return fb
+}
+
+// chance reports whether an event of probability p occurs.
+func (fb *FaultBroker) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	return fb.rnd.Float64() < p
+}
+
+// inject adds the latency to the given operation, and returns the error
+// with which the operation fails, if any.
+func (fb *FaultBroker) inject(op string) error {
+	if fb.ops != nil && !fb.ops[op] {
+		return nil
+	}
+	if fb.cfg.Latency > 0 {
+		time.Sleep(fb.cfg.Latency)
+	}
+	if fb.chance(fb.cfg.ErrorRate) {
+		return errors.E(errors.Op(op), errors.Unknown, &errors.RedisCommandError{Command: op, Err: errInjectedFault})
+	}
+	return nil
+}
+
+// dropAck reports whether to drop the given acknowledgement.
+func (fb *FaultBroker) dropAck(op string) bool {
+	if fb.ops != nil && !fb.ops[op] {
+		return false
+	}
+	return fb.chance(fb.cfg.DropAckRate)
+}
+
+func (fb *FaultBroker) Enqueue(ctx context.Context, msg *base.TaskMessage) error {
+	if err := fb.inject("Enqueue"); err != nil {
+		return err
+	}
+	return fb.Broker.Enqueue(ctx, msg)
+}
+
+func (fb *FaultBroker) EnqueueUnique(ctx context.Context, msg *base.TaskMessage, ttl time.Duration) error {
+	if err := fb.inject("EnqueueUnique"); err != nil {
+		return err
+	}
+	return fb.Broker.EnqueueUnique(ctx, msg, ttl)
+}
+
+func (fb *FaultBroker) Schedule(ctx context.Context, msg *base.TaskMessage, processAt time.Time) error {
+	if err := fb.inject("Schedule"); err != nil {
+		return err
+	}
+	return fb.Broker.Schedule(ctx, msg, processAt)
+}
+
+func (fb *FaultBroker) ScheduleUnique(ctx context.Context, msg *base.TaskMessage, processAt time.Time, ttl time.Duration) error {
+	if err := fb.inject("ScheduleUnique"); err != nil {
+		return err
+	}
+	return fb.Broker.ScheduleUnique(ctx, msg, processAt, ttl)
+}
+
+func (fb *FaultBroker) Dequeue(qnames ...string) (*base.TaskMessage, time.Time, error) {
+	if err := fb.inject("Dequeue"); err != nil {
+		return nil, time.Time{}, err
+	}
+	return fb.Broker.Dequeue(qnames...)
+}
+
+func (fb *FaultBroker) DequeueSkipping(skipClasses []string, qnames ...string) (*base.TaskMessage, time.Time, error) {
+	if err := fb.inject("DequeueSkipping"); err != nil {
+		return nil, time.Time{}, err
+	}
+	return fb.Broker.DequeueSkipping(skipClasses, qnames...)
+}
+
+func (fb *FaultBroker) DequeueMatching(labels, skipClasses []string, qnames ...string) (*base.TaskMessage, time.Time, error) {
+	if err := fb.inject("DequeueMatching"); err != nil {
+		return nil, time.Time{}, err
+	}
+	return fb.Broker.DequeueMatching(labels, skipClasses, qnames...)
+}
+
+func (fb *FaultBroker) Done(msg *base.TaskMessage) error {
+	if err := fb.inject("Done"); err != nil {
+		return err
+	}
+	if fb.dropAck("Done") {
+		return nil
+	}
+	return fb.Broker.Done(msg)
+}
+
+func (fb *FaultBroker) MarkAsComplete(msg *base.TaskMessage) error {
+	if err := fb.inject("MarkAsComplete"); err != nil {
+		return err
+	}
+	if fb.dropAck("MarkAsComplete") {
+		return nil
+	}
+	return fb.Broker.MarkAsComplete(msg)
+}
+
+func (fb *FaultBroker) Requeue(msg *base.TaskMessage) error {
+	if err := fb.inject("Requeue"); err != nil {
+		return err
+	}
+	return fb.Broker.Requeue(msg)
+}
+
+func (fb *FaultBroker) Retry(msg *base.TaskMessage, processAt time.Time, errMsg string, isFailure bool) error {
+	if err := fb.inject("Retry"); err != nil {
+		return err
+	}
+	return fb.Broker.Retry(msg, processAt, errMsg, isFailure)
+}
+
+func (fb *FaultBroker) Archive(msg *base.TaskMessage, errMsg, reason string) error {
+	if err := fb.inject("Archive"); err != nil {
+		return err
+	}
+	return fb.Broker.Archive(msg, errMsg, reason)
+}
+
+func (fb *FaultBroker) ForwardIfReady(qnames ...string) error {
+	if err := fb.inject("ForwardIfReady"); err != nil {
+		return err
+	}
+	return fb.Broker.ForwardIfReady(qnames...)
+}
+
+func (fb *FaultBroker) ListDeadlineExceeded(deadline time.Time, qnames ...string) ([]*base.TaskMessage, error) {
+	if err := fb.inject("ListDeadlineExceeded"); err != nil {
+		return nil, err
+	}
+	return fb.Broker.ListDeadlineExceeded(deadline, qnames...)
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package faultbroker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/errors"
+	"github.com/hibiken/asynq/internal/fakebroker"
+	"github.com/hibiken/asynq/internal/timeutil"
+)
+
+func TestFaultBrokerInjectsErrors(t *testing.T) {
+	b := fakebroker.New(timeutil.NewRealClock())
+	fb := NewFaultBroker(b, Config{
+		Latency:   50 * time.Millisecond,
+		ErrorRate: 1,
+		Ops:       []string{"Enqueue"},
+	})
+	ctx := context.Background()
+
+	start := time.Now()
+	err := fb.Enqueue(ctx, h.NewTaskMessage("task1", nil))
+	if !errors.IsTransient(err) {
+		t.Errorf("Enqueue returned %v, want a transient error", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Enqueue took %v, want at least the injected latency", elapsed)
+	}
+	// Operations not listed in Ops are not faulted.
+	if err := fb.Schedule(ctx, h.NewTaskMessage("task2", nil), time.Now().Add(time.Hour)); err != nil {
+		t.Errorf("Schedule returned error: %v", err)
+	}
+	if n := len(b.Tasks(base.DefaultQueueName, base.TaskStatePending)); n != 0 {
+		t.Errorf("got %d pending tasks, want 0", n)
+	}
+	if n := len(b.Tasks(base.DefaultQueueName, base.TaskStateScheduled)); n != 1 {
+		t.Errorf("got %d scheduled tasks, want 1", n)
+	}
+}
+
+func TestFaultBrokerDropsAcks(t *testing.T) {
+	b := fakebroker.New(timeutil.NewRealClock())
+	fb := NewFaultBroker(b, Config{DropAckRate: 1, Seed: 1})
+	msg := h.NewTaskMessage("task1", nil)
+	if err := b.Enqueue(context.Background(), msg); err != nil {
+		t.Fatalf("Enqueue returned error: %v", err)
+	}
+
+	got, _, err := fb.Dequeue(base.DefaultQueueName)
+	if err != nil {
+		t.Fatalf("Dequeue returned error: %v", err)
+	}
+	if err := fb.Done(got); err != nil {
+		t.Errorf("Done returned error: %v", err)
+	}
+	if active := b.Tasks(base.DefaultQueueName, base.TaskStateActive); len(active) != 1 || active[0].Message.ID != msg.ID {
+		t.Errorf("active tasks = %v, want task %s left active", active, msg.ID)
+	}
+}
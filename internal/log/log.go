@@ -11,6 +11,7 @@ import (
 	stdlog "log"
 	"os"
 	"sync"
+	"time"
 )
 
 // Base supports logging at various log levels.
@@ -95,6 +96,9 @@ type Logger struct {
 	// Minimum log level for this logger.
 	// Message with level lower than this level won't be outputted.
 	level Level
+
+	// sampler drops repeated messages, nil if sampling is disabled.
+	sampler *sampler
 }
 
 // Level represents a log level.
@@ -148,29 +152,56 @@ func (l *Logger) canLogAt(v Level) bool {
 	return v >= l.level
 }
 
+// canLogMessageAt reports whether logger can log a message at level v.
+// key identifies the message for sampling purposes.
+func (l *Logger) canLogMessageAt(v Level, key func() string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if v < l.level {
+		return false
+	}
+	// Fatal messages are never dropped.
+	if v == FatalLevel || l.sampler == nil {
+		return true
+	}
+	return l.sampler.allow(v, key())
+}
+
+// messageKey returns a function which returns the key of the message
+// with the given args. The key is computed only if sampling is enabled.
+func messageKey(args []interface{}) func() string {
+	return func() string { return fmt.Sprint(args...) }
+}
+
+// formatKey returns a function which returns the given format as the key
+// of the message, so that messages with the same format are sampled together.
+func formatKey(format string) func() string {
+	return func() string { return format }
+}
+
 func (l *Logger) Debug(args ...interface{}) {
-	if !l.canLogAt(DebugLevel) {
+	if !l.canLogMessageAt(DebugLevel, messageKey(args)) {
 		return
 	}
 	l.base.Debug(args...)
 }
 
 func (l *Logger) Info(args ...interface{}) {
-	if !l.canLogAt(InfoLevel) {
+	if !l.canLogMessageAt(InfoLevel, messageKey(args)) {
 		return
 	}
 	l.base.Info(args...)
 }
 
 func (l *Logger) Warn(args ...interface{}) {
-	if !l.canLogAt(WarnLevel) {
+	if !l.canLogMessageAt(WarnLevel, messageKey(args)) {
 		return
 	}
 	l.base.Warn(args...)
 }
 
 func (l *Logger) Error(args ...interface{}) {
-	if !l.canLogAt(ErrorLevel) {
+	if !l.canLogMessageAt(ErrorLevel, messageKey(args)) {
 		return
 	}
 	l.base.Error(args...)
@@ -184,19 +215,31 @@ func (l *Logger) Fatal(args ...interface{}) {
 }
 
 func (l *Logger) Debugf(format string, args ...interface{}) {
-	l.Debug(fmt.Sprintf(format, args...))
+	if !l.canLogMessageAt(DebugLevel, formatKey(format)) {
+		return
+	}
+	l.base.Debug(fmt.Sprintf(format, args...))
 }
 
 func (l *Logger) Infof(format string, args ...interface{}) {
-	l.Info(fmt.Sprintf(format, args...))
+	if !l.canLogMessageAt(InfoLevel, formatKey(format)) {
+		return
+	}
+	l.base.Info(fmt.Sprintf(format, args...))
 }
 
 func (l *Logger) Warnf(format string, args ...interface{}) {
-	l.Warn(fmt.Sprintf(format, args...))
+	if !l.canLogMessageAt(WarnLevel, formatKey(format)) {
+		return
+	}
+	l.base.Warn(fmt.Sprintf(format, args...))
 }
 
 func (l *Logger) Errorf(format string, args ...interface{}) {
-	l.Error(fmt.Sprintf(format, args...))
+	if !l.canLogMessageAt(ErrorLevel, formatKey(format)) {
+		return
+	}
+	l.base.Error(fmt.Sprintf(format, args...))
 }
 
 func (l *Logger) Fatalf(format string, args ...interface{}) {
@@ -213,3 +256,56 @@ func (l *Logger) SetLevel(v Level) {
 	}
 	l.level = v
 }
+
+// SetSampling enables sampling of repeated messages.
+// Within each tick, the first n messages with the same level and text (or format
+// string, for the formatting methods) are logged, and after that every m-th one.
+// If m is zero, all repeated messages after the first n are dropped until the next tick.
+//
+// Sampling is disabled if n is zero or less. Fatal messages are never sampled.
+func (l *Logger) SetSampling(n, m int, tick time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n <= 0 {
+		l.sampler = nil
+		return
+	}
+	l.sampler = &sampler{first: n, thereafter: m, tick: tick, now: time.Now}
+}
+
+// sampler counts messages to decide which of them to log.
+//
+// sampler is not safe for concurrent use; Logger guards it with its mutex.
+// A nil *sampler is valid and allows every message.
+type sampler struct {
+	first      int
+	thereafter int
+	tick       time.Duration
+	now        func() time.Time
+
+	resetAt time.Time
+	counts  map[sampleKey]int
+}
+
+type sampleKey struct {
+	level Level
+	msg   string
+}
+
+// allow reports whether the message with the given level and key should be logged.
+func (s *sampler) allow(v Level, key string) bool {
+	if s == nil {
+		return true
+	}
+	if now := s.now(); !now.Before(s.resetAt) {
+		s.resetAt = now.Add(s.tick)
+		s.counts = make(map[sampleKey]int)
+	}
+	k := sampleKey{v, key}
+	s.counts[k]++
+	n := s.counts[k]
+	if n <= s.first {
+		return true
+	}
+	return s.thereafter > 0 && (n-s.first)%s.thereafter == 0
+}
@@ -8,7 +8,9 @@ import (
 	"bytes"
 	"fmt"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 )
 
 // regexp for timestamps
@@ -386,3 +388,72 @@ func TestLoggerWithSameOrHigherLevels(t *testing.T) {
 		}
 	}
 }
+
+func TestLoggerSampling(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(newBase(&buf))
+	logger.SetSampling(2, 3, time.Second)
+	now := time.Now()
+	logger.sampler.now = func() time.Time { return now }
+
+	for i := 0; i < 10; i++ {
+		logger.Errorf("dequeue error: %d", i)
+	}
+	logger.Info("hello")
+	logger.Warn("hello") // sampled separately from Info messages
+
+	want := []string{
+		"ERROR: dequeue error: 0",
+		"ERROR: dequeue error: 1",
+		"ERROR: dequeue error: 4",
+		"ERROR: dequeue error: 7",
+		"INFO: hello",
+		"WARN: hello",
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("logger outputted %d lines, want %d:\n%s", len(lines), len(want), buf.String())
+	}
+	for i, line := range lines {
+		if !strings.HasSuffix(line, want[i]) {
+			t.Errorf("line %d = %q, want suffix %q", i, line, want[i])
+		}
+	}
+
+	// Counts are reset after the tick.
+	buf.Reset()
+	now = now.Add(time.Second)
+	logger.Errorf("dequeue error: %d", 10)
+	if !strings.HasSuffix(buf.String(), "ERROR: dequeue error: 10\n") {
+		t.Errorf("logger outputted %q after the tick, want the message to be logged", buf.String())
+	}
+
+	// Repeated messages are dropped if m is zero.
+	buf.Reset()
+	logger.SetSampling(1, 0, time.Minute)
+	for i := 0; i < 5; i++ {
+		logger.Debug("all queues are empty")
+	}
+	if got := strings.Count(buf.String(), "\n"); got != 1 {
+		t.Errorf("logger outputted %d lines, want 1", got)
+	}
+
+	// Sampling is disabled if n is zero.
+	buf.Reset()
+	logger.SetSampling(0, 0, time.Minute)
+	for i := 0; i < 5; i++ {
+		logger.Debug("all queues are empty")
+	}
+	if got := strings.Count(buf.String(), "\n"); got != 5 {
+		t.Errorf("logger outputted %d lines, want 5", got)
+	}
+
+	// The message key is not computed if sampling is disabled.
+	key := func() string {
+		t.Error("message key was computed with sampling disabled")
+		return ""
+	}
+	if !logger.canLogMessageAt(InfoLevel, key) {
+		t.Error("canLogMessageAt(InfoLevel, key) = false with sampling disabled, want true")
+	}
+}
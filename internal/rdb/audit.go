@@ -0,0 +1,221 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/errors"
+)
+
+// maxAuditLogSize is the approximate maximum number of events kept in the audit log of a queue.
+const maxAuditLogSize = 10000
+
+// Events recorded in the audit log.
+const (
+	AuditEnqueued    = "enqueued"
+	AuditScheduled   = "scheduled"
+	AuditStarted     = "started"
+	AuditRetried     = "retried"
+	AuditArchived    = "archived"
+	AuditParked      = "parked"
+	AuditDeleted     = "deleted"
+	AuditRun         = "run"
+	AuditImported    = "imported"
+	AuditDelayed     = "delayed"
+	AuditRequeued    = "requeued"
+	AuditCloned      = "cloned"
+	AuditQuarantined = "quarantined"
+
+	// Events about the queue itself.
+	AuditPaused    = "paused"
+	AuditUnpaused  = "unpaused"
+	AuditDraining  = "draining"
+	AuditUndrained = "undrained"
+	AuditRemoved   = "removed"
+	AuditTripped   = "tripped"
+)
+
+// AuditEvent is an entry of the audit log of a queue.
+type AuditEvent struct {
+	// ID of the entry in the stream.
+	ID string
+
+	// Event is one of the Audit* constants.
+	Event string
+
+	// TaskID and TaskType identify the task.
+	// Empty for actions applied to all tasks in a state.
+	TaskID   string
+	TaskType string
+
+	// State is the state of the tasks an action applied to all tasks in the
+	// state was performed on (e.g. "archived" for DeleteAllArchivedTasks).
+	State string
+
+	// Count is the number of tasks the event applies to.
+	Count int
+
+	// Reason is the error message of a retried or archived task.
+	Reason string
+
+	// Operator reports whether the event was caused by an administrative action.
+	Operator bool
+
+	// Actor identifies who performed the administrative action, if known.
+	Actor string
+
+	// Time the event was recorded.
+	Time time.Time
+}
+
+// SetAuditLog enables or disables recording of events in the audit logs of queues.
+//
+// When enabled, an event is appended to the capped stream of the queue after
+// each task state transition made through r: enqueueing, dequeueing, retrying
+// and archiving, as well as running, archiving and deleting tasks from the inspector.
+// Pausing, unpausing, draining and removing a queue are recorded as events of the queue.
+// Streams require Redis 5.0 or higher.
+//
+// Note: Events are appended after the transition, not atomically with it.
+// An event may be missing if appending it fails.
+func (r *RDB) SetAuditLog(enabled bool) {
+	r.audit = enabled
+}
+
+// WithAuditActor returns a copy of r which records the given actor in the audit
+// log events of administrative actions. The copy shares the connection with r.
+func (r *RDB) WithAuditActor(actor string) *RDB {
+	c := *r
+	c.actor = actor
+	return &c
+}
+
+// recordTaskEvent appends an event about the given task to the audit log of its queue.
+func (r *RDB) recordTaskEvent(ctx context.Context, event string, msg *base.TaskMessage, reason string) {
+	r.record(ctx, msg.Queue, &AuditEvent{
+		Event:    event,
+		TaskID:   msg.ID,
+		TaskType: msg.Type,
+		Count:    1,
+		Reason:   reason,
+	})
+}
+
+// recordOperatorEvent appends an event about an administrative action to the audit
+// log of the queue. id is empty for actions applied to all tasks in the given state.
+func (r *RDB) recordOperatorEvent(qname, event, id, state string, n int64) {
+	if n == 0 {
+		return
+	}
+	r.record(context.Background(), qname, &AuditEvent{
+		Event:    event,
+		TaskID:   id,
+		State:    state,
+		Count:    int(n),
+		Operator: true,
+		Actor:    r.actor,
+	})
+}
+
+// recordQueueEvent appends an event about an administrative action on the queue itself
+// to the audit log of the queue.
+func (r *RDB) recordQueueEvent(qname, event string) {
+	r.record(context.Background(), qname, &AuditEvent{
+		Event:    event,
+		Operator: true,
+		Actor:    r.actor,
+	})
+}
+
+// record appends the event to the audit log of the queue and publishes it
+// to the subscribers of the queue, as enabled.
+func (r *RDB) record(ctx context.Context, qname string, e *AuditEvent) {
+	r.recordAudit(ctx, qname, e)
+	r.publishEvent(ctx, qname, e)
+}
+
+// recordAudit appends the event to the audit log of the queue, if enabled.
+// Errors are ignored, since the transition of the task has already completed.
+func (r *RDB) recordAudit(ctx context.Context, qname string, e *AuditEvent) {
+	if !r.audit {
+		return
+	}
+	values := map[string]interface{}{
+		"event": e.Event,
+		"count": e.Count,
+		"time":  r.clock.Now().UnixNano(),
+	}
+	if e.TaskID != "" {
+		values["task_id"] = e.TaskID
+	}
+	if e.TaskType != "" {
+		values["task_type"] = e.TaskType
+	}
+	if e.State != "" {
+		values["state"] = e.State
+	}
+	if e.Reason != "" {
+		values["reason"] = e.Reason
+	}
+	if e.Operator {
+		values["operator"] = 1
+	}
+	if e.Actor != "" {
+		values["actor"] = e.Actor
+	}
+	r.client.XAdd(ctx, &redis.XAddArgs{
+		Stream:       base.AuditKey(qname),
+		MaxLenApprox: maxAuditLogSize,
+		Values:       values,
+	})
+}
+
+// ListAuditEvents returns the events in the audit log of the given queue, newest first.
+//
+// The audit log is kept after the queue is removed, so that the events
+// remain available for the removed queue.
+func (r *RDB) ListAuditEvents(qname string, pgn Pagination) ([]*AuditEvent, error) {
+	var op errors.Op = "rdb.ListAuditEvents"
+	// Note: Streams can't be read by offset, read up to the end of the page and
+	// skip the preceding pages. Audit logs are capped, so this stays bounded.
+	msgs, err := r.client.XRevRangeN(context.Background(), base.AuditKey(qname), "+", "-", pgn.stop()+1).Result()
+	if err != nil {
+		return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "xrevrange", Err: err})
+	}
+	if int64(len(msgs)) <= pgn.start() {
+		return nil, nil
+	}
+	var events []*AuditEvent
+	for _, m := range msgs[pgn.start():] {
+		events = append(events, parseAuditEvent(m))
+	}
+	return events, nil
+}
+
+func parseAuditEvent(m redis.XMessage) *AuditEvent {
+	str := func(field string) string {
+		s, _ := m.Values[field].(string)
+		return s
+	}
+	count, _ := strconv.Atoi(str("count"))
+	nsec, _ := strconv.ParseInt(str("time"), 10, 64)
+	return &AuditEvent{
+		ID:       m.ID,
+		Event:    str("event"),
+		TaskID:   str("task_id"),
+		TaskType: str("task_type"),
+		State:    str("state"),
+		Count:    count,
+		Reason:   str("reason"),
+		Operator: str("operator") == "1",
+		Actor:    str("actor"),
+		Time:     time.Unix(0, nsec),
+	}
+}
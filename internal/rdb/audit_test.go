@@ -0,0 +1,204 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/timeutil"
+)
+
+func TestAuditLog(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	now := time.Now()
+	r.SetClock(timeutil.NewSimulatedClock(now))
+	r.SetAuditLog(true)
+	ctx := context.Background()
+
+	m1 := h.NewTaskMessage("task1", nil)
+	m2 := h.NewTaskMessage("task2", nil)
+	if err := r.Enqueue(ctx, m1); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Schedule(ctx, m2, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	msg, _, err := r.Dequeue(base.DefaultQueueName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Retry(msg, now.Add(time.Minute), "oops", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RunTask(m1.Queue, m1.ID); err != nil {
+		t.Fatal(err)
+	}
+	if msg, _, err = r.Dequeue(base.DefaultQueueName); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Archive(msg, "oops again", base.ArchiveReasonMaxRetry); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ArchiveTask(m2.Queue, m2.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.DeleteTask(m1.Queue, m1.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.DeleteAllArchivedTasks(base.DefaultQueueName); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.DeleteAllRetryTasks(base.DefaultQueueName); err != nil {
+		t.Fatal(err) // no task deleted, not recorded.
+	}
+
+	want := []*AuditEvent{
+		{Event: AuditDeleted, State: "archived", Count: 1, Operator: true},
+		{Event: AuditDeleted, TaskID: m1.ID, Count: 1, Operator: true},
+		{Event: AuditArchived, TaskID: m2.ID, Count: 1, Operator: true},
+		{Event: AuditArchived, TaskID: m1.ID, TaskType: "task1", Count: 1, Reason: "oops again"},
+		{Event: AuditStarted, TaskID: m1.ID, TaskType: "task1", Count: 1},
+		{Event: AuditRun, TaskID: m1.ID, Count: 1, Operator: true},
+		{Event: AuditRetried, TaskID: m1.ID, TaskType: "task1", Count: 1, Reason: "oops"},
+		{Event: AuditStarted, TaskID: m1.ID, TaskType: "task1", Count: 1},
+		{Event: AuditScheduled, TaskID: m2.ID, TaskType: "task2", Count: 1},
+		{Event: AuditEnqueued, TaskID: m1.ID, TaskType: "task1", Count: 1},
+	}
+	got, err := r.ListAuditEvents(base.DefaultQueueName, Pagination{Size: 20, Page: 0})
+	if err != nil {
+		t.Fatalf("ListAuditEvents returned error: %v", err)
+	}
+	for _, e := range got {
+		if !e.Time.Equal(now) || e.ID == "" {
+			t.Errorf("event %+v has time %v and ID %q, want time %v and non-empty ID", e, e.Time, e.ID, now)
+		}
+	}
+	ignoreOpt := cmpopts.IgnoreFields(AuditEvent{}, "ID", "Time")
+	if diff := cmp.Diff(want, got, ignoreOpt); diff != "" {
+		t.Errorf("ListAuditEvents returned unexpected events; (-want,+got)\n%s", diff)
+	}
+
+	got, err = r.ListAuditEvents(base.DefaultQueueName, Pagination{Size: 3, Page: 1})
+	if err != nil {
+		t.Fatalf("ListAuditEvents returned error: %v", err)
+	}
+	if diff := cmp.Diff(want[3:6], got, ignoreOpt); diff != "" {
+		t.Errorf("ListAuditEvents returned unexpected second page; (-want,+got)\n%s", diff)
+	}
+	got, err = r.ListAuditEvents(base.DefaultQueueName, Pagination{Size: 20, Page: 1})
+	if err != nil || len(got) != 0 {
+		t.Errorf("ListAuditEvents past the last page returned (%v, %v), want (nil, nil)", got, err)
+	}
+}
+
+func TestAuditLogDisabled(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	ctx := context.Background()
+
+	msg := h.NewTaskMessage("task1", nil)
+	if err := r.Enqueue(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.DeleteTask(msg.Queue, msg.ID); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.client.Exists(ctx, base.AuditKey(msg.Queue)).Val(); n != 0 {
+		t.Errorf("%q exists with audit log disabled, want no audit log", base.AuditKey(msg.Queue))
+	}
+	got, err := r.ListAuditEvents(msg.Queue, Pagination{Size: 20, Page: 0})
+	if err != nil || len(got) != 0 {
+		t.Errorf("ListAuditEvents returned (%v, %v), want (nil, nil)", got, err)
+	}
+}
+
+func TestAuditLogActor(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	r.SetAuditLog(true)
+	ctx := context.Background()
+
+	msg := h.NewTaskMessage("task1", nil)
+	if err := r.Enqueue(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	alice := r.WithAuditActor("alice")
+	if err := alice.Pause(msg.Queue); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Unpause(msg.Queue); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.DeleteTask(msg.Queue, msg.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.DrainQueue(msg.Queue); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.RemoveQueue(msg.Queue, false); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []*AuditEvent{
+		{Event: AuditRemoved, Operator: true, Actor: "alice"},
+		{Event: AuditDraining, Operator: true},
+		{Event: AuditDeleted, TaskID: msg.ID, Count: 1, Operator: true, Actor: "alice"},
+		{Event: AuditUnpaused, Operator: true, Actor: "alice"},
+		{Event: AuditPaused, Operator: true, Actor: "alice"},
+		{Event: AuditEnqueued, TaskID: msg.ID, TaskType: "task1", Count: 1},
+	}
+	got, err := r.ListAuditEvents(msg.Queue, Pagination{Size: 20, Page: 0})
+	if err != nil {
+		t.Fatalf("ListAuditEvents returned error: %v", err)
+	}
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreFields(AuditEvent{}, "ID", "Time")); diff != "" {
+		t.Errorf("ListAuditEvents returned unexpected events; (-want,+got)\n%s", diff)
+	}
+}
+
+func TestAuditLogRequeuedAndCloned(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	r.SetAuditLog(true)
+	ctx := context.Background()
+
+	msg := h.NewTaskMessage("task1", nil)
+	h.SeedActiveQueue(t, r.client, []*base.TaskMessage{msg}, msg.Queue)
+	server := &base.ServerInfo{Host: "127.0.0.1", PID: 1234, ServerID: "dead", Status: "active"}
+	worker := &base.WorkerInfo{
+		Host: server.Host, PID: server.PID, ServerID: server.ServerID, ID: msg.ID, Type: msg.Type,
+		Queue: msg.Queue, Started: time.Now(), Deadline: time.Now().Add(time.Hour),
+	}
+	if err := r.WriteServerState(server, []*base.WorkerInfo{worker}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.RequeueOrphans(server.ServerID); err != nil {
+		t.Fatal(err)
+	}
+	clone := h.NewTaskMessage("task1", nil)
+	clone.ClonedFrom = msg.ID
+	if err := r.Enqueue(ctx, clone); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []*AuditEvent{
+		{Event: AuditCloned, TaskID: clone.ID, Count: 1, Operator: true},
+		{Event: AuditRequeued, TaskID: msg.ID, State: "active", Count: 1, Operator: true},
+	}
+	got, err := r.ListAuditEvents(msg.Queue, Pagination{Size: 20, Page: 0})
+	if err != nil {
+		t.Fatalf("ListAuditEvents returned error: %v", err)
+	}
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreFields(AuditEvent{}, "ID", "Time")); diff != "" {
+		t.Errorf("ListAuditEvents returned unexpected events; (-want,+got)\n%s", diff)
+	}
+}
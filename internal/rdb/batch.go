@@ -0,0 +1,150 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq/internal/errors"
+)
+
+// batcher coalesces the script calls made from many goroutines into pipelined
+// round-trips to redis.
+//
+// A call waits until the batch it belongs to is flushed, either when the
+// batch reaches the size threshold or when the interval elapses after the
+// first call of the batch, and returns the result of its own script.
+type batcher struct {
+	client   redis.UniversalClient
+	interval time.Duration
+	size     int
+
+	mu      sync.Mutex
+	pending []*batchCall // calls waiting for the next flush
+	timer   *time.Timer  // fires the flush of pending calls; nil if no calls are pending
+}
+
+type batchCall struct {
+	script *redis.Script
+	keys   []string
+	args   []interface{}
+	errc   chan error // receives the result of the call
+}
+
+func newBatcher(client redis.UniversalClient, interval time.Duration, size int) *batcher {
+	return &batcher{
+		client:   client,
+		interval: interval,
+		size:     size,
+	}
+}
+
+// run adds the script call to the current batch and waits for its result.
+func (b *batcher) run(script *redis.Script, keys []string, args ...interface{}) error {
+	call := &batchCall{
+		script: script,
+		keys:   keys,
+		args:   args,
+		errc:   make(chan error, 1),
+	}
+	b.mu.Lock()
+	b.pending = append(b.pending, call)
+	var calls []*batchCall
+	switch {
+	case len(b.pending) >= b.size:
+		calls = b.take()
+	case b.timer == nil:
+		b.timer = time.AfterFunc(b.interval, b.flush)
+	}
+	b.mu.Unlock()
+	if calls != nil {
+		b.exec(calls)
+	}
+	return <-call.errc
+}
+
+// take returns the pending calls and resets the batch.
+// Caller must hold b.mu.
+func (b *batcher) take() []*batchCall {
+	calls := b.pending
+	b.pending = nil
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	return calls
+}
+
+// flush executes the pending calls, if any.
+func (b *batcher) flush() {
+	b.mu.Lock()
+	calls := b.take()
+	b.mu.Unlock()
+	if len(calls) > 0 {
+		b.exec(calls)
+	}
+}
+
+// exec runs the calls in a single pipeline and sends each call its result.
+func (b *batcher) exec(calls []*batchCall) {
+	ctx := context.Background()
+	pipe := b.client.Pipeline()
+	cmds := make([]*redis.Cmd, len(calls))
+	for i, c := range calls {
+		cmds[i] = c.script.EvalSha(ctx, pipe, c.keys, c.args...)
+	}
+	pipe.Exec(ctx) // errors are reported by each command
+	for i, c := range calls {
+		err := cmds[i].Err()
+		if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT ") {
+			// The script is not cached in redis yet; Run loads it.
+			err = c.script.Run(ctx, b.client, c.keys, c.args...).Err()
+		}
+		c.errc <- err
+	}
+}
+
+// SetAckBatching enables coalescing the acknowledgements of processed tasks
+// (i.e. Done, MarkAsComplete, Retry and Archive) made from many goroutines
+// into pipelined round-trips to redis. A batch is flushed when it holds size
+// acknowledgements, or after the interval elapses since its first one.
+//
+// Each acknowledgement still runs its own script and returns its own result;
+// only the round-trips are shared, at the cost of up to interval of latency.
+// Batching is disabled if interval or size is less than one.
+func (r *RDB) SetAckBatching(interval time.Duration, size int) {
+	if interval <= 0 || size <= 0 {
+		r.acks = nil
+		return
+	}
+	r.acks = newBatcher(r.client, interval, size)
+}
+
+// runAckScript runs the script acknowledging a processed task, as part of a
+// batch if batching is enabled.
+//
+// The returned error has the NotFound code if the task is not active anymore,
+// and wraps the redis error otherwise, so that errors.IsTransient reports
+// whether the acknowledgement can be retried (e.g. after a failover).
+func (r *RDB) runAckScript(ctx context.Context, op errors.Op, script *redis.Script, keys []string, args ...interface{}) error {
+	var err error
+	if r.acks == nil {
+		err = script.Run(ctx, r.client, keys, args...).Err()
+	} else {
+		err = r.acks.run(script, keys, args...)
+	}
+	switch {
+	case err == nil:
+		return nil
+	case strings.HasPrefix(err.Error(), "NOT FOUND"):
+		return errors.E(op, errors.NotFound, "task is not active")
+	default:
+		return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
+	}
+}
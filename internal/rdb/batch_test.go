@@ -0,0 +1,161 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/errors"
+)
+
+// pipelineCounter counts the pipelines sent to redis.
+type pipelineCounter struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (c *pipelineCounter) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+func (c *pipelineCounter) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (c *pipelineCounter) AfterProcess(ctx context.Context, cmd redis.Cmder) error { return nil }
+
+func (c *pipelineCounter) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n++
+	return ctx, nil
+}
+
+func (c *pipelineCounter) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+func seedActiveTasks(t *testing.T, r *RDB, msgs []*base.TaskMessage) {
+	t.Helper()
+	h.SeedActiveQueue(t, r.client, msgs, base.DefaultQueueName)
+	var deadlines []base.Z
+	for _, msg := range msgs {
+		deadlines = append(deadlines, base.Z{Message: msg, Score: time.Now().Add(time.Hour).Unix()})
+	}
+	h.SeedDeadlines(t, r.client, deadlines, base.DefaultQueueName)
+}
+
+func TestAckBatchingBySize(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	h.FlushDB(t, r.client)
+	// Acknowledgements must load the scripts which aren't cached yet.
+	if err := r.client.ScriptFlush(context.Background()).Err(); err != nil {
+		t.Fatal(err)
+	}
+	msgs := []*base.TaskMessage{
+		h.NewTaskMessage("task1", nil),
+		h.NewTaskMessage("task2", nil),
+		h.NewTaskMessage("task3", nil),
+		h.NewTaskMessage("task4", nil),
+	}
+	seedActiveTasks(t, r, msgs[:3])
+	r.SetAckBatching(time.Hour, len(msgs))
+	counter := &pipelineCounter{}
+	r.client.AddHook(counter)
+
+	errs := make([]error, len(msgs))
+	var wg sync.WaitGroup
+	for i, msg := range msgs {
+		wg.Add(1)
+		go func(i int, msg *base.TaskMessage) {
+			defer wg.Done()
+			if i == 0 {
+				errs[i] = r.Retry(msg, time.Now().Add(time.Minute), "oops", true)
+			} else {
+				errs[i] = r.Done(msg)
+			}
+		}(i, msg)
+	}
+	wg.Wait()
+
+	for i, err := range errs[:3] {
+		if err != nil {
+			t.Errorf("acknowledgement of %s returned error: %v", msgs[i].Type, err)
+		}
+	}
+	// msgs[3] is not active.
+	if errs[3] == nil {
+		t.Errorf("(*RDB).Done(%s) returned nil error, want non-nil error", msgs[3].Type)
+	}
+	if got := counter.count(); got != 1 {
+		t.Errorf("acknowledgements were sent in %d pipelines, want 1", got)
+	}
+	if n := r.client.LLen(context.Background(), base.ActiveKey(base.DefaultQueueName)).Val(); n != 0 {
+		t.Errorf("LLEN %q = %d, want 0", base.ActiveKey(base.DefaultQueueName), n)
+	}
+	if n := r.client.ZCard(context.Background(), base.RetryKey(base.DefaultQueueName)).Val(); n != 1 {
+		t.Errorf("ZCARD %q = %d, want 1", base.RetryKey(base.DefaultQueueName), n)
+	}
+}
+
+func TestAckBatchingByInterval(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	h.FlushDB(t, r.client)
+	msg := h.NewTaskMessage("task1", nil)
+	seedActiveTasks(t, r, []*base.TaskMessage{msg})
+	r.SetAckBatching(20*time.Millisecond, 100)
+
+	start := time.Now()
+	if err := r.Archive(msg, "oops", base.ArchiveReasonMaxRetry); err != nil {
+		t.Fatalf("(*RDB).Archive returned error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("(*RDB).Archive returned after %v, want to wait for the batch interval", elapsed)
+	}
+	if n := r.client.ZCard(context.Background(), base.ArchivedKey(base.DefaultQueueName)).Val(); n != 1 {
+		t.Errorf("ZCARD %q = %d, want 1", base.ArchivedKey(base.DefaultQueueName), n)
+	}
+
+	// Disabling batching runs acknowledgements right away.
+	r.SetAckBatching(0, 0)
+	msg2 := h.NewTaskMessage("task2", nil)
+	seedActiveTasks(t, r, []*base.TaskMessage{msg2})
+	if err := r.Done(msg2); err != nil {
+		t.Errorf("(*RDB).Done returned error: %v", err)
+	}
+}
+
+func TestAckErrorCodes(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+
+	for _, batching := range []bool{false, true} {
+		h.FlushDB(t, r.client)
+		if batching {
+			r.SetAckBatching(time.Millisecond, 100)
+		} else {
+			r.SetAckBatching(0, 0)
+		}
+		msg := h.NewTaskMessage("task1", nil) // not active
+		err := r.Done(msg)
+		if errors.CanonicalCode(err) != errors.NotFound {
+			t.Errorf("batching=%t: (*RDB).Done for inactive task returned %v, want NotFound error", batching, err)
+		}
+		if errors.IsTransient(err) {
+			t.Errorf("batching=%t: (*RDB).Done for inactive task returned transient error %v", batching, err)
+		}
+	}
+	r.SetAckBatching(0, 0)
+}
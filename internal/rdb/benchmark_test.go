@@ -217,7 +217,7 @@ func BenchmarkArchive(b *testing.B) {
 		asynqtest.SeedDeadlines(b, r.client, zs, base.DefaultQueueName)
 		b.StartTimer()
 
-		if err := r.Archive(msgs[0], "error"); err != nil {
+		if err := r.Archive(msgs[0], "error", base.ArchiveReasonMaxRetry); err != nil {
 			b.Fatalf("Archive failed: %v", err)
 		}
 	}
@@ -271,3 +271,43 @@ func BenchmarkCheckAndEnqueue(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkEnqueuePayloadSize(b *testing.B) {
+	r := setup(b)
+	ctx := context.Background()
+	for _, size := range []int{128, 4 << 10, 64 << 10} {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			asynqtest.FlushDB(b, r.client)
+			payload := make([]byte, size)
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				msg := asynqtest.NewTaskMessage("task1", payload)
+				if err := r.Enqueue(ctx, msg); err != nil {
+					b.Fatalf("Enqueue failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMarkAsComplete(b *testing.B) {
+	r := setup(b)
+	m1 := asynqtest.NewTaskMessage("task1", nil)
+	m1.Retention = 3600
+	zs := []base.Z{{Message: m1, Score: time.Now().Add(10 * time.Second).Unix()}}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		asynqtest.FlushDB(b, r.client)
+		asynqtest.SeedActiveQueue(b, r.client, []*base.TaskMessage{m1}, base.DefaultQueueName)
+		asynqtest.SeedDeadlines(b, r.client, zs, base.DefaultQueueName)
+		b.StartTimer()
+
+		if err := r.MarkAsComplete(m1); err != nil {
+			b.Fatalf("MarkAsComplete failed: %v", err)
+		}
+	}
+}
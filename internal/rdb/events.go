@@ -0,0 +1,120 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/errors"
+)
+
+// EventCompleted is published when a task is processed successfully.
+// Unlike the other events, it is not recorded in the audit log.
+const EventCompleted = "completed"
+
+// QueueEvent is an event published to the subscribers of a queue.
+type QueueEvent struct {
+	Queue    string    `json:"queue"`
+	Event    string    `json:"event"`
+	TaskID   string    `json:"task_id,omitempty"`
+	TaskType string    `json:"task_type,omitempty"`
+	State    string    `json:"state,omitempty"`
+	Count    int       `json:"count"`
+	Reason   string    `json:"reason,omitempty"`
+	Operator bool      `json:"operator,omitempty"`
+	Actor    string    `json:"actor,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// SetEventPublishing enables or disables publishing of events to the subscribers of queues.
+//
+// When enabled, the events recorded in audit logs (see SetAuditLog) are also
+// published to the PubSub channel of the queue, as well as an EventCompleted
+// event for each task processed successfully.
+//
+// Note: PubSub messages are delivered to the connected subscribers at most once.
+// Events published while no one is subscribed are lost.
+func (r *RDB) SetEventPublishing(enabled bool) {
+	r.events = enabled
+}
+
+// publishTaskEvent publishes an event about the given task to the subscribers of its queue.
+func (r *RDB) publishTaskEvent(ctx context.Context, event string, msg *base.TaskMessage) {
+	r.publishEvent(ctx, msg.Queue, &AuditEvent{
+		Event:    event,
+		TaskID:   msg.ID,
+		TaskType: msg.Type,
+		Count:    1,
+	})
+}
+
+// publishEvent publishes the event to the subscribers of the queue, if enabled.
+// Errors are ignored, since the transition of the task has already completed.
+func (r *RDB) publishEvent(ctx context.Context, qname string, e *AuditEvent) {
+	if !r.events {
+		return
+	}
+	data, err := json.Marshal(&QueueEvent{
+		Queue:    qname,
+		Event:    e.Event,
+		TaskID:   e.TaskID,
+		TaskType: e.TaskType,
+		State:    e.State,
+		Count:    e.Count,
+		Reason:   e.Reason,
+		Operator: e.Operator,
+		Actor:    e.Actor,
+		Time:     r.clock.Now(),
+	})
+	if err != nil {
+		return
+	}
+	r.client.Publish(ctx, base.EventsChannel(qname), data)
+}
+
+// EventsPubSub returns a pubsub for the events of the given queues,
+// or of all queues if no queue is given.
+// Use DecodeQueueEvent to decode the payloads of the messages.
+func (r *RDB) EventsPubSub(qnames ...string) (*redis.PubSub, error) {
+	var op errors.Op = "rdb.EventsPubSub"
+	ctx := context.Background()
+	var pubsub *redis.PubSub
+	if len(qnames) == 0 {
+		pubsub = r.client.PSubscribe(ctx, base.EventsChannelPrefix+"*")
+	} else {
+		channels := make([]string, len(qnames))
+		for i, qname := range qnames {
+			channels[i] = base.EventsChannel(qname)
+		}
+		pubsub = r.client.Subscribe(ctx, channels...)
+	}
+	// Wait for the confirmation of each subscription, so that no event
+	// published after EventsPubSub returns is missed.
+	n := len(qnames)
+	if n == 0 {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		if _, err := pubsub.Receive(ctx); err != nil {
+			pubsub.Close()
+			return nil, errors.E(op, errors.Unknown, fmt.Sprintf("redis pubsub receive error: %v", err))
+		}
+	}
+	return pubsub, nil
+}
+
+// DecodeQueueEvent decodes the payload of a message received from the pubsub returned by EventsPubSub.
+func DecodeQueueEvent(msg *redis.Message) (*QueueEvent, error) {
+	var e QueueEvent
+	if err := json.Unmarshal([]byte(msg.Payload), &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// receiveEvents receives n events from the pubsub.
+func receiveEvents(t *testing.T, pubsub *redis.PubSub, n int) []*QueueEvent {
+	t.Helper()
+	var events []*QueueEvent
+	for i := 0; i < n; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		msg, err := pubsub.ReceiveMessage(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("ReceiveMessage returned error after %d events: %v", i, err)
+		}
+		e, err := DecodeQueueEvent(msg)
+		if err != nil {
+			t.Fatalf("DecodeQueueEvent(%q) returned error: %v", msg.Payload, err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestEventPublishing(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	h.FlushDB(t, r.client)
+	r.SetEventPublishing(true)
+
+	all, err := r.EventsPubSub()
+	if err != nil {
+		t.Fatalf("EventsPubSub() returned error: %v", err)
+	}
+	defer all.Close()
+	critical, err := r.EventsPubSub("critical")
+	if err != nil {
+		t.Fatalf("EventsPubSub(%q) returned error: %v", "critical", err)
+	}
+	defer critical.Close()
+
+	m1 := h.NewTaskMessageWithQueue("task1", nil, "critical")
+	m2 := h.NewTaskMessageWithQueue("task2", nil, "low")
+	ctx := context.Background()
+	for _, msg := range []*base.TaskMessage{m1, m2} {
+		if err := r.Enqueue(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, _, err := r.Dequeue("critical")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Done(got); err != nil {
+		t.Fatal(err)
+	}
+
+	ignoreTime := cmpopts.IgnoreFields(QueueEvent{}, "Time")
+	want := []*QueueEvent{
+		{Queue: "critical", Event: AuditEnqueued, TaskID: m1.ID, TaskType: m1.Type, Count: 1},
+		{Queue: "critical", Event: AuditStarted, TaskID: m1.ID, TaskType: m1.Type, Count: 1},
+		{Queue: "critical", Event: EventCompleted, TaskID: m1.ID, TaskType: m1.Type, Count: 1},
+	}
+	if diff := cmp.Diff(want, receiveEvents(t, critical, len(want)), ignoreTime); diff != "" {
+		t.Errorf("events of %q mismatch; (-want,+got)\n%s", "critical", diff)
+	}
+	want = []*QueueEvent{
+		{Queue: "critical", Event: AuditEnqueued, TaskID: m1.ID, TaskType: m1.Type, Count: 1},
+		{Queue: "low", Event: AuditEnqueued, TaskID: m2.ID, TaskType: m2.Type, Count: 1},
+		{Queue: "critical", Event: AuditStarted, TaskID: m1.ID, TaskType: m1.Type, Count: 1},
+		{Queue: "critical", Event: EventCompleted, TaskID: m1.ID, TaskType: m1.Type, Count: 1},
+	}
+	if diff := cmp.Diff(want, receiveEvents(t, all, len(want)), ignoreTime); diff != "" {
+		t.Errorf("events of all queues mismatch; (-want,+got)\n%s", diff)
+	}
+}
@@ -7,6 +7,8 @@ package rdb
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -32,6 +34,9 @@ type Stats struct {
 	// Paused indicates whether the queue is paused.
 	// If true, tasks in the queue should not be processed.
 	Paused bool
+	// Draining indicates whether the queue is draining.
+	// If true, new tasks should not be enqueued to the queue.
+	Draining bool
 	// Size is the total number of tasks in the queue.
 	Size int
 	// Number of tasks in each state.
@@ -41,6 +46,12 @@ type Stats struct {
 	Retry     int
 	Archived  int
 	Completed int
+	Waiting   int
+	Unhandled int
+
+	// Number of tasks whose data could not be decoded.
+	// Quarantined tasks are not included in Size.
+	Quarantined int
 
 	// Number of tasks processed within the current date.
 	// The number includes both succeeded and failed tasks.
@@ -52,6 +63,16 @@ type Stats struct {
 	ProcessedTotal int
 	// Total number of tasks failed.
 	FailedTotal int
+	// Total number of tasks processed without a handler registered for their type.
+	UnhandledTotal int
+	// Total number of tasks deleted because their data could not be decoded.
+	DroppedTotal int
+
+	// Number of enqueues rejected as duplicates, by task type.
+	Duplicates map[string]int
+
+	// Environment the database is labeled with, empty if unlabeled.
+	Environment string
 
 	// Latency of the queue, measured by the oldest pending task in the queue.
 	Latency time.Duration
@@ -83,11 +104,32 @@ type DailyStats struct {
 // KEYS[9] ->  asynq:<qname>:processed
 // KEYS[10] -> asynq:<qname>:failed
 // KEYS[11] -> asynq:<qname>:paused
+// KEYS[12] -> asynq:<qname>:waiting
+// KEYS[13] -> asynq:<qname>:draining
+// KEYS[14] -> asynq:<qname>:quarantine
+// KEYS[15] -> asynq:<qname>:unhandled
+// KEYS[16] -> asynq:<qname>:unhandled_total
+// KEYS[17] -> asynq:<qname>:dropped_total
+// KEYS[18] -> asynq:<qname>:pending_lists
 //
 // ARGV[1] -> task key prefix
-var currentStatsCmd = redis.NewScript(`
+//
+// Note: The pending tasks include the tasks set aside by dequeueCmd, and the oldest
+// pending task is the oldest of the last tasks of their lists.
+var currentStatsCmd = newScript("currentStats", pendingListsLua+`
 local res = {}
-local pendingTaskCount = redis.call("LLEN", KEYS[1])
+local pendingTaskCount = 0
+local oldestPendingSince
+for _, list in ipairs(pending_lists(KEYS[1], KEYS[18])) do
+	local id = redis.call("LINDEX", list, -1)
+	if id then
+		pendingTaskCount = pendingTaskCount + redis.call("LLEN", list)
+		local since = redis.call("HGET", ARGV[1] .. id, "pending_since")
+		if since and (not oldestPendingSince or tonumber(since) < tonumber(oldestPendingSince)) then
+			oldestPendingSince = since
+		end
+	end
+end
 table.insert(res, KEYS[1])
 table.insert(res, pendingTaskCount)
 table.insert(res, KEYS[2])
@@ -111,13 +153,20 @@ for i=7,10 do
 end
 table.insert(res, KEYS[11])
 table.insert(res, redis.call("EXISTS", KEYS[11]))
+table.insert(res, KEYS[12])
+table.insert(res, redis.call("ZCARD", KEYS[12]))
+table.insert(res, KEYS[13])
+table.insert(res, redis.call("EXISTS", KEYS[13]))
+table.insert(res, KEYS[14])
+table.insert(res, redis.call("ZCARD", KEYS[14]))
+table.insert(res, KEYS[15])
+table.insert(res, redis.call("ZCARD", KEYS[15]))
+table.insert(res, KEYS[16])
+table.insert(res, tonumber(redis.call("GET", KEYS[16]) or 0))
+table.insert(res, KEYS[17])
+table.insert(res, tonumber(redis.call("GET", KEYS[17]) or 0))
 table.insert(res, "oldest_pending_since")
-if pendingTaskCount > 0 then
-	local id = redis.call("LRANGE", KEYS[1], -1, -1)[1]
-	table.insert(res, redis.call("HGET", ARGV[1] .. id, "pending_since"))
-else
-	table.insert(res, 0)
-end
+table.insert(res, oldestPendingSince or 0)
 return res`)
 
 // CurrentStats returns a current state of the queues.
@@ -125,7 +174,7 @@ func (r *RDB) CurrentStats(qname string) (*Stats, error) {
 	var op errors.Op = "rdb.CurrentStats"
 	exists, err := r.queueExists(qname)
 	if err != nil {
-		return nil, errors.E(op, errors.Unknown, err)
+		return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "sismember", Err: err})
 	}
 	if !exists {
 		return nil, errors.E(op, errors.NotFound, &errors.QueueNotFoundError{Queue: qname})
@@ -143,6 +192,13 @@ func (r *RDB) CurrentStats(qname string) (*Stats, error) {
 		base.ProcessedTotalKey(qname),
 		base.FailedTotalKey(qname),
 		base.PausedKey(qname),
+		base.WaitingKey(qname),
+		base.DrainingKey(qname),
+		base.QuarantineKey(qname),
+		base.UnhandledKey(qname),
+		base.UnhandledTotalKey(qname),
+		base.DroppedTotalKey(qname),
+		base.PendingListsKey(qname),
 	}, base.TaskKeyPrefix(qname)).Result()
 	if err != nil {
 		return nil, errors.E(op, errors.Unknown, err)
@@ -178,6 +234,12 @@ func (r *RDB) CurrentStats(qname string) (*Stats, error) {
 		case base.CompletedKey(qname):
 			stats.Completed = val
 			size += val
+		case base.WaitingKey(qname):
+			stats.Waiting = val
+			size += val
+		case base.UnhandledKey(qname):
+			stats.Unhandled = val
+			size += val
 		case base.ProcessedKey(qname, now):
 			stats.Processed = val
 		case base.FailedKey(qname, now):
@@ -192,6 +254,14 @@ func (r *RDB) CurrentStats(qname string) (*Stats, error) {
 			} else {
 				stats.Paused = true
 			}
+		case base.DrainingKey(qname):
+			stats.Draining = val != 0
+		case base.QuarantineKey(qname):
+			stats.Quarantined = val
+		case base.UnhandledTotalKey(qname):
+			stats.UnhandledTotal = val
+		case base.DroppedTotalKey(qname):
+			stats.DroppedTotal = val
 		case "oldest_pending_since":
 			if val == 0 {
 				stats.Latency = 0
@@ -201,6 +271,21 @@ func (r *RDB) CurrentStats(qname string) (*Stats, error) {
 		}
 	}
 	stats.Size = size
+	dups, err := r.client.HGetAll(context.Background(), base.DuplicatesKey(qname)).Result()
+	if err != nil {
+		return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "hgetall", Err: err})
+	}
+	if len(dups) > 0 {
+		stats.Duplicates = make(map[string]int, len(dups))
+		for typename, n := range dups {
+			stats.Duplicates[typename] = cast.ToInt(n)
+		}
+	}
+	env, err := r.client.Get(context.Background(), base.EnvironmentKey).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "get", Err: err})
+	}
+	stats.Environment = env
 	memusg, err := r.memoryUsage(qname)
 	if err != nil {
 		return nil, errors.E(op, errors.CanonicalCode(err), err)
@@ -219,28 +304,31 @@ func (r *RDB) CurrentStats(qname string) (*Stats, error) {
 // KEYS[4] -> asynq:{qname}:retry
 // KEYS[5] -> asynq:{qname}:archived
 // KEYS[6] -> asynq:{qname}:completed
+// KEYS[7] -> asynq:{qname}:pending_lists
 //
 // ARGV[1] -> asynq:{qname}:t:
 // ARGV[2] -> sample_size (e.g 20)
-var memoryUsageCmd = redis.NewScript(`
+var memoryUsageCmd = newScript("memoryUsage", pendingListsLua+`
 local sample_size = tonumber(ARGV[2])
 if sample_size <= 0 then
     return redis.error_reply("sample size must be a positive number")
 end
 local memusg = 0
-for i=1,2 do
-    local ids = redis.call("LRANGE", KEYS[i], 0, sample_size - 1)
+local lists = pending_lists(KEYS[2], KEYS[7])
+table.insert(lists, KEYS[1])
+for _, list in ipairs(lists) do
+    local ids = redis.call("LRANGE", list, 0, sample_size - 1)
     local sample_total = 0
     if (table.getn(ids) > 0) then
         for _, id in ipairs(ids) do
             local bytes = redis.call("MEMORY", "USAGE", ARGV[1] .. id)
             sample_total = sample_total + bytes
         end
-        local n = redis.call("LLEN", KEYS[i])
+        local n = redis.call("LLEN", list)
         local avg = sample_total / table.getn(ids)
         memusg = memusg + (avg * n)
     end
-    local m = redis.call("MEMORY", "USAGE", KEYS[i])
+    local m = redis.call("MEMORY", "USAGE", list)
     if (m) then
         memusg = memusg + m
     end
@@ -275,6 +363,7 @@ func (r *RDB) memoryUsage(qname string) (int64, error) {
 		base.RetryKey(qname),
 		base.ArchivedKey(qname),
 		base.CompletedKey(qname),
+		base.PendingListsKey(qname),
 	}
 	argv := []interface{}{
 		base.TaskKeyPrefix(qname),
@@ -282,7 +371,7 @@ func (r *RDB) memoryUsage(qname string) (int64, error) {
 	}
 	res, err := memoryUsageCmd.Run(context.Background(), r.client, keys, argv...).Result()
 	if err != nil {
-		return 0, errors.E(op, errors.Unknown, fmt.Sprintf("redis eval error: %v", err))
+		return 0, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
 	}
 	usg, err := cast.ToInt64E(res)
 	if err != nil {
@@ -291,7 +380,7 @@ func (r *RDB) memoryUsage(qname string) (int64, error) {
 	return usg, nil
 }
 
-var historicalStatsCmd = redis.NewScript(`
+var historicalStatsCmd = newScript("historicalStats", `
 local res = {}
 for _, key in ipairs(KEYS) do
 	local n = redis.call("GET", key)
@@ -327,7 +416,7 @@ func (r *RDB) HistoricalStats(qname string, n int) ([]*DailyStats, error) {
 	}
 	res, err := historicalStatsCmd.Run(context.Background(), r.client, keys).Result()
 	if err != nil {
-		return nil, errors.E(op, errors.Unknown, fmt.Sprintf("redis eval error: %v", err))
+		return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
 	}
 	data, err := cast.ToIntSliceE(res)
 	if err != nil {
@@ -345,6 +434,201 @@ func (r *RDB) HistoricalStats(qname string, n int) ([]*DailyStats, error) {
 	return stats, nil
 }
 
+// QueueSample holds the number of tasks in each state of a queue at a given time.
+type QueueSample struct {
+	Queue string
+	// Size is the total number of tasks in the queue.
+	Size int
+	// Number of tasks in each state.
+	Pending   int
+	Active    int
+	Scheduled int
+	Retry     int
+	Archived  int
+	Completed int
+	Waiting   int
+	Unhandled int
+	// Time this sample was taken.
+	Time time.Time
+}
+
+// QueueHistory returns the samples of the sizes of the given queue taken since the given time,
+// sorted by time in ascending order.
+func (r *RDB) QueueHistory(qname string, since time.Time) ([]*QueueSample, error) {
+	var op errors.Op = "rdb.QueueHistory"
+	exists, err := r.queueExists(qname)
+	if err != nil {
+		return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "sismember", Err: err})
+	}
+	if !exists {
+		return nil, errors.E(op, errors.NotFound, &errors.QueueNotFoundError{Queue: qname})
+	}
+	members, err := r.client.ZRangeByScore(context.Background(), base.QueueHistoryKey(qname), &redis.ZRangeBy{
+		Min: fmt.Sprintf("%d", since.UnixNano()/int64(time.Millisecond)),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "zrangebyscore", Err: err})
+	}
+	var samples []*QueueSample
+	for _, m := range members {
+		s, err := parseQueueSample(qname, m)
+		if err != nil {
+			return nil, errors.E(op, errors.Internal, err)
+		}
+		samples = append(samples, s)
+	}
+	return samples, nil
+}
+
+// ListTaskSamples returns the sampled tasks of the given queue, most recent first.
+func (r *RDB) ListTaskSamples(qname string) ([]*base.TaskSample, error) {
+	var op errors.Op = "rdb.ListTaskSamples"
+	if err := r.checkQueueExists(qname); err != nil {
+		return nil, errors.E(op, errors.CanonicalCode(err), err)
+	}
+	members, err := r.client.LRange(context.Background(), base.TaskSamplesKey(qname), 0, -1).Result()
+	if err != nil {
+		return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "lrange", Err: err})
+	}
+	var samples []*base.TaskSample
+	for _, m := range members {
+		s, err := parseTaskSample(m)
+		if err != nil {
+			return nil, errors.E(op, errors.Internal, err)
+		}
+		samples = append(samples, s)
+	}
+	return samples, nil
+}
+
+// LatencyHistogram counts latencies in the buckets of base.LatencyBuckets.
+type LatencyHistogram struct {
+	// Counts holds the number of latencies in each bucket, followed by the
+	// number of latencies in the overflow bucket.
+	Counts []int64
+	// Sum is the sum of the latencies.
+	Sum time.Duration
+}
+
+// TaskLatencyHistograms holds the latency histograms of the tasks of a type.
+type TaskLatencyHistograms struct {
+	// Wait counts the times from the enqueue of the tasks to the start of their processing.
+	Wait *LatencyHistogram
+	// Run counts the times the handler took to process the tasks.
+	Run *LatencyHistogram
+}
+
+// ListLatencyHistograms returns the latency histograms of the completed tasks of
+// the given queue per task type.
+func (r *RDB) ListLatencyHistograms(qname string) (map[string]*TaskLatencyHistograms, error) {
+	var op errors.Op = "rdb.ListLatencyHistograms"
+	if err := r.checkQueueExists(qname); err != nil {
+		return nil, errors.E(op, errors.CanonicalCode(err), err)
+	}
+	fields, err := r.client.HGetAll(context.Background(), base.LatencyKey(qname)).Result()
+	if err != nil {
+		return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "hgetall", Err: err})
+	}
+	res := make(map[string]*TaskLatencyHistograms)
+	for field, val := range fields {
+		// Fields have the form "<kind>:<bucket>:<type>"; see RecordLatency.
+		parts := strings.SplitN(field, ":", 3)
+		if len(parts) != 3 || (parts[0] != "wait" && parts[0] != "run") {
+			continue
+		}
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return nil, errors.E(op, errors.Internal, fmt.Errorf("malformed latency histogram field %q: %v", field, err))
+		}
+		hs, ok := res[parts[2]]
+		if !ok {
+			hs = &TaskLatencyHistograms{
+				Wait: &LatencyHistogram{Counts: make([]int64, len(base.LatencyBuckets)+1)},
+				Run:  &LatencyHistogram{Counts: make([]int64, len(base.LatencyBuckets)+1)},
+			}
+			res[parts[2]] = hs
+		}
+		h := hs.Run
+		if parts[0] == "wait" {
+			h = hs.Wait
+		}
+		if parts[1] == "sum" {
+			h.Sum = time.Duration(n) * time.Microsecond
+			continue
+		}
+		i, err := strconv.Atoi(parts[1])
+		if err != nil || i < 0 || i >= len(h.Counts) {
+			// The bucket is unknown, e.g. the buckets changed; ignore it.
+			continue
+		}
+		h.Counts[i] = n
+	}
+	return res, nil
+}
+
+// parseTaskSample parses a sampled task, which has the form
+// "<unix time in milliseconds>,<payload size>,<duration in microseconds>,<wait time in microseconds>,<type>".
+func parseTaskSample(member string) (*base.TaskSample, error) {
+	parts := strings.SplitN(member, ",", 5)
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("malformed task sample %q", member)
+	}
+	var n [4]int64
+	for i := range n {
+		var err error
+		if n[i], err = strconv.ParseInt(parts[i], 10, 64); err != nil {
+			return nil, fmt.Errorf("malformed task sample %q: %v", member, err)
+		}
+	}
+	return &base.TaskSample{
+		Type:        parts[4],
+		PayloadSize: int(n[1]),
+		Duration:    time.Duration(n[2]) * time.Microsecond,
+		WaitTime:    time.Duration(n[3]) * time.Microsecond,
+		CompletedAt: time.Unix(0, n[0]*int64(time.Millisecond)),
+	}, nil
+}
+
+// parseQueueSample parses a member of the history of the queue, which has the
+// form "<unix time in milliseconds>:<comma separated counts>".
+func parseQueueSample(qname, member string) (*QueueSample, error) {
+	parts := strings.SplitN(member, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("malformed queue sample %q", member)
+	}
+	ms, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed queue sample %q: %v", member, err)
+	}
+	counts := strings.Split(parts[1], ",")
+	if len(counts) != 8 {
+		return nil, fmt.Errorf("malformed queue sample %q", member)
+	}
+	var n [8]int
+	for i, c := range counts {
+		if n[i], err = strconv.Atoi(c); err != nil {
+			return nil, fmt.Errorf("malformed queue sample %q: %v", member, err)
+		}
+	}
+	s := &QueueSample{
+		Queue:     qname,
+		Pending:   n[0],
+		Active:    n[1],
+		Scheduled: n[2],
+		Retry:     n[3],
+		Archived:  n[4],
+		Completed: n[5],
+		Waiting:   n[6],
+		Unhandled: n[7],
+		Time:      time.Unix(0, ms*int64(time.Millisecond)),
+	}
+	for _, c := range n {
+		s.Size += c
+	}
+	return s, nil
+}
+
 // RedisInfo returns a map of redis info.
 func (r *RDB) RedisInfo() (map[string]string, error) {
 	res, err := r.client.Info(context.Background()).Result()
@@ -375,14 +659,6 @@ func parseInfo(infoStr string) (map[string]string, error) {
 	return info, nil
 }
 
-// TODO: Use generics once available.
-func reverse(x []*base.TaskInfo) {
-	for i := len(x)/2 - 1; i >= 0; i-- {
-		opp := len(x) - 1 - i
-		x[i], x[opp] = x[opp], x[i]
-	}
-}
-
 // checkQueueExists verifies whether the queue exists.
 // It returns QueueNotFoundError if queue doesn't exist.
 func (r *RDB) checkQueueExists(qname string) error {
@@ -403,25 +679,26 @@ func (r *RDB) checkQueueExists(qname string) error {
 // ARGV[3] -> queue key prefix (asynq:{<qname>}:)
 //
 // Output:
-// Tuple of {msg, state, nextProcessAt, result}
+// Tuple of {msg, state, nextProcessAt, result, progress}
 // msg: encoded task message
 // state: string describing the state of the task
 // nextProcessAt: unix time in seconds, zero if not applicable.
 // result: result data associated with the task
+// progress: progress data reported by the handler processing the task
 //
 // If the task key doesn't exist, it returns error with a message "NOT FOUND"
-var getTaskInfoCmd = redis.NewScript(`
+var getTaskInfoCmd = newScript("getTaskInfo", `
 	if redis.call("EXISTS", KEYS[1]) == 0 then
 		return redis.error_reply("NOT FOUND")
 	end
-	local msg, state, result = unpack(redis.call("HMGET", KEYS[1], "msg", "state", "result"))
+	local msg, state, result, progress = unpack(redis.call("HMGET", KEYS[1], "msg", "state", "result", "progress"))
 	if state == "scheduled" or state == "retry" then
-		return {msg, state, redis.call("ZSCORE", ARGV[3] .. state, ARGV[1]), result}
+		return {msg, state, redis.call("ZSCORE", ARGV[3] .. state, ARGV[1]), result, progress}
 	end
 	if state == "pending" then
-		return {msg, state, ARGV[2], result}
+		return {msg, state, ARGV[2], result, progress}
 	end
-	return {msg, state, 0, result}
+	return {msg, state, 0, result, progress}
 `)
 
 // GetTaskInfo returns a TaskInfo describing the task from the given queue.
@@ -441,13 +718,57 @@ func (r *RDB) GetTaskInfo(qname, id string) (*base.TaskInfo, error) {
 		if err.Error() == "NOT FOUND" {
 			return nil, errors.E(op, errors.NotFound, &errors.TaskNotFoundError{Queue: qname, ID: id})
 		}
-		return nil, errors.E(op, errors.Unknown, err)
+		return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
+	}
+	return parseTaskInfo(op, res)
+}
+
+// GetTaskInfos returns the TaskInfos describing the tasks with the given IDs from the
+// given queue, in the order of the IDs, looked up in a single round trip to redis.
+// The TaskInfo of a task which doesn't exist is nil.
+func (r *RDB) GetTaskInfos(qname string, ids []string) ([]*base.TaskInfo, error) {
+	var op errors.Op = "rdb.GetTaskInfos"
+	if err := r.checkQueueExists(qname); err != nil {
+		return nil, errors.E(op, errors.CanonicalCode(err), err)
+	}
+	ctx := context.Background()
+	argv := func(id string) []interface{} {
+		return []interface{}{id, time.Now().Unix(), base.QueueKeyPrefix(qname)}
+	}
+	pipe := r.client.Pipeline()
+	cmds := make([]*redis.Cmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = getTaskInfoCmd.EvalSha(ctx, pipe, []string{base.TaskKey(qname, id)}, argv(id)...)
+	}
+	pipe.Exec(ctx) // errors are reported by each command
+	infos := make([]*base.TaskInfo, len(ids))
+	for i, cmd := range cmds {
+		res, err := cmd.Result()
+		if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT ") {
+			// The script is not cached in redis yet; Run loads it.
+			id := ids[i]
+			res, err = getTaskInfoCmd.Run(ctx, r.client, []string{base.TaskKey(qname, id)}, argv(id)...).Result()
+		}
+		if err != nil {
+			if err.Error() == "NOT FOUND" {
+				continue
+			}
+			return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "evalsha", Err: err})
+		}
+		if infos[i], err = parseTaskInfo(op, res); err != nil {
+			return nil, err
+		}
 	}
+	return infos, nil
+}
+
+// parseTaskInfo returns the TaskInfo described by the values returned by getTaskInfoCmd.
+func parseTaskInfo(op errors.Op, res interface{}) (*base.TaskInfo, error) {
 	vals, err := cast.ToSliceE(res)
 	if err != nil {
 		return nil, errors.E(op, errors.Internal, "unexpected value returned from Lua script")
 	}
-	if len(vals) != 4 {
+	if len(vals) != 5 {
 		return nil, errors.E(op, errors.Internal, "unepxected number of values returned from Lua script")
 	}
 	encoded, err := cast.ToStringE(vals[0])
@@ -466,6 +787,13 @@ func (r *RDB) GetTaskInfo(qname, id string) (*base.TaskInfo, error) {
 	if err != nil {
 		return nil, errors.E(op, errors.Internal, "unexpected value returned from Lua script")
 	}
+	progressStr, err := cast.ToStringE(vals[4])
+	if err != nil {
+		return nil, errors.E(op, errors.Internal, "unexpected value returned from Lua script")
+	}
+	if stateStr == "quarantined" {
+		return nil, errors.E(op, errors.FailedPrecondition, "task is quarantined, see ListQuarantined")
+	}
 	msg, err := base.DecodeMessage([]byte(encoded))
 	if err != nil {
 		return nil, errors.E(op, errors.Internal, "could not decode task message")
@@ -482,11 +810,16 @@ func (r *RDB) GetTaskInfo(qname, id string) (*base.TaskInfo, error) {
 	if len(resultStr) > 0 {
 		result = []byte(resultStr)
 	}
+	var progress []byte
+	if len(progressStr) > 0 {
+		progress = []byte(progressStr)
+	}
 	return &base.TaskInfo{
 		Message:       msg,
 		State:         state,
 		NextProcessAt: nextProcessAt,
 		Result:        result,
+		Progress:      progress,
 	}, nil
 }
 
@@ -543,17 +876,43 @@ func (r *RDB) ListActive(qname string, pgn Pagination) ([]*base.TaskInfo, error)
 }
 
 // KEYS[1] -> key for id list (e.g. asynq:{<qname>}:pending)
+// KEYS[2] -> asynq:{<qname>}:pending_lists, if KEYS[1] is the pending list
 // ARGV[1] -> start offset
 // ARGV[2] -> stop offset
 // ARGV[3] -> task key prefix
-var listMessagesCmd = redis.NewScript(`
-local ids = redis.call("LRange", KEYS[1], ARGV[1], ARGV[2])
+//
+// Output:
+// List of (msg, result, progress, task ID, list key) tuples, oldest first.
+//
+// Note: The offsets count from the oldest task. The pending tasks set aside by
+// dequeueCmd are listed before the tasks in pending, as they were ahead of them.
+var listMessagesCmd = newScript("listMessages", pendingListsLua+`
+local lists = {KEYS[1]}
+if KEYS[2] then
+	lists = pending_lists(KEYS[1], KEYS[2])
+end
+local start, stop = tonumber(ARGV[1]), tonumber(ARGV[2])
 local data = {}
-for _, id in ipairs(ids) do
-	local key = ARGV[3] .. id
-	local msg, result = unpack(redis.call("HMGET", key, "msg","result"))
-	table.insert(data, msg)
-	table.insert(data, result)
+for _, list in ipairs(lists) do
+	if stop < 0 then
+		break
+	end
+	local n = redis.call("LLEN", list)
+	if start < n then
+		-- LPUSH adds the newest tasks to the head of the lists.
+		local ids = redis.call("LRANGE", list, -math.min(stop, n - 1) - 1, -math.max(start, 0) - 1)
+		for i = #ids, 1, -1 do
+			local id = ids[i]
+			local msg, result, progress = unpack(redis.call("HMGET", ARGV[3] .. id, "msg", "result", "progress"))
+			table.insert(data, msg)
+			table.insert(data, result)
+			table.insert(data, progress)
+			table.insert(data, id)
+			table.insert(data, list)
+		end
+	end
+	start = start - n
+	stop = stop - n
 end
 return data
 `)
@@ -569,29 +928,35 @@ func (r *RDB) listMessages(qname string, state base.TaskState, pgn Pagination) (
 	default:
 		panic(fmt.Sprintf("unsupported task state: %v", state))
 	}
-	// Note: Because we use LPUSH to redis list, we need to calculate the
-	// correct range and reverse the list to get the tasks with pagination.
-	stop := -pgn.start() - 1
-	start := -pgn.stop() - 1
+	keys := []string{key}
+	if state == base.TaskStatePending {
+		keys = append(keys, base.PendingListsKey(qname))
+	}
 	res, err := listMessagesCmd.Run(context.Background(), r.client,
-		[]string{key}, start, stop, base.TaskKeyPrefix(qname)).Result()
+		keys, pgn.start(), pgn.stop(), base.TaskKeyPrefix(qname)).Result()
 	if err != nil {
-		return nil, errors.E(errors.Unknown, err)
+		return nil, errors.E(errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
 	}
 	data, err := cast.ToStringSliceE(res)
 	if err != nil {
 		return nil, errors.E(errors.Internal, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res))
 	}
 	var infos []*base.TaskInfo
-	for i := 0; i < len(data); i += 2 {
+	bad := make(map[string][]string) // undecodable task ids by list
+	for i := 0; i < len(data); i += 5 {
 		m, err := base.DecodeMessage([]byte(data[i]))
 		if err != nil {
-			continue // bad data, ignore and continue
+			bad[data[i+4]] = append(bad[data[i+4]], data[i+3])
+			continue
 		}
 		var res []byte
 		if len(data[i+1]) > 0 {
 			res = []byte(data[i+1])
 		}
+		var progress []byte
+		if len(data[i+2]) > 0 {
+			progress = []byte(data[i+2])
+		}
 		var nextProcessAt time.Time
 		if state == base.TaskStatePending {
 			nextProcessAt = time.Now()
@@ -601,9 +966,14 @@ func (r *RDB) listMessages(qname string, state base.TaskState, pgn Pagination) (
 			State:         state,
 			NextProcessAt: nextProcessAt,
 			Result:        res,
+			Progress:      progress,
 		})
 	}
-	reverse(infos)
+	for list, ids := range bad {
+		if err := r.quarantine(qname, list, ids); err != nil {
+			return nil, err
+		}
+	}
 	return infos, nil
 
 }
@@ -661,6 +1031,139 @@ func (r *RDB) ListArchived(qname string, pgn Pagination) ([]*base.TaskInfo, erro
 	return zs, nil
 }
 
+// ListArchivedEntries returns archived tasks from the given queue
+// along with the time each task was archived as the score.
+func (r *RDB) ListArchivedEntries(qname string, pgn Pagination) ([]base.Z, error) {
+	var op errors.Op = "rdb.ListArchivedEntries"
+	exists, err := r.queueExists(qname)
+	if err != nil {
+		return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "sismember", Err: err})
+	}
+	if !exists {
+		return nil, errors.E(op, errors.NotFound, &errors.QueueNotFoundError{Queue: qname})
+	}
+	res, err := listZSetEntriesCmd.Run(context.Background(), r.client, []string{base.ArchivedKey(qname)},
+		pgn.start(), pgn.stop(), base.TaskKeyPrefix(qname)).Result()
+	if err != nil {
+		return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
+	}
+	data, err := cast.ToSliceE(res)
+	if err != nil {
+		return nil, errors.E(op, errors.Internal, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res))
+	}
+	var zs []base.Z
+	var bad []string
+	for i := 0; i < len(data); i += 4 {
+		s, err := cast.ToStringE(data[i])
+		if err != nil {
+			return nil, errors.E(op, errors.Internal, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res))
+		}
+		score, err := cast.ToInt64E(data[i+1])
+		if err != nil {
+			return nil, errors.E(op, errors.Internal, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res))
+		}
+		msg, err := base.DecodeMessage([]byte(s))
+		if err != nil {
+			bad = append(bad, cast.ToString(data[i+3]))
+			continue
+		}
+		zs = append(zs, base.Z{Message: msg, Score: score})
+	}
+	if err := r.quarantine(qname, base.ArchivedKey(qname), bad); err != nil {
+		return nil, errors.E(op, errors.CanonicalCode(err), err)
+	}
+	return zs, nil
+}
+
+// addArchivedCmd writes an archived task.
+//
+// Input:
+// KEYS[1] -> asynq:{<qname>}:t:<task_id>
+// KEYS[2] -> asynq:{<qname>}:archived
+// --
+// ARGV[1] -> task message data
+// ARGV[2] -> time the task was archived (unix time in seconds)
+// ARGV[3] -> task ID
+// ARGV[4] -> task class (empty if no class)
+// ARGV[5] -> labels required by the task (empty if no labels)
+// ARGV[6] -> 1 if the task is at-most-once, 0 otherwise
+// ARGV[7] -> 1 if the payload of the task was truncated, 0 otherwise
+// ARGV[8] -> asynq:{<qname>}:group:<key> (empty if the task has no group key)
+//
+// Output:
+// Returns 1 if successfully added
+// Returns 0 if task ID already exists
+var addArchivedCmd = newScript("addArchived", `
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+redis.call("HSET", KEYS[1],
+           "msg", ARGV[1],
+           "state", "archived")
+if ARGV[4] ~= "" then
+	redis.call("HSET", KEYS[1], "class", ARGV[4])
+end
+if ARGV[5] ~= "" then
+	redis.call("HSET", KEYS[1], "labels", ARGV[5])
+end
+if ARGV[6] == "1" then
+	redis.call("HSET", KEYS[1], "at_most_once", 1)
+end
+if ARGV[7] == "1" then
+	redis.call("HSET", KEYS[1], "truncated", 1)
+end
+if ARGV[8] ~= "" then
+	redis.call("HSET", KEYS[1], "group_key", ARGV[8])
+end
+redis.call("ZADD", KEYS[2], ARGV[2], ARGV[3])
+return 1
+`)
+
+// AddArchived writes the given task to the archive of the task's queue
+// as if it was archived at the given time.
+// It returns ErrTaskIdConflict if a task with the same ID already exists in the queue.
+//
+// Note: The task is added as-is. Archived tasks are trimmed by age and count
+// whenever a task is archived, so a task archived long ago may get deleted soon after.
+func (r *RDB) AddArchived(msg *base.TaskMessage, archivedAt time.Time) error {
+	var op errors.Op = "rdb.AddArchived"
+	encoded, err := base.EncodeMessage(msg)
+	if err != nil {
+		return errors.E(op, errors.Unknown, fmt.Sprintf("cannot encode message: %v", err))
+	}
+	ctx := context.Background()
+	if err := r.client.SAdd(ctx, base.AllQueues, msg.Queue).Err(); err != nil {
+		return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "sadd", Err: err})
+	}
+	var groupKey string
+	if msg.GroupKey != "" {
+		groupKey = base.GroupKey(msg.Queue, msg.GroupKey)
+	}
+	keys := []string{
+		base.TaskKey(msg.Queue, msg.ID),
+		base.ArchivedKey(msg.Queue),
+	}
+	argv := []interface{}{
+		encoded,
+		archivedAt.Unix(),
+		msg.ID,
+		msg.Class,
+		labelsArg(msg),
+		atMostOnceArg(msg),
+		msg.PayloadSize > 0,
+		groupKey,
+	}
+	n, err := r.runScriptWithErrorCode(ctx, op, addArchivedCmd, keys, argv...)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.E(op, errors.AlreadyExists, errors.ErrTaskIdConflict)
+	}
+	r.recordOperatorEvent(msg.Queue, AuditImported, msg.ID, "", 1)
+	return nil
+}
+
 // ListCompleted returns all tasks from the given queue that have completed successfully.
 func (r *RDB) ListCompleted(qname string, pgn Pagination) ([]*base.TaskInfo, error) {
 	var op errors.Op = "rdb.ListCompleted"
@@ -678,6 +1181,512 @@ func (r *RDB) ListCompleted(qname string, pgn Pagination) ([]*base.TaskInfo, err
 	return zs, nil
 }
 
+// ListWaiting returns all tasks from the given queue that are waiting for
+// their dependencies to complete.
+func (r *RDB) ListWaiting(qname string, pgn Pagination) ([]*base.TaskInfo, error) {
+	var op errors.Op = "rdb.ListWaiting"
+	exists, err := r.queueExists(qname)
+	if err != nil {
+		return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "sismember", Err: err})
+	}
+	if !exists {
+		return nil, errors.E(op, errors.NotFound, &errors.QueueNotFoundError{Queue: qname})
+	}
+	zs, err := r.listZSetEntries(qname, base.TaskStateWaiting, pgn)
+	if err != nil {
+		return nil, errors.E(op, errors.CanonicalCode(err), err)
+	}
+	return zs, nil
+}
+
+// ListUnhandled returns all tasks from the given queue that were parked
+// because no handler is registered for their type.
+func (r *RDB) ListUnhandled(qname string, pgn Pagination) ([]*base.TaskInfo, error) {
+	var op errors.Op = "rdb.ListUnhandled"
+	exists, err := r.queueExists(qname)
+	if err != nil {
+		return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "sismember", Err: err})
+	}
+	if !exists {
+		return nil, errors.E(op, errors.NotFound, &errors.QueueNotFoundError{Queue: qname})
+	}
+	zs, err := r.listZSetEntries(qname, base.TaskStateUnhandled, pgn)
+	if err != nil {
+		return nil, errors.E(op, errors.CanonicalCode(err), err)
+	}
+	return zs, nil
+}
+
+// KEYS[1] -> key for ids list or set (e.g. asynq:{<qname>}:archived)
+// KEYS[2] -> asynq:{<qname>}:pending_lists, if KEYS[1] is the pending list
+// ARGV[1] -> "list" or "zset"
+// ARGV[2] -> task key prefix
+// ARGV[3] -> task type
+//
+// Returns the number of tasks of the given type.
+//
+// Note: The type is read from the first field of the encoded message,
+// since the messages are encoded with the fields in field number order
+// and the type is field 1.
+var countTasksCmd = newScript("countTasks", pendingListsLua+`
+local function task_type(msg)
+	if not msg or string.byte(msg, 1) ~= 10 then
+		return ""
+	end
+	local len, mul, i = 0, 1, 2
+	while true do
+		local b = string.byte(msg, i)
+		if not b then
+			return ""
+		end
+		len = len + (b % 128) * mul
+		i = i + 1
+		if b < 128 then
+			break
+		end
+		mul = mul * 128
+	end
+	return string.sub(msg, i, i + len - 1)
+end
+local ids = {}
+if ARGV[1] == "list" then
+	local lists = {KEYS[1]}
+	if KEYS[2] then
+		lists = pending_lists(KEYS[1], KEYS[2])
+	end
+	for _, list in ipairs(lists) do
+		for _, id in ipairs(redis.call("LRANGE", list, 0, -1)) do
+			table.insert(ids, id)
+		end
+	end
+else
+	ids = redis.call("ZRANGE", KEYS[1], 0, -1)
+end
+local n = 0
+for _, id in ipairs(ids) do
+	local msg = redis.call("HGET", ARGV[2] .. id, "msg")
+	if task_type(msg) == ARGV[3] then
+		n = n + 1
+	end
+end
+return n
+`)
+
+// CountTasks returns the number of tasks in the given state in the queue.
+// If tasktype is not empty, only the tasks of the type are counted.
+//
+// Counting the tasks of a type reads every task in the state in a single script,
+// which blocks redis for the time it takes on large queues.
+func (r *RDB) CountTasks(qname string, state base.TaskState, tasktype string) (int64, error) {
+	var op errors.Op = "rdb.CountTasks"
+	exists, err := r.queueExists(qname)
+	if err != nil {
+		return 0, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "sismember", Err: err})
+	}
+	if !exists {
+		return 0, errors.E(op, errors.NotFound, &errors.QueueNotFoundError{Queue: qname})
+	}
+	var key, kind string
+	switch state {
+	case base.TaskStateActive:
+		key, kind = base.ActiveKey(qname), "list"
+	case base.TaskStatePending:
+		key, kind = base.PendingKey(qname), "list"
+	case base.TaskStateScheduled:
+		key, kind = base.ScheduledKey(qname), "zset"
+	case base.TaskStateRetry:
+		key, kind = base.RetryKey(qname), "zset"
+	case base.TaskStateArchived:
+		key, kind = base.ArchivedKey(qname), "zset"
+	case base.TaskStateCompleted:
+		key, kind = base.CompletedKey(qname), "zset"
+	case base.TaskStateWaiting:
+		key, kind = base.WaitingKey(qname), "zset"
+	case base.TaskStateUnhandled:
+		key, kind = base.UnhandledKey(qname), "zset"
+	default:
+		return 0, errors.E(op, errors.FailedPrecondition, fmt.Sprintf("unsupported task state: %v", state))
+	}
+	ctx := context.Background()
+	keys := []string{key}
+	if state == base.TaskStatePending {
+		keys = append(keys, base.PendingListsKey(qname))
+	}
+	if tasktype == "" {
+		var n int64
+		if state == base.TaskStatePending {
+			n, err = pendingSizeCmd.Run(ctx, r.client, keys).Int64()
+		} else if kind == "list" {
+			n, err = r.client.LLen(ctx, key).Result()
+		} else {
+			n, err = r.client.ZCard(ctx, key).Result()
+		}
+		if err != nil {
+			return 0, errors.E(op, errors.Unknown, err)
+		}
+		return n, nil
+	}
+	res, err := countTasksCmd.Run(ctx, r.client, keys, kind, base.TaskKeyPrefix(qname), tasktype).Result()
+	if err != nil {
+		return 0, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
+	}
+	n, err := cast.ToInt64E(res)
+	if err != nil {
+		return 0, errors.E(op, errors.Internal, fmt.Sprintf("cast error: unexpected return value from Lua script: %v", res))
+	}
+	return n, nil
+}
+
+// msgFieldsLua defines the Lua function msg_fields, for the scripts which match
+// tasks by the fields of their message: given an encoded task message and a table
+// whose keys are field numbers, it returns a table mapping each of these field numbers
+// to the value of the field in the message, if set. Strings are returned as is and
+// integers as numbers; the value of a field set more than once is the last one.
+const msgFieldsLua = `
+local function read_varint(msg, i)
+	local n, mul = 0, 1
+	while true do
+		local b = string.byte(msg, i)
+		if not b then
+			return nil, i
+		end
+		n = n + (b % 128) * mul
+		i = i + 1
+		if b < 128 then
+			return n, i
+		end
+		mul = mul * 128
+	end
+end
+local function msg_fields(msg, wanted)
+	local res = {}
+	local i = 1
+	while i <= #msg do
+		local tag, v
+		tag, i = read_varint(msg, i)
+		if not tag then
+			break
+		end
+		local wire = tag % 8
+		if wire == 0 then
+			v, i = read_varint(msg, i)
+		elseif wire == 2 then
+			local len
+			len, i = read_varint(msg, i)
+			if len then
+				v = string.sub(msg, i, i + len - 1)
+				i = i + len
+			end
+		elseif wire == 1 then
+			i = i + 8
+		elseif wire == 5 then
+			i = i + 4
+		else
+			break
+		end
+		if wire <= 2 and v == nil then
+			break
+		end
+		if wanted[(tag - wire) / 8] then
+			res[(tag - wire) / 8] = v
+		end
+	end
+	return res
+end
+`
+
+// updateTasksCmd is a Lua script that reads a batch of tasks in the given state,
+// starting at the given index, and counts, deletes, runs or archives the ones
+// matching the filter, the same way deleteTaskCmd, runTaskCmd and archiveTaskCmd do.
+// A task is only updated if it's still in the given state, so that the tasks which
+// changed state since the batch of IDs was read are skipped; archived tasks whose
+// payload was truncated aren't run.
+//
+// Input:
+// KEYS[1] -> key for ids list or set (e.g. asynq:{<qname>}:archived)
+// KEYS[2] -> asynq:{<qname>}:pending_lists, if KEYS[1] is the pending list
+// --
+// ARGV[1] -> "list" or "zset"
+// ARGV[2] -> queue key prefix (asynq:{<qname>}:)
+// ARGV[3] -> state of the tasks
+// ARGV[4] -> action: "count", "delete", "run" or "archive"
+// ARGV[5] -> index of the first task of the batch
+// ARGV[6] -> batch size
+// ARGV[7] -> task type, empty to match all types
+// ARGV[8] -> text the last error of the tasks contains, empty to match all tasks
+// ARGV[9] -> unix time the tasks last failed before, 0 to match all tasks
+// ARGV[10] -> unix time in nsec the tasks were enqueued before, 0 to match all tasks
+// ARGV[11] -> current unix time
+// ARGV[12] -> current unix time in nsec
+// ARGV[13] -> cutoff timestamp of the archive (e.g., 90 days ago)
+// ARGV[14] -> max number of tasks in archived state (e.g., 100)
+// ARGV[15] -> encoded archive reason to append to the messages of the archived tasks
+// ARGV[16] -> encoded archive reason of the tasks waiting for the archived tasks
+// ARGV[17] -> encoded empty archive reason to append to the messages of the archived tasks run
+// ARGV[18] -> unix time the tasks of a zset are scored before, 0 to match all tasks
+//
+// Output:
+// Returns the number of matching tasks counted or updated, the index of the first
+// task of the next batch and the number of tasks read.
+var updateTasksCmd = newScript("updateTasks", advanceGroupLua+dependentsLua+pendingListsLua+msgFieldsLua+`
+local kind, prefix, state, action = ARGV[1], ARGV[2], ARGV[3], ARGV[4]
+local cursor, size = tonumber(ARGV[5]), tonumber(ARGV[6])
+local failed_before, enqueued_before = tonumber(ARGV[9]), tonumber(ARGV[10])
+local score_before = tonumber(ARGV[18])
+local wanted = {[1] = true, [7] = true, [11] = true, [30] = true}
+local function matches(msg, list, id)
+	if score_before > 0 and not (kind == "zset" and tonumber(redis.call("ZSCORE", list, id)) < score_before) then
+		return false
+	end
+	local f = msg_fields(msg, wanted)
+	if ARGV[7] ~= "" and f[1] ~= ARGV[7] then
+		return false
+	end
+	if ARGV[8] ~= "" and not (f[7] and string.find(f[7], ARGV[8], 1, true)) then
+		return false
+	end
+	if failed_before > 0 and not (f[11] and f[11] > 0 and f[11] < failed_before) then
+		return false
+	end
+	if enqueued_before > 0 and not (f[30] and f[30] > 0 and f[30] < enqueued_before) then
+		return false
+	end
+	return true
+end
+local lists = {KEYS[1]}
+if KEYS[2] then
+	lists = pending_lists(KEYS[1], KEYS[2])
+end
+local batch = {}
+local skip = cursor
+for _, list in ipairs(lists) do
+	local len
+	if kind == "list" then
+		len = redis.call("LLEN", list)
+	else
+		len = redis.call("ZCARD", list)
+	end
+	if skip >= len then
+		skip = skip - len
+	else
+		local ids
+		if kind == "list" then
+			ids = redis.call("LRANGE", list, skip, skip + size - #batch - 1)
+		else
+			ids = redis.call("ZRANGE", list, skip, skip + size - #batch - 1)
+		end
+		for _, id in ipairs(ids) do
+			table.insert(batch, {id, list})
+		end
+		skip = 0
+		if #batch >= size then
+			break
+		end
+	end
+end
+local n, kept, promoted = 0, 0, false
+for _, entry in ipairs(batch) do
+	local id, list = entry[1], entry[2]
+	local key = prefix .. "t:" .. id
+	local msg = redis.call("HGET", key, "msg")
+	if not msg or redis.call("HGET", key, "state") ~= state or not matches(msg, list, id)
+		or (action == "run" and state == "archived" and redis.call("HEXISTS", key, "truncated") == 1) then
+		kept = kept + 1
+	elseif action == "count" then
+		n = n + 1
+		kept = kept + 1
+	else
+		if kind == "list" then
+			redis.call("LREM", list, 0, id)
+			redis.call("HDEL", key, "pending_key")
+		else
+			redis.call("ZREM", list, id)
+		end
+		if action == "delete" then
+			advance_group(key, id, prefix .. "pending")
+			resolve_dependents(prefix, id, ARGV[12])
+			local unique_key = redis.call("HGET", key, "unique_key")
+			if unique_key and unique_key ~= "" and redis.call("GET", unique_key) == id then
+				redis.call("DEL", unique_key)
+			end
+			redis.call("DEL", key)
+		elseif action == "run" then
+			redis.call("LPUSH", prefix .. "pending", id)
+			redis.call("HSET", key, "state", "pending")
+			if state == "archived" then
+				redis.call("HSET", key, "msg", msg .. ARGV[17])
+			end
+			promoted = true
+		else
+			advance_group(key, id, prefix .. "pending")
+			redis.call("ZADD", prefix .. "archived", ARGV[11], id)
+			redis.call("HSET", key, "state", "archived", "msg", msg .. ARGV[15])
+			archive_dependents(prefix, id, ARGV[11], ARGV[16])
+		end
+		n = n + 1
+	end
+end
+if action == "archive" and n > 0 then
+	redis.call("ZREMRANGEBYSCORE", prefix .. "archived", "-inf", ARGV[13])
+	redis.call("ZREMRANGEBYRANK", prefix .. "archived", 0, -ARGV[14])
+end
+if promoted then
+	wake_up(prefix)
+end
+return {n, cursor + kept, #batch}
+`)
+
+// TaskFilter specifies the tasks matched by UpdateTasks.
+// The zero value of each field matches all tasks.
+type TaskFilter struct {
+	// Type matches the tasks of the type.
+	Type string
+
+	// ErrorContains matches the tasks whose last error message contains the text.
+	ErrorContains string
+
+	// FailedBefore matches the tasks which last failed before the time.
+	FailedBefore time.Time
+
+	// EnqueuedBefore matches the tasks which were enqueued before the time.
+	// Tasks enqueued by versions which didn't record the enqueue time don't match.
+	EnqueuedBefore time.Time
+
+	// ScoredBefore matches the tasks of the states held in a sorted set whose score
+	// is before the time, e.g. the scheduled tasks to be processed before the time.
+	// Pending and active tasks don't match.
+	ScoredBefore time.Time
+}
+
+// TaskAction is the action UpdateTasks applies to the matching tasks.
+type TaskAction string
+
+// Actions applied by UpdateTasks.
+const (
+	TaskActionCount   TaskAction = "count"
+	TaskActionDelete  TaskAction = "delete"
+	TaskActionRun     TaskAction = "run"
+	TaskActionArchive TaskAction = "archive"
+)
+
+// updateTasksBatchSize is the number of tasks read by each run of updateTasksCmd.
+const updateTasksBatchSize = 100
+
+// UpdateTasks applies the action to the tasks in the given state in the queue
+// which match the filter, and returns the number of tasks counted or updated.
+//
+// The tasks are read in batches, each matched and updated in a single script run,
+// so that redis isn't blocked for the time it takes to read all tasks in the state.
+// A task is updated only if it's still in the state when its batch is run: tasks
+// which changed state meanwhile are skipped, as are the archived tasks with a truncated
+// payload when running tasks. Tasks which enter or leave the state while UpdateTasks
+// is in progress may or may not be updated. If an error occurs, the number of tasks
+// updated by the batches already run is returned with the error.
+//
+// Tasks in the active or waiting state can only be counted.
+// If a queue with the given name doesn't exist, it returns QueueNotFoundError.
+func (r *RDB) UpdateTasks(qname string, state base.TaskState, action TaskAction, f TaskFilter) (int64, error) {
+	var op errors.Op = "rdb.UpdateTasks"
+	if err := r.checkQueueExists(qname); err != nil {
+		return 0, errors.E(op, errors.CanonicalCode(err), err)
+	}
+	var key, kind string
+	switch state {
+	case base.TaskStateActive, base.TaskStateWaiting:
+		if action != TaskActionCount {
+			return 0, errors.E(op, errors.FailedPrecondition, fmt.Sprintf("cannot %s tasks in %v state", action, state))
+		}
+		if state == base.TaskStateActive {
+			key, kind = base.ActiveKey(qname), "list"
+		} else {
+			key, kind = base.WaitingKey(qname), "zset"
+		}
+	case base.TaskStatePending:
+		key, kind = base.PendingKey(qname), "list"
+	default:
+		key, kind = stateKey(qname, state), "zset"
+	}
+	var event string
+	switch action {
+	case TaskActionCount:
+	case TaskActionDelete:
+		event = AuditDeleted
+	case TaskActionRun:
+		event = AuditRun
+	case TaskActionArchive:
+		event = AuditArchived
+	default:
+		return 0, errors.E(op, errors.FailedPrecondition, fmt.Sprintf("unknown action %q", action))
+	}
+	keys := []string{key}
+	if state == base.TaskStatePending {
+		keys = append(keys, base.PendingListsKey(qname))
+	}
+	reason, err := base.EncodeArchiveReason(base.ArchiveReasonOperator)
+	if err != nil {
+		return 0, errors.E(op, errors.Internal, fmt.Sprintf("cannot encode archive reason: %v", err))
+	}
+	depReason, err := encodeDependentsArchiveReason()
+	if err != nil {
+		return 0, errors.E(op, errors.Internal, err)
+	}
+	clearReason, err := base.EncodeArchiveReason("")
+	if err != nil {
+		return 0, errors.E(op, errors.Internal, fmt.Sprintf("cannot encode archive reason: %v", err))
+	}
+	var failedBefore, enqueuedBefore, scoredBefore int64
+	if !f.FailedBefore.IsZero() {
+		failedBefore = f.FailedBefore.Unix()
+	}
+	if !f.ScoredBefore.IsZero() {
+		scoredBefore = f.ScoredBefore.Unix()
+	}
+	if !f.EnqueuedBefore.IsZero() {
+		enqueuedBefore = f.EnqueuedBefore.UnixNano()
+	}
+	var total, cursor int64
+	for {
+		now := r.clock.Now()
+		argv := []interface{}{
+			kind,
+			base.QueueKeyPrefix(qname),
+			state.String(),
+			string(action),
+			cursor,
+			updateTasksBatchSize,
+			f.Type,
+			f.ErrorContains,
+			failedBefore,
+			enqueuedBefore,
+			now.Unix(),
+			now.UnixNano(),
+			now.AddDate(0, 0, -archivedExpirationInDays).Unix(),
+			maxArchiveSize,
+			reason,
+			depReason,
+			clearReason,
+			scoredBefore,
+		}
+		res, err := updateTasksCmd.Run(context.Background(), r.client, keys, argv...).Result()
+		if err != nil {
+			return total, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
+		}
+		data, err := cast.ToSliceE(res)
+		if err != nil || len(data) != 3 {
+			return total, errors.E(op, errors.Internal, fmt.Sprintf("cast error: unexpected return value from Lua script: %v", res))
+		}
+		n, next, read := cast.ToInt64(data[0]), cast.ToInt64(data[1]), cast.ToInt64(data[2])
+		if event != "" {
+			r.recordOperatorEvent(qname, event, "", state.String(), n)
+		}
+		total += n
+		cursor = next
+		if read < updateTasksBatchSize {
+			return total, nil
+		}
+	}
+}
+
 // Reports whether a queue with the given name exists.
 func (r *RDB) queueExists(qname string) (bool, error) {
 	return r.client.SIsMember(context.Background(), base.AllQueues, qname).Result()
@@ -689,8 +1698,8 @@ func (r *RDB) queueExists(qname string) (bool, error) {
 // ARGV[3] -> task key prefix
 //
 // Returns an array populated with
-// [msg1, score1, result1, msg2, score2, result2, ..., msgN, scoreN, resultN]
-var listZSetEntriesCmd = redis.NewScript(`
+// [msg1, score1, result1, id1, msg2, score2, result2, id2, ..., msgN, scoreN, resultN, idN]
+var listZSetEntriesCmd = newScript("listZSetEntries", `
 local data = {}
 local id_score_pairs = redis.call("ZRANGE", KEYS[1], ARGV[1], ARGV[2], "WITHSCORES")
 for i = 1, table.getn(id_score_pairs), 2 do
@@ -701,6 +1710,7 @@ for i = 1, table.getn(id_score_pairs), 2 do
 	table.insert(data, msg)
 	table.insert(data, score)
 	table.insert(data, res)
+	table.insert(data, id)
 end
 return data
 `)
@@ -708,45 +1718,63 @@ return data
 // listZSetEntries returns a list of message and score pairs in Redis sorted-set
 // with the given key.
 func (r *RDB) listZSetEntries(qname string, state base.TaskState, pgn Pagination) ([]*base.TaskInfo, error) {
-	var key string
+	key := zsetKey(qname, state)
+	res, err := listZSetEntriesCmd.Run(context.Background(), r.client, []string{key},
+		pgn.start(), pgn.stop(), base.TaskKeyPrefix(qname)).Result()
+	if err != nil {
+		return nil, errors.E(errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
+	}
+	infos, _, err := r.parseZSetEntries(qname, key, state, res)
+	return infos, err
+}
+
+// zsetKey returns the key of the sorted set holding the tasks of the given state.
+func zsetKey(qname string, state base.TaskState) string {
 	switch state {
 	case base.TaskStateScheduled:
-		key = base.ScheduledKey(qname)
+		return base.ScheduledKey(qname)
 	case base.TaskStateRetry:
-		key = base.RetryKey(qname)
+		return base.RetryKey(qname)
 	case base.TaskStateArchived:
-		key = base.ArchivedKey(qname)
+		return base.ArchivedKey(qname)
 	case base.TaskStateCompleted:
-		key = base.CompletedKey(qname)
+		return base.CompletedKey(qname)
+	case base.TaskStateWaiting:
+		return base.WaitingKey(qname)
+	case base.TaskStateUnhandled:
+		return base.UnhandledKey(qname)
 	default:
 		panic(fmt.Sprintf("unsupported task state: %v", state))
 	}
-	res, err := listZSetEntriesCmd.Run(context.Background(), r.client, []string{key},
-		pgn.start(), pgn.stop(), base.TaskKeyPrefix(qname)).Result()
-	if err != nil {
-		return nil, errors.E(errors.Unknown, err)
-	}
+}
+
+// parseZSetEntries parses the entries returned by listZSetEntriesCmd into task infos
+// and their scores, quarantining the tasks which cannot be decoded.
+func (r *RDB) parseZSetEntries(qname, key string, state base.TaskState, res interface{}) ([]*base.TaskInfo, []int64, error) {
 	data, err := cast.ToSliceE(res)
 	if err != nil {
-		return nil, errors.E(errors.Internal, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res))
+		return nil, nil, errors.E(errors.Internal, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res))
 	}
 	var infos []*base.TaskInfo
-	for i := 0; i < len(data); i += 3 {
+	var scores []int64
+	var bad []string
+	for i := 0; i < len(data); i += 4 {
 		s, err := cast.ToStringE(data[i])
 		if err != nil {
-			return nil, errors.E(errors.Internal, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res))
+			return nil, nil, errors.E(errors.Internal, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res))
 		}
 		score, err := cast.ToInt64E(data[i+1])
 		if err != nil {
-			return nil, errors.E(errors.Internal, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res))
+			return nil, nil, errors.E(errors.Internal, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res))
 		}
 		resStr, err := cast.ToStringE(data[i+2])
 		if err != nil {
-			return nil, errors.E(errors.Internal, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res))
+			return nil, nil, errors.E(errors.Internal, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res))
 		}
 		msg, err := base.DecodeMessage([]byte(s))
 		if err != nil {
-			continue // bad data, ignore and continue
+			bad = append(bad, cast.ToString(data[i+3]))
+			continue
 		}
 		var nextProcessAt time.Time
 		if state == base.TaskStateScheduled || state == base.TaskStateRetry {
@@ -762,8 +1790,349 @@ func (r *RDB) listZSetEntries(qname string, state base.TaskState, pgn Pagination
 			NextProcessAt: nextProcessAt,
 			Result:        resBytes,
 		})
+		scores = append(scores, score)
+	}
+	if err := r.quarantine(qname, key, bad); err != nil {
+		return nil, nil, err
+	}
+	return infos, scores, nil
+}
+
+// ZSetCursor is a position in the sorted set of the tasks of a state,
+// from which ListTasksAfter lists the next tasks.
+// The zero value is the start of the sorted set.
+type ZSetCursor struct {
+	// Score of the last task listed.
+	Score int64
+	// ID of the last task listed; tasks with the same score are ordered by ID.
+	Member string
+}
+
+// ZSetPage is a page of tasks listed by ListTasksAfter.
+type ZSetPage struct {
+	Tasks []*base.TaskInfo
+	// Scores holds the score of each task in Tasks.
+	Scores []int64
+	// Next is the cursor from which to list the next page.
+	Next ZSetCursor
+}
+
+// KEYS[1] -> sorted set key
+// ARGV[1] -> score of the cursor
+// ARGV[2] -> member of the cursor (empty for the first task with the score)
+// ARGV[3] -> maximum number of tasks to list
+// ARGV[4] -> task key prefix
+//
+// Output:
+// Returns the data of the tasks after the cursor in the format of listZSetEntriesCmd.
+//
+// Note: Members with the same score are sorted by their bytes, so the rank of the
+// first task after the cursor is found by binary search among the members with the
+// score of the cursor.
+var listZSetEntriesFromCmd = newScript("listZSetEntriesFrom", `
+local function less_or_equal(a, b)
+	for i = 1, math.min(string.len(a), string.len(b)) do
+		local x, y = string.byte(a, i), string.byte(b, i)
+		if x ~= y then
+			return x < y
+		end
+	end
+	return string.len(a) <= string.len(b)
+end
+local lo = redis.call("ZCOUNT", KEYS[1], "-inf", "(" .. ARGV[1])
+local hi = lo + redis.call("ZCOUNT", KEYS[1], ARGV[1], ARGV[1])
+while lo < hi do
+	local mid = math.floor((lo + hi) / 2)
+	if less_or_equal(redis.call("ZRANGE", KEYS[1], mid, mid)[1], ARGV[2]) then
+		lo = mid + 1
+	else
+		hi = mid
+	end
+end
+local data = {}
+local id_score_pairs = redis.call("ZRANGE", KEYS[1], lo, lo + tonumber(ARGV[3]) - 1, "WITHSCORES")
+for i = 1, table.getn(id_score_pairs), 2 do
+	local id = id_score_pairs[i]
+	local score = id_score_pairs[i+1]
+	local key = ARGV[4] .. id
+	local msg, res = unpack(redis.call("HMGET", key, "msg", "result"))
+	table.insert(data, msg)
+	table.insert(data, score)
+	table.insert(data, res)
+	table.insert(data, id)
+end
+return data
+`)
+
+// ListTasksAfter returns up to n tasks of the given state after the cursor, in increasing
+// order of score (i.e. the time the task is processed, was archived, or expires at),
+// along with the cursor from which to list the next tasks. The state must be stored in a
+// sorted set (i.e. scheduled, retry, archived, completed, waiting or unhandled).
+//
+// Unlike pages of a Pagination, the cursor is not shifted by tasks added or deleted
+// before it, so that iterating over a large sorted set lists each task at most once.
+//
+// Tasks which cannot be decoded are quarantined and omitted. If all the tasks after the
+// cursor are omitted, the returned page has no tasks.
+func (r *RDB) ListTasksAfter(qname string, state base.TaskState, cursor ZSetCursor, n int) (*ZSetPage, error) {
+	var op errors.Op = "rdb.ListTasksAfter"
+	exists, err := r.queueExists(qname)
+	if err != nil {
+		return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "sismember", Err: err})
+	}
+	if !exists {
+		return nil, errors.E(op, errors.NotFound, &errors.QueueNotFoundError{Queue: qname})
+	}
+	key := zsetKey(qname, state)
+	for {
+		res, err := listZSetEntriesFromCmd.Run(context.Background(), r.client, []string{key},
+			cursor.Score, cursor.Member, n, base.TaskKeyPrefix(qname)).Result()
+		if err != nil {
+			return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
+		}
+		infos, scores, err := r.parseZSetEntries(qname, key, state, res)
+		if err != nil {
+			return nil, errors.E(op, errors.CanonicalCode(err), err)
+		}
+		data, _ := res.([]interface{})
+		if len(data) > 0 {
+			// The cursor moves past the tasks omitted as well.
+			last := len(data) - 4
+			cursor = ZSetCursor{Score: cast.ToInt64(data[last+1]), Member: cast.ToString(data[last+3])}
+		}
+		// List again if all the tasks listed were omitted.
+		if len(infos) > 0 || len(data) == 0 {
+			return &ZSetPage{Tasks: infos, Scores: scores, Next: cursor}, nil
+		}
+	}
+}
+
+// quarantineCmd moves tasks whose data could not be decoded from the
+// given list or zset to the quarantine.
+//
+// Input:
+// KEYS[1] -> list or zset holding the task ids (e.g. asynq:{<qname>}:pending)
+// KEYS[2] -> asynq:{<qname>}:quarantine
+// KEYS[3] -> asynq:{<qname>}:deadlines
+// KEYS[4] -> asynq:{<qname>}:pending
+// --
+// ARGV[1] -> current unix time in seconds
+// ARGV[2] -> task key prefix
+// ARGV[3:] -> task IDs
+//
+// Output:
+// Returns the number of tasks quarantined.
+//
+// Note: Task keys are kept as-is, so that the data can be inspected. The state
+// of a task is set to quarantined, and the state it was in is kept in the
+// quarantined_from field. A repaired task is moved to pending, rather than to
+// the list it was set aside in by dequeueCmd. The next tasks of the groups of the quarantined tasks
+// are moved to pending.
+var quarantineCmd = newScript("quarantine", advanceGroupLua+`
+local is_list = redis.call("TYPE", KEYS[1])["ok"] == "list"
+local n = 0
+for i = 3, table.getn(ARGV) do
+	local id = ARGV[i]
+	local removed
+	if is_list then
+		removed = redis.call("LREM", KEYS[1], 0, id)
+	else
+		removed = redis.call("ZREM", KEYS[1], id)
+	end
+	if removed > 0 then
+		local key = ARGV[2] .. id
+		advance_group(key, id, KEYS[4])
+		local state = redis.call("HGET", key, "state")
+		if state then
+			redis.call("HSET", key, "state", "quarantined", "quarantined_from", state)
+		end
+		redis.call("HDEL", key, "pending_key")
+		redis.call("ZREM", KEYS[3], id)
+		redis.call("ZADD", KEYS[2], ARGV[1], id)
+		n = n + 1
+	end
+end
+return n`)
+
+// quarantine moves the tasks with the given ids from the given list or zset
+// to the quarantine of the queue, so that undecodable data is counted in the
+// queue stats instead of being silently skipped on every read.
+//
+// If it fails, the tasks stay where they are and the error is returned.
+// The tasks are left as is if SetReadOnly is enabled.
+func (r *RDB) quarantine(qname, key string, ids []string) error {
+	if len(ids) == 0 || r.readOnly {
+		return nil
+	}
+	argv := []interface{}{r.clock.Now().Unix(), base.TaskKeyPrefix(qname)}
+	for _, id := range ids {
+		argv = append(argv, id)
+	}
+	keys := []string{key, base.QuarantineKey(qname), base.DeadlinesKey(qname), base.PendingKey(qname)}
+	if err := quarantineCmd.Run(context.Background(), r.client, keys, argv...).Err(); err != nil {
+		return errors.E(errors.Unknown, fmt.Sprintf("cannot quarantine %d undecodable tasks: %v", len(ids), err))
+	}
+	return nil
+}
+
+// QuarantinedEntry is a task whose data could not be decoded.
+type QuarantinedEntry struct {
+	// ID of the task.
+	ID string
+	// Data is the encoded task message as stored in redis.
+	Data []byte
+	// State is the state the task was in when it was quarantined.
+	State string
+	// QuarantinedAt is the time the task was quarantined.
+	QuarantinedAt time.Time
+}
+
+// KEYS[1] -> asynq:{<qname>}:quarantine
+// ARGV[1] -> start offset
+// ARGV[2] -> stop offset
+// ARGV[3] -> task key prefix
+//
+// Output:
+// List of (id, score, msg, state) tuples, where state is the state the task
+// was quarantined from.
+var listQuarantinedCmd = newScript("listQuarantined", `
+local data = {}
+local id_score_pairs = redis.call("ZRANGE", KEYS[1], ARGV[1], ARGV[2], "WITHSCORES")
+for i = 1, table.getn(id_score_pairs), 2 do
+	local id = id_score_pairs[i]
+	local msg, state, from = unpack(redis.call("HMGET", ARGV[3] .. id, "msg", "state", "quarantined_from"))
+	if from then
+		state = from
+	end
+	table.insert(data, id)
+	table.insert(data, id_score_pairs[i+1])
+	table.insert(data, msg)
+	table.insert(data, state)
+end
+return data
+`)
+
+// ListQuarantined returns the tasks in the given queue whose data could not be decoded.
+func (r *RDB) ListQuarantined(qname string, pgn Pagination) ([]*QuarantinedEntry, error) {
+	var op errors.Op = "rdb.ListQuarantined"
+	exists, err := r.queueExists(qname)
+	if err != nil {
+		return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "sismember", Err: err})
+	}
+	if !exists {
+		return nil, errors.E(op, errors.NotFound, &errors.QueueNotFoundError{Queue: qname})
+	}
+	res, err := listQuarantinedCmd.Run(context.Background(), r.client, []string{base.QuarantineKey(qname)},
+		pgn.start(), pgn.stop(), base.TaskKeyPrefix(qname)).Result()
+	if err != nil {
+		return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
+	}
+	data, err := cast.ToSliceE(res)
+	if err != nil {
+		return nil, errors.E(op, errors.Internal, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res))
+	}
+	var entries []*QuarantinedEntry
+	for i := 0; i < len(data); i += 4 {
+		score, err := cast.ToInt64E(data[i+1])
+		if err != nil {
+			return nil, errors.E(op, errors.Internal, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res))
+		}
+		entries = append(entries, &QuarantinedEntry{
+			ID:            cast.ToString(data[i]),
+			Data:          []byte(cast.ToString(data[i+2])),
+			State:         cast.ToString(data[i+3]),
+			QuarantinedAt: time.Unix(score, 0),
+		})
+	}
+	return entries, nil
+}
+
+// DeleteAllQuarantinedTasks deletes all quarantined tasks from the given queue
+// and returns the number of tasks deleted.
+func (r *RDB) DeleteAllQuarantinedTasks(qname string) (int64, error) {
+	var op errors.Op = "rdb.DeleteAllQuarantinedTasks"
+	n, err := r.deleteAll(base.QuarantineKey(qname), qname)
+	if errors.IsQueueNotFound(err) {
+		return 0, errors.E(op, errors.NotFound, err)
+	}
+	if err != nil {
+		return 0, errors.E(op, errors.Unknown, err)
+	}
+	r.recordOperatorEvent(qname, AuditDeleted, "", "quarantined", n)
+	return n, nil
+}
+
+// KEYS[1] -> asynq:{<qname>}:quarantine
+// KEYS[2] -> asynq:{<qname>}:t:<task_id>
+// KEYS[3] -> asynq:{<qname>}:pending
+// --
+// ARGV[1] -> task ID
+// ARGV[2] -> encoded task message
+// ARGV[3] -> task timeout in seconds (0 if not timeout)
+// ARGV[4] -> task deadline in unix time (0 if no deadline)
+// ARGV[5] -> current unix time in nsec
+//
+// Output:
+// Returns 1 if the task is repaired.
+// Returns 0 if the task is not quarantined.
+var repairQuarantinedCmd = newScript("repairQuarantined", `
+if redis.call("ZREM", KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[2],
+           "msg", ARGV[2],
+           "state", "pending",
+           "timeout", ARGV[3],
+           "deadline", ARGV[4],
+           "pending_since", ARGV[5])
+redis.call("HDEL", KEYS[2], "quarantined_from")
+redis.call("LPUSH", KEYS[3], ARGV[1])
+return 1`)
+
+// RepairQuarantinedTask replaces the data of the quarantined task with the given
+// encoded message, e.g. a message fixed by hand from the data of the task, and moves
+// the task to pending.
+//
+// It returns a FailedPrecondition error if the data cannot be decoded or is the
+// message of another task, and a NotFound error if the task is not quarantined.
+func (r *RDB) RepairQuarantinedTask(qname, id string, data []byte) error {
+	var op errors.Op = "rdb.RepairQuarantinedTask"
+	exists, err := r.queueExists(qname)
+	if err != nil {
+		return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "sismember", Err: err})
 	}
-	return infos, nil
+	if !exists {
+		return errors.E(op, errors.NotFound, &errors.QueueNotFoundError{Queue: qname})
+	}
+	msg, err := base.DecodeMessage(data)
+	if err != nil {
+		return errors.E(op, errors.FailedPrecondition, fmt.Sprintf("cannot decode message: %v", err))
+	}
+	if msg.ID != id || msg.Queue != qname {
+		return errors.E(op, errors.FailedPrecondition,
+			fmt.Sprintf("message is of task id=%s in queue %q, want task id=%s in queue %q", msg.ID, msg.Queue, id, qname))
+	}
+	keys := []string{
+		base.QuarantineKey(qname),
+		base.TaskKey(qname, id),
+		base.PendingKey(qname),
+	}
+	argv := []interface{}{
+		id,
+		data,
+		msg.Timeout,
+		msg.Deadline,
+		r.clock.Now().UnixNano(),
+	}
+	n, err := repairQuarantinedCmd.Run(context.Background(), r.client, keys, argv...).Int()
+	if err != nil {
+		return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
+	}
+	if n == 0 {
+		return errors.E(op, errors.NotFound, &errors.TaskNotFoundError{Queue: qname, ID: id})
+	}
+	r.recordOperatorEvent(qname, AuditRun, id, "quarantined", 1)
+	return nil
 }
 
 // RunAllScheduledTasks enqueues all scheduled tasks from the given queue
@@ -778,6 +2147,7 @@ func (r *RDB) RunAllScheduledTasks(qname string) (int64, error) {
 	if err != nil {
 		return 0, errors.E(op, errors.Unknown, err)
 	}
+	r.recordOperatorEvent(qname, AuditRun, "", "scheduled", n)
 	return n, nil
 }
 
@@ -793,6 +2163,7 @@ func (r *RDB) RunAllRetryTasks(qname string) (int64, error) {
 	if err != nil {
 		return 0, errors.E(op, errors.Unknown, err)
 	}
+	r.recordOperatorEvent(qname, AuditRun, "", "retry", n)
 	return n, nil
 }
 
@@ -808,10 +2179,102 @@ func (r *RDB) RunAllArchivedTasks(qname string) (int64, error) {
 	if err != nil {
 		return 0, errors.E(op, errors.Unknown, err)
 	}
+	r.recordOperatorEvent(qname, AuditRun, "", "archived", n)
+	return n, nil
+}
+
+// runArchivedAtRateCmd is a Lua script that moves all archived tasks to scheduled
+// state, scheduling them to be processed at most the given number of tasks per
+// second, oldest archived first.
+//
+// Input:
+// KEYS[1] -> asynq:{<qname>}:archived
+// KEYS[2] -> asynq:{<qname>}:scheduled
+// --
+// ARGV[1] -> task key prefix
+// ARGV[2] -> current unix time in seconds
+// ARGV[3] -> number of tasks to schedule per second
+// ARGV[4] -> encoded empty archive reason to append to the task messages
+//
+// Output:
+// integer: number of tasks updated to scheduled state.
+//
+// Note: Archived tasks with a truncated payload are left in the archive.
+var runArchivedAtRateCmd = newScript("runArchivedAtRate", `
+local now = tonumber(ARGV[2])
+local rate = tonumber(ARGV[3])
+local n = 0
+for _, id in ipairs(redis.call("ZRANGE", KEYS[1], 0, -1)) do
+	local key = ARGV[1] .. id
+	if redis.call("HEXISTS", key, "truncated") == 0 then
+		redis.call("ZREM", KEYS[1], id)
+		redis.call("ZADD", KEYS[2], now + math.floor(n / rate), id)
+		redis.call("HSET", key, "state", "scheduled")
+		local msg = redis.call("HGET", key, "msg")
+		if msg then
+			redis.call("HSET", key, "msg", msg .. ARGV[4])
+		end
+		n = n + 1
+	end
+end
+return n`)
+
+// RunAllArchivedTasksAtRate schedules all archived tasks from the given queue to be
+// enqueued at a rate of perSecond tasks per second, starting now, and returns the
+// number of tasks scheduled.
+// If a queue with the given name doesn't exist, it returns QueueNotFoundError.
+func (r *RDB) RunAllArchivedTasksAtRate(qname string, perSecond int) (int64, error) {
+	var op errors.Op = "rdb.RunAllArchivedTasksAtRate"
+	if perSecond < 1 {
+		return 0, errors.E(op, errors.FailedPrecondition, "rate must be positive")
+	}
+	if err := r.checkQueueExists(qname); err != nil {
+		return 0, errors.E(op, errors.CanonicalCode(err), err)
+	}
+	clearReason, err := base.EncodeArchiveReason("")
+	if err != nil {
+		return 0, errors.E(op, errors.Internal, fmt.Sprintf("cannot encode archive reason: %v", err))
+	}
+	keys := []string{
+		base.ArchivedKey(qname),
+		base.ScheduledKey(qname),
+	}
+	argv := []interface{}{
+		base.TaskKeyPrefix(qname),
+		r.clock.Now().Unix(),
+		perSecond,
+		clearReason,
+	}
+	res, err := runArchivedAtRateCmd.Run(context.Background(), r.client, keys, argv...).Result()
+	if err != nil {
+		return 0, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
+	}
+	n, ok := res.(int64)
+	if !ok {
+		return 0, errors.E(op, errors.Internal, fmt.Sprintf("cast error: unexpected return value from Lua script: %v", res))
+	}
+	r.recordOperatorEvent(qname, AuditRun, "", "archived", n)
+	return n, nil
+}
+
+// RunAllUnhandledTasks enqueues all unhandled tasks from the given queue
+// and returns the number of tasks enqueued.
+// If a queue with the given name doesn't exist, it returns QueueNotFoundError.
+func (r *RDB) RunAllUnhandledTasks(qname string) (int64, error) {
+	var op errors.Op = "rdb.RunAllUnhandledTasks"
+	n, err := r.runAll(base.UnhandledKey(qname), qname)
+	if errors.IsQueueNotFound(err) {
+		return 0, errors.E(op, errors.NotFound, err)
+	}
+	if err != nil {
+		return 0, errors.E(op, errors.Unknown, err)
+	}
+	r.recordOperatorEvent(qname, AuditRun, "", "unhandled", n)
 	return n, nil
 }
 
 // runTaskCmd is a Lua script that updates the given task to pending state.
+// The archive reason of an archived task is cleared.
 //
 // Input:
 // KEYS[1] -> asynq:{<qname>}:t:<task_id>
@@ -819,6 +2282,7 @@ func (r *RDB) RunAllArchivedTasks(qname string) (int64, error) {
 // --
 // ARGV[1] -> task ID
 // ARGV[2] -> queue key prefix; asynq:{<qname>}:
+// ARGV[3] -> encoded empty archive reason to append to the task message
 //
 // Output:
 // Numeric code indicating the status:
@@ -826,8 +2290,10 @@ func (r *RDB) RunAllArchivedTasks(qname string) (int64, error) {
 // Returns 0 if task is not found.
 // Returns -1 if task is in active state.
 // Returns -2 if task is in pending state.
+// Returns -3 if task is quarantined.
+// Returns -4 if task is archived with a truncated payload.
 // Returns error reply if unexpected error occurs.
-var runTaskCmd = redis.NewScript(`
+var runTaskCmd = newScript("runTask", `
 if redis.call("EXISTS", KEYS[1]) == 0 then
 	return 0
 end
@@ -836,6 +2302,10 @@ if state == "active" then
 	return -1
 elseif state == "pending" then
 	return -2
+elseif state == "quarantined" then
+	return -3
+elseif state == "archived" and redis.call("HEXISTS", KEYS[1], "truncated") == 1 then
+	return -4
 end
 local n = redis.call("ZREM", ARGV[2] .. state, ARGV[1])
 if n == 0 then
@@ -843,6 +2313,12 @@ if n == 0 then
 end
 redis.call("LPUSH", KEYS[2], ARGV[1])
 redis.call("HSET", KEYS[1], "state", "pending")
+if state == "archived" then
+	local msg = redis.call("HGET", KEYS[1], "msg")
+	if msg then
+		redis.call("HSET", KEYS[1], "msg", msg .. ARGV[3])
+	end
+end
 return 1
 `)
 
@@ -857,6 +2333,10 @@ func (r *RDB) RunTask(qname, id string) error {
 	if err := r.checkQueueExists(qname); err != nil {
 		return errors.E(op, errors.CanonicalCode(err), err)
 	}
+	clearReason, err := base.EncodeArchiveReason("")
+	if err != nil {
+		return errors.E(op, errors.Internal, fmt.Sprintf("cannot encode archive reason: %v", err))
+	}
 	keys := []string{
 		base.TaskKey(qname, id),
 		base.PendingKey(qname),
@@ -864,10 +2344,11 @@ func (r *RDB) RunTask(qname, id string) error {
 	argv := []interface{}{
 		id,
 		base.QueueKeyPrefix(qname),
+		clearReason,
 	}
 	res, err := runTaskCmd.Run(context.Background(), r.client, keys, argv...).Result()
 	if err != nil {
-		return errors.E(op, errors.Unknown, err)
+		return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
 	}
 	n, ok := res.(int64)
 	if !ok {
@@ -875,6 +2356,8 @@ func (r *RDB) RunTask(qname, id string) error {
 	}
 	switch n {
 	case 1:
+		r.notifyPending(context.Background(), qname)
+		r.recordOperatorEvent(qname, AuditRun, id, "", 1)
 		return nil
 	case 0:
 		return errors.E(op, errors.NotFound, &errors.TaskNotFoundError{Queue: qname, ID: id})
@@ -882,41 +2365,66 @@ func (r *RDB) RunTask(qname, id string) error {
 		return errors.E(op, errors.FailedPrecondition, "task is already running")
 	case -2:
 		return errors.E(op, errors.FailedPrecondition, "task is already in pending state")
+	case -3:
+		return errors.E(op, errors.FailedPrecondition, "task is quarantined, use RepairQuarantinedTask instead")
+	case -4:
+		return errors.E(op, errors.FailedPrecondition, "payload of the archived task was truncated")
 	default:
 		return errors.E(op, errors.Internal, fmt.Sprintf("unexpected return value from Lua script %d", n))
 	}
 }
 
 // runAllCmd is a Lua script that moves all tasks in the given state
-// (one of: scheduled, retry, archived) to pending state.
+// (one of: scheduled, retry, archived, unhandled) to pending state.
 //
 // Input:
 // KEYS[1] -> zset which holds task ids (e.g. asynq:{<qname>}:scheduled)
 // KEYS[2] -> asynq:{<qname>}:pending
 // --
 // ARGV[1] -> task key prefix
+// ARGV[2] -> encoding to append to the task messages (e.g. empty archive reason), or empty
 //
 // Output:
 // integer: number of tasks updated to pending state.
-var runAllCmd = redis.NewScript(`
-local ids = redis.call("ZRANGE", KEYS[1], 0, -1)
-for _, id in ipairs(ids) do
-	redis.call("LPUSH", KEYS[2], id)
-	redis.call("HSET", ARGV[1] .. id, "state", "pending")
+//
+// Note: Archived tasks with a truncated payload are left in the archive.
+var runAllCmd = newScript("runAll", `
+local n = 0
+for _, id in ipairs(redis.call("ZRANGE", KEYS[1], 0, -1)) do
+	local key = ARGV[1] .. id
+	if redis.call("HEXISTS", key, "truncated") == 0 then
+		redis.call("ZREM", KEYS[1], id)
+		redis.call("LPUSH", KEYS[2], id)
+		redis.call("HSET", key, "state", "pending")
+		if ARGV[2] ~= "" then
+			local msg = redis.call("HGET", key, "msg")
+			if msg then
+				redis.call("HSET", key, "msg", msg .. ARGV[2])
+			end
+		end
+		n = n + 1
+	end
 end
-redis.call("DEL", KEYS[1])
-return table.getn(ids)`)
+return n`)
 
 func (r *RDB) runAll(zset, qname string) (int64, error) {
 	if err := r.checkQueueExists(qname); err != nil {
 		return 0, err
 	}
+	var suffix []byte
+	if zset == base.ArchivedKey(qname) {
+		var err error
+		if suffix, err = base.EncodeArchiveReason(""); err != nil {
+			return 0, err
+		}
+	}
 	keys := []string{
 		zset,
 		base.PendingKey(qname),
 	}
 	argv := []interface{}{
 		base.TaskKeyPrefix(qname),
+		suffix,
 	}
 	res, err := runAllCmd.Run(context.Background(), r.client, keys, argv...).Result()
 	if err != nil {
@@ -929,6 +2437,9 @@ func (r *RDB) runAll(zset, qname string) (int64, error) {
 	if n == -1 {
 		return 0, &errors.QueueNotFoundError{Queue: qname}
 	}
+	if n > 0 {
+		r.notifyPending(context.Background(), qname)
+	}
 	return n, nil
 }
 
@@ -944,6 +2455,7 @@ func (r *RDB) ArchiveAllRetryTasks(qname string) (int64, error) {
 	if err != nil {
 		return 0, errors.E(op, errors.Internal, err)
 	}
+	r.recordOperatorEvent(qname, AuditArchived, "", "retry", n)
 	return n, nil
 }
 
@@ -959,6 +2471,7 @@ func (r *RDB) ArchiveAllScheduledTasks(qname string) (int64, error) {
 	if err != nil {
 		return 0, errors.E(op, errors.Internal, err)
 	}
+	r.recordOperatorEvent(qname, AuditArchived, "", "scheduled", n)
 	return n, nil
 }
 
@@ -968,23 +2481,45 @@ func (r *RDB) ArchiveAllScheduledTasks(qname string) (int64, error) {
 // Input:
 // KEYS[1] -> asynq:{<qname>}:pending
 // KEYS[2] -> asynq:{<qname>}:archived
+// KEYS[3] -> asynq:{<qname>}:pending_lists
 // --
 // ARGV[1] -> current timestamp
 // ARGV[2] -> cutoff timestamp (e.g., 90 days ago)
 // ARGV[3] -> max number of tasks in archive (e.g., 100)
 // ARGV[4] -> task key prefix (asynq:{<qname>}:t:)
+// ARGV[5] -> encoded archive reason to append to the task messages
+// ARGV[6] -> queue key prefix (asynq:{<qname>}:)
+// ARGV[7] -> encoded archive reason of the tasks waiting for the archived tasks
 //
 // Output:
 // integer: Number of tasks archived
-var archiveAllPendingCmd = redis.NewScript(`
-local ids = redis.call("LRANGE", KEYS[1], 0, -1)
+//
+// Note: The tasks set aside by dequeueCmd are archived too. The next tasks of the
+// groups of the archived tasks are moved to pending, and the tasks waiting for
+// the archived tasks are archived.
+var archiveAllPendingCmd = newScript("archiveAllPending", advanceGroupLua+dependentsLua+pendingListsLua+`
+local ids = {}
+for _, list in ipairs(pending_lists(KEYS[1], KEYS[3])) do
+	for _, id in ipairs(redis.call("LRANGE", list, 0, -1)) do
+		table.insert(ids, id)
+	end
+	redis.call("DEL", list)
+end
+redis.call("DEL", KEYS[3])
 for _, id in ipairs(ids) do
+	local key = ARGV[4] .. id
+	advance_group(key, id, KEYS[1])
 	redis.call("ZADD", KEYS[2], ARGV[1], id)
-	redis.call("HSET", ARGV[4] .. id, "state", "archived")
+	redis.call("HSET", key, "state", "archived")
+	redis.call("HDEL", key, "pending_key")
+	local msg = redis.call("HGET", key, "msg")
+	if msg then
+		redis.call("HSET", key, "msg", msg .. ARGV[5])
+	end
+	archive_dependents(ARGV[6], id, ARGV[1], ARGV[7])
 end
 redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", ARGV[2])
 redis.call("ZREMRANGEBYRANK", KEYS[2], 0, -ARGV[3])
-redis.call("DEL", KEYS[1])
 return table.getn(ids)`)
 
 // ArchiveAllPendingTasks archives all pending tasks from the given queue and
@@ -995,9 +2530,18 @@ func (r *RDB) ArchiveAllPendingTasks(qname string) (int64, error) {
 	if err := r.checkQueueExists(qname); err != nil {
 		return 0, errors.E(op, errors.CanonicalCode(err), err)
 	}
+	reason, err := base.EncodeArchiveReason(base.ArchiveReasonOperator)
+	if err != nil {
+		return 0, errors.E(op, errors.Internal, fmt.Sprintf("cannot encode archive reason: %v", err))
+	}
+	depReason, err := encodeDependentsArchiveReason()
+	if err != nil {
+		return 0, errors.E(op, errors.Internal, err)
+	}
 	keys := []string{
 		base.PendingKey(qname),
 		base.ArchivedKey(qname),
+		base.PendingListsKey(qname),
 	}
 	now := time.Now()
 	argv := []interface{}{
@@ -1005,6 +2549,9 @@ func (r *RDB) ArchiveAllPendingTasks(qname string) (int64, error) {
 		now.AddDate(0, 0, -archivedExpirationInDays).Unix(),
 		maxArchiveSize,
 		base.TaskKeyPrefix(qname),
+		reason,
+		base.QueueKeyPrefix(qname),
+		depReason,
 	}
 	res, err := archiveAllPendingCmd.Run(context.Background(), r.client, keys, argv...).Result()
 	if err != nil {
@@ -1014,6 +2561,7 @@ func (r *RDB) ArchiveAllPendingTasks(qname string) (int64, error) {
 	if !ok {
 		return 0, errors.E(op, errors.Internal, fmt.Sprintf("unexpected return value from script %v", res))
 	}
+	r.recordOperatorEvent(qname, AuditArchived, "", "pending", n)
 	return n, nil
 }
 
@@ -1028,6 +2576,8 @@ func (r *RDB) ArchiveAllPendingTasks(qname string) (int64, error) {
 // ARGV[3] -> cutoff timestamp (e.g., 90 days ago)
 // ARGV[4] -> max number of tasks in archived state (e.g., 100)
 // ARGV[5] -> queue key prefix (asynq:{<qname>}:)
+// ARGV[6] -> encoded archive reason to append to the task message
+// ARGV[7] -> encoded archive reason of the tasks waiting for the task
 //
 // Output:
 // Numeric code indicating the status:
@@ -1035,29 +2585,44 @@ func (r *RDB) ArchiveAllPendingTasks(qname string) (int64, error) {
 // Returns 0 if task is not found.
 // Returns -1 if task is already archived.
 // Returns -2 if task is in active state.
+// Returns -4 if task is quarantined.
 // Returns error reply if unexpected error occurs.
-var archiveTaskCmd = redis.NewScript(`
+var archiveTaskCmd = newScript("archiveTask", advanceGroupLua+dependentsLua+`
 if redis.call("EXISTS", KEYS[1]) == 0 then
 	return 0
 end
 local state = redis.call("HGET", KEYS[1], "state")
 if state == "active" then
 	return -2
+elseif state == "quarantined" then
+	return -4
 end
 if state == "archived" then
 	return -1
 end
-if state == "pending" then
-	if redis.call("LREM", ARGV[5] .. state, 1, ARGV[1]) == 0 then
+local group_key = redis.call("HGET", KEYS[1], "group_key")
+if group_key and state == "pending" and redis.call("LINDEX", group_key, 0) ~= ARGV[1] then
+	-- task is waiting for its turn in the group.
+	redis.call("LREM", group_key, 0, ARGV[1])
+elseif state == "pending" then
+	-- the task may have been set aside by dequeueCmd.
+	if redis.call("LREM", redis.call("HGET", KEYS[1], "pending_key") or ARGV[5] .. state, 1, ARGV[1]) == 0 then
 		return redis.error_reply("task id not found in list " .. tostring(state))
 	end
+	redis.call("HDEL", KEYS[1], "pending_key")
 else 
 	if redis.call("ZREM", ARGV[5] .. state, ARGV[1]) == 0 then
 		return redis.error_reply("task id not found in zset " .. tostring(state))
 	end
 end
+advance_group(KEYS[1], ARGV[1], ARGV[5] .. "pending")
 redis.call("ZADD", KEYS[2], ARGV[2], ARGV[1])
 redis.call("HSET", KEYS[1], "state", "archived")
+local msg = redis.call("HGET", KEYS[1], "msg")
+if msg then
+	redis.call("HSET", KEYS[1], "msg", msg .. ARGV[6])
+end
+archive_dependents(ARGV[5], ARGV[1], ARGV[2], ARGV[7])
 redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", ARGV[3])
 redis.call("ZREMRANGEBYRANK", KEYS[2], 0, -ARGV[4])
 return 1
@@ -1075,6 +2640,14 @@ func (r *RDB) ArchiveTask(qname, id string) error {
 	if err := r.checkQueueExists(qname); err != nil {
 		return errors.E(op, errors.CanonicalCode(err), err)
 	}
+	reason, err := base.EncodeArchiveReason(base.ArchiveReasonOperator)
+	if err != nil {
+		return errors.E(op, errors.Internal, fmt.Sprintf("cannot encode archive reason: %v", err))
+	}
+	depReason, err := encodeDependentsArchiveReason()
+	if err != nil {
+		return errors.E(op, errors.Internal, err)
+	}
 	keys := []string{
 		base.TaskKey(qname, id),
 		base.ArchivedKey(qname),
@@ -1086,10 +2659,12 @@ func (r *RDB) ArchiveTask(qname, id string) error {
 		now.AddDate(0, 0, -archivedExpirationInDays).Unix(),
 		maxArchiveSize,
 		base.QueueKeyPrefix(qname),
+		reason,
+		depReason,
 	}
 	res, err := archiveTaskCmd.Run(context.Background(), r.client, keys, argv...).Result()
 	if err != nil {
-		return errors.E(op, errors.Unknown, err)
+		return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
 	}
 	n, ok := res.(int64)
 	if !ok {
@@ -1097,6 +2672,7 @@ func (r *RDB) ArchiveTask(qname, id string) error {
 	}
 	switch n {
 	case 1:
+		r.recordOperatorEvent(qname, AuditArchived, id, "", 1)
 		return nil
 	case 0:
 		return errors.E(op, errors.NotFound, &errors.TaskNotFoundError{Queue: qname, ID: id})
@@ -1106,6 +2682,8 @@ func (r *RDB) ArchiveTask(qname, id string) error {
 		return errors.E(op, errors.FailedPrecondition, "cannot archive task in active state. use CancelTask instead.")
 	case -3:
 		return errors.E(op, errors.NotFound, &errors.QueueNotFoundError{Queue: qname})
+	case -4:
+		return errors.E(op, errors.FailedPrecondition, "cannot archive quarantined task. use RepairQuarantinedTask instead.")
 	default:
 		return errors.E(op, errors.Internal, fmt.Sprintf("unexpected return value from archiveTaskCmd script: %d", n))
 	}
@@ -1117,19 +2695,33 @@ func (r *RDB) ArchiveTask(qname, id string) error {
 // Input:
 // KEYS[1] -> ZSET to move task from (e.g., asynq:{<qname>}:retry)
 // KEYS[2] -> asynq:{<qname>}:archived
+// KEYS[3] -> asynq:{<qname>}:pending
 // --
 // ARGV[1] -> current timestamp
 // ARGV[2] -> cutoff timestamp (e.g., 90 days ago)
 // ARGV[3] -> max number of tasks in archive (e.g., 100)
 // ARGV[4] -> task key prefix (asynq:{<qname>}:t:)
+// ARGV[5] -> encoded archive reason to append to the task messages
+// ARGV[6] -> queue key prefix (asynq:{<qname>}:)
+// ARGV[7] -> encoded archive reason of the tasks waiting for the archived tasks
 //
 // Output:
 // integer: number of tasks archived
-var archiveAllCmd = redis.NewScript(`
+//
+// Note: The next tasks of the groups of the archived tasks are moved to pending,
+// and the tasks waiting for the archived tasks are archived.
+var archiveAllCmd = newScript("archiveAll", advanceGroupLua+dependentsLua+`
 local ids = redis.call("ZRANGE", KEYS[1], 0, -1)
 for _, id in ipairs(ids) do
+	local key = ARGV[4] .. id
+	advance_group(key, id, KEYS[3])
 	redis.call("ZADD", KEYS[2], ARGV[1], id)
-	redis.call("HSET", ARGV[4] .. id, "state", "archived")
+	redis.call("HSET", key, "state", "archived")
+	local msg = redis.call("HGET", key, "msg")
+	if msg then
+		redis.call("HSET", key, "msg", msg .. ARGV[5])
+	end
+	archive_dependents(ARGV[6], id, ARGV[1], ARGV[7])
 end
 redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", ARGV[2])
 redis.call("ZREMRANGEBYRANK", KEYS[2], 0, -ARGV[3])
@@ -1140,9 +2732,18 @@ func (r *RDB) archiveAll(src, dst, qname string) (int64, error) {
 	if err := r.checkQueueExists(qname); err != nil {
 		return 0, err
 	}
+	reason, err := base.EncodeArchiveReason(base.ArchiveReasonOperator)
+	if err != nil {
+		return 0, fmt.Errorf("cannot encode archive reason: %v", err)
+	}
+	depReason, err := encodeDependentsArchiveReason()
+	if err != nil {
+		return 0, err
+	}
 	keys := []string{
 		src,
 		dst,
+		base.PendingKey(qname),
 	}
 	now := time.Now()
 	argv := []interface{}{
@@ -1150,7 +2751,9 @@ func (r *RDB) archiveAll(src, dst, qname string) (int64, error) {
 		now.AddDate(0, 0, -archivedExpirationInDays).Unix(),
 		maxArchiveSize,
 		base.TaskKeyPrefix(qname),
-		qname,
+		reason,
+		base.QueueKeyPrefix(qname),
+		depReason,
 	}
 	res, err := archiveAllCmd.Run(context.Background(), r.client, keys, argv...).Result()
 	if err != nil {
@@ -1171,13 +2774,14 @@ func (r *RDB) archiveAll(src, dst, qname string) (int64, error) {
 // --
 // ARGV[1] -> task ID
 // ARGV[2] -> queue key prefix
+// ARGV[3] -> current unix time in nsec
 //
 // Output:
 // Numeric code indicating the status:
 // Returns 1 if task is successfully deleted.
 // Returns 0 if task is not found.
 // Returns -1 if task is in active state.
-var deleteTaskCmd = redis.NewScript(`
+var deleteTaskCmd = newScript("deleteTask", advanceGroupLua+dependentsLua+`
 if redis.call("EXISTS", KEYS[1]) == 0 then
 	return 0
 end
@@ -1185,15 +2789,24 @@ local state = redis.call("HGET", KEYS[1], "state")
 if state == "active" then
 	return -1
 end
-if state == "pending" then
-	if redis.call("LREM", ARGV[2] .. state, 0, ARGV[1]) == 0 then
+local group_key = redis.call("HGET", KEYS[1], "group_key")
+if group_key and state == "pending" and redis.call("LINDEX", group_key, 0) ~= ARGV[1] then
+	-- task is waiting for its turn in the group.
+	redis.call("LREM", group_key, 0, ARGV[1])
+elseif state == "pending" then
+	-- the task may have been set aside by dequeueCmd.
+	if redis.call("LREM", redis.call("HGET", KEYS[1], "pending_key") or ARGV[2] .. state, 0, ARGV[1]) == 0 then
 		return redis.error_reply("task is not found in list: " .. tostring(state))
 	end
+elseif state == "quarantined" then
+	redis.call("ZREM", ARGV[2] .. "quarantine", ARGV[1])
 else
 	if redis.call("ZREM", ARGV[2] .. state, ARGV[1]) == 0 then
 		return redis.error_reply("task is not found in zset: " .. tostring(state))
 	end
 end
+advance_group(KEYS[1], ARGV[1], ARGV[2] .. "pending")
+resolve_dependents(ARGV[2], ARGV[1], ARGV[3])
 local unique_key = redis.call("HGET", KEYS[1], "unique_key")
 if unique_key and unique_key ~= "" and redis.call("GET", unique_key) == ARGV[1] then
 	redis.call("DEL", unique_key)
@@ -1218,10 +2831,11 @@ func (r *RDB) DeleteTask(qname, id string) error {
 	argv := []interface{}{
 		id,
 		base.QueueKeyPrefix(qname),
+		r.clock.Now().UnixNano(),
 	}
 	res, err := deleteTaskCmd.Run(context.Background(), r.client, keys, argv...).Result()
 	if err != nil {
-		return errors.E(op, errors.Unknown, err)
+		return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
 	}
 	n, ok := res.(int64)
 	if !ok {
@@ -1229,6 +2843,7 @@ func (r *RDB) DeleteTask(qname, id string) error {
 	}
 	switch n {
 	case 1:
+		r.recordOperatorEvent(qname, AuditDeleted, id, "", 1)
 		return nil
 	case 0:
 		return errors.E(op, errors.NotFound, &errors.TaskNotFoundError{Queue: qname, ID: id})
@@ -1250,6 +2865,7 @@ func (r *RDB) DeleteAllArchivedTasks(qname string) (int64, error) {
 	if err != nil {
 		return 0, errors.E(op, errors.Unknown, err)
 	}
+	r.recordOperatorEvent(qname, AuditDeleted, "", "archived", n)
 	return n, nil
 }
 
@@ -1264,6 +2880,7 @@ func (r *RDB) DeleteAllRetryTasks(qname string) (int64, error) {
 	if err != nil {
 		return 0, errors.E(op, errors.Unknown, err)
 	}
+	r.recordOperatorEvent(qname, AuditDeleted, "", "retry", n)
 	return n, nil
 }
 
@@ -1278,6 +2895,7 @@ func (r *RDB) DeleteAllScheduledTasks(qname string) (int64, error) {
 	if err != nil {
 		return 0, errors.E(op, errors.Unknown, err)
 	}
+	r.recordOperatorEvent(qname, AuditDeleted, "", "scheduled", n)
 	return n, nil
 }
 
@@ -1292,6 +2910,22 @@ func (r *RDB) DeleteAllCompletedTasks(qname string) (int64, error) {
 	if err != nil {
 		return 0, errors.E(op, errors.Unknown, err)
 	}
+	r.recordOperatorEvent(qname, AuditDeleted, "", "completed", n)
+	return n, nil
+}
+
+// DeleteAllUnhandledTasks deletes all unhandled tasks from the given queue
+// and returns the number of tasks deleted.
+func (r *RDB) DeleteAllUnhandledTasks(qname string) (int64, error) {
+	var op errors.Op = "rdb.DeleteAllUnhandledTasks"
+	n, err := r.deleteAll(base.UnhandledKey(qname), qname)
+	if errors.IsQueueNotFound(err) {
+		return 0, errors.E(op, errors.NotFound, err)
+	}
+	if err != nil {
+		return 0, errors.E(op, errors.Unknown, err)
+	}
+	r.recordOperatorEvent(qname, AuditDeleted, "", "unhandled", n)
 	return n, nil
 }
 
@@ -1299,15 +2933,23 @@ func (r *RDB) DeleteAllCompletedTasks(qname string) (int64, error) {
 //
 // Input:
 // KEYS[1] -> zset holding the task ids.
+// KEYS[2] -> asynq:{<qname>}:pending
 // --
 // ARGV[1] -> task key prefix
+// ARGV[2] -> queue key prefix
+// ARGV[3] -> current unix time in nsec
 //
 // Output:
 // integer: number of tasks deleted
-var deleteAllCmd = redis.NewScript(`
+//
+// Note: The next tasks of the groups of the deleted tasks, and the tasks waiting
+// only for them, are moved to pending.
+var deleteAllCmd = newScript("deleteAll", advanceGroupLua+dependentsLua+`
 local ids = redis.call("ZRANGE", KEYS[1], 0, -1)
 for _, id in ipairs(ids) do
 	local task_key = ARGV[1] .. id
+	advance_group(task_key, id, KEYS[2])
+	resolve_dependents(ARGV[2], id, ARGV[3])
 	local unique_key = redis.call("HGET", task_key, "unique_key")
 	if unique_key and unique_key ~= "" and redis.call("GET", unique_key) == id then
 		redis.call("DEL", unique_key)
@@ -1323,9 +2965,10 @@ func (r *RDB) deleteAll(key, qname string) (int64, error) {
 	}
 	argv := []interface{}{
 		base.TaskKeyPrefix(qname),
-		qname,
+		base.QueueKeyPrefix(qname),
+		r.clock.Now().UnixNano(),
 	}
-	res, err := deleteAllCmd.Run(context.Background(), r.client, []string{key}, argv...).Result()
+	res, err := deleteAllCmd.Run(context.Background(), r.client, []string{key, base.PendingKey(qname)}, argv...).Result()
 	if err != nil {
 		return 0, err
 	}
@@ -1340,17 +2983,32 @@ func (r *RDB) deleteAll(key, qname string) (int64, error) {
 //
 // Input:
 // KEYS[1] -> asynq:{<qname>}:pending
+// KEYS[2] -> asynq:{<qname>}:pending_lists
 // --
 // ARGV[1] -> task key prefix
+// ARGV[2] -> queue key prefix
+// ARGV[3] -> current unix time in nsec
 //
 // Output:
 // integer: number of tasks deleted
-var deleteAllPendingCmd = redis.NewScript(`
-local ids = redis.call("LRANGE", KEYS[1], 0, -1)
+//
+// Note: The tasks set aside by dequeueCmd are deleted too. The next tasks of the
+// groups of the deleted tasks, and the tasks waiting only for them, are moved to pending.
+var deleteAllPendingCmd = newScript("deleteAllPending", advanceGroupLua+dependentsLua+pendingListsLua+`
+local ids = {}
+for _, list in ipairs(pending_lists(KEYS[1], KEYS[2])) do
+	for _, id in ipairs(redis.call("LRANGE", list, 0, -1)) do
+		table.insert(ids, id)
+	end
+	redis.call("DEL", list)
+end
+redis.call("DEL", KEYS[2])
 for _, id in ipairs(ids) do
-	redis.call("DEL", ARGV[1] .. id)
+	local key = ARGV[1] .. id
+	advance_group(key, id, KEYS[1])
+	resolve_dependents(ARGV[2], id, ARGV[3])
+	redis.call("DEL", key)
 end
-redis.call("DEL", KEYS[1])
 return table.getn(ids)`)
 
 // DeleteAllPendingTasks deletes all pending tasks from the given queue
@@ -1362,18 +3020,22 @@ func (r *RDB) DeleteAllPendingTasks(qname string) (int64, error) {
 	}
 	keys := []string{
 		base.PendingKey(qname),
+		base.PendingListsKey(qname),
 	}
 	argv := []interface{}{
 		base.TaskKeyPrefix(qname),
+		base.QueueKeyPrefix(qname),
+		r.clock.Now().UnixNano(),
 	}
 	res, err := deleteAllPendingCmd.Run(context.Background(), r.client, keys, argv...).Result()
 	if err != nil {
-		return 0, errors.E(op, errors.Unknown, err)
+		return 0, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
 	}
 	n, ok := res.(int64)
 	if !ok {
 		return 0, errors.E(op, errors.Internal, "command error: unexpected return value %v", res)
 	}
+	r.recordOperatorEvent(qname, AuditDeleted, "", "pending", n)
 	return n, nil
 }
 
@@ -1382,60 +3044,85 @@ func (r *RDB) DeleteAllPendingTasks(qname string) (int64, error) {
 // It only check whether active queue is empty before removing.
 //
 // Input:
-// KEYS[1] -> asynq:{<qname>}
+// KEYS[1] -> asynq:{<qname>}:pending
 // KEYS[2] -> asynq:{<qname>}:active
 // KEYS[3] -> asynq:{<qname>}:scheduled
 // KEYS[4] -> asynq:{<qname>}:retry
 // KEYS[5] -> asynq:{<qname>}:archived
 // KEYS[6] -> asynq:{<qname>}:deadlines
+// KEYS[7] -> asynq:{<qname>}:waiting
+// KEYS[8] -> asynq:{<qname>}:draining
+// KEYS[9] -> asynq:{<qname>}:completed
+// KEYS[10] -> asynq:{<qname>}:paused
+// KEYS[11] -> asynq:{<qname>}:processed
+// KEYS[12] -> asynq:{<qname>}:failed
+// KEYS[13] -> asynq:{<qname>}:expiry
+// KEYS[14] -> asynq:{<qname>}:quarantine
+// KEYS[15] -> asynq:{<qname>}:unhandled
+// KEYS[16] -> asynq:{<qname>}:unhandled_total
+// KEYS[17] -> asynq:{<qname>}:duplicates
+// KEYS[18] -> asynq:{<qname>}:history
+// KEYS[19] -> asynq:{<qname>}:expiry_digest
+// KEYS[20] -> asynq:{<qname>}:samples
+// KEYS[21] -> asynq:{<qname>}:latency
+// KEYS[22] -> asynq:{<qname>}:dropped_total
+// KEYS[23] -> asynq:{<qname>}:pending_lists
 // --
 // ARGV[1] -> task key prefix
+// ARGV[2] -> queue key prefix
 //
 // Output:
 // Numeric code to indicate the status.
 // Returns 1 if successfully removed.
 // Returns -2 if the queue has active tasks.
-var removeQueueForceCmd = redis.NewScript(`
+//
+// Note: Group lists and dependents sets referenced by the removed tasks are deleted
+// along with the tasks, so that the queue can be reused with the same group keys.
+// The tasks in the group lists are deleted too. The audit log of the queue is kept.
+var removeQueueForceCmd = newScript("removeQueueForce", pendingListsLua+`
 local active = redis.call("LLEN", KEYS[2])
 if active > 0 then
     return -2
 end
-for _, id in ipairs(redis.call("LRANGE", KEYS[1], 0, -1)) do
-	redis.call("DEL", ARGV[1] .. id)
-end
-for _, id in ipairs(redis.call("LRANGE", KEYS[2], 0, -1)) do
-	redis.call("DEL", ARGV[1] .. id)
-end
-for _, id in ipairs(redis.call("ZRANGE", KEYS[3], 0, -1)) do
-	redis.call("DEL", ARGV[1] .. id)
+local function deleteTask(id)
+	local key = ARGV[1] .. id
+	local groupKey = redis.call("HGET", key, "group_key")
+	if groupKey then
+		-- The tasks behind the head of the group are only in the group list.
+		for _, member in ipairs(redis.call("LRANGE", groupKey, 0, -1)) do
+			redis.call("DEL", ARGV[1] .. member, ARGV[2] .. "dependents:" .. member)
+		end
+		redis.call("DEL", groupKey)
+	end
+	redis.call("DEL", ARGV[2] .. "dependents:" .. id)
+	redis.call("DEL", key)
 end
-for _, id in ipairs(redis.call("ZRANGE", KEYS[4], 0, -1)) do
-	redis.call("DEL", ARGV[1] .. id)
+for _, list in ipairs(pending_lists(KEYS[1], KEYS[23])) do
+	for _, id in ipairs(redis.call("LRANGE", list, 0, -1)) do
+		deleteTask(id)
+	end
+	redis.call("DEL", list)
 end
-for _, id in ipairs(redis.call("ZRANGE", KEYS[5], 0, -1)) do
-	redis.call("DEL", ARGV[1] .. id)
+for i = 3, 5 do
+	for _, id in ipairs(redis.call("ZRANGE", KEYS[i], 0, -1)) do
+		deleteTask(id)
+	end
 end
-for _, id in ipairs(redis.call("LRANGE", KEYS[1], 0, -1)) do
-	redis.call("DEL", ARGV[1] .. id)
+for _, id in ipairs(redis.call("ZRANGE", KEYS[7], 0, -1)) do
+	deleteTask(id)
 end
-for _, id in ipairs(redis.call("LRANGE", KEYS[2], 0, -1)) do
-	redis.call("DEL", ARGV[1] .. id)
+for _, id in ipairs(redis.call("ZRANGE", KEYS[9], 0, -1)) do
+	deleteTask(id)
 end
-for _, id in ipairs(redis.call("ZRANGE", KEYS[3], 0, -1)) do
-	redis.call("DEL", ARGV[1] .. id)
+for _, id in ipairs(redis.call("ZRANGE", KEYS[14], 0, -1)) do
+	deleteTask(id)
 end
-for _, id in ipairs(redis.call("ZRANGE", KEYS[4], 0, -1)) do
-	redis.call("DEL", ARGV[1] .. id)
+for _, id in ipairs(redis.call("ZRANGE", KEYS[15], 0, -1)) do
+	deleteTask(id)
 end
-for _, id in ipairs(redis.call("ZRANGE", KEYS[5], 0, -1)) do
-	redis.call("DEL", ARGV[1] .. id)
+for i = 1, #KEYS do
+	redis.call("DEL", KEYS[i])
 end
-redis.call("DEL", KEYS[1])
-redis.call("DEL", KEYS[2])
-redis.call("DEL", KEYS[3])
-redis.call("DEL", KEYS[4])
-redis.call("DEL", KEYS[5])
-redis.call("DEL", KEYS[6])
 return 1`)
 
 // removeQueueCmd removes the given queue.
@@ -1448,45 +3135,48 @@ return 1`)
 // KEYS[4] -> asynq:{<qname>}:retry
 // KEYS[5] -> asynq:{<qname>}:archived
 // KEYS[6] -> asynq:{<qname>}:deadlines
+// KEYS[7] -> asynq:{<qname>}:waiting
+// KEYS[8] -> asynq:{<qname>}:draining
+// KEYS[9] -> asynq:{<qname>}:completed
+// KEYS[10] -> asynq:{<qname>}:paused
+// KEYS[11] -> asynq:{<qname>}:processed
+// KEYS[12] -> asynq:{<qname>}:failed
+// KEYS[13] -> asynq:{<qname>}:expiry
+// KEYS[14] -> asynq:{<qname>}:quarantine
+// KEYS[15] -> asynq:{<qname>}:unhandled
+// KEYS[16] -> asynq:{<qname>}:unhandled_total
+// KEYS[17] -> asynq:{<qname>}:duplicates
+// KEYS[18] -> asynq:{<qname>}:history
+// KEYS[19] -> asynq:{<qname>}:expiry_digest
+// KEYS[20] -> asynq:{<qname>}:samples
+// KEYS[21] -> asynq:{<qname>}:latency
+// KEYS[22] -> asynq:{<qname>}:dropped_total
+// KEYS[23] -> asynq:{<qname>}:pending_lists
 // --
 // ARGV[1] -> task key prefix
+// ARGV[2] -> queue key prefix
 //
 // Output:
 // Numeric code to indicate the status
 // Returns 1 if successfully removed.
 // Returns -1 if queue is not empty
-var removeQueueCmd = redis.NewScript(`
-local ids = {}
-for _, id in ipairs(redis.call("LRANGE", KEYS[1], 0, -1)) do
-	table.insert(ids, id)
-end
-for _, id in ipairs(redis.call("LRANGE", KEYS[2], 0, -1)) do
-	table.insert(ids, id)
-end
-for _, id in ipairs(redis.call("ZRANGE", KEYS[3], 0, -1)) do
-	table.insert(ids, id)
-end
-for _, id in ipairs(redis.call("ZRANGE", KEYS[4], 0, -1)) do
-	table.insert(ids, id)
-end
-for _, id in ipairs(redis.call("ZRANGE", KEYS[5], 0, -1)) do
-	table.insert(ids, id)
-end
-if table.getn(ids) > 0 then
+var removeQueueCmd = newScript("removeQueue", `
+if redis.call("LLEN", KEYS[1]) > 0 or redis.call("LLEN", KEYS[2]) > 0 then
 	return -1
 end
-for _, id in ipairs(ids) do
-	redis.call("DEL", ARGV[1] .. id)
+for _, i in ipairs({3, 4, 5, 7, 9, 14, 15}) do
+	if redis.call("ZCARD", KEYS[i]) > 0 then
+		return -1
+	end
 end
-for _, id in ipairs(ids) do
-	redis.call("DEL", ARGV[1] .. id)
+for _, list in ipairs(redis.call("SMEMBERS", KEYS[23])) do
+	if redis.call("LLEN", list) > 0 then
+		return -1
+	end
+end
+for i = 1, #KEYS do
+	redis.call("DEL", KEYS[i])
 end
-redis.call("DEL", KEYS[1])
-redis.call("DEL", KEYS[2])
-redis.call("DEL", KEYS[3])
-redis.call("DEL", KEYS[4])
-redis.call("DEL", KEYS[5])
-redis.call("DEL", KEYS[6])
 return 1`)
 
 // RemoveQueue removes the specified queue.
@@ -1495,6 +3185,7 @@ return 1`)
 // as long as no tasks are active for the queue.
 // If force is set to false, it will only remove the queue if
 // the queue is empty.
+// Queue state (paused, draining) and total counters are removed with the queue.
 func (r *RDB) RemoveQueue(qname string, force bool) error {
 	var op errors.Op = "rdb.RemoveQueue"
 	exists, err := r.queueExists(qname)
@@ -1517,10 +3208,31 @@ func (r *RDB) RemoveQueue(qname string, force bool) error {
 		base.RetryKey(qname),
 		base.ArchivedKey(qname),
 		base.DeadlinesKey(qname),
+		base.WaitingKey(qname),
+		base.DrainingKey(qname),
+		base.CompletedKey(qname),
+		base.PausedKey(qname),
+		base.ProcessedTotalKey(qname),
+		base.FailedTotalKey(qname),
+		base.ExpiryKey(qname),
+		base.QuarantineKey(qname),
+		base.UnhandledKey(qname),
+		base.UnhandledTotalKey(qname),
+		base.DuplicatesKey(qname),
+		base.QueueHistoryKey(qname),
+		base.ExpiryDigestKey(qname),
+		base.TaskSamplesKey(qname),
+		base.LatencyKey(qname),
+		base.DroppedTotalKey(qname),
+		base.PendingListsKey(qname),
+	}
+	argv := []interface{}{
+		base.TaskKeyPrefix(qname),
+		base.QueueKeyPrefix(qname),
 	}
-	res, err := script.Run(context.Background(), r.client, keys, base.TaskKeyPrefix(qname)).Result()
+	res, err := script.Run(context.Background(), r.client, keys, argv...).Result()
 	if err != nil {
-		return errors.E(op, errors.Unknown, err)
+		return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
 	}
 	n, ok := res.(int64)
 	if !ok {
@@ -1529,8 +3241,9 @@ func (r *RDB) RemoveQueue(qname string, force bool) error {
 	switch n {
 	case 1:
 		if err := r.client.SRem(context.Background(), base.AllQueues, qname).Err(); err != nil {
-			return errors.E(op, errors.Unknown, err)
+			return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "srem", Err: err})
 		}
+		r.recordQueueEvent(qname, AuditRemoved)
 		return nil
 	case -1:
 		return errors.E(op, errors.NotFound, &errors.QueueNotEmptyError{Queue: qname})
@@ -1542,7 +3255,7 @@ func (r *RDB) RemoveQueue(qname string, force bool) error {
 }
 
 // Note: Script also removes stale keys.
-var listServerKeysCmd = redis.NewScript(`
+var listServerKeysCmd = newScript("listServerKeys", `
 local now = tonumber(ARGV[1])
 local keys = redis.call("ZRANGEBYSCORE", KEYS[1], now, "+inf")
 redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now-1)
@@ -1575,7 +3288,7 @@ func (r *RDB) ListServers() ([]*base.ServerInfo, error) {
 }
 
 // Note: Script also removes stale keys.
-var listWorkersCmd = redis.NewScript(`
+var listWorkersCmd = newScript("listWorkers", `
 local now = tonumber(ARGV[1])
 local keys = redis.call("ZRANGEBYSCORE", KEYS[1], now, "+inf")
 redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now-1)
@@ -1587,7 +3300,7 @@ func (r *RDB) ListWorkers() ([]*base.WorkerInfo, error) {
 	now := time.Now()
 	res, err := listWorkersCmd.Run(context.Background(), r.client, []string{base.AllWorkers}, now.Unix()).Result()
 	if err != nil {
-		return nil, errors.E(op, errors.Unknown, err)
+		return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
 	}
 	keys, err := cast.ToStringSliceE(res)
 	if err != nil {
@@ -1611,7 +3324,7 @@ func (r *RDB) ListWorkers() ([]*base.WorkerInfo, error) {
 }
 
 // Note: Script also removes stale keys.
-var listSchedulerKeysCmd = redis.NewScript(`
+var listSchedulerKeysCmd = newScript("listSchedulerKeys", `
 local now = tonumber(ARGV[1])
 local keys = redis.call("ZRANGEBYSCORE", KEYS[1], now, "+inf")
 redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now-1)
@@ -1677,6 +3390,7 @@ func (r *RDB) Pause(qname string) error {
 	if !ok {
 		return fmt.Errorf("queue %q is already paused", qname)
 	}
+	r.recordQueueEvent(qname, AuditPaused)
 	return nil
 }
 
@@ -1690,9 +3404,251 @@ func (r *RDB) Unpause(qname string) error {
 	if deleted == 0 {
 		return fmt.Errorf("queue %q is not paused", qname)
 	}
+	r.notifyPending(context.Background(), qname)
+	r.recordQueueEvent(qname, AuditUnpaused)
+	return nil
+}
+
+// PauseFor pauses processing of tasks from the given queue for the duration d,
+// after which the queue is unpaused automatically, and records the reason in
+// the event of the queue.
+// It reports whether the queue was paused, i.e. false if it was already paused.
+func (r *RDB) PauseFor(qname string, d time.Duration, reason string) (bool, error) {
+	var op errors.Op = "rdb.PauseFor"
+	ok, err := r.client.SetNX(context.Background(), base.PausedKey(qname), r.clock.Now().Unix(), d).Result()
+	if err != nil {
+		return false, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "setnx", Err: err})
+	}
+	if ok {
+		r.record(context.Background(), qname, &AuditEvent{Event: AuditTripped, Reason: reason})
+	}
+	return ok, nil
+}
+
+// DrainQueue marks the given queue as draining.
+// Tasks already in the queue are processed as usual, but new tasks
+// cannot be enqueued to the queue until the queue is undrained or removed.
+func (r *RDB) DrainQueue(qname string) error {
+	var op errors.Op = "rdb.DrainQueue"
+	exists, err := r.queueExists(qname)
+	if err != nil {
+		return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "sismember", Err: err})
+	}
+	if !exists {
+		return errors.E(op, errors.NotFound, &errors.QueueNotFoundError{Queue: qname})
+	}
+	ok, err := r.client.SetNX(context.Background(), base.DrainingKey(qname), time.Now().Unix(), 0).Result()
+	if err != nil {
+		return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "setnx", Err: err})
+	}
+	if !ok {
+		return errors.E(op, errors.FailedPrecondition, fmt.Sprintf("queue %q is already draining", qname))
+	}
+	r.recordQueueEvent(qname, AuditDraining)
+	return nil
+}
+
+// UndrainQueue lets the given draining queue accept new tasks again.
+func (r *RDB) UndrainQueue(qname string) error {
+	var op errors.Op = "rdb.UndrainQueue"
+	deleted, err := r.client.Del(context.Background(), base.DrainingKey(qname)).Result()
+	if err != nil {
+		return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "del", Err: err})
+	}
+	if deleted == 0 {
+		return errors.E(op, errors.FailedPrecondition, fmt.Sprintf("queue %q is not draining", qname))
+	}
+	r.recordQueueEvent(qname, AuditUndrained)
 	return nil
 }
 
+// UniqueLock is a uniqueness lock acquired by a task enqueued with a unique key.
+type UniqueLock struct {
+	// Key is the unique key of the lock.
+	Key string
+	// TaskID is the ID of the task holding the lock.
+	TaskID string
+	// TTL is the time remaining until the lock expires, or a negative duration
+	// if the lock doesn't expire.
+	TTL time.Duration
+}
+
+// uniqueLockScanCount is the number of keys scanned per SCAN call by ListUniqueLocks.
+const uniqueLockScanCount = 1000
+
+// ListUniqueLocks returns the uniqueness locks held in the given queue, sorted by key.
+//
+// The keys of the queue are scanned with SCAN, which doesn't block redis but takes
+// time proportional to the number of keys in the database.
+func (r *RDB) ListUniqueLocks(qname string) ([]*UniqueLock, error) {
+	var op errors.Op = "rdb.ListUniqueLocks"
+	if err := r.checkQueueExists(qname); err != nil {
+		return nil, errors.E(op, errors.CanonicalCode(err), err)
+	}
+	ctx := context.Background()
+	prefix := base.UniqueKeyPrefix(qname)
+	var client redis.UniversalClient = r.client
+	if c, ok := r.client.(*redis.ClusterClient); ok {
+		// All keys of the queue are in the same slot.
+		node, err := c.MasterForKey(ctx, prefix)
+		if err != nil {
+			return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "cluster slots", Err: err})
+		}
+		client = node
+	}
+	var keys []string
+	iter := client.Scan(ctx, 0, escapeGlob(prefix)+"*", uniqueLockScanCount).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "scan", Err: err})
+	}
+	sort.Strings(keys)
+	pipe := r.client.Pipeline()
+	owners := make([]*redis.StringCmd, len(keys))
+	ttls := make([]*redis.DurationCmd, len(keys))
+	for i, key := range keys {
+		owners[i] = pipe.Get(ctx, key)
+		ttls[i] = pipe.PTTL(ctx, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "get", Err: err})
+	}
+	var locks []*UniqueLock
+	for i, key := range keys {
+		owner, err := owners[i].Result()
+		if err != nil {
+			// The lock was released since the keys were scanned.
+			continue
+		}
+		locks = append(locks, &UniqueLock{Key: key, TaskID: owner, TTL: ttls[i].Val()})
+	}
+	return locks, nil
+}
+
+// escapeGlob escapes the characters of s which are special in the patterns of SCAN.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// ReleaseUniqueLock deletes the uniqueness lock with the given key in the given queue,
+// so that a task with the same unique key can be enqueued again. The task holding the
+// lock is not changed.
+//
+// It returns a NotFound error if the lock doesn't exist.
+func (r *RDB) ReleaseUniqueLock(qname, key string) error {
+	var op errors.Op = "rdb.ReleaseUniqueLock"
+	if !strings.HasPrefix(key, base.UniqueKeyPrefix(qname)) {
+		return errors.E(op, errors.FailedPrecondition, fmt.Sprintf("%q is not a unique key of queue %q", key, qname))
+	}
+	n, err := r.client.Del(context.Background(), key).Result()
+	if err != nil {
+		return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "del", Err: err})
+	}
+	if n == 0 {
+		return errors.E(op, errors.NotFound, fmt.Sprintf("uniqueness lock %q not found", key))
+	}
+	return nil
+}
+
+// ValidateMessage checks that the task with the given id in the given queue is
+// stored as the scripts of asynq store tasks, e.g. a task enqueued by a producer in
+// another language, and returns the problems found, if any. The message of the task
+// is checked with base.ValidateMessage.
+//
+// It returns a NotFound error if the task doesn't exist.
+func (r *RDB) ValidateMessage(qname, id string) ([]string, error) {
+	var op errors.Op = "rdb.ValidateMessage"
+	ctx := context.Background()
+	fields, err := r.client.HGetAll(ctx, base.TaskKey(qname, id)).Result()
+	if err != nil {
+		return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "hgetall", Err: err})
+	}
+	if len(fields) == 0 {
+		return nil, errors.E(op, errors.NotFound, &errors.TaskNotFoundError{Queue: qname, ID: id})
+	}
+	var problems []string
+	addf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	exists, err := r.queueExists(qname)
+	if err != nil {
+		return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "sismember", Err: err})
+	}
+	if !exists {
+		addf("queue %q is not a member of %s", qname, base.AllQueues)
+	}
+
+	encoded, ok := fields["msg"]
+	if !ok {
+		return append(problems, "msg field is missing"), nil
+	}
+	msg, err := base.DecodeMessage([]byte(encoded))
+	if err != nil {
+		return append(problems, fmt.Sprintf("msg field cannot be decoded: %v", err)), nil
+	}
+	problems = append(problems, base.ValidateMessage(msg)...)
+	if msg.ID != id {
+		addf("id of the message is %q, want %q", msg.ID, id)
+	}
+	if msg.Queue != qname {
+		addf("queue of the message is %q, want %q", msg.Queue, qname)
+	}
+	for _, f := range []struct {
+		name string
+		want int64
+	}{
+		{"timeout", msg.Timeout},
+		{"deadline", msg.Deadline},
+	} {
+		v, ok := fields[f.name]
+		if !ok {
+			addf("%s field is missing", f.name)
+		} else if n, err := strconv.ParseInt(v, 10, 64); err != nil || n != f.want {
+			addf("%s field is %q, want %d as in the message", f.name, v, f.want)
+		}
+	}
+
+	state, err := base.TaskStateFromString(fields["state"])
+	if err != nil {
+		addf("state field %q is not a task state", fields["state"])
+		return problems, nil
+	}
+	var key string
+	switch state {
+	case base.TaskStateScheduled:
+		key = base.ScheduledKey(qname)
+	case base.TaskStateRetry:
+		key = base.RetryKey(qname)
+	case base.TaskStateArchived:
+		key = base.ArchivedKey(qname)
+	case base.TaskStateCompleted:
+		key = base.CompletedKey(qname)
+	case base.TaskStateWaiting:
+		key = base.WaitingKey(qname)
+	case base.TaskStateUnhandled:
+		key = base.UnhandledKey(qname)
+	default:
+		// Pending and active tasks are in lists, which are not searched.
+		return problems, nil
+	}
+	if err := r.client.ZScore(ctx, key, id).Err(); err == redis.Nil {
+		addf("task is %s but is not a member of %s", state, key)
+	} else if err != nil {
+		return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "zscore", Err: err})
+	}
+	return problems, nil
+}
+
 // ClusterKeySlot returns an integer identifying the hash slot the given queue hashes to.
 func (r *RDB) ClusterKeySlot(qname string) (int64, error) {
 	key := base.PendingKey(qname)
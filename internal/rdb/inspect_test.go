@@ -287,6 +287,33 @@ func TestCurrentStats(t *testing.T) {
 	}
 }
 
+func TestCurrentStatsDuplicates(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	ctx := context.Background()
+	for _, typename := range []string{"email", "email", "email", "report"} {
+		msg := h.NewTaskMessage(typename, nil)
+		msg.UniqueKey = base.UniqueKey(msg.Queue, msg.Type, msg.Payload)
+		if err := r.EnqueueUnique(ctx, msg, time.Hour); err != nil && !errors.Is(err, errors.ErrDuplicateTask) {
+			t.Fatalf("(*RDB).EnqueueUnique returned error: %v", err)
+		}
+	}
+	msg := h.NewTaskMessage("report", nil)
+	msg.UniqueKey = base.UniqueKey(msg.Queue, msg.Type, msg.Payload)
+	if err := r.ScheduleUnique(ctx, msg, time.Now().Add(time.Hour), time.Hour); !errors.Is(err, errors.ErrDuplicateTask) {
+		t.Fatalf("(*RDB).ScheduleUnique returned %v, want ErrDuplicateTask", err)
+	}
+
+	stats, err := r.CurrentStats(base.DefaultQueueName)
+	if err != nil {
+		t.Fatalf("(*RDB).CurrentStats returned error: %v", err)
+	}
+	want := map[string]int{"email": 2, "report": 1}
+	if diff := cmp.Diff(want, stats.Duplicates); diff != "" {
+		t.Errorf("Duplicates mismatch (-want,+got):\n%s", diff)
+	}
+}
+
 func TestCurrentStatsWithNonExistentQueue(t *testing.T) {
 	r := setup(t)
 	defer r.Close()
@@ -599,6 +626,41 @@ func TestGetTaskInfoError(t *testing.T) {
 	}
 }
 
+func TestGetTaskInfos(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+
+	now := time.Now()
+	oneHourFromNow := now.Add(1 * time.Hour)
+	m1 := h.NewTaskMessageWithQueue("task1", nil, "custom")
+	m2 := h.NewTaskMessageWithQueue("task2", nil, "custom")
+	h.SeedAllPendingQueues(t, r.client, map[string][]*base.TaskMessage{"custom": {m1}})
+	h.SeedAllRetryQueues(t, r.client, map[string][]base.Z{"custom": {{Message: m2, Score: oneHourFromNow.Unix()}}})
+	// Look up the tasks with the script not cached in redis too.
+	if err := r.client.ScriptFlush(context.Background()).Err(); err != nil {
+		t.Fatalf("could not flush scripts: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		got, err := r.GetTaskInfos("custom", []string{m2.ID, uuid.NewString(), m1.ID})
+		if err != nil {
+			t.Fatalf("GetTaskInfos returned error: %v", err)
+		}
+		want := []*base.TaskInfo{
+			{Message: m2, State: base.TaskStateRetry, NextProcessAt: oneHourFromNow},
+			nil,
+			{Message: m1, State: base.TaskStatePending, NextProcessAt: now},
+		}
+		if diff := cmp.Diff(want, got, cmpopts.EquateApproxTime(2*time.Second)); diff != "" {
+			t.Errorf("GetTaskInfos = %v, want %v; (-want,+got)\n%s", got, want, diff)
+		}
+	}
+
+	if _, err := r.GetTaskInfos("nonexistent", []string{m1.ID}); !errors.IsQueueNotFound(err) {
+		t.Errorf("GetTaskInfos on a nonexistent queue returned %v, want a QueueNotFoundError", err)
+	}
+}
+
 func TestListPending(t *testing.T) {
 	r := setup(t)
 	defer r.Close()
@@ -1293,6 +1355,292 @@ func TestListArchivedPagination(t *testing.T) {
 	}
 }
 
+func TestListQuarantinesUndecodableTasks(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	ctx := context.Background()
+	m1 := h.NewTaskMessage("task1", nil)
+	m2 := h.NewTaskMessage("task2", nil)
+	m3 := h.NewTaskMessage("task3", nil)
+	m4 := h.NewTaskMessage("task4", nil)
+	h.SeedPendingQueue(t, r.client, []*base.TaskMessage{m1, m2}, "default")
+	h.SeedRetryQueue(t, r.client, []base.Z{
+		{Message: m3, Score: time.Now().Add(time.Hour).Unix()},
+		{Message: m4, Score: time.Now().Add(time.Hour).Unix()},
+	}, "default")
+	for _, id := range []string{m2.ID, m4.ID} {
+		if err := r.client.HSet(ctx, base.TaskKey("default", id), "msg", "bad data").Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pending, err := r.ListPending("default", Pagination{Size: 20, Page: 0})
+	if err != nil {
+		t.Fatalf("ListPending returned error: %v", err)
+	}
+	if len(pending) != 1 || pending[0].Message.ID != m1.ID {
+		t.Errorf("ListPending returned %v, want only %v", pending, m1)
+	}
+	retry, err := r.ListRetry("default", Pagination{Size: 20, Page: 0})
+	if err != nil {
+		t.Fatalf("ListRetry returned error: %v", err)
+	}
+	if len(retry) != 1 || retry[0].Message.ID != m3.ID {
+		t.Errorf("ListRetry returned %v, want only %v", retry, m3)
+	}
+
+	if diff := cmp.Diff([]string{m1.ID}, r.client.LRange(ctx, base.PendingKey("default"), 0, -1).Val()); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.PendingKey("default"), diff)
+	}
+	if diff := cmp.Diff([]string{m3.ID}, r.client.ZRange(ctx, base.RetryKey("default"), 0, -1).Val()); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.RetryKey("default"), diff)
+	}
+
+	stats, err := r.CurrentStats("default")
+	if err != nil {
+		t.Fatalf("CurrentStats returned error: %v", err)
+	}
+	if stats.Quarantined != 2 || stats.Size != 2 {
+		t.Errorf("CurrentStats returned Quarantined=%d Size=%d, want Quarantined=2 Size=2", stats.Quarantined, stats.Size)
+	}
+
+	entries, err := r.ListQuarantined("default", Pagination{Size: 20, Page: 0})
+	if err != nil {
+		t.Fatalf("ListQuarantined returned error: %v", err)
+	}
+	got := make(map[string]string)
+	for _, e := range entries {
+		if string(e.Data) != "bad data" {
+			t.Errorf("quarantined task %q has data %q, want %q", e.ID, e.Data, "bad data")
+		}
+		got[e.ID] = e.State
+	}
+	want := map[string]string{m2.ID: "pending", m4.ID: "retry"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ListQuarantined mismatch; (-want,+got)\n%s", diff)
+	}
+
+	for _, id := range []string{m2.ID, m4.ID} {
+		if state := r.client.HGet(ctx, base.TaskKey("default", id), "state").Val(); state != "quarantined" {
+			t.Errorf("quarantined task %q has state %q, want %q", id, state, "quarantined")
+		}
+	}
+	if _, err := r.GetTaskInfo("default", m2.ID); errors.CanonicalCode(err) != errors.FailedPrecondition {
+		t.Errorf("GetTaskInfo of quarantined task returned %v, want an error with code FailedPrecondition", err)
+	}
+	if err := r.RunTask("default", m4.ID); errors.CanonicalCode(err) != errors.FailedPrecondition {
+		t.Errorf("RunTask of quarantined task returned %v, want an error with code FailedPrecondition", err)
+	}
+	if err := r.ArchiveTask("default", m4.ID); errors.CanonicalCode(err) != errors.FailedPrecondition {
+		t.Errorf("ArchiveTask of quarantined task returned %v, want an error with code FailedPrecondition", err)
+	}
+
+	n, err := r.DeleteAllQuarantinedTasks("default")
+	if err != nil || n != 2 {
+		t.Errorf("DeleteAllQuarantinedTasks returned (%d, %v), want (2, nil)", n, err)
+	}
+	for _, key := range []string{base.QuarantineKey("default"), base.TaskKey("default", m2.ID), base.TaskKey("default", m4.ID)} {
+		if r.client.Exists(ctx, key).Val() != 0 {
+			t.Errorf("key %q still exists", key)
+		}
+	}
+}
+
+func TestRepairQuarantinedTask(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	ctx := context.Background()
+	m1 := h.NewTaskMessage("task1", nil)
+	m2 := h.NewTaskMessage("task2", nil)
+	h.SeedPendingQueue(t, r.client, []*base.TaskMessage{m1, m2}, "default")
+	if err := r.client.HSet(ctx, base.TaskKey("default", m1.ID), "msg", "bad data").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ListPending("default", Pagination{Size: 20, Page: 0}); err != nil {
+		t.Fatalf("ListPending returned error: %v", err)
+	}
+	encode := func(msg *base.TaskMessage) []byte {
+		data, err := base.EncodeMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	tests := []struct {
+		desc  string
+		qname string
+		id    string
+		data  []byte
+		code  errors.Code
+	}{
+		{"nonexistent queue", "nonexistent", m1.ID, encode(m1), errors.NotFound},
+		{"undecodable data", "default", m1.ID, []byte("still bad"), errors.FailedPrecondition},
+		{"message of another task", "default", m1.ID, encode(m2), errors.FailedPrecondition},
+		{"task not quarantined", "default", m2.ID, encode(m2), errors.NotFound},
+	}
+	for _, tc := range tests {
+		if err := r.RepairQuarantinedTask(tc.qname, tc.id, tc.data); errors.CanonicalCode(err) != tc.code {
+			t.Errorf("%s: RepairQuarantinedTask returned %v, want an error with code %v", tc.desc, err, tc.code)
+		}
+	}
+
+	if err := r.RepairQuarantinedTask("default", m1.ID, encode(m1)); err != nil {
+		t.Fatalf("RepairQuarantinedTask returned error: %v", err)
+	}
+	if n := r.client.ZCard(ctx, base.QuarantineKey("default")).Val(); n != 0 {
+		t.Errorf("%q has %d entries, want 0", base.QuarantineKey("default"), n)
+	}
+	info, err := r.GetTaskInfo("default", m1.ID)
+	if err != nil {
+		t.Fatalf("GetTaskInfo returned error: %v", err)
+	}
+	if info.State != base.TaskStatePending || info.Message.Type != m1.Type {
+		t.Errorf("repaired task has state %v and type %q, want pending task of type %q", info.State, info.Message.Type, m1.Type)
+	}
+	if r.client.HExists(ctx, base.TaskKey("default", m1.ID), "quarantined_from").Val() {
+		t.Errorf("repaired task still has the quarantined_from field")
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{m1, m2}, h.GetPendingMessages(t, r.client, "default"), h.SortMsgOpt); diff != "" {
+		t.Errorf("mismatch found in pending queue; (-want,+got)\n%s", diff)
+	}
+}
+
+func TestListArchivedEntries(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	m1 := h.NewTaskMessage("task1", nil)
+	m2 := h.NewTaskMessage("task2", nil)
+	now := time.Now()
+	z1 := base.Z{Message: m1, Score: now.Add(-time.Hour).Unix()}
+	z2 := base.Z{Message: m2, Score: now.Add(-time.Minute).Unix()}
+	h.SeedArchivedQueue(t, r.client, []base.Z{z1, z2}, "default")
+
+	got, err := r.ListArchivedEntries("default", Pagination{Size: 20, Page: 0})
+	if err != nil {
+		t.Fatalf("ListArchivedEntries returned error: %v", err)
+	}
+	if diff := cmp.Diff([]base.Z{z1, z2}, got); diff != "" {
+		t.Errorf("ListArchivedEntries returned %v, want %v; (-want,+got)\n%s", got, []base.Z{z1, z2}, diff)
+	}
+
+	got, err = r.ListArchivedEntries("default", Pagination{Size: 1, Page: 1})
+	if err != nil {
+		t.Fatalf("ListArchivedEntries returned error: %v", err)
+	}
+	if diff := cmp.Diff([]base.Z{z2}, got); diff != "" {
+		t.Errorf("ListArchivedEntries returned %v, want %v; (-want,+got)\n%s", got, []base.Z{z2}, diff)
+	}
+
+	if _, err := r.ListArchivedEntries("nonexistent", Pagination{Size: 20, Page: 0}); !errors.IsQueueNotFound(err) {
+		t.Errorf("ListArchivedEntries for nonexistent queue returned %v, want QueueNotFoundError", err)
+	}
+}
+
+func TestListTasksAfter(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	now := time.Now()
+	var entries []base.Z
+	for i := 0; i < 5; i++ {
+		// Tasks archived in the same second have the same score.
+		entries = append(entries, base.Z{Message: h.NewTaskMessage(fmt.Sprintf("task%d", i), nil), Score: now.Add(time.Duration(i/2) * time.Second).Unix()})
+	}
+	h.SeedArchivedQueue(t, r.client, entries, "default")
+	want := h.GetArchivedEntries(t, r.client, "default") // in the order of the sorted set
+
+	page, err := r.ListTasksAfter("default", base.TaskStateArchived, ZSetCursor{}, 3)
+	if err != nil {
+		t.Fatalf("ListTasksAfter returned error: %v", err)
+	}
+	got := page.Tasks
+	if len(page.Scores) != 3 || page.Scores[2] != want[2].Score || page.Next != (ZSetCursor{Score: want[2].Score, Member: want[2].Message.ID}) {
+		t.Errorf("ListTasksAfter returned scores %v and cursor %+v, want the scores of the first 3 tasks", page.Scores, page.Next)
+	}
+	// Deleting tasks listed before, including the task of the cursor which has
+	// the same score as the next task, does not shift the next page.
+	if _, err := r.client.ZRem(context.Background(), base.ArchivedKey("default"), want[0].Message.ID, want[2].Message.ID).Result(); err != nil {
+		t.Fatal(err)
+	}
+	page, err = r.ListTasksAfter("default", base.TaskStateArchived, page.Next, 3)
+	if err != nil {
+		t.Fatalf("ListTasksAfter returned error: %v", err)
+	}
+	got = append(got, page.Tasks...)
+	var gotIDs, wantIDs []string
+	for _, info := range got {
+		gotIDs = append(gotIDs, info.Message.ID)
+	}
+	for _, z := range want {
+		wantIDs = append(wantIDs, z.Message.ID)
+	}
+	if diff := cmp.Diff(wantIDs, gotIDs); diff != "" {
+		t.Errorf("ListTasksAfter listed tasks mismatch (-want,+got):\n%s", diff)
+	}
+	page, err = r.ListTasksAfter("default", base.TaskStateArchived, page.Next, 3)
+	if err != nil || len(page.Tasks) != 0 {
+		t.Errorf("ListTasksAfter at the end returned (%v, %v), want no tasks", page, err)
+	}
+	if _, err := r.ListTasksAfter("nonexistent", base.TaskStateArchived, ZSetCursor{}, 3); !errors.IsQueueNotFound(err) {
+		t.Errorf("ListTasksAfter for nonexistent queue returned %v, want QueueNotFoundError", err)
+	}
+}
+
+func TestListTasksAfterSkipsUndecodableTasks(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	ctx := context.Background()
+	now := time.Now()
+	var entries []base.Z
+	for i := 0; i < 5; i++ {
+		entries = append(entries, base.Z{Message: h.NewTaskMessage(fmt.Sprintf("task%d", i), nil), Score: now.Add(time.Duration(i) * time.Second).Unix()})
+	}
+	h.SeedArchivedQueue(t, r.client, entries, "default")
+	// A whole page of tasks cannot be decoded.
+	for _, z := range entries[:4] {
+		if err := r.client.HSet(ctx, base.TaskKey("default", z.Message.ID), "msg", "bad data").Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page, err := r.ListTasksAfter("default", base.TaskStateArchived, ZSetCursor{}, 2)
+	if err != nil {
+		t.Fatalf("ListTasksAfter returned error: %v", err)
+	}
+	if len(page.Tasks) != 1 || page.Tasks[0].Message.ID != entries[4].Message.ID {
+		t.Errorf("ListTasksAfter returned %v, want only %v", page.Tasks, entries[4].Message)
+	}
+	if n := r.client.ZCard(ctx, base.QuarantineKey("default")).Val(); n != 4 {
+		t.Errorf("%q has %d entries, want 4", base.QuarantineKey("default"), n)
+	}
+}
+
+func TestAddArchived(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	m1 := h.NewTaskMessageWithQueue("task1", nil, "custom")
+	m1.ErrorMsg = "something went wrong"
+	archivedAt := time.Now().Add(-24 * time.Hour)
+
+	if err := r.AddArchived(m1, archivedAt); err != nil {
+		t.Fatalf("AddArchived returned error: %v", err)
+	}
+	want := []base.Z{{Message: m1, Score: archivedAt.Unix()}}
+	if diff := cmp.Diff(want, h.GetArchivedEntries(t, r.client, "custom")); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.ArchivedKey("custom"), diff)
+	}
+	if state := r.client.HGet(context.Background(), base.TaskKey("custom", m1.ID), "state").Val(); state != "archived" {
+		t.Errorf("task state = %q, want %q", state, "archived")
+	}
+	if !r.client.SIsMember(context.Background(), base.AllQueues, "custom").Val() {
+		t.Errorf("%q is not a member of %q", "custom", base.AllQueues)
+	}
+
+	if err := r.AddArchived(m1, time.Now()); !errors.Is(err, errors.ErrTaskIdConflict) {
+		t.Errorf("AddArchived for existing task returned %v, want %v", err, errors.ErrTaskIdConflict)
+	}
+}
+
 func TestListCompleted(t *testing.T) {
 	r := setup(t)
 	defer r.Close()
@@ -2189,6 +2537,51 @@ func TestRunAllArchivedTasks(t *testing.T) {
 	}
 }
 
+func TestRunAllArchivedTasksAtRate(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	now := time.Now()
+	r.SetClock(timeutil.NewSimulatedClock(now))
+	var (
+		msgs    []*base.TaskMessage
+		entries []base.Z
+	)
+	for i := 0; i < 5; i++ {
+		msg := h.NewTaskMessage("send_email", nil)
+		msgs = append(msgs, msg)
+		entries = append(entries, base.Z{Message: msg, Score: now.Add(time.Duration(i-10) * time.Minute).Unix()})
+	}
+	h.FlushDB(t, r.client)
+	h.SeedArchivedQueue(t, r.client, entries, "default")
+
+	n, err := r.RunAllArchivedTasksAtRate("default", 2)
+	if err != nil || n != 5 {
+		t.Fatalf("r.RunAllArchivedTasksAtRate(%q, 2) = (%d, %v), want (5, nil)", "default", n, err)
+	}
+	// Two tasks per second are scheduled, oldest archived first.
+	var want []base.Z
+	for i, msg := range msgs {
+		want = append(want, base.Z{Message: msg, Score: now.Unix() + int64(i/2)})
+	}
+	if diff := cmp.Diff(want, h.GetScheduledEntries(t, r.client, "default"), h.SortZSetEntryOpt); diff != "" {
+		t.Errorf("mismatch found in scheduled entries (-want,+got):\n%s", diff)
+	}
+	if got := h.GetArchivedMessages(t, r.client, "default"); len(got) != 0 {
+		t.Errorf("got %d archived messages, want 0", len(got))
+	}
+	info, err := r.GetTaskInfo("default", msgs[0].ID)
+	if err != nil || info.State != base.TaskStateScheduled {
+		t.Errorf("r.GetTaskInfo returned (%v, %v), want a task in scheduled state", info, err)
+	}
+
+	if _, err := r.RunAllArchivedTasksAtRate("nonexistent", 2); !errors.IsQueueNotFound(err) {
+		t.Errorf("r.RunAllArchivedTasksAtRate on nonexistent queue returned %v, want QueueNotFoundError", err)
+	}
+	if _, err := r.RunAllArchivedTasksAtRate("default", 0); err == nil {
+		t.Errorf("r.RunAllArchivedTasksAtRate with zero rate returned nil error, want non-nil error")
+	}
+}
+
 func TestRunAllTasksError(t *testing.T) {
 	r := setup(t)
 	defer r.Close()
@@ -2218,6 +2611,13 @@ func TestRunAllTasksError(t *testing.T) {
 	}
 }
 
+// operatorArchived returns a copy of msg archived by an operator.
+func operatorArchived(msg *base.TaskMessage) *base.TaskMessage {
+	m := *msg
+	m.ArchiveReason = base.ArchiveReasonOperator
+	return &m
+}
+
 func TestArchiveRetryTask(t *testing.T) {
 	r := setup(t)
 	defer r.Close()
@@ -2254,7 +2654,7 @@ func TestArchiveRetryTask(t *testing.T) {
 				"default": {{Message: m2, Score: t2.Unix()}},
 			},
 			wantArchived: map[string][]base.Z{
-				"default": {{Message: m1, Score: time.Now().Unix()}},
+				"default": {{Message: operatorArchived(m1), Score: time.Now().Unix()}},
 			},
 		},
 		{
@@ -2285,7 +2685,7 @@ func TestArchiveRetryTask(t *testing.T) {
 			},
 			wantArchived: map[string][]base.Z{
 				"default": {},
-				"custom":  {{Message: m3, Score: time.Now().Unix()}},
+				"custom":  {{Message: operatorArchived(m3), Score: time.Now().Unix()}},
 			},
 		},
 	}
@@ -2355,7 +2755,7 @@ func TestArchiveScheduledTask(t *testing.T) {
 				"default": {{Message: m2, Score: t2.Unix()}},
 			},
 			wantArchived: map[string][]base.Z{
-				"default": {{Message: m1, Score: time.Now().Unix()}},
+				"default": {{Message: operatorArchived(m1), Score: time.Now().Unix()}},
 			},
 		},
 		{
@@ -2386,7 +2786,7 @@ func TestArchiveScheduledTask(t *testing.T) {
 			},
 			wantArchived: map[string][]base.Z{
 				"default": {},
-				"custom":  {{Message: m3, Score: time.Now().Unix()}},
+				"custom":  {{Message: operatorArchived(m3), Score: time.Now().Unix()}},
 			},
 		},
 	}
@@ -2449,7 +2849,7 @@ func TestArchivePendingTask(t *testing.T) {
 				"default": {m2},
 			},
 			wantArchived: map[string][]base.Z{
-				"default": {{Message: m1, Score: time.Now().Unix()}},
+				"default": {{Message: operatorArchived(m1), Score: time.Now().Unix()}},
 			},
 		},
 		{
@@ -2469,7 +2869,7 @@ func TestArchivePendingTask(t *testing.T) {
 			},
 			wantArchived: map[string][]base.Z{
 				"default": {},
-				"custom":  {{Message: m3, Score: time.Now().Unix()}},
+				"custom":  {{Message: operatorArchived(m3), Score: time.Now().Unix()}},
 			},
 		},
 	}
@@ -2690,8 +3090,8 @@ func TestArchiveAllPendingTasks(t *testing.T) {
 			},
 			wantArchived: map[string][]base.Z{
 				"default": {
-					{Message: m1, Score: time.Now().Unix()},
-					{Message: m2, Score: time.Now().Unix()},
+					{Message: operatorArchived(m1), Score: time.Now().Unix()},
+					{Message: operatorArchived(m2), Score: time.Now().Unix()},
 				},
 			},
 		},
@@ -2709,7 +3109,7 @@ func TestArchiveAllPendingTasks(t *testing.T) {
 			},
 			wantArchived: map[string][]base.Z{
 				"default": {
-					{Message: m1, Score: time.Now().Unix()},
+					{Message: operatorArchived(m1), Score: time.Now().Unix()},
 					{Message: m2, Score: t2.Unix()},
 				},
 			},
@@ -2754,8 +3154,8 @@ func TestArchiveAllPendingTasks(t *testing.T) {
 			wantArchived: map[string][]base.Z{
 				"default": {},
 				"custom": {
-					{Message: m3, Score: time.Now().Unix()},
-					{Message: m4, Score: time.Now().Unix()},
+					{Message: operatorArchived(m3), Score: time.Now().Unix()},
+					{Message: operatorArchived(m4), Score: time.Now().Unix()},
 				},
 			},
 		},
@@ -2827,8 +3227,8 @@ func TestArchiveAllRetryTasks(t *testing.T) {
 			},
 			wantArchived: map[string][]base.Z{
 				"default": {
-					{Message: m1, Score: time.Now().Unix()},
-					{Message: m2, Score: time.Now().Unix()},
+					{Message: operatorArchived(m1), Score: time.Now().Unix()},
+					{Message: operatorArchived(m2), Score: time.Now().Unix()},
 				},
 			},
 		},
@@ -2846,7 +3246,7 @@ func TestArchiveAllRetryTasks(t *testing.T) {
 			},
 			wantArchived: map[string][]base.Z{
 				"default": {
-					{Message: m1, Score: time.Now().Unix()},
+					{Message: operatorArchived(m1), Score: time.Now().Unix()},
 					{Message: m2, Score: t2.Unix()},
 				},
 			},
@@ -2900,8 +3300,8 @@ func TestArchiveAllRetryTasks(t *testing.T) {
 			wantArchived: map[string][]base.Z{
 				"default": {},
 				"custom": {
-					{Message: m3, Score: time.Now().Unix()},
-					{Message: m4, Score: time.Now().Unix()},
+					{Message: operatorArchived(m3), Score: time.Now().Unix()},
+					{Message: operatorArchived(m4), Score: time.Now().Unix()},
 				},
 			},
 		},
@@ -2974,8 +3374,8 @@ func TestArchiveAllScheduledTasks(t *testing.T) {
 			},
 			wantArchived: map[string][]base.Z{
 				"default": {
-					{Message: m1, Score: time.Now().Unix()},
-					{Message: m2, Score: time.Now().Unix()},
+					{Message: operatorArchived(m1), Score: time.Now().Unix()},
+					{Message: operatorArchived(m2), Score: time.Now().Unix()},
 				},
 			},
 		},
@@ -2993,7 +3393,7 @@ func TestArchiveAllScheduledTasks(t *testing.T) {
 			},
 			wantArchived: map[string][]base.Z{
 				"default": {
-					{Message: m1, Score: time.Now().Unix()},
+					{Message: operatorArchived(m1), Score: time.Now().Unix()},
 					{Message: m2, Score: t2.Unix()},
 				},
 			},
@@ -3047,8 +3447,8 @@ func TestArchiveAllScheduledTasks(t *testing.T) {
 			wantArchived: map[string][]base.Z{
 				"default": {},
 				"custom": {
-					{Message: m3, Score: time.Now().Unix()},
-					{Message: m4, Score: time.Now().Unix()},
+					{Message: operatorArchived(m3), Score: time.Now().Unix()},
+					{Message: operatorArchived(m4), Score: time.Now().Unix()},
 				},
 			},
 		},
@@ -3422,6 +3822,101 @@ func TestDeleteTaskWithUniqueLock(t *testing.T) {
 	}
 }
 
+func TestDeleteTaskInGroup(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	m1 := h.NewTaskMessage("sync", nil)
+	m1.GroupKey = "user:42"
+	m2 := h.NewTaskMessage("sync", nil)
+	m2.GroupKey = "user:42"
+	m3 := h.NewTaskMessage("sync", nil)
+	m3.GroupKey = "user:42"
+
+	for _, msg := range []*base.TaskMessage{m1, m2, m3} {
+		if err := r.Enqueue(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Delete a task waiting for its turn, then the task at the head of the group.
+	for _, id := range []string{m2.ID, m1.ID} {
+		if err := r.DeleteTask(base.DefaultQueueName, id); err != nil {
+			t.Fatalf("r.DeleteTask(%q, %v) returned error: %v", base.DefaultQueueName, id, err)
+		}
+	}
+
+	gotPending := h.GetPendingMessages(t, r.client, base.DefaultQueueName)
+	if diff := cmp.Diff([]*base.TaskMessage{m3}, gotPending); diff != "" {
+		t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.PendingKey(base.DefaultQueueName), diff)
+	}
+	groupKey := base.GroupKey(base.DefaultQueueName, "user:42")
+	if got := r.client.LRange(context.Background(), groupKey, 0, -1).Val(); !cmp.Equal(got, []string{m3.ID}) {
+		t.Errorf("Redis LIST %q = %v, want %v", groupKey, got, []string{m3.ID})
+	}
+}
+
+func TestRemovingGroupHeadAdvancesGroup(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	ctx := context.Background()
+	qname := base.DefaultQueueName
+
+	tests := []struct {
+		desc  string
+		retry bool // whether the head of the group is retried before op
+		op    func(head *base.TaskMessage) error
+	}{
+		{"DeleteAllPendingTasks", false, func(*base.TaskMessage) error { _, err := r.DeleteAllPendingTasks(qname); return err }},
+		{"ArchiveAllPendingTasks", false, func(*base.TaskMessage) error { _, err := r.ArchiveAllPendingTasks(qname); return err }},
+		{"DeleteAllRetryTasks", true, func(*base.TaskMessage) error { _, err := r.DeleteAllRetryTasks(qname); return err }},
+		{"ArchiveAllRetryTasks", true, func(*base.TaskMessage) error { _, err := r.ArchiveAllRetryTasks(qname); return err }},
+		{"ArchiveStaleTasks", true, func(*base.TaskMessage) error {
+			_, err := r.ArchiveStaleTasks(qname, time.Now().Add(2*time.Hour))
+			return err
+		}},
+		{"quarantine", false, func(head *base.TaskMessage) error {
+			if err := r.client.HSet(ctx, base.TaskKey(qname, head.ID), "msg", "bad data").Err(); err != nil {
+				return err
+			}
+			_, err := r.ListPending(qname, Pagination{Size: 1, Page: 0})
+			return err
+		}},
+	}
+	for _, tc := range tests {
+		h.FlushDB(t, r.client)
+		m1 := h.NewTaskMessage("sync", nil)
+		m1.GroupKey = "user:42"
+		m2 := h.NewTaskMessage("sync", nil)
+		m2.GroupKey = "user:42"
+		for _, msg := range []*base.TaskMessage{m1, m2} {
+			if err := r.Enqueue(ctx, msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if tc.retry {
+			msg, _, err := r.Dequeue(qname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Retry(msg, time.Now().Add(time.Hour), "error", true); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := tc.op(m1); err != nil {
+			t.Fatalf("%s returned error: %v", tc.desc, err)
+		}
+
+		if got := r.client.LRange(ctx, base.PendingKey(qname), 0, -1).Val(); !cmp.Equal(got, []string{m2.ID}) {
+			t.Errorf("%s: Redis LIST %q = %v, want %v", tc.desc, base.PendingKey(qname), got, []string{m2.ID})
+		}
+		groupKey := base.GroupKey(qname, "user:42")
+		if got := r.client.LRange(ctx, groupKey, 0, -1).Val(); !cmp.Equal(got, []string{m2.ID}) {
+			t.Errorf("%s: Redis LIST %q = %v, want %v", tc.desc, groupKey, got, []string{m2.ID})
+		}
+	}
+}
+
 func TestDeleteTaskError(t *testing.T) {
 	r := setup(t)
 	defer r.Close()
@@ -4031,6 +4526,12 @@ func TestRemoveQueue(t *testing.T) {
 			base.ScheduledKey(tc.qname),
 			base.RetryKey(tc.qname),
 			base.ArchivedKey(tc.qname),
+			base.CompletedKey(tc.qname),
+			base.WaitingKey(tc.qname),
+			base.PausedKey(tc.qname),
+			base.DrainingKey(tc.qname),
+			base.ProcessedTotalKey(tc.qname),
+			base.FailedTotalKey(tc.qname),
 		}
 		for _, key := range keys {
 			if r.client.Exists(context.Background(), key).Val() != 0 {
@@ -4044,6 +4545,79 @@ func TestRemoveQueue(t *testing.T) {
 	}
 }
 
+func TestRemoveQueueDeletesQueueState(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	m1 := h.NewTaskMessageWithQueue("task1", nil, "custom")
+	m1.GroupKey = "user:1"
+	m2 := h.NewTaskMessageWithQueue("task2", nil, "custom")
+	m2.GroupKey = "user:1"
+	m3 := h.NewTaskMessageWithQueue("task3", nil, "custom")
+	m3.Dependencies = []string{m1.ID}
+	m5 := h.NewTaskMessageWithQueue("task5", nil, "custom")
+	m5.ExpiresAt = time.Now().Add(time.Hour).Unix()
+	for _, msg := range []*base.TaskMessage{m1, m2, m3, m5} {
+		if err := r.Enqueue(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Pause("custom"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.client.Set(context.Background(), base.ProcessedTotalKey("custom"), 10, 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.RemoveQueue("custom", false); !errors.IsQueueNotEmpty(err) {
+		t.Fatalf("RemoveQueue(%q, false) = %v, want QueueNotEmptyError", "custom", err)
+	}
+	if err := r.RemoveQueue("custom", true); err != nil {
+		t.Fatalf("RemoveQueue(%q, true) = %v, want nil", "custom", err)
+	}
+
+	keys := []string{
+		base.GroupKey("custom", "user:1"),
+		base.TaskKey("custom", m2.ID), // behind m1 in the group
+		base.DependentsKey("custom", m1.ID),
+		base.PausedKey("custom"),
+		base.ProcessedTotalKey("custom"),
+		base.ExpiryKey("custom"),
+	}
+	for _, key := range keys {
+		if r.client.Exists(context.Background(), key).Val() != 0 {
+			t.Errorf("key %q still exists", key)
+		}
+	}
+
+	// A new task in the same group is processable right away.
+	m4 := h.NewTaskMessageWithQueue("task4", nil, "custom")
+	m4.GroupKey = "user:1"
+	if err := r.Enqueue(context.Background(), m4); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.GetPendingMessages(t, r.client, "custom"); len(got) != 1 || got[0].ID != m4.ID {
+		t.Errorf("pending tasks in %q = %v, want [%v]", "custom", got, m4)
+	}
+}
+
+func TestRemoveQueueWithCompletedTasks(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	m1 := h.NewTaskMessageWithQueue("task1", nil, "custom")
+	m1.Retention = 3600
+	h.SeedCompletedQueue(t, r.client, []base.Z{{Message: m1, Score: time.Now().Add(time.Hour).Unix()}}, "custom")
+
+	if err := r.RemoveQueue("custom", false); !errors.IsQueueNotEmpty(err) {
+		t.Errorf("RemoveQueue(%q, false) = %v, want QueueNotEmptyError", "custom", err)
+	}
+	if err := r.RemoveQueue("custom", true); err != nil {
+		t.Fatalf("RemoveQueue(%q, true) = %v, want nil", "custom", err)
+	}
+	if r.client.Exists(context.Background(), base.TaskKey("custom", m1.ID)).Val() != 0 {
+		t.Errorf("completed task %q still exists", m1.ID)
+	}
+}
+
 func TestRemoveQueueError(t *testing.T) {
 	r := setup(t)
 	defer r.Close()
@@ -4482,6 +5056,95 @@ func TestRecordSchedulerEnqueueEventTrimsDataSet(t *testing.T) {
 	}
 }
 
+func TestDrainQueue(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	m1 := h.NewTaskMessage("task1", nil)
+	m2 := h.NewTaskMessage("task2", nil)
+	h.SeedPendingQueue(t, r.client, []*base.TaskMessage{m1}, base.DefaultQueueName)
+
+	if err := r.DrainQueue(base.DefaultQueueName); err != nil {
+		t.Fatalf("DrainQueue(%q) returned error: %v", base.DefaultQueueName, err)
+	}
+	if err := r.DrainQueue(base.DefaultQueueName); err == nil {
+		t.Errorf("DrainQueue(%q) on a draining queue returned nil, want error", base.DefaultQueueName)
+	}
+
+	if err := r.Enqueue(context.Background(), m2); !errors.Is(err, errors.ErrQueueDraining) {
+		t.Errorf("Enqueue to a draining queue returned %v, want %v", err, errors.ErrQueueDraining)
+	}
+	if err := r.Schedule(context.Background(), m2, time.Now().Add(time.Hour)); !errors.Is(err, errors.ErrQueueDraining) {
+		t.Errorf("Schedule to a draining queue returned %v, want %v", err, errors.ErrQueueDraining)
+	}
+	m3 := h.NewTaskMessage("task3", nil)
+	m3.UniqueKey = base.UniqueKey(base.DefaultQueueName, m3.Type, nil)
+	if err := r.EnqueueUnique(context.Background(), m3, time.Hour); !errors.Is(err, errors.ErrQueueDraining) {
+		t.Errorf("EnqueueUnique to a draining queue returned %v, want %v", err, errors.ErrQueueDraining)
+	}
+	if err := r.ScheduleUnique(context.Background(), m3, time.Now().Add(time.Hour), time.Hour); !errors.Is(err, errors.ErrQueueDraining) {
+		t.Errorf("ScheduleUnique to a draining queue returned %v, want %v", err, errors.ErrQueueDraining)
+	}
+	if n := r.client.Exists(context.Background(), m3.UniqueKey).Val(); n != 0 {
+		t.Errorf("uniqueness lock %q was acquired for a task of a draining queue", m3.UniqueKey)
+	}
+	m4 := h.NewTaskMessage("task4", nil)
+	m4.GroupKey = "group1"
+	if err := r.Enqueue(context.Background(), m4); !errors.Is(err, errors.ErrQueueDraining) {
+		t.Errorf("Enqueue of a grouped task to a draining queue returned %v, want %v", err, errors.ErrQueueDraining)
+	}
+	stats, err := r.CurrentStats(base.DefaultQueueName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stats.Draining || stats.Pending != 1 {
+		t.Errorf("CurrentStats returned Draining=%t Pending=%d, want Draining=true Pending=1", stats.Draining, stats.Pending)
+	}
+
+	// Removing the queue ends draining.
+	if err := r.RemoveQueue(base.DefaultQueueName, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Enqueue(context.Background(), m2); err != nil {
+		t.Errorf("Enqueue after the queue was removed returned error: %v", err)
+	}
+}
+
+func TestUndrainQueue(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	m1 := h.NewTaskMessage("task1", nil)
+	m2 := h.NewTaskMessage("task2", nil)
+	h.SeedPendingQueue(t, r.client, []*base.TaskMessage{m1}, base.DefaultQueueName)
+
+	if err := r.UndrainQueue(base.DefaultQueueName); err == nil {
+		t.Errorf("UndrainQueue(%q) on a queue which is not draining returned nil, want error", base.DefaultQueueName)
+	}
+	if err := r.DrainQueue(base.DefaultQueueName); err != nil {
+		t.Fatalf("DrainQueue(%q) returned error: %v", base.DefaultQueueName, err)
+	}
+	if err := r.UndrainQueue(base.DefaultQueueName); err != nil {
+		t.Fatalf("UndrainQueue(%q) returned error: %v", base.DefaultQueueName, err)
+	}
+	if key := base.DrainingKey(base.DefaultQueueName); r.client.Exists(context.Background(), key).Val() == 1 {
+		t.Errorf("key %q exists", key)
+	}
+	if err := r.Enqueue(context.Background(), m2); err != nil {
+		t.Errorf("Enqueue to an undrained queue returned error: %v", err)
+	}
+	if msgs := h.GetPendingMessages(t, r.client, base.DefaultQueueName); len(msgs) != 2 {
+		t.Errorf("got %d pending messages, want 2", len(msgs))
+	}
+}
+
+func TestDrainQueueError(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+
+	if err := r.DrainQueue("nonexistent"); !errors.IsQueueNotFound(err) {
+		t.Errorf("DrainQueue(%q) returned %v, want QueueNotFoundError", "nonexistent", err)
+	}
+}
+
 func TestPause(t *testing.T) {
 	r := setup(t)
 
@@ -4506,6 +5169,33 @@ func TestPause(t *testing.T) {
 	}
 }
 
+func TestPauseFor(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	h.FlushDB(t, r.client)
+	r.SetAuditLog(true)
+	defer r.SetAuditLog(false)
+
+	ok, err := r.PauseFor("default", time.Minute, "60% of the last 10 tasks failed")
+	if err != nil || !ok {
+		t.Fatalf("PauseFor returned (%t, %v), want (true, nil)", ok, err)
+	}
+	key := base.PausedKey("default")
+	if ttl := r.client.TTL(context.Background(), key).Val(); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("TTL of %q = %v, want expiration within a minute", key, ttl)
+	}
+	if ok, err := r.PauseFor("default", time.Minute, "again"); err != nil || ok {
+		t.Errorf("PauseFor of paused queue returned (%t, %v), want (false, nil)", ok, err)
+	}
+	events, err := r.ListAuditEvents("default", Pagination{Size: 10})
+	if err != nil {
+		t.Fatalf("ListAuditEvents returned error: %v", err)
+	}
+	if len(events) != 1 || events[0].Event != AuditTripped || events[0].Reason != "60% of the last 10 tasks failed" {
+		t.Errorf("audit events = %v, want one %q event with the reason", events, AuditTripped)
+	}
+}
+
 func TestPauseError(t *testing.T) {
 	r := setup(t)
 
@@ -4586,3 +5276,244 @@ func TestUnpauseError(t *testing.T) {
 		}
 	}
 }
+
+func TestCountTasks(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	// Type long enough for its length to take two bytes in the encoded message.
+	longType := "email:" + string(make([]byte, 200))
+	m1 := h.NewTaskMessage("email:send", []byte(`{"to":"a@example.com"}`))
+	m2 := h.NewTaskMessage("email:send", nil)
+	m3 := h.NewTaskMessage("email:sender", nil)
+	m4 := h.NewTaskMessage("", nil)
+	m5 := h.NewTaskMessage(longType, nil)
+	m2.ErrorMsg = "oops"
+	m2.Headers = map[string]string{"k": "v"}
+	now := time.Now()
+
+	r.client.SAdd(context.Background(), base.AllQueues, base.DefaultQueueName)
+	h.SeedPendingQueue(t, r.client, []*base.TaskMessage{m1, m3}, base.DefaultQueueName)
+	h.SeedArchivedQueue(t, r.client, []base.Z{
+		{Message: m1, Score: now.Unix()},
+		{Message: m2, Score: now.Unix()},
+		{Message: m3, Score: now.Unix()},
+		{Message: m4, Score: now.Unix()},
+		{Message: m5, Score: now.Unix()},
+	}, base.DefaultQueueName)
+
+	tests := []struct {
+		state    base.TaskState
+		tasktype string
+		want     int64
+	}{
+		{base.TaskStateArchived, "", 5},
+		{base.TaskStateArchived, "email:send", 2},
+		{base.TaskStateArchived, "email:sender", 1},
+		{base.TaskStateArchived, longType, 1},
+		{base.TaskStateArchived, "email", 0},
+		{base.TaskStatePending, "", 2},
+		{base.TaskStatePending, "email:send", 1},
+		{base.TaskStateRetry, "email:send", 0},
+		{base.TaskStateActive, "", 0},
+	}
+
+	for _, tc := range tests {
+		got, err := r.CountTasks(base.DefaultQueueName, tc.state, tc.tasktype)
+		if err != nil {
+			t.Errorf("CountTasks(%q, %v, %q) returned error: %v", base.DefaultQueueName, tc.state, tc.tasktype, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("CountTasks(%q, %v, %q) = %d, want %d", base.DefaultQueueName, tc.state, tc.tasktype, got, tc.want)
+		}
+	}
+
+	if _, err := r.CountTasks("nonexistent", base.TaskStatePending, ""); !errors.IsQueueNotFound(err) {
+		t.Errorf("CountTasks on nonexistent queue returned %v, want QueueNotFoundError", err)
+	}
+}
+
+func TestUpdateTasks(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	ctx := context.Background()
+	now := time.Now()
+
+	// More tasks than a batch, matching every other one.
+	var archived []base.Z
+	for i := 0; i < 2*updateTasksBatchSize+50; i++ {
+		msg := h.NewTaskMessage("email:send", nil)
+		if i%2 == 0 {
+			msg = h.NewTaskMessage("image:resize", nil)
+			msg.ErrorMsg = "upstream returned 503"
+			msg.LastFailedAt = now.Add(-2 * time.Hour).Unix()
+		}
+		archived = append(archived, base.Z{Message: msg, Score: now.Unix()})
+	}
+	f := TaskFilter{Type: "image:resize", ErrorContains: "503", FailedBefore: now.Add(-time.Hour)}
+	h.FlushDB(t, r.client)
+	r.client.SAdd(ctx, base.AllQueues, base.DefaultQueueName)
+	h.SeedArchivedQueue(t, r.client, archived, base.DefaultQueueName)
+	// A task whose state changed and a task whose payload was truncated are skipped.
+	changed, truncated := archived[0].Message, archived[2].Message
+	r.client.HSet(ctx, base.TaskKey(base.DefaultQueueName, changed.ID), "state", "pending")
+	r.client.HSet(ctx, base.TaskKey(base.DefaultQueueName, truncated.ID), "truncated", 1)
+	want := int64(len(archived)/2 - 1)
+
+	if n, err := r.UpdateTasks(base.DefaultQueueName, base.TaskStateArchived, TaskActionCount, f); err != nil || n != want {
+		t.Errorf("UpdateTasks(count) = (%d, %v), want (%d, nil)", n, err, want)
+	}
+	if n, err := r.UpdateTasks(base.DefaultQueueName, base.TaskStateArchived, TaskActionRun, f); err != nil || n != want-1 {
+		t.Errorf("UpdateTasks(run) = (%d, %v), want (%d, nil)", n, err, want-1)
+	}
+	for _, msg := range h.GetPendingMessages(t, r.client, base.DefaultQueueName) {
+		if msg.Type != "image:resize" || msg.ID == changed.ID || msg.ID == truncated.ID {
+			t.Errorf("task %s of type %q was run, want it skipped", msg.ID, msg.Type)
+		}
+	}
+	if n, err := r.UpdateTasks(base.DefaultQueueName, base.TaskStateArchived, TaskActionDelete, TaskFilter{}); err != nil || n != int64(len(archived))-want {
+		t.Errorf("UpdateTasks(delete) = (%d, %v), want (%d, nil)", n, err, int64(len(archived))-want)
+	}
+	if got := r.client.ZRange(ctx, base.ArchivedKey(base.DefaultQueueName), 0, -1).Val(); len(got) != 1 || got[0] != changed.ID {
+		t.Errorf("archived tasks = %v, want task %s", got, changed.ID)
+	}
+
+	// Pending tasks enqueued before the time are archived.
+	old, recent, unknown := h.NewTaskMessage("task1", nil), h.NewTaskMessage("task1", nil), h.NewTaskMessage("task1", nil)
+	old.EnqueuedAt = now.Add(-48 * time.Hour).UnixNano()
+	recent.EnqueuedAt = now.UnixNano()
+	h.FlushDB(t, r.client)
+	r.client.SAdd(ctx, base.AllQueues, base.DefaultQueueName)
+	h.SeedPendingQueue(t, r.client, []*base.TaskMessage{old, recent, unknown}, base.DefaultQueueName)
+	f = TaskFilter{EnqueuedBefore: now.Add(-24 * time.Hour)}
+	if n, err := r.UpdateTasks(base.DefaultQueueName, base.TaskStatePending, TaskActionArchive, f); err != nil || n != 1 {
+		t.Errorf("UpdateTasks(archive) = (%d, %v), want (1, nil)", n, err)
+	}
+	if got := h.GetArchivedMessages(t, r.client, base.DefaultQueueName); len(got) != 1 || got[0].ID != old.ID {
+		t.Errorf("archived tasks = %v, want task %s", got, old.ID)
+	}
+	if got := h.GetPendingMessages(t, r.client, base.DefaultQueueName); len(got) != 2 {
+		t.Errorf("got %d pending tasks, want 2", len(got))
+	}
+
+	if _, err := r.UpdateTasks(base.DefaultQueueName, base.TaskStateActive, TaskActionDelete, TaskFilter{}); errors.CanonicalCode(err) != errors.FailedPrecondition {
+		t.Errorf("UpdateTasks(delete) of active tasks returned %v, want FailedPrecondition", err)
+	}
+	if _, err := r.UpdateTasks("nonexistent", base.TaskStateArchived, TaskActionCount, TaskFilter{}); !errors.IsQueueNotFound(err) {
+		t.Errorf("UpdateTasks on nonexistent queue returned %v, want QueueNotFoundError", err)
+	}
+}
+
+func TestListUniqueLocks(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	ctx := context.Background()
+	m1 := h.NewTaskMessage("email:welcome", h.JSON(map[string]interface{}{"user_id": 42}))
+	m1.UniqueKey = base.UniqueKey(base.DefaultQueueName, m1.Type, m1.Payload)
+	m2 := h.NewTaskMessage("reindex", nil)
+	m2.UniqueKey = base.UniqueKey(base.DefaultQueueName, m2.Type, m2.Payload)
+	for _, msg := range []*base.TaskMessage{m1, m2} {
+		if err := r.EnqueueUnique(ctx, msg, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A lock of another queue, and a lock without an expiration.
+	other := h.NewTaskMessage("reindex", nil)
+	other.Queue = "other"
+	other.UniqueKey = base.UniqueKey("other", other.Type, other.Payload)
+	if err := r.EnqueueUnique(ctx, other, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	r.client.Persist(ctx, m2.UniqueKey)
+
+	got, err := r.ListUniqueLocks(base.DefaultQueueName)
+	if err != nil {
+		t.Fatalf("ListUniqueLocks returned error: %v", err)
+	}
+	want := []*UniqueLock{
+		{Key: m1.UniqueKey, TaskID: m1.ID, TTL: time.Hour},
+		{Key: m2.UniqueKey, TaskID: m2.ID, TTL: -1},
+	}
+	if m2.UniqueKey < m1.UniqueKey {
+		want[0], want[1] = want[1], want[0]
+	}
+	ttlOpt := cmp.Comparer(func(x, y time.Duration) bool {
+		if x < 0 || y < 0 {
+			return (x < 0) == (y < 0)
+		}
+		d := x - y
+		return -time.Minute < d && d < time.Minute
+	})
+	if diff := cmp.Diff(want, got, ttlOpt); diff != "" {
+		t.Errorf("ListUniqueLocks mismatch (-want,+got):\n%s", diff)
+	}
+
+	if _, err := r.ListUniqueLocks("nonexistent"); !errors.IsQueueNotFound(err) {
+		t.Errorf("ListUniqueLocks on nonexistent queue returned %v, want QueueNotFoundError", err)
+	}
+}
+
+func TestReleaseUniqueLock(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	ctx := context.Background()
+	msg := h.NewTaskMessage("reindex", nil)
+	msg.UniqueKey = base.UniqueKey(base.DefaultQueueName, msg.Type, msg.Payload)
+	if err := r.EnqueueUnique(ctx, msg, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.ReleaseUniqueLock("other", msg.UniqueKey); errors.CanonicalCode(err) != errors.FailedPrecondition {
+		t.Errorf("ReleaseUniqueLock with a key of another queue returned %v, want FailedPrecondition error", err)
+	}
+	if err := r.ReleaseUniqueLock(base.DefaultQueueName, msg.UniqueKey); err != nil {
+		t.Fatalf("ReleaseUniqueLock returned error: %v", err)
+	}
+	if n := r.client.Exists(ctx, msg.UniqueKey).Val(); n != 0 {
+		t.Errorf("uniqueness lock %q still exists", msg.UniqueKey)
+	}
+	// The task holding the lock is left as is.
+	if diff := cmp.Diff([]*base.TaskMessage{msg}, h.GetPendingMessages(t, r.client, base.DefaultQueueName)); diff != "" {
+		t.Errorf("pending messages mismatch (-want,+got):\n%s", diff)
+	}
+	if err := r.ReleaseUniqueLock(base.DefaultQueueName, msg.UniqueKey); errors.CanonicalCode(err) != errors.NotFound {
+		t.Errorf("ReleaseUniqueLock of released lock returned %v, want NotFound error", err)
+	}
+}
+
+func TestValidateMessage(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	ctx := context.Background()
+	valid := h.NewTaskMessage("email:send", nil)
+	if err := r.Enqueue(ctx, valid); err != nil {
+		t.Fatal(err)
+	}
+	got, err := r.ValidateMessage(base.DefaultQueueName, valid.ID)
+	if err != nil || len(got) != 0 {
+		t.Errorf("ValidateMessage of task enqueued with Enqueue = (%q, %v), want no problems", got, err)
+	}
+
+	// A task written by hand into a queue which is not registered.
+	bad := h.NewTaskMessageWithQueue("email:send", nil, "foreign")
+	encoded := h.MustMarshal(t, bad)
+	r.client.HSet(ctx, base.TaskKey("foreign", "other-id"), "msg", encoded, "state", "scheduled", "timeout", "0")
+	got, err = r.ValidateMessage("foreign", "other-id")
+	if err != nil {
+		t.Fatalf("ValidateMessage returned error: %v", err)
+	}
+	// queue not registered, id mismatch, timeout mismatch, deadline missing, not in the scheduled set.
+	if len(got) != 5 {
+		t.Errorf("ValidateMessage returned %q, want 5 problems", got)
+	}
+
+	r.client.HSet(ctx, base.TaskKey(base.DefaultQueueName, "garbage"), "msg", "not a message", "state", "pending")
+	got, err = r.ValidateMessage(base.DefaultQueueName, "garbage")
+	if err != nil || len(got) != 1 {
+		t.Errorf("ValidateMessage of undecodable message = (%q, %v), want 1 problem", got, err)
+	}
+
+	if _, err := r.ValidateMessage(base.DefaultQueueName, "nonexistent"); !errors.IsTaskNotFound(err) {
+		t.Errorf("ValidateMessage of nonexistent task returned %v, want TaskNotFoundError", err)
+	}
+}
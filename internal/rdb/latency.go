@@ -0,0 +1,113 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// scriptNames maps the SHA1 digest of each lua script of the package to its name.
+// It's only written during the initialization of the package.
+var scriptNames = make(map[string]string)
+
+// newScript returns a lua script whose runs are reported as the operation name.
+func newScript(name, src string) *redis.Script {
+	script := redis.NewScript(src)
+	scriptNames[script.Hash()] = name
+	return script
+}
+
+// SetLatencyFunc installs fn to report the name of the operation, the time it took
+// and the error returned by redis, if any, after each redis command run by RDB.
+// Lua scripts are reported by the name of the script (e.g. "enqueue", "dequeue", "done"),
+// pipelines as "pipeline" and the other commands by their name (e.g. "zrange").
+// A nil reply is not reported as an error.
+//
+// SetLatencyFunc must be called before RDB is used. It's a no-op if fn is nil.
+func (r *RDB) SetLatencyFunc(fn func(op string, d time.Duration, err error)) {
+	if fn == nil {
+		return
+	}
+	r.latency = fn
+	r.client.AddHook(latencyHook{fn: fn})
+}
+
+type startKey struct{}
+
+// latencyHook is a redis.Hook which reports the latency of the commands to fn.
+type latencyHook struct {
+	fn func(op string, d time.Duration, err error)
+}
+
+func (h latencyHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, startKey{}, time.Now()), nil
+}
+
+func (h latencyHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	if err := cmd.Err(); err != nil && cmd.Name() == "evalsha" && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		// The script is loaded and run by the eval which follows.
+		return nil
+	}
+	h.report(ctx, commandName(cmd), cmd.Err())
+	return nil
+}
+
+func (h latencyHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, startKey{}, time.Now()), nil
+}
+
+func (h latencyHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	var err error
+	for _, cmd := range cmds {
+		if cmd.Err() != nil && cmd.Err() != redis.Nil {
+			err = cmd.Err()
+			break
+		}
+	}
+	h.report(ctx, "pipeline", err)
+	return nil
+}
+
+func (h latencyHook) report(ctx context.Context, op string, err error) {
+	start, ok := ctx.Value(startKey{}).(time.Time)
+	if !ok {
+		return
+	}
+	if err == redis.Nil {
+		err = nil
+	}
+	h.fn(op, time.Since(start), err)
+}
+
+// commandName returns the name of the script run by cmd, or the name of cmd
+// if it doesn't run a script of the package.
+func commandName(cmd redis.Cmder) string {
+	args := cmd.Args()
+	if len(args) < 2 {
+		return cmd.Name()
+	}
+	var sha string
+	switch cmd.Name() {
+	case "evalsha":
+		sha, _ = args[1].(string)
+	case "eval":
+		if src, ok := args[1].(string); ok {
+			sum := sha1.Sum([]byte(src))
+			sha = hex.EncodeToString(sum[:])
+		}
+	default:
+		return cmd.Name()
+	}
+	if name, ok := scriptNames[sha]; ok {
+		return name
+	}
+	return cmd.Name()
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/errors"
+)
+
+func TestSetLatencyFunc(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	h.FlushDB(t, r.client)
+
+	var (
+		mu   sync.Mutex
+		ops  []string
+		errs = make(map[string]error)
+	)
+	r.SetLatencyFunc(func(op string, d time.Duration, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if d < 0 {
+			t.Errorf("%s reported negative duration %v", op, d)
+		}
+		ops = append(ops, op)
+		if err != nil {
+			errs[op] = err
+		}
+	})
+
+	msg := h.NewTaskMessage("task1", nil)
+	if err := r.Enqueue(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ListPending(base.DefaultQueueName, Pagination{Size: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.Dequeue(base.DefaultQueueName); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Done(msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.Dequeue(base.DefaultQueueName); !errors.Is(err, errors.ErrNoProcessableTask) {
+		t.Fatalf("Dequeue returned %v, want %v", err, errors.ErrNoProcessableTask)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// Each operation is reported by the name of its script, in order.
+	want := []string{"enqueue", "listMessages", "dequeue", "done", "dequeue"}
+	i := 0
+	for _, op := range ops {
+		if i < len(want) && op == want[i] {
+			i++
+		}
+	}
+	if i != len(want) {
+		t.Errorf("reported operations %v, want %v in order", ops, want)
+	}
+	// An empty queue is a nil reply, not an error.
+	if len(errs) != 0 {
+		t.Errorf("reported errors %v, want none", errs)
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/errors"
+	"github.com/spf13/cast"
+)
+
+// MigrationStates lists the states of the tasks moved by MigrateTasks,
+// in the order in which a queue is migrated.
+//
+// Active tasks are not migrated; they are migrated by a later run once they're
+// retried (or done). The tasks held in a group behind its first task are migrated
+// with the pending tasks, as they become pending once the first task is migrated.
+// Waiting and quarantined tasks are not migrated: MigrateTasks refuses to migrate
+// a queue which has some, see MigrateTasks.
+var MigrationStates = []base.TaskState{
+	base.TaskStateScheduled,
+	base.TaskStateRetry,
+	base.TaskStateArchived,
+	base.TaskStateCompleted,
+	base.TaskStateUnhandled,
+	base.TaskStatePending,
+}
+
+// MigrationBatch describes a batch of tasks moved by MigrateTasks.
+type MigrationBatch struct {
+	// Listed is the number of tasks listed from the source database.
+	Listed int
+
+	// Moved is the number of tasks moved to the destination database.
+	Moved int
+
+	// Conflicts is the number of tasks left in the source database because
+	// the destination database has a task with the same ID.
+	Conflicts int
+}
+
+// KEYS[1] -> asynq:{<qname>}:t:<task_id>
+// KEYS[2] -> asynq:{<qname>}:<state>
+// KEYS[3] -> asynq:{<qname>}:expiry
+// KEYS[4] -> asynq:{<qname>}:pending (unused, see deleteMigratedTaskCmd)
+// KEYS[5] -> unique key (optional)
+// -------
+// ARGV[1] -> task ID
+// ARGV[2] -> 1 if the state is a list, 0 if it's a sorted set
+// ARGV[3] -> score of the task in the sorted set
+// ARGV[4] -> expiration time of the task in unix time (0 if no TTL)
+// ARGV[5] -> TTL of the uniqueness lock in milliseconds
+// ARGV[6:] -> fields and values of the task hash
+//
+// Output:
+// Returns 1 if the task is written
+// Returns 0 if the task ID already exists
+//
+// As with enqueueGroupCmd, a pending task which belongs to a group is added to
+// the group list, and held there if the tasks of the group migrated before it are.
+var writeMigratedTaskCmd = newScript("writeMigratedTask", `
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+redis.call("HSET", KEYS[1], unpack(ARGV, 6))
+local group_key = redis.call("HGET", KEYS[1], "group_key")
+if ARGV[2] == "1" and group_key then
+	if redis.call("RPUSH", group_key, ARGV[1]) == 1 then
+		redis.call("LPUSH", KEYS[2], ARGV[1])
+	end
+elseif ARGV[2] == "1" then
+	redis.call("LPUSH", KEYS[2], ARGV[1])
+else
+	redis.call("ZADD", KEYS[2], ARGV[3], ARGV[1])
+end
+if tonumber(ARGV[4]) > 0 then
+	redis.call("ZADD", KEYS[3], ARGV[4], ARGV[1])
+end
+if #KEYS > 4 and tonumber(ARGV[5]) > 0 then
+	redis.call("SET", KEYS[5], ARGV[1], "PX", ARGV[5], "NX")
+end
+return 1
+`)
+
+// KEYS[1] -> asynq:{<qname>}:t:<task_id>
+// KEYS[2] -> asynq:{<qname>}:<state>
+// KEYS[3] -> asynq:{<qname>}:expiry
+// KEYS[4] -> asynq:{<qname>}:pending
+// KEYS[5] -> unique key (optional)
+// -------
+// ARGV[1] -> task ID
+// ARGV[2] -> 1 if the state is a list, 0 if it's a sorted set
+// ARGV[3] -> state of the task (only deleted if the task is still in the state), empty to delete in any state
+//
+// Output:
+// Returns 1 if the task is deleted
+// Returns 0 if the task is not in the state
+//
+// If the task is the first task of a group, the next task in the group is moved to
+// pending. A task held in a group behind its first task is removed from the group list.
+var deleteMigratedTaskCmd = newScript("deleteMigratedTask", advanceGroupLua+`
+if ARGV[3] ~= "" and redis.call("HGET", KEYS[1], "state") ~= ARGV[3] then
+	return 0
+end
+local n
+if ARGV[2] == "1" then
+	n = redis.call("LREM", KEYS[2], 1, ARGV[1])
+	local group_key = redis.call("HGET", KEYS[1], "group_key")
+	if group_key and n == 1 then
+		advance_group(KEYS[1], ARGV[1], KEYS[4])
+	elseif group_key then
+		n = redis.call("LREM", group_key, 1, ARGV[1])
+	end
+else
+	n = redis.call("ZREM", KEYS[2], ARGV[1])
+end
+if n == 0 then
+	return 0
+end
+redis.call("DEL", KEYS[1])
+redis.call("ZREM", KEYS[3], ARGV[1])
+if #KEYS > 4 and redis.call("GET", KEYS[5]) == ARGV[1] then
+	redis.call("DEL", KEYS[5])
+end
+return 1
+`)
+
+// migratedTask is a task listed from the source database to be moved.
+type migratedTask struct {
+	id     string
+	score  float64
+	fields map[string]string
+	msg    *base.TaskMessage
+}
+
+func stateKey(qname string, state base.TaskState) string {
+	switch state {
+	case base.TaskStatePending:
+		return base.PendingKey(qname)
+	case base.TaskStateScheduled:
+		return base.ScheduledKey(qname)
+	case base.TaskStateRetry:
+		return base.RetryKey(qname)
+	case base.TaskStateArchived:
+		return base.ArchivedKey(qname)
+	case base.TaskStateCompleted:
+		return base.CompletedKey(qname)
+	case base.TaskStateUnhandled:
+		return base.UnhandledKey(qname)
+	}
+	panic(fmt.Sprintf("rdb: tasks in state %v cannot be migrated", state))
+}
+
+// MigrateTasks moves up to n tasks in the given state of the queue from r to dst,
+// oldest first, skipping the first offset tasks. Pass the number of conflicts of
+// the previous batches as offset, to skip the tasks left in r. The state must be
+// one of MigrationStates.
+//
+// Each task is moved with its hash, score, expiration time and uniqueness lock.
+// A task is written to dst before it's deleted from r, and deleted from dst again
+// if it changed state in r meanwhile (e.g. it was dequeued), so that the queue can
+// be migrated while servers process it. The migration of the queue is complete once
+// MigrateTasks lists no task in any of MigrationStates.
+//
+// It returns an error with the FailedPrecondition code if the queue has waiting tasks,
+// as they would never become pending once the tasks they depend on are migrated, or
+// quarantined tasks, which cannot be decoded. Migrate the queue once the waiting tasks
+// are pending, and the quarantined tasks are repaired or deleted.
+func (r *RDB) MigrateTasks(dst *RDB, qname string, state base.TaskState, offset, n int) (*MigrationBatch, error) {
+	var op errors.Op = "rdb.MigrateTasks"
+	ctx := context.Background()
+	for _, k := range []string{base.WaitingKey(qname), base.QuarantineKey(qname)} {
+		size, err := r.client.ZCard(ctx, k).Result()
+		if err != nil {
+			return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "zcard", Err: err})
+		}
+		if size > 0 {
+			return nil, errors.E(op, errors.FailedPrecondition, fmt.Sprintf("queue %q has %d tasks in %q which cannot be migrated", qname, size, k))
+		}
+	}
+	key := stateKey(qname, state)
+	isList := state == base.TaskStatePending
+	tasks, err := r.listMigratedTasks(ctx, key, isList, qname, offset, n)
+	if err != nil {
+		return nil, errors.E(op, errors.Unknown, err)
+	}
+	batch := &MigrationBatch{Listed: len(tasks)}
+	if len(tasks) == 0 {
+		return batch, nil
+	}
+	if err := dst.client.SAdd(ctx, base.AllQueues, qname).Err(); err != nil {
+		return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "sadd", Err: err})
+	}
+	for _, t := range tasks {
+		if t.msg == nil {
+			// The task was deleted since it was listed.
+			continue
+		}
+		srcKeys := []string{base.TaskKey(qname, t.id), key, base.ExpiryKey(qname), base.PendingKey(qname)}
+		if list, ok := t.fields["pending_key"]; ok {
+			// The task was set aside by a server in r, see dequeueCmd.
+			srcKeys[1] = list
+			delete(t.fields, "pending_key")
+		}
+		keys := []string{base.TaskKey(qname, t.id), key, base.ExpiryKey(qname), base.PendingKey(qname)}
+		var lockTTL int64
+		if t.msg.UniqueKey != "" {
+			keys = append(keys, t.msg.UniqueKey)
+			srcKeys = append(srcKeys, t.msg.UniqueKey)
+			if owner, err := r.client.Get(ctx, t.msg.UniqueKey).Result(); err == nil && owner == t.id {
+				lockTTL = r.client.PTTL(ctx, t.msg.UniqueKey).Val().Milliseconds()
+			}
+		}
+		argv := []interface{}{t.id, isList, t.score, t.msg.ExpiresAt, lockTTL}
+		for k, v := range t.fields {
+			argv = append(argv, k, v)
+		}
+		written, err := writeMigratedTaskCmd.Run(ctx, dst.client, keys, argv...).Int()
+		if err != nil {
+			return batch, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
+		}
+		if written == 0 {
+			batch.Conflicts++
+			continue
+		}
+		deleted, err := deleteMigratedTaskCmd.Run(ctx, r.client, srcKeys, t.id, isList, state.String()).Int()
+		if err != nil {
+			return batch, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
+		}
+		if deleted == 0 {
+			// The task changed state in r; keep it there only.
+			if err := deleteMigratedTaskCmd.Run(ctx, dst.client, keys, t.id, isList, "").Err(); err != nil {
+				return batch, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
+			}
+			continue
+		}
+		batch.Moved++
+	}
+	return batch, nil
+}
+
+// listMigratedTasks returns up to n tasks of the state key, oldest first, skipping the first offset tasks.
+func (r *RDB) listMigratedTasks(ctx context.Context, key string, isList bool, qname string, offset, n int) ([]*migratedTask, error) {
+	var tasks []*migratedTask
+	if isList {
+		// The pending tasks include the tasks set aside by dequeueCmd.
+		keys := []string{key, base.PendingListsKey(qname)}
+		res, err := listMessagesCmd.Run(ctx, r.client, keys, offset, offset+n-1, base.TaskKeyPrefix(qname)).Result()
+		if err != nil {
+			return nil, &errors.RedisCommandError{Command: "eval", Err: err}
+		}
+		data, err := cast.ToStringSliceE(res)
+		if err != nil {
+			return nil, fmt.Errorf("cast error: Lua script returned unexpected value: %v", res)
+		}
+		for i := 0; i < len(data); i += 5 {
+			tasks = append(tasks, &migratedTask{id: data[i+3]})
+		}
+	} else {
+		zs, err := r.client.ZRangeWithScores(ctx, key, int64(offset), int64(offset+n-1)).Result()
+		if err != nil {
+			return nil, &errors.RedisCommandError{Command: "zrange", Err: err}
+		}
+		for _, z := range zs {
+			tasks = append(tasks, &migratedTask{id: z.Member.(string), score: z.Score})
+		}
+	}
+	pipe := r.client.Pipeline()
+	cmds := make([]*redis.StringStringMapCmd, len(tasks))
+	for i, t := range tasks {
+		cmds[i] = pipe.HGetAll(ctx, base.TaskKey(qname, t.id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, &errors.RedisCommandError{Command: "hgetall", Err: err}
+	}
+	for i, t := range tasks {
+		t.fields = cmds[i].Val()
+		if msg, err := base.DecodeMessage([]byte(t.fields["msg"])); err == nil {
+			t.msg = msg
+		}
+	}
+	return tasks, nil
+}
@@ -0,0 +1,208 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/errors"
+)
+
+// setupDestination returns an RDB of the database to which tasks are migrated in tests.
+func setupDestination(t *testing.T) *RDB {
+	t.Helper()
+	if useRedisCluster {
+		t.Skip("migration tests use a second database, which redis cluster does not support")
+	}
+	dst := NewRDB(redis.NewClient(&redis.Options{Addr: redisAddr, DB: redisDB + 1}))
+	h.FlushDB(t, dst.client)
+	return dst
+}
+
+// migrateQueue migrates the queue in batches of n tasks, and returns the total
+// numbers of moved and conflicting tasks.
+func migrateQueue(t *testing.T, src, dst *RDB, qname string, n int) (moved, conflicts int) {
+	t.Helper()
+	for _, state := range MigrationStates {
+		offset := 0
+		for {
+			batch, err := src.MigrateTasks(dst, qname, state, offset, n)
+			if err != nil {
+				t.Fatalf("MigrateTasks(%q, %v) returned error: %v", qname, state, err)
+			}
+			if batch.Listed == 0 {
+				break
+			}
+			moved += batch.Moved
+			conflicts += batch.Conflicts
+			offset += batch.Conflicts
+		}
+	}
+	return moved, conflicts
+}
+
+func TestMigrateTasks(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	dst := setupDestination(t)
+	defer dst.Close()
+	now := time.Now()
+	p1 := h.NewTaskMessage("send_email", nil)
+	p2 := h.NewTaskMessage("send_email", nil)
+	p3 := h.NewTaskMessage("send_email", nil)
+	s1 := h.NewTaskMessage("reindex", nil)
+	s1.UniqueKey = base.UniqueKey(s1.Queue, s1.Type, s1.Payload)
+	s2 := h.NewTaskMessage("reindex", nil)
+	s2.ExpiresAt = now.Add(time.Hour).Unix()
+	a1 := h.NewTaskMessage("generate_csv", nil)
+	a1.ErrorMsg = "could not connect"
+	active := h.NewTaskMessage("send_email", nil)
+	// p1 is enqueued first and dequeued first.
+	h.SeedPendingQueue(t, r.client, []*base.TaskMessage{p1, p2, p3}, "default")
+	h.SeedActiveQueue(t, r.client, []*base.TaskMessage{active}, "default")
+	scheduled := []base.Z{
+		{Message: s1, Score: now.Add(time.Minute).Unix()},
+		{Message: s2, Score: now.Add(time.Hour).Unix()},
+	}
+	h.SeedScheduledQueue(t, r.client, scheduled, "default")
+	archived := []base.Z{{Message: a1, Score: now.Add(-time.Hour).Unix()}}
+	h.SeedArchivedQueue(t, r.client, archived, "default")
+	ctx := context.Background()
+	r.client.Set(ctx, s1.UniqueKey, s1.ID, time.Hour)
+	r.client.ZAdd(ctx, base.ExpiryKey("default"), &redis.Z{Score: float64(s2.ExpiresAt), Member: s2.ID})
+	// The destination already has a task with the ID of p2.
+	h.SeedPendingQueue(t, dst.client, []*base.TaskMessage{p2}, "default")
+
+	moved, conflicts := migrateQueue(t, r, dst, "default", 2)
+	if moved != 5 || conflicts != 1 {
+		t.Errorf("migrated %d tasks with %d conflicts, want 5 tasks and 1 conflict", moved, conflicts)
+	}
+
+	wantPending := []*base.TaskMessage{p1, p3, p2}
+	if diff := cmp.Diff(wantPending, h.GetPendingMessages(t, dst.client, "default"), h.SortMsgOpt); diff != "" {
+		t.Errorf("pending messages in destination mismatch (-want,+got):\n%s", diff)
+	}
+	// The order of the pending tasks is preserved.
+	if ids, _ := dst.client.LRange(ctx, base.PendingKey("default"), 0, -1).Result(); ids[len(ids)-1] != p2.ID || ids[1] != p1.ID || ids[0] != p3.ID {
+		t.Errorf("pending list of destination is %v, want [%s %s %s]", ids, p3.ID, p1.ID, p2.ID)
+	}
+	if diff := cmp.Diff(scheduled, h.GetScheduledEntries(t, dst.client, "default"), h.SortZSetEntryOpt); diff != "" {
+		t.Errorf("scheduled entries in destination mismatch (-want,+got):\n%s", diff)
+	}
+	if diff := cmp.Diff(archived, h.GetArchivedEntries(t, dst.client, "default"), h.SortZSetEntryOpt); diff != "" {
+		t.Errorf("archived entries in destination mismatch (-want,+got):\n%s", diff)
+	}
+	if got := dst.client.Get(ctx, s1.UniqueKey).Val(); got != s1.ID {
+		t.Errorf("uniqueness lock in destination holds %q, want %q", got, s1.ID)
+	}
+	if got := dst.client.ZScore(ctx, base.ExpiryKey("default"), s2.ID).Val(); int64(got) != s2.ExpiresAt {
+		t.Errorf("expiry of task in destination is %v, want %d", got, s2.ExpiresAt)
+	}
+	if !dst.client.SIsMember(ctx, base.AllQueues, "default").Val() {
+		t.Errorf("destination does not list queue %q", "default")
+	}
+
+	// The active task and the conflicting task are left in the source.
+	if diff := cmp.Diff([]*base.TaskMessage{p2}, h.GetPendingMessages(t, r.client, "default")); diff != "" {
+		t.Errorf("pending messages in source mismatch (-want,+got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{active}, h.GetActiveMessages(t, r.client, "default")); diff != "" {
+		t.Errorf("active messages in source mismatch (-want,+got):\n%s", diff)
+	}
+	for _, key := range []string{base.ScheduledKey("default"), base.ArchivedKey("default"), s1.UniqueKey, base.TaskKey("default", s1.ID)} {
+		if n := r.client.Exists(ctx, key).Val(); n != 0 {
+			t.Errorf("source still has key %q", key)
+		}
+	}
+}
+
+func TestMigrateTasksWithGroupsAndUnhandledTasks(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	dst := setupDestination(t)
+	defer dst.Close()
+	ctx := context.Background()
+	u := h.NewTaskMessage("unknown", nil)
+	if err := r.Enqueue(ctx, u); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.Dequeue("default"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Park(u, "handler not found"); err != nil {
+		t.Fatal(err)
+	}
+	var group []*base.TaskMessage
+	for i := 0; i < 3; i++ {
+		msg := h.NewTaskMessage("sync_user", nil)
+		msg.GroupKey = "user:1"
+		if err := r.Enqueue(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+		group = append(group, msg)
+	}
+
+	if moved, _ := migrateQueue(t, r, dst, "default", 2); moved != 4 {
+		t.Errorf("migrated %d tasks, want 4", moved)
+	}
+
+	if got := h.GetUnhandledMessages(t, dst.client, "default"); len(got) != 1 || got[0].ID != u.ID {
+		t.Errorf("unhandled tasks in destination = %v, want [%v]", got, u)
+	}
+	groupKey := base.GroupKey("default", "user:1")
+	wantGroup := []string{group[0].ID, group[1].ID, group[2].ID}
+	if diff := cmp.Diff(wantGroup, dst.client.LRange(ctx, groupKey, 0, -1).Val()); diff != "" {
+		t.Errorf("group list in destination mismatch (-want,+got):\n%s", diff)
+	}
+	// Only the first task of the group is pending.
+	if got := h.GetPendingMessages(t, dst.client, "default"); len(got) != 1 || got[0].ID != group[0].ID {
+		t.Errorf("pending tasks in destination = %v, want [%v]", got, group[0])
+	}
+	if n := r.client.Exists(ctx, groupKey, base.PendingKey("default"), base.UnhandledKey("default")).Val(); n != 0 {
+		t.Errorf("source still has %d keys of the migrated tasks", n)
+	}
+
+	msg, _, err := dst.Dequeue("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Done(msg); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.GetPendingMessages(t, dst.client, "default"); len(got) != 1 || got[0].ID != group[1].ID {
+		t.Errorf("pending tasks in destination after the first task is done = %v, want [%v]", got, group[1])
+	}
+}
+
+func TestMigrateTasksRefusesQueueWithWaitingTasks(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	dst := setupDestination(t)
+	defer dst.Close()
+	ctx := context.Background()
+	parent := h.NewTaskMessage("generate_report", nil)
+	child := h.NewTaskMessage("send_report", nil)
+	child.Dependencies = []string{parent.ID}
+	for _, msg := range []*base.TaskMessage{parent, child} {
+		if err := r.Enqueue(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, state := range MigrationStates {
+		if _, err := r.MigrateTasks(dst, "default", state, 0, 10); errors.CanonicalCode(err) != errors.FailedPrecondition {
+			t.Errorf("MigrateTasks(%v) of a queue with waiting tasks returned %v, want FailedPrecondition error", state, err)
+		}
+	}
+	if got := h.GetPendingMessages(t, r.client, "default"); len(got) != 1 || got[0].ID != parent.ID {
+		t.Errorf("pending tasks in source = %v, want [%v]", got, parent)
+	}
+}
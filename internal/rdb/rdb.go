@@ -7,7 +7,10 @@ package rdb
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -23,18 +26,51 @@ const statsTTL = 90 * 24 * time.Hour // 90 days
 type RDB struct {
 	client redis.UniversalClient
 	clock  timeutil.Clock
+
+	// maximum number of tasks moved per script call by ForwardIfReady.
+	forwardBatchSize int
+
+	// maximum size of the payload of a task archived by Archive; zero means no limit.
+	maxArchivedPayloadSize int
+
+	// whether to record events in the audit logs of queues.
+	audit bool
+
+	// actor recorded in the audit log events of administrative actions.
+	actor string
+
+	// whether to publish events to the subscribers of queues.
+	events bool
+
+	// batches the acknowledgements of processed tasks; nil if batching is disabled.
+	acks *batcher
+
+	// whether to delete the dequeued tasks which cannot be decoded instead of
+	// quarantining them.
+	dropUndecodable bool
+
+	// whether list operations omit the tasks which cannot be decoded instead of
+	// quarantining them, so that reads don't write to redis.
+	readOnly bool
+
+	// reports the latency of the redis commands; nil if unset.
+	latency func(op string, d time.Duration, err error)
 }
 
 // NewRDB returns a new instance of RDB.
 func NewRDB(client redis.UniversalClient) *RDB {
 	return &RDB{
-		client: client,
-		clock:  timeutil.NewRealClock(),
+		client:           client,
+		clock:            timeutil.NewRealClock(),
+		forwardBatchSize: defaultForwardBatchSize,
 	}
 }
 
 // Close closes the connection with redis server.
 func (r *RDB) Close() error {
+	if r.acks != nil {
+		r.acks.flush()
+	}
 	return r.client.Close()
 }
 
@@ -43,6 +79,20 @@ func (r *RDB) Client() redis.UniversalClient {
 	return r.client
 }
 
+// SetClient replaces the underlying redis client with c, e.g. to fail over to
+// another database, and closes the previous client. The latency func set with
+// SetLatencyFunc is installed on c.
+//
+// SetClient must be called before RDB is used by other goroutines.
+func (r *RDB) SetClient(c redis.UniversalClient) error {
+	prev := r.client
+	r.client = c
+	if r.latency != nil {
+		c.AddHook(latencyHook{fn: r.latency})
+	}
+	return prev.Close()
+}
+
 // SetClock sets the clock used by RDB to the given clock.
 //
 // Use this function to set the clock to SimulatedClock in tests.
@@ -50,14 +100,102 @@ func (r *RDB) SetClock(c timeutil.Clock) {
 	r.clock = c
 }
 
+// SetForwardBatchSize sets the maximum number of scheduled or retry tasks
+// moved to the pending list at a time by ForwardIfReady.
+// Values less than one are ignored.
+func (r *RDB) SetForwardBatchSize(n int) {
+	if n > 0 {
+		r.forwardBatchSize = n
+	}
+}
+
+// SetMaxArchivedPayloadSize sets the maximum size in bytes of the payload of
+// a task archived by Archive. Larger payloads are truncated to n bytes, and the
+// size and digest of the original payload are recorded in the task message.
+// Values less than one disable the limit.
+func (r *RDB) SetMaxArchivedPayloadSize(n int) {
+	if n < 0 {
+		n = 0
+	}
+	r.maxArchivedPayloadSize = n
+}
+
+// truncatePayload truncates the payload of msg to n bytes if it is larger,
+// recording the size and SHA-256 digest of the original payload.
+func truncatePayload(msg *base.TaskMessage, n int) {
+	if n <= 0 || len(msg.Payload) <= n {
+		return
+	}
+	sum := sha256.Sum256(msg.Payload)
+	msg.PayloadSize = int64(len(msg.Payload))
+	msg.PayloadDigest = hex.EncodeToString(sum[:])
+	msg.Payload = msg.Payload[:n:n]
+}
+
 // Ping checks the connection with redis server.
 func (r *RDB) Ping() error {
 	return r.client.Ping(context.Background()).Err()
 }
 
+// KEYS[1] -> asynq:environment
+// ARGV[1] -> environment name
+//
+// Output:
+// Returns the environment of the database.
+var claimEnvironmentCmd = newScript("claimEnvironment", `
+redis.call("SETNX", KEYS[1], ARGV[1])
+return redis.call("GET", KEYS[1])
+`)
+
+// ClaimEnvironment labels the database with the environment name env unless
+// it's already labeled, and returns the environment of the database.
+func (r *RDB) ClaimEnvironment(env string) (string, error) {
+	var op errors.Op = "rdb.ClaimEnvironment"
+	res, err := claimEnvironmentCmd.Run(context.Background(), r.client, []string{base.EnvironmentKey}, env).Text()
+	if err != nil {
+		return "", errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
+	}
+	return res, nil
+}
+
+// KEYS[1] -> asynq:promoted
+// ARGV[1] -> current unix time
+//
+// Output:
+// Returns the unix time at which the database was promoted.
+var promoteCmd = newScript("promote", `
+redis.call("SETNX", KEYS[1], ARGV[1])
+return redis.call("GET", KEYS[1])
+`)
+
+// Promote marks the database as promoted to replace the primary database
+// it mirrors unless it's already promoted, and returns the time of the promotion.
+func (r *RDB) Promote() (time.Time, error) {
+	var op errors.Op = "rdb.Promote"
+	res, err := promoteCmd.Run(context.Background(), r.client, []string{base.PromotedKey}, r.clock.Now().Unix()).Int64()
+	if err != nil {
+		return time.Time{}, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
+	}
+	return time.Unix(res, 0), nil
+}
+
+// PromotedAt returns the time at which the database was promoted,
+// or the zero time if the database is not promoted.
+func (r *RDB) PromotedAt(ctx context.Context) (time.Time, error) {
+	var op errors.Op = "rdb.PromotedAt"
+	res, err := r.client.Get(ctx, base.PromotedKey).Int64()
+	if err == redis.Nil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "get", Err: err})
+	}
+	return time.Unix(res, 0), nil
+}
+
 func (r *RDB) runScript(ctx context.Context, op errors.Op, script *redis.Script, keys []string, args ...interface{}) error {
 	if err := script.Run(ctx, r.client, keys, args...).Err(); err != nil {
-		return errors.E(op, errors.Internal, fmt.Sprintf("redis eval error: %v", err))
+		return errors.E(op, errors.Internal, &errors.RedisCommandError{Command: "eval", Err: err})
 	}
 	return nil
 }
@@ -66,7 +204,7 @@ func (r *RDB) runScript(ctx context.Context, op errors.Op, script *redis.Script,
 func (r *RDB) runScriptWithErrorCode(ctx context.Context, op errors.Op, script *redis.Script, keys []string, args ...interface{}) (int64, error) {
 	res, err := script.Run(ctx, r.client, keys, args...).Result()
 	if err != nil {
-		return 0, errors.E(op, errors.Unknown, fmt.Sprintf("redis eval error: %v", err))
+		return 0, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
 	}
 	n, ok := res.(int64)
 	if !ok {
@@ -80,17 +218,27 @@ func (r *RDB) runScriptWithErrorCode(ctx context.Context, op errors.Op, script *
 // Input:
 // KEYS[1] -> asynq:{<qname>}:t:<task_id>
 // KEYS[2] -> asynq:{<qname>}:pending
+// KEYS[3] -> asynq:{<qname>}:draining
 // --
 // ARGV[1] -> task message data
 // ARGV[2] -> task ID
 // ARGV[3] -> task timeout in seconds (0 if not timeout)
 // ARGV[4] -> task deadline in unix time (0 if no deadline)
 // ARGV[5] -> current unix time in nsec
+// ARGV[6] -> wakeup channel
+// ARGV[7] -> queue name
+// ARGV[8] -> task class (empty if no class)
+// ARGV[9] -> labels required by the task (empty if no labels)
+// ARGV[10] -> 1 if the task is at-most-once, 0 otherwise
 //
 // Output:
 // Returns 1 if successfully enqueued
 // Returns 0 if task ID already exists
-var enqueueCmd = redis.NewScript(`
+// Returns -2 if the queue is draining
+var enqueueCmd = newScript("enqueue", `
+if redis.call("EXISTS", KEYS[3]) == 1 then
+	return -2
+end
 if redis.call("EXISTS", KEYS[1]) == 1 then
 	return 0
 end
@@ -100,11 +248,158 @@ redis.call("HSET", KEYS[1],
            "timeout", ARGV[3],
            "deadline", ARGV[4],
            "pending_since", ARGV[5])
+if ARGV[8] ~= "" then
+	redis.call("HSET", KEYS[1], "class", ARGV[8])
+end
+if ARGV[9] ~= "" then
+	redis.call("HSET", KEYS[1], "labels", ARGV[9])
+end
+if ARGV[10] == "1" then
+	redis.call("HSET", KEYS[1], "at_most_once", 1)
+end
 redis.call("LPUSH", KEYS[2], ARGV[2])
+redis.call("PUBLISH", ARGV[6], ARGV[7])
+return 1
+`)
+
+// enqueueGroupCmd enqueues a given task message which belongs to a group.
+// The task is added to the pending list only if it's the first task in the group,
+// otherwise it waits in the group list until the tasks before it are processed.
+//
+// Input:
+// KEYS[1] -> asynq:{<qname>}:t:<task_id>
+// KEYS[2] -> asynq:{<qname>}:pending
+// KEYS[3] -> asynq:{<qname>}:group:<group_key>
+// KEYS[4] -> asynq:{<qname>}:draining
+// --
+// ARGV[1] -> task message data
+// ARGV[2] -> task ID
+// ARGV[3] -> task timeout in seconds (0 if not timeout)
+// ARGV[4] -> task deadline in unix time (0 if no deadline)
+// ARGV[5] -> current unix time in nsec
+// ARGV[6] -> wakeup channel
+// ARGV[7] -> queue name
+// ARGV[8] -> task class (empty if no class)
+// ARGV[9] -> labels required by the task (empty if no labels)
+// ARGV[10] -> 1 if the task is at-most-once, 0 otherwise
+//
+// Output:
+// Returns 1 if successfully enqueued
+// Returns 0 if task ID already exists
+// Returns -2 if the queue is draining
+var enqueueGroupCmd = newScript("enqueueGroup", `
+if redis.call("EXISTS", KEYS[4]) == 1 then
+	return -2
+end
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+redis.call("HSET", KEYS[1],
+           "msg", ARGV[1],
+           "state", "pending",
+           "timeout", ARGV[3],
+           "deadline", ARGV[4],
+           "pending_since", ARGV[5],
+           "group_key", KEYS[3])
+if ARGV[8] ~= "" then
+	redis.call("HSET", KEYS[1], "class", ARGV[8])
+end
+if ARGV[9] ~= "" then
+	redis.call("HSET", KEYS[1], "labels", ARGV[9])
+end
+if ARGV[10] == "1" then
+	redis.call("HSET", KEYS[1], "at_most_once", 1)
+end
+if redis.call("RPUSH", KEYS[3], ARGV[2]) == 1 then
+	redis.call("LPUSH", KEYS[2], ARGV[2])
+	redis.call("PUBLISH", ARGV[6], ARGV[7])
+end
+return 1
+`)
+
+// enqueueWaitingCmd enqueues a given task message which depends on other tasks.
+// The task is added to the waiting set until all of its dependencies complete,
+// or to the pending list if no dependency is left to complete.
+// A dependency which doesn't exist is considered completed.
+// The results of the completed dependencies are copied to the task hash.
+// A dependency which is deleted before it completes is considered completed as well,
+// and a task is archived if one of its dependencies is archived (see dependentsLua).
+//
+// Input:
+// KEYS[1] -> asynq:{<qname>}:t:<task_id>
+// KEYS[2] -> asynq:{<qname>}:pending
+// KEYS[3] -> asynq:{<qname>}:waiting
+// KEYS[4] -> asynq:{<qname>}:draining
+// --
+// ARGV[1] -> task message data
+// ARGV[2] -> task ID
+// ARGV[3] -> task timeout in seconds (0 if not timeout)
+// ARGV[4] -> task deadline in unix time (0 if no deadline)
+// ARGV[5] -> current unix time in nsec
+// ARGV[6] -> current unix time in seconds
+// ARGV[7] -> queue key prefix (asynq:{<qname>}:)
+// ARGV[8] -> task class (empty if no class)
+// ARGV[9] -> labels required by the task (empty if no labels)
+// ARGV[10] -> 1 if the task is at-most-once, 0 otherwise
+// ARGV[11:] -> IDs of the tasks the task depends on
+//
+// Output:
+// Returns 1 if successfully enqueued
+// Returns 0 if task ID already exists
+// Returns -2 if the queue is draining
+var enqueueWaitingCmd = newScript("enqueueWaiting", wakeupLua+`
+if redis.call("EXISTS", KEYS[4]) == 1 then
+	return -2
+end
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+local n = 0
+for i = 11, #ARGV do
+	local state = redis.call("HGET", ARGV[7] .. "t:" .. ARGV[i], "state")
+	if state and state ~= "completed" then
+		-- Note: A dependency listed more than once is counted once.
+		n = n + redis.call("SADD", ARGV[7] .. "dependents:" .. ARGV[i], ARGV[2])
+	elseif state then
+		local result = redis.call("HGET", ARGV[7] .. "t:" .. ARGV[i], "result")
+		if result then
+			redis.call("HSET", KEYS[1], "dep_result:" .. ARGV[i], result)
+		end
+	end
+end
+local state = "pending"
+if n > 0 then
+	state = "waiting"
+end
+redis.call("HSET", KEYS[1],
+           "msg", ARGV[1],
+           "state", state,
+           "timeout", ARGV[3],
+           "deadline", ARGV[4],
+           "pending_since", ARGV[5],
+           "waiting_on", n)
+if ARGV[8] ~= "" then
+	redis.call("HSET", KEYS[1], "class", ARGV[8])
+end
+if ARGV[9] ~= "" then
+	redis.call("HSET", KEYS[1], "labels", ARGV[9])
+end
+if ARGV[10] == "1" then
+	redis.call("HSET", KEYS[1], "at_most_once", 1)
+end
+if n > 0 then
+	redis.call("ZADD", KEYS[3], ARGV[6], ARGV[2])
+else
+	redis.call("LPUSH", KEYS[2], ARGV[2])
+	wake_up(ARGV[7])
+end
 return 1
 `)
 
 // Enqueue adds the given task to the pending list of the queue.
+// If the task depends on other tasks, the task waits until all of them complete.
+// If the task belongs to a group, the task is held until all the tasks
+// enqueued before it in the same group are processed.
 func (r *RDB) Enqueue(ctx context.Context, msg *base.TaskMessage) error {
 	var op errors.Op = "rdb.Enqueue"
 	encoded, err := base.EncodeMessage(msg)
@@ -114,6 +409,9 @@ func (r *RDB) Enqueue(ctx context.Context, msg *base.TaskMessage) error {
 	if err := r.client.SAdd(ctx, base.AllQueues, msg.Queue).Err(); err != nil {
 		return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "sadd", Err: err})
 	}
+	if err := r.addExpiry(ctx, op, msg); err != nil {
+		return err
+	}
 	keys := []string{
 		base.TaskKey(msg.Queue, msg.ID),
 		base.PendingKey(msg.Queue),
@@ -125,21 +423,88 @@ func (r *RDB) Enqueue(ctx context.Context, msg *base.TaskMessage) error {
 		msg.Deadline,
 		r.clock.Now().UnixNano(),
 	}
-	n, err := r.runScriptWithErrorCode(ctx, op, enqueueCmd, keys, argv...)
+	script := enqueueCmd
+	switch {
+	case len(msg.Dependencies) > 0:
+		keys = append(keys, base.WaitingKey(msg.Queue))
+		argv = append(argv, r.clock.Now().Unix(), base.QueueKeyPrefix(msg.Queue), msg.Class, labelsArg(msg), atMostOnceArg(msg))
+		for _, id := range msg.Dependencies {
+			argv = append(argv, id)
+		}
+		script = enqueueWaitingCmd
+	case len(msg.GroupKey) > 0:
+		keys = append(keys, base.GroupKey(msg.Queue, msg.GroupKey))
+		argv = append(argv, base.WakeupChannel(msg.Queue), msg.Queue, msg.Class, labelsArg(msg), atMostOnceArg(msg))
+		script = enqueueGroupCmd
+	default:
+		argv = append(argv, base.WakeupChannel(msg.Queue), msg.Queue, msg.Class, labelsArg(msg), atMostOnceArg(msg))
+	}
+	keys = append(keys, base.DrainingKey(msg.Queue))
+	n, err := r.runScriptWithErrorCode(ctx, op, script, keys, argv...)
 	if err != nil {
 		return err
 	}
+	if n == -2 {
+		return errors.E(op, errors.FailedPrecondition, errors.ErrQueueDraining)
+	}
 	if n == 0 {
 		return errors.E(op, errors.AlreadyExists, errors.ErrTaskIdConflict)
 	}
+	if msg.ClonedFrom != "" {
+		r.recordOperatorEvent(msg.Queue, AuditCloned, msg.ID, "", 1)
+		return nil
+	}
+	r.recordTaskEvent(ctx, AuditEnqueued, msg, "")
+	return nil
+}
+
+// labelsArg returns the labels required by the task as stored in the task hash.
+func labelsArg(msg *base.TaskMessage) string {
+	return strings.Join(base.FormatLabels(msg.Labels), ",")
+}
+
+// atMostOnceArg returns 1 if the task is at-most-once, and 0 otherwise.
+// The at_most_once field of the task hash is set for dequeueCmd to mark the task as started.
+func atMostOnceArg(msg *base.TaskMessage) int {
+	if msg.AtMostOnce {
+		return 1
+	}
+	return 0
+}
+
+// addExpiry records the expiration time of the task if the task has a TTL,
+// so that the task is discarded if it hasn't started processing by then.
+//
+// Note: The expiration time is recorded before the task is written. If writing
+// the task fails, the entry is removed once the time passes.
+func (r *RDB) addExpiry(ctx context.Context, op errors.Op, msg *base.TaskMessage) error {
+	if msg.ExpiresAt == 0 {
+		return nil
+	}
+	z := &redis.Z{Score: float64(msg.ExpiresAt), Member: msg.ID}
+	if err := r.client.ZAdd(ctx, base.ExpiryKey(msg.Queue), z).Err(); err != nil {
+		return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "zadd", Err: err})
+	}
 	return nil
 }
 
+// PendingSize returns the number of pending tasks of the given queue.
+func (r *RDB) PendingSize(ctx context.Context, qname string) (int64, error) {
+	var op errors.Op = "rdb.PendingSize"
+	keys := []string{base.PendingKey(qname), base.PendingListsKey(qname)}
+	n, err := pendingSizeCmd.Run(ctx, r.client, keys).Int64()
+	if err != nil {
+		return 0, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
+	}
+	return n, nil
+}
+
 // enqueueUniqueCmd enqueues the task message if the task is unique.
 //
 // KEYS[1] -> unique key
 // KEYS[2] -> asynq:{<qname>}:t:<taskid>
 // KEYS[3] -> asynq:{<qname>}:pending
+// KEYS[4] -> asynq:{<qname>}:draining
 // --
 // ARGV[1] -> task ID
 // ARGV[2] -> uniqueness lock TTL
@@ -147,12 +512,21 @@ func (r *RDB) Enqueue(ctx context.Context, msg *base.TaskMessage) error {
 // ARGV[4] -> task timeout in seconds (0 if not timeout)
 // ARGV[5] -> task deadline in unix time (0 if no deadline)
 // ARGV[6] -> current unix time in nsec
+// ARGV[7] -> wakeup channel
+// ARGV[8] -> queue name
+// ARGV[9] -> task class (empty if no class)
+// ARGV[10] -> labels required by the task (empty if no labels)
+// ARGV[11] -> 1 if the task is at-most-once, 0 otherwise
 //
 // Output:
 // Returns 1 if successfully enqueued
 // Returns 0 if task ID conflicts with another task
 // Returns -1 if task unique key already exists
-var enqueueUniqueCmd = redis.NewScript(`
+// Returns -2 if the queue is draining
+var enqueueUniqueCmd = newScript("enqueueUnique", `
+if redis.call("EXISTS", KEYS[4]) == 1 then
+	return -2
+end
 local ok = redis.call("SET", KEYS[1], ARGV[1], "NX", "EX", ARGV[2])
 if not ok then
   return -1 
@@ -167,10 +541,34 @@ redis.call("HSET", KEYS[2],
            "deadline", ARGV[5],
            "pending_since", ARGV[6],
            "unique_key", KEYS[1])
+if ARGV[9] ~= "" then
+	redis.call("HSET", KEYS[2], "class", ARGV[9])
+end
+if ARGV[10] ~= "" then
+	redis.call("HSET", KEYS[2], "labels", ARGV[10])
+end
+if ARGV[11] == "1" then
+	redis.call("HSET", KEYS[2], "at_most_once", 1)
+end
 redis.call("LPUSH", KEYS[3], ARGV[1])
+redis.call("PUBLISH", ARGV[7], ARGV[8])
 return 1
 `)
 
+// UniqueLockHolder returns the ID of the task holding the uniqueness lock with the given key.
+// It returns a NotFound error if the lock is not held.
+func (r *RDB) UniqueLockHolder(ctx context.Context, key string) (string, error) {
+	var op errors.Op = "rdb.UniqueLockHolder"
+	id, err := r.client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return "", errors.E(op, errors.NotFound, fmt.Sprintf("uniqueness lock %q not found", key))
+	}
+	if err != nil {
+		return "", errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "get", Err: err})
+	}
+	return id, nil
+}
+
 // EnqueueUnique inserts the given task if the task's uniqueness lock can be acquired.
 // It returns ErrDuplicateTask if the lock cannot be acquired.
 func (r *RDB) EnqueueUnique(ctx context.Context, msg *base.TaskMessage, ttl time.Duration) error {
@@ -182,10 +580,14 @@ func (r *RDB) EnqueueUnique(ctx context.Context, msg *base.TaskMessage, ttl time
 	if err := r.client.SAdd(ctx, base.AllQueues, msg.Queue).Err(); err != nil {
 		return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "sadd", Err: err})
 	}
+	if err := r.addExpiry(ctx, op, msg); err != nil {
+		return err
+	}
 	keys := []string{
 		msg.UniqueKey,
 		base.TaskKey(msg.Queue, msg.ID),
 		base.PendingKey(msg.Queue),
+		base.DrainingKey(msg.Queue),
 	}
 	argv := []interface{}{
 		msg.ID,
@@ -194,109 +596,448 @@ func (r *RDB) EnqueueUnique(ctx context.Context, msg *base.TaskMessage, ttl time
 		msg.Timeout,
 		msg.Deadline,
 		r.clock.Now().UnixNano(),
+		base.WakeupChannel(msg.Queue),
+		msg.Queue,
+		msg.Class,
+		labelsArg(msg),
+		atMostOnceArg(msg),
 	}
 	n, err := r.runScriptWithErrorCode(ctx, op, enqueueUniqueCmd, keys, argv...)
 	if err != nil {
 		return err
 	}
+	if n == -2 {
+		return errors.E(op, errors.FailedPrecondition, errors.ErrQueueDraining)
+	}
 	if n == -1 {
+		r.recordDuplicate(ctx, msg)
 		return errors.E(op, errors.AlreadyExists, errors.ErrDuplicateTask)
 	}
 	if n == 0 {
 		return errors.E(op, errors.AlreadyExists, errors.ErrTaskIdConflict)
 	}
+	r.recordTaskEvent(ctx, AuditEnqueued, msg, "")
 	return nil
 }
 
 // Input:
-// KEYS[1] -> asynq:{<qname>}:pending
-// KEYS[2] -> asynq:{<qname>}:paused
-// KEYS[3] -> asynq:{<qname>}:active
-// KEYS[4] -> asynq:{<qname>}:deadlines
+// KEYS[6*i+1] -> asynq:{<qname_i>}:pending
+// KEYS[6*i+2] -> asynq:{<qname_i>}:paused
+// KEYS[6*i+3] -> asynq:{<qname_i>}:active
+// KEYS[6*i+4] -> asynq:{<qname_i>}:deadlines
+// KEYS[6*i+5] -> asynq:{<qname_i>}:pending_lists
+// KEYS[6*i+6] -> asynq:{<qname_i>}:expiry
 // --
 // ARGV[1] -> current time in Unix time
-// ARGV[2] -> task key prefix
+// ARGV[2] -> maximum number of tasks to set aside per queue
+// ARGV[3] -> seconds the started marker of an at-most-once task outlives its deadline
+// ARGV[4] -> number of classes of the tasks to skip (n)
+// ARGV[5:5+n] -> classes of the tasks to skip
+// ARGV[5+n] -> number of labels of the server (m)
+// ARGV[6+n:6+n+m] -> labels of the server
+// ARGV[6+n+m+i] -> key prefix of qname_i, asynq:{<qname_i>}:
 //
 // Output:
-// Returns nil if no processable task is found in the given queue.
-// Returns tuple {msg , deadline} if task is found, where `msg` is the encoded
-// TaskMessage, and `deadline` is Unix time in seconds.
+// Returns nil if no processable task is found in the given queues.
+// Returns tuple {msg, deadline, checkpoint, pending_since, id, i+1, results, lease} if a task
+// is found in qname_i, where `msg` is the encoded TaskMessage, `deadline` is Unix time
+// in seconds, `pending_since` is the Unix time in nanoseconds the task became pending,
+// `id` is the task ID, `results` lists the IDs and results of the dependencies of
+// the task, {id1, result1, ..., idN, resultN}, as written in the dep_result:<id> fields
+// of the task by the scripts completing the dependencies, and `lease` identifies the
+// delivery of the task: the lease field of the task is incremented by every dequeue.
 //
-// Note: dequeueCmd checks whether a queue is paused first, before
-// calling RPOPLPUSH to pop a task from the queue.
+// Note: dequeueCmd skips the paused queues, and pops the oldest task of the first
+// queue in the given order which the server can process: a task whose class is
+// not skipped, and whose labels are all labels of the server.
+// The tasks the server cannot process are set aside instead of being scanned
+// again by every dequeue: they're moved from pending to the list of the pending
+// tasks with the same class and labels, asynq:{<qname>}:pending:<len(class)>:<class>:<labels>,
+// which is added to pending_lists and recorded in the pending_key field of the task.
+// The oldest tasks of these lists are checked first, as they were ahead of the
+// tasks left in pending. At most ARGV[2] tasks of a queue are set aside per call,
+// and the next call carries on from there.
+// An at-most-once task is marked as started by asynq:{<qname>}:started:<task_id>
+// when it's popped, and isn't processable while the marker is held by a previous
+// delivery: it's set aside alone in asynq:{<qname>}:pending:started:<task_id>
+// until the marker is cleared or expires.
 // It computes the task deadline by inspecting Timout and Deadline fields,
 // and inserts the task to the deadlines zset with the computed deadline.
-var dequeueCmd = redis.NewScript(`
-if redis.call("EXISTS", KEYS[2]) == 0 then
-	local id = redis.call("RPOPLPUSH", KEYS[1], KEYS[3])
-	if id then
-		local key = ARGV[2] .. id
-		redis.call("HSET", key, "state", "active")
-		redis.call("HDEL", key, "pending_since")
-		local data = redis.call("HMGET", key, "msg", "timeout", "deadline")
-		local msg = data[1]	
-		local timeout = tonumber(data[2])
-		local deadline = tonumber(data[3])
-		local score
-		if timeout ~= 0 and deadline ~= 0 then
-			score = math.min(ARGV[1]+timeout, deadline)
-		elseif timeout ~= 0 then
-			score = ARGV[1] + timeout
-		elseif deadline ~= 0 then
-			score = deadline
-		else
-			return redis.error_reply("asynq internal error: both timeout and deadline are not set")
+// The task is removed from the expiry zset, as a task which started processing
+// is no longer discarded once it expires.
+// Since it accesses keys of multiple queues, it's run for one queue at a time
+// with Redis Cluster.
+var dequeueCmd = newScript("dequeue", `
+local now = tonumber(ARGV[1])
+local max_set_aside = tonumber(ARGV[2])
+local grace = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+local skip = {}
+for i = 5, 4 + n do
+	skip[ARGV[i]] = true
+end
+local m = tonumber(ARGV[5 + n])
+local labels = {}
+for i = 6 + n, 5 + n + m do
+	labels[ARGV[i]] = true
+end
+local prefixes = 5 + n + m
+
+-- set_aside_list returns the list to set the task aside in if the server
+-- cannot process it now, or nil if it can.
+local function set_aside_list(pending, prefix, id, fields)
+	local class, required, at_most_once = fields[1], fields[2], fields[3]
+	if at_most_once and redis.call("EXISTS", prefix .. "started:" .. id) == 1 then
+		return pending .. ":started:" .. id
+	end
+	local processable = not (class and skip[class])
+	if processable and required then
+		for label in string.gmatch(required, "[^,]+") do
+			if not labels[label] then
+				processable = false
+				break
+			end
+		end
+	end
+	if processable then
+		return nil
+	end
+	class = class or ""
+	return pending .. ":" .. string.len(class) .. ":" .. class .. ":" .. (required or "")
+end
+
+local function activate(prefix, id, active, deadlines, expiry, index)
+	local key = prefix .. "t:" .. id
+	redis.call("LPUSH", active, id)
+	redis.call("ZREM", expiry, id)
+	redis.call("HSET", key, "state", "active")
+	local lease = redis.call("HINCRBY", key, "lease", 1)
+	local data = redis.call("HMGET", key, "msg", "timeout", "deadline", "checkpoint", "pending_since", "at_most_once")
+	redis.call("HDEL", key, "pending_since", "progress", "pending_key")
+	local timeout = tonumber(data[2])
+	local deadline = tonumber(data[3])
+	local score
+	if timeout ~= 0 and deadline ~= 0 then
+		score = math.min(now+timeout, deadline)
+	elseif timeout ~= 0 then
+		score = now + timeout
+	elseif deadline ~= 0 then
+		score = deadline
+	else
+		return redis.error_reply("asynq internal error: both timeout and deadline are not set")
+	end
+	redis.call("ZADD", deadlines, score, id)
+	if data[6] then
+		redis.call("SET", prefix .. "started:" .. id, id, "EX", math.max(score - now, 0) + grace)
+	end
+	local results = {}
+	for _, field in ipairs(redis.call("HKEYS", key)) do
+		if string.sub(field, 1, 11) == "dep_result:" then
+			table.insert(results, string.sub(field, 12))
+			table.insert(results, redis.call("HGET", key, field))
+		end
+	end
+	return {data[1], score, data[4], data[5], id, index, results, lease}
+end
+
+for i = 1, #KEYS / 6 do
+	local pending, paused, active, deadlines, lists, expiry = unpack(KEYS, 6*i-5, 6*i)
+	local prefix = ARGV[prefixes + i]
+	if redis.call("EXISTS", paused) == 0 then
+		for _, list in ipairs(redis.call("SMEMBERS", lists)) do
+			local id = redis.call("LINDEX", list, -1)
+			if not id then
+				redis.call("SREM", lists, list)
+			else
+				local fields = redis.call("HMGET", prefix .. "t:" .. id, "class", "labels", "at_most_once")
+				if not set_aside_list(pending, prefix, id, fields) then
+					redis.call("RPOP", list)
+					return activate(prefix, id, active, deadlines, expiry, i)
+				end
+			end
+		end
+		local set_aside = 0
+		while true do
+			local id = redis.call("LINDEX", pending, -1)
+			if not id then
+				break
+			end
+			local key = prefix .. "t:" .. id
+			local fields = redis.call("HMGET", key, "class", "labels", "at_most_once")
+			local list = set_aside_list(pending, prefix, id, fields)
+			if not list then
+				redis.call("RPOP", pending)
+				return activate(prefix, id, active, deadlines, expiry, i)
+			end
+			if set_aside == max_set_aside then
+				break
+			end
+			redis.call("RPOPLPUSH", pending, list)
+			redis.call("SADD", lists, list)
+			redis.call("HSET", key, "pending_key", list)
+			set_aside = set_aside + 1
 		end
-		redis.call("ZADD", KEYS[4], score, id)
-		return {msg, score}
 	end
 end
 return nil`)
 
+// maxSetAside is the maximum number of pending tasks of a queue set aside by one
+// run of dequeueCmd.
+const maxSetAside = 100
+
+// atMostOnceGrace is the duration after the deadline of an at-most-once task
+// for which it stays marked as started unless the server clears the marker.
+const atMostOnceGrace = time.Minute
+
 // Dequeue queries given queues in order and pops a task message
 // off a queue if one exists and returns the message and deadline.
-// Dequeue skips a queue if the queue is paused.
+// Dequeue skips a queue if the queue is paused, and sets aside the tasks which
+// require labels (see DequeueMatching).
 // If all queues are empty, ErrNoProcessableTask error is returned.
+//
+// Unless the client is a Redis Cluster client, all queues are queried
+// in a single round-trip.
 func (r *RDB) Dequeue(qnames ...string) (msg *base.TaskMessage, deadline time.Time, err error) {
 	var op errors.Op = "rdb.Dequeue"
+	return r.dequeue(op, nil, nil, qnames)
+}
+
+// DequeueSkipping is like Dequeue, but also sets aside the tasks of the given
+// classes. The tasks set aside are dequeued once a server can process them.
+func (r *RDB) DequeueSkipping(skipClasses []string, qnames ...string) (msg *base.TaskMessage, deadline time.Time, err error) {
+	var op errors.Op = "rdb.DequeueSkipping"
+	return r.dequeue(op, nil, skipClasses, qnames)
+}
+
+// DequeueMatching is like DequeueSkipping, but also pops the tasks which require
+// labels if the given labels (as formatted by base.FormatLabels) include all of them.
+// Tasks which require labels are set aside by Dequeue and DequeueSkipping.
+func (r *RDB) DequeueMatching(labels, skipClasses []string, qnames ...string) (msg *base.TaskMessage, deadline time.Time, err error) {
+	var op errors.Op = "rdb.DequeueMatching"
+	return r.dequeue(op, labels, skipClasses, qnames)
+}
+
+func (r *RDB) dequeue(op errors.Op, labels, skipClasses, qnames []string) (*base.TaskMessage, time.Time, error) {
+	if _, ok := r.client.(*redis.ClusterClient); ok && len(qnames) > 1 {
+		for i := range qnames {
+			msg, deadline, err := r.dequeue(op, labels, skipClasses, qnames[i:i+1])
+			if !errors.Is(err, errors.ErrNoProcessableTask) {
+				return msg, deadline, err
+			}
+		}
+		return nil, time.Time{}, errors.E(op, errors.NotFound, errors.ErrNoProcessableTask)
+	}
+	var keys []string
 	for _, qname := range qnames {
-		keys := []string{
+		keys = append(keys,
 			base.PendingKey(qname),
 			base.PausedKey(qname),
 			base.ActiveKey(qname),
 			base.DeadlinesKey(qname),
+			base.PendingListsKey(qname),
+			base.ExpiryKey(qname),
+		)
+	}
+	argv := []interface{}{
+		r.clock.Now().Unix(),
+		maxSetAside,
+		int(atMostOnceGrace.Seconds()),
+		len(skipClasses),
+	}
+	for _, class := range skipClasses {
+		argv = append(argv, class)
+	}
+	argv = append(argv, len(labels))
+	for _, label := range labels {
+		argv = append(argv, label)
+	}
+	for _, qname := range qnames {
+		argv = append(argv, base.QueueKeyPrefix(qname))
+	}
+	res, err := dequeueCmd.Run(context.Background(), r.client, keys, argv...).Result()
+	if err == redis.Nil {
+		return nil, time.Time{}, errors.E(op, errors.NotFound, errors.ErrNoProcessableTask)
+	} else if err != nil {
+		return nil, time.Time{}, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
+	}
+	msg, deadline, err := parseDequeueResult(op, res)
+	if ok, rerr := r.removeUndecodable(qnames, err); rerr != nil {
+		return nil, time.Time{}, errors.E(op, errors.CanonicalCode(rerr), rerr)
+	} else if ok {
+		return r.dequeue(op, labels, skipClasses, qnames)
+	}
+	return r.recordDequeued(msg, deadline, err)
+}
+
+// recordDequeued records the start of the dequeued task in the audit log of its queue.
+func (r *RDB) recordDequeued(msg *base.TaskMessage, deadline time.Time, err error) (*base.TaskMessage, time.Time, error) {
+	if err != nil {
+		return msg, deadline, err
+	}
+	r.recordTaskEvent(context.Background(), AuditStarted, msg, "")
+	return msg, deadline, nil
+}
+
+// parseDequeueResult parses the {msg, deadline, checkpoint, pending_since, id, index, results, lease}
+// tuple returned by dequeueCmd.
+func parseDequeueResult(op errors.Op, res interface{}) (*base.TaskMessage, time.Time, error) {
+	data, err := cast.ToSliceE(res)
+	if err != nil {
+		return nil, time.Time{}, errors.E(op, errors.Internal, fmt.Sprintf("cast error: unexpected return value from Lua script: %v", res))
+	}
+	if len(data) != 8 {
+		return nil, time.Time{}, errors.E(op, errors.Internal, fmt.Sprintf("Lua script returned %d values; expected 8", len(data)))
+	}
+	encoded, err := cast.ToStringE(data[0])
+	if err != nil {
+		return nil, time.Time{}, errors.E(op, errors.Internal, fmt.Sprintf("cast error: unexpected return value from Lua script: %v", res))
+	}
+	d, err := cast.ToInt64E(data[1])
+	if err != nil {
+		return nil, time.Time{}, errors.E(op, errors.Internal, fmt.Sprintf("cast error: unexpected return value from Lua script: %v", res))
+	}
+	msg, err := base.DecodeMessage([]byte(encoded))
+	if err != nil {
+		uerr := &undecodableError{id: cast.ToString(data[4]), index: cast.ToInt(data[5]), err: err}
+		return nil, time.Time{}, errors.E(op, errors.Internal, uerr)
+	}
+	if data[2] != nil {
+		msg.Checkpoint = []byte(cast.ToString(data[2]))
+	}
+	if data[3] != nil {
+		msg.PendingSince = cast.ToInt64(data[3])
+	}
+	results, err := cast.ToStringSliceE(data[6])
+	if err != nil {
+		return nil, time.Time{}, errors.E(op, errors.Internal, fmt.Sprintf("cast error: unexpected return value from Lua script: %v", res))
+	}
+	for i := 0; i+1 < len(results); i += 2 {
+		if msg.DependencyResults == nil {
+			msg.DependencyResults = make(map[string][]byte)
 		}
-		argv := []interface{}{
-			r.clock.Now().Unix(),
-			base.TaskKeyPrefix(qname),
-		}
-		res, err := dequeueCmd.Run(context.Background(), r.client, keys, argv...).Result()
-		if err == redis.Nil {
-			continue
-		} else if err != nil {
-			return nil, time.Time{}, errors.E(op, errors.Unknown, fmt.Sprintf("redis eval error: %v", err))
-		}
-		data, err := cast.ToSliceE(res)
-		if err != nil {
-			return nil, time.Time{}, errors.E(op, errors.Internal, fmt.Sprintf("cast error: unexpected return value from Lua script: %v", res))
-		}
-		if len(data) != 2 {
-			return nil, time.Time{}, errors.E(op, errors.Internal, fmt.Sprintf("Lua script returned %d values; expected 2", len(data)))
-		}
-		encoded, err := cast.ToStringE(data[0])
-		if err != nil {
-			return nil, time.Time{}, errors.E(op, errors.Internal, fmt.Sprintf("cast error: unexpected return value from Lua script: %v", res))
-		}
-		d, err := cast.ToInt64E(data[1])
-		if err != nil {
-			return nil, time.Time{}, errors.E(op, errors.Internal, fmt.Sprintf("cast error: unexpected return value from Lua script: %v", res))
-		}
-		if msg, err = base.DecodeMessage([]byte(encoded)); err != nil {
-			return nil, time.Time{}, errors.E(op, errors.Internal, fmt.Sprintf("cannot decode message: %v", err))
-		}
-		return msg, time.Unix(d, 0), nil
+		msg.DependencyResults[results[i]] = []byte(results[i+1])
+	}
+	msg.Lease = cast.ToInt64(data[7])
+	return msg, time.Unix(d, 0), nil
+}
+
+// advanceGroupLua defines the Lua function advance_group, for the scripts which
+// remove tasks from pending or active: if the task with the given key and id is
+// the head of its group, the next task in the group is moved to the given
+// pending list, so that the group doesn't stall, and idle servers are woken up.
+const advanceGroupLua = wakeupLua + `
+local function advance_group(task_key, id, pending)
+	local group_key = redis.call("HGET", task_key, "group_key")
+	if group_key and redis.call("LINDEX", group_key, 0) == id then
+		redis.call("LPOP", group_key)
+		local next_id = redis.call("LINDEX", group_key, 0)
+		if next_id then
+			redis.call("LPUSH", pending, next_id)
+			wake_up(string.sub(pending, 1, -8))
+		end
+	end
+end
+`
+
+// wakeupLua defines the Lua function wake_up, for the scripts which move tasks
+// to pending: given the queue key prefix (asynq:{<qname>}:), it publishes the name
+// of the queue to the wakeup channel of the queue (see base.WakeupChannel), so that
+// idle servers pick up the tasks without waiting for their next poll.
+const wakeupLua = `
+local function wake_up(prefix)
+	redis.call("PUBLISH", prefix .. "wakeup", string.sub(prefix, 8, -3))
+end
+`
+
+// leaseLua defines the Lua function lease_held, for the scripts acknowledging
+// a processed task: it reports whether the task with the given key is still
+// active under the given lease, i.e. it wasn't recovered and dequeued again
+// since the delivery being acknowledged. A lease of 0 is not checked.
+const leaseLua = `
+local function lease_held(task_key, lease)
+	return lease == "0" or redis.call("HGET", task_key, "lease") == lease
+end
+`
+
+// pendingListsLua defines the Lua function pending_lists, for the scripts which
+// read or remove all pending tasks of a queue: given the pending and pending_lists
+// keys of the queue, it returns the keys of the lists holding its pending tasks,
+// i.e. the lists of the tasks set aside by dequeueCmd, sorted, then pending.
+const pendingListsLua = `
+local function pending_lists(pending, lists)
+	local res = redis.call("SMEMBERS", lists)
+	table.sort(res)
+	table.insert(res, pending)
+	return res
+end
+`
+
+// KEYS[1] -> asynq:{<qname>}:pending
+// KEYS[2] -> asynq:{<qname>}:pending_lists
+//
+// Output:
+// Returns the number of pending tasks, including the tasks set aside by dequeueCmd.
+var pendingSizeCmd = newScript("pendingSize", pendingListsLua+`
+local n = 0
+for _, list in ipairs(pending_lists(KEYS[1], KEYS[2])) do
+	n = n + redis.call("LLEN", list)
+end
+return n`)
+
+// dependentsLua defines the Lua functions for the scripts which delete or archive
+// tasks other tasks may depend on, given the queue key prefix (asynq:{<qname>}:):
+//
+// resolve_dependents moves the tasks waiting only for the deleted task with the given
+// id to pending: like a task which doesn't exist at the time of enqueue, a deleted
+// task is considered completed. Idle servers are woken up.
+//
+// archive_dependents archives the tasks waiting for the archived task with the given
+// id, appending the given encoded archive reason to their messages, and then the
+// tasks waiting for them in turn, since they can no longer be processed.
+const dependentsLua = wakeupLua + `
+local function resolve_dependents(prefix, id, now_ns)
+	local dependents = prefix .. "dependents:" .. id
+	local promoted = false
+	for _, dep in ipairs(redis.call("SMEMBERS", dependents)) do
+		local key = prefix .. "t:" .. dep
+		if redis.call("EXISTS", key) == 1 and redis.call("HINCRBY", key, "waiting_on", -1) <= 0
+			and redis.call("ZREM", prefix .. "waiting", dep) == 1 then
+			redis.call("HSET", key, "state", "pending", "pending_since", now_ns)
+			redis.call("LPUSH", prefix .. "pending", dep)
+			promoted = true
+		end
+	end
+	redis.call("DEL", dependents)
+	if promoted then
+		wake_up(prefix)
+	end
+end
+local function archive_dependents(prefix, id, now, reason)
+	local dependents = prefix .. "dependents:" .. id
+	for _, dep in ipairs(redis.call("SMEMBERS", dependents)) do
+		if redis.call("ZREM", prefix .. "waiting", dep) == 1 then
+			local key = prefix .. "t:" .. dep
+			redis.call("ZADD", prefix .. "archived", now, dep)
+			redis.call("HSET", key, "state", "archived")
+			local msg = redis.call("HGET", key, "msg")
+			if msg then
+				redis.call("HSET", key, "msg", msg .. reason)
+			end
+			archive_dependents(prefix, dep, now, reason)
+		end
+	end
+	redis.call("DEL", dependents)
+end
+`
+
+// encodeDependentsArchiveReason returns the encoded archive reason appended by
+// archive_dependents to the messages of the tasks it archives.
+func encodeDependentsArchiveReason() ([]byte, error) {
+	reason, err := base.EncodeArchiveReason(base.ArchiveReasonDependencyArchived)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode archive reason: %v", err)
 	}
-	return nil, time.Time{}, errors.E(op, errors.NotFound, errors.ErrNoProcessableTask)
+	return reason, nil
 }
 
 // KEYS[1] -> asynq:{<qname>}:active
@@ -304,19 +1045,52 @@ func (r *RDB) Dequeue(qnames ...string) (msg *base.TaskMessage, deadline time.Ti
 // KEYS[3] -> asynq:{<qname>}:t:<task_id>
 // KEYS[4] -> asynq:{<qname>}:processed:<yyyy-mm-dd>
 // KEYS[5] -> asynq:{<qname>}:processed
+// KEYS[6] -> asynq:{<qname>}:pending
+// KEYS[7] -> asynq:{<qname>}:waiting
+// KEYS[8] -> asynq:{<qname>}:dependents:<task_id>
 // ARGV[1] -> task ID
 // ARGV[2] -> stats expiration timestamp
 // ARGV[3] -> max int64 value
-var doneCmd = redis.NewScript(`
+// ARGV[4] -> task key prefix
+// ARGV[5] -> current unix time in nsec
+// ARGV[6] -> lease of the delivery of the task, 0 not to check it
+//
+// If the task belongs to a group, the next task in the group is moved to pending.
+// Tasks waiting only for this task to complete are moved to pending.
+// The result of the task, if any, is copied to the hashes of the tasks waiting for it.
+var doneCmd = newScript("done", leaseLua+advanceGroupLua+`
+if not lease_held(KEYS[3], ARGV[6]) then
+  return redis.error_reply("NOT FOUND")
+end
 if redis.call("LREM", KEYS[1], 0, ARGV[1]) == 0 then
   return redis.error_reply("NOT FOUND")
 end
 if redis.call("ZREM", KEYS[2], ARGV[1]) == 0 then
   return redis.error_reply("NOT FOUND")
 end
+advance_group(KEYS[3], ARGV[1], KEYS[6])
+local result = redis.call("HGET", KEYS[3], "result")
 if redis.call("DEL", KEYS[3]) == 0 then
   return redis.error_reply("NOT FOUND")
 end
+local promoted = false
+for _, id in ipairs(redis.call("SMEMBERS", KEYS[8])) do
+  local key = ARGV[4] .. id
+  if redis.call("EXISTS", key) == 1 then
+    if result then
+      redis.call("HSET", key, "dep_result:" .. ARGV[1], result)
+    end
+    if redis.call("HINCRBY", key, "waiting_on", -1) <= 0 and redis.call("ZREM", KEYS[7], id) == 1 then
+      redis.call("HSET", key, "state", "pending", "pending_since", ARGV[5])
+      redis.call("LPUSH", KEYS[6], id)
+      promoted = true
+    end
+  end
+end
+if promoted then
+  wake_up(string.sub(KEYS[6], 1, -8))
+end
+redis.call("DEL", KEYS[8])
 local n = redis.call("INCR", KEYS[4])
 if tonumber(n) == 1 then
 	redis.call("EXPIREAT", KEYS[4], ARGV[2])
@@ -336,16 +1110,29 @@ return redis.status_reply("OK")
 // KEYS[4] -> asynq:{<qname>}:processed:<yyyy-mm-dd>
 // KEYS[5] -> asynq:{<qname>}:processed
 // KEYS[6] -> unique key
+// KEYS[7] -> asynq:{<qname>}:pending
+// KEYS[8] -> asynq:{<qname>}:waiting
+// KEYS[9] -> asynq:{<qname>}:dependents:<task_id>
 // ARGV[1] -> task ID
 // ARGV[2] -> stats expiration timestamp
 // ARGV[3] -> max int64 value
-var doneUniqueCmd = redis.NewScript(`
+// ARGV[4] -> task key prefix
+// ARGV[5] -> current unix time in nsec
+// ARGV[6] -> lease of the delivery of the task, 0 not to check it
+//
+// Tasks waiting only for this task to complete are moved to pending.
+// The result of the task, if any, is copied to the hashes of the tasks waiting for it.
+var doneUniqueCmd = newScript("doneUnique", leaseLua+wakeupLua+`
+if not lease_held(KEYS[3], ARGV[6]) then
+  return redis.error_reply("NOT FOUND")
+end
 if redis.call("LREM", KEYS[1], 0, ARGV[1]) == 0 then
   return redis.error_reply("NOT FOUND")
 end
 if redis.call("ZREM", KEYS[2], ARGV[1]) == 0 then
   return redis.error_reply("NOT FOUND")
 end
+local result = redis.call("HGET", KEYS[3], "result")
 if redis.call("DEL", KEYS[3]) == 0 then
   return redis.error_reply("NOT FOUND")
 end
@@ -362,7 +1149,25 @@ end
 if redis.call("GET", KEYS[6]) == ARGV[1] then
   redis.call("DEL", KEYS[6])
 end
-return redis.status_reply("OK")
+local promoted = false
+for _, id in ipairs(redis.call("SMEMBERS", KEYS[9])) do
+  local key = ARGV[4] .. id
+  if redis.call("EXISTS", key) == 1 then
+    if result then
+      redis.call("HSET", key, "dep_result:" .. ARGV[1], result)
+    end
+    if redis.call("HINCRBY", key, "waiting_on", -1) <= 0 and redis.call("ZREM", KEYS[8], id) == 1 then
+      redis.call("HSET", key, "state", "pending", "pending_since", ARGV[5])
+      redis.call("LPUSH", KEYS[7], id)
+      promoted = true
+    end
+  end
+end
+if promoted then
+  wake_up(string.sub(KEYS[7], 1, -8))
+end
+redis.call("DEL", KEYS[9])
+return redis.status_reply("OK")
 `)
 
 // Done removes the task from active queue and deletes the task.
@@ -383,13 +1188,26 @@ func (r *RDB) Done(msg *base.TaskMessage) error {
 		msg.ID,
 		expireAt.Unix(),
 		base.MaxInt64,
+		base.TaskKeyPrefix(msg.Queue),
+		now.UnixNano(),
+		msg.Lease,
 	}
+	script := doneCmd
 	// Note: We cannot pass empty unique key when running this script in redis-cluster.
 	if len(msg.UniqueKey) > 0 {
 		keys = append(keys, msg.UniqueKey)
-		return r.runScript(ctx, op, doneUniqueCmd, keys, argv...)
+		script = doneUniqueCmd
+	}
+	keys = append(keys,
+		base.PendingKey(msg.Queue),
+		base.WaitingKey(msg.Queue),
+		base.DependentsKey(msg.Queue, msg.ID),
+	)
+	if err := r.runAckScript(ctx, op, script, keys, argv...); err != nil {
+		return err
 	}
-	return r.runScript(ctx, op, doneCmd, keys, argv...)
+	r.publishTaskEvent(ctx, EventCompleted, msg)
+	return nil
 }
 
 // KEYS[1] -> asynq:{<qname>}:active
@@ -398,23 +1216,38 @@ func (r *RDB) Done(msg *base.TaskMessage) error {
 // KEYS[4] -> asynq:{<qname>}:t:<task_id>
 // KEYS[5] -> asynq:{<qname>}:processed:<yyyy-mm-dd>
 // KEYS[6] -> asynq:{<qname>}:processed
+// KEYS[7] -> asynq:{<qname>}:pending
+// KEYS[8] -> asynq:{<qname>}:waiting
+// KEYS[9] -> asynq:{<qname>}:dependents:<task_id>
 //
 // ARGV[1] -> task ID
 // ARGV[2] -> stats expiration timestamp
 // ARGV[3] -> task exipration time in unix time
 // ARGV[4] -> task message data
 // ARGV[5] -> max int64 value
-var markAsCompleteCmd = redis.NewScript(`
+// ARGV[6] -> task key prefix
+// ARGV[7] -> current unix time in nsec
+// ARGV[8] -> lease of the delivery of the task, 0 not to check it
+//
+// If the task belongs to a group, the next task in the group is moved to pending.
+// Tasks waiting only for this task to complete are moved to pending.
+// The result of the task, if any, is copied to the hashes of the tasks waiting for it.
+var markAsCompleteCmd = newScript("markAsComplete", leaseLua+advanceGroupLua+`
+if not lease_held(KEYS[4], ARGV[8]) then
+  return redis.error_reply("NOT FOUND")
+end
 if redis.call("LREM", KEYS[1], 0, ARGV[1]) == 0 then
   return redis.error_reply("NOT FOUND")
 end
 if redis.call("ZREM", KEYS[2], ARGV[1]) == 0 then
   return redis.error_reply("NOT FOUND")
 end
+advance_group(KEYS[4], ARGV[1], KEYS[7])
 if redis.call("ZADD", KEYS[3], ARGV[3], ARGV[1]) ~= 1 then
   redis.redis.error_reply("INTERNAL")
 end
 redis.call("HSET", KEYS[4], "msg", ARGV[4], "state", "completed")
+local result = redis.call("HGET", KEYS[4], "result")
 local n = redis.call("INCR", KEYS[5])
 if tonumber(n) == 1 then
 	redis.call("EXPIREAT", KEYS[5], ARGV[2])
@@ -425,6 +1258,24 @@ if tonumber(total) == tonumber(ARGV[5]) then
 else
 	redis.call("INCR", KEYS[6])
 end
+local promoted = false
+for _, id in ipairs(redis.call("SMEMBERS", KEYS[9])) do
+  local key = ARGV[6] .. id
+  if redis.call("EXISTS", key) == 1 then
+    if result then
+      redis.call("HSET", key, "dep_result:" .. ARGV[1], result)
+    end
+    if redis.call("HINCRBY", key, "waiting_on", -1) <= 0 and redis.call("ZREM", KEYS[8], id) == 1 then
+      redis.call("HSET", key, "state", "pending", "pending_since", ARGV[7])
+      redis.call("LPUSH", KEYS[7], id)
+      promoted = true
+    end
+  end
+end
+if promoted then
+  wake_up(string.sub(KEYS[7], 1, -8))
+end
+redis.call("DEL", KEYS[9])
 return redis.status_reply("OK")
 `)
 
@@ -435,13 +1286,25 @@ return redis.status_reply("OK")
 // KEYS[5] -> asynq:{<qname>}:processed:<yyyy-mm-dd>
 // KEYS[6] -> asynq:{<qname>}:processed
 // KEYS[7] -> asynq:{<qname>}:unique:{<checksum>}
+// KEYS[8] -> asynq:{<qname>}:pending
+// KEYS[9] -> asynq:{<qname>}:waiting
+// KEYS[10] -> asynq:{<qname>}:dependents:<task_id>
 //
 // ARGV[1] -> task ID
 // ARGV[2] -> stats expiration timestamp
 // ARGV[3] -> task exipration time in unix time
 // ARGV[4] -> task message data
 // ARGV[5] -> max int64 value
-var markAsCompleteUniqueCmd = redis.NewScript(`
+// ARGV[6] -> task key prefix
+// ARGV[7] -> current unix time in nsec
+// ARGV[8] -> lease of the delivery of the task, 0 not to check it
+//
+// Tasks waiting only for this task to complete are moved to pending.
+// The result of the task, if any, is copied to the hashes of the tasks waiting for it.
+var markAsCompleteUniqueCmd = newScript("markAsCompleteUnique", leaseLua+wakeupLua+`
+if not lease_held(KEYS[4], ARGV[8]) then
+  return redis.error_reply("NOT FOUND")
+end
 if redis.call("LREM", KEYS[1], 0, ARGV[1]) == 0 then
   return redis.error_reply("NOT FOUND")
 end
@@ -452,6 +1315,7 @@ if redis.call("ZADD", KEYS[3], ARGV[3], ARGV[1]) ~= 1 then
   redis.redis.error_reply("INTERNAL")
 end
 redis.call("HSET", KEYS[4], "msg", ARGV[4], "state", "completed")
+local result = redis.call("HGET", KEYS[4], "result")
 local n = redis.call("INCR", KEYS[5])
 if tonumber(n) == 1 then
 	redis.call("EXPIREAT", KEYS[5], ARGV[2])
@@ -465,6 +1329,24 @@ end
 if redis.call("GET", KEYS[7]) == ARGV[1] then
   redis.call("DEL", KEYS[7])
 end
+local promoted = false
+for _, id in ipairs(redis.call("SMEMBERS", KEYS[10])) do
+  local key = ARGV[6] .. id
+  if redis.call("EXISTS", key) == 1 then
+    if result then
+      redis.call("HSET", key, "dep_result:" .. ARGV[1], result)
+    end
+    if redis.call("HINCRBY", key, "waiting_on", -1) <= 0 and redis.call("ZREM", KEYS[9], id) == 1 then
+      redis.call("HSET", key, "state", "pending", "pending_since", ARGV[7])
+      redis.call("LPUSH", KEYS[8], id)
+      promoted = true
+    end
+  end
+end
+if promoted then
+  wake_up(string.sub(KEYS[8], 1, -8))
+end
+redis.call("DEL", KEYS[10])
 return redis.status_reply("OK")
 `)
 
@@ -494,13 +1376,26 @@ func (r *RDB) MarkAsComplete(msg *base.TaskMessage) error {
 		now.Unix() + msg.Retention,
 		encoded,
 		base.MaxInt64,
+		base.TaskKeyPrefix(msg.Queue),
+		now.UnixNano(),
+		msg.Lease,
 	}
+	script := markAsCompleteCmd
 	// Note: We cannot pass empty unique key when running this script in redis-cluster.
 	if len(msg.UniqueKey) > 0 {
 		keys = append(keys, msg.UniqueKey)
-		return r.runScript(ctx, op, markAsCompleteUniqueCmd, keys, argv...)
+		script = markAsCompleteUniqueCmd
 	}
-	return r.runScript(ctx, op, markAsCompleteCmd, keys, argv...)
+	keys = append(keys,
+		base.PendingKey(msg.Queue),
+		base.WaitingKey(msg.Queue),
+		base.DependentsKey(msg.Queue, msg.ID),
+	)
+	if err := r.runAckScript(ctx, op, script, keys, argv...); err != nil {
+		return err
+	}
+	r.publishTaskEvent(ctx, EventCompleted, msg)
+	return nil
 }
 
 // KEYS[1] -> asynq:{<qname>}:active
@@ -509,7 +1404,7 @@ func (r *RDB) MarkAsComplete(msg *base.TaskMessage) error {
 // KEYS[4] -> asynq:{<qname>}:t:<task_id>
 // ARGV[1] -> task ID
 // Note: Use RPUSH to push to the head of the queue.
-var requeueCmd = redis.NewScript(`
+var requeueCmd = newScript("requeue", `
 if redis.call("LREM", KEYS[1], 0, ARGV[1]) == 0 then
   return redis.error_reply("NOT FOUND")
 end
@@ -535,16 +1430,24 @@ func (r *RDB) Requeue(msg *base.TaskMessage) error {
 
 // KEYS[1] -> asynq:{<qname>}:t:<task_id>
 // KEYS[2] -> asynq:{<qname>}:scheduled
+// KEYS[3] -> asynq:{<qname>}:draining
 // ARGV[1] -> task message data
 // ARGV[2] -> process_at time in Unix time
 // ARGV[3] -> task ID
 // ARGV[4] -> task timeout in seconds (0 if not timeout)
 // ARGV[5] -> task deadline in unix time (0 if no deadline)
+// ARGV[6] -> task class (empty if no class)
+// ARGV[7] -> labels required by the task (empty if no labels)
+// ARGV[8] -> 1 if the task is at-most-once, 0 otherwise
 //
 // Output:
 // Returns 1 if successfully enqueued
 // Returns 0 if task ID already exists
-var scheduleCmd = redis.NewScript(`
+// Returns -2 if the queue is draining
+var scheduleCmd = newScript("schedule", `
+if redis.call("EXISTS", KEYS[3]) == 1 then
+	return -2
+end
 if redis.call("EXISTS", KEYS[1]) == 1 then
 	return 0
 end
@@ -553,6 +1456,15 @@ redis.call("HSET", KEYS[1],
            "state", "scheduled",
            "timeout", ARGV[4],
            "deadline", ARGV[5])
+if ARGV[6] ~= "" then
+	redis.call("HSET", KEYS[1], "class", ARGV[6])
+end
+if ARGV[7] ~= "" then
+	redis.call("HSET", KEYS[1], "labels", ARGV[7])
+end
+if ARGV[8] == "1" then
+	redis.call("HSET", KEYS[1], "at_most_once", 1)
+end
 redis.call("ZADD", KEYS[2], ARGV[2], ARGV[3])
 return 1
 `)
@@ -567,9 +1479,13 @@ func (r *RDB) Schedule(ctx context.Context, msg *base.TaskMessage, processAt tim
 	if err := r.client.SAdd(ctx, base.AllQueues, msg.Queue).Err(); err != nil {
 		return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "sadd", Err: err})
 	}
+	if err := r.addExpiry(ctx, op, msg); err != nil {
+		return err
+	}
 	keys := []string{
 		base.TaskKey(msg.Queue, msg.ID),
 		base.ScheduledKey(msg.Queue),
+		base.DrainingKey(msg.Queue),
 	}
 	argv := []interface{}{
 		encoded,
@@ -577,32 +1493,47 @@ func (r *RDB) Schedule(ctx context.Context, msg *base.TaskMessage, processAt tim
 		msg.ID,
 		msg.Timeout,
 		msg.Deadline,
+		msg.Class,
+		labelsArg(msg),
+		atMostOnceArg(msg),
 	}
 	n, err := r.runScriptWithErrorCode(ctx, op, scheduleCmd, keys, argv...)
 	if err != nil {
 		return err
 	}
+	if n == -2 {
+		return errors.E(op, errors.FailedPrecondition, errors.ErrQueueDraining)
+	}
 	if n == 0 {
 		return errors.E(op, errors.AlreadyExists, errors.ErrTaskIdConflict)
 	}
+	r.recordTaskEvent(ctx, AuditScheduled, msg, "")
 	return nil
 }
 
 // KEYS[1] -> unique key
 // KEYS[2] -> asynq:{<qname>}:t:<task_id>
 // KEYS[3] -> asynq:{<qname>}:scheduled
+// KEYS[4] -> asynq:{<qname>}:draining
 // ARGV[1] -> task ID
 // ARGV[2] -> uniqueness lock TTL
 // ARGV[3] -> score (process_at timestamp)
 // ARGV[4] -> task message
 // ARGV[5] -> task timeout in seconds (0 if not timeout)
 // ARGV[6] -> task deadline in unix time (0 if no deadline)
+// ARGV[7] -> task class (empty if no class)
+// ARGV[8] -> labels required by the task (empty if no labels)
+// ARGV[9] -> 1 if the task is at-most-once, 0 otherwise
 //
 // Output:
 // Returns 1 if successfully scheduled
 // Returns 0 if task ID already exists
 // Returns -1 if task unique key already exists
-var scheduleUniqueCmd = redis.NewScript(`
+// Returns -2 if the queue is draining
+var scheduleUniqueCmd = newScript("scheduleUnique", `
+if redis.call("EXISTS", KEYS[4]) == 1 then
+	return -2
+end
 local ok = redis.call("SET", KEYS[1], ARGV[1], "NX", "EX", ARGV[2])
 if not ok then
   return -1
@@ -616,6 +1547,15 @@ redis.call("HSET", KEYS[2],
            "timeout", ARGV[5],
            "deadline", ARGV[6],
            "unique_key", KEYS[1])
+if ARGV[7] ~= "" then
+	redis.call("HSET", KEYS[2], "class", ARGV[7])
+end
+if ARGV[8] ~= "" then
+	redis.call("HSET", KEYS[2], "labels", ARGV[8])
+end
+if ARGV[9] == "1" then
+	redis.call("HSET", KEYS[2], "at_most_once", 1)
+end
 redis.call("ZADD", KEYS[3], ARGV[3], ARGV[1])
 return 1
 `)
@@ -631,10 +1571,14 @@ func (r *RDB) ScheduleUnique(ctx context.Context, msg *base.TaskMessage, process
 	if err := r.client.SAdd(ctx, base.AllQueues, msg.Queue).Err(); err != nil {
 		return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "sadd", Err: err})
 	}
+	if err := r.addExpiry(ctx, op, msg); err != nil {
+		return err
+	}
 	keys := []string{
 		msg.UniqueKey,
 		base.TaskKey(msg.Queue, msg.ID),
 		base.ScheduledKey(msg.Queue),
+		base.DrainingKey(msg.Queue),
 	}
 	argv := []interface{}{
 		msg.ID,
@@ -643,20 +1587,78 @@ func (r *RDB) ScheduleUnique(ctx context.Context, msg *base.TaskMessage, process
 		encoded,
 		msg.Timeout,
 		msg.Deadline,
+		msg.Class,
+		labelsArg(msg),
+		atMostOnceArg(msg),
 	}
 	n, err := r.runScriptWithErrorCode(ctx, op, scheduleUniqueCmd, keys, argv...)
 	if err != nil {
 		return err
 	}
+	if n == -2 {
+		return errors.E(op, errors.FailedPrecondition, errors.ErrQueueDraining)
+	}
 	if n == -1 {
+		r.recordDuplicate(ctx, msg)
 		return errors.E(op, errors.AlreadyExists, errors.ErrDuplicateTask)
 	}
 	if n == 0 {
 		return errors.E(op, errors.AlreadyExists, errors.ErrTaskIdConflict)
 	}
+	r.recordTaskEvent(ctx, AuditScheduled, msg, "")
+	return nil
+}
+
+// ReserveIdempotencyKey records the task as the owner of its idempotency key for
+// the given ttl. It returns ErrDuplicateTask if the key is already owned by another task.
+func (r *RDB) ReserveIdempotencyKey(ctx context.Context, msg *base.TaskMessage, ttl time.Duration) error {
+	var op errors.Op = "rdb.ReserveIdempotencyKey"
+	ok, err := r.client.SetNX(ctx, base.IdempotencyKey(msg.Queue, msg.IdempotencyKey), msg.ID, ttl).Result()
+	if err != nil {
+		return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "setnx", Err: err})
+	}
+	if !ok {
+		r.recordDuplicate(ctx, msg)
+		return errors.E(op, errors.AlreadyExists, errors.ErrDuplicateTask)
+	}
 	return nil
 }
 
+// recordDuplicate counts the enqueue of the task rejected as a duplicate.
+// Errors are ignored, since the count is informational.
+func (r *RDB) recordDuplicate(ctx context.Context, msg *base.TaskMessage) {
+	r.client.HIncrBy(ctx, base.DuplicatesKey(msg.Queue), msg.Type, 1)
+}
+
+// KEYS[1] -> asynq:{<qname>}:idempotency:<key>
+// ARGV[1] -> task ID
+var releaseIdempotencyKeyCmd = newScript("releaseIdempotencyKey", `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+  redis.call("DEL", KEYS[1])
+end
+return redis.status_reply("OK")
+`)
+
+// ReleaseIdempotencyKey deletes the idempotency key if it's owned by the given task ID.
+func (r *RDB) ReleaseIdempotencyKey(ctx context.Context, qname, key, taskID string) error {
+	var op errors.Op = "rdb.ReleaseIdempotencyKey"
+	return r.runScript(ctx, op, releaseIdempotencyKeyCmd, []string{base.IdempotencyKey(qname, key)}, taskID)
+}
+
+// GetIdempotencyKeyOwner returns the ID of the task which owns the given idempotency key.
+// It returns an error with NotFound code if no task owns the key.
+func (r *RDB) GetIdempotencyKeyOwner(qname, key string) (string, error) {
+	var op errors.Op = "rdb.GetIdempotencyKeyOwner"
+	id, err := r.client.Get(context.Background(), base.IdempotencyKey(qname, key)).Result()
+	if err == redis.Nil {
+		return "", errors.E(op, errors.NotFound, fmt.Sprintf("idempotency key %q not found in queue %q", key, qname))
+	}
+	if err != nil {
+		return "", errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "get", Err: err})
+	}
+	return id, nil
+}
+
 // KEYS[1] -> asynq:{<qname>}:t:<task_id>
 // KEYS[2] -> asynq:{<qname>}:active
 // KEYS[3] -> asynq:{<qname>}:deadlines
@@ -672,7 +1674,11 @@ func (r *RDB) ScheduleUnique(ctx context.Context, msg *base.TaskMessage, process
 // ARGV[4] -> stats expiration timestamp
 // ARGV[5] -> is_failure (bool)
 // ARGV[6] -> max int64 value
-var retryCmd = redis.NewScript(`
+// ARGV[7] -> lease of the delivery of the task, 0 not to check it
+var retryCmd = newScript("retry", leaseLua+`
+if not lease_held(KEYS[1], ARGV[7]) then
+  return redis.error_reply("NOT FOUND")
+end
 if redis.call("LREM", KEYS[2], 0, ARGV[1]) == 0 then
   return redis.error_reply("NOT FOUND")
 end
@@ -713,6 +1719,7 @@ func (r *RDB) Retry(msg *base.TaskMessage, processAt time.Time, errMsg string, i
 		modified.Retried++
 	}
 	modified.ErrorMsg = errMsg
+	modified.ErrorHistory = base.AppendErrorHistory(msg.ErrorHistory, errMsg)
 	modified.LastFailedAt = now.Unix()
 	encoded, err := base.EncodeMessage(&modified)
 	if err != nil {
@@ -736,8 +1743,13 @@ func (r *RDB) Retry(msg *base.TaskMessage, processAt time.Time, errMsg string, i
 		expireAt.Unix(),
 		isFailure,
 		base.MaxInt64,
+		msg.Lease,
+	}
+	if err := r.runAckScript(ctx, op, retryCmd, keys, argv...); err != nil {
+		return err
 	}
-	return r.runScript(ctx, op, retryCmd, keys, argv...)
+	r.recordTaskEvent(ctx, AuditRetried, msg, errMsg)
+	return nil
 }
 
 const (
@@ -753,6 +1765,7 @@ const (
 // KEYS[6] -> asynq:{<qname>}:failed:<yyyy-mm-dd>
 // KEYS[7] -> asynq:{<qname>}:processed
 // KEYS[8] -> asynq:{<qname>}:failed
+// KEYS[9] -> asynq:{<qname>}:pending
 //
 // ARGV[1] -> task ID
 // ARGV[2] -> updated base.TaskMessage value
@@ -761,17 +1774,34 @@ const (
 // ARGV[5] -> max number of tasks in archive (e.g., 100)
 // ARGV[6] -> stats expiration timestamp
 // ARGV[7] -> max int64 value
-var archiveCmd = redis.NewScript(`
+// ARGV[8] -> queue key prefix
+// ARGV[9] -> encoded archive reason of the tasks waiting for the task
+// ARGV[10] -> lease of the delivery of the task, 0 not to check it
+// ARGV[11] -> 1 if the payload of the task was truncated, 0 otherwise
+//
+// If the task belongs to a group, the next task in the group is moved to pending.
+// The tasks waiting for the task are archived.
+// A task whose payload was truncated is marked by the truncated field of its hash,
+// and cannot be run from the archive.
+var archiveCmd = newScript("archive", leaseLua+advanceGroupLua+dependentsLua+`
+if not lease_held(KEYS[1], ARGV[10]) then
+  return redis.error_reply("NOT FOUND")
+end
 if redis.call("LREM", KEYS[2], 0, ARGV[1]) == 0 then
   return redis.error_reply("NOT FOUND")
 end
 if redis.call("ZREM", KEYS[3], ARGV[1]) == 0 then
   return redis.error_reply("NOT FOUND")
 end
+advance_group(KEYS[1], ARGV[1], KEYS[9])
 redis.call("ZADD", KEYS[4], ARGV[3], ARGV[1])
 redis.call("ZREMRANGEBYSCORE", KEYS[4], "-inf", ARGV[4])
 redis.call("ZREMRANGEBYRANK", KEYS[4], 0, -ARGV[5])
 redis.call("HSET", KEYS[1], "msg", ARGV[2], "state", "archived")
+if ARGV[11] == "1" then
+	redis.call("HSET", KEYS[1], "truncated", 1)
+end
+archive_dependents(ARGV[8], ARGV[1], ARGV[3], ARGV[9])
 local n = redis.call("INCR", KEYS[5])
 if tonumber(n) == 1 then
 	redis.call("EXPIREAT", KEYS[5], ARGV[6])
@@ -790,19 +1820,26 @@ else
 end
 return redis.status_reply("OK")`)
 
-// Archive sends the given task to archive, attaching the error message to the task.
+// Archive sends the given task to archive, attaching the error message and the archive reason to the task.
 // It also trims the archive by timestamp and set size.
-func (r *RDB) Archive(msg *base.TaskMessage, errMsg string) error {
+func (r *RDB) Archive(msg *base.TaskMessage, errMsg, reason string) error {
 	var op errors.Op = "rdb.Archive"
 	ctx := context.Background()
 	now := r.clock.Now()
 	modified := *msg
 	modified.ErrorMsg = errMsg
+	modified.ErrorHistory = base.AppendErrorHistory(msg.ErrorHistory, errMsg)
+	modified.ArchiveReason = reason
 	modified.LastFailedAt = now.Unix()
+	truncatePayload(&modified, r.maxArchivedPayloadSize)
 	encoded, err := base.EncodeMessage(&modified)
 	if err != nil {
 		return errors.E(op, errors.Internal, fmt.Sprintf("cannot encode message: %v", err))
 	}
+	depReason, err := encodeDependentsArchiveReason()
+	if err != nil {
+		return errors.E(op, errors.Internal, err)
+	}
 	cutoff := now.AddDate(0, 0, -archivedExpirationInDays)
 	expireAt := now.Add(statsTTL)
 	keys := []string{
@@ -814,6 +1851,7 @@ func (r *RDB) Archive(msg *base.TaskMessage, errMsg string) error {
 		base.FailedKey(msg.Queue, now),
 		base.ProcessedTotalKey(msg.Queue),
 		base.FailedTotalKey(msg.Queue),
+		base.PendingKey(msg.Queue),
 	}
 	argv := []interface{}{
 		msg.ID,
@@ -823,8 +1861,147 @@ func (r *RDB) Archive(msg *base.TaskMessage, errMsg string) error {
 		maxArchiveSize,
 		expireAt.Unix(),
 		base.MaxInt64,
+		base.QueueKeyPrefix(msg.Queue),
+		depReason,
+		msg.Lease,
+		modified.PayloadSize > 0,
+	}
+	if err := r.runAckScript(ctx, op, archiveCmd, keys, argv...); err != nil {
+		return err
+	}
+	r.recordTaskEvent(ctx, AuditArchived, msg, errMsg)
+	return nil
+}
+
+// KEYS[1] -> asynq:{<qname>}:t:<task_id>
+// KEYS[2] -> asynq:{<qname>}:active
+// KEYS[3] -> asynq:{<qname>}:deadlines
+// KEYS[4] -> asynq:{<qname>}:unhandled
+// KEYS[5] -> asynq:{<qname>}:pending
+//
+// ARGV[1] -> task ID
+// ARGV[2] -> updated base.TaskMessage value
+// ARGV[3] -> parked_at UNIX timestamp
+// ARGV[4] -> lease of the delivery of the task, 0 not to check it
+//
+// If the task belongs to a group, the next task in the group is moved to pending.
+var parkCmd = newScript("park", leaseLua+advanceGroupLua+`
+if not lease_held(KEYS[1], ARGV[4]) then
+  return redis.error_reply("NOT FOUND")
+end
+if redis.call("LREM", KEYS[2], 0, ARGV[1]) == 0 then
+  return redis.error_reply("NOT FOUND")
+end
+if redis.call("ZREM", KEYS[3], ARGV[1]) == 0 then
+  return redis.error_reply("NOT FOUND")
+end
+advance_group(KEYS[1], ARGV[1], KEYS[5])
+redis.call("ZADD", KEYS[4], ARGV[3], ARGV[1])
+redis.call("HSET", KEYS[1], "msg", ARGV[2], "state", "unhandled")
+return redis.status_reply("OK")`)
+
+// Park moves the given task to the unhandled set of its queue, attaching the error message to the task.
+// Unlike archived tasks, parked tasks are kept until they are run or deleted by an operator,
+// and they don't count as failures in the queue stats.
+func (r *RDB) Park(msg *base.TaskMessage, errMsg string) error {
+	var op errors.Op = "rdb.Park"
+	ctx := context.Background()
+	modified := *msg
+	modified.ErrorMsg = errMsg
+	modified.ErrorHistory = base.AppendErrorHistory(msg.ErrorHistory, errMsg)
+	encoded, err := base.EncodeMessage(&modified)
+	if err != nil {
+		return errors.E(op, errors.Internal, fmt.Sprintf("cannot encode message: %v", err))
 	}
-	return r.runScript(ctx, op, archiveCmd, keys, argv...)
+	keys := []string{
+		base.TaskKey(msg.Queue, msg.ID),
+		base.ActiveKey(msg.Queue),
+		base.DeadlinesKey(msg.Queue),
+		base.UnhandledKey(msg.Queue),
+		base.PendingKey(msg.Queue),
+	}
+	argv := []interface{}{
+		msg.ID,
+		encoded,
+		r.clock.Now().Unix(),
+		msg.Lease,
+	}
+	if err := r.runAckScript(ctx, op, parkCmd, keys, argv...); err != nil {
+		return err
+	}
+	r.recordTaskEvent(ctx, AuditParked, msg, errMsg)
+	return nil
+}
+
+// KEYS[1] -> asynq:{<qname>}:t:<task_id>
+// KEYS[2] -> asynq:{<qname>}:active
+// KEYS[3] -> asynq:{<qname>}:deadlines
+// KEYS[4] -> asynq:{<qname>}:quarantine
+// KEYS[5] -> asynq:{<qname>}:pending
+//
+// ARGV[1] -> task ID
+// ARGV[2] -> updated base.TaskMessage value
+// ARGV[3] -> quarantined_at UNIX timestamp
+// ARGV[4] -> lease of the delivery of the task, 0 not to check it
+//
+// If the task belongs to a group, the next task in the group is moved to pending.
+var quarantineActiveCmd = newScript("quarantineActive", leaseLua+advanceGroupLua+`
+if not lease_held(KEYS[1], ARGV[4]) then
+  return redis.error_reply("NOT FOUND")
+end
+if redis.call("LREM", KEYS[2], 0, ARGV[1]) == 0 then
+  return redis.error_reply("NOT FOUND")
+end
+if redis.call("ZREM", KEYS[3], ARGV[1]) == 0 then
+  return redis.error_reply("NOT FOUND")
+end
+advance_group(KEYS[1], ARGV[1], KEYS[5])
+redis.call("ZADD", KEYS[4], ARGV[3], ARGV[1])
+redis.call("HSET", KEYS[1], "msg", ARGV[2], "state", "quarantined", "quarantined_from", "active")
+return redis.status_reply("OK")`)
+
+// Quarantine moves the given active task to the quarantine of its queue, attaching the
+// error message to the task, e.g. because its signature is invalid.
+// Unlike archived tasks, quarantined tasks cannot be run again as-is: they are kept until
+// they are repaired or deleted by an operator, and they don't count as failures in the queue stats.
+func (r *RDB) Quarantine(msg *base.TaskMessage, errMsg string) error {
+	var op errors.Op = "rdb.Quarantine"
+	ctx := context.Background()
+	modified := *msg
+	modified.ErrorMsg = errMsg
+	modified.ErrorHistory = base.AppendErrorHistory(msg.ErrorHistory, errMsg)
+	encoded, err := base.EncodeMessage(&modified)
+	if err != nil {
+		return errors.E(op, errors.Internal, fmt.Sprintf("cannot encode message: %v", err))
+	}
+	keys := []string{
+		base.TaskKey(msg.Queue, msg.ID),
+		base.ActiveKey(msg.Queue),
+		base.DeadlinesKey(msg.Queue),
+		base.QuarantineKey(msg.Queue),
+		base.PendingKey(msg.Queue),
+	}
+	argv := []interface{}{
+		msg.ID,
+		encoded,
+		r.clock.Now().Unix(),
+		msg.Lease,
+	}
+	if err := r.runAckScript(ctx, op, quarantineActiveCmd, keys, argv...); err != nil {
+		return err
+	}
+	r.recordTaskEvent(ctx, AuditQuarantined, msg, errMsg)
+	return nil
+}
+
+// RecordUnhandled increments the count of tasks processed without a handler
+// registered for their type in the given queue.
+func (r *RDB) RecordUnhandled(qname string) error {
+	var op errors.Op = "rdb.RecordUnhandled"
+	if err := r.client.Incr(context.Background(), base.UnhandledTotalKey(qname)).Err(); err != nil {
+		return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "incr", Err: err})
+	}
+	return nil
 }
 
 // ForwardIfReady checks scheduled and retry sets of the given queues
@@ -839,14 +2016,18 @@ func (r *RDB) ForwardIfReady(qnames ...string) error {
 	return nil
 }
 
+// defaultForwardBatchSize is the default maximum number of tasks moved per call of forwardCmd.
+const defaultForwardBatchSize = 100
+
 // KEYS[1] -> source queue (e.g. asynq:{<qname>:scheduled or asynq:{<qname>}:retry})
 // KEYS[2] -> asynq:{<qname>}:pending
 // ARGV[1] -> current unix time in seconds
 // ARGV[2] -> task key prefix
 // ARGV[3] -> current unix time in nsec
-// Note: Script moves tasks up to 100 at a time to keep the runtime of script short.
-var forwardCmd = redis.NewScript(`
-local ids = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, 100)
+// ARGV[4] -> maximum number of tasks to move
+// Note: Script moves tasks up to ARGV[4] at a time to keep the runtime of script short.
+var forwardCmd = newScript("forward", `
+local ids = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, ARGV[4])
 for _, id in ipairs(ids) do
 	redis.call("LPUSH", KEYS[2], id)
 	redis.call("ZREM", KEYS[1], id)
@@ -861,9 +2042,9 @@ return table.getn(ids)`)
 func (r *RDB) forward(src, dst, taskKeyPrefix string) (int, error) {
 	now := r.clock.Now()
 	res, err := forwardCmd.Run(context.Background(), r.client,
-		[]string{src, dst}, now.Unix(), taskKeyPrefix, now.UnixNano()).Result()
+		[]string{src, dst}, now.Unix(), taskKeyPrefix, now.UnixNano(), r.forwardBatchSize).Result()
 	if err != nil {
-		return 0, errors.E(errors.Internal, fmt.Sprintf("redis eval error: %v", err))
+		return 0, errors.E(errors.Internal, &errors.RedisCommandError{Command: "eval", Err: err})
 	}
 	n, err := cast.ToIntE(res)
 	if err != nil {
@@ -875,9 +2056,13 @@ func (r *RDB) forward(src, dst, taskKeyPrefix string) (int, error) {
 // forwardAll checks for tasks in scheduled/retry state that are ready to be run, and updates
 // their state to "pending".
 func (r *RDB) forwardAll(qname string) (err error) {
+	if err := r.discardExpired(qname); err != nil {
+		return err
+	}
 	sources := []string{base.ScheduledKey(qname), base.RetryKey(qname)}
 	dst := base.PendingKey(qname)
 	taskKeyPrefix := base.TaskKeyPrefix(qname)
+	total := 0
 	for _, src := range sources {
 		n := 1
 		for n != 0 {
@@ -885,18 +2070,97 @@ func (r *RDB) forwardAll(qname string) (err error) {
 			if err != nil {
 				return err
 			}
+			total += n
 		}
 	}
+	if total > 0 {
+		r.notifyPending(context.Background(), qname)
+	}
 	return nil
 }
 
+// discardExpiredCmd deletes tasks which haven't started processing
+// by their expiration time.
+//
+// Input:
+// KEYS[1] -> asynq:{<qname>}:expiry
+// KEYS[2] -> asynq:{<qname>}:pending
+// --
+// ARGV[1] -> current unix time in seconds
+// ARGV[2] -> queue key prefix (asynq:{<qname>}:)
+// ARGV[3] -> batch size (i.e. maximum number of entries to process)
+// ARGV[4] -> current unix time in nsec
+//
+// Output:
+// Returns the number of entries removed from the expiry set.
+//
+// Note: Only tasks in pending (including the tasks set aside by dequeueCmd),
+// scheduled or retry state are deleted. Entries of
+// tasks which started processing or which were deleted are simply removed.
+// The next tasks of the groups of the deleted tasks, and the tasks waiting only
+// for them, are moved to pending.
+var discardExpiredCmd = newScript("discardExpired", advanceGroupLua+dependentsLua+`
+local ids = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, tonumber(ARGV[3]))
+for _, id in ipairs(ids) do
+	redis.call("ZREM", KEYS[1], id)
+	local key = ARGV[2] .. "t:" .. id
+	local data = redis.call("HMGET", key, "state", "unique_key", "pending_key")
+	local state = data[1]
+	local removed = 0
+	if state == "pending" then
+		removed = redis.call("LREM", data[3] or KEYS[2], 0, id)
+	elseif state == "scheduled" or state == "retry" then
+		removed = redis.call("ZREM", ARGV[2] .. state, id)
+	end
+	if removed > 0 then
+		advance_group(key, id, KEYS[2])
+		resolve_dependents(ARGV[2], id, ARGV[4])
+		if data[2] and redis.call("GET", data[2]) == id then
+			redis.call("DEL", data[2])
+		end
+		redis.call("DEL", key)
+	end
+end
+return table.getn(ids)`)
+
+// discardExpired deletes the tasks in the given queue which haven't
+// started processing by their expiration time.
+func (r *RDB) discardExpired(qname string) error {
+	// Note: Do this operation in fix batches to prevent long running script.
+	const batchSize = 100
+	for {
+		res, err := discardExpiredCmd.Run(context.Background(), r.client,
+			[]string{base.ExpiryKey(qname), base.PendingKey(qname)},
+			r.clock.Now().Unix(), base.QueueKeyPrefix(qname), batchSize, r.clock.Now().UnixNano()).Result()
+		if err != nil {
+			return errors.E(errors.Internal, &errors.RedisCommandError{Command: "eval", Err: err})
+		}
+		n, err := cast.ToIntE(res)
+		if err != nil {
+			return errors.E(errors.Internal, fmt.Sprintf("cast error: Lua script returned unexpected value: %v", res))
+		}
+		if n < batchSize {
+			return nil
+		}
+	}
+}
+
+// notifyPending publishes a message to wake up servers waiting for tasks
+// in the given queue.
+//
+// The notification is best-effort: servers which miss it pick up
+// the tasks on their next poll, so errors are ignored.
+func (r *RDB) notifyPending(ctx context.Context, qname string) {
+	r.client.Publish(ctx, base.WakeupChannel(qname), qname)
+}
+
 // KEYS[1] -> asynq:{<qname>}:completed
 // ARGV[1] -> current time in unix time
 // ARGV[2] -> task key prefix
 // ARGV[3] -> batch size (i.e. maximum number of tasks to delete)
 //
 // Returns the number of tasks deleted.
-var deleteExpiredCompletedTasksCmd = redis.NewScript(`
+var deleteExpiredCompletedTasksCmd = newScript("deleteExpiredCompletedTasks", `
 local ids = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, tonumber(ARGV[3]))
 for _, id in ipairs(ids) do
 	redis.call("DEL", ARGV[2] .. id)
@@ -920,6 +2184,178 @@ func (r *RDB) DeleteExpiredCompletedTasks(qname string) error {
 	}
 }
 
+// KEYS[1] -> asynq:{<qname>}:scheduled or asynq:{<qname>}:retry
+// KEYS[2] -> asynq:{<qname>}:archived
+// KEYS[3] -> asynq:{<qname>}:pending
+// ARGV[1] -> current time in unix time
+// ARGV[2] -> cutoff in unix time; tasks to be processed before the cutoff are stale
+// ARGV[3] -> archived cutoff in unix time; tasks archived before it are deleted
+// ARGV[4] -> max number of tasks in archive
+// ARGV[5] -> task key prefix
+// ARGV[6] -> encoded archive reason to append to the task messages
+// ARGV[7] -> batch size (i.e. maximum number of tasks to archive)
+// ARGV[8] -> queue key prefix
+// ARGV[9] -> encoded archive reason of the tasks waiting for the archived tasks
+//
+// Returns the number of tasks archived.
+//
+// Note: The next tasks of the groups of the archived tasks are moved to pending,
+// and the tasks waiting for the archived tasks are archived.
+var archiveStaleTasksCmd = newScript("archiveStaleTasks", advanceGroupLua+dependentsLua+`
+local ids = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", "(" .. ARGV[2], "LIMIT", 0, tonumber(ARGV[7]))
+for _, id in ipairs(ids) do
+	local key = ARGV[5] .. id
+	redis.call("ZREM", KEYS[1], id)
+	advance_group(key, id, KEYS[3])
+	redis.call("ZADD", KEYS[2], ARGV[1], id)
+	redis.call("HSET", key, "state", "archived")
+	local msg = redis.call("HGET", key, "msg")
+	if msg then
+		redis.call("HSET", key, "msg", msg .. ARGV[6])
+	end
+	archive_dependents(ARGV[8], id, ARGV[1], ARGV[9])
+end
+if #ids > 0 then
+	redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", ARGV[3])
+	redis.call("ZREMRANGEBYRANK", KEYS[2], 0, -ARGV[4])
+end
+return table.getn(ids)`)
+
+// ArchiveStaleTasks archives the scheduled and retry tasks of the given queue which
+// were to be processed before the cutoff, e.g. tasks stuck in these states because
+// of a past bug, with the archive reason base.ArchiveReasonStale. It returns the
+// number of tasks archived.
+//
+// If a queue with the given name doesn't exist, it returns QueueNotFoundError.
+func (r *RDB) ArchiveStaleTasks(qname string, cutoff time.Time) (int64, error) {
+	var op errors.Op = "rdb.ArchiveStaleTasks"
+	if err := r.checkQueueExists(qname); err != nil {
+		return 0, errors.E(op, errors.CanonicalCode(err), err)
+	}
+	reason, err := base.EncodeArchiveReason(base.ArchiveReasonStale)
+	if err != nil {
+		return 0, errors.E(op, errors.Internal, fmt.Sprintf("cannot encode archive reason: %v", err))
+	}
+	depReason, err := encodeDependentsArchiveReason()
+	if err != nil {
+		return 0, errors.E(op, errors.Internal, err)
+	}
+	// Note: Do this operation in fix batches to prevent long running script.
+	const batchSize = 100
+	var total int64
+	for _, state := range []base.TaskState{base.TaskStateScheduled, base.TaskStateRetry} {
+		keys := []string{stateKey(qname, state), base.ArchivedKey(qname), base.PendingKey(qname)}
+		for {
+			now := r.clock.Now()
+			argv := []interface{}{
+				now.Unix(),
+				cutoff.Unix(),
+				now.AddDate(0, 0, -archivedExpirationInDays).Unix(),
+				maxArchiveSize,
+				base.TaskKeyPrefix(qname),
+				reason,
+				batchSize,
+				base.QueueKeyPrefix(qname),
+				depReason,
+			}
+			n, err := archiveStaleTasksCmd.Run(context.Background(), r.client, keys, argv...).Int64()
+			if err != nil {
+				return total, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
+			}
+			r.recordOperatorEvent(qname, AuditArchived, "", state.String(), n)
+			total += n
+			if n < batchSize {
+				break
+			}
+		}
+	}
+	return total, nil
+}
+
+// KEYS[1] -> asynq:{<qname>}:scheduled or asynq:{<qname>}:retry
+// ARGV[1] -> delay in seconds
+// ARGV[2] -> highest score of the batch, "+inf" for the first batch
+// ARGV[3] -> number of the tasks with the highest score to skip
+// ARGV[4] -> batch size
+// ARGV[5] -> task key prefix
+//
+// Output:
+// Returns the number of tasks delayed, the highest score and the number of tasks
+// with this score to skip for the next batch, and the number of tasks read.
+//
+// Note: The tasks are read from the highest score down, so that the delayed tasks,
+// whose scores are raised, are not read again by the next batches. Tasks which must
+// start processing before their new process time (see TaskMessage.ExpiresAt) keep
+// their process time, so that they are not discarded before being processed.
+var delayQueueCmd = newScript("delayQueue", msgFieldsLua+`
+local entries = redis.call("ZREVRANGEBYSCORE", KEYS[1], ARGV[2], "-inf", "WITHSCORES",
+	"LIMIT", tonumber(ARGV[3]), tonumber(ARGV[4]))
+local delayed, cursor, offset = 0, ARGV[2], tonumber(ARGV[3])
+for i = 1, #entries, 2 do
+	local id, score = entries[i], entries[i+1]
+	if score ~= cursor then
+		cursor, offset = score, 0
+	end
+	local process_at = tonumber(score) + tonumber(ARGV[1])
+	local msg = redis.call("HGET", ARGV[5] .. id, "msg")
+	local expires_at = msg and msg_fields(msg, {[18] = true})[18]
+	if expires_at and expires_at > 0 and process_at > expires_at then
+		offset = offset + 1
+	else
+		redis.call("ZADD", KEYS[1], "XX", process_at, id)
+		delayed = delayed + 1
+	end
+end
+return {delayed, cursor, offset, #entries / 2}`)
+
+// delayQueueBatchSize is the number of tasks read by each run of delayQueueCmd.
+const delayQueueBatchSize = 100
+
+// DelayQueue moves the process time of all the scheduled and retry tasks of the
+// given queue forward by d, rounded down to a second, in batches. It returns the
+// number of tasks delayed.
+//
+// Tasks which would be delayed past the time by which they must start processing
+// (see TaskMessage.ExpiresAt) are not delayed, so that they are not discarded.
+//
+// If a queue with the given name doesn't exist, it returns QueueNotFoundError.
+func (r *RDB) DelayQueue(qname string, d time.Duration) (int64, error) {
+	var op errors.Op = "rdb.DelayQueue"
+	if err := r.checkQueueExists(qname); err != nil {
+		return 0, errors.E(op, errors.CanonicalCode(err), err)
+	}
+	var total int64
+	for _, state := range []base.TaskState{base.TaskStateScheduled, base.TaskStateRetry} {
+		keys := []string{stateKey(qname, state)}
+		cursor, offset := "+inf", int64(0)
+		for {
+			argv := []interface{}{
+				int64(d / time.Second),
+				cursor,
+				offset,
+				delayQueueBatchSize,
+				base.TaskKeyPrefix(qname),
+			}
+			res, err := delayQueueCmd.Run(context.Background(), r.client, keys, argv...).Result()
+			if err != nil {
+				return total, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
+			}
+			data, err := cast.ToSliceE(res)
+			if err != nil || len(data) != 4 {
+				return total, errors.E(op, errors.Internal, fmt.Sprintf("cast error: unexpected return value from Lua script: %v", res))
+			}
+			n := cast.ToInt64(data[0])
+			r.recordOperatorEvent(qname, AuditDelayed, "", state.String(), n)
+			total += n
+			cursor, offset = cast.ToString(data[1]), cast.ToInt64(data[2])
+			if cast.ToInt64(data[3]) < delayQueueBatchSize {
+				break
+			}
+		}
+	}
+	return total, nil
+}
+
 // deleteExpiredCompletedTasks runs the lua script to delete expired deleted task with the specified
 // batch size. It reports the number of tasks deleted.
 func (r *RDB) deleteExpiredCompletedTasks(qname string, batchSize int) (int64, error) {
@@ -932,7 +2368,7 @@ func (r *RDB) deleteExpiredCompletedTasks(qname string, batchSize int) (int64, e
 	}
 	res, err := deleteExpiredCompletedTasksCmd.Run(context.Background(), r.client, keys, argv...).Result()
 	if err != nil {
-		return 0, errors.E(op, errors.Internal, fmt.Sprintf("redis eval error: %v", err))
+		return 0, errors.E(op, errors.Internal, &errors.RedisCommandError{Command: "eval", Err: err})
 	}
 	n, ok := res.(int64)
 	if !ok {
@@ -941,20 +2377,283 @@ func (r *RDB) deleteExpiredCompletedTasks(qname string, batchSize int) (int64, e
 	return n, nil
 }
 
+// maxQueueHistorySize is the maximum number of samples in the history of a queue.
+const maxQueueHistorySize = 10000
+
+// KEYS[1] -> asynq:{<qname>}:history
+// KEYS[2] -> asynq:{<qname>}:pending
+// KEYS[3] -> asynq:{<qname>}:active
+// KEYS[4] -> asynq:{<qname>}:scheduled
+// KEYS[5] -> asynq:{<qname>}:retry
+// KEYS[6] -> asynq:{<qname>}:archived
+// KEYS[7] -> asynq:{<qname>}:completed
+// KEYS[8] -> asynq:{<qname>}:waiting
+// KEYS[9] -> asynq:{<qname>}:unhandled
+// KEYS[10] -> asynq:{<qname>}:pending_lists
+// ARGV[1] -> current time in unix time in milliseconds
+// ARGV[2] -> minimum interval between samples in milliseconds
+// ARGV[3] -> maximum number of samples
+//
+// Returns 1 if the sizes are recorded, 0 if the last sample is more recent than the interval.
+var recordQueueSizesCmd = newScript("recordQueueSizes", pendingListsLua+`
+local last = redis.call("ZRANGE", KEYS[1], -1, -1, "WITHSCORES")
+if #last > 0 and tonumber(ARGV[1]) - tonumber(last[2]) < tonumber(ARGV[2]) then
+	return 0
+end
+local pending = 0
+for _, list in ipairs(pending_lists(KEYS[2], KEYS[10])) do
+	pending = pending + redis.call("LLEN", list)
+end
+local counts = {pending, redis.call("LLEN", KEYS[3])}
+for i = 4, 9 do
+	table.insert(counts, redis.call("ZCARD", KEYS[i]))
+end
+redis.call("ZADD", KEYS[1], ARGV[1], ARGV[1] .. ":" .. table.concat(counts, ","))
+redis.call("ZREMRANGEBYRANK", KEYS[1], 0, -tonumber(ARGV[3]) - 1)
+return 1`)
+
+// RecordQueueSizes samples the number of tasks in each state of the given queue,
+// and adds the sample to the history of the queue unless the last sample was
+// taken within the given interval, e.g. by another server.
+// The history holds the most recent samples only.
+func (r *RDB) RecordQueueSizes(qname string, interval time.Duration) error {
+	var op errors.Op = "rdb.RecordQueueSizes"
+	keys := []string{
+		base.QueueHistoryKey(qname),
+		base.PendingKey(qname),
+		base.ActiveKey(qname),
+		base.ScheduledKey(qname),
+		base.RetryKey(qname),
+		base.ArchivedKey(qname),
+		base.CompletedKey(qname),
+		base.WaitingKey(qname),
+		base.UnhandledKey(qname),
+		base.PendingListsKey(qname),
+	}
+	argv := []interface{}{
+		r.clock.Now().UnixNano() / int64(time.Millisecond),
+		interval.Milliseconds(),
+		maxQueueHistorySize,
+	}
+	if err := recordQueueSizesCmd.Run(context.Background(), r.client, keys, argv...).Err(); err != nil {
+		return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
+	}
+	return nil
+}
+
+// maxTaskSamples is the maximum number of sampled tasks kept for each queue.
+const maxTaskSamples = 1000
+
+// RecordTaskSample adds the sampled task to the samples of the given queue.
+// Only the most recent samples are kept.
+func (r *RDB) RecordTaskSample(qname string, s *base.TaskSample) error {
+	var op errors.Op = "rdb.RecordTaskSample"
+	member := fmt.Sprintf("%d,%d,%d,%d,%s", s.CompletedAt.UnixNano()/int64(time.Millisecond),
+		s.PayloadSize, s.Duration.Microseconds(), s.WaitTime.Microseconds(), s.Type)
+	key := base.TaskSamplesKey(qname)
+	_, err := r.client.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.LPush(context.Background(), key, member)
+		pipe.LTrim(context.Background(), key, 0, maxTaskSamples-1)
+		return nil
+	})
+	if err != nil {
+		return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "lpush", Err: err})
+	}
+	return nil
+}
+
+// RecordLatency counts the latencies of the completed task in the latency
+// histograms of its type in the given queue.
+//
+// The histograms are stored in a hash with the fields "<kind>:<bucket>:<type>",
+// counting the latencies in each bucket of base.LatencyBuckets, and "<kind>:sum:<type>",
+// the sum of the latencies in microseconds, where kind is either "wait" or "run".
+func (r *RDB) RecordLatency(qname string, l *base.TaskLatency) error {
+	var op errors.Op = "rdb.RecordLatency"
+	ctx := context.Background()
+	key := base.LatencyKey(qname)
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		record := func(kind string, d time.Duration) {
+			pipe.HIncrBy(ctx, key, fmt.Sprintf("%s:%d:%s", kind, base.LatencyBucket(d), l.Type), 1)
+			pipe.HIncrBy(ctx, key, fmt.Sprintf("%s:sum:%s", kind, l.Type), d.Microseconds())
+		}
+		record("run", l.Run)
+		if l.Wait > 0 {
+			record("wait", l.Wait)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "hincrby", Err: err})
+	}
+	return nil
+}
+
+// KEYS[1] -> asynq:{<qname>}:expiry_digest
+// KEYS[2] -> asynq:{<qname>}:archived
+// ARGV[1] -> cutoff in unix time; tasks archived before the cutoff are expiring
+// ARGV[2] -> duration of the claim in milliseconds
+// ARGV[3] -> unix time since which the tasks archived give the archive rate
+// ARGV[4] -> max number of tasks in archived state
+// ARGV[5] -> digest period in seconds
+//
+// Output:
+// Returns -1 if the digest was claimed within the period. Otherwise, returns the
+// number of tasks expiring by age and the number of the other tasks trimmed to keep
+// the archive within its maximum size if tasks keep being archived at the same rate.
+// The tasks to delete are the oldest ones, i.e. the first ones of the archive.
+// If there are none, the digest is marked as done for the period.
+var claimExpiryDigestCmd = newScript("claimExpiryDigest", `
+if not redis.call("SET", KEYS[1], "claimed", "NX", "PX", ARGV[2]) then
+	return -1
+end
+local expired = redis.call("ZCOUNT", KEYS[2], "-inf", ARGV[1])
+local trimmed = redis.call("ZCARD", KEYS[2]) + redis.call("ZCOUNT", KEYS[2], "(" .. ARGV[3], "+inf")
+	- tonumber(ARGV[4]) + 1 - expired
+if trimmed < 0 then
+	trimmed = 0
+end
+if expired + trimmed == 0 then
+	redis.call("SET", KEYS[1], "done", "EX", ARGV[5])
+end
+return {expired, trimmed}
+`)
+
+// KEYS[1] -> asynq:{<qname>}:archived
+// ARGV[1] -> start rank of the batch
+// ARGV[2] -> stop rank of the batch
+// ARGV[3] -> task key prefix
+//
+// Output:
+// Returns the scores of the first and the last task of the batch, followed by
+// the type and the number of tasks of each type in the batch.
+var countArchivedByTypeCmd = newScript("countArchivedByType", msgFieldsLua+`
+local entries = redis.call("ZRANGE", KEYS[1], ARGV[1], ARGV[2], "WITHSCORES")
+if #entries == 0 then
+	return {}
+end
+local counts = {}
+for i = 1, #entries, 2 do
+	local msg = redis.call("HGET", ARGV[3] .. entries[i], "msg")
+	if msg then
+		local typename = msg_fields(msg, {[1] = true})[1] or ""
+		counts[typename] = (counts[typename] or 0) + 1
+	end
+end
+local res = {entries[2], entries[#entries]}
+for typename, n in pairs(counts) do
+	table.insert(res, typename)
+	table.insert(res, n)
+end
+return res
+`)
+
+// expiryDigestBatchSize is the number of tasks counted by each run of countArchivedByTypeCmd.
+const expiryDigestBatchSize = 100
+
+// ClaimExpiryDigest claims the digest of the archived tasks of the given queue which
+// are deleted within the given duration, for the given claim duration, and returns
+// a summary of the tasks. The tasks deleted are the tasks archived longer ago than
+// the retention period minus the duration, and the oldest tasks deleted to keep the
+// archive within its maximum size if tasks keep being archived at the rate of the
+// last period. The tasks are counted by type in batches.
+//
+// It returns nil if the digest was already claimed within the given period,
+// e.g. by another server, or if no tasks are deleted within the duration.
+// Call FinishExpiryDigest once the digest is delivered, or failed to be, so that
+// each period the digest is made once.
+func (r *RDB) ClaimExpiryDigest(qname string, within, period, claim time.Duration) (*base.ExpiringArchived, error) {
+	var op errors.Op = "rdb.ClaimExpiryDigest"
+	ctx := context.Background()
+	now := r.clock.Now()
+	cutoff := now.AddDate(0, 0, -archivedExpirationInDays).Add(within)
+	res, err := claimExpiryDigestCmd.Run(ctx, r.client,
+		[]string{base.ExpiryDigestKey(qname), base.ArchivedKey(qname)},
+		cutoff.Unix(), claim.Milliseconds(), now.Add(-period).Unix(), maxArchiveSize, int64(period/time.Second)).Result()
+	if err != nil {
+		return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
+	}
+	if n, ok := res.(int64); ok && n == -1 {
+		return nil, nil
+	}
+	data, err := cast.ToSliceE(res)
+	if err != nil || len(data) != 2 {
+		return nil, errors.E(op, errors.Internal, fmt.Sprintf("cast error: Lua script returned unexpected value: %v", res))
+	}
+	expired, trimmed := cast.ToInt(data[0]), cast.ToInt(data[1])
+	if expired+trimmed == 0 {
+		return nil, nil
+	}
+	summary := &base.ExpiringArchived{
+		CountByType: make(map[string]int),
+		Expired:     expired,
+		Trimmed:     trimmed,
+	}
+	for start := 0; start < expired+trimmed; start += expiryDigestBatchSize {
+		stop := start + expiryDigestBatchSize
+		if stop > expired+trimmed {
+			stop = expired + trimmed
+		}
+		res, err := countArchivedByTypeCmd.Run(ctx, r.client, []string{base.ArchivedKey(qname)},
+			start, stop-1, base.TaskKeyPrefix(qname)).Result()
+		if err != nil {
+			return nil, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
+		}
+		data, err := cast.ToSliceE(res)
+		if err != nil || len(data)%2 != 0 {
+			return nil, errors.E(op, errors.Internal, fmt.Sprintf("cast error: Lua script returned unexpected value: %v", res))
+		}
+		if len(data) == 0 {
+			break // the archive shrank meanwhile
+		}
+		if start == 0 {
+			summary.OldestArchivedAt = time.Unix(cast.ToInt64(data[0]), 0)
+		}
+		summary.NewestArchivedAt = time.Unix(cast.ToInt64(data[1]), 0)
+		for i := 2; i+1 < len(data); i += 2 {
+			summary.CountByType[cast.ToString(data[i])] += cast.ToInt(data[i+1])
+		}
+	}
+	return summary, nil
+}
+
+// FinishExpiryDigest marks the digest of the given queue claimed by ClaimExpiryDigest
+// as done for the given period if it was delivered, or releases the claim otherwise,
+// so that the digest is made again by the next claim.
+func (r *RDB) FinishExpiryDigest(qname string, period time.Duration, notified bool) error {
+	var op errors.Op = "rdb.FinishExpiryDigest"
+	ctx := context.Background()
+	if !notified {
+		if err := r.client.Del(ctx, base.ExpiryDigestKey(qname)).Err(); err != nil {
+			return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "del", Err: err})
+		}
+		return nil
+	}
+	if err := r.client.Set(ctx, base.ExpiryDigestKey(qname), "done", period).Err(); err != nil {
+		return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "set", Err: err})
+	}
+	return nil
+}
+
 // KEYS[1] -> asynq:{<qname>}:deadlines
 // ARGV[1] -> deadline in unix time
 // ARGV[2] -> task key prefix
-var listDeadlineExceededCmd = redis.NewScript(`
+//
+// Output:
+// List of (id, msg) pairs.
+var listDeadlineExceededCmd = newScript("listDeadlineExceeded", `
 local res = {}
 local ids = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
 for _, id in ipairs(ids) do
 	local key = ARGV[2] .. id
+	table.insert(res, id)
 	table.insert(res, redis.call("HGET", key, "msg"))
 end
 return res
 `)
 
 // ListDeadlineExceeded returns a list of task messages that have exceeded the deadline from the given queues.
+// Tasks whose message cannot be decoded are removed from the active tasks, as they are by Dequeue.
 func (r *RDB) ListDeadlineExceeded(deadline time.Time, qnames ...string) ([]*base.TaskMessage, error) {
 	var op errors.Op = "rdb.ListDeadlineExceeded"
 	var msgs []*base.TaskMessage
@@ -963,19 +2662,24 @@ func (r *RDB) ListDeadlineExceeded(deadline time.Time, qnames ...string) ([]*bas
 			[]string{base.DeadlinesKey(qname)},
 			deadline.Unix(), base.TaskKeyPrefix(qname)).Result()
 		if err != nil {
-			return nil, errors.E(op, errors.Internal, fmt.Sprintf("redis eval error: %v", err))
+			return nil, errors.E(op, errors.Internal, &errors.RedisCommandError{Command: "eval", Err: err})
 		}
 		data, err := cast.ToStringSliceE(res)
 		if err != nil {
 			return nil, errors.E(op, errors.Internal, fmt.Sprintf("cast error: Lua script returned unexpected value: %v", res))
 		}
-		for _, s := range data {
-			msg, err := base.DecodeMessage([]byte(s))
+		var bad []string
+		for i := 0; i+1 < len(data); i += 2 {
+			msg, err := base.DecodeMessage([]byte(data[i+1]))
 			if err != nil {
-				return nil, errors.E(op, errors.Internal, fmt.Sprintf("cannot decode message: %v", err))
+				bad = append(bad, data[i])
+				continue
 			}
 			msgs = append(msgs, msg)
 		}
+		if err := r.removeUndecodableTasks(qname, base.ActiveKey(qname), bad); err != nil {
+			return nil, errors.E(op, errors.CanonicalCode(err), err)
+		}
 	}
 	return msgs, nil
 }
@@ -987,7 +2691,7 @@ func (r *RDB) ListDeadlineExceeded(deadline time.Time, qnames ...string) ([]*bas
 // ARGV[3:] -> alternate key-value pair of (worker id, worker data)
 // Note: Add key to ZSET with expiration time as score.
 // ref: https://github.com/antirez/redis/issues/135#issuecomment-2361996
-var writeServerStateCmd = redis.NewScript(`
+var writeServerStateCmd = newScript("writeServerState", `
 redis.call("SETEX", KEYS[1], ARGV[1], ARGV[2])
 redis.call("DEL", KEYS[2])
 for i = 3, table.getn(ARGV)-1, 2 do
@@ -997,6 +2701,8 @@ redis.call("EXPIRE", KEYS[2], ARGV[1])
 return redis.status_reply("OK")`)
 
 // WriteServerState writes server state data to redis with expiration set to the value ttl.
+// It also registers the queues the server processes to the set of all queues,
+// so that the queues are discoverable before any task is enqueued to them.
 func (r *RDB) WriteServerState(info *base.ServerInfo, workers []*base.WorkerInfo, ttl time.Duration) error {
 	var op errors.Op = "rdb.WriteServerState"
 	ctx := context.Background()
@@ -1015,6 +2721,15 @@ func (r *RDB) WriteServerState(info *base.ServerInfo, workers []*base.WorkerInfo
 	}
 	skey := base.ServerInfoKey(info.Host, info.PID, info.ServerID)
 	wkey := base.WorkersKey(info.Host, info.PID, info.ServerID)
+	if len(info.Queues) > 0 {
+		qnames := make([]interface{}, 0, len(info.Queues))
+		for qname := range info.Queues {
+			qnames = append(qnames, qname)
+		}
+		if err := r.client.SAdd(ctx, base.AllQueues, qnames...).Err(); err != nil {
+			return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "sadd", Err: err})
+		}
+	}
 	if err := r.client.ZAdd(ctx, base.AllServers, &redis.Z{Score: float64(exp.Unix()), Member: skey}).Err(); err != nil {
 		return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "sadd", Err: err})
 	}
@@ -1024,9 +2739,20 @@ func (r *RDB) WriteServerState(info *base.ServerInfo, workers []*base.WorkerInfo
 	return r.runScript(ctx, op, writeServerStateCmd, []string{skey, wkey}, args...)
 }
 
+// CheckCompatibility compares the server described by info with the running servers,
+// and returns a description of each incompatibility found (see base.Incompatibilities).
+func (r *RDB) CheckCompatibility(info *base.ServerInfo) ([]string, error) {
+	var op errors.Op = "rdb.CheckCompatibility"
+	servers, err := r.ListServers()
+	if err != nil {
+		return nil, errors.E(op, errors.Unknown, err)
+	}
+	return base.Incompatibilities(info, servers), nil
+}
+
 // KEYS[1] -> asynq:servers:{<host:pid:sid>}
 // KEYS[2] -> asynq:workers:{<host:pid:sid>}
-var clearServerStateCmd = redis.NewScript(`
+var clearServerStateCmd = newScript("clearServerState", `
 redis.call("DEL", KEYS[1])
 redis.call("DEL", KEYS[2])
 return redis.status_reply("OK")`)
@@ -1046,10 +2772,112 @@ func (r *RDB) ClearServerState(host string, pid int, serverID string) error {
 	return r.runScript(ctx, op, clearServerStateCmd, []string{skey, wkey})
 }
 
+// KEYS[1] -> asynq:{<qname>}:active
+// KEYS[2] -> asynq:{<qname>}:deadlines
+// KEYS[3] -> asynq:{<qname>}:pending
+// KEYS[4] -> asynq:{<qname>}:t:<task_id>
+// -------
+// ARGV[1] -> task ID
+// ARGV[2] -> wakeup channel
+// ARGV[3] -> queue name
+//
+// Output:
+// Returns 1 if the task is requeued
+// Returns 0 if the task is not active anymore
+//
+// Note: Use RPUSH to push to the head of the queue.
+var requeueOrphanCmd = newScript("requeueOrphan", `
+if redis.call("LREM", KEYS[1], 0, ARGV[1]) == 0 then
+	return 0
+end
+redis.call("ZREM", KEYS[2], ARGV[1])
+redis.call("RPUSH", KEYS[3], ARGV[1])
+redis.call("HSET", KEYS[4], "state", "pending")
+redis.call("PUBLISH", ARGV[2], ARGV[3])
+return 1`)
+
+// RequeueOrphans moves the tasks processed by the server with the given ID back to
+// the head of their pending lists, and deletes the state of the server. It returns
+// the number of tasks requeued.
+//
+// Use RequeueOrphans only once the server is known to be dead: the tasks are
+// requeued regardless of whether the server is still processing them.
+// It returns a NotFound error if no state of the server is found.
+func (r *RDB) RequeueOrphans(serverID string) (int, error) {
+	var op errors.Op = "rdb.RequeueOrphans"
+	ctx := context.Background()
+	skeys, err := r.serverStateKeys(ctx, base.AllServers, serverID)
+	if err != nil {
+		return 0, errors.E(op, errors.Unknown, err)
+	}
+	wkeys, err := r.serverStateKeys(ctx, base.AllWorkers, serverID)
+	if err != nil {
+		return 0, errors.E(op, errors.Unknown, err)
+	}
+	if len(skeys) == 0 && len(wkeys) == 0 {
+		return 0, errors.E(op, errors.NotFound, fmt.Sprintf("server %q not found", serverID))
+	}
+	n := 0
+	for _, wkey := range wkeys {
+		data, err := r.client.HVals(ctx, wkey).Result()
+		if err != nil {
+			return n, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "hvals", Err: err})
+		}
+		for _, s := range data {
+			w, err := base.DecodeWorkerInfo([]byte(s))
+			if err != nil {
+				continue // skip bad data
+			}
+			keys := []string{
+				base.ActiveKey(w.Queue),
+				base.DeadlinesKey(w.Queue),
+				base.PendingKey(w.Queue),
+				base.TaskKey(w.Queue, w.ID),
+			}
+			requeued, err := requeueOrphanCmd.Run(ctx, r.client, keys, w.ID, base.WakeupChannel(w.Queue), w.Queue).Int()
+			if err != nil {
+				return n, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
+			}
+			n += requeued
+			r.recordOperatorEvent(w.Queue, AuditRequeued, w.ID, "active", int64(requeued))
+		}
+	}
+	for _, key := range skeys {
+		if err := r.client.ZRem(ctx, base.AllServers, key).Err(); err != nil {
+			return n, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "zrem", Err: err})
+		}
+	}
+	for _, key := range wkeys {
+		if err := r.client.ZRem(ctx, base.AllWorkers, key).Err(); err != nil {
+			return n, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "zrem", Err: err})
+		}
+	}
+	if err := r.client.Del(ctx, append(skeys, wkeys...)...).Err(); err != nil {
+		return n, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "del", Err: err})
+	}
+	return n, nil
+}
+
+// serverStateKeys returns the keys listed in the given set (AllServers or AllWorkers)
+// which belong to the server with the given ID.
+func (r *RDB) serverStateKeys(ctx context.Context, set, serverID string) ([]string, error) {
+	keys, err := r.client.ZRange(ctx, set, 0, -1).Result()
+	if err != nil {
+		return nil, &errors.RedisCommandError{Command: "zrange", Err: err}
+	}
+	var res []string
+	for _, key := range keys {
+		if strings.HasSuffix(key, ":"+serverID+"}") {
+			res = append(res, key)
+		}
+	}
+	return res, nil
+}
+
 // KEYS[1]  -> asynq:schedulers:{<schedulerID>}
 // ARGV[1]  -> TTL in seconds
 // ARGV[2:] -> schedler entries
-var writeSchedulerEntriesCmd = redis.NewScript(`
+var writeSchedulerEntriesCmd = newScript("writeSchedulerEntries", `
 redis.call("DEL", KEYS[1])
 for i = 2, #ARGV do
 	redis.call("LPUSH", KEYS[1], ARGV[i])
@@ -1092,11 +2920,12 @@ func (r *RDB) ClearSchedulerEntries(scheduelrID string) error {
 	return nil
 }
 
-// CancelationPubSub returns a pubsub for cancelation messages.
+// CancelationPubSub returns a pubsub for cancelation messages, sent on
+// base.CancelChannel by PublishCancelation and on base.AbortChannel by PublishAbort.
 func (r *RDB) CancelationPubSub() (*redis.PubSub, error) {
 	var op errors.Op = "rdb.CancelationPubSub"
 	ctx := context.Background()
-	pubsub := r.client.Subscribe(ctx, base.CancelChannel)
+	pubsub := r.client.Subscribe(ctx, base.CancelChannel, base.AbortChannel)
 	_, err := pubsub.Receive(ctx)
 	if err != nil {
 		return nil, errors.E(op, errors.Unknown, fmt.Sprintf("redis pubsub receive error: %v", err))
@@ -1115,11 +2944,83 @@ func (r *RDB) PublishCancelation(id string) error {
 	return nil
 }
 
+// PublishAbort publishes a message to all subscribers to cancel the task with the
+// given ID like PublishCancelation, and to archive the task rather than retry it.
+func (r *RDB) PublishAbort(id string) error {
+	var op errors.Op = "rdb.PublishAbort"
+	ctx := context.Background()
+	if err := r.client.Publish(ctx, base.AbortChannel, id).Err(); err != nil {
+		return errors.E(op, errors.Unknown, fmt.Sprintf("redis pubsub publish error: %v", err))
+	}
+	return nil
+}
+
+// WakeupPubSub returns a pubsub for messages sent when tasks become pending
+// in the given queues. The message is the name of the queue which has new pending tasks.
+func (r *RDB) WakeupPubSub(qnames ...string) (*redis.PubSub, error) {
+	var op errors.Op = "rdb.WakeupPubSub"
+	ctx := context.Background()
+	var channels []string
+	for _, qname := range qnames {
+		channels = append(channels, base.WakeupChannel(qname))
+	}
+	pubsub := r.client.Subscribe(ctx, channels...)
+	_, err := pubsub.Receive(ctx)
+	if err != nil {
+		return nil, errors.E(op, errors.Unknown, fmt.Sprintf("redis pubsub receive error: %v", err))
+	}
+	return pubsub, nil
+}
+
+// ConcurrencyPubSub returns a pubsub for concurrency change messages sent to the given server.
+func (r *RDB) ConcurrencyPubSub(serverID string) (*redis.PubSub, error) {
+	var op errors.Op = "rdb.ConcurrencyPubSub"
+	ctx := context.Background()
+	pubsub := r.client.Subscribe(ctx, base.ConcurrencyChannel(serverID))
+	_, err := pubsub.Receive(ctx)
+	if err != nil {
+		return nil, errors.E(op, errors.Unknown, fmt.Sprintf("redis pubsub receive error: %v", err))
+	}
+	return pubsub, nil
+}
+
+// PublishConcurrency publishes a message to the given server to change its concurrency to n.
+func (r *RDB) PublishConcurrency(serverID string, n int) error {
+	var op errors.Op = "rdb.PublishConcurrency"
+	ctx := context.Background()
+	if err := r.client.Publish(ctx, base.ConcurrencyChannel(serverID), n).Err(); err != nil {
+		return errors.E(op, errors.Unknown, fmt.Sprintf("redis pubsub publish error: %v", err))
+	}
+	return nil
+}
+
+// QuietPubSub returns a pubsub for quiet messages sent to the given server.
+func (r *RDB) QuietPubSub(serverID string) (*redis.PubSub, error) {
+	var op errors.Op = "rdb.QuietPubSub"
+	ctx := context.Background()
+	pubsub := r.client.Subscribe(ctx, base.QuietChannel(serverID))
+	_, err := pubsub.Receive(ctx)
+	if err != nil {
+		return nil, errors.E(op, errors.Unknown, fmt.Sprintf("redis pubsub receive error: %v", err))
+	}
+	return pubsub, nil
+}
+
+// PublishQuiet publishes a message to the given server to stop processing new tasks.
+func (r *RDB) PublishQuiet(serverID string) error {
+	var op errors.Op = "rdb.PublishQuiet"
+	ctx := context.Background()
+	if err := r.client.Publish(ctx, base.QuietChannel(serverID), "quiet").Err(); err != nil {
+		return errors.E(op, errors.Unknown, fmt.Sprintf("redis pubsub publish error: %v", err))
+	}
+	return nil
+}
+
 // KEYS[1] -> asynq:scheduler_history:<entryID>
 // ARGV[1] -> enqueued_at timestamp
 // ARGV[2] -> serialized SchedulerEnqueueEvent data
 // ARGV[3] -> max number of events to be persisted
-var recordSchedulerEnqueueEventCmd = redis.NewScript(`
+var recordSchedulerEnqueueEventCmd = newScript("recordSchedulerEnqueueEvent", `
 redis.call("ZREMRANGEBYRANK", KEYS[1], 0, -ARGV[3])
 redis.call("ZADD", KEYS[1], ARGV[1], ARGV[2])
 return redis.status_reply("OK")`)
@@ -1146,6 +3047,35 @@ func (r *RDB) RecordSchedulerEnqueueEvent(entryID string, event *base.SchedulerE
 	return r.runScript(ctx, op, recordSchedulerEnqueueEventCmd, keys, argv...)
 }
 
+// WriteSchedulerPrevTask records the task enqueued on the latest occurrence of the
+// scheduler entry with the given key. The record expires after ttl.
+func (r *RDB) WriteSchedulerPrevTask(entryKey, qname, id string, ttl time.Duration) error {
+	var op errors.Op = "rdb.WriteSchedulerPrevTask"
+	ctx := context.Background()
+	key := base.SchedulerPrevTaskKey(entryKey)
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, "queue", qname, "id", id)
+		pipe.Expire(ctx, key, ttl)
+		return nil
+	})
+	if err != nil {
+		return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "hset", Err: err})
+	}
+	return nil
+}
+
+// SchedulerPrevTask returns the queue and the ID of the task recorded with
+// WriteSchedulerPrevTask for the scheduler entry with the given key.
+// It returns empty strings if there is no record.
+func (r *RDB) SchedulerPrevTask(entryKey string) (qname, id string, err error) {
+	var op errors.Op = "rdb.SchedulerPrevTask"
+	res, err := r.client.HMGet(context.Background(), base.SchedulerPrevTaskKey(entryKey), "queue", "id").Result()
+	if err != nil {
+		return "", "", errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "hmget", Err: err})
+	}
+	return cast.ToString(res[0]), cast.ToString(res[1]), nil
+}
+
 // ClearSchedulerHistory deletes the enqueue event history for the given scheduler entry.
 func (r *RDB) ClearSchedulerHistory(entryID string) error {
 	var op errors.Op = "rdb.ClearSchedulerHistory"
@@ -1157,6 +3087,16 @@ func (r *RDB) ClearSchedulerHistory(entryID string) error {
 	return nil
 }
 
+// ClearStarted removes the started marker which the dequeue of the given
+// at-most-once task set, so that a redelivery of the task can be dequeued.
+func (r *RDB) ClearStarted(msg *base.TaskMessage) error {
+	var op errors.Op = "rdb.ClearStarted"
+	if err := r.client.Del(context.Background(), base.StartedKey(msg.Queue, msg.ID)).Err(); err != nil {
+		return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "del", Err: err})
+	}
+	return nil
+}
+
 // WriteResult writes the given result data for the specified task.
 func (r *RDB) WriteResult(qname, taskID string, data []byte) (int, error) {
 	var op errors.Op = "rdb.WriteResult"
@@ -1167,3 +3107,91 @@ func (r *RDB) WriteResult(qname, taskID string, data []byte) (int, error) {
 	}
 	return len(data), nil
 }
+
+// KEYS[1] -> asynq:{<qname>}:t:<task_id>
+// KEYS[2] -> asynq:{<qname>}:result_cache:<task_type>:<idempotency_key>
+// ARGV[1] -> ttl in milliseconds
+var cacheResultCmd = newScript("cacheResult", `
+local result = redis.call("HGET", KEYS[1], "result") or ""
+redis.call("SET", KEYS[2], result, "PX", ARGV[1])
+return redis.status_reply("OK")
+`)
+
+// CacheResult caches the result of the given completed task for the duration ttl,
+// under the type and the idempotency key of the task.
+func (r *RDB) CacheResult(msg *base.TaskMessage, ttl time.Duration) error {
+	var op errors.Op = "rdb.CacheResult"
+	keys := []string{
+		base.TaskKey(msg.Queue, msg.ID),
+		base.ResultCacheKey(msg.Queue, msg.Type, msg.IdempotencyKey),
+	}
+	return r.runScript(context.Background(), op, cacheResultCmd, keys, ttl.Milliseconds())
+}
+
+// CachedResult returns the cached result of a completed task of the same type and
+// with the same idempotency key as the given task, and reports whether one is cached.
+func (r *RDB) CachedResult(msg *base.TaskMessage) ([]byte, bool, error) {
+	var op errors.Op = "rdb.CachedResult"
+	res, err := r.client.Get(context.Background(), base.ResultCacheKey(msg.Queue, msg.Type, msg.IdempotencyKey)).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "get", Err: err})
+	}
+	return res, true, nil
+}
+
+// KEYS[1] -> asynq:{<qname>}:t:<task_id>
+// ARGV[1] -> progress data
+//
+// Returns 1 if the progress is written, or 0 if the task is not active.
+var writeProgressCmd = newScript("writeProgress", `
+if redis.call("HGET", KEYS[1], "state") ~= "active" then
+	return 0
+end
+redis.call("HSET", KEYS[1], "progress", ARGV[1])
+return 1`)
+
+// WriteProgress saves the given data as the progress of the active task.
+// The progress is cleared when the task is dequeued again (e.g. to be retried).
+//
+// If the task is not active (e.g. it was canceled and deleted), it returns TaskNotFoundError.
+func (r *RDB) WriteProgress(qname, taskID string, data []byte) error {
+	var op errors.Op = "rdb.WriteProgress"
+	res, err := writeProgressCmd.Run(context.Background(), r.client, []string{base.TaskKey(qname, taskID)}, data).Result()
+	if err != nil {
+		return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
+	}
+	if n, _ := res.(int64); n == 0 {
+		return errors.E(op, errors.NotFound, &errors.TaskNotFoundError{Queue: qname, ID: taskID})
+	}
+	return nil
+}
+
+// KEYS[1] -> asynq:{<qname>}:t:<task_id>
+// ARGV[1] -> checkpoint data
+//
+// Returns 1 if the checkpoint is written, or 0 if the task is not active.
+var writeCheckpointCmd = newScript("writeCheckpoint", `
+if redis.call("HGET", KEYS[1], "state") ~= "active" then
+	return 0
+end
+redis.call("HSET", KEYS[1], "checkpoint", ARGV[1])
+return 1`)
+
+// WriteCheckpoint saves the given data as the checkpoint of the active task.
+// The checkpoint is returned with the task by the next Dequeue of the task.
+//
+// If the task is not active (e.g. it was canceled and deleted), it returns TaskNotFoundError.
+func (r *RDB) WriteCheckpoint(qname, taskID string, data []byte) error {
+	var op errors.Op = "rdb.WriteCheckpoint"
+	res, err := writeCheckpointCmd.Run(context.Background(), r.client, []string{base.TaskKey(qname, taskID)}, data).Result()
+	if err != nil {
+		return errors.E(op, errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: err})
+	}
+	if n, _ := res.(int64); n == 0 {
+		return errors.E(op, errors.NotFound, &errors.TaskNotFoundError{Queue: qname, ID: taskID})
+	}
+	return nil
+}
@@ -6,6 +6,8 @@ package rdb
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"strconv"
@@ -426,7 +428,7 @@ func TestDequeue(t *testing.T) {
 			t.Errorf("(*RDB).Dequeue(%v) returned error %v", tc.args, err)
 			continue
 		}
-		if !cmp.Equal(gotMsg, tc.wantMsg) {
+		if !cmp.Equal(gotMsg, tc.wantMsg, cmpopts.IgnoreFields(base.TaskMessage{}, "Lease")) {
 			t.Errorf("(*RDB).Dequeue(%v) returned message %v; want %v",
 				tc.args, gotMsg, tc.wantMsg)
 			continue
@@ -553,6 +555,303 @@ func TestDequeueError(t *testing.T) {
 	}
 }
 
+// commandCounter is a redis.Hook which counts the commands sent to redis.
+type commandCounter struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (c *commandCounter) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+func (c *commandCounter) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n++
+	return ctx, nil
+}
+
+func (c *commandCounter) AfterProcess(ctx context.Context, cmd redis.Cmder) error { return nil }
+
+func (c *commandCounter) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n += len(cmds)
+	return ctx, nil
+}
+
+func (c *commandCounter) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+func TestDequeueMultipleQueuesInSingleRoundTrip(t *testing.T) {
+	if useRedisCluster {
+		t.Skip("multiple queues are queried one by one with redis cluster")
+	}
+	r := setup(t)
+	defer r.Close()
+	h.FlushDB(t, r.client)
+	qnames := []string{"critical", "default", "low"}
+	msg := h.NewTaskMessageWithQueue("task", nil, "low")
+	h.SeedPendingQueue(t, r.client, []*base.TaskMessage{msg}, "low")
+
+	// Load the script so that the count below does not include a fallback EVAL.
+	if _, _, err := r.Dequeue(qnames...); err != nil {
+		t.Fatalf("(*RDB).Dequeue(%v) returned error: %v", qnames, err)
+	}
+	h.SeedPendingQueue(t, r.client, []*base.TaskMessage{h.NewTaskMessageWithQueue("task", nil, "low")}, "low")
+
+	counter := &commandCounter{}
+	r.client.AddHook(counter)
+	if _, _, err := r.Dequeue(qnames...); err != nil {
+		t.Fatalf("(*RDB).Dequeue(%v) returned error: %v", qnames, err)
+	}
+	if got := counter.count(); got != 1 {
+		t.Errorf("(*RDB).Dequeue(%v) sent %d commands to redis, want 1", qnames, got)
+	}
+}
+
+func TestDequeueSkipping(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	h.FlushDB(t, r.client)
+	ctx := context.Background()
+	cpu1 := h.NewTaskMessage("transcode", nil)
+	cpu1.Class = "cpu"
+	cpu2 := h.NewTaskMessage("transcode", nil)
+	cpu2.Class = "cpu"
+	io := h.NewTaskMessage("webhook", nil)
+	io.Class = "io"
+	plain := h.NewTaskMessage("plain", nil)
+	for _, msg := range []*base.TaskMessage{cpu1, cpu2, io, plain} {
+		if err := r.Enqueue(ctx, msg); err != nil {
+			t.Fatalf("(*RDB).Enqueue(%v) returned error: %v", msg, err)
+		}
+	}
+
+	// Tasks of the skipped class are set aside, in order.
+	got, _, err := r.DequeueSkipping([]string{"cpu"}, base.DefaultQueueName)
+	if err != nil || got.ID != io.ID {
+		t.Fatalf("(*RDB).DequeueSkipping returned (%v, %v), want task %s", got, err, io.ID)
+	}
+	got, _, err = r.DequeueSkipping([]string{"cpu", "io"}, base.DefaultQueueName)
+	if err != nil || got.ID != plain.ID {
+		t.Fatalf("(*RDB).DequeueSkipping returned (%v, %v), want task %s", got, err, plain.ID)
+	}
+	if _, _, err := r.DequeueSkipping([]string{"cpu"}, base.DefaultQueueName); !errors.Is(err, errors.ErrNoProcessableTask) {
+		t.Errorf("(*RDB).DequeueSkipping returned %v, want ErrNoProcessableTask", err)
+	}
+	pending, err := r.ListPending(base.DefaultQueueName, Pagination{Size: 10})
+	if err != nil {
+		t.Fatalf("(*RDB).ListPending returned error: %v", err)
+	}
+	var gotPending []string
+	for _, info := range pending {
+		gotPending = append(gotPending, info.Message.ID)
+	}
+	if diff := cmp.Diff([]string{cpu1.ID, cpu2.ID}, gotPending); diff != "" {
+		t.Errorf("mismatch found in pending tasks; (-want,+got)\n%s", diff)
+	}
+	if n, err := r.PendingSize(ctx, base.DefaultQueueName); err != nil || n != 2 {
+		t.Errorf("(*RDB).PendingSize returned (%d, %v), want (2, nil)", n, err)
+	}
+	if n := len(h.GetActiveMessages(t, r.client, base.DefaultQueueName)); n != 2 {
+		t.Errorf("got %d active tasks, want 2", n)
+	}
+
+	// Without classes to skip, DequeueSkipping is the same as Dequeue.
+	got, _, err = r.DequeueSkipping(nil, base.DefaultQueueName)
+	if err != nil || got.ID != cpu1.ID {
+		t.Errorf("(*RDB).DequeueSkipping(nil) returned (%v, %v), want task %s", got, err, cpu1.ID)
+	}
+}
+
+func TestDequeueSetsAsideUnprocessableTasks(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	h.FlushDB(t, r.client)
+	ctx := context.Background()
+	qname := base.DefaultQueueName
+	// More tasks requiring a label than are set aside by one dequeue.
+	var gpus []*base.TaskMessage
+	for i := 0; i < 2*maxSetAside+10; i++ {
+		msg := h.NewTaskMessage("train", nil)
+		msg.Labels = map[string]string{"gpu": "true"}
+		gpus = append(gpus, msg)
+	}
+	plain := h.NewTaskMessage("plain", nil)
+	for _, msg := range append(gpus, plain) {
+		if err := r.Enqueue(ctx, msg); err != nil {
+			t.Fatalf("(*RDB).Enqueue(%v) returned error: %v", msg, err)
+		}
+	}
+
+	// A server without the label gets to the plain task after a few dequeues.
+	var got *base.TaskMessage
+	for i := 0; i < 3 && got == nil; i++ {
+		msg, _, err := r.Dequeue(qname)
+		if err != nil && !errors.Is(err, errors.ErrNoProcessableTask) {
+			t.Fatalf("(*RDB).Dequeue returned error: %v", err)
+		}
+		got = msg
+	}
+	if got == nil || got.ID != plain.ID {
+		t.Fatalf("(*RDB).Dequeue returned %v, want task %s", got, plain.ID)
+	}
+	if _, _, err := r.Dequeue(qname); !errors.Is(err, errors.ErrNoProcessableTask) {
+		t.Errorf("(*RDB).Dequeue returned %v, want ErrNoProcessableTask", err)
+	}
+
+	// The tasks set aside are still pending, and are processed in order by a
+	// server with the label.
+	if n, err := r.PendingSize(ctx, qname); err != nil || n != int64(len(gpus)) {
+		t.Errorf("(*RDB).PendingSize returned (%d, %v), want (%d, nil)", n, err, len(gpus))
+	}
+	stats, err := r.CurrentStats(qname)
+	if err != nil {
+		t.Fatalf("(*RDB).CurrentStats returned error: %v", err)
+	}
+	if stats.Pending != len(gpus) {
+		t.Errorf("CurrentStats reported %d pending tasks, want %d", stats.Pending, len(gpus))
+	}
+	pending, err := r.ListPending(qname, Pagination{Size: 2, Page: 0})
+	if err != nil || len(pending) != 2 || pending[0].Message.ID != gpus[0].ID || pending[1].Message.ID != gpus[1].ID {
+		t.Errorf("(*RDB).ListPending returned (%v, %v), want the two oldest tasks", pending, err)
+	}
+	for _, want := range gpus[:2] {
+		got, _, err := r.DequeueMatching([]string{"gpu=true"}, nil, qname)
+		if err != nil || got.ID != want.ID {
+			t.Fatalf("(*RDB).DequeueMatching returned (%v, %v), want task %s", got, err, want.ID)
+		}
+	}
+
+	// The tasks set aside can be deleted and archived.
+	if err := r.DeleteTask(qname, gpus[2].ID); err != nil {
+		t.Errorf("(*RDB).DeleteTask returned error: %v", err)
+	}
+	if err := r.ArchiveTask(qname, gpus[3].ID); err != nil {
+		t.Errorf("(*RDB).ArchiveTask returned error: %v", err)
+	}
+	n, err := r.DeleteAllPendingTasks(qname)
+	if err != nil || n != int64(len(gpus)-4) {
+		t.Errorf("(*RDB).DeleteAllPendingTasks returned (%d, %v), want (%d, nil)", n, err, len(gpus)-4)
+	}
+	if n, err := r.PendingSize(ctx, qname); err != nil || n != 0 {
+		t.Errorf("(*RDB).PendingSize returned (%d, %v), want (0, nil)", n, err)
+	}
+}
+
+func TestDequeueMatching(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	h.FlushDB(t, r.client)
+	ctx := context.Background()
+	gpu := h.NewTaskMessage("train", nil)
+	gpu.Labels = map[string]string{"gpu": "true"}
+	gpuEU := h.NewTaskMessage("train", nil)
+	gpuEU.Labels = map[string]string{"gpu": "true", "region": "eu"}
+	plain := h.NewTaskMessage("plain", nil)
+	critical := h.NewTaskMessage("plain", nil)
+	critical.Queue = "critical"
+	for _, msg := range []*base.TaskMessage{gpu, gpuEU, plain, critical} {
+		if err := r.Enqueue(ctx, msg); err != nil {
+			t.Fatalf("(*RDB).Enqueue(%v) returned error: %v", msg, err)
+		}
+	}
+
+	// Dequeue leaves the tasks which require labels in place, also when
+	// querying multiple queues.
+	got, _, err := r.Dequeue(base.DefaultQueueName, "critical")
+	if err != nil || got.ID != plain.ID {
+		t.Fatalf("(*RDB).Dequeue returned (%v, %v), want task %s", got, err, plain.ID)
+	}
+	got, _, err = r.Dequeue(base.DefaultQueueName, "critical")
+	if err != nil || got.ID != critical.ID {
+		t.Fatalf("(*RDB).Dequeue returned (%v, %v), want task %s", got, err, critical.ID)
+	}
+	if _, _, err := r.Dequeue(base.DefaultQueueName); !errors.Is(err, errors.ErrNoProcessableTask) {
+		t.Errorf("(*RDB).Dequeue returned %v, want ErrNoProcessableTask", err)
+	}
+	if _, _, err := r.DequeueSkipping([]string{"cpu"}, base.DefaultQueueName); !errors.Is(err, errors.ErrNoProcessableTask) {
+		t.Errorf("(*RDB).DequeueSkipping returned %v, want ErrNoProcessableTask", err)
+	}
+
+	// A task is dequeued only if the server has all the labels it requires.
+	got, _, err = r.DequeueMatching([]string{"gpu=true"}, nil, base.DefaultQueueName)
+	if err != nil || got.ID != gpu.ID {
+		t.Fatalf("(*RDB).DequeueMatching returned (%v, %v), want task %s", got, err, gpu.ID)
+	}
+	if diff := cmp.Diff(gpu.Labels, got.Labels); diff != "" {
+		t.Errorf("labels of the dequeued task mismatch (-want,+got)\n%s", diff)
+	}
+	if _, _, err := r.DequeueMatching([]string{"gpu=true", "region=us"}, nil, base.DefaultQueueName); !errors.Is(err, errors.ErrNoProcessableTask) {
+		t.Errorf("(*RDB).DequeueMatching returned %v, want ErrNoProcessableTask", err)
+	}
+	got, _, err = r.DequeueMatching([]string{"gpu=true", "region=eu"}, nil, base.DefaultQueueName)
+	if err != nil || got.ID != gpuEU.ID {
+		t.Fatalf("(*RDB).DequeueMatching returned (%v, %v), want task %s", got, err, gpuEU.ID)
+	}
+}
+
+func TestDequeueRemovesUndecodableTasks(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	ctx := context.Background()
+
+	for _, drop := range []bool{false, true} {
+		h.FlushDB(t, r.client)
+		r.SetDropUndecodable(drop)
+		bad1 := h.NewTaskMessageWithQueue("task", nil, "critical")
+		bad2 := h.NewTaskMessageWithQueue("task", nil, "low")
+		good := h.NewTaskMessageWithQueue("task", nil, "low")
+		bad3 := h.NewTaskMessageWithQueue("task", nil, "low")
+		h.SeedPendingQueue(t, r.client, []*base.TaskMessage{bad1}, "critical")
+		h.SeedPendingQueue(t, r.client, []*base.TaskMessage{bad2, good, bad3}, "low")
+		for _, msg := range []*base.TaskMessage{bad1, bad2, bad3} {
+			if err := r.client.HSet(ctx, base.TaskKey(msg.Queue, msg.ID), "msg", "bad data").Err(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		got, _, err := r.Dequeue("critical", "low")
+		if err != nil || got.ID != good.ID {
+			t.Fatalf("drop=%t: (*RDB).Dequeue returned (%v, %v), want task %s", drop, got, err, good.ID)
+		}
+		if _, _, err := r.DequeueSkipping([]string{"cpu"}, "low"); !errors.Is(err, errors.ErrNoProcessableTask) {
+			t.Errorf("drop=%t: (*RDB).DequeueSkipping returned %v, want ErrNoProcessableTask", drop, err)
+		}
+		if diff := cmp.Diff([]string{good.ID}, r.client.LRange(ctx, base.ActiveKey("low"), 0, -1).Val()); diff != "" {
+			t.Errorf("drop=%t: mismatch found in %q; (-want,+got)\n%s", drop, base.ActiveKey("low"), diff)
+		}
+		if n := r.client.ZCard(ctx, base.DeadlinesKey("low")).Val(); n != 1 {
+			t.Errorf("drop=%t: %q has %d entries, want 1", drop, base.DeadlinesKey("low"), n)
+		}
+
+		for _, msg := range []*base.TaskMessage{bad1, bad2, bad3} {
+			quarantined := r.client.ZScore(ctx, base.QuarantineKey(msg.Queue), msg.ID).Err() == nil
+			exists := r.client.Exists(ctx, base.TaskKey(msg.Queue, msg.ID)).Val() == 1
+			if quarantined == drop || exists == drop {
+				t.Errorf("drop=%t: task %s is quarantined=%t and exists=%t, want %t", drop, msg.ID, quarantined, exists, !drop)
+			}
+		}
+		stats, err := r.CurrentStats("low")
+		if err != nil {
+			t.Fatalf("CurrentStats returned error: %v", err)
+		}
+		wantDropped, wantQuarantined := 0, 2
+		if drop {
+			wantDropped, wantQuarantined = 2, 0
+		}
+		if stats.DroppedTotal != wantDropped || stats.Quarantined != wantQuarantined {
+			t.Errorf("drop=%t: CurrentStats returned DroppedTotal=%d Quarantined=%d, want DroppedTotal=%d Quarantined=%d",
+				drop, stats.DroppedTotal, stats.Quarantined, wantDropped, wantQuarantined)
+		}
+	}
+}
+
 func TestDequeueIgnoresPausedQueues(t *testing.T) {
 	r := setup(t)
 	defer r.Close()
@@ -645,7 +944,7 @@ func TestDequeueIgnoresPausedQueues(t *testing.T) {
 		h.SeedAllPendingQueues(t, r.client, tc.pending)
 
 		got, _, err := r.Dequeue(tc.args...)
-		if !cmp.Equal(got, tc.wantMsg) || !errors.Is(err, tc.wantErr) {
+		if !cmp.Equal(got, tc.wantMsg, cmpopts.IgnoreFields(base.TaskMessage{}, "Lease")) || !errors.Is(err, tc.wantErr) {
 			t.Errorf("Dequeue(%v) = %v, %v; want %v, %v",
 				tc.args, got, err, tc.wantMsg, tc.wantErr)
 			continue
@@ -666,6 +965,323 @@ func TestDequeueIgnoresPausedQueues(t *testing.T) {
 	}
 }
 
+func TestEnqueueWithGroupKey(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	m1 := h.NewTaskMessage("sync", nil)
+	m1.GroupKey = "user:42"
+	m2 := h.NewTaskMessage("sync", nil)
+	m2.GroupKey = "user:42"
+	m3 := h.NewTaskMessage("sync", nil)
+	m3.GroupKey = "user:43"
+
+	for _, msg := range []*base.TaskMessage{m1, m2, m3} {
+		if err := r.Enqueue(context.Background(), msg); err != nil {
+			t.Fatalf("(*RDB).Enqueue(msg) = %v, want nil", err)
+		}
+	}
+
+	// Only the first task in each group should be pending.
+	gotPending := h.GetPendingMessages(t, r.client, base.DefaultQueueName)
+	if diff := cmp.Diff([]*base.TaskMessage{m1, m3}, gotPending, h.SortMsgOpt); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.PendingKey(base.DefaultQueueName), diff)
+	}
+	groupKey := base.GroupKey(base.DefaultQueueName, "user:42")
+	if got := r.client.LRange(context.Background(), groupKey, 0, -1).Val(); !cmp.Equal(got, []string{m1.ID, m2.ID}) {
+		t.Errorf("Redis LIST %q = %v, want %v", groupKey, got, []string{m1.ID, m2.ID})
+	}
+	state := r.client.HGet(context.Background(), base.TaskKey(m2.Queue, m2.ID), "state").Val()
+	if state != "pending" {
+		t.Errorf("state field under task-key is set to %q, want %q", state, "pending")
+	}
+}
+
+func TestDoneReleasesNextTaskInGroup(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	m1 := h.NewTaskMessage("sync", nil)
+	m1.GroupKey = "user:42"
+	m2 := h.NewTaskMessage("sync", nil)
+	m2.GroupKey = "user:42"
+	m3 := h.NewTaskMessage("sync", nil)
+	m3.GroupKey = "user:42"
+
+	for _, msg := range []*base.TaskMessage{m1, m2, m3} {
+		if err := r.Enqueue(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		complete func(msg *base.TaskMessage) error
+		want     *base.TaskMessage // task expected to be dequeued
+	}{
+		{complete: r.Done, want: m1},
+		{complete: func(msg *base.TaskMessage) error { return r.Archive(msg, "error", base.ArchiveReasonMaxRetry) }, want: m2},
+		{complete: r.MarkAsComplete, want: m3},
+	}
+
+	for _, tc := range tests {
+		got, _, err := r.Dequeue(base.DefaultQueueName)
+		if err != nil {
+			t.Fatalf("(*RDB).Dequeue() returned error: %v", err)
+		}
+		if got.ID != tc.want.ID {
+			t.Fatalf("(*RDB).Dequeue() returned task %q, want %q", got.ID, tc.want.ID)
+		}
+		// The rest of the group should be held while a task in the group is active.
+		if _, _, err := r.Dequeue(base.DefaultQueueName); !errors.Is(err, errors.ErrNoProcessableTask) {
+			t.Errorf("(*RDB).Dequeue() returned %v while a task in the group is active, want ErrNoProcessableTask", err)
+		}
+		if err := tc.complete(got); err != nil {
+			t.Fatal(err)
+		}
+	}
+	groupKey := base.GroupKey(base.DefaultQueueName, "user:42")
+	if n := r.client.Exists(context.Background(), groupKey).Val(); n != 0 {
+		t.Errorf("Redis LIST %q still exists after all tasks in the group are processed", groupKey)
+	}
+}
+
+func TestEnqueueWithDependencies(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	parent := h.NewTaskMessage("import", nil)
+	completed := h.NewTaskMessage("import", nil)
+	if err := r.Enqueue(context.Background(), parent); err != nil {
+		t.Fatal(err)
+	}
+	h.SeedCompletedQueue(t, r.client, []base.Z{{Message: completed, Score: time.Now().Add(time.Hour).Unix()}}, base.DefaultQueueName)
+
+	m1 := h.NewTaskMessage("notify", nil)
+	m1.Dependencies = []string{parent.ID, completed.ID}
+	m2 := h.NewTaskMessage("notify", nil)
+	m2.Dependencies = []string{completed.ID, "nonexistent"}
+
+	for _, msg := range []*base.TaskMessage{m1, m2} {
+		if err := r.Enqueue(context.Background(), msg); err != nil {
+			t.Fatalf("(*RDB).Enqueue(msg) = %v, want nil", err)
+		}
+	}
+
+	// m1 waits for parent, m2 has no dependency left to complete.
+	gotWaiting := h.GetWaitingMessages(t, r.client, base.DefaultQueueName)
+	if diff := cmp.Diff([]*base.TaskMessage{m1}, gotWaiting); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.WaitingKey(base.DefaultQueueName), diff)
+	}
+	gotPending := h.GetPendingMessages(t, r.client, base.DefaultQueueName)
+	if diff := cmp.Diff([]*base.TaskMessage{parent, m2}, gotPending, h.SortMsgOpt); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.PendingKey(base.DefaultQueueName), diff)
+	}
+	dependentsKey := base.DependentsKey(base.DefaultQueueName, parent.ID)
+	if got := r.client.SMembers(context.Background(), dependentsKey).Val(); !cmp.Equal(got, []string{m1.ID}) {
+		t.Errorf("Redis SET %q = %v, want %v", dependentsKey, got, []string{m1.ID})
+	}
+}
+
+func TestDonePromotesDependentTasks(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	p1 := h.NewTaskMessage("import", nil)
+	p2 := h.NewTaskMessage("import", nil)
+	p2.Retention = 3600 // completed via MarkAsComplete
+	child := h.NewTaskMessage("notify", nil)
+	child.Dependencies = []string{p1.ID, p2.ID}
+
+	for _, msg := range []*base.TaskMessage{p1, p2, child} {
+		if err := r.Enqueue(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, _, err := r.Dequeue(base.DefaultQueueName); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := r.Done(p1); err != nil {
+		t.Fatalf("(*RDB).Done(p1) returned error: %v", err)
+	}
+	// child should keep waiting for p2.
+	if got := h.GetWaitingMessages(t, r.client, base.DefaultQueueName); len(got) != 1 {
+		t.Errorf("%q has %d tasks after the first dependency completed, want 1", base.WaitingKey(base.DefaultQueueName), len(got))
+	}
+
+	if err := r.MarkAsComplete(p2); err != nil {
+		t.Fatalf("(*RDB).MarkAsComplete(p2) returned error: %v", err)
+	}
+	if got := h.GetWaitingMessages(t, r.client, base.DefaultQueueName); len(got) != 0 {
+		t.Errorf("%q has %d tasks after all dependencies completed, want 0", base.WaitingKey(base.DefaultQueueName), len(got))
+	}
+	gotPending := h.GetPendingMessages(t, r.client, base.DefaultQueueName)
+	if diff := cmp.Diff([]*base.TaskMessage{child}, gotPending); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.PendingKey(base.DefaultQueueName), diff)
+	}
+}
+
+func TestEnqueueWithDuplicateDependencies(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	ctx := context.Background()
+	parent := h.NewTaskMessage("import", nil)
+	child := h.NewTaskMessage("notify", nil)
+	child.Dependencies = []string{parent.ID, parent.ID}
+	for _, msg := range []*base.TaskMessage{parent, child} {
+		if err := r.Enqueue(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := r.client.HGet(ctx, base.TaskKey(base.DefaultQueueName, child.ID), "waiting_on").Val(); n != "1" {
+		t.Errorf("child is waiting on %s tasks, want 1", n)
+	}
+
+	if _, _, err := r.Dequeue(base.DefaultQueueName); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Done(parent); err != nil {
+		t.Fatalf("(*RDB).Done(parent) returned error: %v", err)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{child}, h.GetPendingMessages(t, r.client, base.DefaultQueueName)); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.PendingKey(base.DefaultQueueName), diff)
+	}
+}
+
+func TestDeletingDependencyPromotesDependentTasks(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	parent := h.NewTaskMessage("import", nil)
+	child := h.NewTaskMessage("notify", nil)
+	child.Dependencies = []string{parent.ID}
+	for _, msg := range []*base.TaskMessage{parent, child} {
+		if err := r.Enqueue(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := r.DeleteTask(base.DefaultQueueName, parent.ID); err != nil {
+		t.Fatalf("(*RDB).DeleteTask(parent) returned error: %v", err)
+	}
+	if got := h.GetWaitingMessages(t, r.client, base.DefaultQueueName); len(got) != 0 {
+		t.Errorf("%q has %d tasks after the dependency was deleted, want 0", base.WaitingKey(base.DefaultQueueName), len(got))
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{child}, h.GetPendingMessages(t, r.client, base.DefaultQueueName)); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.PendingKey(base.DefaultQueueName), diff)
+	}
+}
+
+func TestArchivingDependencyArchivesDependentTasks(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	qname := base.DefaultQueueName
+
+	tests := []struct {
+		desc    string
+		archive func(parent *base.TaskMessage) error
+	}{
+		{"ArchiveTask", func(parent *base.TaskMessage) error { return r.ArchiveTask(qname, parent.ID) }},
+		{"ArchiveAllPendingTasks", func(*base.TaskMessage) error { _, err := r.ArchiveAllPendingTasks(qname); return err }},
+		{"Archive", func(parent *base.TaskMessage) error {
+			msg, _, err := r.Dequeue(qname)
+			if err != nil {
+				return err
+			}
+			return r.Archive(msg, "error", base.ArchiveReasonMaxRetry)
+		}},
+	}
+	for _, tc := range tests {
+		h.FlushDB(t, r.client)
+		parent := h.NewTaskMessage("import", nil)
+		child := h.NewTaskMessage("notify", nil)
+		child.Dependencies = []string{parent.ID}
+		grandchild := h.NewTaskMessage("notify", nil)
+		grandchild.Dependencies = []string{child.ID}
+		for _, msg := range []*base.TaskMessage{parent, child, grandchild} {
+			if err := r.Enqueue(context.Background(), msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := tc.archive(parent); err != nil {
+			t.Fatalf("%s returned error: %v", tc.desc, err)
+		}
+		if got := h.GetWaitingMessages(t, r.client, qname); len(got) != 0 {
+			t.Errorf("%s: %q has %d tasks after the dependency was archived, want 0", tc.desc, base.WaitingKey(qname), len(got))
+		}
+		reasons := make(map[string]string)
+		for _, msg := range h.GetArchivedMessages(t, r.client, qname) {
+			reasons[msg.ID] = msg.ArchiveReason
+		}
+		for _, msg := range []*base.TaskMessage{child, grandchild} {
+			if got := reasons[msg.ID]; got != base.ArchiveReasonDependencyArchived {
+				t.Errorf("%s: dependent task %q archived with reason %q, want %q", tc.desc, msg.ID, got, base.ArchiveReasonDependencyArchived)
+			}
+		}
+		if len(reasons) != 3 {
+			t.Errorf("%s: %q has %d tasks, want 3", tc.desc, base.ArchivedKey(qname), len(reasons))
+		}
+	}
+}
+
+func TestDependencyResults(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	ctx := context.Background()
+	p1 := h.NewTaskMessage("import", nil)
+	p2 := h.NewTaskMessage("import", nil)
+	p2.Retention = 3600                   // completed via MarkAsComplete
+	p3 := h.NewTaskMessage("import", nil) // completes without a result
+	for _, msg := range []*base.TaskMessage{p1, p2, p3} {
+		if err := r.Enqueue(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	child := h.NewTaskMessage("report", nil)
+	child.Dependencies = []string{p1.ID, p2.ID, p3.ID}
+	if err := r.Enqueue(ctx, child); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, err := r.Dequeue(base.DefaultQueueName); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.WriteResult(base.DefaultQueueName, p1.ID, []byte("rows=1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.WriteResult(base.DefaultQueueName, p2.ID, []byte("rows=2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Done(p1); err != nil {
+		t.Fatalf("(*RDB).Done(p1) returned error: %v", err)
+	}
+	if err := r.MarkAsComplete(p2); err != nil {
+		t.Fatalf("(*RDB).MarkAsComplete(p2) returned error: %v", err)
+	}
+	if err := r.Done(p3); err != nil {
+		t.Fatalf("(*RDB).Done(p3) returned error: %v", err)
+	}
+	// late is enqueued after p2 completed; the result of p2 is retained.
+	late := h.NewTaskMessage("report", nil)
+	late.Dependencies = []string{p2.ID}
+	if err := r.Enqueue(ctx, late); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]map[string][]byte{
+		child.ID: {p1.ID: []byte("rows=1"), p2.ID: []byte("rows=2")},
+		late.ID:  {p2.ID: []byte("rows=2")},
+	}
+	for i := 0; i < 2; i++ {
+		got, _, err := r.Dequeue(base.DefaultQueueName)
+		if err != nil {
+			t.Fatalf("(*RDB).Dequeue returned error: %v", err)
+		}
+		if diff := cmp.Diff(want[got.ID], got.DependencyResults); diff != "" {
+			t.Errorf("dependency results of dequeued task %s mismatch (-want,+got):\n%s", got.ID, diff)
+		}
+	}
+}
+
 func TestDone(t *testing.T) {
 	r := setup(t)
 	defer r.Close()
@@ -1446,6 +2062,56 @@ func TestScheduleUniqueTaskIdConflictError(t *testing.T) {
 	}
 }
 
+func TestReserveIdempotencyKey(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	ctx := context.Background()
+	key := base.IdempotencyKey("default", "order:42")
+	msg1 := h.NewTaskMessage("send_email", nil)
+	msg1.ID = "task1"
+	msg1.IdempotencyKey = "order:42"
+	msg2 := h.NewTaskMessage("send_email", nil)
+	msg2.ID = "task2"
+	msg2.IdempotencyKey = "order:42"
+
+	if err := r.ReserveIdempotencyKey(ctx, msg1, time.Hour); err != nil {
+		t.Fatalf("(*RDB).ReserveIdempotencyKey returned error: %v", err)
+	}
+	if got := r.client.Get(ctx, key).Val(); got != "task1" {
+		t.Errorf("idempotency key is owned by %q, want %q", got, "task1")
+	}
+	if ttl := r.client.TTL(ctx, key).Val(); !cmp.Equal(time.Hour.Seconds(), ttl.Seconds(), cmpopts.EquateApprox(0, 2)) {
+		t.Errorf("TTL %q is %v, want %v", key, ttl, time.Hour)
+	}
+
+	err := r.ReserveIdempotencyKey(ctx, msg2, time.Hour)
+	if !errors.Is(err, errors.ErrDuplicateTask) {
+		t.Errorf("(*RDB).ReserveIdempotencyKey returned %v for a reserved key, want %v", err, errors.ErrDuplicateTask)
+	}
+	if n := r.client.HGet(ctx, base.DuplicatesKey("default"), "send_email").Val(); n != "1" {
+		t.Errorf("duplicates count of %q = %q, want %q", "send_email", n, "1")
+	}
+
+	owner, err := r.GetIdempotencyKeyOwner("default", "order:42")
+	if err != nil || owner != "task1" {
+		t.Errorf("(*RDB).GetIdempotencyKeyOwner = %q, %v; want %q, nil", owner, err, "task1")
+	}
+
+	// Release by non-owner should be a no-op.
+	if err := r.ReleaseIdempotencyKey(ctx, "default", "order:42", "task2"); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.client.Exists(ctx, key).Val(); n != 1 {
+		t.Errorf("idempotency key was released by a task which does not own the key")
+	}
+	if err := r.ReleaseIdempotencyKey(ctx, "default", "order:42", "task1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.GetIdempotencyKeyOwner("default", "order:42"); errors.CanonicalCode(err) != errors.NotFound {
+		t.Errorf("(*RDB).GetIdempotencyKeyOwner returned %v after release, want NotFound error", err)
+	}
+}
+
 func TestRetry(t *testing.T) {
 	r := setup(t)
 	defer r.Close()
@@ -1808,14 +2474,80 @@ func TestRetryWithNonFailureError(t *testing.T) {
 	}
 }
 
-func TestArchive(t *testing.T) {
+func TestArchiveTruncatesPayload(t *testing.T) {
 	r := setup(t)
 	defer r.Close()
-	now := time.Now()
-	t1 := &base.TaskMessage{
-		ID:      uuid.NewString(),
-		Type:    "send_email",
-		Payload: nil,
+	r.SetMaxArchivedPayloadSize(4)
+	defer r.SetMaxArchivedPayloadSize(0)
+
+	large := h.NewTaskMessage("import", []byte("0123456789"))
+	small := h.NewTaskMessage("import", []byte("0123"))
+	for _, msg := range []*base.TaskMessage{large, small} {
+		h.FlushDB(t, r.client)
+		h.SeedActiveQueue(t, r.client, []*base.TaskMessage{msg}, base.DefaultQueueName)
+		h.SeedDeadlines(t, r.client, []base.Z{{Message: msg, Score: time.Now().Add(time.Minute).Unix()}}, base.DefaultQueueName)
+		if err := r.Archive(msg, "oops", base.ArchiveReasonMaxRetry); err != nil {
+			t.Fatalf("(*RDB).Archive returned error: %v", err)
+		}
+		archived := h.GetArchivedMessages(t, r.client, base.DefaultQueueName)
+		if len(archived) != 1 {
+			t.Fatalf("got %d archived tasks, want 1", len(archived))
+		}
+		got := archived[0]
+		want := &base.TaskMessage{
+			ID:            msg.ID,
+			Type:          msg.Type,
+			Queue:         msg.Queue,
+			Retry:         msg.Retry,
+			Timeout:       msg.Timeout,
+			Deadline:      msg.Deadline,
+			Payload:       []byte("0123"),
+			ErrorMsg:      "oops",
+			ErrorHistory:  []string{"oops"},
+			ArchiveReason: base.ArchiveReasonMaxRetry,
+			LastFailedAt:  got.LastFailedAt,
+		}
+		if msg == large {
+			sum := sha256.Sum256([]byte("0123456789"))
+			want.PayloadSize = 10
+			want.PayloadDigest = hex.EncodeToString(sum[:])
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("archived message of %q payload mismatch (-want,+got):\n%s", msg.Payload, diff)
+		}
+		if msg == large {
+			// A truncated task must not be run with its truncated payload.
+			if err := r.RunTask(base.DefaultQueueName, msg.ID); errors.CanonicalCode(err) != errors.FailedPrecondition {
+				t.Errorf("(*RDB).RunTask on a truncated task returned %v, want FailedPrecondition", err)
+			}
+			n, err := r.RunAllArchivedTasks(base.DefaultQueueName)
+			if err != nil {
+				t.Fatalf("(*RDB).RunAllArchivedTasks returned error: %v", err)
+			}
+			if n != 0 {
+				t.Errorf("(*RDB).RunAllArchivedTasks = %d, want 0", n)
+			}
+			if got := h.GetArchivedMessages(t, r.client, base.DefaultQueueName); len(got) != 1 {
+				t.Errorf("got %d archived tasks after RunAllArchivedTasks, want 1", len(got))
+			}
+			if got := h.GetPendingMessages(t, r.client, base.DefaultQueueName); len(got) != 0 {
+				t.Errorf("got %d pending tasks after RunAllArchivedTasks, want 0", len(got))
+			}
+		}
+	}
+	if string(large.Payload) != "0123456789" {
+		t.Errorf("(*RDB).Archive modified the payload of the given message: %q", large.Payload)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	now := time.Now()
+	t1 := &base.TaskMessage{
+		ID:      uuid.NewString(),
+		Type:    "send_email",
+		Payload: nil,
 		Queue:   "default",
 		Retry:   25,
 		Retried: 25,
@@ -1889,7 +2621,7 @@ func TestArchive(t *testing.T) {
 			getWantArchived: func(failedAt time.Time) map[string][]base.Z {
 				return map[string][]base.Z{
 					"default": {
-						{Message: h.TaskMessageWithError(*t1, errMsg, failedAt), Score: failedAt.Unix()},
+						{Message: h.TaskMessageAfterArchive(*t1, errMsg, base.ArchiveReasonMaxRetry, failedAt), Score: failedAt.Unix()},
 						{Message: t3, Score: now.Add(-time.Hour).Unix()},
 					},
 				}
@@ -1922,7 +2654,7 @@ func TestArchive(t *testing.T) {
 			getWantArchived: func(failedAt time.Time) map[string][]base.Z {
 				return map[string][]base.Z{
 					"default": {
-						{Message: h.TaskMessageWithError(*t1, errMsg, failedAt), Score: failedAt.Unix()},
+						{Message: h.TaskMessageAfterArchive(*t1, errMsg, base.ArchiveReasonMaxRetry, failedAt), Score: failedAt.Unix()},
 					},
 				}
 			},
@@ -1957,7 +2689,7 @@ func TestArchive(t *testing.T) {
 				return map[string][]base.Z{
 					"default": {},
 					"custom": {
-						{Message: h.TaskMessageWithError(*t4, errMsg, failedAt), Score: failedAt.Unix()},
+						{Message: h.TaskMessageAfterArchive(*t4, errMsg, base.ArchiveReasonMaxRetry, failedAt), Score: failedAt.Unix()},
 					},
 				}
 			},
@@ -1971,7 +2703,7 @@ func TestArchive(t *testing.T) {
 		h.SeedAllArchivedQueues(t, r.client, tc.archived)
 
 		callTime := time.Now() // record time `Archive` was called
-		err := r.Archive(tc.target, errMsg)
+		err := r.Archive(tc.target, errMsg, base.ArchiveReasonMaxRetry)
 		if err != nil {
 			t.Errorf("(*RDB).Archive(%v, %v) = %v, want nil", tc.target, errMsg, err)
 			continue
@@ -2030,6 +2762,125 @@ func TestArchive(t *testing.T) {
 	}
 }
 
+func TestPark(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	m1 := h.NewTaskMessage("email:send@v3", nil)
+	m1.GroupKey = "user:42"
+	m2 := h.NewTaskMessage("sync", nil)
+	m2.GroupKey = "user:42"
+	for _, msg := range []*base.TaskMessage{m1, m2} {
+		if err := r.Enqueue(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, _, err := r.Dequeue(base.DefaultQueueName)
+	if err != nil {
+		t.Fatalf("(*RDB).Dequeue() returned error: %v", err)
+	}
+	errMsg := "handler not found for task \"email:send@v3\""
+	if err := r.Park(got, errMsg); err != nil {
+		t.Fatalf("(*RDB).Park() returned error: %v", err)
+	}
+
+	unhandled := h.GetUnhandledMessages(t, r.client, base.DefaultQueueName)
+	if len(unhandled) != 1 || unhandled[0].ID != m1.ID {
+		t.Fatalf("unhandled tasks = %v, want task %s", unhandled, m1.ID)
+	}
+	if unhandled[0].ErrorMsg != errMsg || unhandled[0].Retried != 0 {
+		t.Errorf("parked task has ErrorMsg=%q Retried=%d, want ErrorMsg=%q Retried=0", unhandled[0].ErrorMsg, unhandled[0].Retried, errMsg)
+	}
+	if n := r.client.ZCard(context.Background(), base.DeadlinesKey(base.DefaultQueueName)).Val(); n != 0 {
+		t.Errorf("ZCARD %q = %d, want 0", base.DeadlinesKey(base.DefaultQueueName), n)
+	}
+	// Parking a task releases the next task in its group.
+	next, _, err := r.Dequeue(base.DefaultQueueName)
+	if err != nil || next.ID != m2.ID {
+		t.Errorf("(*RDB).Dequeue() after Park returned (%v, %v), want task %s", next, err, m2.ID)
+	}
+	// Parked tasks don't count as processed or failed.
+	stats, err := r.CurrentStats(base.DefaultQueueName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Unhandled != 1 || stats.ProcessedTotal != 0 || stats.FailedTotal != 0 {
+		t.Errorf("CurrentStats() = Unhandled:%d ProcessedTotal:%d FailedTotal:%d, want 1, 0, 0",
+			stats.Unhandled, stats.ProcessedTotal, stats.FailedTotal)
+	}
+
+	if err := r.Park(got, errMsg); err == nil {
+		t.Errorf("(*RDB).Park() of a task which is not active returned nil error, want non-nil error")
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	m1 := h.NewTaskMessage("email:send", nil)
+	m1.GroupKey = "user:42"
+	m2 := h.NewTaskMessage("sync", nil)
+	m2.GroupKey = "user:42"
+	for _, msg := range []*base.TaskMessage{m1, m2} {
+		if err := r.Enqueue(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, _, err := r.Dequeue(base.DefaultQueueName)
+	if err != nil {
+		t.Fatalf("(*RDB).Dequeue() returned error: %v", err)
+	}
+	errMsg := "task signature is missing or invalid"
+	if err := r.Quarantine(got, errMsg); err != nil {
+		t.Fatalf("(*RDB).Quarantine() returned error: %v", err)
+	}
+
+	entries, err := r.ListQuarantined(base.DefaultQueueName, Pagination{Size: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ID != m1.ID || entries[0].State != "active" {
+		t.Fatalf("quarantined tasks = %v, want task %s quarantined from active", entries, m1.ID)
+	}
+	if msg, err := base.DecodeMessage(entries[0].Data); err != nil || msg.ErrorMsg != errMsg {
+		t.Errorf("quarantined task decoded to (%v, %v), want ErrorMsg=%q", msg, err, errMsg)
+	}
+	if n := r.client.ZCard(context.Background(), base.DeadlinesKey(base.DefaultQueueName)).Val(); n != 0 {
+		t.Errorf("ZCARD %q = %d, want 0", base.DeadlinesKey(base.DefaultQueueName), n)
+	}
+	// A quarantined task cannot be run with RunTask.
+	if err := r.RunTask(base.DefaultQueueName, m1.ID); errors.CanonicalCode(err) != errors.FailedPrecondition {
+		t.Errorf("(*RDB).RunTask() of a quarantined task returned %v, want FailedPrecondition", err)
+	}
+	// Quarantining a task releases the next task in its group.
+	next, _, err := r.Dequeue(base.DefaultQueueName)
+	if err != nil || next.ID != m2.ID {
+		t.Errorf("(*RDB).Dequeue() after Quarantine returned (%v, %v), want task %s", next, err, m2.ID)
+	}
+
+	if err := r.Quarantine(got, errMsg); err == nil {
+		t.Errorf("(*RDB).Quarantine() of a task which is not active returned nil error, want non-nil error")
+	}
+}
+
+func TestRecordUnhandled(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	h.FlushDB(t, r.client)
+	r.client.SAdd(context.Background(), base.AllQueues, "default")
+	for i := 0; i < 3; i++ {
+		if err := r.RecordUnhandled("default"); err != nil {
+			t.Fatalf("(*RDB).RecordUnhandled() returned error: %v", err)
+		}
+	}
+	stats, err := r.CurrentStats("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.UnhandledTotal != 3 {
+		t.Errorf("CurrentStats().UnhandledTotal = %d, want 3", stats.UnhandledTotal)
+	}
+}
+
 func TestForwardIfReady(t *testing.T) {
 	r := setup(t)
 	defer r.Close()
@@ -2184,12 +3035,520 @@ func TestForwardIfReady(t *testing.T) {
 	}
 }
 
+func TestForwardIfReadyDiscardsExpiredTasks(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	now := time.Now()
+	clock := timeutil.NewSimulatedClock(now)
+	r.SetClock(clock)
+	ctx := context.Background()
+
+	expired := h.NewTaskMessage("expired", nil)
+	expired.ExpiresAt = now.Add(30 * time.Second).Unix()
+	valid := h.NewTaskMessage("valid", nil)
+	valid.ExpiresAt = now.Add(time.Hour).Unix()
+	noTTL := h.NewTaskMessage("no_ttl", nil)
+	unique := h.NewTaskMessage("unique", []byte("hello"))
+	unique.UniqueKey = base.UniqueKey(unique.Queue, unique.Type, unique.Payload)
+	unique.ExpiresAt = now.Add(30 * time.Second).Unix()
+	scheduled := h.NewTaskMessage("scheduled", nil)
+	scheduled.ExpiresAt = now.Add(30 * time.Second).Unix()
+
+	for _, msg := range []*base.TaskMessage{expired, valid, noTTL} {
+		if err := r.Enqueue(ctx, msg); err != nil {
+			t.Fatalf("Enqueue(%v) returned error: %v", msg, err)
+		}
+	}
+	if err := r.EnqueueUnique(ctx, unique, time.Hour); err != nil {
+		t.Fatalf("EnqueueUnique returned error: %v", err)
+	}
+	if err := r.Schedule(ctx, scheduled, now.Add(20*time.Second)); err != nil {
+		t.Fatalf("Schedule returned error: %v", err)
+	}
+
+	clock.SetTime(now.Add(time.Minute))
+	if err := r.ForwardIfReady(base.DefaultQueueName); err != nil {
+		t.Fatalf("ForwardIfReady returned error: %v", err)
+	}
+
+	gotPending := h.GetPendingMessages(t, r.client, base.DefaultQueueName)
+	wantPending := []*base.TaskMessage{valid, noTTL}
+	if diff := cmp.Diff(wantPending, gotPending, h.SortMsgOpt); diff != "" {
+		t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.PendingKey(base.DefaultQueueName), diff)
+	}
+	if got := h.GetScheduledMessages(t, r.client, base.DefaultQueueName); len(got) != 0 {
+		t.Errorf("%q has %d tasks, want 0", base.ScheduledKey(base.DefaultQueueName), len(got))
+	}
+	for _, key := range []string{
+		base.TaskKey(expired.Queue, expired.ID),
+		base.TaskKey(unique.Queue, unique.ID),
+		base.TaskKey(scheduled.Queue, scheduled.ID),
+		unique.UniqueKey,
+	} {
+		if r.client.Exists(ctx, key).Val() != 0 {
+			t.Errorf("%q exists, want deleted", key)
+		}
+	}
+	gotExpiry := r.client.ZRange(ctx, base.ExpiryKey(base.DefaultQueueName), 0, -1).Val()
+	if diff := cmp.Diff([]string{valid.ID}, gotExpiry); diff != "" {
+		t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.ExpiryKey(base.DefaultQueueName), diff)
+	}
+}
+
+func TestForwardIfReadyKeepsStartedTasksPastExpiration(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	now := time.Now()
+	clock := timeutil.NewSimulatedClock(now)
+	r.SetClock(clock)
+	ctx := context.Background()
+
+	msg := h.NewTaskMessage("expiring", nil)
+	msg.ExpiresAt = now.Add(30 * time.Second).Unix()
+	if err := r.Enqueue(ctx, msg); err != nil {
+		t.Fatalf("Enqueue returned error: %v", err)
+	}
+	got, _, err := r.Dequeue(base.DefaultQueueName)
+	if err != nil {
+		t.Fatalf("Dequeue returned error: %v", err)
+	}
+	if n := r.client.ZCard(ctx, base.ExpiryKey(base.DefaultQueueName)).Val(); n != 0 {
+		t.Errorf("%q has %d entries after the task started, want 0", base.ExpiryKey(base.DefaultQueueName), n)
+	}
+	if err := r.Retry(got, now.Add(10*time.Second), "failed", true); err != nil {
+		t.Fatalf("Retry returned error: %v", err)
+	}
+
+	clock.SetTime(now.Add(time.Minute))
+	if err := r.ForwardIfReady(base.DefaultQueueName); err != nil {
+		t.Fatalf("ForwardIfReady returned error: %v", err)
+	}
+	gotPending := h.GetPendingMessages(t, r.client, base.DefaultQueueName)
+	if len(gotPending) != 1 || gotPending[0].ID != msg.ID {
+		t.Errorf("%q = %v, want the retried task", base.PendingKey(base.DefaultQueueName), gotPending)
+	}
+}
+
+func TestForwardIfReadyBatchSize(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	r.SetForwardBatchSize(2)
+	r.SetForwardBatchSize(0) // ignored
+	now := time.Now()
+
+	var entries []base.Z
+	for i := 0; i < 5; i++ {
+		msg := h.NewTaskMessage("task"+strconv.Itoa(i), nil)
+		entries = append(entries, base.Z{Message: msg, Score: now.Add(-time.Minute).Unix()})
+	}
+	h.SeedRetryQueue(t, r.client, entries, base.DefaultQueueName)
+
+	n, err := r.forward(base.RetryKey(base.DefaultQueueName), base.PendingKey(base.DefaultQueueName), base.TaskKeyPrefix(base.DefaultQueueName))
+	if err != nil {
+		t.Fatalf("forward returned error: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("forward moved %d tasks, want 2 (the batch size)", n)
+	}
+
+	// ForwardIfReady moves all ready tasks in batches.
+	if err := r.ForwardIfReady(base.DefaultQueueName); err != nil {
+		t.Fatalf("ForwardIfReady returned error: %v", err)
+	}
+	if got := h.GetPendingMessages(t, r.client, base.DefaultQueueName); len(got) != len(entries) {
+		t.Errorf("%q has %d tasks, want %d", base.PendingKey(base.DefaultQueueName), len(got), len(entries))
+	}
+	if got := h.GetRetryEntries(t, r.client, base.DefaultQueueName); len(got) != 0 {
+		t.Errorf("%q has %d tasks, want 0", base.RetryKey(base.DefaultQueueName), len(got))
+	}
+}
+
 func newCompletedTask(qname, typename string, payload []byte, completedAt time.Time) *base.TaskMessage {
 	msg := h.NewTaskMessageWithQueue(typename, payload, qname)
 	msg.CompletedAt = completedAt.Unix()
 	return msg
 }
 
+func TestRecordQueueSizes(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	h.FlushDB(t, r.client)
+	start := time.Now().Truncate(time.Millisecond)
+	clock := timeutil.NewSimulatedClock(start)
+	r.SetClock(clock)
+
+	m1 := h.NewTaskMessage("task1", nil)
+	m2 := h.NewTaskMessage("task2", nil)
+	m3 := h.NewTaskMessage("task3", nil)
+	h.SeedPendingQueue(t, r.client, []*base.TaskMessage{m1, m2}, "default")
+	h.SeedRetryQueue(t, r.client, []base.Z{{Message: m3, Score: start.Add(time.Hour).Unix()}}, "default")
+
+	if err := r.RecordQueueSizes("default", 5*time.Minute); err != nil {
+		t.Fatalf("RecordQueueSizes returned error: %v", err)
+	}
+	// Samples within the interval are skipped.
+	clock.AdvanceTime(4 * time.Minute)
+	if err := r.RecordQueueSizes("default", 5*time.Minute); err != nil {
+		t.Fatalf("RecordQueueSizes returned error: %v", err)
+	}
+	clock.AdvanceTime(time.Minute)
+	if _, err := r.client.LPop(context.Background(), base.PendingKey("default")).Result(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RecordQueueSizes("default", 5*time.Minute); err != nil {
+		t.Fatalf("RecordQueueSizes returned error: %v", err)
+	}
+
+	got, err := r.QueueHistory("default", start)
+	if err != nil {
+		t.Fatalf("QueueHistory returned error: %v", err)
+	}
+	want := []*QueueSample{
+		{Queue: "default", Size: 3, Pending: 2, Retry: 1, Time: start},
+		{Queue: "default", Size: 2, Pending: 1, Retry: 1, Time: start.Add(5 * time.Minute)},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("QueueHistory returned %v, want %v; (-want,+got)\n%s", got, want, diff)
+	}
+	got, err = r.QueueHistory("default", start.Add(time.Minute))
+	if err != nil || len(got) != 1 {
+		t.Errorf("QueueHistory returned (%v, %v), want only the last sample", got, err)
+	}
+	if _, err := r.QueueHistory("nonexistent", start); !errors.IsQueueNotFound(err) {
+		t.Errorf("QueueHistory of nonexistent queue returned %v, want QueueNotFoundError", err)
+	}
+}
+
+func TestClaimExpiryDigest(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	h.FlushDB(t, r.client)
+	now := time.Now()
+	r.SetClock(timeutil.NewSimulatedClock(now))
+
+	retention := archivedExpirationInDays * 24 * time.Hour
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	m3 := h.NewTaskMessage("send_email", nil)
+	z1 := base.Z{Message: m1, Score: now.Add(-retention).Add(-time.Hour).Unix()}
+	z2 := base.Z{Message: m2, Score: now.Add(-retention).Add(12 * time.Hour).Unix()}
+	z3 := base.Z{Message: m3, Score: now.Add(-retention).Add(48 * time.Hour).Unix()}
+	h.SeedArchivedQueue(t, r.client, []base.Z{z1, z2, z3}, "default")
+
+	got, err := r.ClaimExpiryDigest("default", 24*time.Hour, time.Hour, time.Minute)
+	if err != nil {
+		t.Fatalf("ClaimExpiryDigest returned error: %v", err)
+	}
+	want := &base.ExpiringArchived{
+		CountByType:      map[string]int{"send_email": 1, "reindex": 1},
+		Expired:          2,
+		OldestArchivedAt: time.Unix(z1.Score, 0),
+		NewestArchivedAt: time.Unix(z2.Score, 0),
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ClaimExpiryDigest returned %v; (-want,+got)\n%s", got, diff)
+	}
+	// The digest is claimed until it's finished.
+	if got, err := r.ClaimExpiryDigest("default", 24*time.Hour, time.Hour, time.Minute); err != nil || got != nil {
+		t.Errorf("ClaimExpiryDigest of a claimed digest returned (%v, %v), want nil", got, err)
+	}
+	// A digest which failed to be delivered is made again.
+	if err := r.FinishExpiryDigest("default", time.Hour, false); err != nil {
+		t.Fatalf("FinishExpiryDigest returned error: %v", err)
+	}
+	if got, err := r.ClaimExpiryDigest("default", 24*time.Hour, time.Hour, time.Minute); err != nil || got == nil {
+		t.Errorf("ClaimExpiryDigest of a released digest returned (%v, %v), want the tasks", got, err)
+	}
+	// The digest is made once per period.
+	if err := r.FinishExpiryDigest("default", time.Hour, true); err != nil {
+		t.Fatalf("FinishExpiryDigest returned error: %v", err)
+	}
+	if ttl := r.client.TTL(context.Background(), base.ExpiryDigestKey("default")).Val(); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("TTL of the digest marker = %v, want the period", ttl)
+	}
+	if got, err := r.ClaimExpiryDigest("default", 24*time.Hour, time.Hour, time.Minute); err != nil || got != nil {
+		t.Errorf("ClaimExpiryDigest within the period returned (%v, %v), want nil", got, err)
+	}
+
+	// The oldest tasks trimmed by the next archives of a nearly full archive are included,
+	// at the rate of the last period.
+	r.client.Del(context.Background(), base.ExpiryDigestKey("default"))
+	var recent []*redis.Z
+	for i := 0; i < maxArchiveSize/2; i++ {
+		recent = append(recent, &redis.Z{Member: "recent:" + strconv.Itoa(i), Score: float64(now.Unix())})
+	}
+	if err := r.client.ZAdd(context.Background(), base.ArchivedKey("default"), recent...).Err(); err != nil {
+		t.Fatal(err)
+	}
+	got, err = r.ClaimExpiryDigest("default", 24*time.Hour, time.Hour, time.Minute)
+	if err != nil {
+		t.Fatalf("ClaimExpiryDigest returned error: %v", err)
+	}
+	want = &base.ExpiringArchived{
+		CountByType:      map[string]int{"send_email": 2, "reindex": 1},
+		Expired:          2,
+		Trimmed:          2,
+		OldestArchivedAt: time.Unix(z1.Score, 0),
+		NewestArchivedAt: time.Unix(now.Unix(), 0),
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ClaimExpiryDigest returned %v; (-want,+got)\n%s", got, diff)
+	}
+}
+
+func TestRecordTaskSample(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	h.FlushDB(t, r.client)
+	h.SeedPendingQueue(t, r.client, []*base.TaskMessage{h.NewTaskMessage("task1", nil)}, "default")
+	now := time.Now().Truncate(time.Millisecond)
+
+	s1 := &base.TaskSample{Type: "send_email", PayloadSize: 128, Duration: 3 * time.Millisecond, WaitTime: time.Second, CompletedAt: now}
+	s2 := &base.TaskSample{Type: "report:daily,pdf", PayloadSize: 0, Duration: time.Minute, CompletedAt: now.Add(time.Second)}
+	for _, s := range []*base.TaskSample{s1, s2} {
+		if err := r.RecordTaskSample("default", s); err != nil {
+			t.Fatalf("RecordTaskSample returned error: %v", err)
+		}
+	}
+	got, err := r.ListTaskSamples("default")
+	if err != nil {
+		t.Fatalf("ListTaskSamples returned error: %v", err)
+	}
+	if diff := cmp.Diff([]*base.TaskSample{s2, s1}, got); diff != "" {
+		t.Errorf("ListTaskSamples returned %v; (-want,+got)\n%s", got, diff)
+	}
+
+	for i := 0; i < maxTaskSamples; i++ {
+		if err := r.RecordTaskSample("default", s1); err != nil {
+			t.Fatalf("RecordTaskSample returned error: %v", err)
+		}
+	}
+	if n := r.client.LLen(context.Background(), base.TaskSamplesKey("default")).Val(); n != maxTaskSamples {
+		t.Errorf("got %d samples, want %d", n, maxTaskSamples)
+	}
+	if _, err := r.ListTaskSamples("nonexistent"); !errors.IsQueueNotFound(err) {
+		t.Errorf("ListTaskSamples of nonexistent queue returned %v, want QueueNotFoundError", err)
+	}
+}
+
+func TestRecordLatency(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	h.FlushDB(t, r.client)
+	h.SeedPendingQueue(t, r.client, []*base.TaskMessage{h.NewTaskMessage("task1", nil)}, "default")
+
+	latencies := []*base.TaskLatency{
+		{Type: "email:send", Wait: 2 * time.Second, Run: 3 * time.Millisecond},
+		{Type: "email:send", Wait: 3 * time.Second, Run: 7 * time.Millisecond},
+		{Type: "report", Run: time.Minute}, // wait time unknown
+		{Type: "report", Run: 48 * time.Hour},
+	}
+	for _, l := range latencies {
+		if err := r.RecordLatency("default", l); err != nil {
+			t.Fatalf("RecordLatency returned error: %v", err)
+		}
+	}
+	got, err := r.ListLatencyHistograms("default")
+	if err != nil {
+		t.Fatalf("ListLatencyHistograms returned error: %v", err)
+	}
+	counts := func(buckets ...time.Duration) []int64 {
+		res := make([]int64, len(base.LatencyBuckets)+1)
+		for _, d := range buckets {
+			res[base.LatencyBucket(d)]++
+		}
+		return res
+	}
+	want := map[string]*TaskLatencyHistograms{
+		"email:send": {
+			Wait: &LatencyHistogram{Counts: counts(2*time.Second, 3*time.Second), Sum: 5 * time.Second},
+			Run:  &LatencyHistogram{Counts: counts(3*time.Millisecond, 7*time.Millisecond), Sum: 10 * time.Millisecond},
+		},
+		"report": {
+			Wait: &LatencyHistogram{Counts: counts()},
+			Run:  &LatencyHistogram{Counts: counts(time.Minute, 48*time.Hour), Sum: 48*time.Hour + time.Minute},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ListLatencyHistograms returned %v; (-want,+got)\n%s", got, diff)
+	}
+	if _, err := r.ListLatencyHistograms("nonexistent"); !errors.IsQueueNotFound(err) {
+		t.Errorf("ListLatencyHistograms of nonexistent queue returned %v, want QueueNotFoundError", err)
+	}
+}
+
+func TestDequeueSetsPendingSince(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	h.FlushDB(t, r.client)
+	before := time.Now()
+	if err := r.Enqueue(context.Background(), h.NewTaskMessage("task1", nil)); err != nil {
+		t.Fatalf("Enqueue returned error: %v", err)
+	}
+	msg, _, err := r.Dequeue("default")
+	if err != nil {
+		t.Fatalf("Dequeue returned error: %v", err)
+	}
+	if pendingSince := time.Unix(0, msg.PendingSince); pendingSince.Before(before) || pendingSince.After(time.Now()) {
+		t.Errorf("Dequeue returned message pending since %v, want the time of the enqueue", pendingSince)
+	}
+}
+
+func TestAckUnderPreviousLease(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	h.FlushDB(t, r.client)
+	if err := r.Enqueue(context.Background(), h.NewTaskMessage("task1", nil)); err != nil {
+		t.Fatalf("Enqueue returned error: %v", err)
+	}
+	first, _, err := r.Dequeue("default")
+	if err != nil {
+		t.Fatalf("Dequeue returned error: %v", err)
+	}
+	// The task is recovered and delivered again before the first delivery is acknowledged.
+	if err := r.Requeue(first); err != nil {
+		t.Fatalf("Requeue returned error: %v", err)
+	}
+	second, _, err := r.Dequeue("default")
+	if err != nil {
+		t.Fatalf("Dequeue returned error: %v", err)
+	}
+	if second.Lease == first.Lease {
+		t.Fatalf("Dequeue returned the lease %d of the previous delivery", second.Lease)
+	}
+
+	if err := r.Done(first); errors.CanonicalCode(err) != errors.NotFound {
+		t.Errorf("Done under a previous lease returned %v, want NotFound error", err)
+	}
+	if err := r.Retry(first, time.Now(), "error", true); errors.CanonicalCode(err) != errors.NotFound {
+		t.Errorf("Retry under a previous lease returned %v, want NotFound error", err)
+	}
+	if got := h.GetActiveMessages(t, r.client, "default"); len(got) != 1 {
+		t.Fatalf("active tasks = %v, want the task of the second delivery", got)
+	}
+	if err := r.Done(second); err != nil {
+		t.Errorf("Done under the current lease returned error: %v", err)
+	}
+}
+
+func TestArchiveStaleTasks(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	h.FlushDB(t, r.client)
+	now := time.Now()
+	s1 := h.NewTaskMessage("stuck", nil)
+	s2 := h.NewTaskMessage("recent", nil)
+	r1 := h.NewTaskMessage("stuck_retry", nil)
+	r2 := h.NewTaskMessage("future_retry", nil)
+	h.SeedScheduledQueue(t, r.client, []base.Z{
+		{Message: s1, Score: now.AddDate(-1, 0, 0).Unix()},
+		{Message: s2, Score: now.Add(-time.Minute).Unix()},
+	}, "default")
+	h.SeedRetryQueue(t, r.client, []base.Z{
+		{Message: r1, Score: now.AddDate(0, -2, 0).Unix()},
+		{Message: r2, Score: now.Add(time.Hour).Unix()},
+	}, "default")
+
+	n, err := r.ArchiveStaleTasks("default", now.AddDate(0, 0, -7))
+	if err != nil || n != 2 {
+		t.Fatalf("ArchiveStaleTasks = (%d, %v), want (2, nil)", n, err)
+	}
+	if got := h.GetScheduledMessages(t, r.client, "default"); len(got) != 1 || got[0].ID != s2.ID {
+		t.Errorf("scheduled messages are %v, want only %q", got, s2.ID)
+	}
+	if got := h.GetRetryMessages(t, r.client, "default"); len(got) != 1 || got[0].ID != r2.ID {
+		t.Errorf("retry messages are %v, want only %q", got, r2.ID)
+	}
+	archived := h.GetArchivedMessages(t, r.client, "default")
+	if len(archived) != 2 {
+		t.Fatalf("got %d archived messages, want 2", len(archived))
+	}
+	for _, msg := range archived {
+		if msg.ID != s1.ID && msg.ID != r1.ID {
+			t.Errorf("task %q was archived, want only %q and %q", msg.ID, s1.ID, r1.ID)
+		}
+		if msg.ArchiveReason != base.ArchiveReasonStale {
+			t.Errorf("task %q was archived with reason %q, want %q", msg.ID, msg.ArchiveReason, base.ArchiveReasonStale)
+		}
+		if state := r.client.HGet(context.Background(), base.TaskKey("default", msg.ID), "state").Val(); state != "archived" {
+			t.Errorf("task %q is in state %q, want archived", msg.ID, state)
+		}
+	}
+
+	if _, err := r.ArchiveStaleTasks("nonexistent", now); !errors.IsQueueNotFound(err) {
+		t.Errorf("ArchiveStaleTasks of nonexistent queue returned %v, want QueueNotFoundError", err)
+	}
+}
+
+func TestDelayQueue(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	h.FlushDB(t, r.client)
+	now := time.Now()
+	s1 := h.NewTaskMessage("scheduled", nil)
+	r1 := h.NewTaskMessage("retry", nil)
+	r2 := h.NewTaskMessage("overdue_retry", nil)
+	p1 := h.NewTaskMessage("pending", nil)
+	h.SeedScheduledQueue(t, r.client, []base.Z{{Message: s1, Score: now.Add(time.Hour).Unix()}}, "default")
+	h.SeedRetryQueue(t, r.client, []base.Z{
+		{Message: r1, Score: now.Add(time.Minute).Unix()},
+		{Message: r2, Score: now.Add(-time.Minute).Unix()},
+	}, "default")
+	h.SeedPendingQueue(t, r.client, []*base.TaskMessage{p1}, "default")
+
+	n, err := r.DelayQueue("default", 2*time.Hour)
+	if err != nil || n != 3 {
+		t.Fatalf("DelayQueue = (%d, %v), want (3, nil)", n, err)
+	}
+	wantScheduled := []base.Z{{Message: s1, Score: now.Add(3 * time.Hour).Unix()}}
+	if diff := cmp.Diff(wantScheduled, h.GetScheduledEntries(t, r.client, "default")); diff != "" {
+		t.Errorf("mismatch found in scheduled set; (-want,+got)\n%s", diff)
+	}
+	wantRetry := []base.Z{
+		{Message: r2, Score: now.Add(2*time.Hour - time.Minute).Unix()},
+		{Message: r1, Score: now.Add(2*time.Hour + time.Minute).Unix()},
+	}
+	if diff := cmp.Diff(wantRetry, h.GetRetryEntries(t, r.client, "default"), h.SortZSetEntryOpt); diff != "" {
+		t.Errorf("mismatch found in retry set; (-want,+got)\n%s", diff)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{p1}, h.GetPendingMessages(t, r.client, "default")); diff != "" {
+		t.Errorf("mismatch found in pending list; (-want,+got)\n%s", diff)
+	}
+
+	// More tasks than a batch with the same process time. The tasks which would be
+	// delayed past the time they must start processing by keep their process time.
+	h.FlushDB(t, r.client)
+	processAt := now.Add(time.Hour).Unix()
+	var entries []base.Z
+	expiring := make(map[string]bool)
+	for i := 0; i < 2*delayQueueBatchSize+50; i++ {
+		msg := h.NewTaskMessage("scheduled", nil)
+		if i%3 == 0 {
+			msg.ExpiresAt = processAt + 60
+			expiring[msg.ID] = true
+		}
+		entries = append(entries, base.Z{Message: msg, Score: processAt})
+	}
+	h.SeedScheduledQueue(t, r.client, entries, "default")
+	n, err = r.DelayQueue("default", 2*time.Hour)
+	if want := int64(len(entries) - len(expiring)); err != nil || n != want {
+		t.Fatalf("DelayQueue = (%d, %v), want (%d, nil)", n, err, want)
+	}
+	for _, z := range h.GetScheduledEntries(t, r.client, "default") {
+		want := processAt + int64(2*time.Hour/time.Second)
+		if expiring[z.Message.ID] {
+			want = processAt
+		}
+		if z.Score != want {
+			t.Errorf("task %s is scheduled at %d, want %d", z.Message.ID, z.Score, want)
+		}
+	}
+
+	if _, err := r.DelayQueue("nonexistent", time.Hour); !errors.IsQueueNotFound(err) {
+		t.Errorf("DelayQueue of nonexistent queue returned %v, want QueueNotFoundError", err)
+	}
+}
+
 func TestDeleteExpiredCompletedTasks(t *testing.T) {
 	r := setup(t)
 	defer r.Close()
@@ -2359,6 +3718,37 @@ func TestListDeadlineExceeded(t *testing.T) {
 	}
 }
 
+func TestListDeadlineExceededRemovesUndecodableTasks(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	h.FlushDB(t, r.client)
+	ctx := context.Background()
+	good := h.NewTaskMessage("task1", nil)
+	bad := h.NewTaskMessage("task2", nil)
+	h.SeedActiveQueue(t, r.client, []*base.TaskMessage{good, bad}, "default")
+	h.SeedDeadlines(t, r.client, []base.Z{
+		{Message: good, Score: time.Now().Add(-time.Hour).Unix()},
+		{Message: bad, Score: time.Now().Add(-time.Hour).Unix()},
+	}, "default")
+	if err := r.client.HSet(ctx, base.TaskKey("default", bad.ID), "msg", "bad data").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := r.ListDeadlineExceeded(time.Now(), "default")
+	if err != nil {
+		t.Fatalf("ListDeadlineExceeded returned error: %v", err)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{good}, got); diff != "" {
+		t.Errorf("ListDeadlineExceeded returned %v, want %v; (-want,+got)\n%s", got, []*base.TaskMessage{good}, diff)
+	}
+	if diff := cmp.Diff([]string{bad.ID}, r.client.ZRange(ctx, base.QuarantineKey("default"), 0, -1).Val()); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.QuarantineKey("default"), diff)
+	}
+	if diff := cmp.Diff([]string{good.ID}, r.client.LRange(ctx, base.ActiveKey("default"), 0, -1).Val()); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.ActiveKey("default"), diff)
+	}
+}
+
 func TestWriteServerState(t *testing.T) {
 	r := setup(t)
 	defer r.Close()
@@ -2410,6 +3800,12 @@ func TestWriteServerState(t *testing.T) {
 	if diff := cmp.Diff(wantServerKeys, gotServerKeys); diff != "" {
 		t.Errorf("%q contained %v, want %v", base.AllServers, gotServerKeys, wantServerKeys)
 	}
+	// Check queues were registered to the set of all queues.
+	gotQueues := r.client.SMembers(context.Background(), base.AllQueues).Val()
+	wantQueues := []string{"default", "email", "low"}
+	if diff := cmp.Diff(wantQueues, gotQueues, h.SortStringSliceOpt); diff != "" {
+		t.Errorf("%q contained %v, want %v", base.AllQueues, gotQueues, wantQueues)
+	}
 
 	// Check WorkersInfo was written correctly.
 	wkey := base.WorkersKey(host, pid, serverID)
@@ -2634,6 +4030,64 @@ func TestClearServerState(t *testing.T) {
 	}
 }
 
+func TestRequeueOrphans(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	h.FlushDB(t, r.client)
+	msg1 := h.NewTaskMessage("send_email", nil)
+	msg2 := h.NewTaskMessage("send_email", nil)
+	finished := h.NewTaskMessage("send_email", nil)
+	other := h.NewTaskMessage("send_email", nil)
+	deadline := time.Now().Add(time.Hour)
+	h.SeedActiveQueue(t, r.client, []*base.TaskMessage{msg1, msg2, other}, base.DefaultQueueName)
+	h.SeedDeadlines(t, r.client, []base.Z{
+		{Message: msg1, Score: deadline.Unix()},
+		{Message: msg2, Score: deadline.Unix()},
+		{Message: other, Score: deadline.Unix()},
+	}, base.DefaultQueueName)
+	workers := func(host string, pid int, serverID string, msgs ...*base.TaskMessage) []*base.WorkerInfo {
+		var res []*base.WorkerInfo
+		for _, msg := range msgs {
+			res = append(res, &base.WorkerInfo{
+				Host: host, PID: pid, ServerID: serverID, ID: msg.ID, Type: msg.Type,
+				Queue: msg.Queue, Started: time.Now(), Deadline: deadline,
+			})
+		}
+		return res
+	}
+	dead := &base.ServerInfo{Host: "127.0.0.1", PID: 1234, ServerID: "dead", Status: "active"}
+	alive := &base.ServerInfo{Host: "127.0.0.2", PID: 9876, ServerID: "alive", Status: "active"}
+	// The finished task is not active anymore, but still listed in the last heartbeat of the server.
+	if err := r.WriteServerState(dead, workers(dead.Host, dead.PID, dead.ServerID, msg1, msg2, finished), time.Minute); err != nil {
+		t.Fatalf("could not write server state: %v", err)
+	}
+	if err := r.WriteServerState(alive, workers(alive.Host, alive.PID, alive.ServerID, other), time.Minute); err != nil {
+		t.Fatalf("could not write server state: %v", err)
+	}
+
+	n, err := r.RequeueOrphans("dead")
+	if err != nil || n != 2 {
+		t.Fatalf("(*RDB).RequeueOrphans(%q) = (%d, %v), want (2, nil)", "dead", n, err)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{msg1, msg2}, h.GetPendingMessages(t, r.client, base.DefaultQueueName), h.SortMsgOpt); diff != "" {
+		t.Errorf("mismatch found in pending queue; (-want,+got)\n%s", diff)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{other}, h.GetActiveMessages(t, r.client, base.DefaultQueueName)); diff != "" {
+		t.Errorf("mismatch found in active queue; (-want,+got)\n%s", diff)
+	}
+	wantDeadlines := []base.Z{{Message: other, Score: deadline.Unix()}}
+	if diff := cmp.Diff(wantDeadlines, h.GetDeadlinesEntries(t, r.client, base.DefaultQueueName)); diff != "" {
+		t.Errorf("mismatch found in deadlines; (-want,+got)\n%s", diff)
+	}
+	servers, err := r.ListServers()
+	if err != nil || len(servers) != 1 || servers[0].ServerID != "alive" {
+		t.Errorf("(*RDB).ListServers() = (%v, %v), want server %q only", servers, err, "alive")
+	}
+	if _, err := r.RequeueOrphans("dead"); errors.CanonicalCode(err) != errors.NotFound {
+		t.Errorf("(*RDB).RequeueOrphans(%q) returned %v, want NotFound error", "dead", err)
+	}
+}
+
 func TestCancelationPubSub(t *testing.T) {
 	r := setup(t)
 	defer r.Close()
@@ -2676,6 +4130,204 @@ func TestCancelationPubSub(t *testing.T) {
 	mu.Unlock()
 }
 
+func TestWakeupPubSub(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	h.FlushDB(t, r.client)
+	now := time.Now()
+	r.SetClock(timeutil.NewSimulatedClock(now))
+
+	pubsub, err := r.WakeupPubSub("default", "critical", "low")
+	if err != nil {
+		t.Fatalf("(*RDB).WakeupPubSub() returned an error: %v", err)
+	}
+	defer pubsub.Close()
+	ch := pubsub.Channel()
+
+	receive := func(desc, want string) {
+		t.Helper()
+		select {
+		case msg := <-ch:
+			if msg.Payload != want {
+				t.Errorf("%s; subscriber received %q, want %q", desc, msg.Payload, want)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s; subscriber did not receive a message", desc)
+		}
+	}
+
+	// Servers are woken up only for the queues they subscribe to.
+	if err := r.Enqueue(context.Background(), h.NewTaskMessageWithQueue("task0", nil, "other")); err != nil {
+		t.Fatalf("(*RDB).Enqueue() returned an error: %v", err)
+	}
+	m1 := h.NewTaskMessageWithQueue("task1", nil, "default")
+	if err := r.Enqueue(context.Background(), m1); err != nil {
+		t.Fatalf("(*RDB).Enqueue() returned an error: %v", err)
+	}
+	receive("Enqueue", "default")
+
+	m2 := h.NewTaskMessageWithQueue("task2", nil, "critical")
+	m2.UniqueKey = base.UniqueKey("critical", "task2", nil)
+	if err := r.EnqueueUnique(context.Background(), m2, time.Minute); err != nil {
+		t.Fatalf("(*RDB).EnqueueUnique() returned an error: %v", err)
+	}
+	receive("EnqueueUnique", "critical")
+
+	m3 := h.NewTaskMessageWithQueue("task3", nil, "low")
+	h.SeedScheduledQueue(t, r.client, []base.Z{{Message: m3, Score: now.Add(-time.Second).Unix()}}, "low")
+	if err := r.ForwardIfReady("low"); err != nil {
+		t.Fatalf("(*RDB).ForwardIfReady() returned an error: %v", err)
+	}
+	receive("ForwardIfReady", "low")
+
+	// The next task of a group and the tasks waiting for a completed task
+	// become pending once the task is done.
+	for _, tc := range []struct {
+		desc string
+		next func(first *base.TaskMessage) *base.TaskMessage
+	}{
+		{"Done of a task of a group", func(first *base.TaskMessage) *base.TaskMessage {
+			first.GroupKey = "group1"
+			next := h.NewTaskMessageWithQueue("next", nil, "default")
+			next.GroupKey = "group1"
+			return next
+		}},
+		{"Done of a dependency", func(first *base.TaskMessage) *base.TaskMessage {
+			next := h.NewTaskMessageWithQueue("next", nil, "default")
+			next.Dependencies = []string{first.ID}
+			return next
+		}},
+	} {
+		h.FlushDB(t, r.client)
+		first := h.NewTaskMessageWithQueue("first", nil, "default")
+		next := tc.next(first)
+		if err := r.Enqueue(context.Background(), first); err != nil {
+			t.Fatalf("(*RDB).Enqueue() returned an error: %v", err)
+		}
+		receive(tc.desc+"; Enqueue", "default")
+		if err := r.Enqueue(context.Background(), next); err != nil {
+			t.Fatalf("(*RDB).Enqueue() returned an error: %v", err)
+		}
+		msg, _, err := r.Dequeue("default")
+		if err != nil {
+			t.Fatalf("(*RDB).Dequeue() returned an error: %v", err)
+		}
+		if err := r.Done(msg); err != nil {
+			t.Fatalf("(*RDB).Done() returned an error: %v", err)
+		}
+		receive(tc.desc, "default")
+	}
+}
+
+func TestConcurrencyPubSub(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+
+	pubsub, err := r.ConcurrencyPubSub("server123")
+	if err != nil {
+		t.Fatalf("(*RDB).ConcurrencyPubSub() returned an error: %v", err)
+	}
+	defer pubsub.Close()
+
+	if err := r.PublishConcurrency("server456", 4); err != nil {
+		t.Fatalf("(*RDB).PublishConcurrency() returned an error: %v", err)
+	}
+	if err := r.PublishConcurrency("server123", 8); err != nil {
+		t.Fatalf("(*RDB).PublishConcurrency() returned an error: %v", err)
+	}
+
+	select {
+	case msg := <-pubsub.Channel():
+		if msg.Payload != "8" {
+			t.Errorf("subscriber received %q, want %q", msg.Payload, "8")
+		}
+	case <-time.After(time.Second):
+		t.Error("subscriber did not receive a message")
+	}
+}
+
+func TestQuietPubSub(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+
+	pubsub, err := r.QuietPubSub("server123")
+	if err != nil {
+		t.Fatalf("(*RDB).QuietPubSub() returned an error: %v", err)
+	}
+	defer pubsub.Close()
+
+	if err := r.PublishQuiet("server456"); err != nil {
+		t.Fatalf("(*RDB).PublishQuiet() returned an error: %v", err)
+	}
+	select {
+	case msg := <-pubsub.Channel():
+		t.Errorf("subscriber received %q published to another server", msg.Payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := r.PublishQuiet("server123"); err != nil {
+		t.Fatalf("(*RDB).PublishQuiet() returned an error: %v", err)
+	}
+	select {
+	case <-pubsub.Channel():
+	case <-time.After(time.Second):
+		t.Error("subscriber did not receive a message")
+	}
+}
+
+func TestDequeueAtMostOnce(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	now := time.Now()
+	r.SetClock(timeutil.NewSimulatedClock(now))
+	msg := h.NewTaskMessage("task1", nil)
+	msg.AtMostOnce = true
+	msg.Timeout = 60
+	other := h.NewTaskMessage("task2", nil)
+	if err := r.Enqueue(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	key := base.StartedKey(msg.Queue, msg.ID)
+
+	if _, _, err := r.Dequeue(base.DefaultQueueName); err != nil {
+		t.Fatalf("Dequeue returned error: %v", err)
+	}
+	if ttl := r.client.TTL(context.Background(), key).Val(); ttl <= time.Minute || ttl > 2*time.Minute {
+		t.Errorf("TTL of %q is %v, want up to 2m", key, ttl)
+	}
+
+	// The task is delivered again while the first delivery is being processed.
+	if err := r.Retry(msg, now, "timeout", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ForwardIfReady(base.DefaultQueueName); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Enqueue(context.Background(), other); err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := r.Dequeue(base.DefaultQueueName)
+	if err != nil || got.ID != other.ID {
+		t.Fatalf("Dequeue returned (%v, %v), want task %s", got, err, other.ID)
+	}
+	if _, _, err := r.Dequeue(base.DefaultQueueName); !errors.Is(err, errors.ErrNoProcessableTask) {
+		t.Fatalf("Dequeue of a task marked as started returned %v, want ErrNoProcessableTask", err)
+	}
+	if size, err := r.PendingSize(context.Background(), base.DefaultQueueName); err != nil || size != 1 {
+		t.Errorf("PendingSize returned (%d, %v), want (1, nil)", size, err)
+	}
+
+	if err := r.ClearStarted(msg); err != nil {
+		t.Fatalf("ClearStarted returned error: %v", err)
+	}
+	got, _, err = r.Dequeue(base.DefaultQueueName)
+	if err != nil || got.ID != msg.ID {
+		t.Fatalf("Dequeue after ClearStarted returned (%v, %v), want task %s", got, err, msg.ID)
+	}
+	if r.client.Exists(context.Background(), key).Val() != 1 {
+		t.Errorf("%q does not exist after Dequeue, want the task marked as started", key)
+	}
+}
+
 func TestWriteResult(t *testing.T) {
 	r := setup(t)
 	defer r.Close()
@@ -2711,3 +4363,173 @@ func TestWriteResult(t *testing.T) {
 		}
 	}
 }
+
+func TestWriteProgress(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	msg := h.NewTaskMessage("export", nil)
+	h.SeedPendingQueue(t, r.client, []*base.TaskMessage{msg}, "default")
+
+	if err := r.WriteProgress("default", msg.ID, []byte("10")); !errors.IsTaskNotFound(err) {
+		t.Errorf("WriteProgress for pending task returned %v, want TaskNotFoundError", err)
+	}
+	got, _, err := r.Dequeue("default")
+	if err != nil {
+		t.Fatalf("Dequeue returned error: %v", err)
+	}
+	if err := r.WriteProgress("default", msg.ID, []byte(`{"rows":42}`)); err != nil {
+		t.Fatalf("WriteProgress returned error: %v", err)
+	}
+	info, err := r.GetTaskInfo("default", msg.ID)
+	if err != nil {
+		t.Fatalf("GetTaskInfo returned error: %v", err)
+	}
+	if string(info.Progress) != `{"rows":42}` {
+		t.Errorf("GetTaskInfo returned progress %q, want %q", info.Progress, `{"rows":42}`)
+	}
+	active, err := r.ListActive("default", Pagination{Size: 10})
+	if err != nil {
+		t.Fatalf("ListActive returned error: %v", err)
+	}
+	if len(active) != 1 || string(active[0].Progress) != `{"rows":42}` {
+		t.Errorf("ListActive returned %v, want the task with progress %q", active, `{"rows":42}`)
+	}
+
+	// The progress is cleared when the task is dequeued again.
+	if err := r.Requeue(got); err != nil {
+		t.Fatalf("Requeue returned error: %v", err)
+	}
+	if _, _, err := r.Dequeue("default"); err != nil {
+		t.Fatalf("Dequeue returned error: %v", err)
+	}
+	info, err = r.GetTaskInfo("default", msg.ID)
+	if err != nil {
+		t.Fatalf("GetTaskInfo returned error: %v", err)
+	}
+	if info.Progress != nil {
+		t.Errorf("GetTaskInfo returned progress %q after the task was dequeued again, want nil", info.Progress)
+	}
+}
+
+func TestCacheResult(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	msg := h.NewTaskMessage("report:generate", nil)
+	msg.IdempotencyKey = "report:2021-06"
+	h.SeedPendingQueue(t, r.client, []*base.TaskMessage{msg}, "default")
+	if _, _, err := r.Dequeue("default"); err != nil {
+		t.Fatalf("Dequeue returned error: %v", err)
+	}
+	if _, err := r.WriteResult("default", msg.ID, []byte("s3://reports/2021-06.pdf")); err != nil {
+		t.Fatalf("WriteResult returned error: %v", err)
+	}
+	if err := r.CacheResult(msg, time.Minute); err != nil {
+		t.Fatalf("CacheResult returned error: %v", err)
+	}
+	key := base.ResultCacheKey("default", msg.Type, msg.IdempotencyKey)
+	if ttl := r.client.PTTL(context.Background(), key).Val(); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("TTL of %q = %v, want expiration within a minute", key, ttl)
+	}
+
+	dup := h.NewTaskMessage("report:generate", nil)
+	dup.IdempotencyKey = msg.IdempotencyKey
+	res, ok, err := r.CachedResult(dup)
+	if err != nil || !ok || string(res) != "s3://reports/2021-06.pdf" {
+		t.Errorf("CachedResult = (%q, %t, %v), want (%q, true, nil)", res, ok, err, "s3://reports/2021-06.pdf")
+	}
+	other := h.NewTaskMessage("report:generate", nil)
+	other.IdempotencyKey = "report:2021-07"
+	if _, ok, err := r.CachedResult(other); err != nil || ok {
+		t.Errorf("CachedResult with another idempotency key = (%t, %v), want (false, nil)", ok, err)
+	}
+}
+
+func TestWriteCheckpoint(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+
+	tests := []struct {
+		qnames []string // queues to dequeue from; dequeueing from multiple queues uses a different script.
+	}{
+		{qnames: []string{"default"}},
+		{qnames: []string{"critical", "default"}},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client)
+		msg := h.NewTaskMessage("import", nil)
+		h.SeedPendingQueue(t, r.client, []*base.TaskMessage{msg}, "default")
+
+		if err := r.WriteCheckpoint("default", msg.ID, []byte("offset=1")); !errors.IsTaskNotFound(err) {
+			t.Errorf("WriteCheckpoint for pending task returned %v, want TaskNotFoundError", err)
+		}
+
+		got, _, err := r.Dequeue(tc.qnames...)
+		if err != nil {
+			t.Fatalf("Dequeue(%v) returned error: %v", tc.qnames, err)
+		}
+		if got.Checkpoint != nil {
+			t.Errorf("Dequeue(%v) returned message with checkpoint %q, want nil", tc.qnames, got.Checkpoint)
+		}
+		if err := r.WriteCheckpoint("default", msg.ID, []byte("offset=42")); err != nil {
+			t.Fatalf("WriteCheckpoint returned error: %v", err)
+		}
+		if err := r.Requeue(got); err != nil {
+			t.Fatalf("Requeue returned error: %v", err)
+		}
+
+		got, _, err = r.Dequeue(tc.qnames...)
+		if err != nil {
+			t.Fatalf("Dequeue(%v) returned error: %v", tc.qnames, err)
+		}
+		if string(got.Checkpoint) != "offset=42" {
+			t.Errorf("Dequeue(%v) returned message with checkpoint %q, want %q", tc.qnames, got.Checkpoint, "offset=42")
+		}
+	}
+}
+
+func TestClaimEnvironment(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	h.FlushDB(t, r.client)
+
+	if got, err := r.ClaimEnvironment("staging"); err != nil || got != "staging" {
+		t.Fatalf("ClaimEnvironment(%q) = (%q, %v), want (%q, nil)", "staging", got, err, "staging")
+	}
+	// The database keeps the environment it was first labeled with.
+	if got, err := r.ClaimEnvironment("production"); err != nil || got != "staging" {
+		t.Errorf("ClaimEnvironment(%q) = (%q, %v), want (%q, nil)", "production", got, err, "staging")
+	}
+	h.SeedPendingQueue(t, r.client, []*base.TaskMessage{h.NewTaskMessage("send_email", nil)}, "default")
+	stats, err := r.CurrentStats("default")
+	if err != nil {
+		t.Fatalf("CurrentStats returned error: %v", err)
+	}
+	if stats.Environment != "staging" {
+		t.Errorf("CurrentStats returned Environment %q, want %q", stats.Environment, "staging")
+	}
+}
+
+func TestPromote(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	h.FlushDB(t, r.client)
+	now := time.Now().Truncate(time.Second)
+	clock := timeutil.NewSimulatedClock(now)
+	r.SetClock(clock)
+
+	if got, err := r.PromotedAt(context.Background()); err != nil || !got.IsZero() {
+		t.Fatalf("PromotedAt() = (%v, %v), want (zero time, nil)", got, err)
+	}
+	if got, err := r.Promote(); err != nil || !got.Equal(now) {
+		t.Fatalf("Promote() = (%v, %v), want (%v, nil)", got, err, now)
+	}
+	// The database keeps the time it was first promoted at.
+	clock.AdvanceTime(time.Hour)
+	if got, err := r.Promote(); err != nil || !got.Equal(now) {
+		t.Errorf("Promote() = (%v, %v), want (%v, nil)", got, err, now)
+	}
+	if got, err := r.PromotedAt(context.Background()); err != nil || !got.Equal(now) {
+		t.Errorf("PromotedAt() = (%v, %v), want (%v, nil)", got, err, now)
+	}
+}
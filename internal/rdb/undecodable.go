@@ -0,0 +1,124 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package rdb
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/errors"
+)
+
+// undecodableError is returned by parseDequeueResult if the message of the
+// dequeued task cannot be decoded.
+type undecodableError struct {
+	id string // ID of the task
+	// index is the 1-based index of the queue of the task in the queues passed
+	// to dequeueCmd.
+	index int
+	err   error
+}
+
+func (e *undecodableError) Error() string {
+	return fmt.Sprintf("cannot decode message of task id=%s: %v", e.id, e.err)
+}
+
+func (e *undecodableError) Unwrap() error { return e.err }
+
+// SetDropUndecodable sets whether the dequeued tasks whose message cannot be
+// decoded are deleted, and counted in the stats of their queue, instead of
+// being quarantined with their data kept for repair (see ListQuarantined).
+func (r *RDB) SetDropUndecodable(enabled bool) {
+	r.dropUndecodable = enabled
+}
+
+// SetReadOnly sets whether reading tasks leaves redis unchanged: the tasks
+// whose message cannot be decoded are then omitted by the list operations
+// instead of being quarantined.
+func (r *RDB) SetReadOnly(enabled bool) {
+	r.readOnly = enabled
+}
+
+// removeUndecodable removes the task from the active tasks of its queue if err
+// reports that its message cannot be decoded, so that it's neither processed
+// nor recovered once its lease expires, and reports whether it did.
+//
+// qnames are the queues passed to the dequeue script which returned err.
+func (r *RDB) removeUndecodable(qnames []string, err error) (bool, error) {
+	var uerr *undecodableError
+	if !errors.As(err, &uerr) {
+		return false, nil
+	}
+	qname := qnames[uerr.index-1]
+	if err := r.removeUndecodableTasks(qname, base.ActiveKey(qname), []string{uerr.id}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// removeUndecodableTasks removes the tasks with the given ids from the given
+// list or zset of the queue, either to the quarantine of the queue or deleting
+// them if SetDropUndecodable is enabled.
+//
+// If it fails, the tasks stay where they are and the error is returned.
+func (r *RDB) removeUndecodableTasks(qname, key string, ids []string) error {
+	if !r.dropUndecodable {
+		return r.quarantine(qname, key, ids)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	argv := []interface{}{base.TaskKeyPrefix(qname), base.QueueKeyPrefix(qname), r.clock.Now().UnixNano()}
+	for _, id := range ids {
+		argv = append(argv, id)
+	}
+	keys := []string{key, base.DeadlinesKey(qname), base.DroppedTotalKey(qname), base.PendingKey(qname)}
+	if err := dropCmd.Run(context.Background(), r.client, keys, argv...).Err(); err != nil {
+		return errors.E(errors.Unknown, fmt.Sprintf("cannot drop %d undecodable tasks: %v", len(ids), err))
+	}
+	return nil
+}
+
+// dropCmd deletes tasks whose data could not be decoded from the given list
+// or zset, and counts them.
+//
+// Input:
+// KEYS[1] -> list or zset holding the task ids (e.g. asynq:{<qname>}:active)
+// KEYS[2] -> asynq:{<qname>}:deadlines
+// KEYS[3] -> asynq:{<qname>}:dropped_total
+// KEYS[4] -> asynq:{<qname>}:pending
+// --
+// ARGV[1] -> task key prefix
+// ARGV[2] -> queue key prefix
+// ARGV[3] -> current unix time in nsec
+// ARGV[4:] -> task IDs
+//
+// Output:
+// Returns the number of tasks deleted.
+//
+// Note: The next tasks of the groups of the deleted tasks, and the tasks waiting
+// only for them, are moved to pending.
+var dropCmd = newScript("drop", advanceGroupLua+dependentsLua+`
+local is_list = redis.call("TYPE", KEYS[1])["ok"] == "list"
+local n = 0
+for i = 4, table.getn(ARGV) do
+	local id = ARGV[i]
+	local removed
+	if is_list then
+		removed = redis.call("LREM", KEYS[1], 0, id)
+	else
+		removed = redis.call("ZREM", KEYS[1], id)
+	end
+	if removed > 0 then
+		redis.call("ZREM", KEYS[2], id)
+		advance_group(ARGV[1] .. id, id, KEYS[4])
+		resolve_dependents(ARGV[2], id, ARGV[3])
+		redis.call("DEL", ARGV[1] .. id)
+		redis.call("INCR", KEYS[3])
+		n = n + 1
+	end
+end
+return n`)
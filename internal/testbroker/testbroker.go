@@ -73,6 +73,60 @@ func (tb *TestBroker) Dequeue(qnames ...string) (*base.TaskMessage, time.Time, e
 	return tb.real.Dequeue(qnames...)
 }
 
+func (tb *TestBroker) DequeueSkipping(skipClasses []string, qnames ...string) (*base.TaskMessage, time.Time, error) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.sleeping {
+		return nil, time.Time{}, errRedisDown
+	}
+	return tb.real.DequeueSkipping(skipClasses, qnames...)
+}
+
+func (tb *TestBroker) DequeueMatching(labels, skipClasses []string, qnames ...string) (*base.TaskMessage, time.Time, error) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.sleeping {
+		return nil, time.Time{}, errRedisDown
+	}
+	return tb.real.DequeueMatching(labels, skipClasses, qnames...)
+}
+
+func (tb *TestBroker) ClaimEnvironment(env string) (string, error) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.sleeping {
+		return "", errRedisDown
+	}
+	return tb.real.ClaimEnvironment(env)
+}
+
+func (tb *TestBroker) CacheResult(msg *base.TaskMessage, ttl time.Duration) error {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.sleeping {
+		return errRedisDown
+	}
+	return tb.real.CacheResult(msg, ttl)
+}
+
+func (tb *TestBroker) CachedResult(msg *base.TaskMessage) ([]byte, bool, error) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.sleeping {
+		return nil, false, errRedisDown
+	}
+	return tb.real.CachedResult(msg)
+}
+
+func (tb *TestBroker) PauseFor(qname string, d time.Duration, reason string) (bool, error) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.sleeping {
+		return false, errRedisDown
+	}
+	return tb.real.PauseFor(qname, d, reason)
+}
+
 func (tb *TestBroker) Done(msg *base.TaskMessage) error {
 	tb.mu.Lock()
 	defer tb.mu.Unlock()
@@ -127,13 +181,40 @@ func (tb *TestBroker) Retry(msg *base.TaskMessage, processAt time.Time, errMsg s
 	return tb.real.Retry(msg, processAt, errMsg, isFailure)
 }
 
-func (tb *TestBroker) Archive(msg *base.TaskMessage, errMsg string) error {
+func (tb *TestBroker) Archive(msg *base.TaskMessage, errMsg, reason string) error {
 	tb.mu.Lock()
 	defer tb.mu.Unlock()
 	if tb.sleeping {
 		return errRedisDown
 	}
-	return tb.real.Archive(msg, errMsg)
+	return tb.real.Archive(msg, errMsg, reason)
+}
+
+func (tb *TestBroker) Park(msg *base.TaskMessage, errMsg string) error {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.sleeping {
+		return errRedisDown
+	}
+	return tb.real.Park(msg, errMsg)
+}
+
+func (tb *TestBroker) Quarantine(msg *base.TaskMessage, errMsg string) error {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.sleeping {
+		return errRedisDown
+	}
+	return tb.real.Quarantine(msg, errMsg)
+}
+
+func (tb *TestBroker) RecordUnhandled(qname string) error {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.sleeping {
+		return errRedisDown
+	}
+	return tb.real.RecordUnhandled(qname)
 }
 
 func (tb *TestBroker) ForwardIfReady(qnames ...string) error {
@@ -154,6 +235,24 @@ func (tb *TestBroker) DeleteExpiredCompletedTasks(qname string) error {
 	return tb.real.DeleteExpiredCompletedTasks(qname)
 }
 
+func (tb *TestBroker) ArchiveStaleTasks(qname string, cutoff time.Time) (int64, error) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.sleeping {
+		return 0, errRedisDown
+	}
+	return tb.real.ArchiveStaleTasks(qname, cutoff)
+}
+
+func (tb *TestBroker) RecordQueueSizes(qname string, interval time.Duration) error {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.sleeping {
+		return errRedisDown
+	}
+	return tb.real.RecordQueueSizes(qname, interval)
+}
+
 func (tb *TestBroker) ListDeadlineExceeded(deadline time.Time, qnames ...string) ([]*base.TaskMessage, error) {
 	tb.mu.Lock()
 	defer tb.mu.Unlock()
@@ -163,6 +262,42 @@ func (tb *TestBroker) ListDeadlineExceeded(deadline time.Time, qnames ...string)
 	return tb.real.ListDeadlineExceeded(deadline, qnames...)
 }
 
+func (tb *TestBroker) ClaimExpiryDigest(qname string, within, period, claim time.Duration) (*base.ExpiringArchived, error) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.sleeping {
+		return nil, errRedisDown
+	}
+	return tb.real.ClaimExpiryDigest(qname, within, period, claim)
+}
+
+func (tb *TestBroker) FinishExpiryDigest(qname string, period time.Duration, notified bool) error {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.sleeping {
+		return errRedisDown
+	}
+	return tb.real.FinishExpiryDigest(qname, period, notified)
+}
+
+func (tb *TestBroker) RecordTaskSample(qname string, s *base.TaskSample) error {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.sleeping {
+		return errRedisDown
+	}
+	return tb.real.RecordTaskSample(qname, s)
+}
+
+func (tb *TestBroker) RecordLatency(qname string, l *base.TaskLatency) error {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.sleeping {
+		return errRedisDown
+	}
+	return tb.real.RecordLatency(qname, l)
+}
+
 func (tb *TestBroker) WriteServerState(info *base.ServerInfo, workers []*base.WorkerInfo, ttl time.Duration) error {
 	tb.mu.Lock()
 	defer tb.mu.Unlock()
@@ -172,6 +307,15 @@ func (tb *TestBroker) WriteServerState(info *base.ServerInfo, workers []*base.Wo
 	return tb.real.WriteServerState(info, workers, ttl)
 }
 
+func (tb *TestBroker) CheckCompatibility(info *base.ServerInfo) ([]string, error) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.sleeping {
+		return nil, errRedisDown
+	}
+	return tb.real.CheckCompatibility(info)
+}
+
 func (tb *TestBroker) ClearServerState(host string, pid int, serverID string) error {
 	tb.mu.Lock()
 	defer tb.mu.Unlock()
@@ -199,6 +343,60 @@ func (tb *TestBroker) PublishCancelation(id string) error {
 	return tb.real.PublishCancelation(id)
 }
 
+func (tb *TestBroker) WakeupPubSub(qnames ...string) (*redis.PubSub, error) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.sleeping {
+		return nil, errRedisDown
+	}
+	return tb.real.WakeupPubSub(qnames...)
+}
+
+func (tb *TestBroker) ConcurrencyPubSub(serverID string) (*redis.PubSub, error) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.sleeping {
+		return nil, errRedisDown
+	}
+	return tb.real.ConcurrencyPubSub(serverID)
+}
+
+func (tb *TestBroker) PublishConcurrency(serverID string, n int) error {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.sleeping {
+		return errRedisDown
+	}
+	return tb.real.PublishConcurrency(serverID, n)
+}
+
+func (tb *TestBroker) QuietPubSub(serverID string) (*redis.PubSub, error) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.sleeping {
+		return nil, errRedisDown
+	}
+	return tb.real.QuietPubSub(serverID)
+}
+
+func (tb *TestBroker) PublishQuiet(serverID string) error {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.sleeping {
+		return errRedisDown
+	}
+	return tb.real.PublishQuiet(serverID)
+}
+
+func (tb *TestBroker) ClearStarted(msg *base.TaskMessage) error {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.sleeping {
+		return errRedisDown
+	}
+	return tb.real.ClearStarted(msg)
+}
+
 func (tb *TestBroker) WriteResult(qname, id string, data []byte) (int, error) {
 	tb.mu.Lock()
 	defer tb.mu.Unlock()
@@ -208,6 +406,24 @@ func (tb *TestBroker) WriteResult(qname, id string, data []byte) (int, error) {
 	return tb.real.WriteResult(qname, id, data)
 }
 
+func (tb *TestBroker) WriteCheckpoint(qname, id string, data []byte) error {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.sleeping {
+		return errRedisDown
+	}
+	return tb.real.WriteCheckpoint(qname, id, data)
+}
+
+func (tb *TestBroker) WriteProgress(qname, id string, data []byte) error {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.sleeping {
+		return errRedisDown
+	}
+	return tb.real.WriteProgress(qname, id, data)
+}
+
 func (tb *TestBroker) Ping() error {
 	tb.mu.Lock()
 	defer tb.mu.Unlock()
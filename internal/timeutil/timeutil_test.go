@@ -0,0 +1,26 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package timeutil
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSimulatedClock(t *testing.T) {
+	now := time.Now()
+	c := NewSimulatedClock(now)
+	if got := c.Now(); !got.Equal(now) {
+		t.Errorf("Now() = %v, want %v", got, now)
+	}
+	c.AdvanceTime(time.Minute)
+	if got, want := c.Now(), now.Add(time.Minute); !got.Equal(want) {
+		t.Errorf("Now() after AdvanceTime(1m) = %v, want %v", got, want)
+	}
+	c.SetTime(now)
+	if got := c.Now(); !got.Equal(now) {
+		t.Errorf("Now() after SetTime = %v, want %v", got, now)
+	}
+}
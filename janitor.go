@@ -10,11 +10,12 @@ import (
 
 	"github.com/hibiken/asynq/internal/base"
 	"github.com/hibiken/asynq/internal/log"
+	"github.com/hibiken/asynq/internal/timeutil"
 )
 
 // A janitor is responsible for deleting expired completed tasks from the specified
 // queues. It periodically checks for any expired tasks in the completed set, and
-// deletes them.
+// deletes them. It also archives the stale scheduled and retry tasks, if enabled.
 type janitor struct {
 	logger *log.Logger
 	broker base.Broker
@@ -27,6 +28,12 @@ type janitor struct {
 
 	// average interval between checks.
 	avgInterval time.Duration
+
+	// age after which scheduled and retry tasks are stale; zero if stale tasks are not archived.
+	staleAge time.Duration
+
+	// clock is used to compute the cutoff of stale tasks.
+	clock timeutil.Clock
 }
 
 type janitorParams struct {
@@ -34,6 +41,7 @@ type janitorParams struct {
 	broker   base.Broker
 	queues   []string
 	interval time.Duration
+	staleAge time.Duration
 }
 
 func newJanitor(params janitorParams) *janitor {
@@ -43,6 +51,8 @@ func newJanitor(params janitorParams) *janitor {
 		done:        make(chan struct{}),
 		queues:      params.queues,
 		avgInterval: params.interval,
+		staleAge:    params.staleAge,
+		clock:       timeutil.NewRealClock(),
 	}
 }
 
@@ -77,5 +87,13 @@ func (j *janitor) exec() {
 			j.logger.Errorf("Could not delete expired completed tasks from queue %q: %v",
 				qname, err)
 		}
+		if j.staleAge > 0 {
+			n, err := j.broker.ArchiveStaleTasks(qname, j.clock.Now().Add(-j.staleAge))
+			if err != nil {
+				j.logger.Errorf("Could not archive stale tasks of queue %q: %v", qname, err)
+			} else if n > 0 {
+				j.logger.Warnf("Archived %d stale tasks of queue %q", n, qname)
+			}
+		}
 	}
 }
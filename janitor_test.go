@@ -87,3 +87,37 @@ func TestJanitor(t *testing.T) {
 		}
 	}
 }
+
+func TestJanitorArchivesStaleTasks(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	const interval = 1 * time.Second
+	janitor := newJanitor(janitorParams{
+		logger:   testLogger,
+		broker:   rdb.NewRDB(r),
+		queues:   []string{"default"},
+		interval: interval,
+		staleAge: 24 * time.Hour,
+	})
+
+	now := time.Now()
+	stale := h.NewTaskMessage("stuck", nil)
+	fresh := h.NewTaskMessage("soon", nil)
+	h.SeedScheduledQueue(t, r, []base.Z{
+		{Message: stale, Score: now.AddDate(0, 0, -30).Unix()},
+		{Message: fresh, Score: now.Add(time.Hour).Unix()},
+	}, "default")
+
+	var wg sync.WaitGroup
+	janitor.start(&wg)
+	time.Sleep(2 * interval) // make sure to let janitor run at least one time
+	janitor.shutdown()
+
+	archived := h.GetArchivedMessages(t, r, "default")
+	if len(archived) != 1 || archived[0].ID != stale.ID || archived[0].ArchiveReason != base.ArchiveReasonStale {
+		t.Errorf("archived messages are %v, want %q archived as stale", archived, stale.ID)
+	}
+	if got := h.GetScheduledMessages(t, r, "default"); len(got) != 1 || got[0].ID != fresh.ID {
+		t.Errorf("scheduled messages are %v, want only %q", got, fresh.ID)
+	}
+}
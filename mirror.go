@@ -0,0 +1,292 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/errors"
+	"github.com/hibiken/asynq/internal/log"
+	"github.com/hibiken/asynq/internal/rdb"
+)
+
+// MirrorStats describes the mirroring of the tasks written by a Client.
+// See ClientConfig.Mirror.
+type MirrorStats struct {
+	// Pending is the number of tasks waiting to be written to the mirror.
+	Pending int
+
+	// Mirrored is the number of tasks written to the mirror.
+	Mirrored int64
+
+	// Failed is the number of tasks which could not be written to the mirror.
+	Failed int64
+
+	// Dropped is the number of tasks not written to the mirror because
+	// the buffer of pending tasks was full, or the client was closed first.
+	Dropped int64
+
+	// Trimmed is the number of tasks deleted from the mirror because they were
+	// older than ClientConfig.MirrorRetention.
+	Trimmed int64
+
+	// Lag is the time since the oldest pending task was written to the primary
+	// redis database, or zero if no task is pending.
+	Lag time.Duration
+}
+
+const (
+	// defaultMirrorBufferSize is the number of tasks waiting to be mirrored
+	// above which tasks are dropped if ClientConfig.MirrorBufferSize is unset.
+	defaultMirrorBufferSize = 10000
+
+	// mirrorWriteTimeout bounds the write of a task to the mirror.
+	mirrorWriteTimeout = 5 * time.Second
+
+	// mirrorCloseTimeout bounds the time Close waits for the pending tasks
+	// to be written to the mirror.
+	mirrorCloseTimeout = 5 * time.Second
+
+	// mirrorCheckTimeout bounds the check whether the mirror was promoted.
+	mirrorCheckTimeout = 5 * time.Second
+
+	// defaultMirrorRetention is how long the mirrored tasks are kept in the mirror
+	// if ClientConfig.MirrorRetention is unset.
+	defaultMirrorRetention = 24 * time.Hour
+
+	// mirrorTrimInterval is the interval between the deletions of the tasks older
+	// than the retention from the mirror.
+	mirrorTrimInterval = 10 * time.Minute
+)
+
+// mirrorWrite is a task written to the primary database, to be written to the mirror.
+type mirrorWrite struct {
+	msg *base.TaskMessage
+
+	// processAt is the time the task is scheduled to be processed at,
+	// or the zero time if the task was enqueued.
+	processAt time.Time
+
+	uniqueTTL time.Duration
+
+	// writtenAt is the time the task was written to the primary database.
+	writtenAt time.Time
+}
+
+// mirror writes tasks to the mirror database in the background, in the order
+// they were written to the primary database.
+//
+// Only the writes of tasks are mirrored: tasks processed or deleted on the primary
+// database stay in the mirror. To bound the mirror, the pending tasks enqueued and
+// the scheduled tasks to be processed longer ago than the retention are deleted
+// from the queues the mirror wrote to, assuming they were processed meanwhile.
+type mirror struct {
+	rdb       *rdb.RDB
+	bufSize   int
+	retention time.Duration
+
+	// queues written to; only accessed by the run goroutine.
+	queues map[string]bool
+
+	mu      sync.Mutex
+	pending []*mirrorWrite
+	stats   MirrorStats
+
+	// signal is notified when a write is added to pending.
+	signal chan struct{}
+
+	// done is closed to stop accepting writes and to drain the pending writes.
+	done chan struct{}
+
+	// stopped is closed once the pending writes are drained.
+	stopped chan struct{}
+}
+
+func newMirror(r RedisConnOpt, bufSize int, retention time.Duration) *mirror {
+	c, ok := r.MakeRedisClient().(redis.UniversalClient)
+	if !ok {
+		panic(fmt.Sprintf("asynq: unsupported RedisConnOpt type %T", r))
+	}
+	if bufSize <= 0 {
+		bufSize = defaultMirrorBufferSize
+	}
+	if retention <= 0 {
+		retention = defaultMirrorRetention
+	}
+	m := &mirror{
+		rdb:       rdb.NewRDB(c),
+		bufSize:   bufSize,
+		retention: retention,
+		queues:    make(map[string]bool),
+		signal:    make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	go m.run()
+	return m
+}
+
+// add queues the write to the mirror, or drops it if the buffer is full.
+func (m *mirror) add(w *mirrorWrite) {
+	m.mu.Lock()
+	select {
+	case <-m.done:
+		m.stats.Dropped++
+		m.mu.Unlock()
+		return
+	default:
+	}
+	if len(m.pending) >= m.bufSize {
+		m.stats.Dropped++
+		m.mu.Unlock()
+		return
+	}
+	m.pending = append(m.pending, w)
+	m.mu.Unlock()
+	select {
+	case m.signal <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the oldest pending write, or nil if none is pending.
+func (m *mirror) next() *mirrorWrite {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.pending) == 0 {
+		return nil
+	}
+	w := m.pending[0]
+	m.pending[0] = nil
+	m.pending = m.pending[1:]
+	return w
+}
+
+func (m *mirror) run() {
+	defer close(m.stopped)
+	trim := time.NewTicker(mirrorTrimInterval)
+	defer trim.Stop()
+	var deadline <-chan time.Time
+	for {
+		for w := m.next(); w != nil; w = m.next() {
+			select {
+			case <-deadline:
+				m.mu.Lock()
+				m.stats.Dropped += int64(len(m.pending)) + 1
+				m.pending = nil
+				m.mu.Unlock()
+				return
+			default:
+			}
+			err := m.write(w)
+			m.mu.Lock()
+			if err != nil {
+				m.stats.Failed++
+			} else {
+				m.stats.Mirrored++
+			}
+			m.mu.Unlock()
+		}
+		if deadline != nil {
+			return
+		}
+		select {
+		case <-m.signal:
+		case <-trim.C:
+			m.trim()
+		case <-m.done:
+			deadline = time.After(mirrorCloseTimeout)
+		}
+	}
+}
+
+// trim deletes the tasks older than the retention from the queues written to.
+// Errors are ignored: the tasks are deleted by the next trim.
+func (m *mirror) trim() {
+	cutoff := time.Now().Add(-m.retention)
+	var n int64
+	for qname := range m.queues {
+		pending, _ := m.rdb.UpdateTasks(qname, base.TaskStatePending, rdb.TaskActionDelete, rdb.TaskFilter{EnqueuedBefore: cutoff})
+		scheduled, _ := m.rdb.UpdateTasks(qname, base.TaskStateScheduled, rdb.TaskActionDelete, rdb.TaskFilter{ScoredBefore: cutoff})
+		n += pending + scheduled
+	}
+	m.mu.Lock()
+	m.stats.Trimmed += n
+	m.mu.Unlock()
+}
+
+// write writes the task to the mirror. A task already in the mirror
+// (e.g. written by a previous attempt) is not an error.
+func (m *mirror) write(w *mirrorWrite) error {
+	m.queues[w.msg.Queue] = true
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorWriteTimeout)
+	defer cancel()
+	var err error
+	switch {
+	case w.processAt.IsZero() && w.uniqueTTL > 0:
+		err = m.rdb.EnqueueUnique(ctx, w.msg, w.uniqueTTL)
+	case w.processAt.IsZero():
+		err = m.rdb.Enqueue(ctx, w.msg)
+	case w.uniqueTTL > 0:
+		err = m.rdb.ScheduleUnique(ctx, w.msg, w.processAt, w.processAt.Add(w.uniqueTTL).Sub(time.Now()))
+	default:
+		err = m.rdb.Schedule(ctx, w.msg, w.processAt)
+	}
+	if errors.Is(err, errors.ErrTaskIdConflict) || errors.Is(err, errors.ErrDuplicateTask) {
+		return nil
+	}
+	return err
+}
+
+func (m *mirror) getStats() MirrorStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := m.stats
+	stats.Pending = len(m.pending)
+	if len(m.pending) > 0 {
+		stats.Lag = time.Since(m.pending[0].writtenAt)
+	}
+	return stats
+}
+
+// close stops accepting writes and waits for the pending writes to be written
+// to the mirror, up to mirrorCloseTimeout, before closing the connection.
+func (m *mirror) close() error {
+	m.mu.Lock()
+	close(m.done)
+	m.mu.Unlock()
+	<-m.stopped
+	return m.rdb.Close()
+}
+
+// switchToPromotedMirror switches r to the mirror if the mirror has been promoted,
+// and reports whether it did. It keeps r on the primary database if the mirror
+// cannot be reached within mirrorCheckTimeout.
+func switchToPromotedMirror(r *rdb.RDB, opt RedisConnOpt, logger *log.Logger) bool {
+	c, ok := opt.MakeRedisClient().(redis.UniversalClient)
+	if !ok {
+		panic(fmt.Sprintf("asynq: unsupported RedisConnOpt type %T", opt))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorCheckTimeout)
+	defer cancel()
+	promotedAt, err := rdb.NewRDB(c).PromotedAt(ctx)
+	if err != nil {
+		logger.Warnf("Could not check whether the mirror was promoted, processing tasks of the primary database: %v", err)
+		c.Close()
+		return false
+	}
+	if promotedAt.IsZero() {
+		c.Close()
+		return false
+	}
+	logger.Warnf("Mirror was promoted at %v, processing tasks of the mirror", promotedAt.Format(time.RFC3339))
+	r.SetClient(c)
+	return true
+}
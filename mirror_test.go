@@ -0,0 +1,179 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// setupMirror returns a connection to the database used as the mirror in tests,
+// and its connection option.
+func setupMirror(t *testing.T) (redis.UniversalClient, RedisConnOpt) {
+	t.Helper()
+	if useRedisCluster {
+		t.Skip("mirror tests use a second database, which redis cluster does not support")
+	}
+	opt := RedisClientOpt{Addr: redisAddr, DB: redisDB + 1}
+	r := redis.NewClient(&redis.Options{Addr: opt.Addr, DB: opt.DB})
+	h.FlushDB(t, r)
+	return r, opt
+}
+
+func TestClientMirror(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	mr, mirrorOpt := setupMirror(t)
+	defer mr.Close()
+
+	client := NewClientWithConfig(getRedisConnOpt(t), ClientConfig{Mirror: mirrorOpt})
+	pending, err := client.Enqueue(NewTask("send_email", []byte("to=alice")))
+	if err != nil {
+		t.Fatalf("Enqueue returned error: %v", err)
+	}
+	scheduled, err := client.Enqueue(NewTask("send_email", []byte("to=bob")), ProcessIn(time.Hour), Unique(time.Hour))
+	if err != nil {
+		t.Fatalf("Enqueue returned error: %v", err)
+	}
+	// Close waits for the pending tasks to be mirrored.
+	if err := client.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	if got := client.MirrorStats(); got.Mirrored != 2 || got.Failed != 0 || got.Dropped != 0 || got.Pending != 0 || got.Lag != 0 {
+		t.Errorf("MirrorStats() = %+v, want 2 tasks mirrored", got)
+	}
+	if diff := cmp.Diff(h.GetPendingMessages(t, r, base.DefaultQueueName), h.GetPendingMessages(t, mr, base.DefaultQueueName)); diff != "" {
+		t.Errorf("mirrored pending messages mismatch (-primary,+mirror):\n%s", diff)
+	}
+	if diff := cmp.Diff(h.GetScheduledEntries(t, r, base.DefaultQueueName), h.GetScheduledEntries(t, mr, base.DefaultQueueName)); diff != "" {
+		t.Errorf("mirrored scheduled entries mismatch (-primary,+mirror):\n%s", diff)
+	}
+	msgs := h.GetPendingMessages(t, mr, base.DefaultQueueName)
+	entries := h.GetScheduledEntries(t, mr, base.DefaultQueueName)
+	if len(msgs) != 1 || msgs[0].ID != pending.ID || len(entries) != 1 || entries[0].Message.ID != scheduled.ID {
+		t.Fatalf("mirror has pending %v and scheduled %v, want task %s pending and task %s scheduled",
+			msgs, entries, pending.ID, scheduled.ID)
+	}
+	// The uniqueness lock is mirrored with the task.
+	if ok, _ := mr.Exists(context.Background(), entries[0].Message.UniqueKey).Result(); ok != 1 {
+		t.Errorf("mirror has no uniqueness lock %q", entries[0].Message.UniqueKey)
+	}
+}
+
+func TestClientWithoutMirror(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	client := NewClient(getRedisConnOpt(t))
+	defer client.Close()
+	if _, err := client.Enqueue(NewTask("send_email", nil)); err != nil {
+		t.Fatalf("Enqueue returned error: %v", err)
+	}
+	if got := client.MirrorStats(); got != (MirrorStats{}) {
+		t.Errorf("MirrorStats() = %+v, want zero stats", got)
+	}
+}
+
+func TestServerProcessesPromotedMirror(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	mr, mirrorOpt := setupMirror(t)
+	defer mr.Close()
+	primaryMsg := h.NewTaskMessage("send_email", nil)
+	mirrorMsg := h.NewTaskMessage("send_email", nil)
+	h.SeedPendingQueue(t, r, []*base.TaskMessage{primaryMsg}, base.DefaultQueueName)
+	h.SeedPendingQueue(t, mr, []*base.TaskMessage{mirrorMsg}, base.DefaultQueueName)
+
+	inspector := NewInspector(mirrorOpt)
+	defer inspector.Close()
+	if got, err := inspector.PromotedAt(); err != nil || !got.IsZero() {
+		t.Fatalf("PromotedAt() = (%v, %v), want (zero time, nil)", got, err)
+	}
+	promotedAt, err := inspector.PromoteMirror()
+	if err != nil {
+		t.Fatalf("PromoteMirror returned error: %v", err)
+	}
+	if got, err := inspector.PromotedAt(); err != nil || !got.Equal(promotedAt) {
+		t.Errorf("PromotedAt() = (%v, %v), want (%v, nil)", got, err, promotedAt)
+	}
+
+	processed := make(chan string, 2)
+	srv := NewServer(getRedisConnOpt(t), Config{LogLevel: testLogLevel, Mirror: mirrorOpt})
+	if err := srv.Start(HandlerFunc(func(ctx context.Context, task *Task) error {
+		processed <- task.ResultWriter().TaskID()
+		return nil
+	})); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	time.Sleep(time.Second)
+	srv.Shutdown()
+
+	select {
+	case id := <-processed:
+		if id != mirrorMsg.ID {
+			t.Errorf("processed task %s, want task %s of the mirror", id, mirrorMsg.ID)
+		}
+	default:
+		t.Fatalf("no task was processed, want task %s of the mirror", mirrorMsg.ID)
+	}
+	if msgs := h.GetPendingMessages(t, r, base.DefaultQueueName); len(msgs) != 1 || msgs[0].ID != primaryMsg.ID {
+		t.Errorf("primary has pending messages %v, want task %s left pending", msgs, primaryMsg.ID)
+	}
+}
+
+func TestMirrorTrim(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	mr, mirrorOpt := setupMirror(t)
+	defer mr.Close()
+	now := time.Now()
+	newMsg := func(enqueuedAt time.Time) *base.TaskMessage {
+		msg := h.NewTaskMessage("send_email", nil)
+		msg.EnqueuedAt = enqueuedAt.UnixNano()
+		return msg
+	}
+	oldPending, recentPending := newMsg(now.Add(-2*time.Hour)), newMsg(now)
+	pastScheduled, futureScheduled := newMsg(now.Add(-3*time.Hour)), newMsg(now.Add(-3*time.Hour))
+
+	m := newMirror(mirrorOpt, 0, time.Hour)
+	defer m.close()
+	for _, w := range []*mirrorWrite{
+		{msg: oldPending},
+		{msg: recentPending},
+		{msg: pastScheduled, processAt: now.Add(-2 * time.Hour)},
+		{msg: futureScheduled, processAt: now.Add(time.Hour)},
+	} {
+		if err := m.write(w); err != nil {
+			t.Fatalf("write returned error: %v", err)
+		}
+	}
+	m.trim()
+
+	if got := m.getStats().Trimmed; got != 2 {
+		t.Errorf("Trimmed = %d, want 2", got)
+	}
+	if msgs := h.GetPendingMessages(t, mr, base.DefaultQueueName); len(msgs) != 1 || msgs[0].ID != recentPending.ID {
+		t.Errorf("mirror has pending messages %v, want task %s", msgs, recentPending.ID)
+	}
+	if entries := h.GetScheduledEntries(t, mr, base.DefaultQueueName); len(entries) != 1 || entries[0].Message.ID != futureScheduled.ID {
+		t.Errorf("mirror has scheduled entries %v, want task %s", entries, futureScheduled.ID)
+	}
+}
+
+func TestNewServerDoesNotCheckMirror(t *testing.T) {
+	// The mirror is only checked for promotion once the server is started.
+	start := time.Now()
+	srv := NewServer(getRedisConnOpt(t), Config{LogLevel: testLogLevel, Mirror: RedisClientOpt{Addr: "localhost:1"}})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("NewServer took %v, want it not to wait for the mirror", elapsed)
+	}
+	srv.Shutdown()
+}
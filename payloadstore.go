@@ -0,0 +1,62 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// PayloadStore stores task payloads outside of redis.
+//
+// Set ClientConfig.PayloadStore to store the payloads larger than
+// ClientConfig.PayloadStoreThreshold in the store; redis then holds only the key
+// of the payload. Set Config.PayloadStore to the same store for the servers
+// processing the tasks to load the payloads before the handler is called.
+//
+// Implementations are typically backed by an object storage service (e.g. S3 or GCS)
+// and must be safe for concurrent use by multiple goroutines.
+type PayloadStore interface {
+	// Put stores the payload under the given key, overwriting any payload
+	// previously stored under the key.
+	Put(ctx context.Context, key string, payload []byte) error
+
+	// Get returns the payload stored under the given key.
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Delete deletes the payload stored under the given key.
+	// Deleting a key which does not exist is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// defaultPayloadStoreThreshold is the size in bytes above which payloads are
+// stored in the PayloadStore if ClientConfig.PayloadStoreThreshold is unset.
+const defaultPayloadStoreThreshold = 64 << 10
+
+// newPayloadKey returns a new key under which to store the payload of the task.
+// The key is unique to each enqueue so that enqueueing a task with the ID of an
+// existing task does not overwrite the payload of the existing task.
+func newPayloadKey(msg *base.TaskMessage) string {
+	return msg.Queue + "/" + msg.ID + "/" + uuid.NewString()
+}
+
+// loadPayload returns the payload of the task, loading it from the store
+// if the payload is stored externally.
+func loadPayload(ctx context.Context, store PayloadStore, msg *base.TaskMessage) ([]byte, error) {
+	if msg.PayloadRef == "" {
+		return msg.Payload, nil
+	}
+	if store == nil {
+		return nil, fmt.Errorf("asynq: payload of task id=%s is stored externally (key=%q) but no PayloadStore is configured", msg.ID, msg.PayloadRef)
+	}
+	payload, err := store.Get(ctx, msg.PayloadRef)
+	if err != nil {
+		return nil, fmt.Errorf("asynq: could not load payload of task id=%s (key=%q): %v", msg.ID, msg.PayloadRef, err)
+	}
+	return payload, nil
+}
@@ -0,0 +1,247 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/rdb"
+)
+
+// memPayloadStore is an in-memory PayloadStore for testing.
+type memPayloadStore struct {
+	mu       sync.Mutex
+	payloads map[string][]byte
+	putErr   error
+}
+
+func newMemPayloadStore() *memPayloadStore {
+	return &memPayloadStore{payloads: make(map[string][]byte)}
+}
+
+func (s *memPayloadStore) Put(ctx context.Context, key string, payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.putErr != nil {
+		return s.putErr
+	}
+	s.payloads[key] = append([]byte(nil), payload...)
+	return nil
+}
+
+func (s *memPayloadStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	payload, ok := s.payloads[key]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return payload, nil
+}
+
+func (s *memPayloadStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.payloads, key)
+	return nil
+}
+
+func (s *memPayloadStore) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.payloads)
+}
+
+func TestClientEnqueueWithPayloadStore(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	store := newMemPayloadStore()
+	client := NewClientWithConfig(getRedisConnOpt(t), ClientConfig{
+		PayloadStore:          store,
+		PayloadStoreThreshold: 8,
+	})
+	defer client.Close()
+
+	large := []byte("this payload is stored externally")
+	info, err := client.Enqueue(NewTask("media:encode", large))
+	if err != nil {
+		t.Fatalf("Enqueue returned error: %v", err)
+	}
+	if !strings.HasPrefix(info.PayloadRef, "default/"+info.ID+"/") || len(info.Payload) != 0 {
+		t.Errorf("Enqueue returned PayloadRef=%q Payload=%q, want a key prefixed with %q and empty payload",
+			info.PayloadRef, info.Payload, "default/"+info.ID+"/")
+	}
+	if _, err := client.Enqueue(NewTask("media:encode", []byte("small"))); err != nil {
+		t.Fatalf("Enqueue returned error: %v", err)
+	}
+
+	msgs := h.GetPendingMessages(t, r, base.DefaultQueueName)
+	if len(msgs) != 2 {
+		t.Fatalf("got %d pending messages, want 2", len(msgs))
+	}
+	// Pending messages are listed newest first.
+	if msgs[1].PayloadRef != info.PayloadRef || len(msgs[1].Payload) != 0 {
+		t.Errorf("pending message has PayloadRef=%q Payload=%q, want PayloadRef=%q and empty payload",
+			msgs[1].PayloadRef, msgs[1].Payload, info.PayloadRef)
+	}
+	if msgs[0].PayloadRef != "" || string(msgs[0].Payload) != "small" {
+		t.Errorf("pending message has PayloadRef=%q Payload=%q, want payload %q stored in redis",
+			msgs[0].PayloadRef, msgs[0].Payload, "small")
+	}
+	got, err := store.Get(context.Background(), info.PayloadRef)
+	if err != nil || string(got) != string(large) {
+		t.Errorf("store.Get(%q) = (%q, %v), want %q", info.PayloadRef, got, err, large)
+	}
+
+	// A task which is not written does not leave its payload behind.
+	if _, err := client.Enqueue(NewTask("media:encode", large), TaskID(info.ID)); !errors.Is(err, ErrTaskIDConflict) {
+		t.Fatalf("Enqueue with taken task ID returned %v, want ErrTaskIDConflict", err)
+	}
+	if n := store.len(); n != 1 {
+		t.Errorf("store has %d payloads, want 1", n)
+	}
+
+	store.putErr = errors.New("store unavailable")
+	if _, err := client.Enqueue(NewTask("media:encode", large)); err == nil {
+		t.Errorf("Enqueue with failing store returned nil error, want non-nil error")
+	}
+	if n := len(h.GetPendingMessages(t, r, base.DefaultQueueName)); n != 2 {
+		t.Errorf("got %d pending messages after failed enqueue, want 2", n)
+	}
+}
+
+func TestProcessorLoadsPayloadFromPayloadStore(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	store := newMemPayloadStore()
+	client := NewClientWithConfig(getRedisConnOpt(t), ClientConfig{
+		PayloadStore:          store,
+		PayloadStoreThreshold: 8,
+	})
+	defer client.Close()
+	payloads := []string{"this payload is stored externally", "small"}
+	for _, p := range payloads {
+		if _, err := client.Enqueue(NewTask("media:encode", []byte(p))); err != nil {
+			t.Fatalf("Enqueue returned error: %v", err)
+		}
+	}
+	retained, err := client.Enqueue(NewTask("media:encode", []byte("this payload is retained")), Retention(time.Hour))
+	if err != nil {
+		t.Fatalf("Enqueue returned error: %v", err)
+	}
+
+	var (
+		mu        sync.Mutex
+		processed []string
+	)
+	handler := func(ctx context.Context, task *Task) error {
+		mu.Lock()
+		defer mu.Unlock()
+		processed = append(processed, string(task.Payload()))
+		return nil
+	}
+	p := newProcessorForTest(t, rdb.NewRDB(r), HandlerFunc(handler))
+	p.payloadStore = store
+	p.start(&sync.WaitGroup{})
+	time.Sleep(2 * time.Second)
+	p.shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := append(payloads, "this payload is retained")
+	sort.Strings(want)
+	sort.Strings(processed)
+	if diff := cmp.Diff(want, processed); diff != "" {
+		t.Errorf("payloads processed mismatch (-want,+got):\n%s", diff)
+	}
+	// Only the payload of the retained task is left in the store.
+	if _, err := store.Get(context.Background(), retained.PayloadRef); err != nil || store.len() != 1 {
+		t.Errorf("store has %d payloads, want only the payload of the retained task", store.len())
+	}
+}
+
+func TestProcessorFailedTaskWithPayloadStore(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	store := newMemPayloadStore()
+	client := NewClientWithConfig(getRedisConnOpt(t), ClientConfig{
+		PayloadStore:          store,
+		PayloadStoreThreshold: 8,
+	})
+	defer client.Close()
+	const payload = "this payload is stored externally"
+	if _, err := client.Enqueue(NewTask("media:encode", []byte(payload))); err != nil {
+		t.Fatalf("Enqueue returned error: %v", err)
+	}
+
+	var (
+		mu      sync.Mutex
+		handled []string // payloads passed to the error handler
+		delayed []string // payloads passed to the retry delay func
+	)
+	p := newProcessorForTest(t, rdb.NewRDB(r), HandlerFunc(func(ctx context.Context, task *Task) error {
+		return errors.New("encode failed")
+	}))
+	p.payloadStore = store
+	p.errHandler = ErrorHandlerFunc(func(ctx context.Context, task *Task, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, string(task.Payload()))
+	})
+	p.retryDelayFunc = func(n int, e error, task *Task) time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+		delayed = append(delayed, string(task.Payload()))
+		return time.Hour
+	}
+	p.start(&sync.WaitGroup{})
+	time.Sleep(time.Second)
+	p.shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if diff := cmp.Diff([]string{payload}, handled); diff != "" {
+		t.Errorf("payloads passed to the error handler mismatch (-want,+got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{payload}, delayed); diff != "" {
+		t.Errorf("payloads passed to the retry delay func mismatch (-want,+got):\n%s", diff)
+	}
+}
+
+func TestProcessorWithoutPayloadStore(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	msg := h.NewTaskMessage("media:encode", nil)
+	msg.PayloadRef = "default/" + msg.ID + "/ref"
+	h.SeedPendingQueue(t, r, []*base.TaskMessage{msg}, base.DefaultQueueName)
+
+	called := make(chan struct{}, 1)
+	p := newProcessorForTest(t, rdb.NewRDB(r), HandlerFunc(func(ctx context.Context, task *Task) error {
+		called <- struct{}{}
+		return nil
+	}))
+	p.start(&sync.WaitGroup{})
+	time.Sleep(time.Second)
+	p.shutdown()
+
+	select {
+	case <-called:
+		t.Errorf("handler was called for a task whose payload could not be loaded")
+	default:
+	}
+	retry := h.GetRetryMessages(t, r, base.DefaultQueueName)
+	if len(retry) != 1 || !strings.Contains(retry[0].ErrorMsg, "no PayloadStore is configured") {
+		t.Errorf("retry messages = %v, want the task retried with an error about the missing PayloadStore", retry)
+	}
+}
@@ -19,12 +19,14 @@ import (
 	asynqcontext "github.com/hibiken/asynq/internal/context"
 	"github.com/hibiken/asynq/internal/errors"
 	"github.com/hibiken/asynq/internal/log"
+	"github.com/hibiken/asynq/internal/timeutil"
 	"golang.org/x/time/rate"
 )
 
 type processor struct {
 	logger *log.Logger
 	broker base.Broker
+	clock  timeutil.Clock
 
 	handler Handler
 
@@ -38,17 +40,78 @@ type processor struct {
 
 	errHandler ErrorHandler
 
+	// crashOnPanic makes a panic in the handler crash the process instead of
+	// failing the task.
+	crashOnPanic bool
+
+	// unhandledPolicy specifies how to handle tasks with no handler registered for their type.
+	unhandledPolicy UnhandledTaskPolicy
+
+	// baseCtxFn returns the context from which the context of each task is derived.
+	baseCtxFn func() context.Context
+
 	shutdownTimeout time.Duration
 
+	// pollInterval is the maximum time to wait before checking empty queues again.
+	pollInterval time.Duration
+
+	// minPollInterval is the time to wait before checking the queues again once
+	// they are found empty after a task was dequeued. The wait doubles with each
+	// check finding the queues empty, up to pollInterval.
+	// Zero means the processor always waits for pollInterval.
+	minPollInterval time.Duration
+
+	// idleWait is the time to wait after the next check finding the queues empty.
+	// Zero means minPollInterval. It is only accessed by the goroutine running exec.
+	idleWait time.Duration
+
+	// wakeupCh receives a value when tasks may have become pending in the queues.
+	wakeupCh chan struct{}
+
 	// channel via which to send sync requests to syncer.
 	syncRequestCh chan<- *syncRequest
 
 	// rate limiter to prevent spamming logs with a bunch of errors.
 	errLogLimiter *rate.Limiter
 
+	// breaker pauses dequeue attempts after repeated broker failures.
+	breaker *circuitBreaker
+
+	// queueBreaker pauses a queue for queueCoolOff when too many of its tasks fail.
+	queueBreaker *queueBreaker
+	queueCoolOff time.Duration
+
+	// retryWindows maps queue names to the windows within which their retries may be processed.
+	retryWindows map[string]RetryWindow
+
+	// retryPolicies maps queue names to the policies with which their tasks are retried.
+	retryPolicies retryPolicies
+
+	// resultCacheTTL maps task types to how long the results of their completed
+	// tasks are cached by idempotency key.
+	resultCacheTTL map[string]time.Duration
+
+	// sampleRate is the fraction of the successfully processed tasks to sample.
+	sampleRate float64
+
+	// trackLatency reports whether to record the latencies of the successfully processed tasks.
+	trackLatency bool
+
 	// sema is a counting semaphore to ensure the number of active workers
 	// does not exceed the limit.
-	sema chan struct{}
+	sema *workerSema
+
+	// queueLimits limits the number of active workers per queue.
+	// It is nil if no per-queue limit is configured.
+	queueLimits *workerLimits
+
+	// classLimits limits the number of active workers per task class.
+	// It is nil if no per-class limit is configured.
+	classLimits *workerLimits
+
+	// labels of the server, as formatted by base.FormatLabels.
+	// Tasks which require other labels are set aside in their queues.
+	labels []string
 
 	// channel to communicate back to the long running "processor" goroutine.
 	// once is used to send value to the channel only once.
@@ -61,9 +124,25 @@ type processor struct {
 	// abort channel communicates to the in-flight worker goroutines to stop.
 	abort chan struct{}
 
+	// shuttingDown channel is closed when the shutdown starts, to let
+	// handlers wrap up before they are aborted.
+	shuttingDown chan struct{}
+
 	// cancelations is a set of cancel functions for all active tasks.
 	cancelations *base.Cancelations
 
+	// mu guards the tasks finished and aborted during the shutdown.
+	mu       sync.Mutex
+	drained  int
+	aborted  []*base.TaskMessage
+	requeued int
+
+	// payloadStore holds the payloads of tasks stored outside of redis, if non-nil.
+	payloadStore PayloadStore
+
+	// signingKey is the key with which to verify the signature of tasks, if non-nil.
+	signingKey []byte
+
 	starting chan<- *workerInfo
 	finished chan<- *base.TaskMessage
 }
@@ -77,9 +156,28 @@ type processorParams struct {
 	cancelations    *base.Cancelations
 	concurrency     int
 	queues          map[string]int
+	queueLimits     map[string]int
+	classLimits     map[string]int
+	labels          []string
 	strictPriority  bool
 	errHandler      ErrorHandler
+	crashOnPanic    bool
+	unhandledPolicy UnhandledTaskPolicy
+	baseCtxFn       func() context.Context
 	shutdownTimeout time.Duration
+	pollInterval    time.Duration
+	minPollInterval time.Duration
+	breaker         *circuitBreaker
+	queueBreaker    *queueBreaker
+	queueCoolOff    time.Duration
+	resultCacheTTL  map[string]time.Duration
+	retryWindows    map[string]RetryWindow
+	retryPolicies   retryPolicies
+	sampleRate      float64
+	trackLatency    bool
+	clock           timeutil.Clock // defaults to the real clock if nil.
+	payloadStore    PayloadStore
+	signingKey      []byte
 	starting        chan<- *workerInfo
 	finished        chan<- *base.TaskMessage
 }
@@ -91,23 +189,48 @@ func newProcessor(params processorParams) *processor {
 	if params.strictPriority {
 		orderedQueues = sortByPriority(queues)
 	}
+	clock := params.clock
+	if clock == nil {
+		clock = timeutil.NewRealClock()
+	}
 	return &processor{
 		logger:          params.logger,
 		broker:          params.broker,
+		clock:           clock,
 		queueConfig:     queues,
 		orderedQueues:   orderedQueues,
 		retryDelayFunc:  params.retryDelayFunc,
 		isFailureFunc:   params.isFailureFunc,
 		syncRequestCh:   params.syncCh,
 		cancelations:    params.cancelations,
+		payloadStore:    params.payloadStore,
+		signingKey:      params.signingKey,
 		errLogLimiter:   rate.NewLimiter(rate.Every(3*time.Second), 1),
-		sema:            make(chan struct{}, params.concurrency),
+		breaker:         params.breaker,
+		queueBreaker:    params.queueBreaker,
+		queueCoolOff:    params.queueCoolOff,
+		resultCacheTTL:  params.resultCacheTTL,
+		retryWindows:    params.retryWindows,
+		retryPolicies:   params.retryPolicies,
+		sampleRate:      params.sampleRate,
+		trackLatency:    params.trackLatency,
+		sema:            newWorkerSema(params.concurrency),
+		queueLimits:     newWorkerLimits(params.queueLimits),
+		classLimits:     newWorkerLimits(params.classLimits),
+		labels:          params.labels,
 		done:            make(chan struct{}),
 		quit:            make(chan struct{}),
 		abort:           make(chan struct{}),
+		shuttingDown:    make(chan struct{}),
 		errHandler:      params.errHandler,
+		crashOnPanic:    params.crashOnPanic,
+		unhandledPolicy: params.unhandledPolicy,
+		baseCtxFn:       params.baseCtxFn,
 		handler:         HandlerFunc(func(ctx context.Context, t *Task) error { return fmt.Errorf("handler not set") }),
 		shutdownTimeout: params.shutdownTimeout,
+		pollInterval:    params.pollInterval,
+		minPollInterval: params.minPollInterval,
+		wakeupCh:        make(chan struct{}, 1),
 		starting:        params.starting,
 		finished:        params.finished,
 	}
@@ -130,14 +253,104 @@ func (p *processor) stop() {
 func (p *processor) shutdown() {
 	p.stop()
 
+	// Let handlers know that they will be aborted after the timeout.
+	close(p.shuttingDown)
 	time.AfterFunc(p.shutdownTimeout, func() { close(p.abort) })
 
 	p.logger.Info("Waiting for all workers to finish...")
 	// block until all workers have released the token
-	for i := 0; i < cap(p.sema); i++ {
-		p.sema <- struct{}{}
-	}
+	p.sema.wait()
 	p.logger.Info("All workers have finished")
+	p.requeueAborted()
+	finished, requeued := p.shutdownStats()
+	p.logger.Infof("Finished %d tasks and requeued %d tasks during the shutdown", finished, requeued)
+}
+
+// shutdownStats returns the number of tasks finished and requeued during the shutdown.
+func (p *processor) shutdownStats() (finished, requeued int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.drained, p.requeued
+}
+
+// countDrained counts the task as finished during the shutdown if the shutdown has started.
+func (p *processor) countDrained() {
+	select {
+	case <-p.shuttingDown:
+		p.mu.Lock()
+		p.drained++
+		p.mu.Unlock()
+	default:
+	}
+}
+
+// requeueAborted pushes the tasks aborted at the shutdown timeout back to their queues
+// in the priority order of the queues, so that the tasks of the queues with the highest
+// priority are available to other servers first.
+func (p *processor) requeueAborted() {
+	p.mu.Lock()
+	aborted := p.aborted
+	p.aborted = nil
+	p.mu.Unlock()
+	sort.SliceStable(aborted, func(i, j int) bool {
+		return p.queueConfig[aborted[i].Queue] > p.queueConfig[aborted[j].Queue]
+	})
+	for _, msg := range aborted {
+		if p.requeue(msg) {
+			p.mu.Lock()
+			p.requeued++
+			p.mu.Unlock()
+		}
+	}
+}
+
+// nextPollInterval returns the time to wait before checking empty queues again,
+// and doubles the wait for the next time, up to pollInterval.
+func (p *processor) nextPollInterval() time.Duration {
+	if p.minPollInterval <= 0 || p.minPollInterval >= p.pollInterval {
+		return p.pollInterval
+	}
+	d := p.idleWait
+	if d < p.minPollInterval {
+		d = p.minPollInterval
+	}
+	p.idleWait = 2 * d
+	if p.idleWait > p.pollInterval {
+		p.idleWait = p.pollInterval
+	}
+	return d
+}
+
+// waitForTasks blocks until tasks may have become pending, d elapses,
+// or the processor starts shutting down.
+func (p *processor) waitForTasks(d time.Duration) {
+	select {
+	case <-p.wakeupCh:
+	case <-time.After(d):
+	case <-p.quit:
+	}
+}
+
+// wakeup notifies the processor that tasks have become pending in the given queue.
+func (p *processor) wakeup(qname string) {
+	if _, ok := p.queueConfig[qname]; ok {
+		p.notifyWakeup()
+	}
+}
+
+func (p *processor) notifyWakeup() {
+	select {
+	case p.wakeupCh <- struct{}{}:
+	default:
+		// wakeup is already pending.
+	}
+}
+
+// setConcurrency changes the maximum number of active workers.
+// If the number of active workers exceeds n, no new task is processed until
+// enough workers have finished.
+func (p *processor) setConcurrency(n int) {
+	p.sema.setLimit(n)
 }
 
 func (p *processor) start(wg *sync.WaitGroup) {
@@ -159,102 +372,348 @@ func (p *processor) start(wg *sync.WaitGroup) {
 // exec pulls a task out of the queue and starts a worker goroutine to
 // process the task.
 func (p *processor) exec() {
-	select {
-	case <-p.quit:
+	if !p.breaker.allow() {
+		// Broker failed repeatedly, wait for the cool-off period to elapse
+		// instead of hot-looping on errors.
+		select {
+		case <-p.quit:
+		case <-time.After(time.Second):
+		}
 		return
-	case p.sema <- struct{}{}: // acquire token
-		qnames := p.queues()
-		msg, deadline, err := p.broker.Dequeue(qnames...)
-		switch {
-		case errors.Is(err, errors.ErrNoProcessableTask):
-			p.logger.Debug("All queues are empty")
-			// Queues are empty, this is a normal behavior.
-			// Sleep to avoid slamming redis and let scheduler move tasks into queues.
-			// Note: We are not using blocking pop operation and polling queues instead.
-			// This adds significant load to redis.
-			time.Sleep(time.Second)
-			<-p.sema // release token
-			return
-		case err != nil:
-			if p.errLogLimiter.Allow() {
-				p.logger.Errorf("Dequeue error: %v", err)
+	}
+	if !p.sema.acquire(p.quit) {
+		return
+	}
+	all := p.queues()
+	qnames := p.queueLimits.available(all)
+	if len(qnames) == 0 {
+		// All queues have reached their concurrency limit.
+		// Sleep to let active workers finish.
+		select {
+		case <-p.quit:
+		case <-time.After(100 * time.Millisecond):
+		}
+		p.sema.release() // release token
+		return
+	}
+	var (
+		msg      *base.TaskMessage
+		deadline time.Time
+		err      error
+	)
+	// Leave the tasks of the classes which have reached their concurrency
+	// limit in the queues for the other workers.
+	skipClasses := p.classLimits.full()
+	if len(p.labels) > 0 {
+		msg, deadline, err = p.broker.DequeueMatching(p.labels, skipClasses, qnames...)
+	} else if len(skipClasses) > 0 {
+		msg, deadline, err = p.broker.DequeueSkipping(skipClasses, qnames...)
+	} else {
+		msg, deadline, err = p.broker.Dequeue(qnames...)
+	}
+	if errors.Is(err, errors.ErrNoProcessableTask) {
+		p.breaker.record(nil)
+	} else {
+		p.breaker.record(err)
+	}
+	switch {
+	case errors.Is(err, errors.ErrNoProcessableTask):
+		p.logger.Debug("All queues are empty")
+		// Queues are empty, this is a normal behavior.
+		// Wait until a task is enqueued to avoid slamming redis.
+		// Note: Blocking pop operations cannot be used to wait on multiple queues
+		// (e.g. across Redis Cluster slots), so the server is woken up by a
+		// message published when tasks become pending, and polls the queues
+		// periodically in case the message is missed.
+		d := p.nextPollInterval()
+		if len(qnames) < len(all) || len(skipClasses) > 0 {
+			// Some queues or classes were skipped because of their concurrency
+			// limit, and may have tasks once an active worker finishes.
+			d = 100 * time.Millisecond
+		}
+		p.waitForTasks(d)
+		p.sema.release() // release token
+		return
+	case err != nil:
+		if p.errLogLimiter.Allow() {
+			p.logger.Errorf("Dequeue error: %v", err)
+		}
+		p.sema.release() // release token
+		return
+	}
+	// Tasks were found, check the queues again soon once they're empty.
+	p.idleWait = 0
+
+	p.queueLimits.acquire(msg.Queue)
+	p.classLimits.acquire(msg.Class)
+	p.starting <- &workerInfo{msg, p.clock.Now(), deadline}
+	go func() {
+		defer func() {
+			p.finished <- msg
+			p.queueLimits.release(msg.Queue)
+			p.classLimits.release(msg.Class)
+			p.sema.release() // release token
+			// Completing a task may have made other tasks pending
+			// (e.g. tasks depending on it), check the queues again.
+			p.notifyWakeup()
+		}()
+
+		ctx, cancel := p.taskContext(msg, deadline)
+		p.cancelations.Add(msg.ID, cancel)
+		defer func() {
+			cancel()
+			p.cancelations.Delete(msg.ID)
+		}()
+		aborted := false
+		defer func() {
+			if !aborted {
+				p.countDrained()
 			}
-			<-p.sema // release token
+		}()
+
+		if p.handleWithoutRun(ctx, msg) {
 			return
 		}
 
-		p.starting <- &workerInfo{msg, time.Now(), deadline}
+		// payload is set by the worker goroutine before it sends to resCh.
+		var payload []byte
+		started := p.clock.Now()
+		resCh := make(chan error, 1)
 		go func() {
-			defer func() {
-				p.finished <- msg
-				<-p.sema // release token
-			}()
-
-			ctx, cancel := asynqcontext.New(msg, deadline)
-			p.cancelations.Add(msg.ID, cancel)
-			defer func() {
-				cancel()
-				p.cancelations.Delete(msg.ID)
-			}()
-
-			// check context before starting a worker goroutine.
-			select {
-			case <-ctx.Done():
-				// already canceled (e.g. deadline exceeded).
-				p.handleFailedMessage(ctx, msg, ctx.Err())
-				return
-			default:
-			}
+			var err error
+			payload, err = p.run(ctx, msg)
+			resCh <- err
+		}()
 
-			resCh := make(chan error, 1)
-			go func() {
-				task := newTask(
-					msg.Type,
-					msg.Payload,
-					&ResultWriter{
-						id:     msg.ID,
-						qname:  msg.Queue,
-						broker: p.broker,
-						ctx:    ctx,
-					},
-				)
-				resCh <- p.perform(ctx, task)
-			}()
+		select {
+		case <-p.abort:
+			// time is up, quit this worker goroutine.
+			// The message is pushed back to queue once all workers have quit.
+			p.logger.Warnf("Quitting worker. task id=%s", msg.ID)
+			aborted = true
+			p.mu.Lock()
+			p.aborted = append(p.aborted, msg)
+			p.mu.Unlock()
+			return
+		case <-ctx.Done():
+			p.handleFailedMessage(ctx, msg, msg.Payload, ctx.Err())
+			return
+		case resErr := <-resCh:
+			p.handleResult(ctx, msg, payload, started, resErr)
+		}
+	}()
+}
 
-			select {
-			case <-p.abort:
-				// time is up, push the message back to queue and quit this worker goroutine.
-				p.logger.Warnf("Quitting worker. task id=%s", msg.ID)
-				p.requeue(msg)
-				return
-			case <-ctx.Done():
-				p.handleFailedMessage(ctx, msg, ctx.Err())
-				return
-			case resErr := <-resCh:
-				if resErr != nil {
-					p.handleFailedMessage(ctx, msg, resErr)
-					return
-				}
-				p.handleSucceededMessage(ctx, msg)
-			}
-		}()
+// taskContext returns the context in which the task is processed until the given deadline.
+func (p *processor) taskContext(msg *base.TaskMessage, deadline time.Time) (context.Context, context.CancelFunc) {
+	baseCtx := context.Background()
+	if p.baseCtxFn != nil {
+		baseCtx = p.baseCtxFn()
+	}
+	ctxMsg := msg
+	if n := p.retryPolicies.maxRetry(msg); n != msg.Retry {
+		// Report the max retry of the queue to the handler. The message itself
+		// is left as is, since its signature covers the max retry.
+		m := *msg
+		m.Retry = n
+		ctxMsg = &m
+	}
+	ctx, cancel := asynqcontext.New(baseCtx, ctxMsg, deadline)
+	ctx = asynqcontext.WithShutdownSignal(ctx, p.shuttingDown)
+	ctx = asynqcontext.WithCheckpointer(ctx, func(data []byte) error {
+		return p.broker.WriteCheckpoint(msg.Queue, msg.ID, data)
+	})
+	ctx = asynqcontext.WithProgressWriter(ctx, func(data []byte) error {
+		return p.broker.WriteProgress(msg.Queue, msg.ID, data)
+	})
+	return ctx, cancel
+}
+
+// handleWithoutRun handles the dequeued task without calling the handler if the
+// task has a bad signature, a cached result, or its context is already done,
+// and reports whether it did.
+func (p *processor) handleWithoutRun(ctx context.Context, msg *base.TaskMessage) bool {
+	if p.signingKey != nil && !base.VerifyMessage(msg, p.signingKey) {
+		p.logger.Warnf("Quarantining task id=%s type=%q: %v", msg.ID, msg.Type, ErrBadSignature)
+		if p.errHandler != nil {
+			p.errHandler.HandleError(ctx, NewTask(msg.Type, msg.Payload), ErrBadSignature)
+		}
+		p.clearStarted(msg)
+		p.quarantine(msg, ErrBadSignature)
+		return true
+	}
+
+	if p.useCachedResult(ctx, msg) {
+		p.clearStarted(msg)
+		return true
+	}
+
+	// check context before starting a worker goroutine.
+	select {
+	case <-ctx.Done():
+		// already canceled (e.g. deadline exceeded).
+		p.clearStarted(msg)
+		p.handleFailedMessage(ctx, msg, msg.Payload, ctx.Err())
+		return true
+	default:
+		return false
 	}
 }
 
-func (p *processor) requeue(msg *base.TaskMessage) {
+// run loads the payload of the task and calls the handler with the task.
+// It returns the payload and the error returned by the handler.
+func (p *processor) run(ctx context.Context, msg *base.TaskMessage) (payload []byte, err error) {
+	payload, err = loadPayload(ctx, p.payloadStore, msg)
+	if err != nil {
+		p.clearStarted(msg)
+		return msg.Payload, err
+	}
+	task := newTask(
+		msg.Type,
+		payload,
+		&ResultWriter{
+			id:     msg.ID,
+			qname:  msg.Queue,
+			broker: p.broker,
+			ctx:    ctx,
+		},
+	)
+	err = p.perform(ctx, task)
+	// Note: The handler may return after the worker has given up on the task
+	// (e.g. deadline exceeded), the mark is held until then.
+	p.clearStarted(msg)
+	return payload, err
+}
+
+// handleResult handles the task started at the given time once the handler,
+// called with the given payload, returned the given error.
+func (p *processor) handleResult(ctx context.Context, msg *base.TaskMessage, payload []byte, started time.Time, err error) {
+	if err != nil {
+		p.handleFailedMessage(ctx, msg, payload, err)
+		return
+	}
+	p.sample(msg, len(payload), started)
+	p.recordLatency(msg, started)
+	p.handleSucceededMessage(ctx, msg)
+}
+
+// clearStarted clears the started mark which the broker set when it dequeued
+// the at-most-once task, once the task is no longer being processed.
+func (p *processor) clearStarted(msg *base.TaskMessage) {
+	if !msg.AtMostOnce {
+		return
+	}
+	if err := p.broker.ClearStarted(msg); err != nil {
+		p.logger.Warnf("Could not clear started mark of task id=%s: %v", msg.ID, err)
+	}
+}
+
+// requeue pushes the task back to queue, and reports whether it did.
+func (p *processor) requeue(msg *base.TaskMessage) bool {
 	err := p.broker.Requeue(msg)
 	if err != nil {
 		p.logger.Errorf("Could not push task id=%s back to queue: %v", msg.ID, err)
-	} else {
-		p.logger.Infof("Pushed task id=%s back to queue", msg.ID)
+		return false
+	}
+	p.logger.Infof("Pushed task id=%s back to queue", msg.ID)
+	return true
+}
+
+// useCachedResult completes the task without calling the handler if a task of the same
+// type and with the same idempotency key completed recently, and reports whether it did.
+// The result of the completed task is written as the result of the task.
+func (p *processor) useCachedResult(ctx context.Context, msg *base.TaskMessage) bool {
+	if msg.IdempotencyKey == "" || p.resultCacheTTL[msg.Type] <= 0 {
+		return false
 	}
+	res, ok, err := p.broker.CachedResult(msg)
+	if err != nil {
+		p.logger.Warnf("Could not get cached result of task id=%s type=%q: %v", msg.ID, msg.Type, err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+	if len(res) > 0 {
+		if _, err := p.broker.WriteResult(msg.Queue, msg.ID, res); err != nil {
+			p.logger.Warnf("Could not write cached result of task id=%s type=%q: %v", msg.ID, msg.Type, err)
+		}
+	}
+	p.logger.Infof("Completing task id=%s type=%q without calling the handler: a task with idempotency key %q completed recently",
+		msg.ID, msg.Type, msg.IdempotencyKey)
+	p.completeMessage(ctx, msg)
+	return true
 }
 
 func (p *processor) handleSucceededMessage(ctx context.Context, msg *base.TaskMessage) {
+	if ttl := p.resultCacheTTL[msg.Type]; ttl > 0 && msg.IdempotencyKey != "" {
+		// Cache the result before the task is deleted.
+		if err := p.broker.CacheResult(msg, ttl); err != nil {
+			p.logger.Warnf("Could not cache result of task id=%s type=%q: %v", msg.ID, msg.Type, err)
+		}
+	}
+	p.completeMessage(ctx, msg)
+}
+
+// sample records the measurements of the successfully processed task with
+// the probability sampleRate.
+func (p *processor) sample(msg *base.TaskMessage, payloadSize int, started time.Time) {
+	if p.sampleRate <= 0 || rand.Float64() >= p.sampleRate {
+		return
+	}
+	now := p.clock.Now()
+	s := &base.TaskSample{
+		Type:        msg.Type,
+		PayloadSize: payloadSize,
+		Duration:    now.Sub(started),
+		CompletedAt: now,
+	}
+	if msg.PendingSince > 0 {
+		if d := started.Sub(time.Unix(0, msg.PendingSince)); d > 0 {
+			s.WaitTime = d
+		}
+	}
+	if err := p.broker.RecordTaskSample(msg.Queue, s); err != nil {
+		p.logger.Warnf("Could not record sample of task id=%s type=%q: %v", msg.ID, msg.Type, err)
+	}
+}
+
+// recordLatency records the wait time and the run time of the successfully
+// processed task started at the given time, if latency tracking is enabled.
+func (p *processor) recordLatency(msg *base.TaskMessage, started time.Time) {
+	if !p.trackLatency {
+		return
+	}
+	l := &base.TaskLatency{Type: msg.Type, Run: p.clock.Now().Sub(started)}
+	if msg.PendingSince > 0 {
+		if d := started.Sub(time.Unix(0, msg.PendingSince)); d > 0 {
+			l.Wait = d
+		}
+	}
+	if err := p.broker.RecordLatency(msg.Queue, l); err != nil {
+		p.logger.Warnf("Could not record latency of task id=%s type=%q: %v", msg.ID, msg.Type, err)
+	}
+}
+
+// completeMessage records the success of the task and removes it from the active state.
+func (p *processor) completeMessage(ctx context.Context, msg *base.TaskMessage) {
+	p.recordOutcome(msg.Queue, false)
 	if msg.Retention > 0 {
 		p.markAsComplete(ctx, msg)
 	} else {
 		p.markAsDone(ctx, msg)
+		p.deletePayload(msg)
+	}
+}
+
+// deletePayload deletes the payload of the task from the payload store, if the
+// payload is stored externally.
+func (p *processor) deletePayload(msg *base.TaskMessage) {
+	if msg.PayloadRef == "" || p.payloadStore == nil {
+		return
+	}
+	if err := p.payloadStore.Delete(context.Background(), msg.PayloadRef); err != nil {
+		p.logger.Warnf("Could not delete payload of task id=%s (key=%q) from the payload store: %v", msg.ID, msg.PayloadRef, err)
 	}
 }
 
@@ -263,17 +722,12 @@ func (p *processor) markAsComplete(ctx context.Context, msg *base.TaskMessage) {
 	if err != nil {
 		errMsg := fmt.Sprintf("Could not move task id=%s type=%q from %q to %q:  %+v",
 			msg.ID, msg.Type, base.ActiveKey(msg.Queue), base.CompletedKey(msg.Queue), err)
-		deadline, ok := ctx.Deadline()
-		if !ok {
-			panic("asynq: internal error: missing deadline in context")
-		}
 		p.logger.Warnf("%s; Will retry syncing", errMsg)
 		p.syncRequestCh <- &syncRequest{
 			fn: func() error {
 				return p.broker.MarkAsComplete(msg)
 			},
-			errMsg:   errMsg,
-			deadline: deadline,
+			errMsg: errMsg,
 		}
 	}
 }
@@ -282,82 +736,208 @@ func (p *processor) markAsDone(ctx context.Context, msg *base.TaskMessage) {
 	err := p.broker.Done(msg)
 	if err != nil {
 		errMsg := fmt.Sprintf("Could not remove task id=%s type=%q from %q err: %+v", msg.ID, msg.Type, base.ActiveKey(msg.Queue), err)
-		deadline, ok := ctx.Deadline()
-		if !ok {
-			panic("asynq: internal error: missing deadline in context")
-		}
 		p.logger.Warnf("%s; Will retry syncing", errMsg)
 		p.syncRequestCh <- &syncRequest{
 			fn: func() error {
 				return p.broker.Done(msg)
 			},
-			errMsg:   errMsg,
-			deadline: deadline,
+			errMsg: errMsg,
 		}
 	}
 }
 
+// ErrBadSignature indicates that a task is not signed or that its signature is invalid,
+// i.e. the task was not enqueued by a client with the signing key of the server, or
+// it was modified after it was enqueued.
+//
+// See Config.SigningKey for how the server handles such tasks.
+var ErrBadSignature = errors.New("task signature is missing or invalid")
+
 // SkipRetry is used as a return value from Handler.ProcessTask to indicate that
 // the task should not be retried and should be archived instead.
 var SkipRetry = errors.New("skip retry for the task")
 
-func (p *processor) handleFailedMessage(ctx context.Context, msg *base.TaskMessage, err error) {
+// RetryIn returns an error wrapping err which makes the server retry the task
+// after the delay d, instead of the delay computed by Config.RetryDelayFunc.
+// It can be used, for example, to honor the Retry-After header of an HTTP response.
+//
+// The retry counts toward the maximum number of retries of the task as usual.
+func RetryIn(err error, d time.Duration) error {
+	return &retryAtError{err: err, delay: d}
+}
+
+// RetryAt returns an error wrapping err which makes the server retry the task
+// at the time t, instead of after the delay computed by Config.RetryDelayFunc.
+//
+// The retry counts toward the maximum number of retries of the task as usual.
+func RetryAt(err error, t time.Time) error {
+	return &retryAtError{err: err, at: t}
+}
+
+// retryAtError is an error returned from Handler to specify when to retry the task.
+type retryAtError struct {
+	err   error
+	delay time.Duration // used if at is zero
+	at    time.Time
+}
+
+func (e *retryAtError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("retry requested at %v", e.retryAt(time.Now()))
+	}
+	return e.err.Error()
+}
+
+func (e *retryAtError) Unwrap() error { return e.err }
+
+func (e *retryAtError) retryAt(now time.Time) time.Time {
+	if !e.at.IsZero() {
+		return e.at
+	}
+	return now.Add(e.delay)
+}
+
+// handleFailedMessage handles the task which failed with the given error.
+// The task passed to the error handler and the retry delay func is made of the
+// given payload, which is loaded from the PayloadStore if the task has a PayloadRef.
+func (p *processor) handleFailedMessage(ctx context.Context, msg *base.TaskMessage, payload []byte, err error) {
+	task := NewTask(msg.Type, payload)
+	if errors.Is(err, errHandlerBusy) {
+		// The task wasn't processed, retry it shortly without counting a failure.
+		p.retry(ctx, msg, task, err, false /*isFailure*/)
+		return
+	}
+	if p.cancelations.Aborted(msg.ID) && !errors.Is(err, SkipRetry) {
+		// The task was canceled not to be run again, see Scheduler's OverlapCancelPrevious.
+		err = fmt.Errorf("%v: %w", err, SkipRetry)
+	}
 	if p.errHandler != nil {
-		p.errHandler.HandleError(ctx, NewTask(msg.Type, msg.Payload), err)
+		p.errHandler.HandleError(ctx, task, err)
+	}
+	if errors.Is(err, ErrHandlerNotFound) {
+		p.recordUnhandled(msg)
+		switch p.unhandledPolicy {
+		case ParkUnhandled:
+			p.logger.Warnf("Parking task id=%s: no handler for type %q", msg.ID, msg.Type)
+			p.park(ctx, msg, err)
+			return
+		case ArchiveUnhandled:
+			p.logger.Warnf("Archiving task id=%s: no handler for type %q", msg.ID, msg.Type)
+			p.archive(ctx, msg, err, base.ArchiveReasonNoHandler)
+			return
+		}
 	}
 	if !p.isFailureFunc(err) {
 		// retry the task without marking it as failed
-		p.retry(ctx, msg, err, false /*isFailure*/)
+		p.retry(ctx, msg, task, err, false /*isFailure*/)
 		return
 	}
-	if msg.Retried >= msg.Retry || errors.Is(err, SkipRetry) {
+	p.recordOutcome(msg.Queue, true)
+	if msg.Retried >= p.retryPolicies.maxRetry(msg) || errors.Is(err, SkipRetry) {
 		p.logger.Warnf("Retry exhausted for task id=%s", msg.ID)
-		p.archive(ctx, msg, err)
+		reason := base.ArchiveReasonMaxRetry
+		if errors.Is(err, SkipRetry) {
+			reason = base.ArchiveReasonSkipRetry
+		}
+		p.archive(ctx, msg, err, reason)
 	} else {
-		p.retry(ctx, msg, err, true /*isFailure*/)
+		p.retry(ctx, msg, task, err, true /*isFailure*/)
+	}
+}
+
+// recordOutcome records the outcome of a task processed from the queue, and
+// pauses the queue for the cool-off period if the failure rate exceeds the threshold.
+func (p *processor) recordOutcome(qname string, failed bool) {
+	tripped, rate := p.queueBreaker.record(qname, failed)
+	if !tripped {
+		return
+	}
+	reason := fmt.Sprintf("%.0f%% of the last %d tasks failed", rate*100, p.queueBreaker.window)
+	ok, err := p.broker.PauseFor(qname, p.queueCoolOff, reason)
+	switch {
+	case err != nil:
+		p.logger.Errorf("Could not pause queue %q: %v", qname, err)
+	case ok:
+		p.logger.Warnf("Paused queue %q for %v: %s", qname, p.queueCoolOff, reason)
 	}
 }
 
-func (p *processor) retry(ctx context.Context, msg *base.TaskMessage, e error, isFailure bool) {
-	d := p.retryDelayFunc(msg.Retried, e, NewTask(msg.Type, msg.Payload))
-	retryAt := time.Now().Add(d)
+func (p *processor) retry(ctx context.Context, msg *base.TaskMessage, task *Task, e error, isFailure bool) {
+	var retryAt time.Time
+	var re *retryAtError
+	if errors.As(e, &re) {
+		retryAt = re.retryAt(p.clock.Now())
+	} else {
+		delayFunc := p.retryPolicies.delayFunc(msg.Queue, p.retryDelayFunc)
+		d := delayFunc(msg.Retried, e, task)
+		retryAt = p.clock.Now().Add(d)
+	}
+	if w, ok := p.retryWindows[msg.Queue]; ok {
+		retryAt = w.Next(retryAt)
+	}
 	err := p.broker.Retry(msg, retryAt, e.Error(), isFailure)
 	if err != nil {
 		errMsg := fmt.Sprintf("Could not move task id=%s from %q to %q", msg.ID, base.ActiveKey(msg.Queue), base.RetryKey(msg.Queue))
-		deadline, ok := ctx.Deadline()
-		if !ok {
-			panic("asynq: internal error: missing deadline in context")
-		}
 		p.logger.Warnf("%s; Will retry syncing", errMsg)
 		p.syncRequestCh <- &syncRequest{
 			fn: func() error {
 				return p.broker.Retry(msg, retryAt, e.Error(), isFailure)
 			},
-			errMsg:   errMsg,
-			deadline: deadline,
+			errMsg: errMsg,
 		}
 	}
 }
 
-func (p *processor) archive(ctx context.Context, msg *base.TaskMessage, e error) {
-	err := p.broker.Archive(msg, e.Error())
+func (p *processor) archive(ctx context.Context, msg *base.TaskMessage, e error, reason string) {
+	err := p.broker.Archive(msg, e.Error(), reason)
 	if err != nil {
 		errMsg := fmt.Sprintf("Could not move task id=%s from %q to %q", msg.ID, base.ActiveKey(msg.Queue), base.ArchivedKey(msg.Queue))
-		deadline, ok := ctx.Deadline()
-		if !ok {
-			panic("asynq: internal error: missing deadline in context")
+		p.logger.Warnf("%s; Will retry syncing", errMsg)
+		p.syncRequestCh <- &syncRequest{
+			fn: func() error {
+				return p.broker.Archive(msg, e.Error(), reason)
+			},
+			errMsg: errMsg,
 		}
+	}
+}
+
+func (p *processor) park(ctx context.Context, msg *base.TaskMessage, e error) {
+	err := p.broker.Park(msg, e.Error())
+	if err != nil {
+		errMsg := fmt.Sprintf("Could not move task id=%s from %q to %q", msg.ID, base.ActiveKey(msg.Queue), base.UnhandledKey(msg.Queue))
 		p.logger.Warnf("%s; Will retry syncing", errMsg)
 		p.syncRequestCh <- &syncRequest{
 			fn: func() error {
-				return p.broker.Archive(msg, e.Error())
+				return p.broker.Park(msg, e.Error())
 			},
-			errMsg:   errMsg,
-			deadline: deadline,
+			errMsg: errMsg,
 		}
 	}
 }
 
+func (p *processor) quarantine(msg *base.TaskMessage, e error) {
+	err := p.broker.Quarantine(msg, e.Error())
+	if err != nil {
+		errMsg := fmt.Sprintf("Could not move task id=%s from %q to %q", msg.ID, base.ActiveKey(msg.Queue), base.QuarantineKey(msg.Queue))
+		p.logger.Warnf("%s; Will retry syncing", errMsg)
+		p.syncRequestCh <- &syncRequest{
+			fn: func() error {
+				return p.broker.Quarantine(msg, e.Error())
+			},
+			errMsg: errMsg,
+		}
+	}
+}
+
+// recordUnhandled counts the task in the stats of tasks without a handler.
+// The count is best-effort and is not retried on failure.
+func (p *processor) recordUnhandled(msg *base.TaskMessage) {
+	if err := p.broker.RecordUnhandled(msg.Queue); err != nil {
+		p.logger.Warnf("Could not record unhandled task id=%s: %v", msg.ID, err)
+	}
+}
+
 // queues returns a list of queues to query.
 // Order of the queue names is based on the priority of each queue.
 // Queue names is sorted by their priority level if strict-priority is true.
@@ -385,26 +965,66 @@ func (p *processor) queues() []string {
 	return uniq(names, len(p.queueConfig))
 }
 
+// PanicError is the error returned for a task whose handler panicked.
+//
+// ErrorHandler can use errors.As to retrieve the value passed to panic and
+// the stack trace of the goroutine which panicked.
+type PanicError struct {
+	// TaskID is the ID of the task being processed.
+	TaskID string
+
+	// TaskType is the type name of the task being processed.
+	TaskType string
+
+	// Value is the value passed to panic.
+	Value interface{}
+
+	// File and Line identify the source location which triggered the panic.
+	// File is empty if the location could not be determined.
+	File string
+	Line int
+
+	// Stack is the formatted stack trace of the goroutine which panicked.
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	// Include the file and line number info in the error, if known.
+	if e.File != "" {
+		return fmt.Sprintf("panic [%s:%d]: %v", e.File, e.Line, e.Value)
+	}
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
 // perform calls the handler with the given task.
 // If the call returns without panic, it simply returns the value,
-// otherwise, it recovers from panic and returns an error.
+// otherwise, it recovers from panic and returns a *PanicError.
+//
+// If the processor is configured to crash on panic, the error is reported
+// to the ErrorHandler and the panic is propagated instead.
 func (p *processor) perform(ctx context.Context, task *Task) (err error) {
 	defer func() {
 		if x := recover(); x != nil {
-			p.logger.Errorf("recovering from panic. See the stack trace below for details:\n%s", string(debug.Stack()))
+			stack := debug.Stack()
+			p.logger.Errorf("recovering from panic. See the stack trace below for details:\n%s", string(stack))
 			_, file, line, ok := runtime.Caller(1) // skip the first frame (panic itself)
 			if ok && strings.Contains(file, "runtime/") {
 				// The panic came from the runtime, most likely due to incorrect
 				// map/slice usage. The parent frame should have the real trigger.
 				_, file, line, ok = runtime.Caller(2)
 			}
-
-			// Include the file and line number info in the error, if runtime.Caller returned ok.
+			perr := &PanicError{TaskType: task.Type(), Value: x, Stack: stack}
+			perr.TaskID, _ = asynqcontext.GetTaskID(ctx)
 			if ok {
-				err = fmt.Errorf("panic [%s:%d]: %v", file, line, x)
-			} else {
-				err = fmt.Errorf("panic: %v", x)
+				perr.File, perr.Line = file, line
 			}
+			if p.crashOnPanic {
+				if p.errHandler != nil {
+					p.errHandler.HandleError(ctx, task, perr)
+				}
+				panic(perr)
+			}
+			err = perr
 		}
 	}()
 	return p.handler.ProcessTask(ctx, task)
@@ -483,3 +1103,144 @@ func gcd(xs ...int) int {
 	}
 	return res
 }
+
+// workerSema is a counting semaphore which limits the number of active workers.
+// Unlike a buffered channel, its limit can be changed while tokens are held.
+type workerSema struct {
+	mu     sync.Mutex
+	limit  int
+	active int
+	// changed is closed and replaced whenever a token is released or the limit
+	// changes, to wake up goroutines waiting for a token.
+	changed chan struct{}
+}
+
+func newWorkerSema(limit int) *workerSema {
+	return &workerSema{limit: limit, changed: make(chan struct{})}
+}
+
+// acquire blocks until a token is available or quit is closed.
+// It reports whether a token was acquired.
+func (s *workerSema) acquire(quit <-chan struct{}) bool {
+	for {
+		s.mu.Lock()
+		if s.active < s.limit {
+			s.active++
+			s.mu.Unlock()
+			return true
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-quit:
+			return false
+		case <-changed:
+		}
+	}
+}
+
+// release returns a token acquired with acquire.
+func (s *workerSema) release() {
+	s.mu.Lock()
+	s.active--
+	s.notify()
+	s.mu.Unlock()
+}
+
+// setLimit changes the maximum number of tokens.
+func (s *workerSema) setLimit(n int) {
+	s.mu.Lock()
+	s.limit = n
+	s.notify()
+	s.mu.Unlock()
+}
+
+// wait blocks until all tokens are released.
+func (s *workerSema) wait() {
+	for {
+		s.mu.Lock()
+		if s.active == 0 {
+			s.mu.Unlock()
+			return
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		<-changed
+	}
+}
+
+// notify wakes up all waiting goroutines. s.mu must be held.
+func (s *workerSema) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// workerLimits tracks the number of active workers per key (a queue name or
+// a task class) and limits it for the keys with a configured limit.
+//
+// A nil *workerLimits is valid and limits nothing.
+type workerLimits struct {
+	mu     sync.Mutex
+	limits map[string]int // maps key to max number of active workers
+	active map[string]int // maps key to number of active workers
+}
+
+func newWorkerLimits(limits map[string]int) *workerLimits {
+	if len(limits) == 0 {
+		return nil
+	}
+	return &workerLimits{limits: limits, active: make(map[string]int)}
+}
+
+// available returns the keys which have not reached their limit,
+// preserving the order.
+func (l *workerLimits) available(keys []string) []string {
+	if l == nil {
+		return keys
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var res []string
+	for _, key := range keys {
+		if max, ok := l.limits[key]; ok && l.active[key] >= max {
+			continue
+		}
+		res = append(res, key)
+	}
+	return res
+}
+
+// full returns the keys which have reached their limit, in sorted order.
+func (l *workerLimits) full() []string {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var res []string
+	for key, max := range l.limits {
+		if l.active[key] >= max {
+			res = append(res, key)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (l *workerLimits) acquire(key string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active[key]++
+}
+
+func (l *workerLimits) release(key string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active[key]--
+}
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -17,7 +18,10 @@ import (
 	"github.com/google/go-cmp/cmp/cmpopts"
 	h "github.com/hibiken/asynq/internal/asynqtest"
 	"github.com/hibiken/asynq/internal/base"
+	asynqcontext "github.com/hibiken/asynq/internal/context"
+	"github.com/hibiken/asynq/internal/errors"
 	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/hibiken/asynq/internal/testbroker"
 )
 
 var taskCmpOpts = []cmp.Option{
@@ -70,6 +74,7 @@ func newProcessorForTest(t *testing.T, r *rdb.RDB, h Handler) *processor {
 		strictPriority:  false,
 		errHandler:      nil,
 		shutdownTimeout: defaultShutdownTimeout,
+		pollInterval:    time.Second,
 		starting:        starting,
 		finished:        finished,
 	})
@@ -299,6 +304,7 @@ func TestProcessorRetry(t *testing.T) {
 		wantErrMsg   string              // error message the task should record
 		wantRetry    []*base.TaskMessage // tasks in retry queue at the end
 		wantArchived []*base.TaskMessage // tasks in archived queue at the end
+		wantReason   string              // archive reason the archived tasks should record
 		wantErrCount int                 // number of times error handler should be called
 	}{
 		{
@@ -312,6 +318,7 @@ func TestProcessorRetry(t *testing.T) {
 			wantErrMsg:   errMsg,
 			wantRetry:    []*base.TaskMessage{m2, m3, m4},
 			wantArchived: []*base.TaskMessage{m1},
+			wantReason:   base.ArchiveReasonMaxRetry,
 			wantErrCount: 4,
 		},
 		{
@@ -325,6 +332,7 @@ func TestProcessorRetry(t *testing.T) {
 			wantErrMsg:   SkipRetry.Error(),
 			wantRetry:    []*base.TaskMessage{},
 			wantArchived: []*base.TaskMessage{m1, m2},
+			wantReason:   base.ArchiveReasonSkipRetry,
 			wantErrCount: 2, // ErrorHandler should still be called with SkipRetry error
 		},
 		{
@@ -338,6 +346,7 @@ func TestProcessorRetry(t *testing.T) {
 			wantErrMsg:   wrappedSkipRetry.Error(),
 			wantRetry:    []*base.TaskMessage{},
 			wantArchived: []*base.TaskMessage{m1, m2},
+			wantReason:   base.ArchiveReasonSkipRetry,
 			wantErrCount: 2, // ErrorHandler should still be called with SkipRetry error
 		},
 	}
@@ -387,7 +396,7 @@ func TestProcessorRetry(t *testing.T) {
 		for _, msg := range tc.wantArchived {
 			wantArchived = append(wantArchived,
 				base.Z{
-					Message: h.TaskMessageWithError(*msg, tc.wantErrMsg, runTime),
+					Message: h.TaskMessageAfterArchive(*msg, tc.wantErrMsg, tc.wantReason, runTime),
 					Score:   runTime.Unix(),
 				})
 		}
@@ -405,6 +414,416 @@ func TestProcessorRetry(t *testing.T) {
 	}
 }
 
+func TestProcessorRetryIn(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	rdbClient := rdb.NewRDB(r)
+
+	now := time.Now()
+	tests := []struct {
+		desc      string
+		err       error
+		wantScore int64 // score of the task in the retry zset
+	}{
+		{
+			desc:      "RetryIn",
+			err:       RetryIn(errors.New("rate limited"), 2*time.Hour),
+			wantScore: now.Add(2 * time.Hour).Unix(),
+		},
+		{
+			desc:      "wrapped RetryAt",
+			err:       fmt.Errorf("request failed: %w", RetryAt(errors.New("rate limited"), now.Add(3*time.Hour))),
+			wantScore: now.Add(3 * time.Hour).Unix(),
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r)
+		msg := h.NewTaskMessage("task", nil)
+		h.SeedPendingQueue(t, r, []*base.TaskMessage{msg}, base.DefaultQueueName)
+
+		handler := func(ctx context.Context, task *Task) error { return tc.err }
+		p := newProcessorForTest(t, rdbClient, HandlerFunc(handler))
+		p.retryDelayFunc = func(n int, e error, t *Task) time.Duration { return time.Minute }
+
+		p.start(&sync.WaitGroup{})
+		time.Sleep(time.Second)
+		p.shutdown()
+
+		retry := h.GetRetryEntries(t, r, base.DefaultQueueName)
+		if len(retry) != 1 {
+			t.Errorf("%s: got %d tasks in retry queue, want 1", tc.desc, len(retry))
+			continue
+		}
+		if diff := retry[0].Score - tc.wantScore; diff < -2 || diff > 2 {
+			t.Errorf("%s: task is retried at %v, want %v", tc.desc, time.Unix(retry[0].Score, 0), time.Unix(tc.wantScore, 0))
+		}
+		if retry[0].Message.ErrorMsg != tc.err.Error() {
+			t.Errorf("%s: error message = %q, want %q", tc.desc, retry[0].Message.ErrorMsg, tc.err.Error())
+		}
+	}
+}
+
+func TestProcessorUnhandledTaskPolicy(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	rdbClient := rdb.NewRDB(r)
+
+	tests := []struct {
+		policy        UnhandledTaskPolicy
+		wantRetry     int
+		wantArchived  int
+		wantUnhandled int
+	}{
+		{policy: RetryUnhandled, wantRetry: 1},
+		{policy: ParkUnhandled, wantUnhandled: 1},
+		{policy: ArchiveUnhandled, wantArchived: 1},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r)
+		msg := h.NewTaskMessage("image:resize", nil)
+		h.SeedPendingQueue(t, r, []*base.TaskMessage{msg}, base.DefaultQueueName)
+
+		mux := NewServeMux()
+		mux.HandleFunc("email:send", func(ctx context.Context, task *Task) error { return nil })
+		p := newProcessorForTest(t, rdbClient, mux)
+		p.unhandledPolicy = tc.policy
+
+		p.start(&sync.WaitGroup{})
+		time.Sleep(time.Second)
+		p.shutdown()
+
+		if got := len(h.GetRetryMessages(t, r, base.DefaultQueueName)); got != tc.wantRetry {
+			t.Errorf("policy=%d: got %d retry tasks, want %d", tc.policy, got, tc.wantRetry)
+		}
+		archived := h.GetArchivedMessages(t, r, base.DefaultQueueName)
+		if len(archived) != tc.wantArchived {
+			t.Errorf("policy=%d: got %d archived tasks, want %d", tc.policy, len(archived), tc.wantArchived)
+		} else if len(archived) == 1 && archived[0].ArchiveReason != ArchiveReasonNoHandler {
+			t.Errorf("policy=%d: archive reason = %q, want %q", tc.policy, archived[0].ArchiveReason, ArchiveReasonNoHandler)
+		}
+		unhandled := h.GetUnhandledMessages(t, r, base.DefaultQueueName)
+		if len(unhandled) != tc.wantUnhandled {
+			t.Errorf("policy=%d: got %d unhandled tasks, want %d", tc.policy, len(unhandled), tc.wantUnhandled)
+		} else if len(unhandled) == 1 && unhandled[0].Retried != 0 {
+			t.Errorf("policy=%d: parked task has Retried=%d, want 0", tc.policy, unhandled[0].Retried)
+		}
+		if n, _ := r.Get(context.Background(), base.UnhandledTotalKey(base.DefaultQueueName)).Int(); n != 1 {
+			t.Errorf("policy=%d: unhandled total = %d, want 1", tc.policy, n)
+		}
+	}
+}
+
+func TestProcessorCheckpoint(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	rdbClient := rdb.NewRDB(r)
+	h.FlushDB(t, r)
+	msg := h.NewTaskMessage("import", nil)
+	h.SeedPendingQueue(t, r, []*base.TaskMessage{msg}, base.DefaultQueueName)
+
+	var (
+		mu          sync.Mutex
+		checkpoints []string // checkpoint read by each attempt; empty if there was none.
+	)
+	handler := func(ctx context.Context, task *Task) error {
+		data, _ := GetCheckpoint(ctx)
+		mu.Lock()
+		checkpoints = append(checkpoints, string(data))
+		mu.Unlock()
+		if err := Checkpoint(ctx, []byte("offset=42")); err != nil {
+			return err
+		}
+		return errors.New("interrupted")
+	}
+	for i := 0; i < 2; i++ {
+		p := newProcessorForTest(t, rdbClient, HandlerFunc(handler))
+		p.start(&sync.WaitGroup{})
+		time.Sleep(time.Second)
+		p.shutdown()
+		// Move the retried task back to the pending state to process it again.
+		if err := rdbClient.RunTask(base.DefaultQueueName, msg.ID); err != nil {
+			t.Fatalf("RunTask returned error: %v", err)
+		}
+	}
+
+	want := []string{"", "offset=42"}
+	mu.Lock()
+	defer mu.Unlock()
+	if diff := cmp.Diff(want, checkpoints); diff != "" {
+		t.Errorf("checkpoints read by handler mismatch (-want,+got):\n%s", diff)
+	}
+	if err := Checkpoint(context.Background(), nil); err == nil {
+		t.Errorf("Checkpoint with background context returned nil error, want non-nil error")
+	}
+}
+
+func TestProcessorReportProgress(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	msg := h.NewTaskMessage("export", nil)
+	h.SeedPendingQueue(t, r, []*base.TaskMessage{msg}, base.DefaultQueueName)
+
+	reported := make(chan struct{})
+	handler := func(ctx context.Context, task *Task) error {
+		if err := ReportProgress(ctx, []byte("50")); err != nil {
+			return err
+		}
+		close(reported)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	p := newProcessorForTest(t, rdb.NewRDB(r), HandlerFunc(handler))
+	p.start(&sync.WaitGroup{})
+	defer p.shutdown()
+
+	select {
+	case <-reported:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler did not report progress")
+	}
+	inspector := NewInspector(getRedisConnOpt(t))
+	tasks, err := inspector.ListActiveTasks(base.DefaultQueueName)
+	if err != nil {
+		t.Fatalf("ListActiveTasks returned error: %v", err)
+	}
+	if len(tasks) != 1 || string(tasks[0].Progress) != "50" {
+		t.Errorf("ListActiveTasks returned %v, want the task with progress %q", tasks, "50")
+	}
+	if err := ReportProgress(context.Background(), nil); err == nil {
+		t.Errorf("ReportProgress with background context returned nil error, want non-nil error")
+	}
+}
+
+func TestProcessorUsesCachedResult(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	m1 := h.NewTaskMessage("report:generate", nil)
+	m1.IdempotencyKey = "report:2021-06"
+	m2 := h.NewTaskMessage("report:generate", nil)
+	m2.IdempotencyKey = m1.IdempotencyKey
+	m2.Retention = 3600
+	m3 := h.NewTaskMessage("report:generate", nil)
+	m3.IdempotencyKey = "report:2021-07"
+	h.SeedPendingQueue(t, r, []*base.TaskMessage{m1}, base.DefaultQueueName)
+
+	var calls int32
+	handler := func(ctx context.Context, task *Task) error {
+		atomic.AddInt32(&calls, 1)
+		_, err := task.ResultWriter().Write([]byte("s3://reports/" + task.ResultWriter().TaskID()))
+		return err
+	}
+	p := newProcessorForTest(t, rdb.NewRDB(r), HandlerFunc(handler))
+	p.resultCacheTTL = map[string]time.Duration{"report:generate": time.Hour}
+	p.start(&sync.WaitGroup{})
+	time.Sleep(time.Second)
+	h.SeedPendingQueue(t, r, []*base.TaskMessage{m2, m3}, base.DefaultQueueName)
+	time.Sleep(2 * time.Second)
+	p.shutdown()
+
+	// m1 and m3 run the handler, m2 uses the result of m1.
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("handler was called %d times, want 2", n)
+	}
+	info, err := rdb.NewRDB(r).GetTaskInfo(base.DefaultQueueName, m2.ID)
+	if err != nil {
+		t.Fatalf("GetTaskInfo returned error: %v", err)
+	}
+	if info.State != base.TaskStateCompleted || string(info.Result) != "s3://reports/"+m1.ID {
+		t.Errorf("task %s has state %v and result %q, want completed with result %q",
+			m2.ID, info.State, info.Result, "s3://reports/"+m1.ID)
+	}
+}
+
+func TestProcessorRetryWindow(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	msg := h.NewTaskMessage("partner:sync", nil)
+	h.SeedPendingQueue(t, r, []*base.TaskMessage{msg}, base.DefaultQueueName)
+
+	// The window opens for the entire day after tomorrow.
+	now := time.Now().UTC()
+	opens := time.Date(now.Year(), now.Month(), now.Day()+2, 0, 0, 0, 0, time.UTC)
+	p := newProcessorForTest(t, rdb.NewRDB(r), HandlerFunc(func(ctx context.Context, task *Task) error {
+		return errors.New("partner API is closed")
+	}))
+	p.retryWindows = map[string]RetryWindow{
+		base.DefaultQueueName: {Weekdays: []time.Weekday{opens.Weekday()}},
+	}
+	p.start(&sync.WaitGroup{})
+	time.Sleep(time.Second)
+	p.shutdown()
+
+	retry := h.GetRetryEntries(t, r, base.DefaultQueueName)
+	if len(retry) != 1 || retry[0].Score != opens.Unix() {
+		t.Errorf("retry entries = %v, want the task retried at %v", retry, opens)
+	}
+}
+
+func TestProcessorRetryPolicy(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	defaultRetry := h.NewTaskMessage("report:generate", nil)
+	defaultRetry.DefaultRetry = true
+	taskRetry := h.NewTaskMessage("report:generate", nil)
+	h.SeedPendingQueue(t, r, []*base.TaskMessage{defaultRetry, taskRetry}, base.DefaultQueueName)
+
+	var (
+		mu         sync.Mutex
+		maxRetries = make(map[string]int) // max retry reported to the handler, by task ID
+	)
+	p := newProcessorForTest(t, rdb.NewRDB(r), HandlerFunc(func(ctx context.Context, task *Task) error {
+		id, _ := GetTaskID(ctx)
+		n, _ := GetMaxRetry(ctx)
+		mu.Lock()
+		defer mu.Unlock()
+		maxRetries[id] = n
+		return errors.New("failed")
+	}))
+	p.retryPolicies = retryPolicies{
+		base.DefaultQueueName: {
+			MaxRetry:  -1,
+			DelayFunc: func(n int, err error, t *Task) time.Duration { return time.Hour },
+		},
+	}
+	start := time.Now()
+	p.start(&sync.WaitGroup{})
+	time.Sleep(time.Second)
+	p.shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if n := maxRetries[defaultRetry.ID]; n != 0 {
+		t.Errorf("handler got max retry %d for the task with the default max retry, want 0", n)
+	}
+	if n := maxRetries[taskRetry.ID]; n != taskRetry.Retry {
+		t.Errorf("handler got max retry %d for the task with its own max retry, want %d", n, taskRetry.Retry)
+	}
+	archived := h.GetArchivedEntries(t, r, base.DefaultQueueName)
+	if len(archived) != 1 || archived[0].Message.ID != defaultRetry.ID {
+		t.Errorf("archived entries = %v, want the task with the default max retry", archived)
+	}
+	retry := h.GetRetryEntries(t, r, base.DefaultQueueName)
+	if len(retry) != 1 || retry[0].Message.ID != taskRetry.ID {
+		t.Fatalf("retry entries = %v, want the task with its own max retry", retry)
+	}
+	if at := time.Unix(retry[0].Score, 0); at.Before(start.Add(time.Hour - time.Second)) {
+		t.Errorf("task retried at %v, want an hour after %v", at, start)
+	}
+}
+
+func TestProcessorVerifiesSignature(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	key := []byte("secret")
+	signed := h.NewTaskMessage("email:send", []byte("to=user"))
+	base.SignMessage(signed, key)
+	tampered := h.NewTaskMessage("email:send", []byte("to=user"))
+	base.SignMessage(tampered, key)
+	tampered.Payload = []byte("to=attacker")
+	unsigned := h.NewTaskMessage("email:send", []byte("to=user"))
+	h.SeedPendingQueue(t, r, []*base.TaskMessage{signed, tampered, unsigned}, base.DefaultQueueName)
+
+	var (
+		mu        sync.Mutex
+		processed []string // IDs of the tasks passed to the handler
+		reported  []string // IDs of the tasks reported to the error handler
+	)
+	p := newProcessorForTest(t, rdb.NewRDB(r), HandlerFunc(func(ctx context.Context, task *Task) error {
+		id, _ := GetTaskID(ctx)
+		mu.Lock()
+		defer mu.Unlock()
+		processed = append(processed, id)
+		return nil
+	}))
+	p.signingKey = key
+	p.errHandler = ErrorHandlerFunc(func(ctx context.Context, task *Task, err error) {
+		if !errors.Is(err, ErrBadSignature) {
+			t.Errorf("error handler called with %v, want ErrBadSignature", err)
+		}
+		id, _ := GetTaskID(ctx)
+		mu.Lock()
+		defer mu.Unlock()
+		reported = append(reported, id)
+	})
+	p.start(&sync.WaitGroup{})
+	time.Sleep(time.Second)
+	p.shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if diff := cmp.Diff([]string{signed.ID}, processed); diff != "" {
+		t.Errorf("tasks processed mismatch (-want,+got):\n%s", diff)
+	}
+	sortIDs := cmpopts.SortSlices(func(a, b string) bool { return a < b })
+	if diff := cmp.Diff([]string{tampered.ID, unsigned.ID}, reported, sortIDs); diff != "" {
+		t.Errorf("tasks reported to the error handler mismatch (-want,+got):\n%s", diff)
+	}
+	// Tasks with a bad signature are quarantined, so that they cannot be run from the archive.
+	if got := h.GetArchivedMessages(t, r, base.DefaultQueueName); len(got) != 0 {
+		t.Errorf("got %d archived tasks, want 0", len(got))
+	}
+	entries, err := rdb.NewRDB(r).ListQuarantined(base.DefaultQueueName, rdb.Pagination{Size: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var quarantined []string
+	for _, e := range entries {
+		if e.State != "active" {
+			t.Errorf("task id=%s quarantined from %q, want %q", e.ID, e.State, "active")
+		}
+		quarantined = append(quarantined, e.ID)
+	}
+	if diff := cmp.Diff([]string{tampered.ID, unsigned.ID}, quarantined, sortIDs); diff != "" {
+		t.Errorf("quarantined tasks mismatch (-want,+got):\n%s", diff)
+	}
+	if got := h.GetActiveMessages(t, r, base.DefaultQueueName); len(got) != 0 {
+		t.Errorf("got %d active tasks, want 0", len(got))
+	}
+}
+
+func TestProcessorAckSurvivesRedisOutage(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	rdbClient := rdb.NewRDB(r)
+	testBroker := testbroker.NewTestBroker(rdbClient)
+	h.FlushDB(t, r)
+	msg := h.NewTaskMessage("import", nil)
+	msg.Timeout = 2 // the outage outlasts the deadline of the task.
+	h.SeedPendingQueue(t, r, []*base.TaskMessage{msg}, base.DefaultQueueName)
+
+	release := make(chan struct{})
+	handler := func(ctx context.Context, task *Task) error {
+		<-release
+		return nil
+	}
+	p := newProcessorForTest(t, rdbClient, HandlerFunc(handler))
+	p.broker = testBroker
+	syncCh := make(chan *syncRequest)
+	p.syncRequestCh = syncCh
+	syncer := newSyncer(syncerParams{logger: testLogger, requestsCh: syncCh, interval: 100 * time.Millisecond})
+	var wg sync.WaitGroup
+	syncer.start(&wg)
+	defer syncer.shutdown()
+
+	p.start(&sync.WaitGroup{})
+	time.Sleep(200 * time.Millisecond) // wait for the task to be dequeued.
+	testBroker.Sleep()                 // simulate redis failing over.
+	close(release)
+	time.Sleep(3 * time.Second)
+	testBroker.Wakeup()
+	time.Sleep(500 * time.Millisecond)
+	p.shutdown()
+
+	if n := len(h.GetActiveMessages(t, r, base.DefaultQueueName)); n != 0 {
+		t.Errorf("got %d active tasks after redis recovered, want 0", n)
+	}
+	if n := r.Exists(context.Background(), base.TaskKey(msg.Queue, msg.ID)).Val(); n != 0 {
+		t.Errorf("task %s still exists after redis recovered, want it to be deleted", msg.ID)
+	}
+}
+
 func TestProcessorMarkAsComplete(t *testing.T) {
 	r := setup(t)
 	defer r.Close()
@@ -480,6 +899,792 @@ func TestProcessorMarkAsComplete(t *testing.T) {
 	}
 }
 
+func TestProcessorBaseContext(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	rdbClient := rdb.NewRDB(r)
+
+	type ctxKey struct{}
+	msg := h.NewTaskMessage("task1", nil)
+	h.SeedPendingQueue(t, r, []*base.TaskMessage{msg}, base.DefaultQueueName)
+
+	var mu sync.Mutex
+	var gotVal interface{}
+	var gotID string
+	handler := func(ctx context.Context, task *Task) error {
+		mu.Lock()
+		defer mu.Unlock()
+		gotVal = ctx.Value(ctxKey{})
+		gotID, _ = GetTaskID(ctx)
+		return nil
+	}
+	p := newProcessorForTest(t, rdbClient, HandlerFunc(handler))
+	p.baseCtxFn = func() context.Context {
+		return context.WithValue(context.Background(), ctxKey{}, "base")
+	}
+
+	p.start(&sync.WaitGroup{})
+	time.Sleep(2 * time.Second)
+	p.shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if gotVal != "base" {
+		t.Errorf("context value in Handler = %v, want %q", gotVal, "base")
+	}
+	if gotID != msg.ID {
+		t.Errorf("GetTaskID returned %q, want %q", gotID, msg.ID)
+	}
+}
+
+func TestProcessorSetConcurrency(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	rdbClient := rdb.NewRDB(r)
+
+	var msgs []*base.TaskMessage
+	for i := 0; i < 3; i++ {
+		msgs = append(msgs, h.NewTaskMessage("task", nil))
+	}
+	h.SeedPendingQueue(t, r, msgs, base.DefaultQueueName)
+
+	var (
+		mu        sync.Mutex
+		active    int
+		maxActive int
+		processed int
+	)
+	handler := func(ctx context.Context, task *Task) error {
+		mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mu.Unlock()
+		time.Sleep(200 * time.Millisecond)
+		mu.Lock()
+		active--
+		processed++
+		mu.Unlock()
+		return nil
+	}
+	p := newProcessorForTest(t, rdbClient, HandlerFunc(handler))
+	p.setConcurrency(1)
+
+	p.start(&sync.WaitGroup{})
+	time.Sleep(2 * time.Second)
+	p.shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if maxActive != 1 {
+		t.Errorf("maximum number of active workers = %d, want 1", maxActive)
+	}
+	if processed != len(msgs) {
+		t.Errorf("processed %d tasks, want %d", processed, len(msgs))
+	}
+}
+
+func TestProcessorQueueLimits(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	rdbClient := rdb.NewRDB(r)
+
+	var low, high []*base.TaskMessage
+	for i := 0; i < 3; i++ {
+		low = append(low, h.NewTaskMessageWithQueue("low_task", nil, "low"))
+		high = append(high, h.NewTaskMessageWithQueue("high_task", nil, "high"))
+	}
+	h.SeedAllPendingQueues(t, r, map[string][]*base.TaskMessage{"low": low, "high": high})
+
+	var (
+		mu        sync.Mutex
+		active    = make(map[string]int)
+		maxActive = make(map[string]int)
+		processed int
+	)
+	handler := func(ctx context.Context, task *Task) error {
+		qname, _ := GetQueueName(ctx)
+		mu.Lock()
+		active[qname]++
+		if active[qname] > maxActive[qname] {
+			maxActive[qname] = active[qname]
+		}
+		mu.Unlock()
+		time.Sleep(200 * time.Millisecond)
+		mu.Lock()
+		active[qname]--
+		processed++
+		mu.Unlock()
+		return nil
+	}
+	p := newProcessorForTest(t, rdbClient, HandlerFunc(handler))
+	p.queueConfig = map[string]int{"low": 1, "high": 1}
+	p.queueLimits = newWorkerLimits(map[string]int{"low": 1})
+
+	p.start(&sync.WaitGroup{})
+	time.Sleep(2 * time.Second)
+	p.shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if maxActive["low"] != 1 {
+		t.Errorf("maximum number of active workers for queue %q = %d, want 1", "low", maxActive["low"])
+	}
+	if maxActive["high"] != len(high) {
+		t.Errorf("maximum number of active workers for queue %q = %d, want %d", "high", maxActive["high"], len(high))
+	}
+	if want := len(low) + len(high); processed != want {
+		t.Errorf("processed %d tasks, want %d", processed, want)
+	}
+}
+
+func TestProcessorClassLimits(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	rdbClient := rdb.NewRDB(r)
+
+	var cpu, io []*base.TaskMessage
+	for i := 0; i < 3; i++ {
+		msg := h.NewTaskMessage("transcode", nil)
+		msg.Class = "cpu"
+		cpu = append(cpu, msg)
+	}
+	for i := 0; i < 3; i++ {
+		msg := h.NewTaskMessage("webhook", nil)
+		msg.Class = "io"
+		io = append(io, msg)
+	}
+	// CPU-bound tasks are ahead of the IO-bound tasks in the queue.
+	for _, msg := range append(cpu, io...) {
+		if err := rdbClient.Enqueue(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		mu        sync.Mutex
+		active    = make(map[string]int)
+		maxActive = make(map[string]int)
+		processed int
+	)
+	handler := func(ctx context.Context, task *Task) error {
+		mu.Lock()
+		active[task.Type()]++
+		if active[task.Type()] > maxActive[task.Type()] {
+			maxActive[task.Type()] = active[task.Type()]
+		}
+		mu.Unlock()
+		time.Sleep(200 * time.Millisecond)
+		mu.Lock()
+		active[task.Type()]--
+		processed++
+		mu.Unlock()
+		return nil
+	}
+	p := newProcessorForTest(t, rdbClient, HandlerFunc(handler))
+	p.classLimits = newWorkerLimits(map[string]int{"cpu": 1})
+
+	p.start(&sync.WaitGroup{})
+	time.Sleep(2 * time.Second)
+	p.shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if maxActive["transcode"] != 1 {
+		t.Errorf("maximum number of active workers for class %q = %d, want 1", "cpu", maxActive["transcode"])
+	}
+	if maxActive["webhook"] != len(io) {
+		t.Errorf("maximum number of active workers for class %q = %d, want %d", "io", maxActive["webhook"], len(io))
+	}
+	if want := len(cpu) + len(io); processed != want {
+		t.Errorf("processed %d tasks, want %d", processed, want)
+	}
+}
+
+func TestProcessorLabels(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	rdbClient := rdb.NewRDB(r)
+	gpu := h.NewTaskMessage("train", nil)
+	gpu.Labels = map[string]string{"gpu": "true"}
+	plain := h.NewTaskMessage("plain", nil)
+	// The task which requires a GPU is ahead of the other task in the queue.
+	for _, msg := range []*base.TaskMessage{gpu, plain} {
+		if err := rdbClient.Enqueue(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run := func(labels []string) []string {
+		var (
+			mu        sync.Mutex
+			processed []string
+		)
+		handler := func(ctx context.Context, task *Task) error {
+			mu.Lock()
+			defer mu.Unlock()
+			processed = append(processed, task.ResultWriter().TaskID())
+			return nil
+		}
+		p := newProcessorForTest(t, rdbClient, HandlerFunc(handler))
+		p.labels = labels
+		p.start(&sync.WaitGroup{})
+		time.Sleep(time.Second)
+		p.shutdown()
+		mu.Lock()
+		defer mu.Unlock()
+		return processed
+	}
+
+	if got := run(nil); len(got) != 1 || got[0] != plain.ID {
+		t.Errorf("processor without labels processed %v, want task %s only", got, plain.ID)
+	}
+	if got := run([]string{"gpu=true"}); len(got) != 1 || got[0] != gpu.ID {
+		t.Errorf("processor with label gpu=true processed %v, want task %s", got, gpu.ID)
+	}
+}
+
+func TestProcessorPausesFailingQueue(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	rdbClient := rdb.NewRDB(r)
+	var msgs []*base.TaskMessage
+	for i := 0; i < 10; i++ {
+		msgs = append(msgs, h.NewTaskMessage("webhook", nil))
+	}
+	h.SeedPendingQueue(t, r, msgs, base.DefaultQueueName)
+
+	var (
+		mu        sync.Mutex
+		processed int
+	)
+	handler := func(ctx context.Context, task *Task) error {
+		mu.Lock()
+		defer mu.Unlock()
+		processed++
+		return fmt.Errorf("connection refused")
+	}
+	p := newProcessorForTest(t, rdbClient, HandlerFunc(handler))
+	p.setConcurrency(1)
+	p.queueBreaker = newQueueBreaker(0.5, 4)
+	p.queueCoolOff = time.Minute
+
+	p.start(&sync.WaitGroup{})
+	time.Sleep(time.Second)
+	p.shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if processed != 4 {
+		t.Errorf("processed %d tasks, want 4 before the queue is paused", processed)
+	}
+	key := base.PausedKey(base.DefaultQueueName)
+	if ttl := r.TTL(context.Background(), key).Val(); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("TTL of %q = %v, want the queue paused for the cool-off period", key, ttl)
+	}
+	if n := len(h.GetPendingMessages(t, r, base.DefaultQueueName)); n != 6 {
+		t.Errorf("got %d pending tasks, want 6", n)
+	}
+}
+
+func TestQueueLimits(t *testing.T) {
+	l := newWorkerLimits(map[string]int{"low": 1, "default": 2})
+	qnames := []string{"critical", "default", "low"}
+	if diff := cmp.Diff(qnames, l.available(qnames)); diff != "" {
+		t.Errorf("available returned unexpected queues; (-want,+got)\n%s", diff)
+	}
+	l.acquire("low")
+	l.acquire("default")
+	l.acquire("critical")
+	if diff := cmp.Diff([]string{"critical", "default"}, l.available(qnames)); diff != "" {
+		t.Errorf("available returned unexpected queues; (-want,+got)\n%s", diff)
+	}
+	l.acquire("default")
+	if diff := cmp.Diff([]string{"critical"}, l.available(qnames)); diff != "" {
+		t.Errorf("available returned unexpected queues; (-want,+got)\n%s", diff)
+	}
+	l.release("low")
+	if diff := cmp.Diff([]string{"critical", "low"}, l.available(qnames)); diff != "" {
+		t.Errorf("available returned unexpected queues; (-want,+got)\n%s", diff)
+	}
+
+	if diff := cmp.Diff([]string{"default"}, l.full()); diff != "" {
+		t.Errorf("full returned unexpected queues; (-want,+got)\n%s", diff)
+	}
+
+	var nilLimits *workerLimits
+	if diff := cmp.Diff(qnames, nilLimits.available(qnames)); diff != "" {
+		t.Errorf("available on nil limits returned unexpected queues; (-want,+got)\n%s", diff)
+	}
+	if got := nilLimits.full(); got != nil {
+		t.Errorf("full on nil limits returned %v, want nil", got)
+	}
+}
+
+func TestProcessorNextPollInterval(t *testing.T) {
+	p := &processor{pollInterval: time.Second, minPollInterval: 100 * time.Millisecond}
+	want := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	for i, d := range want {
+		if got := p.nextPollInterval(); got != d {
+			t.Errorf("nextPollInterval() #%d = %v, want %v", i, got, d)
+		}
+	}
+	// A task was found.
+	p.idleWait = 0
+	if got := p.nextPollInterval(); got != 100*time.Millisecond {
+		t.Errorf("nextPollInterval() after a task was found = %v, want %v", got, 100*time.Millisecond)
+	}
+
+	for _, min := range []time.Duration{0, time.Second, time.Minute} {
+		p := &processor{pollInterval: time.Second, minPollInterval: min}
+		for i := 0; i < 3; i++ {
+			if got := p.nextPollInterval(); got != time.Second {
+				t.Errorf("nextPollInterval() with minPollInterval %v = %v, want %v", min, got, time.Second)
+			}
+		}
+	}
+}
+
+func TestProcessorWakeup(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	rdbClient := rdb.NewRDB(r)
+
+	processed := make(chan string, 1)
+	handler := func(ctx context.Context, task *Task) error {
+		id, _ := GetTaskID(ctx)
+		processed <- id
+		return nil
+	}
+	p := newProcessorForTest(t, rdbClient, HandlerFunc(handler))
+	p.pollInterval = time.Minute
+
+	p.start(&sync.WaitGroup{})
+	defer p.shutdown()
+	// Let the processor find the queue empty and start waiting.
+	time.Sleep(500 * time.Millisecond)
+
+	msg := h.NewTaskMessage("task1", nil)
+	h.SeedPendingQueue(t, r, []*base.TaskMessage{msg}, base.DefaultQueueName)
+	p.wakeup("other") // not a queue of the processor, should be ignored.
+	select {
+	case id := <-processed:
+		t.Fatalf("processed task %q before the processor was woken up", id)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	p.wakeup(base.DefaultQueueName)
+	select {
+	case id := <-processed:
+		if id != msg.ID {
+			t.Errorf("processed task %q, want %q", id, msg.ID)
+		}
+	case <-time.After(time.Second):
+		t.Error("task was not processed after the processor was woken up")
+	}
+}
+
+func TestProcessorShutdownSignal(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	rdbClient := rdb.NewRDB(r)
+
+	msg := h.NewTaskMessage("task1", nil)
+	h.SeedPendingQueue(t, r, []*base.TaskMessage{msg}, base.DefaultQueueName)
+
+	started := make(chan struct{})
+	var (
+		mu       sync.Mutex
+		signaled bool
+		canceled bool
+	)
+	handler := func(ctx context.Context, task *Task) error {
+		close(started)
+		shutdown, ok := GetShutdownSignal(ctx)
+		if !ok {
+			return fmt.Errorf("no shutdown signal in context")
+		}
+		select {
+		case <-shutdown:
+			mu.Lock()
+			signaled = true
+			canceled = ctx.Err() != nil
+			mu.Unlock()
+			return nil // checkpoint and finish before the timeout.
+		case <-time.After(10 * time.Second):
+			return fmt.Errorf("shutdown signal not received")
+		}
+	}
+	p := newProcessorForTest(t, rdbClient, HandlerFunc(handler))
+	p.shutdownTimeout = 5 * time.Second
+
+	p.start(&sync.WaitGroup{})
+	<-started
+	start := time.Now()
+	p.shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !signaled {
+		t.Fatal("Handler did not receive the shutdown signal")
+	}
+	if canceled {
+		t.Error("context was canceled when the shutdown signal was received, want it canceled only after the timeout")
+	}
+	if elapsed := time.Since(start); elapsed >= p.shutdownTimeout {
+		t.Errorf("shutdown took %v, want less than the shutdown timeout %v", elapsed, p.shutdownTimeout)
+	}
+	if pending := h.GetPendingMessages(t, r, base.DefaultQueueName); len(pending) != 0 {
+		t.Errorf("task was pushed back to the queue: %v", pending)
+	}
+}
+
+// requeueRecorder is a broker which records the queues of the requeued tasks.
+type requeueRecorder struct {
+	base.Broker
+	mu     sync.Mutex
+	qnames []string
+}
+
+func (r *requeueRecorder) Requeue(msg *base.TaskMessage) error {
+	r.mu.Lock()
+	r.qnames = append(r.qnames, msg.Queue)
+	r.mu.Unlock()
+	return r.Broker.Requeue(msg)
+}
+
+func TestProcessorSamplesTasks(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	client := NewClient(getRedisConnOpt(t))
+	defer client.Close()
+	for _, payload := range []string{"hello", "hello world"} {
+		if _, err := client.Enqueue(NewTask("greet", []byte(payload))); err != nil {
+			t.Fatalf("Enqueue returned error: %v", err)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	p := newProcessorForTest(t, rdb.NewRDB(r), HandlerFunc(func(ctx context.Context, task *Task) error { return nil }))
+	p.sampleRate = 1
+	p.start(&sync.WaitGroup{})
+	time.Sleep(2 * time.Second)
+	p.shutdown()
+
+	stats, err := NewInspector(getRedisConnOpt(t)).TaskSampleStats(base.DefaultQueueName)
+	if err != nil {
+		t.Fatalf("TaskSampleStats returned error: %v", err)
+	}
+	greet := stats.ByType["greet"]
+	if len(stats.Samples) != 2 || greet == nil || greet.Count != 2 {
+		t.Fatalf("TaskSampleStats returned %d samples (%+v), want 2 samples of type %q", len(stats.Samples), stats.ByType, "greet")
+	}
+	if greet.MaxPayloadSize != 11 || greet.AvgPayloadSize != 8 {
+		t.Errorf("payload sizes are max=%d avg=%d, want max=11 avg=8", greet.MaxPayloadSize, greet.AvgPayloadSize)
+	}
+	if greet.MaxWaitTime < 10*time.Millisecond {
+		t.Errorf("max wait time is %v, want at least 10ms", greet.MaxWaitTime)
+	}
+	if *stats.Total != *greet {
+		t.Errorf("total summary %+v differs from the summary of the only type %+v", stats.Total, greet)
+	}
+}
+
+func TestProcessorTracksLatency(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	client := NewClient(getRedisConnOpt(t))
+	defer client.Close()
+	for i := 0; i < 2; i++ {
+		if _, err := client.Enqueue(NewTask("greet", nil)); err != nil {
+			t.Fatalf("Enqueue returned error: %v", err)
+		}
+	}
+	// A task seeded without the time it became pending is counted in the run time only.
+	h.SeedPendingQueue(t, r, []*base.TaskMessage{h.NewTaskMessage("greet", nil)}, base.DefaultQueueName)
+	time.Sleep(10 * time.Millisecond)
+
+	p := newProcessorForTest(t, rdb.NewRDB(r), HandlerFunc(func(ctx context.Context, task *Task) error {
+		time.Sleep(5 * time.Millisecond)
+		return nil
+	}))
+	p.trackLatency = true
+	p.start(&sync.WaitGroup{})
+	time.Sleep(2 * time.Second)
+	p.shutdown()
+
+	stats, err := NewInspector(getRedisConnOpt(t)).TaskLatencyStats(base.DefaultQueueName)
+	if err != nil {
+		t.Fatalf("TaskLatencyStats returned error: %v", err)
+	}
+	greet := stats.ByType["greet"]
+	if greet == nil || greet.Run.Count != 3 || greet.Wait.Count != 2 {
+		t.Fatalf("TaskLatencyStats returned %+v, want 3 run times and 2 wait times of type %q", stats.ByType, "greet")
+	}
+	if greet.Run.Mean() < 5*time.Millisecond {
+		t.Errorf("mean run time is %v, want at least 5ms", greet.Run.Mean())
+	}
+	if greet.Wait.Mean() < 10*time.Millisecond {
+		t.Errorf("mean wait time is %v, want at least 10ms", greet.Wait.Mean())
+	}
+	if stats.Total.Run.Count != 3 || stats.Total.Wait.Count != 2 {
+		t.Errorf("total latencies count %d run times and %d wait times, want 3 and 2", stats.Total.Run.Count, stats.Total.Wait.Count)
+	}
+}
+
+func TestProcessorShutdownRequeuesInPriorityOrder(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	rdbClient := rdb.NewRDB(r)
+
+	m1 := h.NewTaskMessageWithQueue("slow", nil, "low")
+	m2 := h.NewTaskMessageWithQueue("slow", nil, "critical")
+	m3 := h.NewTaskMessageWithQueue("quick", nil, "low")
+	h.SeedPendingQueue(t, r, []*base.TaskMessage{m1, m3}, "low")
+	h.SeedPendingQueue(t, r, []*base.TaskMessage{m2}, "critical")
+
+	started := make(chan struct{}, 3)
+	block := make(chan struct{})
+	defer close(block)
+	handler := func(ctx context.Context, task *Task) error {
+		started <- struct{}{}
+		if task.Type() == "quick" {
+			shutdown, _ := GetShutdownSignal(ctx)
+			<-shutdown
+			return nil
+		}
+		<-block
+		return nil
+	}
+	broker := &requeueRecorder{Broker: rdbClient}
+	p := newProcessorForTest(t, rdbClient, HandlerFunc(handler))
+	p.broker = broker
+	p.queueConfig = map[string]int{"low": 1, "critical": 3}
+	p.shutdownTimeout = time.Second
+
+	p.start(&sync.WaitGroup{})
+	for i := 0; i < 3; i++ {
+		<-started
+	}
+	p.shutdown()
+
+	if finished, requeued := p.shutdownStats(); finished != 1 || requeued != 2 {
+		t.Errorf("shutdownStats() = (%d, %d), want (1, 2)", finished, requeued)
+	}
+	if diff := cmp.Diff([]string{"critical", "low"}, broker.qnames); diff != "" {
+		t.Errorf("tasks requeued from queues mismatch (-want,+got):\n%s", diff)
+	}
+	for qname, want := range map[string]*base.TaskMessage{"low": m1, "critical": m2} {
+		pending := h.GetPendingMessages(t, r, qname)
+		if len(pending) != 1 || pending[0].ID != want.ID {
+			t.Errorf("pending tasks in queue %q = %v, want task %s", qname, pending, want.ID)
+		}
+	}
+}
+
+func TestProcessorAtMostOnce(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	rdbClient := rdb.NewRDB(r)
+
+	msg := h.NewTaskMessage("task1", nil)
+	msg.AtMostOnce = true
+	msg.Timeout = 1
+	h.SeedPendingQueue(t, r, []*base.TaskMessage{msg}, base.DefaultQueueName)
+
+	var (
+		mu    sync.Mutex
+		calls int
+	)
+	release := make(chan struct{})
+	handler := func(ctx context.Context, task *Task) error {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		<-release // ignores the cancelation of the context.
+		return nil
+	}
+	p := newProcessorForTest(t, rdbClient, HandlerFunc(handler))
+	p.retryDelayFunc = func(n int, err error, task *Task) time.Duration { return 0 }
+	p.start(&sync.WaitGroup{})
+	defer p.shutdown()
+
+	waitFor := func(desc string, cond func() bool) {
+		t.Helper()
+		for start := time.Now(); !cond(); time.Sleep(100 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("timed out waiting for %s", desc)
+			}
+		}
+	}
+	// The task is retried once its timeout is exceeded, while the handler is still running.
+	waitFor("the task to be retried", func() bool {
+		return len(h.GetRetryEntries(t, r, base.DefaultQueueName)) == 1
+	})
+	if err := rdbClient.ForwardIfReady(base.DefaultQueueName); err != nil {
+		t.Fatal(err)
+	}
+	// The retried task isn't dequeued while the first handler is running.
+	time.Sleep(time.Second)
+	if size, err := rdbClient.PendingSize(context.Background(), base.DefaultQueueName); err != nil || size != 1 {
+		t.Errorf("PendingSize returned (%d, %v), want (1, nil)", size, err)
+	}
+	mu.Lock()
+	if calls != 1 {
+		t.Errorf("handler was called %d times, want 1", calls)
+	}
+	mu.Unlock()
+
+	// The retried task is processed once the first handler returns.
+	close(release)
+	waitFor("the task to be processed again", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls == 2
+	})
+	waitFor("the started mark to be cleared", func() bool {
+		return r.Exists(context.Background(), base.StartedKey(msg.Queue, msg.ID)).Val() == 0
+	})
+}
+
+func TestProcessorRetriesTasksBeyondHandlerConcurrency(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	rdbClient := rdb.NewRDB(r)
+
+	m1 := h.NewTaskMessage("image:resize", nil)
+	m2 := h.NewTaskMessage("image:resize", nil)
+	h.SeedPendingQueue(t, r, []*base.TaskMessage{m1, m2}, base.DefaultQueueName)
+
+	release := make(chan struct{})
+	mux := NewServeMux()
+	mux.HandleFunc("image:resize", func(ctx context.Context, task *Task) error {
+		<-release
+		return nil
+	}, HandlerConcurrency(1))
+	p := newProcessorForTest(t, rdbClient, mux)
+	p.start(&sync.WaitGroup{})
+	defer p.shutdown()
+	defer close(release)
+
+	var retried []*base.TaskMessage
+	for start := time.Now(); len(retried) == 0; time.Sleep(100 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timed out waiting for the task beyond the limit to be retried")
+		}
+		retried = h.GetRetryMessages(t, r, base.DefaultQueueName)
+	}
+	if len(retried) != 1 || retried[0].Retried != 0 {
+		t.Errorf("retry tasks = %v, want one task retried without counting a failure", retried)
+	}
+	if n := r.Get(context.Background(), base.FailedKey(base.DefaultQueueName, time.Now())).Val(); n != "" {
+		t.Errorf("failed count = %s, want none", n)
+	}
+}
+
+func TestProcessorArchivesAbortedTask(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	rdbClient := rdb.NewRDB(r)
+
+	msg := h.NewTaskMessage("report", nil)
+	h.SeedPendingQueue(t, r, []*base.TaskMessage{msg}, base.DefaultQueueName)
+
+	started := make(chan struct{})
+	p := newProcessorForTest(t, rdbClient, HandlerFunc(func(ctx context.Context, task *Task) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}))
+	p.start(&sync.WaitGroup{})
+	defer p.shutdown()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the task to start")
+	}
+	if !p.cancelations.Abort(msg.ID) {
+		t.Fatalf("(*Cancelations).Abort(%q) = false, want true", msg.ID)
+	}
+	var archived []*base.TaskMessage
+	for start := time.Now(); len(archived) == 0; time.Sleep(100 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timed out waiting for the aborted task to be archived")
+		}
+		archived = h.GetArchivedMessages(t, r, base.DefaultQueueName)
+	}
+	// The task is archived although it has retries left.
+	if archived[0].ID != msg.ID || archived[0].ArchiveReason != ArchiveReasonSkipRetry {
+		t.Errorf("archived task id=%s with reason %q, want id=%s with reason %q",
+			archived[0].ID, archived[0].ArchiveReason, msg.ID, ArchiveReasonSkipRetry)
+	}
+	if got := h.GetRetryMessages(t, r, base.DefaultQueueName); len(got) != 0 {
+		t.Errorf("got %d retry tasks, want 0", len(got))
+	}
+}
+
+func TestWorkerSema(t *testing.T) {
+	quit := make(chan struct{})
+	s := newWorkerSema(1)
+	if !s.acquire(quit) {
+		t.Fatal("acquire returned false, want true")
+	}
+
+	acquired := make(chan bool)
+	go func() { acquired <- s.acquire(quit) }()
+	select {
+	case <-acquired:
+		t.Fatal("acquire returned while the limit was reached")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Raising the limit should unblock the waiting goroutine.
+	s.setLimit(2)
+	select {
+	case ok := <-acquired:
+		if !ok {
+			t.Fatal("acquire returned false, want true")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("acquire did not return after the limit was raised")
+	}
+
+	// Lowering the limit blocks new acquisitions until enough tokens are released.
+	s.setLimit(1)
+	go func() { acquired <- s.acquire(quit) }()
+	s.release()
+	select {
+	case <-acquired:
+		t.Fatal("acquire returned while the number of active tokens reached the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(quit)
+	if ok := <-acquired; ok {
+		t.Error("acquire returned true after quit was closed, want false")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wait()
+		close(done)
+	}()
+	s.release()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("wait did not return after all tokens were released")
+	}
+}
+
 func TestProcessorQueues(t *testing.T) {
 	sortOpt := cmp.Transformer("SortStrings", func(in []string) []string {
 		out := append([]string(nil), in...) // Copy input to avoid mutating it
@@ -601,6 +1806,7 @@ func TestProcessorWithStrictPriority(t *testing.T) {
 			strictPriority:  true,
 			errHandler:      nil,
 			shutdownTimeout: defaultShutdownTimeout,
+			pollInterval:    time.Second,
 			starting:        starting,
 			finished:        finished,
 		})
@@ -673,6 +1879,48 @@ func TestProcessorPerform(t *testing.T) {
 	}
 }
 
+func TestProcessorPerformPanic(t *testing.T) {
+	msg := h.NewTaskMessage("gen_thumbnail", nil)
+	ctx, cancel := asynqcontext.New(context.Background(), msg, time.Now().Add(time.Minute))
+	defer cancel()
+	task := NewTask(msg.Type, msg.Payload)
+	handler := HandlerFunc(func(ctx context.Context, t *Task) error {
+		panic("something went terribly wrong")
+	})
+
+	p := newProcessorForTest(t, nil, handler)
+	err := p.perform(ctx, task)
+	var perr *PanicError
+	if !errors.As(err, &perr) {
+		t.Fatalf("perform() = %v, want *PanicError", err)
+	}
+	if perr.TaskID != msg.ID || perr.TaskType != msg.Type {
+		t.Errorf("PanicError has TaskID=%q TaskType=%q, want TaskID=%q TaskType=%q", perr.TaskID, perr.TaskType, msg.ID, msg.Type)
+	}
+	if perr.Value != "something went terribly wrong" {
+		t.Errorf("PanicError.Value = %v, want %q", perr.Value, "something went terribly wrong")
+	}
+	if len(perr.Stack) == 0 {
+		t.Errorf("PanicError.Stack is empty")
+	}
+
+	// With crashOnPanic, the error is reported and the panic is propagated.
+	var reported error
+	p.crashOnPanic = true
+	p.errHandler = ErrorHandlerFunc(func(ctx context.Context, t *Task, err error) { reported = err })
+	func() {
+		defer func() {
+			if x := recover(); x == nil {
+				t.Errorf("perform() did not panic with crashOnPanic set")
+			}
+		}()
+		p.perform(ctx, task)
+	}()
+	if !errors.As(reported, &perr) {
+		t.Errorf("ErrorHandler received %v, want *PanicError", reported)
+	}
+}
+
 func TestGCD(t *testing.T) {
 	tests := []struct {
 		input []int
@@ -6,6 +6,7 @@ package asynq
 
 import (
 	"context"
+	"fmt"
 	"sync"
 	"time"
 
@@ -13,12 +14,26 @@ import (
 	"github.com/hibiken/asynq/internal/log"
 )
 
+// ErrLeaseExpired is recorded as the error of a task whose deadline passed
+// without the server processing it reporting the outcome, e.g. because the
+// server crashed or lost its connection to redis.
+//
+// Unlike the errors returned by a Handler, it is unlikely to be caused by the task itself.
+// See Config.RetryLeaseExpired to retry such tasks once more instead of archiving them.
+//
+// ErrLeaseExpired wraps context.DeadlineExceeded.
+var ErrLeaseExpired = fmt.Errorf("asynq: task lease expired: %w", context.DeadlineExceeded)
+
 type recoverer struct {
 	logger         *log.Logger
 	broker         base.Broker
 	retryDelayFunc RetryDelayFunc
+	retryPolicies  retryPolicies
 	isFailureFunc  func(error) bool
 
+	// whether to retry a task whose lease expired on its last attempt once more.
+	retryLeaseExpired bool
+
 	// channel to communicate back to the long running "recoverer" goroutine.
 	done chan struct{}
 
@@ -35,7 +50,10 @@ type recovererParams struct {
 	queues         []string
 	interval       time.Duration
 	retryDelayFunc RetryDelayFunc
+	retryPolicies  retryPolicies
 	isFailureFunc  func(error) bool
+
+	retryLeaseExpired bool
 }
 
 func newRecoverer(params recovererParams) *recoverer {
@@ -46,7 +64,10 @@ func newRecoverer(params recovererParams) *recoverer {
 		queues:         params.queues,
 		interval:       params.interval,
 		retryDelayFunc: params.retryDelayFunc,
+		retryPolicies:  params.retryPolicies,
 		isFailureFunc:  params.isFailureFunc,
+
+		retryLeaseExpired: params.retryLeaseExpired,
 	}
 }
 
@@ -85,16 +106,24 @@ func (r *recoverer) recover() {
 		return
 	}
 	for _, msg := range msgs {
-		if msg.Retried >= msg.Retry {
-			r.archive(msg, context.DeadlineExceeded)
-		} else {
-			r.retry(msg, context.DeadlineExceeded)
+		maxRetry := r.retryPolicies.maxRetry(msg)
+		switch {
+		case msg.Retried < maxRetry:
+			r.retry(msg, ErrLeaseExpired)
+		case msg.Retried == maxRetry && r.retryLeaseExpired:
+			// Note: The retry count then exceeds the max retry count, so that
+			// the task is archived if this attempt fails too.
+			r.logger.Infof("recoverer: retrying task %s once more since its lease expired on its last attempt", msg.ID)
+			r.retry(msg, ErrLeaseExpired)
+		default:
+			r.archive(msg, ErrLeaseExpired)
 		}
 	}
 }
 
 func (r *recoverer) retry(msg *base.TaskMessage, err error) {
-	delay := r.retryDelayFunc(msg.Retried, err, NewTask(msg.Type, msg.Payload))
+	delayFunc := r.retryPolicies.delayFunc(msg.Queue, r.retryDelayFunc)
+	delay := delayFunc(msg.Retried, err, NewTask(msg.Type, msg.Payload))
 	retryAt := time.Now().Add(delay)
 	if err := r.broker.Retry(msg, retryAt, err.Error(), r.isFailureFunc(err)); err != nil {
 		r.logger.Warnf("recoverer: could not retry deadline exceeded task: %v", err)
@@ -102,7 +131,7 @@ func (r *recoverer) retry(msg *base.TaskMessage, err error) {
 }
 
 func (r *recoverer) archive(msg *base.TaskMessage, err error) {
-	if err := r.broker.Archive(msg, err.Error()); err != nil {
+	if err := r.broker.Archive(msg, err.Error(), base.ArchiveReasonDeadlineExceeded); err != nil {
 		r.logger.Warnf("recoverer: could not move task to archive: %v", err)
 	}
 }
@@ -5,6 +5,8 @@
 package asynq
 
 import (
+	"context"
+	"errors"
 	"sync"
 	"testing"
 	"time"
@@ -260,7 +262,7 @@ func TestRecoverer(t *testing.T) {
 			gotRetry := h.GetRetryMessages(t, r, qname)
 			var wantRetry []*base.TaskMessage // Note: construct message here since `LastFailedAt` is relative to each test run
 			for _, msg := range msgs {
-				wantRetry = append(wantRetry, h.TaskMessageAfterRetry(*msg, "context deadline exceeded", runTime))
+				wantRetry = append(wantRetry, h.TaskMessageAfterRetry(*msg, ErrLeaseExpired.Error(), runTime))
 			}
 			if diff := cmp.Diff(wantRetry, gotRetry, h.SortMsgOpt, cmpOpt); diff != "" {
 				t.Errorf("%s; mismatch found in %q: (-want, +got)\n%s", tc.desc, base.RetryKey(qname), diff)
@@ -270,7 +272,7 @@ func TestRecoverer(t *testing.T) {
 			gotArchived := h.GetArchivedMessages(t, r, qname)
 			var wantArchived []*base.TaskMessage
 			for _, msg := range msgs {
-				wantArchived = append(wantArchived, h.TaskMessageWithError(*msg, "context deadline exceeded", runTime))
+				wantArchived = append(wantArchived, h.TaskMessageAfterArchive(*msg, ErrLeaseExpired.Error(), base.ArchiveReasonDeadlineExceeded, runTime))
 			}
 			if diff := cmp.Diff(wantArchived, gotArchived, h.SortMsgOpt, cmpOpt); diff != "" {
 				t.Errorf("%s; mismatch found in %q: (-want, +got)\n%s", tc.desc, base.ArchivedKey(qname), diff)
@@ -278,3 +280,46 @@ func TestRecoverer(t *testing.T) {
 		}
 	}
 }
+
+func TestRecovererRetryLeaseExpired(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	rdbClient := rdb.NewRDB(r)
+
+	t1 := h.NewTaskMessageWithQueue("task1", nil, "default")
+	t1.Retried = t1.Retry // t1 has reached its max retry count
+	t2 := h.NewTaskMessageWithQueue("task2", nil, "default")
+	t2.Retried = t2.Retry + 1 // t2 has already been retried once more
+	fiveMinutesAgo := time.Now().Add(-5 * time.Minute)
+
+	h.SeedActiveQueue(t, r, []*base.TaskMessage{t1, t2}, "default")
+	h.SeedDeadlines(t, r, []base.Z{
+		{Message: t1, Score: fiveMinutesAgo.Unix()},
+		{Message: t2, Score: fiveMinutesAgo.Unix()},
+	}, "default")
+
+	recoverer := newRecoverer(recovererParams{
+		logger:            testLogger,
+		broker:            rdbClient,
+		queues:            []string{"default"},
+		interval:          1 * time.Second,
+		retryDelayFunc:    func(n int, err error, task *Task) time.Duration { return 30 * time.Second },
+		isFailureFunc:     defaultIsFailureFunc,
+		retryLeaseExpired: true,
+	})
+	runTime := time.Now()
+	recoverer.recover()
+
+	cmpOpt := h.EquateInt64Approx(2) // allow up to two-second difference in `LastFailedAt`
+	wantRetry := []*base.TaskMessage{h.TaskMessageAfterRetry(*t1, ErrLeaseExpired.Error(), runTime)}
+	if diff := cmp.Diff(wantRetry, h.GetRetryMessages(t, r, "default"), cmpOpt); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got)\n%s", base.RetryKey("default"), diff)
+	}
+	wantArchived := []*base.TaskMessage{h.TaskMessageAfterArchive(*t2, ErrLeaseExpired.Error(), base.ArchiveReasonDeadlineExceeded, runTime)}
+	if diff := cmp.Diff(wantArchived, h.GetArchivedMessages(t, r, "default"), cmpOpt); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got)\n%s", base.ArchivedKey("default"), diff)
+	}
+	if !errors.Is(ErrLeaseExpired, context.DeadlineExceeded) {
+		t.Errorf("ErrLeaseExpired does not wrap context.DeadlineExceeded")
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// PayloadRedactor returns the payload of a task of the given type as shown by
+// an Inspector, e.g. with the values of sensitive fields masked.
+// It must not modify the given payload.
+//
+// See InspectorConfig.RedactPayload.
+type PayloadRedactor func(typename string, payload []byte) []byte
+
+// RedactedValue replaces the values masked by RedactJSONFields.
+const RedactedValue = "[REDACTED]"
+
+// RedactJSONFields returns a PayloadRedactor which masks the values of the fields
+// of JSON payloads whose name contains any of the given names, ignoring case.
+// For example, RedactJSONFields("password", "token") masks the values of the fields
+// "password", "oldPassword" and "access_token", in nested objects as well.
+//
+// Payloads which are not JSON are replaced with RedactedValue entirely, since their
+// sensitive fields cannot be told apart. Empty payloads are returned as is.
+func RedactJSONFields(names ...string) PayloadRedactor {
+	lnames := make([]string, 0, len(names))
+	for _, name := range names {
+		if name != "" {
+			lnames = append(lnames, strings.ToLower(name))
+		}
+	}
+	sensitive := func(field string) bool {
+		field = strings.ToLower(field)
+		for _, name := range lnames {
+			if strings.Contains(field, name) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(typename string, payload []byte) []byte {
+		if len(payload) == 0 {
+			return payload
+		}
+		dec := json.NewDecoder(bytes.NewReader(payload))
+		dec.UseNumber()
+		var v interface{}
+		if err := dec.Decode(&v); err != nil || dec.More() {
+			return []byte(RedactedValue)
+		}
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(redactJSONValue(v, sensitive)); err != nil {
+			return []byte(RedactedValue)
+		}
+		return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+	}
+}
+
+// redactJSONValue returns v with the values of the object fields for which
+// sensitive reports true replaced with RedactedValue.
+func redactJSONValue(v interface{}, sensitive func(field string) bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for field, fv := range v {
+			if sensitive(field) {
+				v[field] = RedactedValue
+			} else {
+				v[field] = redactJSONValue(fv, sensitive)
+			}
+		}
+	case []interface{}:
+		for i, ev := range v {
+			v[i] = redactJSONValue(ev, sensitive)
+		}
+	}
+	return v
+}
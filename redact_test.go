@@ -0,0 +1,37 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import "testing"
+
+func TestRedactJSONFields(t *testing.T) {
+	redact := RedactJSONFields("password", "Token")
+	tests := []struct {
+		payload string
+		want    string
+	}{
+		{
+			payload: `{"user":"alice","password":"s3cret","attempts":3}`,
+			want:    `{"attempts":3,"password":"[REDACTED]","user":"alice"}`,
+		},
+		{
+			payload: `{"auth":{"access_token":"abc","scopes":["read"]},"items":[{"NewPassword":"x"}]}`,
+			want:    `{"auth":{"access_token":"[REDACTED]","scopes":["read"]},"items":[{"NewPassword":"[REDACTED]"}]}`,
+		},
+		{
+			payload: `{"amount":12345678901234567890,"note":"<b>&</b>"}`,
+			want:    `{"amount":12345678901234567890,"note":"<b>&</b>"}`,
+		},
+		{payload: `["password"]`, want: `["password"]`},
+		{payload: "user=alice password=s3cret", want: RedactedValue},
+		{payload: `{"a":1} {"b":2}`, want: RedactedValue},
+		{payload: "", want: ""},
+	}
+	for _, tc := range tests {
+		if got := string(redact("task", []byte(tc.payload))); got != tc.want {
+			t.Errorf("redact(%q) = %q, want %q", tc.payload, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import "github.com/hibiken/asynq/internal/base"
+
+// RetryPolicy specifies how the failed tasks of a queue are retried.
+// See Config.QueueRetryPolicies.
+//
+// Example to retry webhooks aggressively, and reports barely:
+//
+//	QueueRetryPolicies: map[string]asynq.RetryPolicy{
+//	    "webhooks": {MaxRetry: 50, DelayFunc: func(n int, err error, t *asynq.Task) time.Duration {
+//	        return 10 * time.Second
+//	    }},
+//	    "reports": {MaxRetry: 1},
+//	}
+type RetryPolicy struct {
+	// MaxRetry is the maximum number of retries of the tasks of the queue enqueued
+	// without the MaxRetry option. Tasks enqueued with the MaxRetry option keep
+	// their max retry.
+	//
+	// If zero, tasks keep the default max retry of the client. Use a negative
+	// value to not retry tasks.
+	MaxRetry int
+
+	// DelayFunc computes the delay before retrying the failed tasks of the queue,
+	// instead of Config.RetryDelayFunc.
+	//
+	// If nil, Config.RetryDelayFunc is used.
+	DelayFunc RetryDelayFunc
+}
+
+// retryPolicies maps queue names to their retry policy.
+type retryPolicies map[string]RetryPolicy
+
+// maxRetry returns the maximum number of retries of the task of the given message.
+func (rp retryPolicies) maxRetry(msg *base.TaskMessage) int {
+	p, ok := rp[msg.Queue]
+	if !ok || !msg.DefaultRetry || p.MaxRetry == 0 {
+		return msg.Retry
+	}
+	if p.MaxRetry < 0 {
+		return 0
+	}
+	return p.MaxRetry
+}
+
+// delayFunc returns the function computing the retry delay of the tasks of the
+// given queue, or fallback if the queue has no delay function.
+func (rp retryPolicies) delayFunc(qname string, fallback RetryDelayFunc) RetryDelayFunc {
+	if p, ok := rp[qname]; ok && p.DelayFunc != nil {
+		return p.DelayFunc
+	}
+	return fallback
+}
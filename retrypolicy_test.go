@@ -0,0 +1,83 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+func TestRetryPoliciesMaxRetry(t *testing.T) {
+	policies := retryPolicies{
+		"webhooks": {MaxRetry: 50},
+		"reports":  {MaxRetry: -1},
+		"emails":   {DelayFunc: DefaultRetryDelayFunc},
+	}
+
+	tests := []struct {
+		desc string
+		msg  *base.TaskMessage
+		want int
+	}{
+		{
+			desc: "default max retry in queue with a max retry",
+			msg:  &base.TaskMessage{Queue: "webhooks", Retry: 25, DefaultRetry: true},
+			want: 50,
+		},
+		{
+			desc: "max retry set for the task",
+			msg:  &base.TaskMessage{Queue: "webhooks", Retry: 3},
+			want: 3,
+		},
+		{
+			desc: "queue not retrying tasks",
+			msg:  &base.TaskMessage{Queue: "reports", Retry: 25, DefaultRetry: true},
+			want: 0,
+		},
+		{
+			desc: "queue without a max retry",
+			msg:  &base.TaskMessage{Queue: "emails", Retry: 25, DefaultRetry: true},
+			want: 25,
+		},
+		{
+			desc: "queue without a policy",
+			msg:  &base.TaskMessage{Queue: "default", Retry: 25, DefaultRetry: true},
+			want: 25,
+		},
+	}
+
+	for _, tc := range tests {
+		if got := policies.maxRetry(tc.msg); got != tc.want {
+			t.Errorf("%s: maxRetry() = %d, want %d", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestRetryPoliciesDelayFunc(t *testing.T) {
+	fallback := func(n int, err error, t *Task) time.Duration { return time.Minute }
+	policies := retryPolicies{
+		"webhooks": {DelayFunc: func(n int, err error, t *Task) time.Duration { return time.Second }},
+		"reports":  {MaxRetry: 1},
+	}
+
+	tests := []struct {
+		qname string
+		want  time.Duration
+	}{
+		{"webhooks", time.Second},
+		{"reports", time.Minute},
+		{"default", time.Minute},
+	}
+
+	for _, tc := range tests {
+		d := policies.delayFunc(tc.qname, fallback)(1, errors.New("failed"), NewTask("task", nil))
+		if d != tc.want {
+			t.Errorf("delayFunc(%q) returned a delay of %v, want %v", tc.qname, d, tc.want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import "time"
+
+// RetryWindow specifies the hours of the day, and optionally the days of the week,
+// within which the retries of a queue may be processed. See Config.RetryWindows.
+//
+// Example to retry only on weekdays between 08:00 and 20:00 Jakarta time:
+//
+//	RetryWindow{
+//	    Start:    8 * time.Hour,
+//	    End:      20 * time.Hour,
+//	    Weekdays: []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+//	    Location: jakarta, // loaded with time.LoadLocation("Asia/Jakarta")
+//	}
+type RetryWindow struct {
+	// Start and End are the times of day the window opens and closes, as offsets
+	// from midnight between 0 and 24 hours (e.g. 8*time.Hour for 08:00).
+	//
+	// If End is before Start, the window spans midnight (e.g. 22:00 to 06:00),
+	// and if End equals Start, the window lasts the entire day.
+	Start time.Duration
+	End   time.Duration
+
+	// Weekdays are the days of the week on which the window opens.
+	// For a window spanning midnight, it's the day the window opens.
+	//
+	// If empty, the window opens on every day.
+	Weekdays []time.Weekday
+
+	// Location is the time zone Start, End and Weekdays are interpreted in.
+	//
+	// If nil, UTC is used.
+	Location *time.Location
+}
+
+// valid reports whether Start and End of the window are within a day.
+func (w RetryWindow) valid() bool {
+	return w.Start >= 0 && w.Start <= 24*time.Hour && w.End >= 0 && w.End <= 24*time.Hour
+}
+
+// Next returns the earliest time at or after t which is within the window.
+func (w RetryWindow) Next(t time.Time) time.Time {
+	loc := w.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	lt := t.In(loc)
+	// Start from the previous day to find a window spanning midnight opened the day before.
+	y, m, d := lt.Date()
+	for i := -1; i <= 7; i++ {
+		day := time.Date(y, m, d+i, 0, 0, 0, 0, loc)
+		if !w.opensOn(day.Weekday()) {
+			continue
+		}
+		start := atTimeOfDay(day, w.Start)
+		end := atTimeOfDay(day, w.End)
+		if !end.After(start) {
+			end = atTimeOfDay(day, w.End+24*time.Hour)
+		}
+		if lt.Before(end) {
+			if lt.Before(start) {
+				return start.In(t.Location())
+			}
+			return t
+		}
+	}
+	// Unreachable for a valid window since it opens at least once a week.
+	return t
+}
+
+func (w RetryWindow) opensOn(day time.Weekday) bool {
+	if len(w.Weekdays) == 0 {
+		return true
+	}
+	for _, wd := range w.Weekdays {
+		if wd == day {
+			return true
+		}
+	}
+	return false
+}
+
+// atTimeOfDay returns the wall clock time offset d from midnight of the given day.
+// The offset is applied to the wall clock, e.g. 08:00 is 08:00 on days with a DST transition.
+func atTimeOfDay(day time.Time, d time.Duration) time.Time {
+	y, m, dd := day.Date()
+	return time.Date(y, m, dd, 0, 0, int(d/time.Second), int(d%time.Second), day.Location())
+}
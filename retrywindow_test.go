@@ -0,0 +1,85 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryWindowNext(t *testing.T) {
+	jakarta, err := time.LoadLocation("Asia/Jakarta")
+	if err != nil {
+		t.Skipf("could not load location: %v", err)
+	}
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("could not load location: %v", err)
+	}
+	weekdays := []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+	businessHours := RetryWindow{Start: 8 * time.Hour, End: 20 * time.Hour, Weekdays: weekdays, Location: jakarta}
+
+	tests := []struct {
+		desc   string
+		window RetryWindow
+		t      time.Time
+		want   time.Time
+	}{
+		{
+			desc:   "within the window",
+			window: businessHours,
+			t:      time.Date(2021, 6, 2, 10, 30, 0, 0, jakarta), // Wednesday
+			want:   time.Date(2021, 6, 2, 10, 30, 0, 0, jakarta),
+		},
+		{
+			desc:   "before the window opens",
+			window: businessHours,
+			t:      time.Date(2021, 6, 2, 6, 0, 0, 0, jakarta),
+			want:   time.Date(2021, 6, 2, 8, 0, 0, 0, jakarta),
+		},
+		{
+			desc:   "after the window closes",
+			window: businessHours,
+			t:      time.Date(2021, 6, 2, 20, 0, 0, 0, jakarta),
+			want:   time.Date(2021, 6, 3, 8, 0, 0, 0, jakarta),
+		},
+		{
+			desc:   "on the weekend",
+			window: businessHours,
+			t:      time.Date(2021, 6, 4, 21, 0, 0, 0, jakarta), // Friday
+			want:   time.Date(2021, 6, 7, 8, 0, 0, 0, jakarta),  // Monday
+		},
+		{
+			desc:   "in another time zone",
+			window: businessHours,
+			t:      time.Date(2021, 6, 2, 0, 0, 0, 0, time.UTC), // 07:00 in Jakarta
+			want:   time.Date(2021, 6, 2, 1, 0, 0, 0, time.UTC),
+		},
+		{
+			desc:   "spanning midnight, after midnight",
+			window: RetryWindow{Start: 22 * time.Hour, End: 6 * time.Hour},
+			t:      time.Date(2021, 6, 2, 3, 0, 0, 0, time.UTC),
+			want:   time.Date(2021, 6, 2, 3, 0, 0, 0, time.UTC),
+		},
+		{
+			desc:   "spanning midnight, during the day",
+			window: RetryWindow{Start: 22 * time.Hour, End: 6 * time.Hour},
+			t:      time.Date(2021, 6, 2, 12, 0, 0, 0, time.UTC),
+			want:   time.Date(2021, 6, 2, 22, 0, 0, 0, time.UTC),
+		},
+		{
+			desc:   "on the day daylight saving time starts",
+			window: RetryWindow{Start: 8 * time.Hour, End: 20 * time.Hour, Location: newYork},
+			t:      time.Date(2021, 3, 14, 1, 0, 0, 0, newYork),
+			want:   time.Date(2021, 3, 14, 8, 0, 0, 0, newYork),
+		},
+	}
+
+	for _, tc := range tests {
+		if got := tc.window.Next(tc.t); !got.Equal(tc.want) {
+			t.Errorf("%s: Next(%v) = %v, want %v", tc.desc, tc.t, got, tc.want)
+		}
+	}
+}
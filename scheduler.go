@@ -5,14 +5,18 @@
 package asynq
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
 	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/errors"
 	"github.com/hibiken/asynq/internal/log"
 	"github.com/hibiken/asynq/internal/rdb"
 	"github.com/robfig/cron/v3"
@@ -22,16 +26,18 @@ import (
 //
 // Schedulers are safe for concurrent use by multiple goroutines.
 type Scheduler struct {
-	id         string
-	state      *base.ServerState
-	logger     *log.Logger
-	client     *Client
-	rdb        *rdb.RDB
-	cron       *cron.Cron
-	location   *time.Location
-	done       chan struct{}
-	wg         sync.WaitGroup
-	errHandler func(task *Task, opts []Option, err error)
+	id          string
+	state       *base.ServerState
+	logger      *log.Logger
+	client      *Client
+	rdb         *rdb.RDB
+	cron        *cron.Cron
+	location    *time.Location
+	done        chan struct{}
+	wg          sync.WaitGroup
+	errHandler  func(task *Task, opts []Option, err error)
+	preEnqueue  func(task *Task, opts []Option) error
+	postEnqueue func(info *TaskInfo, err error)
 
 	// guards idmap
 	mu sync.Mutex
@@ -65,16 +71,23 @@ func NewScheduler(r RedisConnOpt, opts *SchedulerOpts) *Scheduler {
 	}
 
 	return &Scheduler{
-		id:         generateSchedulerID(),
-		state:      base.NewServerState(),
-		logger:     logger,
-		client:     NewClient(r),
-		rdb:        rdb.NewRDB(c),
-		cron:       cron.New(cron.WithLocation(loc)),
-		location:   loc,
-		done:       make(chan struct{}),
-		errHandler: opts.EnqueueErrorHandler,
-		idmap:      make(map[string]cron.EntryID),
+		id:     generateSchedulerID(),
+		state:  base.NewServerState(),
+		logger: logger,
+		client: NewClientWithConfig(r, ClientConfig{
+			SigningKey:      opts.SigningKey,
+			Environment:     opts.Environment,
+			Mirror:          opts.Mirror,
+			MirrorRetention: opts.MirrorRetention,
+		}),
+		rdb:         rdb.NewRDB(c),
+		cron:        cron.New(cron.WithLocation(loc)),
+		location:    loc,
+		done:        make(chan struct{}),
+		errHandler:  opts.EnqueueErrorHandler,
+		preEnqueue:  opts.PreEnqueueFunc,
+		postEnqueue: opts.PostEnqueueFunc,
+		idmap:       make(map[string]cron.EntryID),
 	}
 }
 
@@ -106,23 +119,148 @@ type SchedulerOpts struct {
 	// EnqueueErrorHandler gets called when scheduler cannot enqueue a registered task
 	// due to an error.
 	EnqueueErrorHandler func(task *Task, opts []Option, err error)
+
+	// PreEnqueueFunc, if provided, is called before a registered task is enqueued.
+	//
+	// If it returns a non-nil error, the task is not enqueued this time, e.g. to skip
+	// tasks during a maintenance window. The task is enqueued again on its next schedule.
+	PreEnqueueFunc func(task *Task, opts []Option) error
+
+	// PostEnqueueFunc, if provided, is called after a registered task is enqueued
+	// with the info of the enqueued task, or with the error if the task could not be enqueued.
+	// It is not called for the tasks skipped by PreEnqueueFunc.
+	PostEnqueueFunc func(info *TaskInfo, err error)
+
+	// SigningKey is the key with which to sign the tasks enqueued by the scheduler.
+	// See ClientConfig.SigningKey for details.
+	SigningKey []byte
+
+	// Environment specifies the name of the environment the scheduler runs in.
+	// See ClientConfig.Environment for details.
+	Environment string
+
+	// Mirror specifies the redis database to which the scheduler mirrors the tasks
+	// it enqueues, and MirrorRetention how long they are kept in it.
+	// See ClientConfig.Mirror for details.
+	Mirror          RedisConnOpt
+	MirrorRetention time.Duration
+}
+
+// OverlapPolicy specifies what a scheduler entry does when the task it enqueued
+// on the previous occurrence has not finished yet.
+type OverlapPolicy int
+
+const (
+	// OverlapAllow enqueues the task regardless of the previous run.
+	// This is the default.
+	OverlapAllow OverlapPolicy = iota
+
+	// OverlapSkip skips the occurrence while the previous run is still pending
+	// or being processed.
+	OverlapSkip
+
+	// OverlapCancelPrevious cancels the previous run before enqueueing the task.
+	// An active previous run is sent a cancelation signal (see Inspector.CancelProcessing)
+	// and is archived rather than retried if it fails, as if its handler returned SkipRetry.
+	// A previous run which is waiting to be processed is deleted.
+	OverlapCancelPrevious
+)
+
+func (p OverlapPolicy) String() string {
+	switch p {
+	case OverlapAllow:
+		return "allow"
+	case OverlapSkip:
+		return "skip"
+	case OverlapCancelPrevious:
+		return "cancel"
+	}
+	return fmt.Sprintf("OverlapPolicy(%d)", int(p))
 }
 
+type overlapOption OverlapPolicy
+
+// Overlap returns an option to specify the overlap policy of a scheduler entry,
+// e.g. to skip an hourly task while the task enqueued an hour ago is still running.
+//
+// The option only applies to the tasks registered with a Scheduler and is ignored
+// by Client.Enqueue. The previous run is the task enqueued by the same entry on
+// its previous occurrence; it is finished once it's completed, archived or deleted.
+//
+// The previous run is recorded in redis until an hour after the next occurrence, so
+// that it's known after the scheduler restarts. Entries registered with the same
+// cronspec, task and options, e.g. by the replicas of a scheduler, share the record.
+func Overlap(policy OverlapPolicy) Option {
+	return overlapOption(policy)
+}
+
+func (p overlapOption) String() string     { return fmt.Sprintf("Overlap(%s)", OverlapPolicy(p)) }
+func (p overlapOption) Type() OptionType   { return OverlapOpt }
+func (p overlapOption) Value() interface{} { return OverlapPolicy(p) }
+
 // enqueueJob encapsulates the job of enqueing a task and recording the event.
 type enqueueJob struct {
-	id         uuid.UUID
-	cronspec   string
-	task       *Task
-	opts       []Option
-	location   *time.Location
-	logger     *log.Logger
-	client     *Client
-	rdb        *rdb.RDB
-	errHandler func(task *Task, opts []Option, err error)
+	id          uuid.UUID
+	key         string // identifies the entry across restarts, see base.SchedulerPrevTaskKey.
+	cronspec    string
+	schedule    cron.Schedule
+	task        *Task
+	opts        []Option
+	overlap     OverlapPolicy
+	location    *time.Location
+	logger      *log.Logger
+	client      *Client
+	rdb         *rdb.RDB
+	errHandler  func(task *Task, opts []Option, err error)
+	preEnqueue  func(task *Task, opts []Option) error
+	postEnqueue func(info *TaskInfo, err error)
+
+	// serializes the runs of the job
+	mu sync.Mutex
 }
 
+// prevTaskGrace is how long the task enqueued on an occurrence is recorded after
+// the next occurrence, see Overlap.
+const prevTaskGrace = time.Hour
+
 func (j *enqueueJob) Run() {
+	// Jobs may overlap if enqueueing takes longer than the schedule interval.
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.overlap != OverlapAllow {
+		qname, id, err := j.rdb.SchedulerPrevTask(j.key)
+		if err != nil {
+			// Assume there is no previous run so that an unavailable redis
+			// is reported by the enqueue below.
+			j.logger.Warnf("scheduler could not get the previous task of entry %s: %v", j.id, err)
+		}
+		if id != "" && j.prevRunning(qname, id) {
+			switch j.overlap {
+			case OverlapSkip:
+				j.logger.Infof("scheduler skipped enqueueing a task %+v: previous task id=%s is still running", j.task, id)
+				return
+			case OverlapCancelPrevious:
+				j.cancelPrev(qname, id)
+			}
+		}
+	}
+	if j.preEnqueue != nil {
+		if err := j.preEnqueue(j.task, j.opts); err != nil {
+			j.logger.Infof("scheduler skipped enqueueing a task %+v: %v", j.task, err)
+			return
+		}
+	}
 	info, err := j.client.Enqueue(j.task, j.opts...)
+	if err == nil && j.overlap != OverlapAllow {
+		now := time.Now()
+		ttl := j.schedule.Next(now).Sub(now) + prevTaskGrace
+		if err := j.rdb.WriteSchedulerPrevTask(j.key, info.Queue, info.ID, ttl); err != nil {
+			j.logger.Warnf("scheduler could not record the enqueued task id=%s of entry %s: %v", info.ID, j.id, err)
+		}
+	}
+	if j.postEnqueue != nil {
+		j.postEnqueue(info, err)
+	}
 	if err != nil {
 		j.logger.Errorf("scheduler could not enqueue a task %+v: %v", j.task, err)
 		if j.errHandler != nil {
@@ -141,30 +279,107 @@ func (j *enqueueJob) Run() {
 	}
 }
 
+// prevRunning reports whether the task enqueued on the previous occurrence has not finished yet.
+func (j *enqueueJob) prevRunning(qname, id string) bool {
+	info, err := j.rdb.GetTaskInfo(qname, id)
+	switch {
+	case errors.IsQueueNotFound(err) || errors.IsTaskNotFound(err):
+		return false
+	case err != nil:
+		// Assume the previous run has finished so that an unavailable redis
+		// is reported by the enqueue below.
+		j.logger.Warnf("scheduler could not get info of previous task id=%s: %v", id, err)
+		return false
+	}
+	return info.State != base.TaskStateCompleted && info.State != base.TaskStateArchived
+}
+
+// cancelPrev cancels the task enqueued on the previous occurrence. An active task
+// is aborted, so that it's archived rather than retried.
+func (j *enqueueJob) cancelPrev(qname, id string) {
+	info, err := j.rdb.GetTaskInfo(qname, id)
+	if err != nil {
+		j.logger.Warnf("scheduler could not get info of previous task id=%s: %v", id, err)
+		return
+	}
+	if info.State == base.TaskStateActive {
+		err = j.rdb.PublishAbort(id)
+	} else {
+		err = j.rdb.DeleteTask(qname, id)
+	}
+	if err != nil {
+		j.logger.Warnf("scheduler could not cancel previous task id=%s: %v", id, err)
+		return
+	}
+	j.logger.Infof("scheduler canceled previous task id=%s", id)
+}
+
 // Register registers a task to be enqueued on the given schedule specified by the cronspec.
 // It returns an ID of the newly registered entry.
 func (s *Scheduler) Register(cronspec string, task *Task, opts ...Option) (entryID string, err error) {
-	job := &enqueueJob{
-		id:         uuid.New(),
-		cronspec:   cronspec,
-		task:       task,
-		opts:       opts,
-		location:   s.location,
-		client:     s.client,
-		rdb:        s.rdb,
-		logger:     s.logger,
-		errHandler: s.errHandler,
-	}
-	cronID, err := s.cron.AddJob(cronspec, job)
+	// Parsed as cron.AddJob does, so that the job knows its schedule.
+	schedule, err := cron.ParseStandard(cronspec)
 	if err != nil {
 		return "", err
 	}
+	job := s.newEnqueueJob(cronspec, schedule, s.location, task, opts)
+	cronID := s.cron.Schedule(schedule, job)
 	s.mu.Lock()
 	s.idmap[job.id.String()] = cronID
 	s.mu.Unlock()
 	return job.id.String(), nil
 }
 
+// RegisterWithLocation registers a task to be enqueued on the given schedule specified
+// by the cronspec, interpreted in the given time zone location instead of the location
+// of the scheduler. It returns an ID of the newly registered entry.
+//
+// The schedule follows the daylight saving time transitions of the location, e.g.
+// "0 9 * * *" with America/New_York fires at 09:00 New York time all year round.
+// The cronspec must not have its own CRON_TZ= or TZ= prefix.
+func (s *Scheduler) RegisterWithLocation(cronspec string, loc *time.Location, task *Task, opts ...Option) (entryID string, err error) {
+	if loc == nil {
+		return "", fmt.Errorf("asynq: location must not be nil")
+	}
+	if strings.HasPrefix(cronspec, "TZ=") || strings.HasPrefix(cronspec, "CRON_TZ=") {
+		return "", fmt.Errorf("asynq: cronspec %q must not specify a time zone", cronspec)
+	}
+	schedule, err := cron.ParseStandard(cronspec)
+	if err != nil {
+		return "", err
+	}
+	if spec, ok := schedule.(*cron.SpecSchedule); ok {
+		spec.Location = loc
+	}
+	// The entry reports the location as part of its spec so that the spec
+	// shown to the inspector can be registered again as is.
+	job := s.newEnqueueJob(fmt.Sprintf("CRON_TZ=%s %s", loc, cronspec), schedule, loc, task, opts)
+	cronID := s.cron.Schedule(schedule, job)
+	s.mu.Lock()
+	s.idmap[job.id.String()] = cronID
+	s.mu.Unlock()
+	return job.id.String(), nil
+}
+
+func (s *Scheduler) newEnqueueJob(cronspec string, schedule cron.Schedule, loc *time.Location, task *Task, opts []Option) *enqueueJob {
+	return &enqueueJob{
+		id:          uuid.New(),
+		key:         schedulerEntryKey(cronspec, task, opts),
+		cronspec:    cronspec,
+		schedule:    schedule,
+		task:        task,
+		opts:        opts,
+		overlap:     overlapPolicy(opts),
+		location:    loc,
+		client:      s.client,
+		rdb:         s.rdb,
+		logger:      s.logger,
+		errHandler:  s.errHandler,
+		preEnqueue:  s.preEnqueue,
+		postEnqueue: s.postEnqueue,
+	}
+}
+
 // Unregister removes a registered entry by entry ID.
 // Unregister returns a non-nil error if no entries were found for the given entryID.
 func (s *Scheduler) Unregister(entryID string) error {
@@ -260,6 +475,17 @@ func (s *Scheduler) beat() {
 	}
 }
 
+// overlapPolicy returns the overlap policy specified by the Overlap option in opts.
+func overlapPolicy(opts []Option) OverlapPolicy {
+	policy := OverlapAllow
+	for _, opt := range opts {
+		if opt, ok := opt.(overlapOption); ok {
+			policy = OverlapPolicy(opt)
+		}
+	}
+	return policy
+}
+
 func stringifyOptions(opts []Option) []string {
 	var res []string
 	for _, opt := range opts {
@@ -268,6 +494,20 @@ func stringifyOptions(opts []Option) []string {
 	return res
 }
 
+// schedulerEntryKey returns the key identifying the entry enqueueing the task with
+// the given options on the given cronspec, which unlike the entry ID is the same
+// across restarts of the scheduler.
+func schedulerEntryKey(cronspec string, task *Task, opts []Option) string {
+	h := sha256.New()
+	for _, s := range []string{cronspec, task.Type(), string(task.Payload())} {
+		fmt.Fprintf(h, "%d:%s", len(s), s)
+	}
+	for _, s := range stringifyOptions(append(task.opts[:len(task.opts):len(task.opts)], opts...)) {
+		fmt.Fprintf(h, "%d:%s", len(s), s)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
 func (s *Scheduler) clearHistory() {
 	for _, entry := range s.cron.Entries() {
 		job := entry.Job.(*enqueueJob)
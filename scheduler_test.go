@@ -5,6 +5,8 @@
 package asynq
 
 import (
+	"context"
+	"errors"
 	"sync"
 	"testing"
 	"time"
@@ -70,7 +72,7 @@ func TestSchedulerRegister(t *testing.T) {
 		scheduler.Shutdown()
 
 		got := asynqtest.GetPendingMessages(t, r, tc.queue)
-		if diff := cmp.Diff(tc.want, got, asynqtest.IgnoreIDOpt); diff != "" {
+		if diff := cmp.Diff(tc.want, got, asynqtest.IgnoreIDOpt, asynqtest.IgnoreEnqueuedAtOpt); diff != "" {
 			t.Errorf("mismatch found in queue %q: (-want,+got)\n%s", tc.queue, diff)
 		}
 	}
@@ -154,3 +156,192 @@ func TestSchedulerUnregister(t *testing.T) {
 		}
 	}
 }
+
+func TestSchedulerRegisterWithLocation(t *testing.T) {
+	jakarta, err := time.LoadLocation("Asia/Jakarta")
+	if err != nil {
+		t.Skipf("could not load location: %v", err)
+	}
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("could not load location: %v", err)
+	}
+	tests := []struct {
+		loc      *time.Location
+		cronspec string
+		from     time.Time
+		want     []time.Time
+	}{
+		{
+			loc:      jakarta,
+			cronspec: "0 9 * * *",
+			from:     time.Date(2021, 6, 1, 3, 0, 0, 0, time.UTC),
+			want: []time.Time{
+				time.Date(2021, 6, 2, 2, 0, 0, 0, time.UTC),
+				time.Date(2021, 6, 3, 2, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			// Daylight saving time starts in New York on 2021-03-14.
+			loc:      newYork,
+			cronspec: "0 9 * * *",
+			from:     time.Date(2021, 3, 12, 15, 0, 0, 0, time.UTC),
+			want: []time.Time{
+				time.Date(2021, 3, 13, 14, 0, 0, 0, time.UTC),
+				time.Date(2021, 3, 14, 13, 0, 0, 0, time.UTC),
+				time.Date(2021, 3, 15, 13, 0, 0, 0, time.UTC),
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		scheduler := NewScheduler(getRedisConnOpt(t), nil)
+		entryID, err := scheduler.RegisterWithLocation(tc.cronspec, tc.loc, NewTask("report", nil))
+		if err != nil {
+			t.Fatalf("RegisterWithLocation(%q, %v) returned error: %v", tc.cronspec, tc.loc, err)
+		}
+		entry := scheduler.cron.Entry(scheduler.idmap[entryID])
+		if want := "CRON_TZ=" + tc.loc.String() + " " + tc.cronspec; entry.Job.(*enqueueJob).cronspec != want {
+			t.Errorf("entry has spec %q, want %q", entry.Job.(*enqueueJob).cronspec, want)
+		}
+		var got []time.Time
+		next := tc.from
+		for range tc.want {
+			next = entry.Schedule.Next(next)
+			got = append(got, next.UTC())
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("schedule of %q in %v mismatch (-want,+got):\n%s", tc.cronspec, tc.loc, diff)
+		}
+	}
+}
+
+func TestSchedulerRegisterWithLocationError(t *testing.T) {
+	tests := []struct {
+		desc     string
+		cronspec string
+		loc      *time.Location
+	}{
+		{"nil location", "0 9 * * *", nil},
+		{"cronspec with time zone", "CRON_TZ=Asia/Tokyo 0 9 * * *", time.UTC},
+		{"invalid cronspec", "0 9 * *", time.UTC},
+	}
+
+	for _, tc := range tests {
+		scheduler := NewScheduler(getRedisConnOpt(t), nil)
+		if _, err := scheduler.RegisterWithLocation(tc.cronspec, tc.loc, NewTask("report", nil)); err == nil {
+			t.Errorf("%s: RegisterWithLocation(%q, %v) returned nil error, want non-nil error", tc.desc, tc.cronspec, tc.loc)
+		}
+	}
+}
+
+func TestSchedulerOverlap(t *testing.T) {
+	tests := []struct {
+		policy OverlapPolicy
+		want   int // number of pending tasks after two occurrences
+	}{
+		{OverlapAllow, 2},
+		{OverlapSkip, 1},
+		{OverlapCancelPrevious, 1},
+	}
+
+	r := setup(t)
+	defer r.Close()
+	for _, tc := range tests {
+		asynqtest.FlushDB(t, r)
+		scheduler := NewScheduler(getRedisConnOpt(t), nil)
+		entryID, err := scheduler.Register("@every 1h", NewTask("aggregate", nil), Overlap(tc.policy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		job := scheduler.cron.Entry(scheduler.idmap[entryID]).Job.(*enqueueJob)
+		job.Run()
+		first := asynqtest.GetPendingMessages(t, r, "default")[0]
+		// The previous run is known to a scheduler registering the same entry, e.g. after a restart.
+		restarted := NewScheduler(getRedisConnOpt(t), nil)
+		entryID, err = restarted.Register("@every 1h", NewTask("aggregate", nil), Overlap(tc.policy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		job = restarted.cron.Entry(restarted.idmap[entryID]).Job.(*enqueueJob)
+		job.Run()
+
+		got := asynqtest.GetPendingMessages(t, r, "default")
+		if len(got) != tc.want {
+			t.Fatalf("%v: got %d pending tasks, want %d", tc.policy, len(got), tc.want)
+		}
+		if tc.policy == OverlapCancelPrevious && got[0].ID == first.ID {
+			t.Errorf("%v: the previous task id=%s is still pending, want it canceled", tc.policy, first.ID)
+		}
+		if tc.policy != OverlapAllow {
+			key := base.SchedulerPrevTaskKey(job.key)
+			if ttl := r.TTL(context.Background(), key).Val(); ttl <= time.Hour || ttl > 2*time.Hour {
+				t.Errorf("%v: TTL %q = %v, want an hour after the next occurrence", tc.policy, key, ttl)
+			}
+		}
+
+		// The entry enqueues the task again once the previous run has finished.
+		asynqtest.FlushDB(t, r)
+		job.Run()
+		if n := len(asynqtest.GetPendingMessages(t, r, "default")); n != 1 {
+			t.Errorf("%v: got %d pending tasks after the previous run finished, want 1", tc.policy, n)
+		}
+	}
+}
+
+func TestSchedulerEnqueueHooks(t *testing.T) {
+	r := setup(t)
+
+	var (
+		skip     bool
+		preCalls int
+		infos    []*TaskInfo
+		errs     []error
+	)
+	scheduler := NewScheduler(getRedisConnOpt(t), &SchedulerOpts{
+		PreEnqueueFunc: func(task *Task, opts []Option) error {
+			preCalls++
+			if skip {
+				return errors.New("maintenance window")
+			}
+			return nil
+		},
+		PostEnqueueFunc: func(info *TaskInfo, err error) {
+			infos = append(infos, info)
+			errs = append(errs, err)
+		},
+	})
+	defer scheduler.Shutdown()
+	if _, err := scheduler.Register("@every 1h", NewTask("task1", nil), Unique(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	// Run the job directly instead of waiting for the schedule.
+	job := scheduler.cron.Entries()[0].Job
+
+	job.Run()
+	if len(infos) != 1 || errs[0] != nil || infos[0].Type != "task1" {
+		t.Fatalf("PostEnqueueFunc called with %v %v, want the info of the enqueued task", infos, errs)
+	}
+	if got := asynqtest.GetPendingMessages(t, r, "default"); len(got) != 1 || got[0].ID != infos[0].ID {
+		t.Errorf("pending tasks = %v, want the task %q", got, infos[0].ID)
+	}
+
+	// Enqueueing the duplicate task fails.
+	job.Run()
+	if len(errs) != 2 || !errors.Is(errs[1], ErrDuplicateTask) || infos[1] != nil {
+		t.Errorf("PostEnqueueFunc called with (%v, %v), want (nil, ErrDuplicateTask)", infos[len(infos)-1], errs[len(errs)-1])
+	}
+
+	// Task is not enqueued if PreEnqueueFunc returns an error.
+	skip = true
+	job.Run()
+	if preCalls != 3 {
+		t.Errorf("PreEnqueueFunc called %d times, want 3", preCalls)
+	}
+	if len(errs) != 2 {
+		t.Errorf("PostEnqueueFunc called %d times, want 2", len(errs))
+	}
+	if got := asynqtest.GetPendingMessages(t, r, "default"); len(got) != 1 {
+		t.Errorf("%d pending tasks, want 1", len(got))
+	}
+}
@@ -6,10 +6,13 @@ package asynq
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // ServeMux is a multiplexer for asynchronous tasks.
@@ -22,16 +25,29 @@ import (
 // the latter handler will be called for tasks with a type name beginning with
 // "images:thumbnails" and the former will receive tasks with type name beginning
 // with "images".
+//
+// Task types can be versioned with a "@v<N>" suffix (e.g. "email:send@v2",
+// see VersionedType). Patterns registered for versioned types match only their
+// version exactly, unless SetVersionFallback is enabled.
 type ServeMux struct {
-	mu  sync.RWMutex
-	m   map[string]muxEntry
-	es  []muxEntry // slice of entries sorted from longest to shortest.
-	mws []MiddlewareFunc
+	mu       sync.RWMutex
+	m        map[string]muxEntry
+	es       []muxEntry       // slice of entries sorted from longest to shortest.
+	versions map[string][]int // registered versions of each versioned type name, sorted in ascending order.
+	fallback bool             // whether to route tasks without a handler for their version to the latest version.
+	mws      []MiddlewareFunc
 }
 
 type muxEntry struct {
-	h       Handler
-	pattern string
+	h         Handler
+	pattern   string
+	queues    map[string]bool // queues the handler is bound to, nil if the handler is not bound.
+	versioned bool            // whether the pattern is a versioned type, see VersionedType.
+}
+
+// accepts reports whether the entry's handler processes the tasks of the given queue.
+func (e muxEntry) accepts(qname string) bool {
+	return e.queues == nil || e.queues[qname]
 }
 
 // MiddlewareFunc is a function which receives an asynq.Handler and returns another asynq.Handler.
@@ -62,7 +78,11 @@ func (mux *ServeMux) Handler(t *Task) (h Handler, pattern string) {
 	mux.mu.RLock()
 	defer mux.mu.RUnlock()
 
-	h, pattern = mux.match(t.Type())
+	var qname string
+	if t.w != nil {
+		qname = t.w.qname
+	}
+	h, pattern = mux.match(t.Type(), qname)
 	if h == nil {
 		h, pattern = NotFoundHandler(), ""
 	}
@@ -72,19 +92,35 @@ func (mux *ServeMux) Handler(t *Task) (h Handler, pattern string) {
 	return h, pattern
 }
 
-// Find a handler on a handler map given a typename string.
-// Most-specific (longest) pattern wins.
-func (mux *ServeMux) match(typename string) (h Handler, pattern string) {
+// Find a handler on a handler map given a typename string and the queue of the task.
+// Most-specific (longest) pattern wins. Handlers bound to other queues are skipped.
+func (mux *ServeMux) match(typename, qname string) (h Handler, pattern string) {
 	// Check for exact match first.
 	v, ok := mux.m[typename]
-	if ok {
+	if ok && v.accepts(qname) {
 		return v.h, v.pattern
 	}
 
+	// Check for the latest version of the type.
+	if mux.fallback {
+		name, _, _ := splitVersion(typename)
+		if vs := mux.versions[name]; len(vs) > 0 {
+			v := mux.m[VersionedType(name, vs[len(vs)-1])]
+			if v.accepts(qname) {
+				return v.h, v.pattern
+			}
+		}
+	}
+
 	// Check for longest valid match.
 	// mux.es contains all patterns from longest to shortest.
+	// Patterns of versioned types match exactly only, so that e.g. "email:send@v1"
+	// doesn't match "email:send@v12".
 	for _, e := range mux.es {
-		if strings.HasPrefix(typename, e.pattern) {
+		if e.versioned {
+			continue
+		}
+		if strings.HasPrefix(typename, e.pattern) && e.accepts(qname) {
 			return e.h, e.pattern
 		}
 	}
@@ -94,7 +130,10 @@ func (mux *ServeMux) match(typename string) (h Handler, pattern string) {
 
 // Handle registers the handler for the given pattern.
 // If a handler already exists for pattern, Handle panics.
-func (mux *ServeMux) Handle(pattern string, handler Handler) {
+//
+// Options can be passed to specify operational limits of the handler
+// (see HandlerConcurrency, HandlerTimeout and HandlerQueues).
+func (mux *ServeMux) Handle(pattern string, handler Handler, opts ...HandlerOption) {
 	mux.mu.Lock()
 	defer mux.mu.Unlock()
 
@@ -111,9 +150,66 @@ func (mux *ServeMux) Handle(pattern string, handler Handler) {
 	if mux.m == nil {
 		mux.m = make(map[string]muxEntry)
 	}
-	e := muxEntry{h: handler, pattern: pattern}
+	e := composeHandlerOptions(opts...).entry(pattern, handler)
 	mux.m[pattern] = e
 	mux.es = appendSorted(mux.es, e)
+	if name, version, ok := splitVersion(pattern); ok {
+		if mux.versions == nil {
+			mux.versions = make(map[string][]int)
+		}
+		vs := append(mux.versions[name], version)
+		sort.Ints(vs)
+		mux.versions[name] = vs
+	}
+}
+
+// SetVersionFallback specifies whether to route a task to the handler of the latest
+// registered version of its type when there is no handler for the version of the task.
+//
+// For example, with handlers registered for "email:send@v1" and "email:send@v2",
+// tasks of type "email:send@v3" or "email:send" are processed by the "email:send@v2" handler
+// if fallback is enabled. By default fallback is disabled, and such tasks are matched
+// against the other patterns as usual.
+func (mux *ServeMux) SetVersionFallback(enabled bool) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	mux.fallback = enabled
+}
+
+// hasVersionHandler reports whether a handler is registered for the exact version
+// of the given task type. Unversioned task types always report true.
+func (mux *ServeMux) hasVersionHandler(typename string) bool {
+	if _, _, ok := splitVersion(typename); !ok {
+		return true
+	}
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+	_, ok := mux.m[typename]
+	return ok
+}
+
+// VersionedType returns the type name of the given version of a task type
+// (e.g. VersionedType("email:send", 2) returns "email:send@v2").
+func VersionedType(typename string, version int) string {
+	return typename + "@v" + strconv.Itoa(version)
+}
+
+// splitVersion splits a versioned type name into the type name and the version.
+// It reports false if the type name is not versioned.
+func splitVersion(typename string) (name string, version int, ok bool) {
+	i := strings.LastIndex(typename, "@v")
+	if i < 0 {
+		return typename, 0, false
+	}
+	digits := typename[i+2:]
+	if digits == "" || strings.TrimLeft(digits, "0123456789") != "" {
+		return typename, 0, false
+	}
+	version, err := strconv.Atoi(digits)
+	if err != nil {
+		return typename, 0, false
+	}
+	return typename[:i], version, true
 }
 
 func appendSorted(es []muxEntry, e muxEntry) []muxEntry {
@@ -132,11 +228,11 @@ func appendSorted(es []muxEntry, e muxEntry) []muxEntry {
 }
 
 // HandleFunc registers the handler function for the given pattern.
-func (mux *ServeMux) HandleFunc(pattern string, handler func(context.Context, *Task) error) {
+func (mux *ServeMux) HandleFunc(pattern string, handler func(context.Context, *Task) error, opts ...HandlerOption) {
 	if handler == nil {
 		panic("asynq: nil handler")
 	}
-	mux.Handle(pattern, HandlerFunc(handler))
+	mux.Handle(pattern, HandlerFunc(handler), opts...)
 }
 
 // Use appends a MiddlewareFunc to the chain.
@@ -149,9 +245,133 @@ func (mux *ServeMux) Use(mws ...MiddlewareFunc) {
 	}
 }
 
-// NotFound returns an error indicating that the handler was not found for the given task.
+// HandlerOption specifies an operational limit of a handler registered with ServeMux.Handle.
+type HandlerOption interface{}
+
+// Internal handler option representations.
+type (
+	handlerConcurrencyOpt int
+	handlerTimeoutOpt     time.Duration
+	handlerQueuesOpt      []string
+)
+
+// HandlerConcurrency returns an option to limit the number of tasks processed
+// concurrently by the handler to n. Tasks beyond the limit are not processed: they're
+// retried after a second, and the attempt doesn't count as a failure nor toward the
+// maximum number of retries of the task. The limit applies to each server.
+//
+// To leave such tasks in their queue instead, give them a class with the TaskClass
+// option and limit the class with Config.ClassConcurrency.
+// A zero or negative value is ignored.
+func HandlerConcurrency(n int) HandlerOption {
+	return handlerConcurrencyOpt(n)
+}
+
+// HandlerTimeout returns an option to limit the time the handler takes to process
+// a task to d. The context passed to the handler is canceled once d elapses, or once
+// the timeout or deadline of the task passes if it's earlier.
+// A zero or negative value is ignored.
+func HandlerTimeout(d time.Duration) HandlerOption {
+	return handlerTimeoutOpt(d)
+}
+
+// HandlerQueues returns an option to bind the handler to the given queues: the handler
+// only processes the tasks in these queues. Tasks of other queues are routed as if
+// the handler wasn't registered, i.e. to the handler of the next longest pattern matching
+// their type, if any.
+func HandlerQueues(qnames ...string) HandlerOption {
+	return handlerQueuesOpt(append([]string(nil), qnames...))
+}
+
+type handlerOptions struct {
+	concurrency int
+	timeout     time.Duration
+	queues      map[string]bool
+}
+
+// composeHandlerOptions merges the given handler options.
+// Invalid options are ignored.
+func composeHandlerOptions(opts ...HandlerOption) handlerOptions {
+	var res handlerOptions
+	for _, opt := range opts {
+		switch opt := opt.(type) {
+		case handlerConcurrencyOpt:
+			if opt > 0 {
+				res.concurrency = int(opt)
+			}
+		case handlerTimeoutOpt:
+			if opt > 0 {
+				res.timeout = time.Duration(opt)
+			}
+		case handlerQueuesOpt:
+			if res.queues == nil {
+				res.queues = make(map[string]bool)
+			}
+			for _, qname := range opt {
+				res.queues[qname] = true
+			}
+		default:
+			// ignore unexpected option
+		}
+	}
+	return res
+}
+
+// entry returns the mux entry of the handler registered for the pattern with the options.
+func (o handlerOptions) entry(pattern string, h Handler) muxEntry {
+	if o.timeout > 0 {
+		h = timeoutHandler(h, o.timeout)
+	}
+	if o.concurrency > 0 {
+		h = concurrencyHandler(h, o.concurrency)
+	}
+	_, _, versioned := splitVersion(pattern)
+	return muxEntry{h: h, pattern: pattern, queues: o.queues, versioned: versioned}
+}
+
+// timeoutHandler returns a handler which calls h with a context canceled after d.
+func timeoutHandler(h Handler, d time.Duration) Handler {
+	return HandlerFunc(func(ctx context.Context, task *Task) error {
+		ctx, cancel := context.WithTimeout(ctx, d)
+		defer cancel()
+		return h.ProcessTask(ctx, task)
+	})
+}
+
+// errHandlerBusy is returned by a handler registered with the HandlerConcurrency
+// option for the tasks beyond its limit. The server retries these tasks after
+// handlerBusyRetryDelay without counting the attempt as a failure.
+var errHandlerBusy = errors.New("handler concurrency limit reached")
+
+// handlerBusyRetryDelay is the delay after which a task beyond the concurrency
+// limit of its handler is retried.
+const handlerBusyRetryDelay = time.Second
+
+// concurrencyHandler returns a handler which calls h for at most n tasks concurrently.
+// Tasks beyond the limit are rejected with errHandlerBusy instead of waiting for a
+// slot, so that they don't occupy workers needed by the tasks of other types.
+func concurrencyHandler(h Handler, n int) Handler {
+	sema := make(chan struct{}, n)
+	return HandlerFunc(func(ctx context.Context, task *Task) error {
+		select {
+		case sema <- struct{}{}:
+		default:
+			return RetryIn(errHandlerBusy, handlerBusyRetryDelay)
+		}
+		defer func() { <-sema }()
+		return h.ProcessTask(ctx, task)
+	})
+}
+
+// ErrHandlerNotFound indicates that no handler is registered for the type of a task.
+//
+// See Config.UnhandledTaskPolicy for how the server handles such tasks.
+var ErrHandlerNotFound = errors.New("handler not found")
+
+// NotFound returns an error wrapping ErrHandlerNotFound, indicating that the handler
+// was not found for the given task.
 func NotFound(ctx context.Context, task *Task) error {
-	return fmt.Errorf("handler not found for task %q", task.Type())
+	return fmt.Errorf("%w for task %q", ErrHandlerNotFound, task.Type())
 }
 
 // NotFoundHandler returns a simple task handler that returns a ``not found`` error.
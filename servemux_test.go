@@ -6,7 +6,11 @@ package asynq
 
 import (
 	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 )
@@ -168,3 +172,194 @@ func TestServeMuxMiddlewares(t *testing.T) {
 		}
 	}
 }
+
+func TestServeMuxVersions(t *testing.T) {
+	tests := []struct {
+		fallback bool
+		typename string
+		want     string // identifier of the handler that should be called, empty if not found
+	}{
+		{false, "email:send@v1", "v1 handler"},
+		{false, "email:send@v2", "v2 handler"},
+		{false, "email:send@v3", ""},
+		{false, "email:send@v12", ""},
+		{false, "image:resize@v1", "image handler"},
+		{true, "email:send@v1", "v1 handler"},
+		{true, "email:send@v3", "v2 handler"},
+		{true, "email:send@v12", "v2 handler"},
+		{true, "email:send", "v2 handler"},
+		{true, "email:send@vx", ""},
+		{true, "image:resize@v1", "image handler"},
+	}
+
+	for _, tc := range tests {
+		mux := NewServeMux()
+		mux.Handle(VersionedType("email:send", 2), makeFakeHandler("v2 handler"))
+		mux.Handle(VersionedType("email:send", 1), makeFakeHandler("v1 handler"))
+		mux.Handle("image:", makeFakeHandler("image handler"))
+		mux.SetVersionFallback(tc.fallback)
+
+		called = "" // reset to zero value
+		err := mux.ProcessTask(context.Background(), NewTask(tc.typename, nil))
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("fallback=%t: %q handler was called for task %q, want not found", tc.fallback, called, tc.typename)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("fallback=%t: ProcessTask(%q) returned error: %v", tc.fallback, tc.typename, err)
+			continue
+		}
+		if called != tc.want {
+			t.Errorf("fallback=%t: %q handler was called for task %q, want %q to be called", tc.fallback, called, tc.typename, tc.want)
+		}
+	}
+}
+
+func TestSplitVersion(t *testing.T) {
+	tests := []struct {
+		typename    string
+		wantName    string
+		wantVersion int
+		wantOK      bool
+	}{
+		{"email:send@v2", "email:send", 2, true},
+		{"email:send@v10", "email:send", 10, true},
+		{"a@b@v3", "a@b", 3, true},
+		{"email:send", "email:send", 0, false},
+		{"email:send@v", "email:send@v", 0, false},
+		{"email:send@v+1", "email:send@v+1", 0, false},
+		{"email:send@v2x", "email:send@v2x", 0, false},
+	}
+	for _, tc := range tests {
+		name, version, ok := splitVersion(tc.typename)
+		if name != tc.wantName || version != tc.wantVersion || ok != tc.wantOK {
+			t.Errorf("splitVersion(%q) = (%q, %d, %t), want (%q, %d, %t)",
+				tc.typename, name, version, ok, tc.wantName, tc.wantVersion, tc.wantOK)
+		}
+	}
+}
+
+func TestServeMuxHandlerQueues(t *testing.T) {
+	mux := NewServeMux()
+	mux.Handle("email:", makeFakeHandler("default email handler"))
+	mux.Handle("email:signup", makeFakeHandler("critical signup email handler"), HandlerQueues("critical"))
+
+	tests := []struct {
+		typename string
+		qname    string
+		want     string
+	}{
+		{"email:signup", "critical", "critical signup email handler"},
+		{"email:signup", "default", "default email handler"},
+		{"email:daily", "critical", "default email handler"},
+	}
+	for _, tc := range tests {
+		called = ""
+		task := newTask(tc.typename, nil, &ResultWriter{qname: tc.qname})
+		if err := mux.ProcessTask(context.Background(), task); err != nil {
+			t.Fatalf("ProcessTask(%q) in queue %q returned error: %v", tc.typename, tc.qname, err)
+		}
+		if called != tc.want {
+			t.Errorf("%q handler was called for task %q in queue %q, want %q to be called", called, tc.typename, tc.qname, tc.want)
+		}
+	}
+
+	// Tasks of other queues fall through to no handler if no other pattern matches.
+	mux = NewServeMux()
+	mux.Handle("csv:export", makeFakeHandler("csv export handler"), HandlerQueues("reports"))
+	task := newTask("csv:export", nil, &ResultWriter{qname: "default"})
+	if err := mux.ProcessTask(context.Background(), task); !errors.Is(err, ErrHandlerNotFound) {
+		t.Errorf("ProcessTask(%q) in queue %q returned %v, want ErrHandlerNotFound", task.Type(), "default", err)
+	}
+}
+
+func TestServeMuxHandlerConcurrency(t *testing.T) {
+	const limit = 2
+	var (
+		mu      sync.Mutex
+		running int
+		max     int
+	)
+	mux := NewServeMux()
+	mux.HandleFunc("image:resize", func(ctx context.Context, t *Task) error {
+		mu.Lock()
+		running++
+		if running > max {
+			max = running
+		}
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	}, HandlerConcurrency(limit))
+
+	var (
+		wg   sync.WaitGroup
+		busy int32
+	)
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := mux.ProcessTask(context.Background(), NewTask("image:resize", nil))
+			switch {
+			case errors.Is(err, errHandlerBusy):
+				atomic.AddInt32(&busy, 1)
+			case err != nil:
+				t.Errorf("ProcessTask returned error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if max > limit {
+		t.Errorf("handler processed up to %d tasks concurrently, want at most %d", max, limit)
+	}
+	if busy == 0 {
+		t.Errorf("no task was rejected beyond the limit")
+	}
+
+	// A task beyond the limit is rejected without waiting for a slot.
+	started := make(chan struct{})
+	release := make(chan struct{})
+	mux = NewServeMux()
+	mux.HandleFunc("image:resize", func(ctx context.Context, t *Task) error {
+		close(started)
+		<-release
+		return nil
+	}, HandlerConcurrency(1))
+	go mux.ProcessTask(context.Background(), NewTask("image:resize", nil))
+	<-started
+	err := mux.ProcessTask(context.Background(), NewTask("image:resize", nil))
+	var re *retryAtError
+	if !errors.Is(err, errHandlerBusy) || !errors.As(err, &re) || re.delay != handlerBusyRetryDelay {
+		t.Errorf("ProcessTask beyond the limit returned %v, want errHandlerBusy retried in %v", err, handlerBusyRetryDelay)
+	}
+	close(release)
+}
+
+func TestServeMuxHandlerTimeout(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc("csv:export", func(ctx context.Context, t *Task) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, HandlerTimeout(10*time.Millisecond))
+
+	start := time.Now()
+	if err := mux.ProcessTask(context.Background(), NewTask("csv:export", nil)); err != context.DeadlineExceeded {
+		t.Errorf("ProcessTask returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("ProcessTask returned after %v, want the handler to time out after 10ms", elapsed)
+	}
+}
+
+func TestComposeHandlerOptionsIgnoresInvalidValues(t *testing.T) {
+	got := composeHandlerOptions(HandlerConcurrency(0), HandlerTimeout(-time.Second))
+	if got.concurrency != 0 || got.timeout != 0 || got.queues != nil {
+		t.Errorf("composeHandlerOptions with invalid values = %+v, want zero options", got)
+	}
+}
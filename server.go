@@ -50,6 +50,23 @@ type Server struct {
 	recoverer     *recoverer
 	healthchecker *healthchecker
 	janitor       *janitor
+	historian     *historian
+	digester      *digester
+	debug         *debugServer
+
+	// environment the server runs in, empty if unset.
+	environment string
+
+	// strictCompatibility makes Start fail if the server is incompatible with
+	// the running servers.
+	strictCompatibility bool
+
+	// rdb is the connection of the broker, switched to the mirror by Start if
+	// the mirror was promoted.
+	rdb *rdb.RDB
+
+	// mirror to which the clients mirror the tasks, nil if unset.
+	mirror RedisConnOpt
 }
 
 // Config specifies the server's background-task processing behavior.
@@ -60,6 +77,17 @@ type Config struct {
 	// to the number of CPUs usable by the current process.
 	Concurrency int
 
+	// BaseContext optionally specifies a function that returns the base context for
+	// Handler invocations on this server.
+	//
+	// The context passed to Handler is derived from the returned context, so values
+	// it carries (e.g. loggers, tracers) are accessible in the Handler, and canceling it
+	// cancels all tasks that are being processed.
+	//
+	// If BaseContext is nil, the default is context.Background().
+	// If this is non-nil, it must return a non-nil context.
+	BaseContext func() context.Context
+
 	// Function to calculate retry delay for a failed task.
 	//
 	// By default, it uses exponential backoff algorithm to calculate the delay.
@@ -73,6 +101,16 @@ type Config struct {
 	// By default, if the given error is non-nil the function returns true.
 	IsFailure func(error) bool
 
+	// RetryLeaseExpired specifies whether to retry a task once more, instead of archiving it,
+	// if its lease expired on its last attempt.
+	//
+	// The lease of a task expires if its deadline passes without the server processing
+	// it reporting the outcome, e.g. because the server crashed. Such tasks are recovered
+	// with ErrLeaseExpired as their error, which is unlikely to be caused by the task itself.
+	//
+	// By default, such tasks are archived like any other task which exhausted its retries.
+	RetryLeaseExpired bool
+
 	// List of queues to process with given priority value. Keys are the names of the
 	// queues and values are associated priority value.
 	//
@@ -95,6 +133,64 @@ type Config struct {
 	// If a queue has a zero or negative priority value, the queue will be ignored.
 	Queues map[string]int
 
+	// QueueConcurrency optionally specifies the maximum number of tasks from each
+	// queue that are processed concurrently.
+	//
+	// Example:
+	//
+	//     Concurrency: 15,
+	//     QueueConcurrency: map[string]int{
+	//         "critical": 10,
+	//         "low":      2,
+	//     }
+	//
+	// With the above config, at most 2 workers process tasks from "low" so that
+	// slow tasks in "low" cannot occupy every worker. The limits apply within the
+	// pool of workers specified by Concurrency; queues without a limit can use
+	// any free worker.
+	//
+	// A queue with a zero or negative value is not limited.
+	QueueConcurrency map[string]int
+
+	// ClassConcurrency optionally specifies the maximum number of tasks of each
+	// class that are processed concurrently. Use TaskClass option to specify the
+	// class of a task.
+	//
+	// Example:
+	//
+	//     Concurrency: 100,
+	//     ClassConcurrency: map[string]int{
+	//         "cpu": 4,
+	//     }
+	//
+	// With the above config, at most 4 workers process CPU-bound tasks, so that a
+	// flood of them leaves the other workers to the cheap IO-bound tasks. As with
+	// QueueConcurrency, the limits apply within the pool of workers specified by
+	// Concurrency. While a class is at its limit, its pending tasks are set aside
+	// by the server, and processed in order once the class is below its limit.
+	//
+	// A class with a zero or negative value is not limited.
+	ClassConcurrency map[string]int
+
+	// Labels optionally specifies the labels of the server, e.g. the hardware or the
+	// region of the host. Use RequireLabel option to require labels to process a task.
+	//
+	// Example:
+	//
+	//     Labels: map[string]string{
+	//         "gpu":    "true",
+	//         "region": "eu",
+	//     }
+	//
+	// With the above config, the server processes the tasks which require no label
+	// as well as the tasks which require any of the above labels, while servers without
+	// the "gpu" label set aside the tasks which require it, for the servers with
+	// the label to process them in order.
+	//
+	// Labels with an empty key, a key containing a comma or an equal sign,
+	// or a value containing a comma are ignored.
+	Labels map[string]string
+
 	// StrictPriority indicates whether the queue priority should be treated strictly.
 	//
 	// If set to true, tasks in the queue with the highest priority is processed first.
@@ -120,6 +216,34 @@ type Config struct {
 	//     ErrorHandler: asynq.ErrorHandlerFunc(reportError)
 	ErrorHandler ErrorHandler
 
+	// CrashOnPanic specifies whether a panic in the task handler should crash the process.
+	//
+	// By default, Server recovers from the panic and treats it as a failure of the task,
+	// which is retried like any other failed task. The error passed to ErrorHandler is
+	// a *PanicError containing the panic value and the stack trace.
+	//
+	// If set to true, the *PanicError is reported to ErrorHandler and the panic is propagated,
+	// terminating the process. The active task is recovered by another server after its deadline.
+	CrashOnPanic bool
+
+	// UnhandledTaskPolicy specifies what to do with a task for which the handler
+	// returns an error wrapping ErrHandlerNotFound, i.e. a task whose type has no
+	// handler registered with the ServeMux (e.g. a task enqueued by a newer version
+	// of the application during a rolling deploy).
+	//
+	// Such tasks are counted in QueueInfo.UnhandledTotal regardless of the policy.
+	//
+	// If unset, RetryUnhandled is used, and the task is retried like any other failed task.
+	UnhandledTaskPolicy UnhandledTaskPolicy
+
+	// UndecodableTaskPolicy specifies what to do with a dequeued task whose data
+	// cannot be decoded (e.g. written to redis by a faulty producer), which cannot
+	// be processed nor retried.
+	//
+	// If unset, QuarantineUndecodable is used, and the task is kept with its data
+	// for repair.
+	UndecodableTaskPolicy UndecodableTaskPolicy
+
 	// Logger specifies the logger used by the server instance.
 	//
 	// If unset, default logger is used.
@@ -130,12 +254,169 @@ type Config struct {
 	// If unset, InfoLevel is used by default.
 	LogLevel LogLevel
 
+	// LogSampleFirst and LogSampleThereafter specify how repeated log messages are sampled,
+	// so that high-frequency messages (e.g. dequeue errors while redis is unavailable, or
+	// debug logs of an idle processor) don't flood the log output.
+	//
+	// Within each second, the first LogSampleFirst messages with the same level and text
+	// (or format string, for formatted messages) are logged, and after that every
+	// LogSampleThereafter-th one. If LogSampleThereafter is zero, the rest are dropped.
+	//
+	// If LogSampleFirst is unset or zero, all messages are logged.
+	LogSampleFirst      int
+	LogSampleThereafter int
+
+	// DebugAddr specifies the TCP address (e.g. "localhost:6060") to serve debug endpoints on.
+	//
+	// The following endpoints are served:
+	//   /debug/pprof/         runtime profiles, which can be read with go tool pprof
+	//   /debug/asynq/server   server info and the configuration after defaults are applied
+	//   /debug/asynq/workers  tasks being processed by the server
+	//   /debug/asynq/broker   result and latency of a ping to redis
+	//
+	// The endpoints are not authenticated, so the address should not be reachable
+	// from untrusted networks.
+	//
+	// If unset, debug endpoints are not served.
+	DebugAddr string
+
+	// AuditLog specifies whether to record the tasks started, retried and archived
+	// by the server in the audit logs of their queues.
+	//
+	// The audit log of a queue is a capped redis stream holding the most recent
+	// events of the queue, and can be read with Inspector.ListAuditEvents.
+	// Enable ClientConfig.AuditLog and InspectorConfig.AuditLog as well to record
+	// the tasks enqueued, and the tasks run, archived and deleted by operators.
+	// Audit logs require Redis 5.0 or higher.
+	//
+	// Note: Events are recorded after the task changes state and may be missing
+	// if recording fails, e.g. on network errors.
+	AuditLog bool
+
+	// PublishEvents specifies whether to publish the tasks started, completed, retried
+	// and archived by the server to the subscribers of their queues, which can be
+	// received with Inspector.Subscribe.
+	// Enable ClientConfig.PublishEvents and InspectorConfig.PublishEvents as well to
+	// publish the tasks enqueued, and the actions of operators.
+	//
+	// Events are published with redis PubSub at the cost of one more round-trip
+	// to redis per event, and are lost if no one is subscribed.
+	PublishEvents bool
+
 	// ShutdownTimeout specifies the duration to wait to let workers finish their tasks
 	// before forcing them to abort when stopping the server.
 	//
+	// Handlers are notified when the shutdown starts via the channel returned by
+	// GetShutdownSignal, and can use the timeout to checkpoint their progress.
+	// The tasks of the aborted workers are pushed back to their queues in the
+	// priority order of the queues.
+	//
 	// If unset or zero, default timeout of 8 seconds is used.
 	ShutdownTimeout time.Duration
 
+	// ShutdownStatusTTL specifies how long the server is listed by Inspector.Servers
+	// after it shuts down, with status "closed" and the number of tasks finished and
+	// requeued during the shutdown, e.g. for deploy tooling to check whether tasks
+	// were aborted.
+	//
+	// If unset or zero, the server is unlisted once it shuts down.
+	ShutdownStatusTTL time.Duration
+
+	// PollInterval specifies the maximum duration to wait before checking
+	// empty queues for new tasks again.
+	//
+	// Idle servers are woken up as soon as tasks become pending in their queues:
+	// when tasks are enqueued by Client, scheduled or retry tasks become ready,
+	// the next task of a group or the tasks waiting for a completed task are released,
+	// tasks are run with Inspector, or a queue is unpaused. Polling picks up the tasks
+	// whose wakeup message is missed, e.g. while the server reconnects to redis.
+	//
+	// If unset or zero, default interval of 1 second is used.
+	PollInterval time.Duration
+
+	// MinPollInterval specifies the duration to wait before checking the queues
+	// again once they are found empty after processing a task.
+	//
+	// The wait doubles each time the queues are found empty, up to PollInterval,
+	// and drops back to MinPollInterval once a task is found, so that a busy server
+	// picks up tasks with low latency while an idle server checks redis rarely.
+	//
+	// If unset or zero, default interval of 100 milliseconds is used.
+	// If MinPollInterval is not less than PollInterval, the server always waits for PollInterval.
+	MinPollInterval time.Duration
+
+	// ForwardBatchSize specifies the maximum number of scheduled or retry tasks
+	// moved to the pending state in a single script call, when they become ready.
+	// All ready tasks are moved on each check; smaller batches keep each call short
+	// so that redis is not blocked for long by a large backlog of ready tasks.
+	//
+	// If unset or zero, default batch size of 100 is used.
+	ForwardBatchSize int
+
+	// StaleTaskAge specifies how long after the time they were to be processed scheduled
+	// and retry tasks are considered stale. The server periodically archives the stale
+	// tasks of its queues with the ArchiveReasonStale reason.
+	//
+	// Tasks become ready and are moved to the pending state within a second of their
+	// process time, so stale tasks are tasks stuck in these states, e.g. because of a
+	// past bug. Use an age well above the time a server may be down, e.g. a week, so
+	// that the tasks waiting for the servers to be up again are not archived.
+	//
+	// If unset or zero, stale tasks are not archived.
+	StaleTaskAge time.Duration
+
+	// AckBatchInterval specifies the maximum duration to hold the acknowledgement
+	// of a processed task (i.e. marking it as done, retried or archived), so that
+	// the acknowledgements from all workers are sent to redis in pipelined batches.
+	//
+	// At high throughput this cuts the number of round-trips to redis, at the cost of
+	// up to AckBatchInterval of latency per task. Each acknowledgement still runs
+	// its own script, and a worker waits for its acknowledgement to complete.
+	//
+	// If unset or zero, acknowledgements are sent to redis one at a time.
+	AckBatchInterval time.Duration
+
+	// AckBatchSize specifies the number of acknowledgements which triggers sending
+	// the batch before AckBatchInterval elapses. Used only if AckBatchInterval is set.
+	//
+	// If unset or zero, default batch size of 100 is used.
+	AckBatchSize int
+
+	// MaxArchivedPayloadSize specifies the maximum size in bytes of the payload of a
+	// task archived by the server (e.g. after it exhausted its retries), so that large
+	// payloads don't bloat redis. Larger payloads are truncated to this size; the task
+	// keeps its type, error and other metadata, and TaskInfo reports the size and
+	// SHA-256 digest of the original payload.
+	//
+	// Truncated archived tasks cannot be run or cloned by Inspector, and are left in
+	// the archive by RunAllArchivedTasks.
+	//
+	// If unset or zero, archived payloads are kept intact.
+	MaxArchivedPayloadSize int
+
+	// PayloadStore is the store of the payloads stored outside of redis by clients
+	// (see ClientConfig.PayloadStore). The server loads the payload of such a task
+	// from the store before calling the handler, and deletes it from the store once
+	// the task is processed successfully, unless the task is retained (see Retention option).
+	//
+	// Payloads of tasks which are retained, archived or deleted with Inspector are not
+	// deleted from the store; use the expiration policy of the store to clean them up.
+	//
+	// If unset, tasks with payloads stored externally fail to be processed.
+	PayloadStore PayloadStore
+
+	// SigningKey is the key with which clients sign the tasks (see ClientConfig.SigningKey).
+	// If set, the server verifies the signature of each task before processing it, and
+	// moves the tasks which are not signed or whose signature is invalid to the quarantine
+	// of the queue without calling the handler (see Inspector.ListQuarantinedTasks), so
+	// that they cannot be run again as-is. ErrorHandler is called with ErrBadSignature
+	// for such tasks.
+	//
+	// Note that tasks enqueued before the clients started signing tasks are not signed.
+	//
+	// If unset, signatures are not verified.
+	SigningKey []byte
+
 	// HealthCheckFunc is called periodically with any errors encountered during ping to the
 	// connected redis server.
 	HealthCheckFunc func(error)
@@ -144,8 +425,221 @@ type Config struct {
 	//
 	// If unset or zero, the interval is set to 15 seconds.
 	HealthCheckInterval time.Duration
+
+	// QueueHistoryInterval specifies the interval between samples of the number of
+	// tasks in each state of the queues, which are returned by Inspector.QueueHistory.
+	// The servers processing a queue share the samples of the queue, and the most
+	// recent 10,000 samples of each queue are kept.
+	//
+	// If unset or zero, the interval is set to 5 minutes.
+	// If negative, the queues are not sampled by the server.
+	QueueHistoryInterval time.Duration
+
+	// ExpiryNotifier is called once a day with a digest of the archived tasks of each
+	// queue which are deleted within the next day by the retention policy of the archive,
+	// either by age or to keep the archive within its maximum size, so that the tasks
+	// can be inspected or run before they are dropped.
+	// The servers share the digests: each digest is delivered by one of the servers only.
+	// If the notifier returns an error, the digest is made again on the next hourly check.
+	//
+	// If unset, no digest is made.
+	ExpiryNotifier ExpiryNotifier
+
+	// BrokerLatencyFunc is called after each redis command run by the server
+	// with the name of the operation and the time it took, so that slow lua scripts
+	// or network issues can be diagnosed. See BrokerLatencyFunc for details.
+	BrokerLatencyFunc BrokerLatencyFunc
+
+	// CircuitBreakerThreshold specifies the number of consecutive broker errors after
+	// which the server stops trying to dequeue tasks for the duration of CircuitBreakerCoolOff.
+	// While the circuit is open, HealthCheckFunc is called with an error wrapping ErrCircuitOpen.
+	//
+	// After the cool-off period, the server retries once: the circuit closes if the
+	// attempt succeeds and opens again otherwise.
+	//
+	// If unset or zero, the circuit breaker is disabled.
+	CircuitBreakerThreshold int
+
+	// CircuitBreakerCoolOff specifies how long the server waits before retrying
+	// the broker once the circuit opens.
+	//
+	// If unset or zero, the cool-off period is set to 30 seconds.
+	CircuitBreakerCoolOff time.Duration
+
+	// QueueFailureThreshold specifies the fraction of failed tasks, between 0 and 1,
+	// among the last QueueFailureWindow tasks processed from a queue above which the
+	// server pauses the queue for the duration of QueueFailureCoolOff, so that retries
+	// don't keep hammering a dependency which is down.
+	//
+	// The queue is paused in redis, so that all servers stop processing its tasks,
+	// and unpaused automatically after the cool-off period. A "tripped" event is
+	// recorded for the queue (see Config.AuditLog and Config.PublishEvents).
+	// Use Inspector.UnpauseQueue to unpause the queue before the cool-off elapses.
+	//
+	// Only the tasks processed by the server count towards the failure rate, and
+	// errors for which IsFailure returns false are not counted.
+	//
+	// If unset or zero, queues are never paused because of failures.
+	QueueFailureThreshold float64
+
+	// QueueFailureWindow specifies the number of the last tasks processed from a
+	// queue the failure rate is computed over.
+	//
+	// If unset or zero, the window is set to 100 tasks.
+	QueueFailureWindow int
+
+	// QueueFailureCoolOff specifies how long a queue is paused for once its
+	// failure rate exceeds QueueFailureThreshold.
+	//
+	// If unset or zero, the cool-off period is set to 1 minute.
+	QueueFailureCoolOff time.Duration
+
+	// ResultCacheTTL optionally maps task type names to how long the completion of a task
+	// of the type enqueued with an IdempotencyKey option is remembered.
+	//
+	// Within that time, a task of the same type with the same idempotency key (e.g. a task
+	// enqueued again after its idempotency key expired) is completed without calling the
+	// handler, and gets the result written by the completed task, if any.
+	// Use this for task types whose handlers are idempotent and costly to run.
+	//
+	// Example:
+	//
+	//     ResultCacheTTL: map[string]time.Duration{
+	//         "report:generate": 24 * time.Hour,
+	//     }
+	//
+	// If unset, all tasks are processed by the handler.
+	ResultCacheTTL map[string]time.Duration
+
+	// TaskSampleRate is the fraction, between 0 and 1, of the successfully processed
+	// tasks whose payload size, processing duration and wait time in the queue are
+	// sampled, for capacity analysis with Inspector.TaskSampleStats.
+	// The most recent 1,000 samples of each queue are kept.
+	//
+	// If unset or zero, no task is sampled.
+	TaskSampleRate float64
+
+	// TrackLatency enables the latency histograms of the successfully processed tasks,
+	// per queue and task type, reported by Inspector.TaskLatencyStats. Two latencies
+	// are counted for each task: the wait time, from the time the task became pending
+	// to the start of the processing which completed it, and the run time of the handler.
+	// Like the wait time of TaskSampleRate, the wait time excludes the time the task was
+	// scheduled or waiting to be retried.
+	//
+	// Tracking the latency costs a round trip to redis for each processed task.
+	TrackLatency bool
+
+	// RetryWindows optionally maps queue names to the windows within which the retries
+	// of their tasks may be processed, e.g. for tasks calling a partner API available
+	// only during business hours.
+	//
+	// The retry time computed by RetryDelayFunc (or requested with RetryAt) is moved
+	// forward to the start of the next window if it falls outside of a window.
+	// Windows with Start or End outside of a day are ignored.
+	//
+	// Example:
+	//
+	//     RetryWindows: map[string]asynq.RetryWindow{
+	//         "partner": {Start: 8 * time.Hour, End: 20 * time.Hour, Location: jakarta},
+	//     }
+	//
+	// If unset, retries are processed as soon as they are due.
+	RetryWindows map[string]RetryWindow
+
+	// QueueRetryPolicies optionally maps queue names to the policies with which their
+	// failed tasks are retried, overriding RetryDelayFunc and the default max retry of
+	// the client for the queue, e.g. to retry webhooks aggressively and reports barely.
+	//
+	// The max retry of a policy applies to the tasks enqueued without the MaxRetry
+	// option only, so that a task can still override it. See RetryPolicy for details.
+	//
+	// If unset, tasks are retried with RetryDelayFunc up to their max retry.
+	QueueRetryPolicies map[string]RetryPolicy
+
+	// Environment specifies the name of the environment the server runs in
+	// (e.g. "staging", "production"), to guard against processing the tasks of
+	// another environment when the redis database is misconfigured.
+	//
+	// The first client or server with an environment to connect to a redis database
+	// labels the database with its environment. Start returns an error wrapping
+	// ErrEnvironmentMismatch if the database is labeled with another environment.
+	// The environment is reported in ServerInfo and QueueInfo.
+	//
+	// Environments are isolated by database only: the keys of asynq are not
+	// namespaced, so each environment must use its own database (see RedisClientOpt.DB)
+	// or redis instance. An environment cannot share a database with another one.
+	//
+	// If unset, the server processes tasks from any database.
+	Environment string
+
+	// StrictCompatibility specifies whether Start returns an error wrapping
+	// ErrIncompatibleServers if the server is incompatible with the running servers
+	// of its environment.
+	//
+	// Servers report the version of the library and the features which affect how
+	// tasks are read (PayloadStore, SigningKey) in their heartbeat. On Start, the
+	// server checks that the running servers sharing a queue with it have the same
+	// features and that all running servers run the same minor version of the library,
+	// so that upgrades changing how tasks are stored can be rolled out safely.
+	//
+	// If unset, the incompatibilities are logged as warnings.
+	StrictCompatibility bool
+
+	// Mirror specifies the redis database to which the clients mirror the tasks
+	// of the primary database (see ClientConfig.Mirror).
+	//
+	// If the mirror has been promoted (see Inspector.PromoteMirror), the server
+	// connects to the mirror instead of the primary database when started, so that
+	// the servers process the tasks of the mirror once restarted after a failover.
+	// Start waits up to 5 seconds for the mirror to respond, and keeps the server
+	// on the primary database if the mirror cannot be reached.
+	//
+	// If unset, the server processes the tasks of the primary database.
+	Mirror RedisConnOpt
 }
 
+// ErrCircuitOpen indicates that the server paused task processing
+// because of repeated broker errors.
+//
+// See Config.CircuitBreakerThreshold for details.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// UnhandledTaskPolicy specifies how the server handles tasks with no handler
+// registered for their type. See Config.UnhandledTaskPolicy.
+type UnhandledTaskPolicy int
+
+const (
+	// RetryUnhandled retries the task like any other failed task,
+	// and archives it once it has no retries left.
+	RetryUnhandled UnhandledTaskPolicy = iota
+
+	// ParkUnhandled moves the task to the unhandled state right away, without
+	// consuming its retries. Unhandled tasks are kept until they are run again
+	// (e.g. with Inspector.RunAllUnhandledTasks after the handler is deployed)
+	// or deleted.
+	ParkUnhandled
+
+	// ArchiveUnhandled archives the task right away,
+	// with ArchiveReasonNoHandler as its archive reason.
+	ArchiveUnhandled
+)
+
+// UndecodableTaskPolicy specifies how the server handles tasks whose data cannot
+// be decoded. See Config.UndecodableTaskPolicy.
+type UndecodableTaskPolicy int
+
+const (
+	// QuarantineUndecodable moves the task to the quarantine of its queue with its
+	// data kept as is. Quarantined tasks are counted in QueueInfo.Quarantined, and
+	// can be listed with Inspector.ListQuarantinedTasks and repaired with
+	// Inspector.RepairQuarantinedTask.
+	QuarantineUndecodable UndecodableTaskPolicy = iota
+
+	// DropUndecodable deletes the task. Deleted tasks are counted in
+	// QueueInfo.DroppedTotal.
+	DropUndecodable
+)
+
 // An ErrorHandler handles an error occured during task processing.
 type ErrorHandler interface {
 	HandleError(ctx context.Context, task *Task, err error)
@@ -168,6 +662,16 @@ func (fn ErrorHandlerFunc) HandleError(ctx context.Context, task *Task, err erro
 // t is the task in question.
 type RetryDelayFunc func(n int, e error, t *Task) time.Duration
 
+// BrokerLatencyFunc is called after each redis command run by a Server, Client or
+// Inspector with the name of the operation, the time it took to complete, and the
+// error returned by redis, if any.
+//
+// Lua scripts are reported by the name of the script (e.g. "enqueue", "dequeue",
+// "done"), pipelines as "pipeline" and the other commands by their name (e.g. "zrange").
+//
+// The function is called synchronously and should return quickly.
+type BrokerLatencyFunc func(op string, d time.Duration, err error)
+
 // Logger supports logging at various log levels.
 type Logger interface {
 	// Debug logs a message at Debug level.
@@ -277,6 +781,38 @@ func DefaultRetryDelayFunc(n int, e error, t *Task) time.Duration {
 	return time.Duration(s) * time.Second
 }
 
+// ExponentialBackoff returns a RetryDelayFunc which uses the same exponential back-off
+// strategy as DefaultRetryDelayFunc, with configurable randomization and an upper bound.
+//
+// jitter is the fraction of the delay which is randomized, and should be in the range [0, 1].
+// E.g. with jitter 0.2, the delay is picked at random between 80% and 100% of the computed value,
+// so that tasks which failed at the same time are retried at different times.
+//
+// maxDelay caps the delay before jitter is applied. Zero or negative value means no cap.
+func ExponentialBackoff(jitter float64, maxDelay time.Duration) RetryDelayFunc {
+	jitter = math.Max(0, math.Min(jitter, 1))
+	if maxDelay <= 0 {
+		maxDelay = math.MaxInt64
+	}
+	// Retry count above which the delay reaches maxDelay. Comparing the retry
+	// count, rather than the computed delay, keeps large counts from overflowing.
+	maxN := math.Pow(math.Max(maxDelay.Seconds()-15, 0), 0.25)
+	return func(n int, e error, t *Task) time.Duration {
+		d := maxDelay
+		if float64(n) < maxN {
+			d = time.Duration(math.Pow(float64(n), 4)+15) * time.Second
+			if d > maxDelay {
+				d = maxDelay
+			}
+		}
+		if jitter > 0 {
+			r := rand.New(rand.NewSource(time.Now().UnixNano()))
+			d -= time.Duration(float64(d) * jitter * r.Float64())
+		}
+		return d
+	}
+}
+
 func defaultIsFailureFunc(err error) bool { return err != nil }
 
 var defaultQueueConfig = map[string]int{
@@ -287,6 +823,18 @@ const (
 	defaultShutdownTimeout = 8 * time.Second
 
 	defaultHealthCheckInterval = 15 * time.Second
+
+	defaultQueueHistoryInterval = 5 * time.Minute
+
+	defaultCircuitBreakerCoolOff = 30 * time.Second
+
+	defaultQueueFailureWindow  = 100
+	defaultQueueFailureCoolOff = time.Minute
+
+	defaultPollInterval    = time.Second
+	defaultMinPollInterval = 100 * time.Millisecond
+
+	defaultAckBatchSize = 100
 )
 
 // NewServer returns a new Server given a redis connection option
@@ -320,6 +868,34 @@ func NewServer(r RedisConnOpt, cfg Config) *Server {
 	if len(queues) == 0 {
 		queues = defaultQueueConfig
 	}
+	queueLimits := make(map[string]int)
+	for qname, n := range cfg.QueueConcurrency {
+		if _, ok := queues[qname]; ok && n > 0 {
+			queueLimits[qname] = n
+		}
+	}
+	retryWindows := make(map[string]RetryWindow)
+	for qname, w := range cfg.RetryWindows {
+		if w.valid() {
+			retryWindows[qname] = w
+		}
+	}
+	policies := make(retryPolicies)
+	for qname, p := range cfg.QueueRetryPolicies {
+		policies[qname] = p
+	}
+	classLimits := make(map[string]int)
+	for class, n := range cfg.ClassConcurrency {
+		if n > 0 {
+			classLimits[class] = n
+		}
+	}
+	labels := make(map[string]string)
+	for k, v := range cfg.Labels {
+		if base.ValidLabel(k, v) {
+			labels[k] = v
+		}
+	}
 	var qnames []string
 	for q := range queues {
 		qnames = append(qnames, q)
@@ -328,18 +904,54 @@ func NewServer(r RedisConnOpt, cfg Config) *Server {
 	if shutdownTimeout == 0 {
 		shutdownTimeout = defaultShutdownTimeout
 	}
+	pollInterval := cfg.PollInterval
+	if pollInterval == 0 {
+		pollInterval = defaultPollInterval
+	}
+	minPollInterval := cfg.MinPollInterval
+	if minPollInterval == 0 {
+		minPollInterval = defaultMinPollInterval
+	}
 	healthcheckInterval := cfg.HealthCheckInterval
 	if healthcheckInterval == 0 {
 		healthcheckInterval = defaultHealthCheckInterval
 	}
+	queueHistoryInterval := cfg.QueueHistoryInterval
+	if queueHistoryInterval == 0 {
+		queueHistoryInterval = defaultQueueHistoryInterval
+	}
+	coolOff := cfg.CircuitBreakerCoolOff
+	if coolOff == 0 {
+		coolOff = defaultCircuitBreakerCoolOff
+	}
+	breaker := newCircuitBreaker(cfg.CircuitBreakerThreshold, coolOff)
+	failureWindow := cfg.QueueFailureWindow
+	if failureWindow <= 0 {
+		failureWindow = defaultQueueFailureWindow
+	}
+	queueCoolOff := cfg.QueueFailureCoolOff
+	if queueCoolOff <= 0 {
+		queueCoolOff = defaultQueueFailureCoolOff
+	}
 	logger := log.NewLogger(cfg.Logger)
 	loglevel := cfg.LogLevel
 	if loglevel == level_unspecified {
 		loglevel = InfoLevel
 	}
 	logger.SetLevel(toInternalLogLevel(loglevel))
-
+	logger.SetSampling(cfg.LogSampleFirst, cfg.LogSampleThereafter, time.Second)
 	rdb := rdb.NewRDB(c)
+	rdb.SetForwardBatchSize(cfg.ForwardBatchSize)
+	ackBatchSize := cfg.AckBatchSize
+	if ackBatchSize <= 0 {
+		ackBatchSize = defaultAckBatchSize
+	}
+	rdb.SetAckBatching(cfg.AckBatchInterval, ackBatchSize)
+	rdb.SetMaxArchivedPayloadSize(cfg.MaxArchivedPayloadSize)
+	rdb.SetAuditLog(cfg.AuditLog)
+	rdb.SetEventPublishing(cfg.PublishEvents)
+	rdb.SetDropUndecodable(cfg.UndecodableTaskPolicy == DropUndecodable)
+	rdb.SetLatencyFunc(cfg.BrokerLatencyFunc)
 	starting := make(chan *workerInfo)
 	finished := make(chan *base.TaskMessage)
 	syncCh := make(chan *syncRequest)
@@ -358,6 +970,9 @@ func NewServer(r RedisConnOpt, cfg Config) *Server {
 		concurrency:    n,
 		queues:         queues,
 		strictPriority: cfg.StrictPriority,
+		environment:    cfg.Environment,
+		features:       serverFeatures(cfg),
+		statusTTL:      cfg.ShutdownStatusTTL,
 		state:          state,
 		starting:       starting,
 		finished:       finished,
@@ -368,11 +983,6 @@ func NewServer(r RedisConnOpt, cfg Config) *Server {
 		queues:   qnames,
 		interval: 5 * time.Second,
 	})
-	subscriber := newSubscriber(subscriberParams{
-		logger:       logger,
-		broker:       rdb,
-		cancelations: cancels,
-	})
 	processor := newProcessor(processorParams{
 		logger:          logger,
 		broker:          rdb,
@@ -382,31 +992,107 @@ func NewServer(r RedisConnOpt, cfg Config) *Server {
 		cancelations:    cancels,
 		concurrency:     n,
 		queues:          queues,
+		queueLimits:     queueLimits,
+		classLimits:     classLimits,
+		labels:          base.FormatLabels(labels),
 		strictPriority:  cfg.StrictPriority,
 		errHandler:      cfg.ErrorHandler,
+		crashOnPanic:    cfg.CrashOnPanic,
+		unhandledPolicy: cfg.UnhandledTaskPolicy,
+		breaker:         breaker,
+		queueBreaker:    newQueueBreaker(cfg.QueueFailureThreshold, failureWindow),
+		queueCoolOff:    queueCoolOff,
+		resultCacheTTL:  cfg.ResultCacheTTL,
+		sampleRate:      cfg.TaskSampleRate,
+		trackLatency:    cfg.TrackLatency,
+		retryWindows:    retryWindows,
+		retryPolicies:   policies,
+		baseCtxFn:       cfg.BaseContext,
 		shutdownTimeout: shutdownTimeout,
+		pollInterval:    pollInterval,
+		minPollInterval: minPollInterval,
+		payloadStore:    cfg.PayloadStore,
+		signingKey:      cfg.SigningKey,
 		starting:        starting,
 		finished:        finished,
 	})
+	subscriber := newSubscriber(subscriberParams{
+		logger:       logger,
+		broker:       rdb,
+		cancelations: cancels,
+		serverID:     heartbeater.serverID,
+		setConcurrency: func(n int) {
+			processor.setConcurrency(n)
+			heartbeater.setConcurrency(n)
+		},
+		quiet: func() {
+			processor.stop()
+			state.Set(base.StateStopped)
+		},
+		wakeup: processor.wakeup,
+		queues: qnames,
+	})
 	recoverer := newRecoverer(recovererParams{
 		logger:         logger,
 		broker:         rdb,
 		retryDelayFunc: delayFunc,
+		retryPolicies:  policies,
 		isFailureFunc:  isFailureFunc,
 		queues:         qnames,
 		interval:       1 * time.Minute,
+
+		retryLeaseExpired: cfg.RetryLeaseExpired,
 	})
 	healthchecker := newHealthChecker(healthcheckerParams{
 		logger:          logger,
 		broker:          rdb,
 		interval:        healthcheckInterval,
 		healthcheckFunc: cfg.HealthCheckFunc,
+		breaker:         breaker,
 	})
+	var staleTaskAge time.Duration
+	if cfg.StaleTaskAge > 0 {
+		staleTaskAge = cfg.StaleTaskAge
+	}
 	janitor := newJanitor(janitorParams{
 		logger:   logger,
 		broker:   rdb,
 		queues:   qnames,
 		interval: 8 * time.Second,
+		staleAge: staleTaskAge,
+	})
+	historian := newHistorian(historianParams{
+		logger:   logger,
+		broker:   rdb,
+		queues:   qnames,
+		interval: queueHistoryInterval,
+	})
+	digester := newDigester(digesterParams{
+		logger:   logger,
+		broker:   rdb,
+		notifier: cfg.ExpiryNotifier,
+		queues:   qnames,
+		interval: expiryDigestCheckInterval,
+		period:   expiryDigestPeriod,
+	})
+	debug := newDebugServer(debugServerParams{
+		logger: logger,
+		broker: rdb,
+		addr:   cfg.DebugAddr,
+		config: &debugConfig{
+			Queues:              queues,
+			StrictPriority:      cfg.StrictPriority,
+			QueueConcurrency:    queueLimits,
+			ClassConcurrency:    classLimits,
+			Labels:              labels,
+			Environment:         cfg.Environment,
+			ShutdownTimeout:     shutdownTimeout.String(),
+			HealthCheckInterval: healthcheckInterval.String(),
+			PollInterval:        pollInterval.String(),
+			MinPollInterval:     minPollInterval.String(),
+			LogLevel:            loglevel.String(),
+		},
+		state: heartbeater.currentState,
 	})
 	return &Server{
 		logger:        logger,
@@ -420,6 +1106,14 @@ func NewServer(r RedisConnOpt, cfg Config) *Server {
 		recoverer:     recoverer,
 		healthchecker: healthchecker,
 		janitor:       janitor,
+		historian:     historian,
+		digester:      digester,
+		debug:         debug,
+		environment:   cfg.Environment,
+
+		strictCompatibility: cfg.StrictCompatibility,
+		rdb:                 rdb,
+		mirror:              cfg.Mirror,
 	}
 }
 
@@ -435,6 +1129,9 @@ func NewServer(r RedisConnOpt, cfg Config) *Server {
 // One exception to this rule is when ProcessTask returns a SkipRetry error.
 // If the returned error is SkipRetry or an error wraps SkipRetry, retry is
 // skipped and the task will be immediately archived instead.
+//
+// If the returned error is created by RetryIn or RetryAt, or wraps such an error,
+// the task is retried at the specified time instead of after the retry delay.
 type Handler interface {
 	ProcessTask(context.Context, *Task) error
 }
@@ -489,6 +1186,15 @@ func (srv *Server) Start(handler Handler) error {
 	case base.StateClosed:
 		return ErrServerClosed
 	}
+	if srv.mirror != nil {
+		switchToPromotedMirror(srv.rdb, srv.mirror, srv.logger)
+	}
+	if err := checkEnvironment(srv.broker, srv.environment); err != nil {
+		return err
+	}
+	if err := srv.checkCompatibility(); err != nil {
+		return err
+	}
 	srv.state.Set(base.StateActive)
 	srv.processor.handler = handler
 
@@ -502,6 +1208,26 @@ func (srv *Server) Start(handler Handler) error {
 	srv.forwarder.start(&srv.wg)
 	srv.processor.start(&srv.wg)
 	srv.janitor.start(&srv.wg)
+	srv.historian.start(&srv.wg)
+	srv.digester.start(&srv.wg)
+	srv.debug.start(&srv.wg)
+	return nil
+}
+
+// SetConcurrency changes the maximum number of concurrent processing of tasks
+// while the server is running.
+//
+// If n is smaller than the number of active workers, active workers are not
+// interrupted, but no new task is processed until the number of active workers
+// drops below n.
+//
+// Concurrency of a running server can also be changed from another process
+// using Inspector.SetServerConcurrency.
+func (srv *Server) SetConcurrency(n int) error {
+	if n < 1 {
+		return fmt.Errorf("asynq: concurrency must be positive, got %d", n)
+	}
+	srv.subscriber.setConcurrency(n)
 	return nil
 }
 
@@ -521,12 +1247,17 @@ func (srv *Server) Shutdown() {
 	// Sender goroutines should be terminated before the receiver goroutines.
 	// processor -> syncer (via syncCh)
 	// processor -> heartbeater (via starting, finished channels)
+	// debug server -> heartbeater (via requests channel)
+	srv.debug.shutdown()
 	srv.forwarder.shutdown()
 	srv.processor.shutdown()
+	srv.heartbeater.setShutdownStats(srv.processor.shutdownStats())
 	srv.recoverer.shutdown()
 	srv.syncer.shutdown()
 	srv.subscriber.shutdown()
 	srv.janitor.shutdown()
+	srv.historian.shutdown()
+	srv.digester.shutdown()
 	srv.healthchecker.shutdown()
 	srv.heartbeater.shutdown()
 
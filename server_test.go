@@ -7,11 +7,13 @@ package asynq
 import (
 	"context"
 	"fmt"
+	"math"
 	"syscall"
 	"testing"
 	"time"
 
 	"github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
 	"github.com/hibiken/asynq/internal/rdb"
 	"github.com/hibiken/asynq/internal/testbroker"
 	"go.uber.org/goleak"
@@ -117,6 +119,43 @@ func TestServerErrServerRunning(t *testing.T) {
 	srv.Shutdown()
 }
 
+func TestServerSetConcurrency(t *testing.T) {
+	srv := NewServer(RedisClientOpt{Addr: ":6379"}, Config{LogLevel: testLogLevel, Concurrency: 2})
+	if err := srv.SetConcurrency(0); err == nil {
+		t.Error("(*Server).SetConcurrency(0) did not return error")
+	}
+	if err := srv.SetConcurrency(5); err != nil {
+		t.Fatalf("(*Server).SetConcurrency(5) returned error: %v", err)
+	}
+	if got := srv.processor.sema.limit; got != 5 {
+		t.Errorf("processor concurrency = %d, want 5", got)
+	}
+	if got := srv.heartbeater.getConcurrency(); got != 5 {
+		t.Errorf("heartbeater concurrency = %d, want 5", got)
+	}
+}
+
+func TestServerQuietSignal(t *testing.T) {
+	srv := NewServer(getRedisConnOpt(t), Config{LogLevel: testLogLevel})
+	if err := srv.Start(HandlerFunc(func(ctx context.Context, task *Task) error { return nil })); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown()
+	inspector := NewInspector(getRedisConnOpt(t))
+	defer inspector.Close()
+
+	// wait for the subscriber to establish connection to pubsub channel
+	time.Sleep(time.Second)
+	if err := inspector.QuietServer(srv.heartbeater.serverID); err != nil {
+		t.Fatalf("QuietServer returned error: %v", err)
+	}
+	time.Sleep(time.Second)
+
+	if got := srv.state.Get(); got != base.StateStopped {
+		t.Errorf("server state = %v, want %v", got, base.StateStopped)
+	}
+}
+
 func TestServerWithRedisDown(t *testing.T) {
 	// Make sure that server does not panic and exit if redis is down.
 	defer func() {
@@ -210,6 +249,38 @@ func TestServerWithFlakyBroker(t *testing.T) {
 	srv.Shutdown()
 }
 
+func TestExponentialBackoff(t *testing.T) {
+	tests := []struct {
+		jitter   float64
+		maxDelay time.Duration
+		n        int
+		wantMin  time.Duration
+		wantMax  time.Duration
+	}{
+		{jitter: 0, maxDelay: 0, n: 0, wantMin: 15 * time.Second, wantMax: 15 * time.Second},
+		{jitter: 0, maxDelay: 0, n: 3, wantMin: 96 * time.Second, wantMax: 96 * time.Second},
+		{jitter: 0, maxDelay: time.Hour, n: 20, wantMin: time.Hour, wantMax: time.Hour},
+		{jitter: 0.5, maxDelay: time.Hour, n: 20, wantMin: 30 * time.Minute, wantMax: time.Hour},
+		{jitter: 2, maxDelay: time.Hour, n: 20, wantMin: 0, wantMax: time.Hour},
+		{jitter: -1, maxDelay: 0, n: 1, wantMin: 16 * time.Second, wantMax: 16 * time.Second},
+		{jitter: 0, maxDelay: time.Hour, n: 1 << 20, wantMin: time.Hour, wantMax: time.Hour},
+		{jitter: 0, maxDelay: 0, n: math.MaxInt32, wantMin: math.MaxInt64, wantMax: math.MaxInt64},
+		{jitter: 0.5, maxDelay: 0, n: math.MaxInt32, wantMin: math.MaxInt64 / 2, wantMax: math.MaxInt64},
+	}
+
+	for _, tc := range tests {
+		fn := ExponentialBackoff(tc.jitter, tc.maxDelay)
+		for i := 0; i < 100; i++ {
+			got := fn(tc.n, fmt.Errorf("oops"), NewTask("foo", nil))
+			if got < tc.wantMin || got > tc.wantMax {
+				t.Errorf("ExponentialBackoff(%v, %v)(%d, ...) = %v, want in range [%v, %v]",
+					tc.jitter, tc.maxDelay, tc.n, got, tc.wantMin, tc.wantMax)
+				break
+			}
+		}
+	}
+}
+
 func TestLogLevel(t *testing.T) {
 	tests := []struct {
 		flagVal string
@@ -238,3 +309,87 @@ func TestLogLevel(t *testing.T) {
 		}
 	}
 }
+
+// countingLogger is a Logger which counts the messages logged at each level.
+type countingLogger struct {
+	counts map[string]int
+}
+
+func (l *countingLogger) Debug(args ...interface{}) { l.counts["debug"]++ }
+func (l *countingLogger) Info(args ...interface{})  { l.counts["info"]++ }
+func (l *countingLogger) Warn(args ...interface{})  { l.counts["warn"]++ }
+func (l *countingLogger) Error(args ...interface{}) { l.counts["error"]++ }
+func (l *countingLogger) Fatal(args ...interface{}) { l.counts["fatal"]++ }
+
+func TestServerLogSampling(t *testing.T) {
+	logger := &countingLogger{counts: make(map[string]int)}
+	srv := NewServer(RedisClientOpt{Addr: ":6379"}, Config{
+		Logger:              logger,
+		LogLevel:            DebugLevel,
+		LogSampleFirst:      3,
+		LogSampleThereafter: 10,
+	})
+	defer srv.broker.Close()
+
+	for i := 0; i < 25; i++ {
+		srv.logger.Errorf("Dequeue error: %v", i)
+	}
+	// first 3 messages, then the 13th and the 23rd.
+	if got := logger.counts["error"]; got != 5 {
+		t.Errorf("logged %d error messages, want 5", got)
+	}
+}
+
+func TestServerAckBatching(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	redisConnOpt := getRedisConnOpt(t)
+	c := NewClient(redisConnOpt)
+	defer c.Close()
+	inspector := NewInspector(redisConnOpt)
+	defer inspector.Close()
+	srv := NewServer(redisConnOpt, Config{
+		Concurrency:      10,
+		LogLevel:         testLogLevel,
+		AckBatchInterval: 10 * time.Millisecond,
+		AckBatchSize:     3,
+	})
+
+	const n = 5
+	processed := make(chan struct{}, n)
+	h := func(ctx context.Context, task *Task) error {
+		processed <- struct{}{}
+		return nil
+	}
+	if err := srv.Start(HandlerFunc(h)); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown()
+
+	for i := 0; i < n; i++ {
+		if _, err := c.Enqueue(NewTask("send_email", nil)); err != nil {
+			t.Fatalf("could not enqueue a task: %v", err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case <-processed:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("processed %d tasks, want %d", i, n)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info, err := inspector.GetQueueInfo("default")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Active == 0 && info.Processed == n {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queue has %d active and %d processed tasks, want 0 active and %d processed", info.Active, info.Processed, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
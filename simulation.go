@@ -0,0 +1,286 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/errors"
+	"github.com/hibiken/asynq/internal/fakebroker"
+	"github.com/hibiken/asynq/internal/log"
+	"github.com/hibiken/asynq/internal/timeutil"
+)
+
+// Simulation processes tasks with a Handler in the calling goroutine, using an
+// in-memory broker and a simulated clock instead of Redis and the system time.
+//
+// Simulation makes the behavior of a handler over time (e.g. retry, backoff and
+// scheduling) testable without sleeps or races: a test enqueues tasks, advances
+// the clock with Advance, and processes the tasks which are due with Step or Drain.
+//
+//	sim := asynq.NewSimulation(asynq.Config{}, handler)
+//	sim.Enqueue(asynq.NewTask("email:send", payload))
+//	sim.Drain()              // the handler fails, the task is scheduled for retry.
+//	sim.Advance(time.Minute) // the task becomes pending once the retry delay elapses.
+//	sim.Drain()              // the task is processed again.
+//
+// Queues are always queried in the order of their priority, as if
+// Config.StrictPriority was set, so that the order in which tasks are processed
+// is deterministic. Task groups, task dependencies and idempotency keys are not supported.
+type Simulation struct {
+	logger *log.Logger
+	clock  *timeutil.SimulatedClock
+	broker *fakebroker.Broker
+	proc   *processor
+	syncCh chan *syncRequest
+	qnames []string // queue names in the order of their priority.
+}
+
+// NewSimulation returns a new Simulation processing tasks with the given handler.
+// The simulated clock starts at the current time.
+//
+// Only the fields of cfg which apply to processing a single task are used:
+// Queues, RetryDelayFunc, QueueRetryPolicies, RetryWindows, IsFailure, ErrorHandler,
+// UnhandledTaskPolicy, BaseContext, PayloadStore, SigningKey, Logger and LogLevel.
+// Tasks enqueued with Enqueue are signed with SigningKey, if set.
+func NewSimulation(cfg Config, handler Handler) *Simulation {
+	delayFunc := cfg.RetryDelayFunc
+	if delayFunc == nil {
+		delayFunc = DefaultRetryDelayFunc
+	}
+	isFailureFunc := cfg.IsFailure
+	if isFailureFunc == nil {
+		isFailureFunc = defaultIsFailureFunc
+	}
+	queues := make(map[string]int)
+	for qname, p := range cfg.Queues {
+		if err := base.ValidateQueueName(qname); err != nil {
+			continue // ignore invalid queue names
+		}
+		if p > 0 {
+			queues[qname] = p
+		}
+	}
+	if len(queues) == 0 {
+		queues = defaultQueueConfig
+	}
+	var qnames []string
+	for qname := range queues {
+		qnames = append(qnames, qname)
+	}
+	sort.Slice(qnames, func(i, j int) bool {
+		if queues[qnames[i]] != queues[qnames[j]] {
+			return queues[qnames[i]] > queues[qnames[j]]
+		}
+		return qnames[i] < qnames[j]
+	})
+	logger := log.NewLogger(cfg.Logger)
+	loglevel := cfg.LogLevel
+	if loglevel == level_unspecified {
+		loglevel = InfoLevel
+	}
+	logger.SetLevel(toInternalLogLevel(loglevel))
+
+	clock := timeutil.NewSimulatedClock(time.Unix(time.Now().Unix(), 0))
+	broker := fakebroker.New(clock)
+	syncCh := make(chan *syncRequest, 100)
+	proc := newProcessor(processorParams{
+		logger:          logger,
+		broker:          broker,
+		clock:           clock,
+		retryDelayFunc:  delayFunc,
+		isFailureFunc:   isFailureFunc,
+		syncCh:          syncCh,
+		cancelations:    base.NewCancelations(),
+		concurrency:     1,
+		queues:          queues,
+		strictPriority:  true,
+		errHandler:      cfg.ErrorHandler,
+		unhandledPolicy: cfg.UnhandledTaskPolicy,
+		retryWindows:    cfg.RetryWindows,
+		retryPolicies:   retryPolicies(cfg.QueueRetryPolicies),
+		baseCtxFn:       cfg.BaseContext,
+		payloadStore:    cfg.PayloadStore,
+		signingKey:      cfg.SigningKey,
+	})
+	proc.handler = handler
+	return &Simulation{
+		logger: logger,
+		clock:  clock,
+		broker: broker,
+		proc:   proc,
+		syncCh: syncCh,
+		qnames: qnames,
+	}
+}
+
+// Now returns the current time of the simulated clock.
+func (s *Simulation) Now() time.Time {
+	return s.clock.Now()
+}
+
+// Advance moves the simulated clock forward by d, and makes the scheduled
+// and retry tasks which are due by then pending.
+func (s *Simulation) Advance(d time.Duration) {
+	s.clock.AdvanceTime(d)
+	s.forward()
+}
+
+func (s *Simulation) forward() {
+	if err := s.broker.ForwardIfReady(s.qnames...); err != nil {
+		s.logger.Errorf("Failed to forward scheduled tasks: %v", err)
+	}
+}
+
+// Enqueue enqueues the given task as Client.Enqueue does, taking the current time
+// from the simulated clock.
+//
+// GroupKey, DependsOn and IdempotencyKey options are not supported and make Enqueue return an error.
+func (s *Simulation) Enqueue(task *Task, opts ...Option) (*TaskInfo, error) {
+	if strings.TrimSpace(task.Type()) == "" {
+		return nil, fmt.Errorf("task typename cannot be empty")
+	}
+	now := s.clock.Now()
+	opts = append(task.opts, opts...)
+	opt, err := composeOptionsAt(now, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if opt.groupKey != "" || len(opt.dependencies) > 0 || opt.idempotencyKey != "" {
+		return nil, fmt.Errorf("GroupKey, DependsOn and IdempotencyKey options are not supported in simulation")
+	}
+	deadline := noDeadline
+	if !opt.deadline.IsZero() {
+		deadline = opt.deadline
+	}
+	timeout := noTimeout
+	if opt.timeout != 0 {
+		timeout = opt.timeout
+	}
+	if deadline.Equal(noDeadline) && timeout == noTimeout {
+		timeout = defaultTimeout
+	}
+	var uniqueKey string
+	if opt.uniqueTTL > 0 {
+		uniqueKey = base.UniqueKey(opt.queue, task.Type(), task.Payload())
+	}
+	msg := &base.TaskMessage{
+		ID:         opt.taskID,
+		Type:       task.Type(),
+		Payload:    task.Payload(),
+		Queue:      opt.queue,
+		Retry:      opt.retry,
+		Deadline:   deadline.Unix(),
+		Timeout:    int64(timeout.Seconds()),
+		UniqueKey:  uniqueKey,
+		Retention:  int64(opt.retention.Seconds()),
+		Headers:    opt.headers,
+		AtMostOnce: opt.atMostOnce,
+		Class:      opt.class,
+
+		EnqueuedAt:   now.UnixNano(),
+		DefaultRetry: !opt.retrySet,
+	}
+	if s.proc.signingKey != nil {
+		base.SignMessage(msg, s.proc.signingKey)
+	}
+	ctx := context.Background()
+	state := base.TaskStatePending
+	switch {
+	case opt.processAt.After(now) && opt.uniqueTTL > 0:
+		err = s.broker.ScheduleUnique(ctx, msg, opt.processAt, opt.processAt.Add(opt.uniqueTTL).Sub(now))
+		state = base.TaskStateScheduled
+	case opt.processAt.After(now):
+		err = s.broker.Schedule(ctx, msg, opt.processAt)
+		state = base.TaskStateScheduled
+	case opt.uniqueTTL > 0:
+		opt.processAt = now
+		err = s.broker.EnqueueUnique(ctx, msg, opt.uniqueTTL)
+	default:
+		opt.processAt = now
+		err = s.broker.Enqueue(ctx, msg)
+	}
+	switch {
+	case errors.Is(err, errors.ErrDuplicateTask):
+		return nil, fmt.Errorf("%w", ErrDuplicateTask)
+	case errors.Is(err, errors.ErrTaskIdConflict):
+		return nil, fmt.Errorf("%w", ErrTaskIDConflict)
+	case err != nil:
+		return nil, err
+	}
+	return newTaskInfo(msg, state, opt.processAt, nil), nil
+}
+
+// Step processes the next pending task, if any, and reports whether a task was processed.
+//
+// The task is processed the way a Server processes it (e.g. its signature is verified
+// and its payload is loaded from the PayloadStore), except that the handler is called
+// in the calling goroutine. The task context has a deadline as far in the future as
+// the task deadline is from the simulated current time.
+func (s *Simulation) Step() bool {
+	s.forward()
+	msg, deadline, err := s.broker.Dequeue(s.qnames...)
+	if err != nil {
+		if !errors.Is(err, errors.ErrNoProcessableTask) {
+			s.logger.Errorf("Dequeue error: %v", err)
+		}
+		return false
+	}
+	p := s.proc
+	ctx, cancel := p.taskContext(msg, time.Now().Add(deadline.Sub(s.clock.Now())))
+	defer cancel()
+	if !p.handleWithoutRun(ctx, msg) {
+		started := p.clock.Now()
+		payload, err := p.run(ctx, msg)
+		p.handleResult(ctx, msg, payload, started, err)
+	}
+	s.sync()
+	return true
+}
+
+// sync runs the broker operations which failed during a step once more.
+func (s *Simulation) sync() {
+	for {
+		select {
+		case req := <-s.syncCh:
+			if err := req.fn(); err != nil {
+				s.logger.Errorf("%s: %v", req.errMsg, err)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Drain processes pending tasks until there is none left, without advancing
+// the simulated clock, and returns the number of tasks processed.
+func (s *Simulation) Drain() int {
+	n := 0
+	for s.Step() {
+		n++
+	}
+	return n
+}
+
+// Tasks returns the tasks in the given queue and state.
+//
+// Pending tasks are returned in the order they are processed, and scheduled and
+// retry tasks in the order they become pending.
+func (s *Simulation) Tasks(qname string, state TaskState) []*TaskInfo {
+	st, err := toBaseTaskState(state)
+	if err != nil {
+		return nil
+	}
+	var res []*TaskInfo
+	for _, info := range s.broker.Tasks(qname, st) {
+		res = append(res, newTaskInfo(info.Message, info.State, info.NextProcessAt, info.Result))
+	}
+	return res
+}
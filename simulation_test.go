@@ -0,0 +1,199 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSimulationRetryBackoff(t *testing.T) {
+	var attempts []time.Time
+	var sim *Simulation
+	handler := func(ctx context.Context, task *Task) error {
+		attempts = append(attempts, sim.Now())
+		if len(attempts) < 3 {
+			return errors.New("temporary failure")
+		}
+		return nil
+	}
+	sim = NewSimulation(Config{
+		RetryDelayFunc: func(n int, err error, task *Task) time.Duration {
+			return time.Duration(n+1) * time.Minute
+		},
+		LogLevel: FatalLevel,
+	}, HandlerFunc(handler))
+	start := sim.Now()
+
+	if _, err := sim.Enqueue(NewTask("import", nil)); err != nil {
+		t.Fatalf("Enqueue returned error: %v", err)
+	}
+	if n := sim.Drain(); n != 1 {
+		t.Fatalf("Drain() = %d, want 1", n)
+	}
+	retry := sim.Tasks("default", TaskStateRetry)
+	if len(retry) != 1 {
+		t.Fatalf("got %d retry tasks, want 1", len(retry))
+	}
+	if want := start.Add(time.Minute); !retry[0].NextProcessAt.Equal(want) {
+		t.Errorf("NextProcessAt = %v, want %v", retry[0].NextProcessAt, want)
+	}
+
+	sim.Advance(59 * time.Second)
+	if n := sim.Drain(); n != 0 {
+		t.Errorf("Drain() before the retry delay elapsed = %d, want 0", n)
+	}
+	sim.Advance(time.Second)
+	if n := sim.Drain(); n != 1 {
+		t.Errorf("Drain() after the retry delay elapsed = %d, want 1", n)
+	}
+	sim.Advance(2 * time.Minute)
+	if n := sim.Drain(); n != 1 {
+		t.Errorf("Drain() after the second retry delay elapsed = %d, want 1", n)
+	}
+
+	want := []time.Time{start, start.Add(time.Minute), start.Add(3 * time.Minute)}
+	if diff := cmp.Diff(want, attempts); diff != "" {
+		t.Errorf("attempt times mismatch (-want,+got):\n%s", diff)
+	}
+	for _, state := range []TaskState{TaskStatePending, TaskStateRetry, TaskStateArchived} {
+		if got := sim.Tasks("default", state); len(got) != 0 {
+			t.Errorf("got %d tasks in state %v, want none", len(got), state)
+		}
+	}
+}
+
+func TestSimulationArchivesAfterMaxRetry(t *testing.T) {
+	sim := NewSimulation(Config{LogLevel: FatalLevel}, HandlerFunc(func(ctx context.Context, task *Task) error {
+		return errors.New("permanent failure")
+	}))
+	if _, err := sim.Enqueue(NewTask("import", nil), MaxRetry(1)); err != nil {
+		t.Fatalf("Enqueue returned error: %v", err)
+	}
+	sim.Drain()
+	sim.Advance(24 * time.Hour)
+	sim.Drain()
+
+	archived := sim.Tasks("default", TaskStateArchived)
+	if len(archived) != 1 {
+		t.Fatalf("got %d archived tasks, want 1", len(archived))
+	}
+	if archived[0].Retried != 1 || archived[0].LastErr != "permanent failure" {
+		t.Errorf("archived task has Retried=%d LastErr=%q, want Retried=1 LastErr=%q",
+			archived[0].Retried, archived[0].LastErr, "permanent failure")
+	}
+}
+
+func TestSimulationQueueRetryPolicy(t *testing.T) {
+	sim := NewSimulation(Config{
+		LogLevel:           FatalLevel,
+		QueueRetryPolicies: map[string]RetryPolicy{"default": {MaxRetry: 1}},
+	}, HandlerFunc(func(ctx context.Context, task *Task) error {
+		return errors.New("permanent failure")
+	}))
+	// The policy of the queue applies only to the tasks enqueued without MaxRetry.
+	if _, err := sim.Enqueue(NewTask("default-retry", nil)); err != nil {
+		t.Fatalf("Enqueue returned error: %v", err)
+	}
+	if _, err := sim.Enqueue(NewTask("own-retry", nil), MaxRetry(2)); err != nil {
+		t.Fatalf("Enqueue returned error: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		sim.Drain()
+		sim.Advance(24 * time.Hour)
+	}
+
+	retried := make(map[string]int)
+	for _, info := range sim.Tasks("default", TaskStateArchived) {
+		retried[info.Type] = info.Retried
+	}
+	if diff := cmp.Diff(map[string]int{"default-retry": 1, "own-retry": 2}, retried); diff != "" {
+		t.Errorf("retries of the archived tasks mismatch (-want,+got):\n%s", diff)
+	}
+}
+
+func TestSimulationSharesServerExecution(t *testing.T) {
+	var maxRetry []int
+	sim := NewSimulation(Config{
+		LogLevel:           FatalLevel,
+		SigningKey:         []byte("secret"),
+		QueueRetryPolicies: map[string]RetryPolicy{"default": {MaxRetry: 1}},
+	}, HandlerFunc(func(ctx context.Context, task *Task) error {
+		n, _ := GetMaxRetry(ctx)
+		maxRetry = append(maxRetry, n)
+		return nil
+	}))
+	// The tasks are signed and verified as with a Client and a Server,
+	// and the handler sees the max retry of the queue.
+	if _, err := sim.Enqueue(NewTask("task1", nil)); err != nil {
+		t.Fatalf("Enqueue returned error: %v", err)
+	}
+	if n := sim.Drain(); n != 1 {
+		t.Errorf("Drain processed %d tasks, want 1", n)
+	}
+	if diff := cmp.Diff([]int{1}, maxRetry); diff != "" {
+		t.Errorf("max retry seen by the handler mismatch (-want,+got):\n%s", diff)
+	}
+}
+
+func TestSimulationScheduledTasksAndPriority(t *testing.T) {
+	var processed []string
+	sim := NewSimulation(Config{
+		Queues: map[string]int{"critical": 6, "default": 3, "low": 1},
+	}, HandlerFunc(func(ctx context.Context, task *Task) error {
+		processed = append(processed, task.Type())
+		return nil
+	}))
+
+	enqueue := []struct {
+		typename string
+		opts     []Option
+	}{
+		{"later", []Option{ProcessIn(time.Hour), Queue("critical")}},
+		{"low", []Option{Queue("low")}},
+		{"default", nil},
+		{"critical", []Option{Queue("critical")}},
+	}
+	for _, e := range enqueue {
+		if _, err := sim.Enqueue(NewTask(e.typename, nil), e.opts...); err != nil {
+			t.Fatalf("Enqueue(%q) returned error: %v", e.typename, err)
+		}
+	}
+	if got := sim.Tasks("critical", TaskStateScheduled); len(got) != 1 {
+		t.Errorf("got %d scheduled tasks, want 1", len(got))
+	}
+	sim.Drain()
+	sim.Advance(time.Hour)
+	sim.Drain()
+
+	want := []string{"critical", "default", "low", "later"}
+	if diff := cmp.Diff(want, processed); diff != "" {
+		t.Errorf("processed tasks mismatch (-want,+got):\n%s", diff)
+	}
+}
+
+func TestSimulationEnqueueUnique(t *testing.T) {
+	sim := NewSimulation(Config{}, HandlerFunc(func(ctx context.Context, task *Task) error { return nil }))
+	task := NewTask("report", []byte("daily"))
+	if _, err := sim.Enqueue(task, Unique(time.Hour), ProcessIn(time.Hour)); err != nil {
+		t.Fatalf("Enqueue returned error: %v", err)
+	}
+	if _, err := sim.Enqueue(task, Unique(time.Hour)); !errors.Is(err, ErrDuplicateTask) {
+		t.Errorf("Enqueue of duplicate task returned %v, want ErrDuplicateTask", err)
+	}
+	sim.Advance(time.Hour)
+	sim.Drain()
+	// The lock is released when the task is processed.
+	if _, err := sim.Enqueue(task, Unique(time.Hour)); err != nil {
+		t.Errorf("Enqueue after the task was processed returned error: %v", err)
+	}
+	if _, err := sim.Enqueue(NewTask("batch", nil), GroupKey("g")); err == nil {
+		t.Errorf("Enqueue with GroupKey returned nil error, want non-nil error")
+	}
+}
@@ -5,6 +5,7 @@
 package asynq
 
 import (
+	"strconv"
 	"sync"
 	"time"
 
@@ -23,33 +24,100 @@ type subscriber struct {
 	// cancelations hold cancel functions for all active tasks.
 	cancelations *base.Cancelations
 
+	// serverID is the ID of the server to receive concurrency change messages for.
+	serverID string
+
+	// setConcurrency is called with the new concurrency when a message is received.
+	setConcurrency func(n int)
+
+	// quiet is called when a message to stop processing new tasks is received.
+	quiet func()
+
+	// wakeup is called with the name of the queue when tasks become pending in one
+	// of the queues.
+	wakeup func(qname string)
+	queues []string
+
 	// time to wait before retrying to connect to redis.
 	retryTimeout time.Duration
 }
 
 type subscriberParams struct {
-	logger       *log.Logger
-	broker       base.Broker
-	cancelations *base.Cancelations
+	logger         *log.Logger
+	broker         base.Broker
+	cancelations   *base.Cancelations
+	serverID       string
+	setConcurrency func(n int)
+	quiet          func()
+	wakeup         func(qname string)
+	queues         []string
 }
 
 func newSubscriber(params subscriberParams) *subscriber {
 	return &subscriber{
-		logger:       params.logger,
-		broker:       params.broker,
-		done:         make(chan struct{}),
-		cancelations: params.cancelations,
-		retryTimeout: 5 * time.Second,
+		logger:         params.logger,
+		broker:         params.broker,
+		done:           make(chan struct{}),
+		cancelations:   params.cancelations,
+		serverID:       params.serverID,
+		setConcurrency: params.setConcurrency,
+		quiet:          params.quiet,
+		wakeup:         params.wakeup,
+		queues:         params.queues,
+		retryTimeout:   5 * time.Second,
 	}
 }
 
 func (s *subscriber) shutdown() {
 	s.logger.Debug("Subscriber shutting down...")
-	// Signal the subscriber goroutine to stop.
-	s.done <- struct{}{}
+	// Signal the subscriber goroutines to stop.
+	close(s.done)
 }
 
 func (s *subscriber) start(wg *sync.WaitGroup) {
+	s.listen(wg, "cancelation", s.broker.CancelationPubSub, func(msg *redis.Message) {
+		if msg.Channel == base.AbortChannel {
+			s.cancelations.Abort(msg.Payload)
+			return
+		}
+		cancel, ok := s.cancelations.Get(msg.Payload)
+		if ok {
+			cancel()
+		}
+	})
+	if s.setConcurrency != nil {
+		s.listen(wg, "concurrency", func() (*redis.PubSub, error) {
+			return s.broker.ConcurrencyPubSub(s.serverID)
+		}, func(msg *redis.Message) {
+			n, err := strconv.Atoi(msg.Payload)
+			if err != nil || n < 1 {
+				s.logger.Warnf("Ignoring invalid concurrency value %q", msg.Payload)
+				return
+			}
+			s.logger.Infof("Changing concurrency to %d", n)
+			s.setConcurrency(n)
+		})
+	}
+	if s.quiet != nil {
+		s.listen(wg, "quiet", func() (*redis.PubSub, error) {
+			return s.broker.QuietPubSub(s.serverID)
+		}, func(msg *redis.Message) {
+			s.logger.Info("Received signal to stop processing new tasks")
+			s.quiet()
+		})
+	}
+	if s.wakeup != nil && len(s.queues) > 0 {
+		s.listen(wg, "wakeup", func() (*redis.PubSub, error) {
+			return s.broker.WakeupPubSub(s.queues...)
+		}, func(msg *redis.Message) {
+			s.wakeup(msg.Payload)
+		})
+	}
+}
+
+// listen starts a goroutine which subscribes to a channel using the subscribe
+// function and calls handle for each message received until shutdown.
+func (s *subscriber) listen(wg *sync.WaitGroup, name string, subscribe func() (*redis.PubSub, error), handle func(*redis.Message)) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -59,31 +127,28 @@ func (s *subscriber) start(wg *sync.WaitGroup) {
 		)
 		// Try until successfully connect to Redis.
 		for {
-			pubsub, err = s.broker.CancelationPubSub()
+			pubsub, err = subscribe()
 			if err != nil {
-				s.logger.Errorf("cannot subscribe to cancelation channel: %v", err)
+				s.logger.Errorf("cannot subscribe to %s channel: %v", name, err)
 				select {
 				case <-time.After(s.retryTimeout):
 					continue
 				case <-s.done:
-					s.logger.Debug("Subscriber done")
+					s.logger.Debugf("Subscriber for %s channel done", name)
 					return
 				}
 			}
 			break
 		}
-		cancelCh := pubsub.Channel()
+		ch := pubsub.Channel()
 		for {
 			select {
 			case <-s.done:
 				pubsub.Close()
-				s.logger.Debug("Subscriber done")
+				s.logger.Debugf("Subscriber for %s channel done", name)
 				return
-			case msg := <-cancelCh:
-				cancel, ok := s.cancelations.Get(msg.Payload)
-				if ok {
-					cancel()
-				}
+			case msg := <-ch:
+				handle(msg)
 			}
 		}
 	}()
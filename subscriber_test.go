@@ -5,10 +5,12 @@
 package asynq
 
 import (
+	"context"
 	"sync"
 	"testing"
 	"time"
 
+	h "github.com/hibiken/asynq/internal/asynqtest"
 	"github.com/hibiken/asynq/internal/base"
 	"github.com/hibiken/asynq/internal/rdb"
 	"github.com/hibiken/asynq/internal/testbroker"
@@ -22,10 +24,12 @@ func TestSubscriber(t *testing.T) {
 	tests := []struct {
 		registeredID string // ID for which cancel func is registered
 		publishID    string // ID to be published
+		abort        bool   // whether to publish with PublishAbort
 		wantCalled   bool   // whether cancel func should be called
 	}{
-		{"abc123", "abc123", true},
-		{"abc456", "abc123", false},
+		{"abc123", "abc123", false, true},
+		{"abc456", "abc123", false, false},
+		{"abc123", "abc123", true, true},
 	}
 
 	for _, tc := range tests {
@@ -51,7 +55,11 @@ func TestSubscriber(t *testing.T) {
 		// wait for subscriber to establish connection to pubsub channel
 		time.Sleep(time.Second)
 
-		if err := rdbClient.PublishCancelation(tc.publishID); err != nil {
+		publish := rdbClient.PublishCancelation
+		if tc.abort {
+			publish = rdbClient.PublishAbort
+		}
+		if err := publish(tc.publishID); err != nil {
 			t.Fatalf("could not publish cancelation message: %v", err)
 		}
 
@@ -67,6 +75,9 @@ func TestSubscriber(t *testing.T) {
 			}
 		}
 		mu.Unlock()
+		if got := cancelations.Aborted(tc.registeredID); got != (tc.abort && tc.wantCalled) {
+			t.Errorf("(*Cancelations).Aborted(%q) = %t, want %t", tc.registeredID, got, tc.abort && tc.wantCalled)
+		}
 	}
 }
 
@@ -122,3 +133,135 @@ func TestSubscriberWithRedisDown(t *testing.T) {
 	}
 	mu.Unlock()
 }
+
+func TestSubscriberConcurrency(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	rdbClient := rdb.NewRDB(r)
+
+	tests := []struct {
+		publishID string // server ID to which the message is published
+		publishN  int    // concurrency to be published
+		want      int    // value setConcurrency should be called with; zero if not called
+	}{
+		{"server123", 8, 8},
+		{"server456", 8, 0},
+	}
+
+	for _, tc := range tests {
+		var (
+			mu  sync.Mutex
+			got int
+		)
+		subscriber := newSubscriber(subscriberParams{
+			logger:       testLogger,
+			broker:       rdbClient,
+			cancelations: base.NewCancelations(),
+			serverID:     "server123",
+			setConcurrency: func(n int) {
+				mu.Lock()
+				defer mu.Unlock()
+				got = n
+			},
+		})
+		var wg sync.WaitGroup
+		subscriber.start(&wg)
+
+		// wait for subscriber to establish connection to pubsub channel
+		time.Sleep(time.Second)
+
+		if err := rdbClient.PublishConcurrency(tc.publishID, tc.publishN); err != nil {
+			t.Fatalf("could not publish concurrency message: %v", err)
+		}
+
+		// wait for redis to publish message
+		time.Sleep(time.Second)
+
+		mu.Lock()
+		if got != tc.want {
+			t.Errorf("setConcurrency called with %d, want %d", got, tc.want)
+		}
+		mu.Unlock()
+		subscriber.shutdown()
+		wg.Wait()
+	}
+}
+
+func TestSubscriberQuiet(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	rdbClient := rdb.NewRDB(r)
+
+	var (
+		mu    sync.Mutex
+		calls int
+	)
+	subscriber := newSubscriber(subscriberParams{
+		logger:       testLogger,
+		broker:       rdbClient,
+		cancelations: base.NewCancelations(),
+		serverID:     "server123",
+		quiet: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			calls++
+		},
+	})
+	var wg sync.WaitGroup
+	subscriber.start(&wg)
+	defer func() {
+		subscriber.shutdown()
+		wg.Wait()
+	}()
+
+	// wait for subscriber to establish connection to pubsub channel
+	time.Sleep(time.Second)
+
+	for _, id := range []string{"server456", "server123"} {
+		if err := rdbClient.PublishQuiet(id); err != nil {
+			t.Fatalf("could not publish quiet message: %v", err)
+		}
+	}
+
+	// wait for redis to publish message
+	time.Sleep(time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Errorf("quiet called %d times, want 1", calls)
+	}
+}
+
+func TestSubscriberWakeup(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	rdbClient := rdb.NewRDB(r)
+
+	woken := make(chan string, 1)
+	subscriber := newSubscriber(subscriberParams{
+		logger:       testLogger,
+		broker:       rdbClient,
+		cancelations: base.NewCancelations(),
+		wakeup:       func(qname string) { woken <- qname },
+		queues:       []string{"critical"},
+	})
+	var wg sync.WaitGroup
+	subscriber.start(&wg)
+	defer subscriber.shutdown()
+
+	// wait for subscriber to establish connection to pubsub channel
+	time.Sleep(time.Second)
+
+	if err := rdbClient.Enqueue(context.Background(), h.NewTaskMessageWithQueue("task", nil, "critical")); err != nil {
+		t.Fatalf("could not enqueue task: %v", err)
+	}
+	select {
+	case qname := <-woken:
+		if qname != "critical" {
+			t.Errorf("wakeup called with %q, want %q", qname, "critical")
+		}
+	case <-time.After(time.Second):
+		t.Error("wakeup was not called")
+	}
+}
@@ -8,11 +8,19 @@ import (
 	"sync"
 	"time"
 
+	"github.com/hibiken/asynq/internal/errors"
 	"github.com/hibiken/asynq/internal/log"
 )
 
 // syncer is responsible for queuing up failed requests to redis and retry
 // those requests to sync state between the background process and redis.
+//
+// Requests without a deadline (e.g. acknowledgements of processed tasks) are
+// retried until they succeed, so that they are not lost while redis is unavailable
+// (e.g. during a failover). A request is dropped if it fails because the task
+// it applies to is not found anymore: an acknowledgement only applies to the
+// delivery of the task it was made for (see base.TaskMessage.Lease), so a late
+// acknowledgement of a task which was recovered and delivered again is dropped.
 type syncer struct {
 	logger *log.Logger
 
@@ -28,7 +36,7 @@ type syncer struct {
 type syncRequest struct {
 	fn       func() error // sync operation
 	errMsg   string       // error message
-	deadline time.Time    // request should be dropped if deadline has been exceeded
+	deadline time.Time    // request should be dropped if deadline has been exceeded; zero means no deadline
 }
 
 type syncerParams struct {
@@ -63,7 +71,7 @@ func (s *syncer) start(wg *sync.WaitGroup) {
 				// Try sync one last time before shutting down.
 				for _, req := range requests {
 					if err := req.fn(); err != nil {
-						s.logger.Error(req.errMsg)
+						s.logger.Errorf("%s: %v", req.errMsg, err)
 					}
 				}
 				s.logger.Debug("Syncer done")
@@ -71,17 +79,42 @@ func (s *syncer) start(wg *sync.WaitGroup) {
 			case req := <-s.requestsCh:
 				requests = append(requests, req)
 			case <-time.After(s.interval):
-				var temp []*syncRequest
-				for _, req := range requests {
-					if req.deadline.Before(time.Now()) {
-						continue // drop stale request
-					}
-					if err := req.fn(); err != nil {
-						temp = append(temp, req)
-					}
-				}
-				requests = temp
+				requests = s.sync(requests)
 			}
 		}
 	}()
 }
+
+// sync runs the given requests and returns the ones to retry later.
+func (s *syncer) sync(requests []*syncRequest) []*syncRequest {
+	var (
+		temp    []*syncRequest
+		dropped int // number of requests dropped since they're stale or their task is not found
+	)
+	for i, req := range requests {
+		if !req.deadline.IsZero() && req.deadline.Before(time.Now()) {
+			dropped++ // drop stale request
+			continue
+		}
+		err := req.fn()
+		switch {
+		case err == nil:
+		case errors.CanonicalCode(err) == errors.NotFound:
+			s.logger.Warnf("Dropping sync request: %s: %v", req.errMsg, err)
+			dropped++
+		case errors.IsTransient(err):
+			// Redis is still unavailable, retry all the remaining requests later.
+			return append(append(temp, req), requests[i+1:]...)
+		default:
+			temp = append(temp, req)
+		}
+	}
+	switch {
+	case len(requests) == 0 || len(temp) > 0:
+	case dropped == 0:
+		s.logger.Info("Synced all pending requests")
+	default:
+		s.logger.Warnf("Synced %d pending requests, dropped %d", len(requests)-dropped, dropped)
+	}
+	return temp
+}
@@ -6,12 +6,15 @@ package asynq
 
 import (
 	"fmt"
+	"io"
 	"sync"
 	"testing"
 	"time"
 
 	h "github.com/hibiken/asynq/internal/asynqtest"
 	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/errors"
+	"github.com/hibiken/asynq/internal/log"
 	"github.com/hibiken/asynq/internal/rdb"
 )
 
@@ -139,3 +142,109 @@ func TestSyncerDropsStaleRequests(t *testing.T) {
 	}
 	mu.Unlock()
 }
+
+func TestSyncerRetriesRequestsWithoutDeadlineUntilRedisRecovers(t *testing.T) {
+	const interval = 100 * time.Millisecond
+	syncRequestCh := make(chan *syncRequest)
+	syncer := newSyncer(syncerParams{
+		logger:     testLogger,
+		requestsCh: syncRequestCh,
+		interval:   interval,
+	})
+	var wg sync.WaitGroup
+	syncer.start(&wg)
+	defer syncer.shutdown()
+
+	var (
+		mu       sync.Mutex
+		down     = true
+		calls    int // number of calls to the request made while redis is down.
+		synced   bool
+		notFound int // number of calls to the request failing with NotFound error.
+	)
+	syncRequestCh <- &syncRequest{
+		fn: func() error {
+			mu.Lock()
+			defer mu.Unlock()
+			if down {
+				calls++
+				return errors.E(errors.Op("rdb.Done"), errors.Unknown, &errors.RedisCommandError{Command: "eval", Err: io.EOF})
+			}
+			synced = true
+			return nil
+		},
+		errMsg: "could not ack",
+	}
+	syncRequestCh <- &syncRequest{
+		fn: func() error {
+			mu.Lock()
+			defer mu.Unlock()
+			notFound++
+			return errors.E(errors.Op("rdb.Done"), errors.NotFound, "task is not active")
+		},
+		errMsg: "could not ack",
+	}
+
+	// Keep redis down for longer than the default deadline of a task would allow.
+	time.Sleep(10 * interval)
+	mu.Lock()
+	if calls < 2 {
+		t.Errorf("request was called %d times while redis was down, want at least 2", calls)
+	}
+	down = false
+	mu.Unlock()
+	time.Sleep(3 * interval)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !synced {
+		t.Errorf("request was not synced after redis recovered")
+	}
+	if notFound != 1 {
+		t.Errorf("request failing with NotFound error was called %d times, want 1", notFound)
+	}
+}
+
+// syncLogger is a Logger which records the info and warn messages.
+type syncLogger struct {
+	infos, warns []string
+}
+
+func (l *syncLogger) Debug(args ...interface{}) {}
+func (l *syncLogger) Info(args ...interface{})  { l.infos = append(l.infos, fmt.Sprint(args...)) }
+func (l *syncLogger) Warn(args ...interface{})  { l.warns = append(l.warns, fmt.Sprint(args...)) }
+func (l *syncLogger) Error(args ...interface{}) {}
+func (l *syncLogger) Fatal(args ...interface{}) {}
+
+func TestSyncerReportsDroppedRequests(t *testing.T) {
+	synced := &syncRequest{fn: func() error { return nil }, errMsg: "could not ack"}
+	notFound := &syncRequest{
+		fn:     func() error { return errors.E(errors.Op("rdb.Done"), errors.NotFound, "task is not active") },
+		errMsg: "could not ack",
+	}
+	stale := &syncRequest{fn: func() error { return nil }, deadline: time.Now().Add(-time.Second)}
+
+	tests := []struct {
+		desc      string
+		requests  []*syncRequest
+		wantInfos int // number of "Synced all pending requests" messages
+		wantWarn  string
+	}{
+		{"all synced", []*syncRequest{synced, synced}, 1, ""},
+		{"task not found", []*syncRequest{synced, notFound}, 0, "Synced 1 pending requests, dropped 1"},
+		{"stale", []*syncRequest{stale, synced, stale}, 0, "Synced 1 pending requests, dropped 2"},
+	}
+	for _, tc := range tests {
+		logger := &syncLogger{}
+		s := newSyncer(syncerParams{logger: log.NewLogger(logger), interval: time.Second})
+		if left := s.sync(tc.requests); len(left) != 0 {
+			t.Errorf("%s; sync returned %d requests to retry, want 0", tc.desc, len(left))
+		}
+		if len(logger.infos) != tc.wantInfos {
+			t.Errorf("%s; logged info messages %q, want %d \"Synced all pending requests\" message(s)", tc.desc, logger.infos, tc.wantInfos)
+		}
+		if tc.wantWarn != "" && (len(logger.warns) == 0 || logger.warns[len(logger.warns)-1] != tc.wantWarn) {
+			t.Errorf("%s; logged warn messages %q, want the last one to be %q", tc.desc, logger.warns, tc.wantWarn)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(benchCmd)
+	benchCmd.Flags().IntP("count", "c", 10000, "number of tasks to enqueue")
+	benchCmd.Flags().IntP("size", "s", 128, "payload size of each task in bytes")
+	benchCmd.Flags().Int("producers", 10, "number of goroutines enqueueing tasks")
+	benchCmd.Flags().Int("concurrency", 10, "number of workers processing tasks")
+	benchCmd.Flags().StringP("queue", "q", "asynq_bench", "queue to use for the benchmark")
+	benchCmd.Flags().Duration("timeout", 5*time.Minute, "maximum time to wait for the tasks to be processed")
+}
+
+var benchCmd = &cobra.Command{
+	Use:   "bench",
+	Short: "Measures throughput and latency against the redis server",
+	Long: `Bench (asynq bench) enqueues tasks to a dedicated queue while a server processes them,
+and reports the throughput and latency percentiles of enqueueing and of processing
+the tasks end-to-end (from before the enqueue until the handler is called).
+
+The queue must not exist before the benchmark, and is deleted afterwards.
+
+Example: asynq bench --count=100000 --size=1024 --concurrency=20`,
+	Args: cobra.NoArgs,
+	Run:  bench,
+}
+
+// benchResult holds the measurements of a phase of the benchmark.
+type benchResult struct {
+	phase     string
+	elapsed   time.Duration
+	latencies []time.Duration
+}
+
+func bench(cmd *cobra.Command, args []string) {
+	count, err := cmd.Flags().GetInt("count")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	size, err := cmd.Flags().GetInt("size")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	producers, err := cmd.Flags().GetInt("producers")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	concurrency, err := cmd.Flags().GetInt("concurrency")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	qname, err := cmd.Flags().GetString("queue")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	timeout, err := cmd.Flags().GetDuration("timeout")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if count < 1 || producers < 1 || concurrency < 1 {
+		fmt.Println("count, producers and concurrency must be positive")
+		os.Exit(1)
+	}
+	if err := base.ValidateQueueName(qname); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// The payload holds the time before the enqueue to measure the end-to-end latency.
+	if size < 8 {
+		size = 8
+	}
+
+	inspector := createInspector()
+	defer inspector.Close()
+	queues, err := inspector.Queues()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	for _, q := range queues {
+		if q == qname {
+			fmt.Printf("Queue %q already exists; use --queue to choose another queue\n", qname)
+			os.Exit(1)
+		}
+	}
+	defer func() {
+		if err := inspector.DeleteQueue(qname, true); err != nil {
+			fmt.Printf("Could not delete queue %q: %v\n", qname, err)
+		}
+	}()
+
+	var (
+		mu        sync.Mutex
+		processed []time.Duration
+		done      = make(chan struct{})
+	)
+	srv := asynq.NewServer(getRedisConnOpt(), asynq.Config{
+		Concurrency: concurrency,
+		Queues:      map[string]int{qname: 1},
+		LogLevel:    asynq.WarnLevel,
+	})
+	handler := func(ctx context.Context, t *asynq.Task) error {
+		latency := time.Since(time.Unix(0, int64(binary.BigEndian.Uint64(t.Payload()))))
+		mu.Lock()
+		defer mu.Unlock()
+		processed = append(processed, latency)
+		if len(processed) == count {
+			close(done)
+		}
+		return nil
+	}
+	if err := srv.Start(asynq.HandlerFunc(handler)); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer srv.Shutdown()
+
+	fmt.Printf("Enqueueing %d tasks of %d bytes to queue %q with %d producers...\n", count, size, qname, producers)
+	client := asynq.NewClient(getRedisConnOpt())
+	defer client.Close()
+	enqueued := make([][]time.Duration, producers)
+	var failed int32
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < producers; i++ {
+		n := count / producers
+		if i < count%producers {
+			n++
+		}
+		wg.Add(1)
+		go func(i, n int) {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				payload := make([]byte, size)
+				t := time.Now()
+				binary.BigEndian.PutUint64(payload, uint64(t.UnixNano()))
+				if _, err := client.Enqueue(asynq.NewTask("bench", payload), asynq.Queue(qname)); err != nil {
+					fmt.Printf("Could not enqueue task: %v\n", err)
+					atomic.AddInt32(&failed, 1)
+					return
+				}
+				enqueued[i] = append(enqueued[i], time.Since(t))
+			}
+		}(i, n)
+	}
+	wg.Wait()
+	enqueueResult := benchResult{phase: "enqueue", elapsed: time.Since(start)}
+	for _, ls := range enqueued {
+		enqueueResult.latencies = append(enqueueResult.latencies, ls...)
+	}
+
+	if n := atomic.LoadInt32(&failed); n > 0 {
+		fmt.Printf("Aborting the benchmark: %d producers failed to enqueue tasks\n", n)
+		return
+	}
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		fmt.Printf("Timed out waiting for the tasks to be processed after %v\n", timeout)
+	}
+	mu.Lock()
+	e2eResult := benchResult{phase: "end-to-end", elapsed: time.Since(start), latencies: append([]time.Duration(nil), processed...)}
+	mu.Unlock()
+
+	fmt.Println()
+	printBenchResults([]benchResult{enqueueResult, e2eResult})
+}
+
+func printBenchResults(results []benchResult) {
+	cols := []string{"Phase", "Tasks", "Elapsed", "Throughput (tasks/s)", "p50", "p90", "p99", "Max"}
+	printRows := func(w io.Writer, tmpl string) {
+		for _, r := range results {
+			ls := r.latencies
+			sort.Slice(ls, func(i, j int) bool { return ls[i] < ls[j] })
+			fmt.Fprintf(w, tmpl, r.phase, len(ls), r.elapsed.Round(time.Millisecond),
+				fmt.Sprintf("%.1f", float64(len(ls))/r.elapsed.Seconds()),
+				percentile(ls, 50), percentile(ls, 90), percentile(ls, 99), percentile(ls, 100))
+		}
+	}
+	printTable(cols, printRows)
+}
+
+// percentile returns the p-th percentile of the sorted latencies, using the nearest-rank method.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1].Round(time.Microsecond)
+}
@@ -0,0 +1,244 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(enqueueCmd)
+	enqueueCmd.Flags().StringP("file", "f", "", "path of the file to read the tasks from, one JSON object per line (- for stdin)")
+	enqueueCmd.Flags().StringP("queue", "q", "", "queue to enqueue the tasks without a queue to (default: default queue)")
+	enqueueCmd.Flags().Int("concurrency", 10, "number of tasks enqueued concurrently")
+	enqueueCmd.MarkFlagRequired("file")
+}
+
+var enqueueCmd = &cobra.Command{
+	Use:   "enqueue --file=<path>",
+	Short: "Enqueues tasks read from a file",
+	Long: `Enqueue (asynq enqueue) enqueues the tasks read from a file, e.g. to backfill
+a queue or to seed tasks during a migration.
+
+The file holds one task per line, as a JSON object with the type of the task and,
+optionally, its payload and the options to enqueue it with:
+
+  {"type": "email:welcome", "payload": {"user_id": 42}, "queue": "low", "process_at": "2021-06-01T09:00:00Z"}
+
+  type        type of the task (required)
+  payload     payload of the task; a JSON string is used as is, other values in their JSON encoding
+  queue       queue of the task (default: --queue)
+  task_id     ID of the task
+  process_at  time to process the task at, in RFC 3339 format
+  process_in  duration after which to process the task, e.g. "10m"
+  max_retry   maximum number of retries
+  timeout     timeout of the task, e.g. "30s"
+  deadline    deadline of the task, in RFC 3339 format
+  retention   duration to retain the task for once completed, e.g. "24h"
+  unique      TTL of the uniqueness lock of the task, e.g. "1h"
+  headers     headers of the task, as an object of strings
+
+Lines which cannot be parsed or enqueued are reported with their line number, and
+the other lines are enqueued. Empty lines are skipped.
+
+Example: asynq enqueue --file=tasks.jsonl --queue=backfill`,
+	Args: cobra.NoArgs,
+	Run:  enqueue,
+}
+
+// enqueueLine is a line of the file read by the enqueue command.
+type enqueueLine struct {
+	Type      string            `json:"type"`
+	Payload   json.RawMessage   `json:"payload"`
+	Queue     string            `json:"queue"`
+	TaskID    string            `json:"task_id"`
+	ProcessAt string            `json:"process_at"`
+	ProcessIn string            `json:"process_in"`
+	MaxRetry  *int              `json:"max_retry"`
+	Timeout   string            `json:"timeout"`
+	Deadline  string            `json:"deadline"`
+	Retention string            `json:"retention"`
+	Unique    string            `json:"unique"`
+	Headers   map[string]string `json:"headers"`
+}
+
+// task returns the task and the options to enqueue it with.
+func (l *enqueueLine) task() (*asynq.Task, []asynq.Option, error) {
+	if l.Type == "" {
+		return nil, nil, fmt.Errorf("type is missing")
+	}
+	var payload []byte
+	if len(l.Payload) > 0 && !bytes.Equal(l.Payload, []byte("null")) {
+		var s string
+		if err := json.Unmarshal(l.Payload, &s); err == nil {
+			payload = []byte(s)
+		} else {
+			payload = []byte(l.Payload)
+		}
+	}
+	var opts []asynq.Option
+	if l.Queue != "" {
+		opts = append(opts, asynq.Queue(l.Queue))
+	}
+	if l.TaskID != "" {
+		opts = append(opts, asynq.TaskID(l.TaskID))
+	}
+	if l.MaxRetry != nil {
+		opts = append(opts, asynq.MaxRetry(*l.MaxRetry))
+	}
+	for _, t := range []struct {
+		name  string
+		value string
+		opt   func(time.Time) asynq.Option
+	}{
+		{"process_at", l.ProcessAt, asynq.ProcessAt},
+		{"deadline", l.Deadline, asynq.Deadline},
+	} {
+		if t.value == "" {
+			continue
+		}
+		v, err := time.Parse(time.RFC3339, t.value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid %s: %v", t.name, err)
+		}
+		opts = append(opts, t.opt(v))
+	}
+	for _, d := range []struct {
+		name  string
+		value string
+		opt   func(time.Duration) asynq.Option
+	}{
+		{"process_in", l.ProcessIn, asynq.ProcessIn},
+		{"timeout", l.Timeout, asynq.Timeout},
+		{"retention", l.Retention, asynq.Retention},
+		{"unique", l.Unique, asynq.Unique},
+	} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid %s: %v", d.name, err)
+		}
+		opts = append(opts, d.opt(v))
+	}
+	for k, v := range l.Headers {
+		opts = append(opts, asynq.Header(k, v))
+	}
+	return asynq.NewTask(l.Type, payload), opts, nil
+}
+
+// enqueueJob is a task read from the file to be enqueued.
+type enqueueJob struct {
+	lineno int
+	task   *asynq.Task
+	opts   []asynq.Option
+}
+
+func enqueue(cmd *cobra.Command, args []string) {
+	path, err := cmd.Flags().GetString("file")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	qname, err := cmd.Flags().GetString("queue")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	concurrency, err := cmd.Flags().GetInt("concurrency")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if concurrency < 1 {
+		fmt.Println("concurrency must be positive")
+		os.Exit(1)
+	}
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	client := asynq.NewClient(getRedisConnOpt())
+	defer client.Close()
+	var (
+		enqueued int64
+		failed   int64
+		mu       sync.Mutex // serializes the error messages
+		wg       sync.WaitGroup
+		jobs     = make(chan *enqueueJob)
+	)
+	report := func(lineno int, err error) {
+		atomic.AddInt64(&failed, 1)
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Printf("line %d: %v\n", lineno, err)
+	}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if _, err := client.Enqueue(job.task, job.opts...); err != nil {
+					report(job.lineno, err)
+					continue
+				}
+				atomic.AddInt64(&enqueued, 1)
+			}
+		}()
+	}
+
+	br := bufio.NewReader(r)
+	for lineno := 1; ; lineno++ {
+		data, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			report(lineno, err)
+			break
+		}
+		if data = bytes.TrimSpace(data); len(data) > 0 {
+			var l enqueueLine
+			if perr := json.Unmarshal(data, &l); perr != nil {
+				report(lineno, perr)
+			} else if task, opts, perr := l.task(); perr != nil {
+				report(lineno, perr)
+			} else {
+				if l.Queue == "" && qname != "" {
+					opts = append(opts, asynq.Queue(qname))
+				}
+				jobs <- &enqueueJob{lineno: lineno, task: task, opts: opts}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	fmt.Printf("%d tasks enqueued", enqueued)
+	if failed > 0 {
+		fmt.Printf(", %d lines failed\n", failed)
+		os.Exit(1)
+	}
+	fmt.Println()
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(locksCmd)
+	locksCmd.AddCommand(locksListCmd)
+	locksListCmd.Flags().StringP("queue", "q", "", "queue to which the locks belong")
+	locksListCmd.MarkFlagRequired("queue")
+
+	locksCmd.AddCommand(locksReleaseCmd)
+	locksReleaseCmd.Flags().StringP("queue", "q", "", "queue to which the lock belongs")
+	locksReleaseCmd.Flags().StringP("key", "k", "", "key of the lock, as listed by locks ls")
+	locksReleaseCmd.MarkFlagRequired("queue")
+	locksReleaseCmd.MarkFlagRequired("key")
+}
+
+var locksCmd = &cobra.Command{
+	Use:   "locks",
+	Short: "Manage uniqueness locks",
+	Long: `Locks (asynq locks) manages the uniqueness locks held by the tasks enqueued
+with the Unique option. While a task holds a lock, tasks of the same type and payload
+cannot be enqueued in its queue.`,
+}
+
+var locksListCmd = &cobra.Command{
+	Use:   "ls --queue=QUEUE",
+	Short: "List uniqueness locks",
+	Args:  cobra.NoArgs,
+	Run:   locksList,
+}
+
+var locksReleaseCmd = &cobra.Command{
+	Use:   "release --queue=QUEUE --key=KEY",
+	Short: "Release a uniqueness lock",
+	Long: `Release (asynq locks release) releases a uniqueness lock, e.g. a lock held by
+a stuck task, so that a task of the same type and payload can be enqueued again.
+The task holding the lock is left as is.`,
+	Args: cobra.NoArgs,
+	Run:  locksRelease,
+}
+
+func locksList(cmd *cobra.Command, args []string) {
+	qname, err := cmd.Flags().GetString("queue")
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	i := createInspector()
+	locks, err := i.ListUniqueLocks(qname)
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(locks) == 0 {
+		fmt.Printf("No uniqueness locks in %q queue\n", qname)
+		return
+	}
+	printTable(
+		[]string{"Key", "Type", "Task ID", "TTL"},
+		func(w io.Writer, tmpl string) {
+			for _, l := range locks {
+				ttl := "none"
+				if l.TTL >= 0 {
+					ttl = l.TTL.Round(time.Second).String()
+				}
+				fmt.Fprintf(w, tmpl, l.Key, l.Type, l.TaskID, ttl)
+			}
+		},
+	)
+}
+
+func locksRelease(cmd *cobra.Command, args []string) {
+	qname, err := cmd.Flags().GetString("queue")
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	key, err := cmd.Flags().GetString("key")
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	i := createInspector()
+	if err := i.ReleaseUniqueLock(qname, key); err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Uniqueness lock %q released\n", key)
+}
@@ -0,0 +1,221 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq"
+	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(migrateQueuesCmd)
+	migrateQueuesCmd.Flags().String("from", "", "redis URI of the source database (e.g. redis://old:6379/0)")
+	migrateQueuesCmd.Flags().String("to", "", "redis URI of the destination database (e.g. redis://new:6379/0)")
+	migrateQueuesCmd.Flags().StringSliceP("queue", "q", nil, "queues to migrate (default: all queues of the source)")
+	migrateQueuesCmd.Flags().Int("batch-size", 100, "number of tasks moved per batch")
+	migrateQueuesCmd.Flags().String("cursor-file", "", "path of the file recording the progress, to resume an interrupted migration")
+	migrateQueuesCmd.MarkFlagRequired("from")
+	migrateQueuesCmd.MarkFlagRequired("to")
+}
+
+var migrateQueuesCmd = &cobra.Command{
+	Use:   "migrate-queues --from=<uri> --to=<uri>",
+	Short: "Moves queues from one redis database to another",
+	Long: `Migrate queues (asynq migrate-queues) moves the tasks of queues from one redis
+database to another, e.g. to move to a new redis instance.
+
+Scheduled, retry, archived, completed, unhandled and pending tasks are moved in batches,
+oldest first, with their scores and metadata. Each task is written to the destination before
+it's deleted from the source, so clients and servers can keep running on both databases
+during the migration: point the clients at the destination, start servers processing the
+destination, migrate the queues, then stop the servers processing the source.
+
+Active tasks are not moved. Run the command again once they are retried or done.
+Tasks held in a group are moved once the tasks before them are. Tasks whose ID is
+taken in the destination are left in the source.
+
+Queues with waiting tasks (tasks depending on other tasks) or quarantined tasks are
+not migrated: wait until the waiting tasks are pending, and repair or delete the
+quarantined tasks, then run the command again.
+
+With --cursor-file, the progress is recorded after each batch, and an interrupted
+migration resumes from the file. The file is deleted once the migration completes.
+
+Example: asynq migrate-queues --from=redis://old:6379/0 --to=redis://new:6379/0 --cursor-file=migrate.json`,
+	Args: cobra.NoArgs,
+	Run:  migrateQueues,
+}
+
+// migrationCursor records the progress of a migration.
+type migrationCursor struct {
+	// Queues to migrate, in order.
+	Queues []string `json:"queues"`
+	// Index of the queue being migrated in Queues.
+	Queue int `json:"queue"`
+	// Index of the state being migrated in rdb.MigrationStates.
+	State int `json:"state"`
+	// Number of tasks left in the state of the queue because of conflicts.
+	Offset int `json:"offset"`
+
+	// Total numbers of tasks moved and left because of conflicts.
+	Moved     int `json:"moved"`
+	Conflicts int `json:"conflicts"`
+}
+
+func migrateQueues(cmd *cobra.Command, args []string) {
+	from, err := cmd.Flags().GetString("from")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	to, err := cmd.Flags().GetString("to")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	qnames, err := cmd.Flags().GetStringSlice("queue")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	batchSize, err := cmd.Flags().GetInt("batch-size")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	cursorFile, err := cmd.Flags().GetString("cursor-file")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if batchSize < 1 {
+		fmt.Println("batch-size must be positive")
+		os.Exit(1)
+	}
+	if from == to {
+		fmt.Println("source and destination must be different databases")
+		os.Exit(1)
+	}
+	src, err := createRDBFromURI(from)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer src.Close()
+	dst, err := createRDBFromURI(to)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer dst.Close()
+
+	cursor, err := readMigrationCursor(cursorFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if cursor != nil {
+		fmt.Printf("Resuming the migration of %d queues from %s\n", len(cursor.Queues), cursorFile)
+	} else {
+		if len(qnames) == 0 {
+			if qnames, err = src.AllQueues(); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		cursor = &migrationCursor{Queues: qnames}
+	}
+
+	for ; cursor.Queue < len(cursor.Queues); cursor.Queue, cursor.State = cursor.Queue+1, 0 {
+		qname := cursor.Queues[cursor.Queue]
+		for ; cursor.State < len(rdb.MigrationStates); cursor.State, cursor.Offset = cursor.State+1, 0 {
+			state := rdb.MigrationStates[cursor.State]
+			for {
+				batch, err := src.MigrateTasks(dst, qname, state, cursor.Offset, batchSize)
+				if err != nil {
+					fmt.Printf("Could not migrate %s tasks of queue %q: %v\n", state, qname, err)
+					os.Exit(1)
+				}
+				if batch.Listed == 0 {
+					break
+				}
+				cursor.Offset += batch.Conflicts
+				cursor.Moved += batch.Moved
+				cursor.Conflicts += batch.Conflicts
+				if err := writeMigrationCursor(cursorFile, cursor); err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+			}
+		}
+		fmt.Printf("Migrated queue %q\n", qname)
+	}
+	if cursorFile != "" {
+		if err := os.Remove(cursorFile); err != nil && !os.IsNotExist(err) {
+			fmt.Println(err)
+		}
+	}
+	fmt.Printf("Moved %d tasks of %d queues", cursor.Moved, len(cursor.Queues))
+	if cursor.Conflicts > 0 {
+		fmt.Printf("; %d tasks were left in the source because their ID is taken in the destination", cursor.Conflicts)
+	}
+	fmt.Println()
+}
+
+func createRDBFromURI(uri string) (*rdb.RDB, error) {
+	opt, err := asynq.ParseRedisURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	c, ok := opt.MakeRedisClient().(redis.UniversalClient)
+	if !ok {
+		return nil, fmt.Errorf("unsupported redis uri %q", uri)
+	}
+	return rdb.NewRDB(c), nil
+}
+
+// readMigrationCursor returns the cursor recorded in the given file, or nil
+// if no file is given or the file doesn't exist.
+func readMigrationCursor(path string) (*migrationCursor, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cursor migrationCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, fmt.Errorf("could not read cursor file %s: %v", path, err)
+	}
+	return &cursor, nil
+}
+
+// writeMigrationCursor records the cursor in the given file, if any.
+// The file is replaced atomically so that an interrupted write doesn't corrupt it.
+func writeMigrationCursor(path string, cursor *migrationCursor) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(mirrorCmd)
+	mirrorCmd.AddCommand(mirrorPromoteCmd)
+	mirrorCmd.AddCommand(mirrorStatusCmd)
+}
+
+var mirrorCmd = &cobra.Command{
+	Use:   "mirror",
+	Short: "Manage the mirror of a redis database",
+	Long: `Mirror (asynq mirror) manages a redis database to which clients mirror
+the tasks of the primary database (see ClientConfig.Mirror).
+
+Run the commands against the mirror, e.g. asynq mirror promote --uri=mirror:6379`,
+}
+
+var mirrorPromoteCmd = &cobra.Command{
+	Use:   "promote",
+	Short: "Promote the mirror to replace the primary database",
+	Long: `Mirror promote (asynq mirror promote) marks the redis database as promoted
+to replace the primary database it mirrors, e.g. during an outage of the primary database.
+
+Servers configured with the database in Config.Mirror process the tasks of the
+database once restarted. Point the clients at the database to enqueue tasks to it.`,
+	Args: cobra.NoArgs,
+	Run:  mirrorPromote,
+}
+
+var mirrorStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show whether the mirror is promoted",
+	Args:  cobra.NoArgs,
+	Run:   mirrorStatus,
+}
+
+func mirrorPromote(cmd *cobra.Command, args []string) {
+	inspector := createInspector()
+	defer inspector.Close()
+	promotedAt, err := inspector.PromoteMirror()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("Mirror promoted at %s\nRestart the servers to process the tasks of the mirror\n",
+		promotedAt.Format(time.RFC3339))
+}
+
+func mirrorStatus(cmd *cobra.Command, args []string) {
+	inspector := createInspector()
+	defer inspector.Close()
+	promotedAt, err := inspector.PromotedAt()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if promotedAt.IsZero() {
+		fmt.Println("Mirror is not promoted")
+		return
+	}
+	fmt.Printf("Mirror promoted at %s\n", promotedAt.Format(time.RFC3339))
+}
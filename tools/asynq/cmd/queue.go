@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
 
 	"github.com/fatih/color"
 	"github.com/hibiken/asynq"
@@ -26,6 +27,11 @@ func init() {
 
 	queueCmd.AddCommand(queuePauseCmd)
 	queueCmd.AddCommand(queueUnpauseCmd)
+	queueCmd.AddCommand(queueDrainCmd)
+	queueCmd.AddCommand(queueUndrainCmd)
+	queueCmd.AddCommand(queueDelayCmd)
+	queueDelayCmd.Flags().Duration("by", 0, "duration to postpone the tasks by, e.g. 2h")
+	queueDelayCmd.MarkFlagRequired("by")
 	queueCmd.AddCommand(queueRemoveCmd)
 	queueRemoveCmd.Flags().BoolP("force", "f", false, "remove the queue regardless of its size")
 }
@@ -71,6 +77,37 @@ var queueUnpauseCmd = &cobra.Command{
 	Run:   queueUnpause,
 }
 
+var queueDrainCmd = &cobra.Command{
+	Use:   "drain QUEUE [QUEUE...]",
+	Short: "Stop one or more queues from accepting new tasks",
+	Long: `Drain (asynq queue drain) stops the queues from accepting new tasks.
+Tasks already in the queues continue to be processed.
+
+A draining queue accepts new tasks again once it's undrained or removed.`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  queueDrain,
+}
+
+var queueUndrainCmd = &cobra.Command{
+	Use:   "undrain QUEUE [QUEUE...]",
+	Short: "Let one or more draining queues accept new tasks again",
+	Args:  cobra.MinimumNArgs(1),
+	Run:   queueUndrain,
+}
+
+var queueDelayCmd = &cobra.Command{
+	Use:   "delay QUEUE [QUEUE...] --by=DURATION",
+	Short: "Postpone the scheduled and retry tasks of one or more queues",
+	Long: `Delay (asynq queue delay) postpones all the scheduled and retry tasks of the
+queues by the given duration, e.g. during a known outage of a downstream service.
+Pending tasks are not affected; pause the queues to hold them. Tasks which would
+be postponed past the time by which they must start processing are left as is.
+
+Example: asynq queue delay webhooks --by=2h`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  queueDelay,
+}
+
 var queueRemoveCmd = &cobra.Command{
 	Use:   "rm QUEUE [QUEUE...]",
 	Short: "Remove one or more queues",
@@ -143,9 +180,10 @@ func queueInspect(cmd *cobra.Command, args []string) {
 func printQueueInfo(info *asynq.QueueInfo) {
 	bold := color.New(color.Bold)
 	bold.Println("Queue Info")
-	fmt.Printf("Name:   %s\n", info.Queue)
-	fmt.Printf("Size:   %d\n", info.Size)
-	fmt.Printf("Paused: %t\n\n", info.Paused)
+	fmt.Printf("Name:     %s\n", info.Queue)
+	fmt.Printf("Size:     %d\n", info.Size)
+	fmt.Printf("Paused:   %t\n", info.Paused)
+	fmt.Printf("Draining: %t\n\n", info.Draining)
 	bold.Println("Task Count by State")
 	printTable(
 		[]string{"active", "pending", "scheduled", "retry", "archived", "completed"},
@@ -154,6 +192,12 @@ func printQueueInfo(info *asynq.QueueInfo) {
 		},
 	)
 	fmt.Println()
+	if info.Quarantined > 0 {
+		fmt.Printf("%d tasks are quarantined since their data could not be decoded\n\n", info.Quarantined)
+	}
+	if info.Unhandled > 0 {
+		fmt.Printf("%d tasks are parked since no handler is registered for their type\n\n", info.Unhandled)
+	}
 	bold.Printf("Daily Stats %s UTC\n", info.Timestamp.UTC().Format("2006-01-02"))
 	printTable(
 		[]string{"processed", "failed", "error rate"},
@@ -167,6 +211,23 @@ func printQueueInfo(info *asynq.QueueInfo) {
 			fmt.Fprintf(w, tmpl, info.Processed, info.Failed, errRate)
 		},
 	)
+	if len(info.Duplicates) > 0 {
+		fmt.Println()
+		bold.Println("Duplicate Enqueues by Type")
+		types := make([]string, 0, len(info.Duplicates))
+		for typename := range info.Duplicates {
+			types = append(types, typename)
+		}
+		sort.Strings(types)
+		printTable(
+			[]string{"type", "rejected"},
+			func(w io.Writer, tmpl string) {
+				for _, typename := range types {
+					fmt.Fprintf(w, tmpl, typename, info.Duplicates[typename])
+				}
+			},
+		)
+	}
 }
 
 func queueHistory(cmd *cobra.Command, args []string) {
@@ -231,6 +292,47 @@ func queueUnpause(cmd *cobra.Command, args []string) {
 	}
 }
 
+func queueDrain(cmd *cobra.Command, args []string) {
+	inspector := createInspector()
+	for _, qname := range args {
+		err := inspector.DrainQueue(qname)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		fmt.Printf("Successfully started draining queue %q\n", qname)
+	}
+}
+
+func queueUndrain(cmd *cobra.Command, args []string) {
+	inspector := createInspector()
+	for _, qname := range args {
+		err := inspector.UndrainQueue(qname)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		fmt.Printf("Successfully undrained queue %q\n", qname)
+	}
+}
+
+func queueDelay(cmd *cobra.Command, args []string) {
+	d, err := cmd.Flags().GetDuration("by")
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	inspector := createInspector()
+	for _, qname := range args {
+		n, err := inspector.DelayQueue(qname, d)
+		if err != nil {
+			fmt.Printf("error: %v\n", err)
+			continue
+		}
+		fmt.Printf("Postponed %d tasks of queue %q by %v\n", n, qname, d)
+	}
+}
+
 func queueRemove(cmd *cobra.Command, args []string) {
 	// TODO: Use inspector once RemoveQueue become public API.
 	force, err := cmd.Flags().GetBool("force")
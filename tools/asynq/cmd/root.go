@@ -35,6 +35,8 @@ var (
 	useRedisCluster bool
 	clusterAddrs    string
 	tlsServerName   string
+
+	redactFields []string
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -80,6 +82,8 @@ func init() {
 		"list of comma-separated redis server addresses")
 	rootCmd.PersistentFlags().StringVar(&tlsServerName, "tls_server",
 		"", "server name for TLS validation")
+	rootCmd.PersistentFlags().StringSliceVar(&redactFields, "redact_fields", nil,
+		"comma-separated names of the payload fields whose values are masked in the output (e.g. password,token)")
 	// Bind flags with config.
 	viper.BindPFlag("uri", rootCmd.PersistentFlags().Lookup("uri"))
 	viper.BindPFlag("db", rootCmd.PersistentFlags().Lookup("db"))
@@ -87,6 +91,7 @@ func init() {
 	viper.BindPFlag("cluster", rootCmd.PersistentFlags().Lookup("cluster"))
 	viper.BindPFlag("cluster_addrs", rootCmd.PersistentFlags().Lookup("cluster_addrs"))
 	viper.BindPFlag("tls_server", rootCmd.PersistentFlags().Lookup("tls_server"))
+	viper.BindPFlag("redact_fields", rootCmd.PersistentFlags().Lookup("redact_fields"))
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -138,7 +143,11 @@ func createRDB() *rdb.RDB {
 
 // createRDB creates a Inspector instance using flag values and returns it.
 func createInspector() *asynq.Inspector {
-	return asynq.NewInspector(getRedisConnOpt())
+	var cfg asynq.InspectorConfig
+	if fields := viper.GetStringSlice("redact_fields"); len(fields) > 0 {
+		cfg.RedactPayload = asynq.RedactJSONFields(fields...)
+	}
+	return asynq.NewInspectorWithConfig(getRedisConnOpt(), cfg)
 }
 
 func getRedisConnOpt() asynq.RedisConnOpt {
@@ -9,6 +9,7 @@ import (
 	"io"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,6 +19,10 @@ import (
 func init() {
 	rootCmd.AddCommand(serverCmd)
 	serverCmd.AddCommand(serverListCmd)
+	serverCmd.AddCommand(serverConcurrencyCmd)
+	serverCmd.AddCommand(serverQuietCmd)
+	serverCmd.AddCommand(serverRequeueOrphansCmd)
+	serverCmd.AddCommand(serverDriftCmd)
 }
 
 var serverCmd = &cobra.Command{
@@ -32,7 +37,9 @@ var serverListCmd = &cobra.Command{
 pulling tasks from the given redis instance.
 
 The command shows the following for each server:
+* ID of the server
 * Host and PID of the process in which the server is running
+* Environment the server runs in, if any
 * Number of active workers out of worker pool
 * Queue configuration
 * State of the worker server ("active" | "stopped")
@@ -66,11 +73,11 @@ func serverList(cmd *cobra.Command, args []string) {
 	})
 
 	// print server info
-	cols := []string{"Host", "PID", "State", "Active Workers", "Queues", "Started"}
+	cols := []string{"ID", "Host", "PID", "State", "Environment", "Active Workers", "Queues", "Started"}
 	printRows := func(w io.Writer, tmpl string) {
 		for _, info := range servers {
 			fmt.Fprintf(w, tmpl,
-				info.Host, info.PID, info.Status,
+				info.ServerID, info.Host, info.PID, info.Status, info.Environment,
 				fmt.Sprintf("%d/%d", info.ActiveWorkerCount, info.Concurrency),
 				formatQueues(info.Queues), timeAgo(info.Started))
 		}
@@ -78,6 +85,125 @@ func serverList(cmd *cobra.Command, args []string) {
 	printTable(cols, printRows)
 }
 
+var serverConcurrencyCmd = &cobra.Command{
+	Use:   "concurrency SERVER_ID N",
+	Short: "Change the concurrency of a running server",
+	Long: `Server concurrency (asynq server concurrency SERVER_ID N) sends a signal
+to the server with the given ID to change the maximum number of concurrent
+workers to N.
+
+Use 'asynq server ls' to find the ID of a server.
+The new value is shown in 'asynq server ls' after the server's next heartbeat.`,
+	Args: cobra.ExactArgs(2),
+	Run:  serverConcurrency,
+}
+
+func serverConcurrency(cmd *cobra.Command, args []string) {
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 1 {
+		fmt.Printf("error: concurrency must be a positive integer, got %q\n", args[1])
+		os.Exit(1)
+	}
+	i := createInspector()
+	if err := i.SetServerConcurrency(args[0], n); err != nil {
+		fmt.Printf("error: could not send concurrency signal: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Sent signal to change concurrency of server %s to %d\n", args[0], n)
+}
+
+var serverQuietCmd = &cobra.Command{
+	Use:   "quiet SERVER_ID [SERVER_ID...]",
+	Short: "Stop servers from processing new tasks",
+	Long: `Server quiet (asynq server quiet SERVER_ID [SERVER_ID...]) sends a signal
+to the servers with the given IDs to stop pulling new tasks from queues.
+Active tasks are processed to completion, and the servers keep running
+until they are shut down (e.g. before a deploy).
+
+Use 'asynq server ls' to find the ID of a server.
+The server is shown as "stopped" in 'asynq server ls' after its next heartbeat.`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  serverQuiet,
+}
+
+func serverQuiet(cmd *cobra.Command, args []string) {
+	i := createInspector()
+	for _, id := range args {
+		if err := i.QuietServer(id); err != nil {
+			fmt.Printf("error: could not send quiet signal to server %s: %v\n", id, err)
+			continue
+		}
+		fmt.Printf("Sent signal to quiet server %s\n", id)
+	}
+}
+
+var serverRequeueOrphansCmd = &cobra.Command{
+	Use:   "requeue-orphans SERVER_ID [SERVER_ID...]",
+	Short: "Requeue the active tasks of dead servers",
+	Long: `Server requeue-orphans (asynq server requeue-orphans SERVER_ID [SERVER_ID...])
+moves the tasks being processed by the servers with the given IDs back to their
+queues, and removes the servers from 'asynq server ls'.
+
+Use it only for servers known to be dead (e.g. after a host failure), to get their
+tasks processed by other servers right away instead of once their deadline passes.
+Tasks of a server which is still running are processed twice.`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  serverRequeueOrphans,
+}
+
+func serverRequeueOrphans(cmd *cobra.Command, args []string) {
+	i := createInspector()
+	for _, id := range args {
+		n, err := i.RequeueOrphans(id)
+		if err != nil {
+			fmt.Printf("error: could not requeue tasks of server %s: %v\n", id, err)
+			continue
+		}
+		fmt.Printf("Requeued %d tasks of server %s\n", n, id)
+	}
+}
+
+var serverDriftCmd = &cobra.Command{
+	Use:   "drift",
+	Short: "Show configuration differences between running servers",
+	Long: `Server drift (asynq server drift) compares the configuration of the running
+servers of each environment, and shows the settings whose value differs between
+servers (e.g. during a partial deploy): the asynq version, the concurrency, the
+features (e.g. payload store, signing), the queue configuration and whether
+strict priority is enabled.
+
+For each value of a setting, the IDs of the servers configured with the value are shown.`,
+	Args: cobra.NoArgs,
+	Run:  serverDrift,
+}
+
+func serverDrift(cmd *cobra.Command, args []string) {
+	i := createInspector()
+	drifts, err := i.ConfigDrift()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if len(drifts) == 0 {
+		fmt.Println("No configuration drift between running servers")
+		return
+	}
+	cols := []string{"Environment", "Setting", "Value", "Servers"}
+	printRows := func(w io.Writer, tmpl string) {
+		for _, d := range drifts {
+			var values []string
+			for v := range d.Values {
+				values = append(values, v)
+			}
+			sort.Strings(values)
+			for _, v := range values {
+				fmt.Fprintf(w, tmpl, d.Environment, d.Setting, v, strings.Join(d.Values[v], ", "))
+			}
+		}
+	}
+	printTable(cols, printRows)
+}
+
 func formatQueues(qmap map[string]int) string {
 	// sort queues by priority and name
 	type queue struct {
@@ -64,6 +64,9 @@ type AggregateStats struct {
 	Processed int
 	Failed    int
 	Timestamp time.Time
+
+	// Environment the redis database is labeled with, empty if unlabeled.
+	Environment string
 }
 
 func stats(cmd *cobra.Command, args []string) {
@@ -92,6 +95,7 @@ func stats(cmd *cobra.Command, args []string) {
 		aggStats.Processed += s.Processed
 		aggStats.Failed += s.Failed
 		aggStats.Timestamp = s.Timestamp
+		aggStats.Environment = s.Environment
 		stats = append(stats, s)
 	}
 	var info map[string]string
@@ -105,6 +109,10 @@ func stats(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 	bold := color.New(color.Bold)
+	if aggStats.Environment != "" {
+		bold.Printf("Environment: %s\n", aggStats.Environment)
+		fmt.Println()
+	}
 	bold.Println("Task Count by State")
 	printStatsByState(&aggStats)
 	fmt.Println()
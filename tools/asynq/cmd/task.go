@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/fatih/color"
@@ -51,23 +53,53 @@ func init() {
 	taskRunCmd.MarkFlagRequired("queue")
 	taskRunCmd.MarkFlagRequired("id")
 
+	taskCmd.AddCommand(taskCloneCmd)
+	taskCloneCmd.Flags().StringP("queue", "q", "", "queue to which the task belongs")
+	taskCloneCmd.Flags().StringP("id", "i", "", "id of the task")
+	taskCloneCmd.Flags().StringP("payload", "p", "", "payload of the clone")
+	taskCloneCmd.MarkFlagRequired("queue")
+	taskCloneCmd.MarkFlagRequired("id")
+	taskCloneCmd.MarkFlagRequired("payload")
+
 	taskCmd.AddCommand(taskArchiveAllCmd)
 	taskArchiveAllCmd.Flags().StringP("queue", "q", "", "queue to which the tasks belong")
 	taskArchiveAllCmd.Flags().StringP("state", "s", "", "state of the tasks")
+	addTaskFilterFlags(taskArchiveAllCmd)
 	taskArchiveAllCmd.MarkFlagRequired("queue")
 	taskArchiveAllCmd.MarkFlagRequired("state")
 
+	taskCmd.AddCommand(taskArchiveStaleCmd)
+	taskArchiveStaleCmd.Flags().StringP("queue", "q", "", "queue to which the tasks belong")
+	taskArchiveStaleCmd.Flags().Duration("age", 7*24*time.Hour, "time after their process time scheduled and retry tasks are stale")
+	taskArchiveStaleCmd.MarkFlagRequired("queue")
+
 	taskCmd.AddCommand(taskDeleteAllCmd)
 	taskDeleteAllCmd.Flags().StringP("queue", "q", "", "queue to which the tasks belong")
 	taskDeleteAllCmd.Flags().StringP("state", "s", "", "state of the tasks")
+	taskDeleteAllCmd.Flags().Bool("dry-run", false, "report the number of tasks to delete without deleting them")
+	addTaskFilterFlags(taskDeleteAllCmd)
 	taskDeleteAllCmd.MarkFlagRequired("queue")
 	taskDeleteAllCmd.MarkFlagRequired("state")
 
 	taskCmd.AddCommand(taskRunAllCmd)
 	taskRunAllCmd.Flags().StringP("queue", "q", "", "queue to which the tasks belong")
 	taskRunAllCmd.Flags().StringP("state", "s", "", "state of the tasks")
+	addTaskFilterFlags(taskRunAllCmd)
+	taskRunAllCmd.Flags().Int("rate", 0, "number of archived tasks to enqueue per second (default: all at once)")
 	taskRunAllCmd.MarkFlagRequired("queue")
 	taskRunAllCmd.MarkFlagRequired("state")
+
+	taskCmd.AddCommand(taskExportCmd)
+	taskExportCmd.Flags().StringP("queue", "q", "", "queue to which the tasks belong")
+	taskExportCmd.Flags().StringP("file", "f", "", "path of the file to write the tasks to")
+	taskExportCmd.MarkFlagRequired("queue")
+	taskExportCmd.MarkFlagRequired("file")
+
+	taskCmd.AddCommand(taskImportCmd)
+	taskImportCmd.Flags().StringP("queue", "q", "", "queue to import the tasks to")
+	taskImportCmd.Flags().StringP("file", "f", "", "path of the file to read the tasks from")
+	taskImportCmd.MarkFlagRequired("queue")
+	taskImportCmd.MarkFlagRequired("file")
 }
 
 var taskCmd = &cobra.Command{
@@ -87,6 +119,8 @@ The value for the state flag should be one of:
 - retry
 - archived
 - completed
+- waiting
+- unhandled
 
 List opeartion paginates the result set.
 By default, the command fetches the first 30 tasks.
@@ -136,25 +170,149 @@ var taskRunCmd = &cobra.Command{
 	Run:   taskRun,
 }
 
+var taskCloneCmd = &cobra.Command{
+	Use:   "clone --queue=QUEUE --id=TASK_ID --payload=PAYLOAD",
+	Short: "Enqueue a copy of an archived task with a new payload",
+	Long: `Clone (asynq task clone) enqueues a copy of the archived task with the given id
+to the pending state of the same queue, with the given payload instead of the payload
+of the archived task. The archived task is left in place, and the clone shows its id
+in the "Cloned From" field of 'asynq task inspect'.
+
+Example: asynq task clone --queue=default --id=ca8365a1 --payload='{"user_id": 42}'`,
+	Args: cobra.NoArgs,
+	Run:  taskClone,
+}
+
 var taskArchiveAllCmd = &cobra.Command{
 	Use:   "archiveall --queue=QUEUE --state=STATE",
 	Short: "Archive all tasks in the given state",
-	Args:  cobra.NoArgs,
-	Run:   taskArchiveAll,
+	Long: `Archiveall archives all tasks in the given state, or only the tasks matching
+the --type, --error and --failed-before flags if any is given.`,
+	Args: cobra.NoArgs,
+	Run:  taskArchiveAll,
+}
+
+var taskArchiveStaleCmd = &cobra.Command{
+	Use:   "archivestale --queue=QUEUE [--age=DURATION]",
+	Short: "Archive scheduled and retry tasks stuck past their process time",
+	Long: `Archivestale archives the scheduled and retry tasks which were to be processed
+more than --age ago, with the "stale" archive reason. Such tasks are stuck, e.g. because
+of a past bug, since ready tasks are moved to the pending state by the running servers.`,
+	Args: cobra.NoArgs,
+	Run:  taskArchiveStale,
 }
 
 var taskDeleteAllCmd = &cobra.Command{
 	Use:   "deleteall --queue=QUEUE --state=STATE",
 	Short: "Delete all tasks in the given state",
-	Args:  cobra.NoArgs,
-	Run:   taskDeleteAll,
+	Long: `Deleteall deletes all tasks in the given state, or only the tasks matching
+the --type, --error and --failed-before flags if any is given.`,
+	Args: cobra.NoArgs,
+	Run:  taskDeleteAll,
 }
 
 var taskRunAllCmd = &cobra.Command{
 	Use:   "runall --queue=QUEUE --state=STATE",
 	Short: "Run all tasks in the given state",
-	Args:  cobra.NoArgs,
-	Run:   taskRunAll,
+	Long: `Runall moves all tasks in the given state to the pending state, or only the
+tasks matching the --type, --error and --failed-before flags if any is given.
+
+With --rate, archived tasks are enqueued at the given number of tasks per second
+instead of all at once, to avoid overloading the service which made them fail.
+
+Example: asynq task runall --queue=default --state=archived --type=image:resize --error=503
+Example: asynq task runall --queue=default --state=archived --rate=50`,
+	Args: cobra.NoArgs,
+	Run:  taskRunAll,
+}
+
+// addTaskFilterFlags adds the flags to filter the tasks of a bulk action to cmd.
+func addTaskFilterFlags(cmd *cobra.Command) {
+	cmd.Flags().String("type", "", "only tasks of the given type")
+	cmd.Flags().String("error", "", "only tasks whose last error contains the given text")
+	cmd.Flags().Duration("failed-before", 0, "only tasks which last failed more than the given duration ago (e.g. 24h)")
+	cmd.Flags().Duration("enqueued-before", 0, "only tasks which were enqueued more than the given duration ago (e.g. 24h)")
+}
+
+// taskFilters returns the filters given with the flags added by addTaskFilterFlags.
+func taskFilters(cmd *cobra.Command) ([]asynq.TaskFilter, error) {
+	var filters []asynq.TaskFilter
+	typename, err := cmd.Flags().GetString("type")
+	if err != nil {
+		return nil, err
+	}
+	if typename != "" {
+		filters = append(filters, asynq.FilterByType(typename))
+	}
+	errText, err := cmd.Flags().GetString("error")
+	if err != nil {
+		return nil, err
+	}
+	if errText != "" {
+		filters = append(filters, asynq.FilterByErrorContains(errText))
+	}
+	age, err := cmd.Flags().GetDuration("failed-before")
+	if err != nil {
+		return nil, err
+	}
+	if age > 0 {
+		filters = append(filters, asynq.FilterByFailedBefore(time.Now().Add(-age)))
+	}
+	age, err = cmd.Flags().GetDuration("enqueued-before")
+	if err != nil {
+		return nil, err
+	}
+	if age > 0 {
+		filters = append(filters, asynq.FilterByEnqueuedBefore(time.Now().Add(-age)))
+	}
+	return filters, nil
+}
+
+func parseTaskState(state string) (asynq.TaskState, error) {
+	switch state {
+	case "pending":
+		return asynq.TaskStatePending, nil
+	case "scheduled":
+		return asynq.TaskStateScheduled, nil
+	case "retry":
+		return asynq.TaskStateRetry, nil
+	case "archived":
+		return asynq.TaskStateArchived, nil
+	case "completed":
+		return asynq.TaskStateCompleted, nil
+	case "unhandled":
+		return asynq.TaskStateUnhandled, nil
+	}
+	return 0, fmt.Errorf("unsupported state %q", state)
+}
+
+var taskExportCmd = &cobra.Command{
+	Use:   "export --queue=QUEUE --file=FILE",
+	Short: "Export archived tasks to a file",
+	Long: `Export writes all archived tasks in the specified queue to a file in JSON Lines format.
+
+Exported tasks stay in the queue. To free up the memory in redis, delete them with
+  asynq task deleteall --queue=QUEUE --state=archived
+
+Example:
+  asynq task export --queue=default --file=archived.jsonl`,
+	Args: cobra.NoArgs,
+	Run:  taskExport,
+}
+
+var taskImportCmd = &cobra.Command{
+	Use:   "import --queue=QUEUE --file=FILE",
+	Short: "Import archived tasks from a file",
+	Long: `Import adds the tasks in a file written by the export command to the archived
+tasks of the specified queue. Tasks which already exist in the queue are skipped.
+
+To process the imported tasks again, run
+  asynq task runall --queue=QUEUE --state=archived
+
+Example:
+  asynq task import --queue=default --file=archived.jsonl`,
+	Args: cobra.NoArgs,
+	Run:  taskImport,
 }
 
 func taskList(cmd *cobra.Command, args []string) {
@@ -192,6 +350,10 @@ func taskList(cmd *cobra.Command, args []string) {
 		listArchivedTasks(qname, pageNum, pageSize)
 	case "completed":
 		listCompletedTasks(qname, pageNum, pageSize)
+	case "waiting":
+		listWaitingTasks(qname, pageNum, pageSize)
+	case "unhandled":
+		listUnhandledTasks(qname, pageNum, pageSize)
 	default:
 		fmt.Printf("error: state=%q is not supported\n", state)
 		os.Exit(1)
@@ -210,10 +372,10 @@ func listActiveTasks(qname string, pageNum, pageSize int) {
 		return
 	}
 	printTable(
-		[]string{"ID", "Type", "Payload"},
+		[]string{"ID", "Type", "Payload", "Progress"},
 		func(w io.Writer, tmpl string) {
 			for _, t := range tasks {
-				fmt.Fprintf(w, tmpl, t.ID, t.Type, sprintBytes(t.Payload))
+				fmt.Fprintf(w, tmpl, t.ID, t.Type, sprintBytes(t.Payload), sprintBytes(t.Progress))
 			}
 		},
 	)
@@ -334,6 +496,46 @@ func listCompletedTasks(qname string, pageNum, pageSize int) {
 		})
 }
 
+func listWaitingTasks(qname string, pageNum, pageSize int) {
+	i := createInspector()
+	tasks, err := i.ListWaitingTasks(qname, asynq.PageSize(pageSize), asynq.Page(pageNum))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if len(tasks) == 0 {
+		fmt.Printf("No waiting tasks in %q queue\n", qname)
+		return
+	}
+	printTable(
+		[]string{"ID", "Type", "Payload", "Depends On"},
+		func(w io.Writer, tmpl string) {
+			for _, t := range tasks {
+				fmt.Fprintf(w, tmpl, t.ID, t.Type, sprintBytes(t.Payload), strings.Join(t.Dependencies, ", "))
+			}
+		})
+}
+
+func listUnhandledTasks(qname string, pageNum, pageSize int) {
+	i := createInspector()
+	tasks, err := i.ListUnhandledTasks(qname, asynq.PageSize(pageSize), asynq.Page(pageNum))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if len(tasks) == 0 {
+		fmt.Printf("No unhandled tasks in %q queue\n", qname)
+		return
+	}
+	printTable(
+		[]string{"ID", "Type", "Payload", "Last Error"},
+		func(w io.Writer, tmpl string) {
+			for _, t := range tasks {
+				fmt.Fprintf(w, tmpl, t.ID, t.Type, sprintBytes(t.Payload), t.LastErr)
+			}
+		})
+}
+
 func taskCancel(cmd *cobra.Command, args []string) {
 	i := createInspector()
 	for _, id := range args {
@@ -373,15 +575,51 @@ func printTaskInfo(info *asynq.TaskInfo) {
 	fmt.Printf("ID:      %s\n", info.ID)
 	fmt.Printf("Type:    %s\n", info.Type)
 	fmt.Printf("State:   %v\n", info.State)
-	fmt.Printf("Retried: %d/%d\n", info.Retried, info.MaxRetry)
+	if info.DefaultMaxRetry {
+		// The retry policy of the queue, if any, applies to the task instead.
+		fmt.Printf("Retried: %d/%d (client default, unless the queue has a retry policy)\n", info.Retried, info.MaxRetry)
+	} else {
+		fmt.Printf("Retried: %d/%d\n", info.Retried, info.MaxRetry)
+	}
+	if info.ClonedFrom != "" {
+		fmt.Printf("Cloned From: %s\n", info.ClonedFrom)
+	}
 	fmt.Println()
 	fmt.Printf("Next process time: %s\n", formatNextProcessAt(info.NextProcessAt))
+	if info.Progress != nil {
+		fmt.Printf("Progress:          %s\n", sprintBytes(info.Progress))
+	}
+	if len(info.Headers) != 0 {
+		fmt.Println()
+		bold.Println("Headers")
+		keys := make([]string, 0, len(info.Headers))
+		for k := range info.Headers {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Printf("%s: %s\n", k, info.Headers[k])
+		}
+	}
 	if len(info.LastErr) != 0 {
 		fmt.Println()
 		bold.Println("Last Failure")
 		fmt.Printf("Failed at:     %s\n", formatPastTime(info.LastFailedAt))
 		fmt.Printf("Error message: %s\n", info.LastErr)
 	}
+	if info.State == asynq.TaskStateRetry {
+		fmt.Println()
+		bold.Println("Retry Schedule (estimated with the default retry delay)")
+		for i, t := range info.RetrySchedule(asynq.DefaultRetryDelayFunc) {
+			fmt.Printf("Attempt %d/%d: %s\n", info.Retried+i+1, info.MaxRetry+1, formatNextProcessAt(t))
+		}
+	}
+	if info.PayloadSize != 0 {
+		fmt.Println()
+		bold.Println("Truncated Payload")
+		fmt.Printf("Original size:   %d bytes (%d bytes kept)\n", info.PayloadSize, len(info.Payload))
+		fmt.Printf("Original SHA256: %s\n", info.PayloadDigest)
+	}
 }
 
 func formatNextProcessAt(processAt time.Time) string {
@@ -465,6 +703,32 @@ func taskRun(cmd *cobra.Command, args []string) {
 	fmt.Println("task is now pending")
 }
 
+func taskClone(cmd *cobra.Command, args []string) {
+	qname, err := cmd.Flags().GetString("queue")
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	id, err := cmd.Flags().GetString("id")
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	payload, err := cmd.Flags().GetString("payload")
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+
+	i := createInspector()
+	info, err := i.CloneTask(qname, id, []byte(payload))
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("task cloned: id=%s is now pending\n", info.ID)
+}
+
 func taskArchiveAll(cmd *cobra.Command, args []string) {
 	qname, err := cmd.Flags().GetString("queue")
 	if err != nil {
@@ -477,14 +741,25 @@ func taskArchiveAll(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
+	filters, err := taskFilters(cmd)
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+
 	i := createInspector()
 	var n int
-	switch state {
-	case "pending":
+	switch {
+	case len(filters) > 0:
+		var s asynq.TaskState
+		if s, err = parseTaskState(state); err == nil {
+			n, err = i.ArchiveTasks(qname, s, filters...)
+		}
+	case state == "pending":
 		n, err = i.ArchiveAllPendingTasks(qname)
-	case "scheduled":
+	case state == "scheduled":
 		n, err = i.ArchiveAllScheduledTasks(qname)
-	case "retry":
+	case state == "retry":
 		n, err = i.ArchiveAllRetryTasks(qname)
 	default:
 		fmt.Printf("error: unsupported state %q\n", state)
@@ -497,6 +772,26 @@ func taskArchiveAll(cmd *cobra.Command, args []string) {
 	fmt.Printf("%d tasks archived\n", n)
 }
 
+func taskArchiveStale(cmd *cobra.Command, args []string) {
+	qname, err := cmd.Flags().GetString("queue")
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	age, err := cmd.Flags().GetDuration("age")
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	i := createInspector()
+	n, err := i.ArchiveStaleTasks(qname, age)
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%d stale tasks archived\n", n)
+}
+
 func taskDeleteAll(cmd *cobra.Command, args []string) {
 	qname, err := cmd.Flags().GetString("queue")
 	if err != nil {
@@ -509,27 +804,41 @@ func taskDeleteAll(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+
+	filters, err := taskFilters(cmd)
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+
+	s, err := parseTaskState(state)
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
 	i := createInspector()
 	var n int
-	switch state {
-	case "pending":
-		n, err = i.DeleteAllPendingTasks(qname)
-	case "scheduled":
-		n, err = i.DeleteAllScheduledTasks(qname)
-	case "retry":
-		n, err = i.DeleteAllRetryTasks(qname)
-	case "archived":
-		n, err = i.DeleteAllArchivedTasks(qname)
-	case "completed":
-		n, err = i.DeleteAllCompletedTasks(qname)
+	switch {
+	case len(filters) > 0 && dryRun:
+		n, err = i.CountTasks(qname, s, filters...)
+	case len(filters) > 0:
+		n, err = i.DeleteTasks(qname, s, filters...)
 	default:
-		fmt.Printf("error: unsupported state %q\n", state)
-		os.Exit(1)
+		n, err = i.PurgeQueue(qname, s, dryRun)
 	}
 	if err != nil {
 		fmt.Printf("error: %v\n", err)
 		os.Exit(1)
 	}
+	if dryRun {
+		fmt.Printf("%d tasks would be deleted\n", n)
+		return
+	}
 	fmt.Printf("%d tasks deleted\n", n)
 }
 
@@ -545,15 +854,43 @@ func taskRunAll(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
+	filters, err := taskFilters(cmd)
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	rate, err := cmd.Flags().GetInt("rate")
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	if rate > 0 && (state != "archived" || len(filters) > 0) {
+		fmt.Println("error: --rate is only supported for archived tasks without filters")
+		os.Exit(1)
+	}
+
 	i := createInspector()
 	var n int
-	switch state {
-	case "scheduled":
+	switch {
+	case rate > 0:
+		n, err = i.RunAllArchivedTasksAtRate(qname, rate)
+		if err == nil {
+			fmt.Printf("%d tasks are scheduled to be enqueued at %d tasks per second\n", n, rate)
+			return
+		}
+	case len(filters) > 0:
+		var s asynq.TaskState
+		if s, err = parseTaskState(state); err == nil {
+			n, err = i.RunTasks(qname, s, filters...)
+		}
+	case state == "scheduled":
 		n, err = i.RunAllScheduledTasks(qname)
-	case "retry":
+	case state == "retry":
 		n, err = i.RunAllRetryTasks(qname)
-	case "archived":
+	case state == "archived":
 		n, err = i.RunAllArchivedTasks(qname)
+	case state == "unhandled":
+		n, err = i.RunAllUnhandledTasks(qname)
 	default:
 		fmt.Printf("error: unsupported state %q\n", state)
 		os.Exit(1)
@@ -564,3 +901,59 @@ func taskRunAll(cmd *cobra.Command, args []string) {
 	}
 	fmt.Printf("%d tasks are now pending\n", n)
 }
+
+func taskExport(cmd *cobra.Command, args []string) {
+	qname, err := cmd.Flags().GetString("queue")
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	path, err := cmd.Flags().GetString("file")
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+
+	i := createInspector()
+	n, err := i.ExportArchivedTasks(qname, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%d tasks exported to %s\n", n, path)
+}
+
+func taskImport(cmd *cobra.Command, args []string) {
+	qname, err := cmd.Flags().GetString("queue")
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	path, err := cmd.Flags().GetString("file")
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	i := createInspector()
+	n, err := i.ImportArchivedTasks(qname, f)
+	if err != nil {
+		fmt.Printf("error: %v (%d tasks imported)\n", err, n)
+		os.Exit(1)
+	}
+	fmt.Printf("%d tasks imported\n", n)
+}
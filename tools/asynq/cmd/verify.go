@@ -0,0 +1,102 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(verifyMessageCmd)
+	verifyMessageCmd.Flags().StringP("queue", "q", "", "queue to which the tasks belong")
+	verifyMessageCmd.Flags().String("data", "", "base64 encoding of a message to verify instead of stored tasks")
+}
+
+var verifyMessageCmd = &cobra.Command{
+	Use:   "verify-message --queue=QUEUE TASK_ID [TASK_ID...] | --data=BASE64",
+	Short: "Verifies that task messages conform to the wire format",
+	Long: `Verify-message (asynq verify-message) checks that tasks conform to the wire format
+of asynq, e.g. tasks enqueued by producers written in other languages, and reports the
+problems found. See docs/wire-format.md for the format.
+
+With --queue, the tasks with the given IDs are read from redis, and their message and
+the fields of their task hash are checked. With --data, the given encoded message is
+checked without reading from redis.
+
+The command exits with a non-zero status if a problem is found.
+
+Example: asynq verify-message --queue=default 7c3f0e2a-1e5f-4c4b-9d0f-6ad3c1a7a9b1`,
+	Run: verifyMessage,
+}
+
+func verifyMessage(cmd *cobra.Command, args []string) {
+	qname, err := cmd.Flags().GetString("queue")
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	data, err := cmd.Flags().GetString("data")
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	if data != "" {
+		encoded, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			fmt.Printf("error: invalid base64 data: %v\n", err)
+			os.Exit(1)
+		}
+		msg, err := base.DecodeMessage(encoded)
+		if err != nil {
+			fmt.Printf("message cannot be decoded: %v\n", err)
+			os.Exit(1)
+		}
+		if !printProblems("message", base.ValidateMessage(msg)) {
+			os.Exit(1)
+		}
+		return
+	}
+	if qname == "" || len(args) == 0 {
+		fmt.Println("error: either --queue and task IDs or --data must be given")
+		os.Exit(1)
+	}
+
+	r := createRDB()
+	defer r.Close()
+	ok := true
+	for _, id := range args {
+		problems, err := r.ValidateMessage(qname, id)
+		if err != nil {
+			fmt.Printf("%s: error: %v\n", id, err)
+			ok = false
+			continue
+		}
+		if !printProblems(id, problems) {
+			ok = false
+		}
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// printProblems prints the problems found in the named message,
+// and reports whether none were found.
+func printProblems(name string, problems []string) bool {
+	if len(problems) == 0 {
+		fmt.Printf("%s: ok\n", name)
+		return true
+	}
+	fmt.Printf("%s: %d problems found\n", name, len(problems))
+	for _, p := range problems {
+		fmt.Printf("  - %s\n", p)
+	}
+	return false
+}
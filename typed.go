@@ -0,0 +1,74 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+//go:build go1.18
+// +build go1.18
+
+package asynq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// NewTypedTask returns a new Task given a type name and a payload, which is
+// encoded as JSON.
+//
+// Use HandlerFor with the same payload type to process the tasks.
+func NewTypedTask[T any](typename string, payload T, opts ...Option) (*Task, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("asynq: could not encode payload of task %q: %v", typename, err)
+	}
+	return NewTask(typename, b, opts...), nil
+}
+
+// HandlerFor returns a Handler which decodes the JSON payload of each task
+// into a value of type T and calls fn with the value.
+//
+// If the payload cannot be decoded, the task is archived without calling fn,
+// since retrying the task cannot succeed.
+func HandlerFor[T any](fn func(ctx context.Context, payload T) error) Handler {
+	return HandlerFunc(func(ctx context.Context, t *Task) error {
+		var payload T
+		if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+			return fmt.Errorf("asynq: could not decode payload of task %q: %v: %w", t.Type(), err, SkipRetry)
+		}
+		return fn(ctx, payload)
+	})
+}
+
+// TaskType binds a task type name to the type of its payload, so that the
+// tasks of the type are created and handled with payloads of the same type.
+//
+// Example:
+//
+//	var EmailDelivery = asynq.NewTaskType[EmailPayload]("email:deliver")
+//
+//	task, err := EmailDelivery.NewTask(EmailPayload{UserID: 42})
+//
+//	mux.Handle(EmailDelivery.Name(), EmailDelivery.Handler(sendEmail))
+type TaskType[T any] struct {
+	name string
+}
+
+// NewTaskType returns a TaskType with the given type name whose payloads are of type T.
+func NewTaskType[T any](name string) TaskType[T] {
+	return TaskType[T]{name: name}
+}
+
+// Name returns the type name of the tasks.
+func (tt TaskType[T]) Name() string { return tt.name }
+
+// NewTask returns a new Task of the type with the given payload.
+func (tt TaskType[T]) NewTask(payload T, opts ...Option) (*Task, error) {
+	return NewTypedTask(tt.name, payload, opts...)
+}
+
+// Handler returns a Handler for the tasks of the type which calls fn with
+// the decoded payload of each task. See HandlerFor.
+func (tt TaskType[T]) Handler(fn func(ctx context.Context, payload T) error) Handler {
+	return HandlerFor(fn)
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+//go:build go1.18
+// +build go1.18
+
+package asynq
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type emailPayload struct {
+	UserID int      `json:"user_id"`
+	To     []string `json:"to"`
+}
+
+func TestTypedTask(t *testing.T) {
+	emailDelivery := NewTaskType[emailPayload]("email:deliver")
+	want := emailPayload{UserID: 42, To: []string{"a@example.com"}}
+	task, err := emailDelivery.NewTask(want, Queue("critical"))
+	if err != nil {
+		t.Fatalf("NewTask returned error: %v", err)
+	}
+	if task.Type() != "email:deliver" || string(task.Payload()) != `{"user_id":42,"to":["a@example.com"]}` {
+		t.Errorf("NewTask returned task with type %q and payload %s", task.Type(), task.Payload())
+	}
+
+	var got emailPayload
+	h := emailDelivery.Handler(func(ctx context.Context, p emailPayload) error {
+		got = p
+		return nil
+	})
+	if err := h.ProcessTask(context.Background(), task); err != nil {
+		t.Fatalf("ProcessTask returned error: %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("handler was called with payload mismatch (-want,+got):\n%s", diff)
+	}
+}
+
+func TestHandlerForInvalidPayload(t *testing.T) {
+	called := false
+	h := HandlerFor(func(ctx context.Context, p emailPayload) error {
+		called = true
+		return nil
+	})
+	err := h.ProcessTask(context.Background(), NewTask("email:deliver", []byte(`{"user_id":"42"}`)))
+	if !errors.Is(err, SkipRetry) {
+		t.Errorf("ProcessTask returned %v, want an error wrapping SkipRetry", err)
+	}
+	if called {
+		t.Errorf("handler was called with a payload which could not be decoded")
+	}
+}
+
+func TestNewTypedTaskUnsupportedPayload(t *testing.T) {
+	if _, err := NewTypedTask("report", make(chan int)); err == nil {
+		t.Errorf("NewTypedTask with a channel payload returned nil error, want non-nil error")
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ValidatorFunc checks a task before it is enqueued.
+// If it returns a non-nil error, the task is not enqueued.
+//
+// See ClientConfig.Validators for how to register validators.
+type ValidatorFunc func(task *Task) error
+
+// ValidationError is returned by Client's enqueue methods when a validator
+// rejects a task. The task is not written to redis.
+type ValidationError struct {
+	// Type is the type name of the rejected task.
+	Type string
+
+	// Err is the error returned by the validator.
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("asynq: invalid task %q: %v", e.Type, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error { return e.Err }
+
+// ErrPayloadTooLarge indicates that the payload of a task exceeds the size
+// allowed by MaxPayloadSize.
+var ErrPayloadTooLarge = errors.New("payload too large")
+
+// ErrMissingField indicates that the payload of a task lacks a field
+// required by RequireFields.
+var ErrMissingField = errors.New("missing required field")
+
+// MaxPayloadSize returns a validator rejecting tasks whose payload is larger than n bytes.
+func MaxPayloadSize(n int) ValidatorFunc {
+	return func(task *Task) error {
+		if size := len(task.Payload()); size > n {
+			return fmt.Errorf("%w: %d bytes, max %d bytes", ErrPayloadTooLarge, size, n)
+		}
+		return nil
+	}
+}
+
+// RequireFields returns a validator rejecting tasks whose payload is not a JSON object
+// with all the given top-level fields.
+func RequireFields(fields ...string) ValidatorFunc {
+	return func(task *Task) error {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(task.Payload(), &obj); err != nil {
+			return fmt.Errorf("payload is not a JSON object: %v", err)
+		}
+		for _, f := range fields {
+			if _, ok := obj[f]; !ok {
+				return fmt.Errorf("%w %q", ErrMissingField, f)
+			}
+		}
+		return nil
+	}
+}
+
+// Validators combines the given validators into one, which runs them in order
+// and returns the first error.
+func Validators(fns ...ValidatorFunc) ValidatorFunc {
+	return func(task *Task) error {
+		for _, fn := range fns {
+			if err := fn(task); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// validate runs the validators registered for all tasks and for the type of the task.
+func (c *Client) validate(task *Task) error {
+	for _, key := range []string{"*", task.Type()} {
+		fn, ok := c.validators[key]
+		if !ok {
+			continue
+		}
+		if err := fn(task); err != nil {
+			return &ValidationError{Type: task.Type(), Err: err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	h "github.com/hibiken/asynq/internal/asynqtest"
+)
+
+func TestClientValidators(t *testing.T) {
+	r := setup(t)
+	defer r.Close()
+	errNoReply := errors.New("noreply address")
+	client := NewClientWithConfig(getRedisConnOpt(t), ClientConfig{
+		Validators: map[string]ValidatorFunc{
+			"*": MaxPayloadSize(32),
+			"email:send": Validators(
+				RequireFields("to"),
+				func(task *Task) error {
+					if string(task.Payload()) == `{"to":"noreply"}` {
+						return errNoReply
+					}
+					return nil
+				},
+			),
+		},
+	})
+	defer client.Close()
+
+	tests := []struct {
+		desc    string
+		task    *Task
+		wantErr error // nil if the task should be enqueued
+	}{
+		{
+			desc: "valid task",
+			task: NewTask("email:send", []byte(`{"to":"a@example.com"}`)),
+		},
+		{
+			desc: "task type without validator",
+			task: NewTask("image:resize", nil),
+		},
+		{
+			desc:    "payload too large for any task type",
+			task:    NewTask("image:resize", make([]byte, 33)),
+			wantErr: ErrPayloadTooLarge,
+		},
+		{
+			desc:    "missing required field",
+			task:    NewTask("email:send", []byte(`{"subject":"hi"}`)),
+			wantErr: ErrMissingField,
+		},
+		{
+			desc:    "error of custom validator",
+			task:    NewTask("email:send", []byte(`{"to":"noreply"}`)),
+			wantErr: errNoReply,
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r)
+		_, err := client.Enqueue(tc.task)
+		if tc.wantErr == nil {
+			if err != nil {
+				t.Errorf("%s: Enqueue returned error: %v", tc.desc, err)
+			}
+			continue
+		}
+		var verr *ValidationError
+		if !errors.As(err, &verr) || verr.Type != tc.task.Type() {
+			t.Errorf("%s: Enqueue returned %v, want *ValidationError for type %q", tc.desc, err, tc.task.Type())
+			continue
+		}
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("%s: Enqueue returned %v, want error wrapping %v", tc.desc, err, tc.wantErr)
+		}
+		if keys := r.Keys(context.Background(), "asynq:{default}:t:*").Val(); len(keys) != 0 {
+			t.Errorf("%s: rejected task was written to redis: %v", tc.desc, keys)
+		}
+	}
+}
+
+func TestRequireFieldsNonObjectPayload(t *testing.T) {
+	for _, payload := range []string{``, `[1,2]`, `"to"`} {
+		if err := RequireFields("to")(NewTask("email:send", []byte(payload))); err == nil {
+			t.Errorf("RequireFields(%q) returned nil error for payload %q, want non-nil error", "to", payload)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+// Package alert notifies when tasks in a queue are archived at a high rate.
+//
+// A Monitor is installed as the ErrorHandler of an asynq.Server. It counts the
+// tasks archived in each queue, and calls the Notifier once the number of tasks
+// archived within the window reaches the threshold:
+//
+//	monitor := alert.NewMonitor(alert.Config{
+//		Threshold: 10,
+//		Window:    5 * time.Minute,
+//		Notifier:  &alert.SlackNotifier{WebhookURL: url},
+//	})
+//	srv := asynq.NewServer(redisConnOpt, asynq.Config{ErrorHandler: monitor})
+//
+// Counts are kept in memory, so each server alerts on the tasks it processed.
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+// Alert describes a queue in which the number of archived tasks reached the threshold.
+type Alert struct {
+	// Queue is the name of the queue.
+	Queue string
+
+	// Count is the number of tasks archived within the window.
+	Count int
+
+	// Threshold and Window are the values the Monitor is configured with.
+	Threshold int
+	Window    time.Duration
+
+	// LastErr is the error message of the last archived task.
+	LastErr string
+
+	// Time is the time the alert fired.
+	Time time.Time
+}
+
+func (a *Alert) String() string {
+	return fmt.Sprintf("asynq: %d tasks archived in queue %q within %v (threshold %d); last error: %s",
+		a.Count, a.Queue, a.Window, a.Threshold, a.LastErr)
+}
+
+// Notifier delivers alerts, e.g. to a chat channel or a paging service.
+type Notifier interface {
+	Notify(ctx context.Context, a *Alert) error
+}
+
+// NotifierFunc is an adapter to allow the use of ordinary functions as a Notifier.
+type NotifierFunc func(ctx context.Context, a *Alert) error
+
+// Notify calls fn(ctx, a).
+func (fn NotifierFunc) Notify(ctx context.Context, a *Alert) error {
+	return fn(ctx, a)
+}
+
+// Config specifies the behavior of a Monitor.
+type Config struct {
+	// Threshold is the number of tasks archived within Window for a queue to alert.
+	//
+	// If unset or zero, 1 is used.
+	Threshold int
+
+	// Window is the duration over which archived tasks are counted.
+	// After an alert fires for a queue, no further alert fires for the queue
+	// until Window elapses.
+	//
+	// If unset or zero, 5 minutes is used.
+	Window time.Duration
+
+	// Notifier is called when an alert fires. It is called from a new goroutine,
+	// so that processing of tasks is not blocked by the delivery of the alert.
+	Notifier Notifier
+
+	// NotifyTimeout is the maximum duration of a call to Notifier.
+	//
+	// If unset or zero, 10 seconds is used.
+	NotifyTimeout time.Duration
+
+	// IsFailure should be the same function as the asynq.Config.IsFailure of the server,
+	// since tasks failing with a non-failure error are not archived.
+	//
+	// If unset, every non-nil error is treated as a failure.
+	IsFailure func(error) bool
+
+	// ErrorFunc is called with the error returned by Notifier, if any.
+	ErrorFunc func(a *Alert, err error)
+}
+
+// Monitor counts archived tasks and fires alerts.
+//
+// Monitor implements asynq.ErrorHandler. To use another ErrorHandler together with
+// a Monitor, call HandleError of the Monitor from the other handler.
+type Monitor struct {
+	threshold int
+	window    time.Duration
+	notifier  Notifier
+	timeout   time.Duration
+	isFailure func(error) bool
+	errFunc   func(a *Alert, err error)
+
+	// now returns the current time; replaced in tests.
+	now func() time.Time
+
+	mu     sync.Mutex
+	queues map[string]*queueState
+}
+
+// queueState holds the archived tasks counted for a queue.
+type queueState struct {
+	archived []time.Time // times tasks were archived within the window, in ascending order
+	alerted  time.Time   // time the last alert fired, zero if none
+}
+
+// Make sure Monitor implements asynq.ErrorHandler at compile time.
+var _ asynq.ErrorHandler = (*Monitor)(nil)
+
+// NewMonitor returns a new Monitor with the given config.
+func NewMonitor(cfg Config) *Monitor {
+	if cfg.Notifier == nil {
+		panic("alert.NewMonitor: Notifier cannot be nil")
+	}
+	threshold := cfg.Threshold
+	if threshold < 1 {
+		threshold = 1
+	}
+	window := cfg.Window
+	if window <= 0 {
+		window = 5 * time.Minute
+	}
+	timeout := cfg.NotifyTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	isFailure := cfg.IsFailure
+	if isFailure == nil {
+		isFailure = func(err error) bool { return err != nil }
+	}
+	return &Monitor{
+		threshold: threshold,
+		window:    window,
+		notifier:  cfg.Notifier,
+		timeout:   timeout,
+		isFailure: isFailure,
+		errFunc:   cfg.ErrorFunc,
+		now:       time.Now,
+		queues:    make(map[string]*queueState),
+	}
+}
+
+// HandleError records the task as archived if the error makes the server archive
+// the task, i.e. the task has no retry left or the error wraps asynq.SkipRetry.
+func (m *Monitor) HandleError(ctx context.Context, task *asynq.Task, err error) {
+	if !m.isFailure(err) {
+		return
+	}
+	retried, _ := asynq.GetRetryCount(ctx)
+	maxRetry, _ := asynq.GetMaxRetry(ctx)
+	if retried < maxRetry && !errors.Is(err, asynq.SkipRetry) {
+		return
+	}
+	qname, ok := asynq.GetQueueName(ctx)
+	if !ok {
+		return
+	}
+	if a := m.record(qname, err); a != nil {
+		go m.notify(a)
+	}
+}
+
+// record counts an archived task in the given queue, and returns an alert
+// if one should fire.
+func (m *Monitor) record(qname string, err error) *Alert {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	q, ok := m.queues[qname]
+	if !ok {
+		q = &queueState{}
+		m.queues[qname] = q
+	}
+	cutoff := now.Add(-m.window)
+	i := 0
+	for i < len(q.archived) && !q.archived[i].After(cutoff) {
+		i++
+	}
+	q.archived = append(q.archived[i:], now)
+	if len(q.archived) < m.threshold {
+		return nil
+	}
+	if !q.alerted.IsZero() && now.Sub(q.alerted) < m.window {
+		return nil // already alerted within the window
+	}
+	q.alerted = now
+	return &Alert{
+		Queue:     qname,
+		Count:     len(q.archived),
+		Threshold: m.threshold,
+		Window:    m.window,
+		LastErr:   err.Error(),
+		Time:      now,
+	}
+}
+
+func (m *Monitor) notify(a *Alert) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	if err := m.notifier.Notify(ctx, a); err != nil && m.errFunc != nil {
+		m.errFunc(a, err)
+	}
+}
+
+// SlackNotifier posts alerts to a Slack channel using an incoming webhook.
+type SlackNotifier struct {
+	// WebhookURL is the URL of the incoming webhook.
+	WebhookURL string
+
+	// Client is used to send the requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// Notify posts the alert to the webhook.
+func (n *SlackNotifier) Notify(ctx context.Context, a *Alert) error {
+	body, err := json.Marshal(map[string]string{"text": a.String()})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, n.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	client := n.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("alert: could not post to slack: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("alert: slack webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
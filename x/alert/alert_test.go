@@ -0,0 +1,154 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/hibiken/asynq/internal/base"
+	asynqcontext "github.com/hibiken/asynq/internal/context"
+)
+
+// taskContext returns a context of a task in the given queue, on its last attempt
+// if last is true.
+func taskContext(t *testing.T, qname string, last bool) context.Context {
+	msg := &base.TaskMessage{
+		ID:    "id",
+		Type:  "send_email",
+		Queue: qname,
+		Retry: 3,
+	}
+	if last {
+		msg.Retried = 3
+	}
+	ctx, cancel := asynqcontext.New(context.Background(), msg, time.Now().Add(time.Minute))
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestMonitor(t *testing.T) {
+	alerts := make(chan *Alert, 10)
+	m := NewMonitor(Config{
+		Threshold: 3,
+		Window:    time.Minute,
+		Notifier: NotifierFunc(func(ctx context.Context, a *Alert) error {
+			alerts <- a
+			return nil
+		}),
+		IsFailure: func(err error) bool { return err.Error() != "not a failure" },
+	})
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	failed := errors.New("failed")
+	task := asynq.NewTask("send_email", nil)
+
+	// Tasks that are retried or not failed are not counted.
+	for n := 0; n < 5; n++ {
+		m.HandleError(taskContext(t, "default", false), task, failed)
+		m.HandleError(taskContext(t, "default", true), task, errors.New("not a failure"))
+	}
+	m.HandleError(taskContext(t, "default", true), task, failed)
+	m.HandleError(taskContext(t, "default", false), task, asynq.SkipRetry)
+	m.HandleError(taskContext(t, "critical", true), task, failed)
+	select {
+	case a := <-alerts:
+		t.Fatalf("alert fired below threshold: %v", a)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Tasks archived before the window are not counted.
+	now = now.Add(time.Minute + time.Second)
+	m.HandleError(taskContext(t, "default", true), task, failed)
+	m.HandleError(taskContext(t, "default", true), task, failed)
+	select {
+	case a := <-alerts:
+		t.Fatalf("alert fired below threshold: %v", a)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	m.HandleError(taskContext(t, "default", true), task, errors.New("last error"))
+	select {
+	case a := <-alerts:
+		if a.Queue != "default" || a.Count != 3 || a.Threshold != 3 || a.Window != time.Minute || a.LastErr != "last error" || !a.Time.Equal(now) {
+			t.Errorf("got alert %+v, want alert for 3 tasks in queue default", a)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("alert did not fire")
+	}
+
+	// At most one alert fires per queue within the window.
+	now = now.Add(30 * time.Second)
+	m.HandleError(taskContext(t, "default", true), task, failed)
+	select {
+	case a := <-alerts:
+		t.Fatalf("alert fired again within the window: %v", a)
+	case <-time.After(50 * time.Millisecond):
+	}
+	now = now.Add(31 * time.Second)
+	m.HandleError(taskContext(t, "default", true), task, failed)
+	m.HandleError(taskContext(t, "default", true), task, failed)
+	select {
+	case a := <-alerts:
+		if a.Queue != "default" || a.Count != 3 {
+			t.Errorf("got alert %+v, want alert for 3 tasks in queue default", a)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("alert did not fire after the window")
+	}
+}
+
+func TestMonitorNotifyError(t *testing.T) {
+	errs := make(chan error, 1)
+	m := NewMonitor(Config{
+		Notifier: NotifierFunc(func(ctx context.Context, a *Alert) error {
+			return errors.New("could not deliver")
+		}),
+		ErrorFunc: func(a *Alert, err error) { errs <- err },
+	})
+	m.HandleError(taskContext(t, "default", true), asynq.NewTask("send_email", nil), errors.New("failed"))
+	select {
+	case err := <-errs:
+		if err.Error() != "could not deliver" {
+			t.Errorf("ErrorFunc called with %v, want the error returned by the notifier", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ErrorFunc was not called")
+	}
+}
+
+func TestSlackNotifier(t *testing.T) {
+	var got map[string]string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s request with content type %q, want POST with application/json", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("could not decode request body: %v", err)
+		}
+		if strings.Contains(r.URL.Path, "fail") {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer ts.Close()
+
+	a := &Alert{Queue: "default", Count: 10, Threshold: 10, Window: time.Minute, LastErr: "boom"}
+	n := &SlackNotifier{WebhookURL: ts.URL + "/hook"}
+	if err := n.Notify(context.Background(), a); err != nil {
+		t.Fatalf("Notify returned error: %v", err)
+	}
+	if got["text"] != a.String() {
+		t.Errorf("webhook got text %q, want %q", got["text"], a.String())
+	}
+
+	n = &SlackNotifier{WebhookURL: ts.URL + "/fail"}
+	if err := n.Notify(context.Background(), a); err == nil {
+		t.Errorf("Notify returned nil error for status 403, want non-nil error")
+	}
+}
@@ -76,6 +76,36 @@ var (
 		[]string{"queue"}, nil,
 	)
 
+	tasksUnhandledTotalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "tasks_unhandled_total"),
+		"Number of tasks processed without a handler registered for their type; broken down by queue",
+		[]string{"queue"}, nil,
+	)
+
+	tasksDroppedTotalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "tasks_dropped_total"),
+		"Number of tasks deleted because their data could not be decoded; broken down by queue",
+		[]string{"queue"}, nil,
+	)
+
+	duplicateEnqueuesTotalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "duplicate_enqueues_total"),
+		"Number of enqueues rejected as duplicates; broken down by queue and task type",
+		[]string{"queue", "task_type"}, nil,
+	)
+
+	taskWaitSecondsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "task_wait_seconds"),
+		"Time from successfully processed tasks becoming pending to the start of their processing; broken down by queue and task type",
+		[]string{"queue", "task_type"}, nil,
+	)
+
+	taskRunSecondsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "task_run_seconds"),
+		"Time the handler took to process successfully processed tasks; broken down by queue and task type",
+		[]string{"queue", "task_type"}, nil,
+	)
+
 	pausedQueues = prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, "", "queue_paused_total"),
 		"Number of queues paused",
@@ -135,6 +165,13 @@ func (qmc *QueueMetricsCollector) Collect(ch chan<- prometheus.Metric) {
 			info.Queue,
 			"completed",
 		)
+		ch <- prometheus.MustNewConstMetric(
+			tasksQueuedDesc,
+			prometheus.GaugeValue,
+			float64(info.Unhandled),
+			info.Queue,
+			"unhandled",
+		)
 
 		ch <- prometheus.MustNewConstMetric(
 			queueSizeDesc,
@@ -171,6 +208,29 @@ func (qmc *QueueMetricsCollector) Collect(ch chan<- prometheus.Metric) {
 			info.Queue,
 		)
 
+		ch <- prometheus.MustNewConstMetric(
+			tasksUnhandledTotalDesc,
+			prometheus.CounterValue,
+			float64(info.UnhandledTotal),
+			info.Queue,
+		)
+
+		ch <- prometheus.MustNewConstMetric(
+			tasksDroppedTotalDesc,
+			prometheus.CounterValue,
+			float64(info.DroppedTotal),
+			info.Queue,
+		)
+
+		for typename, n := range info.Duplicates {
+			ch <- prometheus.MustNewConstMetric(
+				duplicateEnqueuesTotalDesc,
+				prometheus.CounterValue,
+				float64(n),
+				info.Queue, typename,
+			)
+		}
+
 		pausedValue := 0 // zero to indicate "not paused"
 		if info.Paused {
 			pausedValue = 1
@@ -181,7 +241,29 @@ func (qmc *QueueMetricsCollector) Collect(ch chan<- prometheus.Metric) {
 			float64(pausedValue),
 			info.Queue,
 		)
+
+		// Latency histograms are recorded only by servers with Config.TrackLatency set.
+		latency, err := qmc.inspector.TaskLatencyStats(info.Queue)
+		if err != nil {
+			log.Printf("Failed to collect latency metrics of queue %q: %v", info.Queue, err)
+			continue
+		}
+		for typename, l := range latency.ByType {
+			ch <- newHistogramMetric(taskWaitSecondsDesc, l.Wait, info.Queue, typename)
+			ch <- newHistogramMetric(taskRunSecondsDesc, l.Run, info.Queue, typename)
+		}
+	}
+}
+
+// newHistogramMetric returns a histogram metric of the given latency histogram.
+func newHistogramMetric(desc *prometheus.Desc, h *asynq.LatencyHistogram, labelValues ...string) prometheus.Metric {
+	buckets := make(map[float64]uint64, len(h.Bounds))
+	var cumulative uint64
+	for i, bound := range h.Bounds {
+		cumulative += uint64(h.Counts[i])
+		buckets[bound.Seconds()] = cumulative
 	}
+	return prometheus.MustNewConstHistogram(desc, uint64(h.Count), h.Sum.Seconds(), buckets, labelValues...)
 }
 
 // NewQueueMetricsCollector returns a collector that exports metrics about Asynq queues.
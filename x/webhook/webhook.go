@@ -0,0 +1,208 @@
+// Package webhook provides an asynq.Handler which delivers HTTP requests, for
+// the common use case of calling a URL later or reliably.
+//
+// The request is described by the payload of the task, created with NewTask:
+//
+//	task, err := webhook.NewTask(webhook.Request{
+//		URL:    "https://example.com/hooks/order",
+//		Method: http.MethodPost,
+//		Header: map[string]string{"Content-Type": "application/json"},
+//		Body:   body,
+//	}, asynq.ProcessIn(time.Hour))
+//
+//	mux.Handle(webhook.TypeName, webhook.NewHandler(webhook.Config{}))
+//
+// The Handler classifies the response status codes: a 2xx response completes the
+// task; a 408, 429 or 5xx response, or a network error, fails the task so that it is
+// retried, honoring the Retry-After header of the response; any other response
+// archives the task without retrying it, since the request would fail again.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+// TypeName is the type name of the tasks created by NewTask.
+const TypeName = "webhook:deliver"
+
+// Request describes the HTTP request to deliver.
+type Request struct {
+	// URL is the URL to send the request to.
+	URL string `json:"url"`
+
+	// Method is the HTTP method of the request.
+	//
+	// If empty, POST is used.
+	Method string `json:"method,omitempty"`
+
+	// Header holds the header fields of the request.
+	Header map[string]string `json:"header,omitempty"`
+
+	// Body is the body of the request.
+	Body []byte `json:"body,omitempty"`
+}
+
+// NewTask returns a new task which delivers the given request when processed
+// by a Handler.
+func NewTask(req Request, opts ...asynq.Option) (*asynq.Task, error) {
+	if req.URL == "" {
+		return nil, errors.New("webhook: URL cannot be empty")
+	}
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	return asynq.NewTask(TypeName, payload, opts...), nil
+}
+
+// StatusError is returned by Handler when the response to the request has a
+// status code which is not 2xx.
+//
+// A StatusError for a status code which is not retried wraps asynq.SkipRetry.
+type StatusError struct {
+	// StatusCode is the status code of the response.
+	StatusCode int
+
+	permanent bool
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("webhook: request returned status %d", e.StatusCode)
+}
+
+func (e *StatusError) Unwrap() error {
+	if e.permanent {
+		return asynq.SkipRetry
+	}
+	return nil
+}
+
+// Config specifies the behavior of a Handler.
+type Config struct {
+	// Client is used to send the requests.
+	//
+	// If nil, http.DefaultClient is used.
+	Client *http.Client
+
+	// Timeout is the maximum duration of a request, which is further limited
+	// by the deadline of the task.
+	//
+	// If unset or zero, 30 seconds is used.
+	Timeout time.Duration
+
+	// IsRetryable reports whether a request whose response has the given
+	// status code should be retried.
+	//
+	// If unset, 408, 429 and 5xx responses are retried.
+	IsRetryable func(statusCode int) bool
+}
+
+// Handler delivers the requests of the tasks created by NewTask.
+//
+// Handler implements asynq.Handler.
+type Handler struct {
+	client      *http.Client
+	timeout     time.Duration
+	isRetryable func(statusCode int) bool
+
+	// now returns the current time; replaced in tests.
+	now func() time.Time
+}
+
+// Make sure Handler implements asynq.Handler at compile time.
+var _ asynq.Handler = (*Handler)(nil)
+
+// NewHandler returns a new Handler with the given config.
+func NewHandler(cfg Config) *Handler {
+	client := cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	isRetryable := cfg.IsRetryable
+	if isRetryable == nil {
+		isRetryable = defaultIsRetryable
+	}
+	return &Handler{
+		client:      client,
+		timeout:     timeout,
+		isRetryable: isRetryable,
+		now:         time.Now,
+	}
+}
+
+func defaultIsRetryable(statusCode int) bool {
+	return statusCode == http.StatusRequestTimeout ||
+		statusCode == http.StatusTooManyRequests ||
+		statusCode >= 500
+}
+
+// ProcessTask delivers the request described by the payload of the task.
+func (h *Handler) ProcessTask(ctx context.Context, task *asynq.Task) error {
+	var r Request
+	if err := json.Unmarshal(task.Payload(), &r); err != nil {
+		return fmt.Errorf("webhook: invalid payload: %v: %w", err, asynq.SkipRetry)
+	}
+	method := r.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequest(method, r.URL, bytes.NewReader(r.Body))
+	if err != nil {
+		return fmt.Errorf("webhook: invalid request: %v: %w", err, asynq.SkipRetry)
+	}
+	for k, v := range r.Header {
+		req.Header.Set(k, v)
+	}
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	resp, err := h.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("webhook: could not send request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	statusErr := &StatusError{StatusCode: resp.StatusCode}
+	if !h.isRetryable(resp.StatusCode) {
+		statusErr.permanent = true
+		return statusErr
+	}
+	if d, ok := h.retryAfter(resp.Header.Get("Retry-After")); ok {
+		return asynq.RetryIn(statusErr, d)
+	}
+	return statusErr
+}
+
+// retryAfter parses the value of a Retry-After header, given either in seconds
+// or as an HTTP date, and returns the delay before the request may be retried.
+func (h *Handler) retryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	d := t.Sub(h.now())
+	if d < 0 {
+		d = 0
+	}
+	return d, true
+}
@@ -0,0 +1,118 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+func TestHandler(t *testing.T) {
+	var (
+		gotMethod, gotHeader, gotBody string
+		status                        int
+		retryAfter                    string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		gotMethod, gotHeader, gotBody = r.Method, r.Header.Get("X-Signature"), string(b)
+		if retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	h := NewHandler(Config{})
+	task, err := NewTask(Request{
+		URL:    ts.URL,
+		Method: http.MethodPut,
+		Header: map[string]string{"X-Signature": "abc"},
+		Body:   []byte(`{"order":1}`),
+	})
+	if err != nil {
+		t.Fatalf("NewTask returned error: %v", err)
+	}
+	if task.Type() != TypeName {
+		t.Errorf("NewTask returned task of type %q, want %q", task.Type(), TypeName)
+	}
+
+	tests := []struct {
+		status     int
+		retryAfter string
+		wantErr    bool
+		wantSkip   bool
+	}{
+		{http.StatusNoContent, "", false, false},
+		{http.StatusServiceUnavailable, "120", true, false},
+		{http.StatusTooManyRequests, "", true, false},
+		{http.StatusNotFound, "", true, true},
+		{http.StatusBadRequest, "", true, true},
+	}
+	for _, tc := range tests {
+		status, retryAfter = tc.status, tc.retryAfter
+		err := h.ProcessTask(context.Background(), task)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("status %d: ProcessTask returned %v, want error %t", tc.status, err, tc.wantErr)
+			continue
+		}
+		if err == nil {
+			continue
+		}
+		var statusErr *StatusError
+		if !errors.As(err, &statusErr) || statusErr.StatusCode != tc.status {
+			t.Errorf("status %d: ProcessTask returned %v, want a StatusError with the status code", tc.status, err)
+		}
+		if got := errors.Is(err, asynq.SkipRetry); got != tc.wantSkip {
+			t.Errorf("status %d: errors.Is(err, SkipRetry) = %t, want %t", tc.status, got, tc.wantSkip)
+		}
+	}
+	if gotMethod != http.MethodPut || gotHeader != "abc" || gotBody != `{"order":1}` {
+		t.Errorf("server received method=%q header=%q body=%q", gotMethod, gotHeader, gotBody)
+	}
+}
+
+func TestHandlerNetworkError(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	ts.Close()
+	task, _ := NewTask(Request{URL: ts.URL})
+	err := NewHandler(Config{}).ProcessTask(context.Background(), task)
+	if err == nil || errors.Is(err, asynq.SkipRetry) {
+		t.Errorf("ProcessTask returned %v, want an error to retry", err)
+	}
+}
+
+func TestHandlerInvalidPayload(t *testing.T) {
+	err := NewHandler(Config{}).ProcessTask(context.Background(), asynq.NewTask(TypeName, []byte("{")))
+	if !errors.Is(err, asynq.SkipRetry) {
+		t.Errorf("ProcessTask returned %v, want an error wrapping SkipRetry", err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+	h := NewHandler(Config{})
+	h.now = func() time.Time { return now }
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"", 0, false},
+		{"30", 30 * time.Second, true},
+		{"Sun, 01 Aug 2021 12:02:00 GMT", 2 * time.Minute, true},
+		{"Sun, 01 Aug 2021 11:00:00 GMT", 0, true},
+		{"soon", 0, false},
+	}
+	for _, tc := range tests {
+		got, ok := h.retryAfter(tc.value)
+		if got != tc.want || ok != tc.wantOK {
+			t.Errorf("retryAfter(%q) = (%v, %t), want (%v, %t)", tc.value, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
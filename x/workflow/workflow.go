@@ -0,0 +1,147 @@
+// Package workflow provides a builder to enqueue chains and fan-out/fan-in graphs of asynq tasks.
+//
+// A workflow is a sequence of stages. Every task in a stage runs only after all
+// tasks in the previous stage have completed successfully:
+//
+//	// a -> b -> c
+//	wf := workflow.Chain(a, b, c)
+//
+//	// a and b run concurrently, c runs after both of them complete.
+//	wf := workflow.Group(a, b).Then(c)
+//
+// Ordering is enforced by the server using the asynq.DependsOn option, so the
+// intermediate state of a workflow lives in Redis: tasks of a stage that is
+// not yet runnable are in the waiting state and can be inspected with
+// asynq.Inspector like any other task.
+//
+// A task can consume the output of the previous stage: the results written by
+// the tasks of the previous stage with their ResultWriter are available to its
+// handler with asynq.GetDependencyResults.
+package workflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/hibiken/asynq"
+)
+
+// Workflow is a sequence of stages of tasks.
+//
+// Workflow is not safe for concurrent modification.
+type Workflow struct {
+	stages [][]*asynq.Task
+}
+
+// Chain returns a workflow which runs the given tasks one after another.
+func Chain(tasks ...*asynq.Task) *Workflow {
+	wf := &Workflow{}
+	for _, t := range tasks {
+		wf.stages = append(wf.stages, []*asynq.Task{t})
+	}
+	return wf
+}
+
+// Group returns a workflow which runs the given tasks concurrently.
+func Group(tasks ...*asynq.Task) *Workflow {
+	return (&Workflow{}).Then(tasks...)
+}
+
+// Then appends a stage to the workflow. The given tasks run concurrently
+// once all tasks in the previous stage have completed.
+//
+// Then returns the receiver so that calls can be chained.
+func (wf *Workflow) Then(tasks ...*asynq.Task) *Workflow {
+	if len(tasks) > 0 {
+		wf.stages = append(wf.stages, tasks)
+	}
+	return wf
+}
+
+// Info describes a workflow enqueued to Redis.
+type Info struct {
+	// Queue is the name of the queue the tasks in the workflow were enqueued to.
+	Queue string
+
+	// Stages holds the IDs of the tasks in each stage, in the order the stages run.
+	Stages [][]string
+}
+
+// ErrEmptyWorkflow indicates that a workflow without any tasks was enqueued.
+var ErrEmptyWorkflow = errors.New("workflow has no tasks")
+
+// Enqueue enqueues all tasks in the workflow using the given client.
+//
+// Options are applied to every task in the workflow and take precedence over
+// the options each task was created with. All tasks must be enqueued to the same
+// queue, and options that cannot be combined with asynq.DependsOn (e.g. Unique,
+// GroupKey, ProcessIn, ProcessAt) are not allowed for tasks in stages other
+// than the first.
+//
+// Stages are enqueued in order. If an error occurs, tasks enqueued before the
+// error are not removed; the returned Info lists the IDs of those tasks.
+func (wf *Workflow) Enqueue(c *asynq.Client, opts ...asynq.Option) (*Info, error) {
+	return wf.EnqueueContext(context.Background(), c, opts...)
+}
+
+// EnqueueContext enqueues all tasks in the workflow using the given client.
+//
+// The provided context can be used to cancel the enqueue operation.
+// See Enqueue for details.
+func (wf *Workflow) EnqueueContext(ctx context.Context, c *asynq.Client, opts ...asynq.Option) (*Info, error) {
+	if len(wf.stages) == 0 {
+		return nil, fmt.Errorf("workflow: %w", ErrEmptyWorkflow)
+	}
+	info := &Info{}
+	var prev []string
+	for _, stage := range wf.stages {
+		var ids []string
+		for _, t := range stage {
+			taskOpts := opts
+			if len(prev) > 0 {
+				taskOpts = append([]asynq.Option{asynq.DependsOn(prev...)}, opts...)
+			}
+			ti, err := c.EnqueueContext(ctx, t, taskOpts...)
+			if err != nil {
+				if len(ids) > 0 {
+					info.Stages = append(info.Stages, ids)
+				}
+				return info, fmt.Errorf("workflow: could not enqueue task %q: %w", t.Type(), err)
+			}
+			ids = append(ids, ti.ID)
+			if info.Queue == "" {
+				info.Queue = ti.Queue
+			} else if info.Queue != ti.Queue {
+				info.Stages = append(info.Stages, ids)
+				return info, fmt.Errorf("workflow: task %q was enqueued to queue %q, want %q", t.Type(), ti.Queue, info.Queue)
+			}
+		}
+		info.Stages = append(info.Stages, ids)
+		prev = ids
+	}
+	return info, nil
+}
+
+// Inspect returns the current state of each task in the enqueued workflow,
+// grouped by stage.
+//
+// A completed task is deleted from Redis unless it was enqueued with the
+// asynq.Retention option; such tasks are reported as nil.
+func Inspect(i *asynq.Inspector, info *Info) ([][]*asynq.TaskInfo, error) {
+	res := make([][]*asynq.TaskInfo, len(info.Stages))
+	for n, ids := range info.Stages {
+		res[n] = make([]*asynq.TaskInfo, len(ids))
+		for k, id := range ids {
+			ti, err := i.GetTaskInfo(info.Queue, id)
+			if errors.Is(err, asynq.ErrTaskNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("workflow: %w", err)
+			}
+			res[n][k] = ti
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,126 @@
+package workflow
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"strings"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/go-cmp/cmp"
+	"github.com/hibiken/asynq"
+)
+
+var (
+	redisAddr string
+	redisDB   int
+
+	useRedisCluster   bool
+	redisClusterAddrs string // comma-separated list of host:port
+)
+
+func init() {
+	flag.StringVar(&redisAddr, "redis_addr", "localhost:6379", "redis address to use in testing")
+	flag.IntVar(&redisDB, "redis_db", 14, "redis db number to use in testing")
+	flag.BoolVar(&useRedisCluster, "redis_cluster", false, "use redis cluster as a broker in testing")
+	flag.StringVar(&redisClusterAddrs, "redis_cluster_addrs", "localhost:7000,localhost:7001,localhost:7002", "comma separated list of redis server addresses")
+}
+
+func TestWorkflowEnqueue(t *testing.T) {
+	connOpt := getRedisConnOpt(t)
+	rc := connOpt.MakeRedisClient().(redis.UniversalClient)
+	defer rc.Close()
+	c := asynq.NewClient(connOpt)
+	defer c.Close()
+	inspector := asynq.NewInspector(connOpt)
+	defer inspector.Close()
+
+	tests := []struct {
+		desc       string
+		wf         *Workflow
+		wantStages []int // number of tasks in each stage
+	}{
+		{
+			desc:       "chain",
+			wf:         Chain(asynq.NewTask("a", nil), asynq.NewTask("b", nil), asynq.NewTask("c", nil)),
+			wantStages: []int{1, 1, 1},
+		},
+		{
+			desc:       "fan-out and fan-in",
+			wf:         Group(asynq.NewTask("a", nil), asynq.NewTask("b", nil)).Then(asynq.NewTask("c", nil)),
+			wantStages: []int{2, 1},
+		},
+	}
+
+	for _, tc := range tests {
+		if err := rc.FlushDB(context.Background()).Err(); err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := tc.wf.Enqueue(c, asynq.Queue("workflow"))
+		if err != nil {
+			t.Errorf("%s; Enqueue returned error: %v", tc.desc, err)
+			continue
+		}
+		var gotStages []int
+		for _, ids := range info.Stages {
+			gotStages = append(gotStages, len(ids))
+		}
+		if diff := cmp.Diff(tc.wantStages, gotStages); diff != "" {
+			t.Errorf("%s; stages mismatch (-want,+got)\n%s", tc.desc, diff)
+			continue
+		}
+
+		tasks, err := Inspect(inspector, info)
+		if err != nil {
+			t.Errorf("%s; Inspect returned error: %v", tc.desc, err)
+			continue
+		}
+		for n, stage := range tasks {
+			for _, ti := range stage {
+				if ti.Queue != "workflow" {
+					t.Errorf("%s; task %q in queue %q, want %q", tc.desc, ti.ID, ti.Queue, "workflow")
+				}
+				if n == 0 {
+					if ti.State != asynq.TaskStatePending {
+						t.Errorf("%s; task %q in first stage has state %v, want %v", tc.desc, ti.ID, ti.State, asynq.TaskStatePending)
+					}
+					continue
+				}
+				if ti.State != asynq.TaskStateWaiting {
+					t.Errorf("%s; task %q in stage %d has state %v, want %v", tc.desc, ti.ID, n, ti.State, asynq.TaskStateWaiting)
+				}
+				if diff := cmp.Diff(info.Stages[n-1], ti.Dependencies); diff != "" {
+					t.Errorf("%s; dependencies of task %q mismatch (-want,+got)\n%s", tc.desc, ti.ID, diff)
+				}
+			}
+		}
+	}
+}
+
+func TestWorkflowEnqueueEmpty(t *testing.T) {
+	c := asynq.NewClient(getRedisConnOpt(t))
+	defer c.Close()
+
+	if _, err := Chain().Enqueue(c); !errors.Is(err, ErrEmptyWorkflow) {
+		t.Errorf("Enqueue returned %v, want error wrapping %v", err, ErrEmptyWorkflow)
+	}
+}
+
+func getRedisConnOpt(tb testing.TB) asynq.RedisConnOpt {
+	tb.Helper()
+	if useRedisCluster {
+		addrs := strings.Split(redisClusterAddrs, ",")
+		if len(addrs) == 0 {
+			tb.Fatal("No redis cluster addresses provided. Please set addresses using --redis_cluster_addrs flag.")
+		}
+		return asynq.RedisClusterClientOpt{
+			Addrs: addrs,
+		}
+	}
+	return asynq.RedisClientOpt{
+		Addr: redisAddr,
+		DB:   redisDB,
+	}
+}